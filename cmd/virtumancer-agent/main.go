@@ -0,0 +1,60 @@
+// Command virtumancer-agent runs on a hypervisor that the Virtumancer server
+// cannot reach directly. It dials out to the server and serves libvirt RPC
+// and console connections over the resulting reverse tunnel.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/agent"
+)
+
+func main() {
+	server := flag.String("server", "", "Virtumancer agent endpoint, e.g. wss://virtumancer.example.com:8888/api/v1/agent/connect")
+	hostID := flag.String("host", "", "ID of this host in Virtumancer")
+	token := flag.String("token", os.Getenv("VIRTUMANCER_AGENT_TOKEN"), "agent token issued when the host was added (or $VIRTUMANCER_AGENT_TOKEN)")
+	socket := flag.String("socket", "/var/run/libvirt/libvirt-sock", "local libvirt daemon socket")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification of the server")
+	flag.Parse()
+
+	if *server == "" || *hostID == "" || *token == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dial := func(target string) (net.Conn, error) {
+		switch {
+		case target == agent.TargetLibvirt:
+			return net.Dial("unix", *socket)
+		case strings.HasPrefix(target, agent.TargetTCPPrefix):
+			return net.DialTimeout("tcp", strings.TrimPrefix(target, agent.TargetTCPPrefix), 10*time.Second)
+		default:
+			return nil, fmt.Errorf("unsupported target %q", target)
+		}
+	}
+
+	// Reconnect forever with capped exponential backoff.
+	backoff := time.Second
+	for {
+		session, err := agent.Dial(*server, *hostID, *token, *insecure, dial)
+		if err != nil {
+			log.Printf("Could not connect to Virtumancer: %v (retrying in %s)", err, backoff)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+
+		log.Printf("Connected to %s as host %s", *server, *hostID)
+		backoff = time.Second
+		if err := session.Serve(); err != nil {
+			log.Printf("Tunnel closed: %v", err)
+		}
+		time.Sleep(backoff)
+	}
+}
@@ -0,0 +1,332 @@
+// Package agent implements the reverse tunnel used by hosts that cannot be
+// dialled by the Virtumancer server (e.g. behind NAT). The remote host runs
+// an agent that opens an outbound WebSocket to the server; both ends then
+// multiplex independent byte streams (libvirt RPC, console traffic) over it.
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frame types. Every WebSocket binary message carries exactly one frame:
+// a 4-byte big-endian stream ID, a 1-byte type and the payload.
+const (
+	frameOpen  byte = 1 // payload is the target to dial
+	frameData  byte = 2 // payload is stream data
+	frameClose byte = 3 // payload is an optional error message
+)
+
+const frameHeaderLen = 5
+
+// Targets that can be requested when opening a stream.
+const (
+	TargetLibvirt   = "libvirt" // the host's local libvirt daemon socket
+	TargetTCPPrefix = "tcp:"    // followed by host:port, e.g. a VNC listener
+)
+
+// ErrSessionClosed is returned when using a session whose tunnel has gone away.
+var ErrSessionClosed = errors.New("agent session closed")
+
+// DialFunc is used by the accepting end of a stream to reach its target.
+type DialFunc func(target string) (net.Conn, error)
+
+// Session multiplexes streams over a single WebSocket connection.
+type Session struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+
+	// dial handles open requests from the peer. The server leaves it nil and
+	// rejects them; the agent sets it to reach local services.
+	dial DialFunc
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewSession wraps an established WebSocket. Stream IDs opened locally are
+// odd on the server and even on the agent so the two ends never collide.
+func NewSession(conn *websocket.Conn, isServer bool, dial DialFunc) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		dial:    dial,
+		done:    make(chan struct{}),
+	}
+	if isServer {
+		s.nextID = 1
+	} else {
+		s.nextID = 2
+	}
+	return s
+}
+
+// Done is closed when the session terminates.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Open starts a new stream to the given target on the peer.
+func (s *Session) Open(target string) (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id, target)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(id, frameOpen, []byte(target)); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Serve reads frames until the connection fails or Close is called. It must
+// be running for streams to receive data.
+func (s *Session) Serve() error {
+	defer s.Close()
+	for {
+		mt, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if mt != websocket.BinaryMessage || len(data) < frameHeaderLen {
+			continue
+		}
+		id := binary.BigEndian.Uint32(data[:4])
+		payload := data[frameHeaderLen:]
+
+		switch data[4] {
+		case frameOpen:
+			s.acceptStream(id, string(payload))
+		case frameData:
+			if stream := s.getStream(id); stream != nil {
+				stream.deliver(payload)
+			}
+		case frameClose:
+			if stream := s.getStream(id); stream != nil {
+				if len(payload) > 0 {
+					log.Printf("Agent stream %d (%s) closed by peer: %s", id, stream.target, payload)
+				}
+				stream.closeLocal()
+				s.removeStream(id)
+			}
+		}
+	}
+}
+
+// Close tears down the tunnel and all of its streams.
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, stream := range streams {
+			stream.closeLocal()
+		}
+	})
+	return err
+}
+
+func (s *Session) acceptStream(id uint32, target string) {
+	if s.dial == nil {
+		s.writeFrame(id, frameClose, []byte("opening streams is not permitted on this end"))
+		return
+	}
+
+	stream := newStream(s, id, target)
+	s.mu.Lock()
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	// Dial outside the read loop; data frames that arrive meanwhile are
+	// buffered on the stream.
+	go func() {
+		conn, err := s.dial(target)
+		if err != nil {
+			s.writeFrame(id, frameClose, []byte(err.Error()))
+			stream.closeLocal()
+			s.removeStream(id)
+			return
+		}
+		Pipe(stream, conn)
+	}()
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(id uint32, frameType byte, payload []byte) error {
+	frame := make([]byte, frameHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], id)
+	frame[4] = frameType
+	copy(frame[frameHeaderLen:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return ErrSessionClosed
+	default:
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// Pipe copies data in both directions between two connections and closes
+// both once either side is done.
+func Pipe(a, b io.ReadWriteCloser) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closeBoth)
+	}()
+	wg.Wait()
+}
+
+// Stream is one multiplexed connection. It implements net.Conn.
+type Stream struct {
+	session *Session
+	id      uint32
+	target  string
+
+	incoming chan []byte
+	pending  []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// streamBuffer is the number of frames buffered per stream before the
+// session read loop blocks on a slow consumer.
+const streamBuffer = 64
+
+func newStream(session *Session, id uint32, target string) *Stream {
+	return &Stream{
+		session:  session,
+		id:       id,
+		target:   target,
+		incoming: make(chan []byte, streamBuffer),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (st *Stream) deliver(data []byte) {
+	select {
+	case st.incoming <- data:
+	case <-st.closed:
+	}
+}
+
+// Read implements io.Reader.
+func (st *Stream) Read(p []byte) (int, error) {
+	if len(st.pending) == 0 {
+		select {
+		case data := <-st.incoming:
+			st.pending = data
+		case <-st.closed:
+			// Drain anything that arrived before the close.
+			select {
+			case data := <-st.incoming:
+				st.pending = data
+			default:
+				return 0, io.EOF
+			}
+		}
+	}
+	n := copy(p, st.pending)
+	st.pending = st.pending[n:]
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (st *Stream) Write(p []byte) (int, error) {
+	select {
+	case <-st.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	if err := st.session.writeFrame(st.id, frameData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the stream and notifies the peer.
+func (st *Stream) Close() error {
+	alreadyClosed := true
+	st.closeOnce.Do(func() {
+		alreadyClosed = false
+		close(st.closed)
+	})
+	if alreadyClosed {
+		return nil
+	}
+	st.session.removeStream(st.id)
+	if err := st.session.writeFrame(st.id, frameClose, nil); err != nil && !errors.Is(err, ErrSessionClosed) {
+		return fmt.Errorf("failed to close agent stream %d: %w", st.id, err)
+	}
+	return nil
+}
+
+// closeLocal marks the stream closed without notifying the peer.
+func (st *Stream) closeLocal() {
+	st.closeOnce.Do(func() { close(st.closed) })
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return streamAddr(fmt.Sprintf("agent-stream-%d", st.id)) }
+func (st *Stream) RemoteAddr() net.Addr { return streamAddr(st.target) }
+
+// Deadlines are not supported on tunnelled streams.
+func (st *Stream) SetDeadline(time.Time) error      { return nil }
+func (st *Stream) SetReadDeadline(time.Time) error  { return nil }
+func (st *Stream) SetWriteDeadline(time.Time) error { return nil }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "agent" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pingInterval keeps NAT mappings and proxies from expiring idle tunnels.
+const pingInterval = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	// Agents are not browsers; authentication is done with the host token.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Accept upgrades an incoming agent request to a server-side session.
+func Accept(w http.ResponseWriter, r *http.Request) (*Session, error) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade agent connection: %w", err)
+	}
+	session := NewSession(conn, true, nil)
+	go session.keepAlive()
+	return session, nil
+}
+
+// Dial connects an agent to the server and returns the agent-side session.
+// Open requests from the server are served with dial.
+func Dial(url, hostID, token string, insecureTLS bool, dial DialFunc) (*Session, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 15 * time.Second,
+		ReadBufferSize:   32 * 1024,
+		WriteBufferSize:  32 * 1024,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: insecureTLS},
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("X-Virtumancer-Host", hostID)
+
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w (HTTP %d)", url, err, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", url, err)
+	}
+	session := NewSession(conn, false, dial)
+	go session.keepAlive()
+	return session, nil
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
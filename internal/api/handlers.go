@@ -1,9 +1,28 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/capsali/virtumancer-flash/internal/agent"
 	"github.com/capsali/virtumancer-flash/internal/console"
 	"github.com/capsali/virtumancer-flash/internal/libvirt"
 	"github.com/capsali/virtumancer-flash/internal/services"
@@ -29,8 +48,153 @@ func NewAPIHandler(hostService services.HostServiceProvider, hub *ws.Hub, db *go
 	}
 }
 
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error   string                `json:"error"`
+	Libvirt *libvirt.ErrorInfo    `json:"libvirt,omitempty"` // Set when the error came from a libvirt daemon
+	Fields  []services.FieldError `json:"fields,omitempty"`  // Set for 422 responses to invalid requests
+}
+
+// libvirtErrorStatuses maps kinds of libvirt errors to HTTP statuses.
+var libvirtErrorStatuses = map[string]int{
+	libvirt.ErrorKindNotFound:     http.StatusNotFound,
+	libvirt.ErrorKindInvalidState: http.StatusConflict,
+	libvirt.ErrorKindExists:       http.StatusConflict,
+	libvirt.ErrorKindDenied:       http.StatusForbidden,
+	libvirt.ErrorKindInvalid:      http.StatusBadRequest,
+	libvirt.ErrorKindUnsupported:  http.StatusNotImplemented,
+	libvirt.ErrorKindTimeout:      http.StatusGatewayTimeout,
+}
+
+// writeError sends an error in the JSON error envelope. Errors from libvirt
+// carry its error number, and a 500 status is replaced by one matching the
+// libvirt error, e.g. 409 for starting a domain that is already running.
+// Validation errors are always sent as 422 with the fields at fault, and
+// operations on a host whose circuit breaker is open as 503.
+func writeError(w http.ResponseWriter, err error, status int) {
+	body := errorResponse{Error: err.Error(), Libvirt: libvirt.ErrorDetails(err)}
+	var validationErr *services.ValidationError
+	if errors.As(err, &validationErr) {
+		body.Fields = validationErr.Fields
+		status = http.StatusUnprocessableEntity
+	}
+	if status == http.StatusInternalServerError && errors.Is(err, libvirt.ErrHostUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(libvirt.BreakerProbeInterval.Seconds())))
+		status = http.StatusServiceUnavailable
+	}
+	if body.Libvirt != nil && status == http.StatusInternalServerError {
+		if mapped, ok := libvirtErrorStatuses[body.Libvirt.Kind]; ok {
+			status = mapped
+		}
+	}
+	writeErrorResponse(w, body, status)
+}
+
+// writeErrorMessage sends a message in the JSON error envelope.
+func writeErrorMessage(w http.ResponseWriter, message string, status int) {
+	writeErrorResponse(w, errorResponse{Error: message}, status)
+}
+
+func writeErrorResponse(w http.ResponseWriter, body errorResponse, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// hostParam returns the ID of the host in the request path, which older
+// clients give by name.
+func (h *APIHandler) hostParam(r *http.Request) string {
+	return h.HostService.ResolveHostID(chi.URLParam(r, "hostID"))
+}
+
+// decodeJSON reads a JSON request body into v. Malformed JSON is answered
+// with 400, and a value of the wrong type with 422 naming the field. It
+// reports whether the handler can go on.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		writeError(w, &services.ValidationError{Fields: []services.FieldError{{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be a %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value),
+		}}}, http.StatusUnprocessableEntity)
+		return false
+	}
+	writeErrorMessage(w, "Invalid request body", http.StatusBadRequest)
+	return false
+}
+
+// jsonTypeName names a Go type the way a JSON client knows it.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// ValidatePathNames refuses requests whose host ID or VM name path parameter
+// can never name a host or VM, before any handler looks them up. It runs
+// before routing, so it reads the parameters off the path itself.
+func (h *APIHandler) ValidatePathNames(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(r.URL.EscapedPath(), "/")
+		var problems []services.FieldError
+		for i := 0; i+1 < len(segments); i++ {
+			if segments[i+1] == "" && i+2 == len(segments) {
+				break // Trailing slash of a collection
+			}
+			var validate func(field, value string) error
+			var field string
+			switch segments[i] {
+			case "hosts":
+				validate, field = services.ValidateHostID, "hostID"
+			case "vms":
+				validate, field = services.ValidateVMName, "vmName"
+			default:
+				continue
+			}
+			value, err := url.PathUnescape(segments[i+1])
+			if err != nil {
+				writeErrorMessage(w, "Invalid path", http.StatusBadRequest)
+				return
+			}
+			var validationErr *services.ValidationError
+			if errors.As(validate(field, value), &validationErr) {
+				problems = append(problems, validationErr.Fields...)
+			}
+			i++
+		}
+		if len(problems) > 0 {
+			writeError(w, &services.ValidationError{Fields: problems}, http.StatusUnprocessableEntity)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleWebSocket connects a client to the hub. Connections with a session
+// also receive the notifications of their user, and project-scoped users
+// only the broadcasts about their projects' hosts and VMs.
 func (h *APIHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	ws.ServeWs(h.Hub, h.HostService, w, r)
+	var userID uint
+	if user := h.sessionUser(r); user != nil {
+		userID = user.ID
+	}
+	ws.ServeWs(h.Hub, h.HostService, userID, h.HostService.BroadcastFilter(projectScope(r)), w, r)
 }
 
 func (h *APIHandler) HandleVMConsole(w http.ResponseWriter, r *http.Request) {
@@ -41,151 +205,5338 @@ func (h *APIHandler) HandleSpiceConsole(w http.ResponseWriter, r *http.Request)
 	console.HandleSpiceConsole(h.DB, h.Connector, w, r)
 }
 
-func (h *APIHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+// GetConsoleSessions lists the open console sessions and their traffic.
+func (h *APIHandler) GetConsoleSessions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	json.NewEncoder(w).Encode(console.Sessions())
 }
 
-func (h *APIHandler) CreateHost(w http.ResponseWriter, r *http.Request) {
-	var host storage.Host
-	if err := json.NewDecoder(r.Body).Decode(&host); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+func (h *APIHandler) GetConsoleSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.GetConsoleSettings())
+}
+
+func (h *APIHandler) SetConsoleSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PingIntervalSeconds uint `json:"ping_interval_seconds"`
+		IdleTimeoutSeconds  uint `json:"idle_timeout_seconds"`
+	}
+	if !decodeJSON(w, r, &req) {
 		return
 	}
-	newHost, err := h.HostService.AddHost(host)
+	settings, err := h.HostService.SetConsoleSettings(req.PingIntervalSeconds, req.IdleTimeoutSeconds)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidConsoleSettings) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(newHost)
+	json.NewEncoder(w).Encode(settings)
 }
 
-func (h *APIHandler) GetHosts(w http.ResponseWriter, r *http.Request) {
-	hosts, err := h.HostService.GetAllHosts()
+// GetVMDisplays lists the VM's graphics devices so a client can pick one
+// with the consoles' display query parameter.
+func (h *APIHandler) GetVMDisplays(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	displays, err := console.ListDisplays(h.Connector, hostID, vmName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(hosts)
+	json.NewEncoder(w).Encode(displays)
 }
 
-func (h *APIHandler) GetHostInfo(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
-	info, err := h.HostService.GetHostInfo(hostID)
+// GetConsoleInfo returns connection details and a one-time ticket for a
+// native console client, as JSON or, with format=vv, as a virt-viewer file.
+func (h *APIHandler) GetConsoleInfo(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	index := -1
+	if value := r.URL.Query().Get("display"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeErrorMessage(w, fmt.Sprintf("invalid display %q", value), http.StatusBadRequest)
+			return
+		}
+		index = n
+	}
+	serverHost := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		serverHost = host
+	}
+
+	info, err := h.HostService.GetConsoleInfo(hostID, vmName, index, serverHost)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrConsoleUnavailable), errors.Is(err, services.ErrConsoleNotReachable):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "vv" {
+		w.Header().Set("Content-Type", "application/x-virt-viewer")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", vmName+".vv"))
+		io.WriteString(w, info.VirtViewerFile())
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(info)
 }
 
-func (h *APIHandler) DeleteHost(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
-	if err := h.HostService.RemoveHost(hostID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// HandleAgentConnect accepts the reverse tunnel of an agent-transport host.
+func (h *APIHandler) HandleAgentConnect(w http.ResponseWriter, r *http.Request) {
+	hostID := h.HostService.ResolveHostID(r.Header.Get("X-Virtumancer-Host"))
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err := h.HostService.AuthenticateAgent(hostID, token); err != nil {
+		writeError(w, err, http.StatusUnauthorized)
+		return
+	}
+	session, err := agent.Accept(w, r)
+	if err != nil {
+		log.Printf("Agent connection for host %s failed: %v", hostID, err)
+		return
+	}
+	h.HostService.RunAgentSession(hostID, session)
+}
+
+// --- Authentication ---
+
+// sessionCookie carries the session token for browsers; API clients can
+// send it as a bearer token instead.
+const sessionCookie = "virtumancer_session"
+
+type sessionContextKey struct{}
+
+// requestSession is the logged-in user of a request.
+type requestSession struct {
+	User    *storage.User
+	Session *storage.UserSession
+}
+
+func sessionToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RequireSession rejects requests without a valid session and makes the
+// logged-in user available to the handlers.
+func (h *APIHandler) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, session, err := h.HostService.AuthenticateSession(sessionToken(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, services.ErrUnauthenticated) {
+				status = http.StatusUnauthorized
+			}
+			writeError(w, err, status)
+			return
+		}
+		if !passwordChangeAllows(w, r, user) {
+			return
+		}
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, &requestSession{User: user, Session: session})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// passwordChangeRoute reports whether a route stays open to users who must
+// change their password: enough to see the account, change the password and
+// log out.
+func passwordChangeRoute(segments []string) bool {
+	route := strings.Join(segments, "/")
+	return route == "me" || route == "me/password" || route == "auth/logout"
+}
+
+// passwordChangeAllows refuses with 403 the requests of a user who must
+// change their password, except on the routes that let them do so. It
+// reports whether the request may go on.
+func passwordChangeAllows(w http.ResponseWriter, r *http.Request, user *storage.User) bool {
+	if !user.MustChangePassword {
+		return true
+	}
+	if segments, err := apiPathSegments(r); err == nil && passwordChangeRoute(segments) {
+		return true
+	}
+	writeError(w, services.ErrPasswordChangeRequired, http.StatusForbidden)
+	return false
+}
+
+func currentSession(r *http.Request) *requestSession {
+	return r.Context().Value(sessionContextKey{}).(*requestSession)
+}
+
+// RequirePermission rejects requests of users whose role lacks an action.
+// It must run after RequireSession.
+func (h *APIHandler) RequirePermission(action string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, err := h.HostService.UserHasPermission(currentSession(r).User, action)
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				writeError(w, services.ErrForbidden, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sessionUser returns the logged-in user, or nil without a valid session.
+// Unlike currentSession, it works on routes that do not require a session.
+func (h *APIHandler) sessionUser(r *http.Request) *storage.User {
+	if session, ok := r.Context().Value(sessionContextKey{}).(*requestSession); ok {
+		return session.User
+	}
+	user, _, err := h.HostService.AuthenticateSession(sessionToken(r))
+	if err != nil {
+		return nil
+	}
+	return user
+}
+
+// RequireFeature rejects requests while a feature flag is off, or not on for
+// the user's role.
+func (h *APIHandler) RequireFeature(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := h.HostService.CheckFeature(name, h.sessionUser(r)); err != nil {
+				writeError(w, err, featureErrorStatus(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// --- Idempotency ---
+
+// maxIdempotentRequestSize limits the body of requests with an
+// Idempotency-Key, which is read in full to fingerprint the request.
+const maxIdempotentRequestSize = 1 << 20
+
+// recordingWriter keeps a copy of a response so it can be replayed.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Idempotency makes POST requests with an Idempotency-Key header safe to
+// retry: the first request with a key runs, later ones with the same key and
+// request get its response replayed. Keys belong to the user of the session,
+// so a replay needs that user's session, and the middleware must come after
+// ScopeProjects so project access is checked before anything is replayed.
+// Responses that set cookies carry credentials and are not kept.
+func (h *APIHandler) Idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > services.MaxIdempotencyKeyLength {
+			writeErrorMessage(w, fmt.Sprintf("Idempotency-Key must be at most %d characters", services.MaxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentRequestSize))
+		if err != nil {
+			writeErrorMessage(w, "Request body too large for an idempotent request", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var userID uint
+		if user := h.sessionUser(r); user != nil {
+			userID = user.ID
+		}
+		hash := sha256.New()
+		fmt.Fprintf(hash, "user %d\n%s %s?%s\n", userID, r.Method, r.URL.Path, r.URL.RawQuery)
+		hash.Write(body)
+
+		record, err := h.HostService.BeginIdempotentRequest(userID, key, hex.EncodeToString(hash.Sum(nil)))
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, services.ErrIdempotencyKeyReused):
+				status = http.StatusUnprocessableEntity
+			case errors.Is(err, services.ErrIdempotencyKeyInProgress):
+				status = http.StatusConflict
+			}
+			writeError(w, err, status)
+			return
+		}
+		if record.StatusCode != 0 {
+			if record.ContentType != "" {
+				w.Header().Set("Content-Type", record.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Body)
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		completed := false
+		// Give the key back if the handler panics, so a retry is not stuck
+		// behind a request that never finishes.
+		defer func() {
+			if !completed {
+				h.HostService.ReleaseIdempotencyKey(record.ID)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+
+		if recorder.Header().Get("Set-Cookie") != "" {
+			return
+		}
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		err = h.HostService.CompleteIdempotentRequest(record.ID, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes())
+		if err != nil {
+			log.Printf("Warning: failed to store response for idempotency key %s: %v", key, err)
+			return
+		}
+		completed = true
+	})
+}
+
+// --- VM Versions ---
+
+// statusWriter remembers the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// RequireVMVersion guards an edit of a VM's specification with the VM's
+// version, its generation, given in an If-Match header, e.g. If-Match: "7".
+// An edit without one is refused with 428, one based on an outdated version
+// with 409, so concurrent edits cannot overwrite each other unnoticed.
+func (h *APIHandler) RequireVMVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			writeErrorMessage(w, "If-Match with the VM's generation is required to edit it", http.StatusPreconditionRequired)
+			return
+		}
+		version, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`), 10, 64)
+		if err != nil {
+			writeErrorMessage(w, "If-Match must be the VM's generation, e.g. \"7\"", http.StatusBadRequest)
+			return
+		}
+		finish, err := h.HostService.BeginVMSpecEdit(h.hostParam(r), chi.URLParam(r, "vmName"), version)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, services.ErrVersionConflict):
+				status = http.StatusConflict
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				status = http.StatusNotFound
+			}
+			writeError(w, err, status)
+			return
+		}
+		recorder := &statusWriter{ResponseWriter: w}
+		applied := false
+		defer func() { finish(applied) }()
+		next.ServeHTTP(recorder, r)
+		applied = recorder.status == 0 || recorder.status < 300
+	})
+}
+
+// --- ETags ---
+
+// ETag serves conditional GETs of a resource whose tag the given function
+// computes cheaply, typically from generation counters, before the handler
+// runs. A request whose If-None-Match holds the current tag is answered with
+// 304 Not Modified without calling the handler; other responses carry the
+// tag in an ETag header. The tag also covers the query and the projects the
+// user may see. Tags are weak, as values computed at request time, such as
+// uptimes, are not part of them. An empty tag or an error skips the check.
+func (h *APIHandler) ETag(tag func(r *http.Request) (string, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			value, err := tag(r)
+			if err != nil || value == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sum := sha256.Sum256([]byte(value + "\x00" + r.URL.RawQuery + "\x00" + projectScope(r).String()))
+			etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Cache-Control", "private, no-cache")
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// A change while the handler runs makes the response newer
+			// than its tag, which only costs the client a refetch.
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// etagMatches compares an If-None-Match header with a tag the weak way,
+// ignoring W/ prefixes.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// HostsTag, VMsTag, HostVMsTag and VMHardwareTag are the tags of the lists
+// served with ETags.
+func (h *APIHandler) HostsTag(r *http.Request) (string, error) {
+	return h.HostService.HostInventoryTag()
+}
+
+func (h *APIHandler) VMsTag(r *http.Request) (string, error) {
+	return h.HostService.VMInventoryTag("")
+}
+
+func (h *APIHandler) HostVMsTag(r *http.Request) (string, error) {
+	if query := r.URL.Query(); query.Has("limit") || query.Has("continue") {
+		return "", nil // Pages are read live from libvirt
+	}
+	return h.HostService.VMInventoryTag(h.hostParam(r))
+}
+
+func (h *APIHandler) VMHardwareTag(r *http.Request) (string, error) {
+	return h.HostService.VMHardwareTag(h.hostParam(r), chi.URLParam(r, "vmName"))
+}
+
+func (h *APIHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.Login(req.Username, req.Password, clientIP(r), r.UserAgent())
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			status = http.StatusUnauthorized
+		case errors.Is(err, services.ErrAccountDisabled):
+			status = http.StatusForbidden
+		case errors.Is(err, services.ErrAccountLocked):
+			status = http.StatusLocked
+		}
+		writeError(w, err, status)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    result.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *APIHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.Logout(sessionToken(r)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrUnauthenticated) {
+			status = http.StatusUnauthorized
+		}
+		writeError(w, err, status)
 		return
 	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// ListVMsFromLibvirt gets the unified view of VMs for a host.
-func (h *APIHandler) ListVMsFromLibvirt(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+// --- Current User ---
 
-	// Immediately get VMs from the DB for a fast response.
-	vms, err := h.HostService.GetVMsForHostFromDB(hostID)
+func (h *APIHandler) GetMe(w http.ResponseWriter, r *http.Request) {
+	profile, err := h.HostService.GetUserProfile(currentSession(r).User.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
 
-	// In the background, trigger a sync from libvirt.
-	// The service will broadcast a websocket update when it's done.
-	go h.HostService.SyncVMsForHost(hostID)
+func (h *APIHandler) ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	session := currentSession(r)
+	if err := h.HostService.ChangePassword(session.User.ID, session.Session.ID, req.CurrentPassword, req.NewPassword, clientIP(r), r.UserAgent()); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidCredentials):
+			status = http.StatusForbidden
+		case errors.Is(err, services.ErrAccountLocked):
+			status = http.StatusLocked
+		case errors.Is(err, services.ErrWeakPassword):
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
+func (h *APIHandler) GetMySessions(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	sessions, err := h.HostService.ListUserSessions(session.User.ID, session.Session.ID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(vms)
+	json.NewEncoder(w).Encode(sessions)
 }
 
-func (h *APIHandler) GetVMStats(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
-	vmName := chi.URLParam(r, "vmName")
-	stats, err := h.HostService.GetVMStats(hostID, vmName)
+func (h *APIHandler) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "sessionID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.RevokeUserSession(currentSession(r).User.ID, uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeMyOtherSessions logs the user out everywhere but in the current session.
+func (h *APIHandler) RevokeMyOtherSessions(w http.ResponseWriter, r *http.Request) {
+	session := currentSession(r)
+	revoked, err := h.HostService.RevokeOtherUserSessions(session.User.ID, session.Session.ID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(map[string]int64{"revoked": revoked})
 }
 
-func (h *APIHandler) GetVMHardware(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
-	vmName := chi.URLParam(r, "vmName")
-	hardware, err := h.HostService.GetVMHardwareAndTriggerSync(hostID, vmName)
+// --- User Management ---
+
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrInvalidUser), errors.Is(err, services.ErrWeakPassword):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrUserExists), errors.Is(err, services.ErrEmailDisabled):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrSelfManagement):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func parseUserID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func writeUser(w http.ResponseWriter, user *services.UserView, err error) {
 	if err != nil {
-		// Even if there's an error (e.g., no cache yet), we might still proceed
-		// if we want to allow the background sync to populate it.
-		// For now, we'll return an error if the initial fetch fails.
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err, userErrorStatus(err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(hardware)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (h *APIHandler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.HostService.ListRoles()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+func (h *APIHandler) GetUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := h.HostService.ListUsers()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *APIHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.HostService.GetUser(id)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
+	var req services.UserRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.HostService.CreateUser(currentSession(r).User.ID, req)
+	if err != nil {
+		writeError(w, err, userErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+func (h *APIHandler) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.HostService.SetUserRole(currentSession(r).User.ID, id, req.Role)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) DisableUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.HostService.SetUserDisabled(currentSession(r).User.ID, id, true)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) EnableUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.HostService.SetUserDisabled(currentSession(r).User.ID, id, false)
+	writeUser(w, user, err)
+}
+
+// ResetUserPassword sets a temporary password the user must change at the
+// next login.
+func (h *APIHandler) ResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+		Email    bool   `json:"email"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.HostService.ResetUserPassword(currentSession(r).User.ID, id, req.Password, req.Email)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) SetUserEmail(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Email string `json:"email"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	user, err := h.HostService.SetUserEmail(currentSession(r).User.ID, id, req.Email)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	user, err := h.HostService.UnlockUser(currentSession(r).User.ID, id)
+	writeUser(w, user, err)
+}
+
+func (h *APIHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.HostService.DeleteUser(currentSession(r).User.ID, id); err != nil {
+		writeError(w, err, userErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Projects ---
+
+type projectScopeContextKey struct{}
+
+// projectScope returns the project scope of a request, or nil when the
+// request is not restricted to any projects.
+func projectScope(r *http.Request) *services.ProjectScope {
+	scope, _ := r.Context().Value(projectScopeContextKey{}).(*services.ProjectScope)
+	return scope
+}
+
+// projectAccess is what a project-scoped user needs for a request.
+type projectAccess struct {
+	open        bool   // Any logged-in user; the handler filters or checks itself
+	hostVisible bool   // The host must be visible; the handler filters the list
+	kind        string // Otherwise a role in the project of this resource
+	host        string
+	key         string
+	role        string
+}
+
+// Console routes hand out access to the guest, so they need an operator
+// even though they are reads.
+var consoleRoutes = []string{"console", "spice", "console-info", "graphics-password"}
+
+// projectAccessFor maps a request to what a project-scoped user needs for
+// it. Routes it does not know are only open to unrestricted users.
+func projectAccessFor(method string, segments []string) (projectAccess, bool) {
+	read := method == http.MethodGet
+	switch {
+	case len(segments) == 0:
+		return projectAccess{}, false
+	case segments[0] == "me" || segments[0] == "projects" || segments[0] == "notifications" || segments[0] == "ws":
+		return projectAccess{open: true}, true
+	case read && len(segments) == 1 && (segments[0] == "hosts" || segments[0] == "vms"):
+		return projectAccess{open: true}, true
+	case read && len(segments) == 2 && segments[0] == "export" && segments[1] == "vms":
+		return projectAccess{open: true}, true
+	case segments[0] != "hosts" || len(segments) < 2:
+		return projectAccess{}, false
+	}
+
+	host, rest := segments[1], segments[2:]
+	operate := services.ProjectOperator
+	if read {
+		operate = services.ProjectViewer
+	}
+	switch {
+	case len(rest) == 1 && rest[0] == "vms" && read:
+		return projectAccess{hostVisible: true, host: host}, true
+	case len(rest) >= 2 && rest[0] == "vms":
+		if len(rest) > 2 && rest[2] == "migrate" {
+			return projectAccess{}, false // The target host may be outside the project
+		}
+		if len(rest) > 2 && slices.Contains(consoleRoutes, rest[2]) {
+			operate = services.ProjectOperator
+		}
+		return projectAccess{kind: services.ResourceVM, host: host, key: rest[1], role: operate}, true
+	case len(rest) == 1 && rest[0] == "refresh":
+		return projectAccess{kind: services.ResourceHost, host: host, role: services.ProjectOperator}, true
+	case len(rest) == 1 && rest[0] == "networks":
+		if read {
+			return projectAccess{hostVisible: true, host: host}, true
+		}
+		return projectAccess{kind: services.ResourceHost, host: host, role: services.ProjectAdmin}, true
+	case len(rest) == 2 && rest[0] == "networks":
+		return projectAccess{kind: services.ResourceNetwork, host: host, key: rest[1], role: operate}, true
+	case len(rest) == 3 && rest[0] == "pools" && rest[2] == "volumes" && read:
+		return projectAccess{hostVisible: true, host: host}, true
+	case len(rest) >= 4 && rest[0] == "pools" && rest[2] == "volumes":
+		if len(rest) > 4 && rest[4] == "download" {
+			operate = services.ProjectOperator // The image holds the guest's data
+		}
+		return projectAccess{kind: services.ResourceVolume, host: host, key: rest[1] + "/" + rest[3], role: operate}, true
+	}
+	if read {
+		return projectAccess{kind: services.ResourceHost, host: host, role: services.ProjectViewer}, true
+	}
+	return projectAccess{kind: services.ResourceHost, host: host, role: services.ProjectAdmin}, true
+}
+
+// apiPathSegments splits the path of a request below /api/v1 into its
+// unescaped segments, without a trailing empty one.
+func apiPathSegments(r *http.Request) ([]string, error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1")
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		value, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = value
+	}
+	return segments, nil
+}
+
+// publicRoute reports whether a route works without logging in.
+func publicRoute(segments []string) bool {
+	route := strings.Join(segments, "/")
+	return route == "health" || route == "capabilities" || route == "auth/login" || route == "auth/logout" || route == "agent/connect"
+}
+
+// ScopeProjects requires a session on every route but the public ones once
+// a user exists. Once projects are in use as well, users who may not manage
+// projects only reach the resources of their projects, with what their role
+// there allows.
+func (h *APIHandler) ScopeProjects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments, err := apiPathSegments(r)
+		if err != nil {
+			writeErrorMessage(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		if publicRoute(segments) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		usersExist, err := h.HostService.UsersExist()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !usersExist {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, session, err := h.HostService.AuthenticateSession(sessionToken(r))
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, services.ErrUnauthenticated) {
+				status = http.StatusUnauthorized
+			}
+			writeError(w, err, status)
+			return
+		}
+		if !passwordChangeAllows(w, r, user) {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, &requestSession{User: user, Session: session}))
+		enabled, err := h.HostService.ProjectsEnabled()
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope, err := h.HostService.ProjectScopeFor(user)
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), projectScopeContextKey{}, scope))
+		if scope == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		access, ok := projectAccessFor(r.Method, segments)
+		if !ok {
+			writeError(w, services.ErrForbidden, http.StatusForbidden)
+			return
+		}
+		switch {
+		case access.open:
+			next.ServeHTTP(w, r)
+			return
+		case access.hostVisible:
+			ok, err = h.HostService.HostVisible(scope, h.HostService.ResolveHostID(access.host))
+		default:
+			var projectID uint
+			projectID, err = h.HostService.ResourceProject(access.kind, h.HostService.ResolveHostID(access.host), access.key)
+			ok = scope.Allows(projectID, access.role)
+		}
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			writeError(w, services.ErrForbidden, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scopeVMs keeps the VMs a scope can see.
+func scopeVMs(scope *services.ProjectScope, vms []services.VMView) []services.VMView {
+	if scope == nil {
+		return vms
+	}
+	visible := vms[:0]
+	for _, vm := range vms {
+		if scope.Allows(vm.ProjectID, services.ProjectViewer) {
+			visible = append(visible, vm)
+		}
+	}
+	return visible
+}
+
+func projectErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrProjectExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func parseProjectID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "projectID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid project ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// GetProjects lists the projects the user can see: all of them for users
+// who manage projects, otherwise those they are a member of.
+func (h *APIHandler) GetProjects(w http.ResponseWriter, r *http.Request) {
+	projects, err := h.HostService.ListProjects(projectScope(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(projects)
+}
+
+func (h *APIHandler) CreateProject(w http.ResponseWriter, r *http.Request) {
+	var req services.ProjectRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	project, err := h.HostService.CreateProject(currentSession(r).User.ID, req)
+	if err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(project)
+}
+
+// GetProject returns a project with its members and resources. Projects the
+// user is not a member of are reported as not found.
+func (h *APIHandler) GetProject(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	scope := projectScope(r)
+	if !scope.Allows(id, services.ProjectViewer) {
+		writeError(w, fmt.Errorf("could not find project %d: %w", id, gorm.ErrRecordNotFound), http.StatusNotFound)
+		return
+	}
+	project, err := h.HostService.GetProject(scope, id)
+	if err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(project)
+}
+
+func (h *APIHandler) DeleteProject(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.HostService.DeleteProject(currentSession(r).User.ID, id); err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireProjectAdmin lets through users who manage projects and admins of
+// the given project.
+func requireProjectAdmin(w http.ResponseWriter, r *http.Request, projectID uint) bool {
+	if !projectScope(r).Allows(projectID, services.ProjectAdmin) {
+		writeError(w, services.ErrForbidden, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// SetProjectMember adds a user to a project or changes their role. Project
+// admins can manage the members of their own project.
+func (h *APIHandler) SetProjectMember(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := parseUserID(w, r)
+	if !ok || !requireProjectAdmin(w, r, projectID) {
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetProjectMember(currentSession(r).User.ID, projectID, userID, req.Role); err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) RemoveProjectMember(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	userID, ok := parseUserID(w, r)
+	if !ok || !requireProjectAdmin(w, r, projectID) {
+		return
+	}
+	if err := h.HostService.RemoveProjectMember(currentSession(r).User.ID, projectID, userID); err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) AssignProjectResource(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	var req services.ProjectResourceRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.HostID = h.HostService.ResolveHostID(req.HostID)
+	resource, err := h.HostService.AssignProjectResource(currentSession(r).User.ID, projectID, req)
+	if err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resource)
+}
+
+func (h *APIHandler) UnassignProjectResource(w http.ResponseWriter, r *http.Request) {
+	projectID, ok := parseProjectID(w, r)
+	if !ok {
+		return
+	}
+	resourceID, err := strconv.ParseUint(chi.URLParam(r, "resourceID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid resource ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.UnassignProjectResource(currentSession(r).User.ID, projectID, uint(resourceID)); err != nil {
+		writeError(w, err, projectErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Notifications ---
+
+func parseNotificationID(w http.ResponseWriter, r *http.Request, param string) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, param), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func notificationErrorStatus(err error) int {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// GetNotifications lists the notifications of the logged-in user, newest
+// first; unread=true leaves out those already read.
+func (h *APIHandler) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var limit int
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeErrorMessage(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	list, err := h.HostService.ListNotifications(currentSession(r).User.ID, query.Get("unread") == "true", limit)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *APIHandler) MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	h.markNotification(w, r, true)
+}
+
+func (h *APIHandler) MarkNotificationUnread(w http.ResponseWriter, r *http.Request) {
+	h.markNotification(w, r, false)
+}
+
+func (h *APIHandler) markNotification(w http.ResponseWriter, r *http.Request, read bool) {
+	id, ok := parseNotificationID(w, r, "notificationID")
+	if !ok {
+		return
+	}
+	if err := h.HostService.MarkNotificationRead(currentSession(r).User.ID, id, read); err != nil {
+		writeError(w, err, notificationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.MarkAllNotificationsRead(currentSession(r).User.ID); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) DeleteNotification(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseNotificationID(w, r, "notificationID")
+	if !ok {
+		return
+	}
+	if err := h.HostService.DeleteNotification(currentSession(r).User.ID, id); err != nil {
+		writeError(w, err, notificationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) GetNotificationSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subs, err := h.HostService.ListNotificationSubscriptions(currentSession(r).User.ID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+func (h *APIHandler) CreateNotificationSubscription(w http.ResponseWriter, r *http.Request) {
+	var req services.NotificationSubscriptionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.HostID != "" {
+		req.HostID = h.HostService.ResolveHostID(req.HostID)
+	}
+	sub, err := h.HostService.CreateNotificationSubscription(currentSession(r).User.ID, req)
+	if err != nil {
+		writeError(w, err, notificationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+func (h *APIHandler) DeleteNotificationSubscription(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseNotificationID(w, r, "subscriptionID")
+	if !ok {
+		return
+	}
+	if err := h.HostService.DeleteNotificationSubscription(currentSession(r).User.ID, id); err != nil {
+		writeError(w, err, notificationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Email ---
+
+func emailErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrEmailDisabled):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrEmailFailed):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetEmailSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetEmailSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetEmailSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.EmailSettingsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetEmailSettings(currentSession(r).User.ID, req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// SendTestEmail sends a message to check the email settings, answering with
+// the SMTP server's error if it fails.
+func (h *APIHandler) SendTestEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		To string `json:"to"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SendTestEmail(currentSession(r).User.ID, req.To); err != nil {
+		writeError(w, err, emailErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendCapacityReport emails the capacity summary to the report recipients
+// now, whether or not the weekly report is enabled.
+func (h *APIHandler) SendCapacityReport(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.SendCapacityReport(currentSession(r).User.ID); err != nil {
+		writeError(w, err, emailErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Login Security ---
+
+func (h *APIHandler) GetSecuritySettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetSecuritySettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetSecuritySettings(w http.ResponseWriter, r *http.Request) {
+	var req services.SecuritySettingsView
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetSecuritySettings(currentSession(r).User.ID, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidSecuritySettings) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// GetLoginAttempts lists login attempts, filtered by the username, ip,
+// success, since and limit query parameters.
+func (h *APIHandler) GetLoginAttempts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := services.LoginAttemptFilter{
+		Username:  query.Get("username"),
+		IPAddress: query.Get("ip"),
+	}
+	if v := query.Get("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			writeErrorMessage(w, "Invalid success parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Success = &success
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeErrorMessage(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			writeErrorMessage(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	attempts, err := h.HostService.ListLoginAttempts(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
+
+// GetSecurityReport summarizes logins since the since query parameter, or
+// over the last 24 hours.
+func (h *APIHandler) GetSecurityReport(w http.ResponseWriter, r *http.Request) {
+	since := time.Now().Add(-24 * time.Hour)
+	if v := r.URL.Query().Get("since"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeErrorMessage(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	report, err := h.HostService.GetSecurityReport(since)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (h *APIHandler) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// GetCapabilities describes the server for the web UI, before logging in.
+func (h *APIHandler) GetCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps, err := h.HostService.GetCapabilities(h.sessionUser(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	caps.Auth.SessionCookie = sessionCookie
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
+
+func (h *APIHandler) CreateHost(w http.ResponseWriter, r *http.Request) {
+	var host storage.Host
+	if !decodeJSON(w, r, &host) {
+		return
+	}
+	newHost, err := h.HostService.AddHost(host)
+	if err != nil {
+		writeError(w, err, hostErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newHost)
+}
+
+// RenameHost changes the display name of a host.
+func (h *APIHandler) RenameHost(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	host, err := h.HostService.RenameHost(hostID, req.Name)
+	if err != nil {
+		writeError(w, err, hostErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(host)
+}
+
+func hostErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrHostExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := h.HostService.GetAllHosts()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if scope := projectScope(r); scope != nil {
+		visible := hosts[:0]
+		for _, host := range hosts {
+			ok, err := h.HostService.HostVisible(scope, host.ID)
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if ok {
+				visible = append(visible, host)
+			}
+		}
+		hosts = visible
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hosts)
+}
+
+func (h *APIHandler) GetHostInfo(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	info, err := h.HostService.GetHostInfo(hostID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// dryRun reports whether a request only asks what it would do, with the
+// dry_run=true query parameter.
+func dryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dry_run") == "true"
+}
+
+func writeDryRunPlan(w http.ResponseWriter, plan *services.DryRunPlan) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (h *APIHandler) DeleteHost(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	if dryRun(r) {
+		plan, err := h.HostService.PlanRemoveHost(hostID)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				status = http.StatusNotFound
+			}
+			writeError(w, err, status)
+			return
+		}
+		writeDryRunPlan(w, plan)
+		return
+	}
+	if err := h.HostService.RemoveHost(hostID); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) SetHostMaintenance(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetHostMaintenance(hostID, req.Enabled); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EvacuateHost puts a host into maintenance mode and migrates or shuts down
+// its running VMs as one task.
+func (h *APIHandler) EvacuateHost(w http.ResponseWriter, r *http.Request) {
+	var req services.HostEvacuationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.TargetHostID = h.HostService.ResolveHostID(req.TargetHostID)
+	task, err := h.HostService.EvacuateHost(h.hostParam(r), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrEvacuationInProgress):
+			status = http.StatusConflict
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// SetHostReservation sets the CPU and memory reserved for the hypervisor OS.
+func (h *APIHandler) SetHostReservation(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req services.HostReservation
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetHostReservation(hostID, req); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidReservation):
+			status = http.StatusBadRequest
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHostCapacity returns what a host offers to VMs after its reservation.
+func (h *APIHandler) GetHostCapacity(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	capacity, err := h.HostService.GetHostCapacity(hostID)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capacity)
+}
+
+func startupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidStartupSettings):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// SetHostStartup enables or disables ordered VM startup after a host outage.
+func (h *APIHandler) SetHostStartup(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req services.HostStartupSettings
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetHostStartupSettings(hostID, req); err != nil {
+		writeError(w, err, startupErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreviewHostStartup shows the startup sequence without starting anything.
+func (h *APIHandler) PreviewHostStartup(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	plan, err := h.HostService.PreviewHostStartup(hostID)
+	if err != nil {
+		writeError(w, err, startupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// GetBalloonPolicy returns the balloon policy of a host.
+func (h *APIHandler) GetBalloonPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.HostService.GetBalloonPolicy(h.hostParam(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetBalloonPolicy configures the balloon policy of a host.
+func (h *APIHandler) SetBalloonPolicy(w http.ResponseWriter, r *http.Request) {
+	var req services.BalloonPolicyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	policy, err := h.HostService.SetBalloonPolicy(h.hostParam(r), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// GetDiskCompactionPolicy returns the disk compaction policy of a host.
+func (h *APIHandler) GetDiskCompactionPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.HostService.GetDiskCompactionPolicy(h.hostParam(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetDiskCompactionPolicy configures the disk compaction policy of a host.
+func (h *APIHandler) SetDiskCompactionPolicy(w http.ResponseWriter, r *http.Request) {
+	var req services.DiskCompactionPolicyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	policy, err := h.HostService.SetDiskCompactionPolicy(h.hostParam(r), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// GetFstrimPolicy returns the fstrim policy of a host.
+func (h *APIHandler) GetFstrimPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.HostService.GetFstrimPolicy(h.hostParam(r))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// SetFstrimPolicy configures the fstrim policy of a host.
+func (h *APIHandler) SetFstrimPolicy(w http.ResponseWriter, r *http.Request) {
+	var req services.FstrimPolicyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	policy, err := h.HostService.SetFstrimPolicy(h.hostParam(r), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// GetKSM returns the kernel same-page merging state of a host.
+func (h *APIHandler) GetKSM(w http.ResponseWriter, r *http.Request) {
+	status, err := h.HostService.GetKSM(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetKSM turns kernel same-page merging on or off and tunes it.
+func (h *APIHandler) SetKSM(w http.ResponseWriter, r *http.Request) {
+	var req services.KSMRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	status, err := h.HostService.SetKSM(h.hostParam(r), req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, libvirt.ErrNoSSHChannel) {
+			code = http.StatusConflict
+		}
+		writeError(w, err, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// GetHostCommands lists the commands ExecHostCommand runs.
+func (h *APIHandler) GetHostCommands(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.ListHostCommands())
+}
+
+// ExecHostCommand runs an allow-listed command on a host over its SSH
+// connection and returns the output.
+func (h *APIHandler) ExecHostCommand(w http.ResponseWriter, r *http.Request) {
+	var req services.HostExecRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.ExecHostCommand(currentSession(r).User.ID, h.hostParam(r), req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, libvirt.ErrNoSSHChannel) {
+			code = http.StatusConflict
+		}
+		writeError(w, err, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetHostSEV reports the AMD SEV support of a host.
+func (h *APIHandler) GetHostSEV(w http.ResponseWriter, r *http.Request) {
+	sev, err := h.HostService.GetHostSEV(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sev)
+}
+
+// GetMachineTypes lists the QEMU machine types a host offers.
+func (h *APIHandler) GetMachineTypes(w http.ResponseWriter, r *http.Request) {
+	types, err := h.HostService.ListMachineTypes(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types)
+}
+
+// PrepareHostPower validates a host power action and returns a confirmation token.
+func (h *APIHandler) PrepareHostPower(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req struct {
+		Action services.HostPowerAction `json:"action"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	token, err := h.HostService.PrepareHostPowerAction(hostID, req.Action)
+	if err != nil {
+		writeError(w, err, hostPowerErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// ExecuteHostPower reboots or shuts down a host using a confirmation token.
+func (h *APIHandler) ExecuteHostPower(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req struct {
+		Action services.HostPowerAction `json:"action"`
+		Token  string                   `json:"token"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.ExecuteHostPowerAction(hostID, req.Action, req.Token); err != nil {
+		writeError(w, err, hostPowerErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func hostPowerErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrUnknownPowerAction):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrInvalidConfirmToken):
+		return http.StatusForbidden
+	case errors.Is(err, services.ErrHostNotInMaintenance), errors.Is(err, services.ErrHostHasActiveVMs):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func fencingErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrMissingMigrationTarget):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrInvalidConfirmToken):
+		return http.StatusForbidden
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrHostNotDead), errors.Is(err, services.ErrHostNotFenced):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetHostFencing returns the fencing check of a host and what it found.
+func (h *APIHandler) GetHostFencing(w http.ResponseWriter, r *http.Request) {
+	status, err := h.HostService.GetHostFencing(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetHostFencing configures the check that declares a disconnected host dead.
+func (h *APIHandler) SetHostFencing(w http.ResponseWriter, r *http.Request) {
+	var req services.HostFencingRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	status, err := h.HostService.SetHostFencing(h.hostParam(r), req)
+	if err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// PrepareHostFence checks that a host is dead and returns a confirmation token.
+func (h *APIHandler) PrepareHostFence(w http.ResponseWriter, r *http.Request) {
+	token, err := h.HostService.PrepareHostFence(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(token)
+}
+
+// FenceHost confirms a dead host as off using a confirmation token.
+func (h *APIHandler) FenceHost(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.FenceHost(h.hostParam(r), req.Token); err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHostRecovery lists the VMs of a dead host and whether they can be
+// recovered on the target given in the query.
+func (h *APIHandler) GetHostRecovery(w http.ResponseWriter, r *http.Request) {
+	target := h.HostService.ResolveHostID(r.URL.Query().Get("target"))
+	plan, err := h.HostService.GetHostRecovery(h.hostParam(r), target)
+	if err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// RecoverHostVMs defines VMs of a fenced host on another host.
+func (h *APIHandler) RecoverHostVMs(w http.ResponseWriter, r *http.Request) {
+	var req services.HostRecoveryRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.TargetHostID = h.HostService.ResolveHostID(req.TargetHostID)
+	task, err := h.HostService.RecoverHostVMs(h.hostParam(r), req)
+	if err != nil {
+		writeError(w, err, fencingErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// PrepareHost starts provisioning a bare machine as a libvirt host.
+func (h *APIHandler) PrepareHost(w http.ResponseWriter, r *http.Request) {
+	var req services.HostPrepareRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	task, err := h.HostService.PrepareHost(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// --- System ---
+
+// GetDatabaseStats reports database activity and write contention.
+func (h *APIHandler) GetDatabaseStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.GetDatabaseStats())
+}
+
+// Metrics exposes counters in the Prometheus text format for scraping.
+func (h *APIHandler) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	console.WriteMetrics(w)
+	h.Hub.WriteMetrics(w)
+	h.HostService.WriteMetrics(w)
+}
+
+// GetConnectionStats reports concurrent and queued libvirt operations per host.
+func (h *APIHandler) GetConnectionStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.GetConnectionStats())
+}
+
+// GetRuntimeDiagnostics reports goroutines, heap usage, WebSocket queues and
+// stats subscriptions.
+func (h *APIHandler) GetRuntimeDiagnostics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.GetRuntimeDiagnostics())
+}
+
+// GetDBConsistency reports the orphaned rows of the database.
+func (h *APIHandler) GetDBConsistency(w http.ResponseWriter, r *http.Request) {
+	report, err := h.HostService.CheckDBConsistency()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// Diagnostics serves the Go profiler under /debug/pprof/ and the runtime
+// diagnostics under /debug/runtime, without authentication. It is meant for
+// a listener only reachable from the host itself.
+func (h *APIHandler) Diagnostics() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", h.GetRuntimeDiagnostics)
+	return mux
+}
+
+// --- Events ---
+
+// GetEventHistory lists recorded events, optionally filtered by host, VM,
+// type (comma-separated) and time range (RFC 3339).
+func (h *APIHandler) GetEventHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := services.EventFilter{
+		HostID: query.Get("host"),
+		VMName: query.Get("vm"),
+	}
+	if v := query.Get("type"); v != "" {
+		filter.Types = strings.Split(v, ",")
+	}
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeErrorMessage(w, fmt.Sprintf("Invalid %s parameter", param), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeErrorMessage(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	events, err := h.HostService.ListEvents(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// --- Tasks ---
+
+func (h *APIHandler) GetTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := h.HostService.ListTasks()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tasks)
+}
+
+func (h *APIHandler) GetTask(w http.ResponseWriter, r *http.Request) {
+	taskID, err := strconv.ParseUint(chi.URLParam(r, "taskID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	task, err := h.HostService.GetTask(uint(taskID))
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(task)
+}
+
+// --- Packet Captures ---
+
+// StartPacketCapture starts a bounded tcpdump on a VM's host-side NIC.
+func (h *APIHandler) StartPacketCapture(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.PacketCaptureRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	capture, err := h.HostService.StartPacketCapture(hostID, vmName, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidCaptureRequest):
+			status = http.StatusBadRequest
+		case errors.Is(err, services.ErrInterfaceNotFound):
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(capture)
+}
+
+func snapshotErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidSnapshotRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, libvirt.ErrSnapshotNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrSnapshotExists), errors.Is(err, libvirt.ErrSnapshotUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetSnapshots lists the snapshots of a VM.
+func (h *APIHandler) GetSnapshots(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	snapshots, err := h.HostService.ListSnapshots(hostID, vmName)
+	if err != nil {
+		writeError(w, err, snapshotErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// EstimateSnapshot tells how long a snapshot of a VM would take and whether
+// it can be taken at all.
+func (h *APIHandler) EstimateSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	estimate, err := h.HostService.EstimateSnapshot(hostID, vmName, r.URL.Query().Get("memory"))
+	if err != nil {
+		writeError(w, err, snapshotErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
+
+// CreateSnapshot takes a snapshot of a VM, with its memory when it runs.
+func (h *APIHandler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.SnapshotRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	task, err := h.HostService.CreateSnapshot(hostID, vmName, req)
+	if err != nil {
+		writeError(w, err, snapshotErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// RevertSnapshot puts a VM back to one of its snapshots.
+func (h *APIHandler) RevertSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	task, err := h.HostService.RevertSnapshot(hostID, vmName, chi.URLParam(r, "snapshot"))
+	if err != nil {
+		writeError(w, err, snapshotErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// DeleteSnapshot removes a snapshot of a VM.
+func (h *APIHandler) DeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	if err := h.HostService.DeleteSnapshot(hostID, vmName, chi.URLParam(r, "snapshot")); err != nil {
+		writeError(w, err, snapshotErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func graphicsPasswordErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidGraphicsPassword):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, libvirt.ErrNoGraphics):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetGraphicsPassword tells whether a VM's consoles are password protected.
+func (h *APIHandler) GetGraphicsPassword(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	status, err := h.HostService.GetGraphicsPasswordStatus(hostID, vmName)
+	if err != nil {
+		writeError(w, err, graphicsPasswordErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// SetGraphicsPassword sets or rotates the password of a VM's consoles.
+func (h *APIHandler) SetGraphicsPassword(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.GraphicsPasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.SetGraphicsPassword(hostID, vmName, req)
+	if err != nil {
+		writeError(w, err, graphicsPasswordErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
+
+// RevokeGraphicsPassword locks everyone out of a VM's consoles.
+func (h *APIHandler) RevokeGraphicsPassword(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	if err := h.HostService.RevokeGraphicsPassword(hostID, vmName); err != nil {
+		writeError(w, err, graphicsPasswordErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) GetPacketCaptures(w http.ResponseWriter, r *http.Request) {
+	captures, err := h.HostService.ListPacketCaptures()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(captures)
+}
+
+// DownloadPacketCapture serves a capture's pcap file.
+func (h *APIHandler) DownloadPacketCapture(w http.ResponseWriter, r *http.Request) {
+	captureID, err := strconv.ParseUint(chi.URLParam(r, "captureID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid capture ID", http.StatusBadRequest)
+		return
+	}
+	capture, err := h.HostService.OpenPacketCapture(uint(captureID))
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s-%d.pcap", capture.VMName, capture.Interface, capture.ID)))
+	http.ServeFile(w, r, capture.FilePath)
+}
+
+func (h *APIHandler) DeletePacketCapture(w http.ResponseWriter, r *http.Request) {
+	captureID, err := strconv.ParseUint(chi.URLParam(r, "captureID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid capture ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.DeletePacketCapture(uint(captureID)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Storage Pools & Alerts ---
+
+func (h *APIHandler) GetStoragePools(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	pools, err := h.HostService.ListStoragePools(hostID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pools)
+}
+
+func (h *APIHandler) RefreshStoragePools(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	if err := h.HostService.RefreshStoragePools(hostID); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	h.GetStoragePools(w, r)
+}
+
+func (h *APIHandler) GetStoragePoolUsage(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+
+	hours := 24
+	if v := r.URL.Query().Get("hours"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeErrorMessage(w, "Invalid hours parameter", http.StatusBadRequest)
+			return
+		}
+		hours = parsed
+	}
+
+	samples, err := h.HostService.GetStoragePoolUsage(hostID, poolName, time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(samples)
+}
+
+func (h *APIHandler) SetStoragePoolThresholds(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+
+	var thresholds services.PoolThresholds
+	if !decodeJSON(w, r, &thresholds) {
+		return
+	}
+
+	pool, err := h.HostService.SetStoragePoolThresholds(hostID, poolName, thresholds)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidThresholds):
+			status = http.StatusBadRequest
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool)
+}
+
+// SetStoragePoolAutostart sets whether a pool is started with libvirtd.
+func (h *APIHandler) SetStoragePoolAutostart(w http.ResponseWriter, r *http.Request) {
+	h.setStoragePoolFlag(w, r, h.HostService.SetStoragePoolAutostart)
+}
+
+// SetStoragePoolActive starts or stops a pool.
+func (h *APIHandler) SetStoragePoolActive(w http.ResponseWriter, r *http.Request) {
+	h.setStoragePoolFlag(w, r, h.HostService.SetStoragePoolActive)
+}
+
+func (h *APIHandler) setStoragePoolFlag(w http.ResponseWriter, r *http.Request, set func(hostID, poolName string, enabled bool) (*storage.StoragePool, error)) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	pool, err := set(hostID, poolName, req.Enabled)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool)
+}
+
+func (h *APIHandler) GetVolumes(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volumes, err := h.HostService.ListVolumes(hostID, poolName)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if scope := projectScope(r); scope != nil {
+		visible := volumes[:0]
+		for _, vol := range volumes {
+			projectID, err := h.HostService.ResourceProject(services.ResourceVolume, hostID, poolName+"/"+vol.Name)
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if scope.Allows(projectID, services.ProjectViewer) {
+				visible = append(visible, vol)
+			}
+		}
+		volumes = visible
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(volumes)
+}
+
+// DeleteVolume removes a volume. With wipe=true the data is overwritten
+// first and the deletion runs as a task.
+func (h *APIHandler) DeleteVolume(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volName := chi.URLParam(r, "volName")
+	opts := services.VolumeDeleteOptions{
+		Wipe:          r.URL.Query().Get("wipe") == "true",
+		WipeAlgorithm: r.URL.Query().Get("algorithm"),
+	}
+	if dryRun(r) {
+		plan, err := h.HostService.PlanDeleteVolume(hostID, poolName, volName, opts)
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, libvirt.ErrUnknownWipeAlgorithm):
+				status = http.StatusBadRequest
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				status = http.StatusNotFound
+			}
+			writeError(w, err, status)
+			return
+		}
+		writeDryRunPlan(w, plan)
+		return
+	}
+
+	task, err := h.HostService.DeleteVolume(hostID, poolName, volName, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, libvirt.ErrUnknownWipeAlgorithm) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
+		return
+	}
+	if task == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// DownloadVolume streams a volume's image. A single byte range may be
+// requested, so interrupted downloads can be resumed.
+func (h *APIHandler) DownloadVolume(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volName := chi.URLParam(r, "volName")
+	size, err := h.HostService.GetVolumeImageSize(hostID, poolName, volName)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	offset, length, partial, ok := parseByteRange(r.Header.Get("Range"), size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeErrorMessage(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", volName))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatUint(length, 10))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if length == 0 {
+		return
+	}
+	// The status is sent with the first bytes, so a failure from here on can
+	// only cut the body short.
+	if err := h.HostService.DownloadVolume(hostID, poolName, volName, offset, length, w); err != nil {
+		log.Printf("Download of volume %s/%s on host %s failed: %v", poolName, volName, hostID, err)
+	}
+}
+
+// UploadVolume stores the request body, a disk image or ISO, in a new
+// volume. The expected checksum comes in the sha256 query parameter.
+func (h *APIHandler) UploadVolume(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volName := chi.URLParam(r, "volName")
+	if r.ContentLength < 0 {
+		writeErrorMessage(w, "Content-Length is required", http.StatusLengthRequired)
+		return
+	}
+	req := services.VolumeUploadRequest{SizeBytes: uint64(r.ContentLength), SHA256: r.URL.Query().Get("sha256")}
+	uploaded, err := h.HostService.UploadVolume(hostID, poolName, volName, req, r.Body)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrChecksumMismatch):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, libvirt.ErrInvalidVolumeSpec):
+			status = http.StatusBadRequest
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploaded)
+}
+
+// parseByteRange reads a Range header of a single byte range against
+// content of the given size. Without a header, or with several ranges, it
+// selects the whole content. ok is false if the range cannot be served.
+func parseByteRange(header string, size uint64) (offset, length uint64, partial, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if header == "" || !found || strings.Contains(spec, ",") {
+		return 0, size, false, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// A suffix: the last bytes of the content.
+		n, err := strconv.ParseUint(last, 10, 64)
+		if err != nil || n == 0 || size == 0 {
+			return 0, 0, false, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseUint(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseUint(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true, true
+}
+
+func catalogImageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrCatalogImageExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetCatalogImages(w http.ResponseWriter, r *http.Request) {
+	images, err := h.HostService.ListCatalogImages()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+func (h *APIHandler) CreateCatalogImage(w http.ResponseWriter, r *http.Request) {
+	var req services.CatalogImageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	image, err := h.HostService.CreateCatalogImage(req)
+	if err != nil {
+		writeError(w, err, catalogImageErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(image)
+}
+
+func (h *APIHandler) UpdateCatalogImage(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "imageName")
+	var req services.CatalogImageRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	image, err := h.HostService.UpdateCatalogImage(name, req)
+	if err != nil {
+		writeError(w, err, catalogImageErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(image)
+}
+
+func (h *APIHandler) DeleteCatalogImage(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "imageName")
+	if err := h.HostService.DeleteCatalogImage(name); err != nil {
+		writeError(w, err, catalogImageErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DownloadCatalogImage starts downloading a catalog image into a pool.
+func (h *APIHandler) DownloadCatalogImage(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	var req services.ImageDownloadRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	task, err := h.HostService.DownloadCatalogImage(hostID, poolName, req)
+	if err != nil {
+		writeError(w, err, catalogImageErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// --- Maintenance Windows ---
+
+func maintenanceWindowErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrMaintenanceWindowExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetMaintenanceWindows lists the maintenance windows, or with active=true
+// only the ones that are on.
+func (h *APIHandler) GetMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	windows, err := h.HostService.ListMaintenanceWindows(r.URL.Query().Get("active") == "true")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(windows)
+}
+
+func (h *APIHandler) GetMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	window, err := h.HostService.GetMaintenanceWindow(chi.URLParam(r, "windowName"))
+	if err != nil {
+		writeError(w, err, maintenanceWindowErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(window)
+}
+
+func (h *APIHandler) CreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var req services.MaintenanceWindowRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	window, err := h.HostService.CreateMaintenanceWindow(req)
+	if err != nil {
+		writeError(w, err, maintenanceWindowErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(window)
+}
+
+func (h *APIHandler) UpdateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	var req services.MaintenanceWindowRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	window, err := h.HostService.UpdateMaintenanceWindow(chi.URLParam(r, "windowName"), req)
+	if err != nil {
+		writeError(w, err, maintenanceWindowErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(window)
+}
+
+func (h *APIHandler) DeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteMaintenanceWindow(chi.URLParam(r, "windowName")); err != nil {
+		writeError(w, err, maintenanceWindowErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Hardware Presets ---
+
+func hardwarePresetErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrHardwarePresetExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetHardwarePresets(w http.ResponseWriter, r *http.Request) {
+	presets, err := h.HostService.ListHardwarePresets()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(presets)
+}
+
+func (h *APIHandler) GetHardwarePreset(w http.ResponseWriter, r *http.Request) {
+	preset, err := h.HostService.GetHardwarePreset(chi.URLParam(r, "presetName"))
+	if err != nil {
+		writeError(w, err, hardwarePresetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preset)
+}
+
+func (h *APIHandler) CreateHardwarePreset(w http.ResponseWriter, r *http.Request) {
+	var req services.HardwarePresetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	preset, err := h.HostService.CreateHardwarePreset(req)
+	if err != nil {
+		writeError(w, err, hardwarePresetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(preset)
+}
+
+func (h *APIHandler) UpdateHardwarePreset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "presetName")
+	var req services.HardwarePresetRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	preset, err := h.HostService.UpdateHardwarePreset(name, req)
+	if err != nil {
+		writeError(w, err, hardwarePresetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preset)
+}
+
+func (h *APIHandler) DeleteHardwarePreset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "presetName")
+	if err := h.HostService.DeleteHardwarePreset(name); err != nil {
+		writeError(w, err, hardwarePresetErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetOrphanedVolumes lists volumes of a directory pool that no VM uses.
+func (h *APIHandler) GetOrphanedVolumes(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volumes, err := h.HostService.FindOrphanedVolumes(hostID, poolName)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrUnsupportedPoolType) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(volumes)
+}
+
+// AdoptOrphanedVolume attaches an unmanaged volume to a VM.
+func (h *APIHandler) AdoptOrphanedVolume(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	poolName := chi.URLParam(r, "poolName")
+	volName := chi.URLParam(r, "volName")
+	var req services.OrphanAttachRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := services.ValidateVMName("vm_name", req.VMName); err != nil {
+		writeError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+	disk, err := h.HostService.AdoptOrphanedVolume(hostID, poolName, volName, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrUnsupportedPoolType):
+			status = http.StatusBadRequest
+		case errors.Is(err, services.ErrVolumeInUse), errors.Is(err, libvirt.ErrNoFreeDiskTarget), errors.Is(err, services.ErrChecksumMismatch):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(disk)
+}
+
+func poolFileErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrUnsupportedPoolType):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrPathOutsidePool):
+		return http.StatusForbidden
+	case errors.Is(err, libvirt.ErrHostFileNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrPoolInactive), errors.Is(err, services.ErrPoolFileNotRegular),
+		errors.Is(err, services.ErrPoolFileInUse), errors.Is(err, libvirt.ErrHostFileExists),
+		errors.Is(err, libvirt.ErrNoSSHChannel):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetPoolFiles lists a directory of a storage pool on the host.
+func (h *APIHandler) GetPoolFiles(w http.ResponseWriter, r *http.Request) {
+	listing, err := h.HostService.ListPoolFiles(h.hostParam(r), chi.URLParam(r, "poolName"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, err, poolFileErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// GetPoolFile describes a file of a storage pool and what uses it.
+func (h *APIHandler) GetPoolFile(w http.ResponseWriter, r *http.Request) {
+	file, err := h.HostService.StatPoolFile(h.hostParam(r), chi.URLParam(r, "poolName"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, err, poolFileErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// DeletePoolFile deletes a file of a storage pool that no VM uses.
+func (h *APIHandler) DeletePoolFile(w http.ResponseWriter, r *http.Request) {
+	err := h.HostService.DeletePoolFile(h.hostParam(r), chi.URLParam(r, "poolName"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeError(w, err, poolFileErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RenamePoolFile renames a file of a storage pool that no VM uses.
+func (h *APIHandler) RenamePoolFile(w http.ResponseWriter, r *http.Request) {
+	var req services.PoolFileRenameRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	file, err := h.HostService.RenamePoolFile(h.hostParam(r), chi.URLParam(r, "poolName"), req)
+	if err != nil {
+		writeError(w, err, poolFileErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+func (h *APIHandler) GetAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts, err := h.HostService.ListAlerts(r.URL.Query().Get("all") == "true")
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// --- Networks ---
+
+func (h *APIHandler) GetNetworks(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	networks, err := h.HostService.ListNetworks(hostID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if scope := projectScope(r); scope != nil {
+		visible := networks[:0]
+		for _, network := range networks {
+			projectID, err := h.HostService.ResourceProject(services.ResourceNetwork, hostID, network.Name)
+			if err != nil {
+				writeError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if scope.Allows(projectID, services.ProjectViewer) {
+				visible = append(visible, network)
+			}
+		}
+		networks = visible
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(networks)
+}
+
+func (h *APIHandler) CreateNetwork(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req services.NetworkRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	network, err := h.HostService.CreateNetwork(hostID, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidNetwork):
+			status = http.StatusBadRequest
+		case errors.Is(err, services.ErrNetworkExists):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(network)
+}
+
+func (h *APIHandler) DeleteNetwork(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	name := chi.URLParam(r, "networkName")
+	var plan *services.DryRunPlan
+	var err error
+	if dryRun(r) {
+		plan, err = h.HostService.PlanDeleteNetwork(hostID, name)
+	} else {
+		err = h.HostService.DeleteNetwork(hostID, name)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrNetworkInUse):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	if plan != nil {
+		writeDryRunPlan(w, plan)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetNetworkAutostart sets whether a libvirt network is started with libvirtd.
+func (h *APIHandler) SetNetworkAutostart(w http.ResponseWriter, r *http.Request) {
+	h.setNetworkFlag(w, r, h.HostService.SetNetworkAutostart)
+}
+
+// SetNetworkActive starts or stops a libvirt network.
+func (h *APIHandler) SetNetworkActive(w http.ResponseWriter, r *http.Request) {
+	h.setNetworkFlag(w, r, h.HostService.SetNetworkActive)
+}
+
+func (h *APIHandler) setNetworkFlag(w http.ResponseWriter, r *http.Request, set func(hostID, name string, enabled bool) (*storage.Network, error)) {
+	hostID := h.hostParam(r)
+	name := chi.URLParam(r, "networkName")
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	network, err := set(hostID, name, req.Enabled)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrNotLibvirtNetwork):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(network)
+}
+
+// --- Secrets ---
+
+func (h *APIHandler) GetSecrets(w http.ResponseWriter, r *http.Request) {
+	secrets, err := h.HostService.ListSecrets(h.hostParam(r))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secrets)
+}
+
+func (h *APIHandler) GetSecret(w http.ResponseWriter, r *http.Request) {
+	secret, err := h.HostService.GetSecret(h.hostParam(r), chi.URLParam(r, "secretID"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secret)
+}
+
+func (h *APIHandler) CreateSecret(w http.ResponseWriter, r *http.Request) {
+	var req services.SecretRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	secret, err := h.HostService.CreateSecret(h.hostParam(r), req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(secret)
+}
+
+func (h *APIHandler) DeleteSecret(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteSecret(h.hostParam(r), chi.URLParam(r, "secretID")); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Placement Rules ---
+
+func placementRuleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidPlacementRule):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrPlacementRuleExists):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetPlacementRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.HostService.ListPlacementRules()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (h *APIHandler) CreatePlacementRule(w http.ResponseWriter, r *http.Request) {
+	var req services.PlacementRuleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	rule, err := h.HostService.CreatePlacementRule(req)
+	if err != nil {
+		writeError(w, err, placementRuleErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (h *APIHandler) UpdatePlacementRule(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "ruleName")
+	var req services.PlacementRuleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	rule, err := h.HostService.UpdatePlacementRule(name, req)
+	if err != nil {
+		writeError(w, err, placementRuleErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (h *APIHandler) DeletePlacementRule(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "ruleName")
+	if err := h.HostService.DeletePlacementRule(name); err != nil {
+		writeError(w, err, placementRuleErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetPlacementViolations lists the rules the current VM placement breaks.
+func (h *APIHandler) GetPlacementViolations(w http.ResponseWriter, r *http.Request) {
+	violations, err := h.HostService.GetPlacementViolations()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(violations)
+}
+
+// CheckVMPlacement reports the rules that moving a VM to another host would
+// break, e.g. before a migration.
+func (h *APIHandler) CheckVMPlacement(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeErrorMessage(w, "Missing target host", http.StatusBadRequest)
+		return
+	}
+	violations, err := h.HostService.CheckPlacement(hostID, vmName, target)
+	if err != nil {
+		writeError(w, err, placementRuleErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(violations)
+}
+
+// --- VM Dependencies ---
+
+func dependencyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidDependency), errors.Is(err, services.ErrInvalidOrchestration):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrDependencyExists), errors.Is(err, services.ErrDependencyCycle):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetVMDependencies(w http.ResponseWriter, r *http.Request) {
+	deps, err := h.HostService.ListVMDependencies()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deps)
+}
+
+func (h *APIHandler) CreateVMDependency(w http.ResponseWriter, r *http.Request) {
+	var req services.VMDependencyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	dep, err := h.HostService.CreateVMDependency(req)
+	if err != nil {
+		writeError(w, err, dependencyErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(dep)
+}
+
+func (h *APIHandler) DeleteVMDependency(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "dependencyID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid dependency ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.DeleteVMDependency(uint(id)); err != nil {
+		writeError(w, err, dependencyErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PlanOrchestration shows the order in which an orchestrated start or stop
+// would handle a group of VMs.
+func (h *APIHandler) PlanOrchestration(w http.ResponseWriter, r *http.Request) {
+	action := chi.URLParam(r, "action")
+	var req services.OrchestrationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	steps, err := h.HostService.PlanOrchestration(action, req)
+	if err != nil {
+		writeError(w, err, dependencyErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(steps)
+}
+
+// StartOrchestration starts or stops a group of VMs along their
+// dependencies as a background task.
+func (h *APIHandler) StartOrchestration(w http.ResponseWriter, r *http.Request) {
+	action := chi.URLParam(r, "action")
+	var req services.OrchestrationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if dryRun(r) {
+		plan, err := h.HostService.PlanOrchestrationRun(action, req)
+		if err != nil {
+			writeError(w, err, dependencyErrorStatus(err))
+			return
+		}
+		writeDryRunPlan(w, plan)
+		return
+	}
+	task, err := h.HostService.StartOrchestration(action, req)
+	if err != nil {
+		writeError(w, err, dependencyErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// --- VM Groups ---
+
+func vmGroupErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidSnapshotRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrVMGroupExists), errors.Is(err, services.ErrVMGroupEmpty),
+		errors.Is(err, services.ErrSnapshotExists), errors.Is(err, libvirt.ErrSnapshotUnsupported):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetVMGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := h.HostService.ListVMGroups()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+func (h *APIHandler) GetVMGroup(w http.ResponseWriter, r *http.Request) {
+	group, err := h.HostService.GetVMGroup(chi.URLParam(r, "groupName"))
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h *APIHandler) CreateVMGroup(w http.ResponseWriter, r *http.Request) {
+	var req services.VMGroupRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	group, err := h.HostService.CreateVMGroup(req)
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h *APIHandler) UpdateVMGroup(w http.ResponseWriter, r *http.Request) {
+	var req services.VMGroupRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	group, err := h.HostService.UpdateVMGroup(chi.URLParam(r, "groupName"), req)
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h *APIHandler) DeleteVMGroup(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteVMGroup(chi.URLParam(r, "groupName")); err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) AddVMGroupMember(w http.ResponseWriter, r *http.Request) {
+	var req services.VMGroupMemberRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	group, err := h.HostService.AddVMGroupMember(chi.URLParam(r, "groupName"), req)
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+func (h *APIHandler) RemoveVMGroupMember(w http.ResponseWriter, r *http.Request) {
+	err := h.HostService.RemoveVMGroupMember(chi.URLParam(r, "groupName"), chi.URLParam(r, "vmUUID"))
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VMGroupAction starts or stops the members of a group in their start
+// order.
+func (h *APIHandler) VMGroupAction(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "groupName")
+	var task *storage.Task
+	var err error
+	switch chi.URLParam(r, "action") {
+	case "start":
+		task, err = h.HostService.StartVMGroup(name)
+	case "stop":
+		task, err = h.HostService.StopVMGroup(name)
+	default:
+		writeErrorMessage(w, "Action must be start or stop", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// SnapshotVMGroup takes a snapshot of every member of a group.
+func (h *APIHandler) SnapshotVMGroup(w http.ResponseWriter, r *http.Request) {
+	var req services.SnapshotRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	task, err := h.HostService.SnapshotVMGroup(chi.URLParam(r, "groupName"), req)
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+func (h *APIHandler) GetVMGroupStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.HostService.GetVMGroupStats(chi.URLParam(r, "groupName"))
+	if err != nil {
+		writeError(w, err, vmGroupErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// --- Runbooks ---
+
+func runbookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrRunbookExists), errors.Is(err, services.ErrRunbookRunning):
+		return http.StatusConflict
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetRunbooks(w http.ResponseWriter, r *http.Request) {
+	books, err := h.HostService.ListRunbooks()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(books)
+}
+
+func (h *APIHandler) GetRunbook(w http.ResponseWriter, r *http.Request) {
+	book, err := h.HostService.GetRunbook(chi.URLParam(r, "runbookName"))
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+func (h *APIHandler) CreateRunbook(w http.ResponseWriter, r *http.Request) {
+	var req services.RunbookRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	book, err := h.HostService.CreateRunbook(req)
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(book)
+}
+
+func (h *APIHandler) UpdateRunbook(w http.ResponseWriter, r *http.Request) {
+	var req services.RunbookRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	book, err := h.HostService.UpdateRunbook(chi.URLParam(r, "runbookName"), req)
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(book)
+}
+
+func (h *APIHandler) DeleteRunbook(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.DeleteRunbook(chi.URLParam(r, "runbookName")); err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RunRunbook starts a run of a runbook, which goes on as a task.
+func (h *APIHandler) RunRunbook(w http.ResponseWriter, r *http.Request) {
+	var req services.RunbookRunRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	var userID uint
+	if user := h.sessionUser(r); user != nil {
+		userID = user.ID
+	}
+	run, err := h.HostService.RunRunbook(chi.URLParam(r, "runbookName"), userID, req)
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
+
+func (h *APIHandler) GetRunbookRuns(w http.ResponseWriter, r *http.Request) {
+	runs, err := h.HostService.ListRunbookRuns(chi.URLParam(r, "runbookName"))
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+func (h *APIHandler) GetRunbookRun(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "runID"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid run ID", http.StatusBadRequest)
+		return
+	}
+	run, err := h.HostService.GetRunbookRun(uint(id))
+	if err != nil {
+		writeError(w, err, runbookErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// --- MAC Addresses ---
+
+func (h *APIHandler) GetMACPool(w http.ResponseWriter, r *http.Request) {
+	pool, err := h.HostService.GetMACPool()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool)
+}
+
+func (h *APIHandler) SetMACPool(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Prefix string `json:"prefix"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	pool, err := h.HostService.SetMACPool(req.Prefix)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrInvalidMACPrefix) {
+			status = http.StatusBadRequest
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool)
+}
+
+func (h *APIHandler) GetMACConflicts(w http.ResponseWriter, r *http.Request) {
+	conflicts, err := h.HostService.ListMACConflicts()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+// --- Monitoring ---
+
+func monitoringErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidInterval):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetMonitoringSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetMonitoringSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetMonitoringSettings(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetMonitoringSettings(req.StatsIntervalSeconds)
+	if err != nil {
+		writeError(w, err, monitoringErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// SetHostMonitoring overrides the stats interval for all VMs of a host.
+func (h *APIHandler) SetHostMonitoring(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	var req struct {
+		StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetHostStatsInterval(hostID, req.StatsIntervalSeconds); err != nil {
+		writeError(w, err, monitoringErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) GetVMMonitoring(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	interval, err := h.HostService.GetVMStatsInterval(hostID, vmName)
+	if err != nil {
+		writeError(w, err, monitoringErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(interval)
+}
+
+// SetVMMonitoring overrides the stats interval for a single VM.
+func (h *APIHandler) SetVMMonitoring(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req struct {
+		StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	interval, err := h.HostService.SetVMStatsInterval(hostID, vmName, req.StatsIntervalSeconds)
+	if err != nil {
+		writeError(w, err, monitoringErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(interval)
+}
+
+// CreateVM defines a new VM on a host from a guest profile.
+func (h *APIHandler) CreateVM(w http.ResponseWriter, r *http.Request) {
+	var req services.VMCreateRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	vm, err := h.HostService.CreateVM(h.hostParam(r), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, libvirt.ErrInvalidVolumeSpec), errors.Is(err, services.ErrInvalidNICRequest):
+			status = http.StatusBadRequest
+		case errors.Is(err, libvirt.ErrDomainExists), errors.Is(err, services.ErrChecksumMismatch),
+			errors.Is(err, services.ErrMACInUse):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(vm)
+}
+
+// ListVMsFromLibvirt gets the unified view of VMs for a host. With a limit
+// or continue parameter it instead reads one page live from libvirt.
+func (h *APIHandler) ListVMsFromLibvirt(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	query := r.URL.Query()
+	if query.Has("limit") || query.Has("continue") {
+		var limit int
+		if value := query.Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				writeErrorMessage(w, "Invalid limit parameter", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		page, err := h.HostService.ListVMsPage(hostID, query.Get("continue"), limit)
+		if errors.Is(err, libvirt.ErrInvalidContinueToken) {
+			writeError(w, err, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, services.ErrHostGone) {
+			writeError(w, err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, err, http.StatusInternalServerError)
+			return
+		}
+		page.VMs = scopeVMs(projectScope(r), page.VMs)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	// Immediately get VMs from the DB for a fast response.
+	vms, err := h.HostService.GetVMsForHostFromDB(hostID)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	vms = scopeVMs(projectScope(r), vms)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vms)
+}
+
+// RefreshHostVMs syncs a host's VMs from libvirt and returns them.
+func (h *APIHandler) RefreshHostVMs(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.RefreshHostVMs(h.hostParam(r)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrHostGone) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	h.ListVMsFromLibvirt(w, r)
+}
+
+// RefreshVM syncs a VM from libvirt and returns its hardware.
+func (h *APIHandler) RefreshVM(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.RefreshVM(r.Context(), h.hostParam(r), chi.URLParam(r, "vmName")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrHostGone) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	h.GetVMHardware(w, r)
+}
+
+func (h *APIHandler) GetVMStats(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	stats, err := h.HostService.GetVMStats(hostID, vmName)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *APIHandler) GetVMHardware(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	hardware, err := h.HostService.GetVMHardware(hostID, vmName)
+	if err != nil {
+		writeError(w, err, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hardware)
+}
+
+// GetVMCapabilities reports which devices can be hot-plugged into a VM.
+func (h *APIHandler) GetVMCapabilities(w http.ResponseWriter, r *http.Request) {
+	caps, err := h.HostService.GetVMCapabilities(h.hostParam(r), chi.URLParam(r, "vmName"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caps)
+}
+
+func (h *APIHandler) GetVMScreenshot(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	img, err := h.HostService.GetVMScreenshot(hostID, vmName)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(img)
+}
+
+// GetVMProcessUsage reports what a VM's QEMU process costs its host.
+func (h *APIHandler) GetVMProcessUsage(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	usage, err := h.HostService.GetVMProcessUsage(hostID, vmName)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, libvirt.ErrDomainNotRunning) {
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// GetDiskBackingChain reports the backing file chain of a VM disk.
+func (h *APIHandler) GetDiskBackingChain(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	target := chi.URLParam(r, "target")
+	chain, err := h.HostService.GetDiskBackingChain(hostID, vmName, target)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, libvirt.ErrDiskNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(chain)
+}
+
+// AttachDisk adds a disk to a VM, optionally creating its volume.
+func (h *APIHandler) AttachDisk(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.DiskAttachRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	disk, err := h.HostService.AttachDisk(hostID, vmName, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidDiskRequest), errors.Is(err, libvirt.ErrInvalidVolumeSpec):
+			status = http.StatusBadRequest
+		case errors.Is(err, libvirt.ErrNoFreeDiskTarget), errors.Is(err, services.ErrChecksumMismatch),
+			errors.Is(err, libvirt.ErrHotplugUnsupported):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(disk)
+}
+
+// CompactVMDisks reclaims the space freed inside the disk images of a
+// shut-off VM as a task.
+func (h *APIHandler) CompactVMDisks(w http.ResponseWriter, r *http.Request) {
+	var req services.DiskCompactionRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	task, err := h.HostService.CompactVMDisks(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, libvirt.ErrDomainActive), errors.Is(err, libvirt.ErrCompactionUnsupported),
+			errors.Is(err, services.ErrDiskCompactionInProgress):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// TrimVMFilesystems discards the unused blocks of a running VM's
+// filesystems through its guest agent.
+func (h *APIHandler) TrimVMFilesystems(w http.ResponseWriter, r *http.Request) {
+	var req services.FstrimRequest
+	if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.TrimVMFilesystems(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *APIHandler) AttachNIC(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.NICAttachRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	nic, err := h.HostService.AttachNIC(hostID, vmName, req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, services.ErrInvalidNICRequest):
+			status = http.StatusBadRequest
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, services.ErrMACInUse), errors.Is(err, services.ErrMACPoolExhausted),
+			errors.Is(err, libvirt.ErrHotplugUnsupported):
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(nic)
+}
+
+// --- Custom Fields ---
+
+func customFieldErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrInvalidCustomField):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *APIHandler) GetVMCustomFields(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	fields, err := h.HostService.GetVMCustomFields(hostID, vmName)
+	if err != nil {
+		writeError(w, err, customFieldErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fields)
+}
+
+// ReplaceVMCustomFields replaces all custom fields of a VM.
+func (h *APIHandler) ReplaceVMCustomFields(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var fields map[string]string
+	if !decodeJSON(w, r, &fields) {
+		return
+	}
+	updated, err := h.HostService.ReplaceVMCustomFields(hostID, vmName, fields)
+	if err != nil {
+		writeError(w, err, customFieldErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *APIHandler) SetVMCustomField(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	name := chi.URLParam(r, "name")
+	var req struct {
+		Value string `json:"value"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetVMCustomField(hostID, vmName, name, req.Value); err != nil {
+		writeError(w, err, customFieldErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) DeleteVMCustomField(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	name := chi.URLParam(r, "name")
+	if err := h.HostService.DeleteVMCustomField(hostID, vmName, name); err != nil {
+		writeError(w, err, customFieldErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Labels ---
+
+func labelErrorStatus(err error) int {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// labelParam returns the label key from the path. Keys with a prefix contain
+// a '/', which clients escape as %2F.
+func labelParam(r *http.Request) (string, error) {
+	return url.PathUnescape(chi.URLParam(r, "key"))
+}
+
+// ListVMs lists the VMs of all hosts, filtered by the 'selector' query
+// parameter.
+func (h *APIHandler) ListVMs(w http.ResponseWriter, r *http.Request) {
+	vms, err := h.HostService.ListVMs(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	vms = scopeVMs(projectScope(r), vms)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vms)
+}
+
+func (h *APIHandler) GetVMLabels(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	labels, err := h.HostService.GetVMLabels(hostID, vmName)
+	if err != nil {
+		writeError(w, err, labelErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// ReplaceVMLabels replaces all labels of a VM.
+func (h *APIHandler) ReplaceVMLabels(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var labels map[string]string
+	if !decodeJSON(w, r, &labels) {
+		return
+	}
+	updated, err := h.HostService.ReplaceVMLabels(hostID, vmName, labels)
+	if err != nil {
+		writeError(w, err, labelErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+func (h *APIHandler) SetVMLabel(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	key, err := labelParam(r)
+	if err != nil {
+		writeErrorMessage(w, "Invalid label key", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Value string `json:"value"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetVMLabel(hostID, vmName, key, req.Value); err != nil {
+		writeError(w, err, labelErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) DeleteVMLabel(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	key, err := labelParam(r)
+	if err != nil {
+		writeErrorMessage(w, "Invalid label key", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.DeleteVMLabel(hostID, vmName, key); err != nil {
+		writeError(w, err, labelErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Cost Reports ---
+
+func (h *APIHandler) GetCostRates(w http.ResponseWriter, r *http.Request) {
+	rates, err := h.HostService.GetCostRates()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+func (h *APIHandler) SetCostRates(w http.ResponseWriter, r *http.Request) {
+	var req storage.CostRates
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	rates, err := h.HostService.SetCostRates(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// GetCostReport reports the usage and cost of VMs between the from and to
+// query parameters (RFC 3339), grouped by group_by, as JSON or, with
+// format=csv, as a CSV download.
+func (h *APIHandler) GetCostReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := services.CostReportFilter{GroupBy: query.Get("group_by")}
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeErrorMessage(w, fmt.Sprintf("Invalid %s parameter", param), http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeErrorMessage(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.HostService.GetCostReport(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if format != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	filename := fmt.Sprintf("cost-report-%s-%s.csv", report.From.Format("2006-01-02"), report.To.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	out := csv.NewWriter(w)
+	out.Write([]string{report.GroupBy, "vm_uuid", "host_id", "vms", "vcpu_hours", "memory_gb_hours", "storage_gb_hours",
+		"vcpu_cost", "memory_cost", "storage_cost", "cost", "currency"})
+	for _, row := range append(report.Rows, report.Total) {
+		out.Write([]string{csvText(row.Group), row.VMUUID, row.HostID, strconv.Itoa(row.VMs),
+			formatAmount(row.VCPUHours), formatAmount(row.MemoryGBHours), formatAmount(row.StorageGBHours),
+			formatAmount(row.VCPUCost), formatAmount(row.MemoryCost), formatAmount(row.StorageCost), formatAmount(row.Cost),
+			report.Currency})
+	}
+	out.Flush()
+}
+
+func formatAmount(x float64) string {
+	return strconv.FormatFloat(x, 'f', 2, 64)
+}
+
+// --- Availability ---
+
+// availabilityFilter reads the time range of an availability report: range,
+// a span up to now such as 30d or 12h, or from and to as RFC 3339 times. A
+// malformed one is answered with 400; it reports whether the handler can go
+// on.
+func availabilityFilter(w http.ResponseWriter, r *http.Request) (services.AvailabilityFilter, bool) {
+	query := r.URL.Query()
+	var filter services.AvailabilityFilter
+	if v := query.Get("range"); v != "" {
+		span, err := time.ParseDuration(v)
+		if days, ok := strings.CutSuffix(v, "d"); ok {
+			var n uint64
+			n, err = strconv.ParseUint(days, 10, 16)
+			span = time.Duration(n) * 24 * time.Hour
+		}
+		if err != nil {
+			writeErrorMessage(w, "Invalid range parameter", http.StatusBadRequest)
+			return filter, false
+		}
+		filter.To = time.Now()
+		filter.From = filter.To.Add(-span)
+		return filter, true
+	}
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeErrorMessage(w, fmt.Sprintf("Invalid %s parameter", param), http.StatusBadRequest)
+				return filter, false
+			}
+			*target = parsed
+		}
+	}
+	return filter, true
+}
+
+// GetVMAvailability reports how long a VM was running over a time range.
+func (h *APIHandler) GetVMAvailability(w http.ResponseWriter, r *http.Request) {
+	filter, ok := availabilityFilter(w, r)
+	if !ok {
+		return
+	}
+	availability, err := h.HostService.GetVMAvailability(h.hostParam(r), chi.URLParam(r, "vmName"), filter)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(availability)
+}
+
+// GetAvailabilityReport reports the availability of every VM over a time
+// range as JSON or, with format=csv, as a CSV download.
+func (h *APIHandler) GetAvailabilityReport(w http.ResponseWriter, r *http.Request) {
+	filter, ok := availabilityFilter(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeErrorMessage(w, "Invalid format parameter", http.StatusBadRequest)
+		return
+	}
+
+	report, err := h.HostService.GetAvailabilityReport(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	if format != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	filename := fmt.Sprintf("availability-report-%s-%s.csv", report.From.Format("2006-01-02"), report.To.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	out := csv.NewWriter(w)
+	out.Write([]string{"vm_name", "vm_uuid", "host_id", "from", "to", "total_seconds", "excluded_seconds",
+		"up_seconds", "down_seconds", "outages", "availability_percent"})
+	for _, vm := range report.VMs {
+		out.Write([]string{csvText(vm.VMName), vm.VMUUID, vm.HostID, vm.From.Format(time.RFC3339), vm.To.Format(time.RFC3339),
+			formatAmount(vm.TotalSeconds), formatAmount(vm.ExcludedSeconds), formatAmount(vm.UpSeconds), formatAmount(vm.DownSeconds),
+			strconv.Itoa(len(vm.Outages)), strconv.FormatFloat(vm.AvailabilityPercent, 'f', 3, 64)})
+	}
+	out.Flush()
+}
+
+// --- Exports ---
+
+// csvColumn is a column of a CSV export: a field of the exported struct,
+// named by its JSON name, and for map fields optionally one key of the map.
+type csvColumn struct {
+	name  string
+	index []int
+	key   string
+}
+
+// csvColumns returns the columns of a struct type, in field order.
+func csvColumns(t reflect.Type) []csvColumn {
+	var columns []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		columns = append(columns, csvColumn{name: name, index: field.Index})
+	}
+	return columns
+}
+
+// selectCSVColumns picks the columns named in a comma-separated list, in its
+// order. Map fields can be narrowed to one key with 'field.key', such as
+// labels.env. An empty list selects every column.
+func selectCSVColumns(available []csvColumn, t reflect.Type, list string) ([]csvColumn, error) {
+	if strings.TrimSpace(list) == "" {
+		return available, nil
+	}
+	var selected []csvColumn
+	var unknown []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		base, key, hasKey := strings.Cut(name, ".")
+		found := false
+		for _, column := range available {
+			if column.name != base || (hasKey && t.FieldByIndex(column.index).Type.Kind() != reflect.Map) {
+				continue
+			}
+			column.name, column.key = name, key
+			selected = append(selected, column)
+			found = true
+			break
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		names := make([]string, len(available))
+		for i, column := range available {
+			names[i] = column.name
+		}
+		return nil, &services.ValidationError{Fields: []services.FieldError{{
+			Field:   "columns",
+			Message: fmt.Sprintf("unknown columns %s; available are %s", strings.Join(unknown, ", "), strings.Join(names, ", ")),
+		}}}
+	}
+	return selected, nil
+}
+
+// csvCell formats a value for a CSV cell. Times are RFC 3339, maps are
+// sorted key=value pairs separated by ';' and other composite values JSON.
+func csvCell(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return csvText(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Map:
+		pairs := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", iter.Key(), iter.Value()))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ";")
+	}
+	encoded, err := json.Marshal(v.Interface())
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// csvText keeps spreadsheets from running a string as a formula by
+// prefixing it with a quote.
+func csvText(str string) string {
+	if str != "" && strings.ContainsRune("=+-@\t\r", rune(str[0])) {
+		return "'" + str
+	}
+	return str
+}
+
+// writeCSVExport writes a slice of structs as a CSV download with a header
+// row, limited to the columns named by the columns query parameter.
+func writeCSVExport(w http.ResponseWriter, r *http.Request, filename string, rows any) {
+	slice := reflect.ValueOf(rows)
+	t := slice.Type().Elem()
+	columns, err := selectCSVColumns(csvColumns(t), t, r.URL.Query().Get("columns"))
+	if err != nil {
+		writeError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	out := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.name
+	}
+	out.Write(header)
+	record := make([]string, len(columns))
+	for i := 0; i < slice.Len(); i++ {
+		row := slice.Index(i)
+		for j, column := range columns {
+			value := row.FieldByIndex(column.index)
+			if column.key != "" {
+				value = value.MapIndex(reflect.ValueOf(column.key))
+				if !value.IsValid() {
+					record[j] = ""
+					continue
+				}
+			}
+			record[j] = csvCell(value)
+		}
+		out.Write(record)
+	}
+	out.Flush()
+}
+
+// usageFilter reads the host, name and from/to (RFC 3339) query parameters
+// of a usage export. On failure it writes the error response and reports
+// false.
+func (h *APIHandler) usageFilter(w http.ResponseWriter, r *http.Request, nameParam string) (services.UsageFilter, bool) {
+	query := r.URL.Query()
+	filter := services.UsageFilter{Name: query.Get(nameParam)}
+	if v := query.Get("host"); v != "" {
+		filter.HostID = h.HostService.ResolveHostID(v)
+	}
+	for param, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := query.Get(param); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeErrorMessage(w, fmt.Sprintf("Invalid %s parameter", param), http.StatusBadRequest)
+				return filter, false
+			}
+			*target = parsed
+		}
+	}
+	return filter, true
+}
+
+// ExportVMs exports the VMs of all hosts, optionally filtered by a label
+// selector, as CSV.
+func (h *APIHandler) ExportVMs(w http.ResponseWriter, r *http.Request) {
+	vms, err := h.HostService.ListVMs(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeCSVExport(w, r, "vms.csv", scopeVMs(projectScope(r), vms))
+}
+
+// ExportHostCapacity exports the capacity of every connected host as CSV.
+func (h *APIHandler) ExportHostCapacity(w http.ResponseWriter, r *http.Request) {
+	capacities, err := h.HostService.ListHostCapacities()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeCSVExport(w, r, "host-capacity.csv", capacities)
+}
+
+// ExportVMUsage exports the sampled VM usage history as CSV.
+func (h *APIHandler) ExportVMUsage(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.usageFilter(w, r, "vm")
+	if !ok {
+		return
+	}
+	samples, err := h.HostService.ListVMUsage(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeCSVExport(w, r, "vm-usage.csv", samples)
+}
+
+// ExportPoolUsage exports the storage pool usage history as CSV.
+func (h *APIHandler) ExportPoolUsage(w http.ResponseWriter, r *http.Request) {
+	filter, ok := h.usageFilter(w, r, "pool")
+	if !ok {
+		return
+	}
+	rows, err := h.HostService.ListPoolUsage(filter)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeCSVExport(w, r, "pool-usage.csv", rows)
+}
+
+// SetVMStartup sets a VM's place in its host's startup sequence.
+func (h *APIHandler) SetVMStartup(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.VMStartupSettings
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetVMStartupSettings(hostID, vmName, req); err != nil {
+		writeError(w, err, startupErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetVMTuning returns a VM's CPU shares and block I/O weight.
+func (h *APIHandler) GetVMTuning(w http.ResponseWriter, r *http.Request) {
+	tuning, err := h.HostService.GetVMTuning(h.hostParam(r), chi.URLParam(r, "vmName"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tuning)
+}
+
+// SetVMTuning sets a VM's CPU shares and block I/O weight.
+func (h *APIHandler) SetVMTuning(w http.ResponseWriter, r *http.Request) {
+	var req services.VMTuningRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	tuning, err := h.HostService.SetVMTuning(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tuning)
+}
+
+// GetVMLaunchSecurity returns the SEV configuration and attestation info of a VM.
+func (h *APIHandler) GetVMLaunchSecurity(w http.ResponseWriter, r *http.Request) {
+	result, err := h.HostService.GetVMLaunchSecurity(h.hostParam(r), chi.URLParam(r, "vmName"))
+	if err != nil {
+		writeError(w, err, launchSecurityErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// SetVMLaunchSecurity enables or disables SEV memory encryption on a VM.
+func (h *APIHandler) SetVMLaunchSecurity(w http.ResponseWriter, r *http.Request) {
+	var req services.LaunchSecurityRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.SetVMLaunchSecurity(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		writeError(w, err, launchSecurityErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func launchSecurityErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, libvirt.ErrDomainActive), errors.Is(err, libvirt.ErrSEVUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetVMMachineType previews a machine type upgrade of a VM.
+func (h *APIHandler) GetVMMachineType(w http.ResponseWriter, r *http.Request) {
+	result, err := h.HostService.GetVMMachineType(h.hostParam(r), chi.URLParam(r, "vmName"), r.URL.Query().Get("target"))
+	if err != nil {
+		writeError(w, err, machineTypeErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// UpgradeVMMachineType moves a shut-off VM to another machine type.
+func (h *APIHandler) UpgradeVMMachineType(w http.ResponseWriter, r *http.Request) {
+	var req services.MachineTypeUpgradeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	change, err := h.HostService.UpgradeVMMachineType(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		writeError(w, err, machineTypeErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+// RollbackVMMachineType undoes the latest machine type change of a VM.
+func (h *APIHandler) RollbackVMMachineType(w http.ResponseWriter, r *http.Request) {
+	change, err := h.HostService.RollbackVMMachineType(h.hostParam(r), chi.URLParam(r, "vmName"))
+	if err != nil {
+		writeError(w, err, machineTypeErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(change)
+}
+
+// GetVMDefinitions lists the archived versions of a VM's definition.
+func (h *APIHandler) GetVMDefinitions(w http.ResponseWriter, r *http.Request) {
+	defs, err := h.HostService.ListVMDefinitions(h.hostParam(r), chi.URLParam(r, "vmName"))
+	if err != nil {
+		writeError(w, err, vmDefinitionErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(defs)
+}
+
+// GetVMDefinition returns an archived version of a VM's definition.
+func (h *APIHandler) GetVMDefinition(w http.ResponseWriter, r *http.Request) {
+	version, ok := parseDefinitionVersion(w, chi.URLParam(r, "version"))
+	if !ok {
+		return
+	}
+	def, err := h.HostService.GetVMDefinition(h.hostParam(r), chi.URLParam(r, "vmName"), version)
+	if err != nil {
+		writeError(w, err, vmDefinitionErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(def)
+}
+
+// DiffVMDefinition compares an archived version of a VM's definition with
+// the version given by ?to=, or with the current definition.
+func (h *APIHandler) DiffVMDefinition(w http.ResponseWriter, r *http.Request) {
+	from, ok := parseDefinitionVersion(w, chi.URLParam(r, "version"))
+	if !ok {
+		return
+	}
+	var to uint
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, ok = parseDefinitionVersion(w, value); !ok {
+			return
+		}
+	}
+	diff, err := h.HostService.DiffVMDefinitions(h.hostParam(r), chi.URLParam(r, "vmName"), from, to)
+	if err != nil {
+		writeError(w, err, vmDefinitionErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
+
+// RestoreVMDefinition puts an archived version of a VM's definition back.
+func (h *APIHandler) RestoreVMDefinition(w http.ResponseWriter, r *http.Request) {
+	version, ok := parseDefinitionVersion(w, chi.URLParam(r, "version"))
+	if !ok {
+		return
+	}
+	def, err := h.HostService.RestoreVMDefinition(h.hostParam(r), chi.URLParam(r, "vmName"), version)
+	if err != nil {
+		writeError(w, err, vmDefinitionErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(def)
+}
+
+func parseDefinitionVersion(w http.ResponseWriter, value string) (uint, bool) {
+	version, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || version == 0 {
+		writeErrorMessage(w, "Invalid definition version", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(version), true
+}
+
+func vmDefinitionErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, libvirt.ErrDefinitionMismatch):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func machineTypeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, libvirt.ErrUnknownMachineType):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, libvirt.ErrDomainActive), errors.Is(err, libvirt.ErrMachineTypeUpgradeBlocked),
+		errors.Is(err, services.ErrMachineTypeStartFailed):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// SetVMBalloonGuarantee sets the memory the balloon policy leaves a VM.
+func (h *APIHandler) SetVMBalloonGuarantee(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MinBytes uint64 `json:"min_bytes"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.SetVMBalloonGuarantee(h.hostParam(r), chi.URLParam(r, "vmName"), req.MinBytes); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetVMEvacuation sets what evacuating the VM's host does with it.
+func (h *APIHandler) SetVMEvacuation(w http.ResponseWriter, r *http.Request) {
+	var req services.VMEvacuationSettings
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.TargetHostID = h.HostService.ResolveHostID(req.TargetHostID)
+	if err := h.HostService.SetVMEvacuationSettings(h.hostParam(r), chi.URLParam(r, "vmName"), req); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Host Discovery ---
+
+// GetDiscovery lists the machines found by the latest discovery scan.
+func (h *APIHandler) GetDiscovery(w http.ResponseWriter, r *http.Request) {
+	status, err := h.HostService.GetDiscoveryStatus()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// ScanForHosts starts a discovery scan right away.
+func (h *APIHandler) ScanForHosts(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.ScanForHosts(); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrDiscoveryBusy) {
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *APIHandler) GetDiscoverySettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetDiscoverySettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetDiscoverySettings(w http.ResponseWriter, r *http.Request) {
+	var req services.DiscoverySettingsView
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetDiscoverySettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) GetSyncSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetSyncSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetSyncSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.SyncSettingsView
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetSyncSettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) GetForecastSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetForecastSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetForecastSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.ForecastSettingsView
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetForecastSettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// GetForecast predicts when hosts and pools run out of CPU, memory or
+// storage. The horizons (comma-separated days), history_days and method
+// query parameters override the settings.
+func (h *APIHandler) GetForecast(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := services.ForecastSettingsView{Method: query.Get("method")}
+	if v := query.Get("horizons"); v != "" {
+		for _, part := range strings.Split(v, ",") {
+			days, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+			if err != nil {
+				writeErrorMessage(w, "Invalid horizons parameter", http.StatusBadRequest)
+				return
+			}
+			req.HorizonsDays = append(req.HorizonsDays, uint(days))
+		}
+	}
+	if v := query.Get("history_days"); v != "" {
+		days, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			writeErrorMessage(w, "Invalid history_days parameter", http.StatusBadRequest)
+			return
+		}
+		req.HistoryDays = uint(days)
+	}
+	forecast, err := h.HostService.GetForecast(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forecast)
+}
+
+func (h *APIHandler) GetHealthSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetHealthSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func (h *APIHandler) SetHealthSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.HealthSettingsView
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetHealthSettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// GetSyncStatus returns the periodic sync schedule of the connected hosts.
+func (h *APIHandler) GetSyncStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.HostService.GetSyncStatus())
+}
+
+// GetGuestSettings returns the settings applied to new VMs.
+func (h *APIHandler) GetGuestSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetGuestSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// SetGuestSettings changes the settings applied to new VMs.
+func (h *APIHandler) SetGuestSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.GuestSettingsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetGuestSettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// GetTracingSettings returns where spans are exported.
+func (h *APIHandler) GetTracingSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := h.HostService.GetTracingSettings()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// SetTracingSettings changes where spans are exported.
+func (h *APIHandler) SetTracingSettings(w http.ResponseWriter, r *http.Request) {
+	var req services.TracingSettingsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	settings, err := h.HostService.SetTracingSettings(req)
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+func featureErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrFeatureNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrFeatureDisabled):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetFeatureFlags lists the feature flags with their defaults and overrides.
+func (h *APIHandler) GetFeatureFlags(w http.ResponseWriter, r *http.Request) {
+	flags, err := h.HostService.ListFeatureFlags()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flags)
+}
+
+// SetFeatureFlag overrides whether a feature is on and for which roles.
+func (h *APIHandler) SetFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	var req services.FeatureFlagRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	flag, err := h.HostService.SetFeatureFlag(chi.URLParam(r, "name"), req)
+	if err != nil {
+		writeError(w, err, featureErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+// ResetFeatureFlag puts a feature flag back to its default.
+func (h *APIHandler) ResetFeatureFlag(w http.ResponseWriter, r *http.Request) {
+	flag, err := h.HostService.ResetFeatureFlag(chi.URLParam(r, "name"))
+	if err != nil {
+		writeError(w, err, featureErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flag)
+}
+
+// AdoptDiscoveredHost adds a discovered machine as a host.
+func (h *APIHandler) AdoptDiscoveredHost(w http.ResponseWriter, r *http.Request) {
+	var req services.DiscoveryAdoptRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	host, err := h.HostService.AdoptDiscoveredHost(chi.URLParam(r, "address"), req)
+	if err != nil {
+		status := hostErrorStatus(err)
+		if errors.Is(err, services.ErrCandidateNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(host)
+}
+
+// --- Migration ---
+
+// PrecheckMigration reports what would prevent a VM from moving to another host.
+func (h *APIHandler) PrecheckMigration(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req struct {
+		TargetHostID string `json:"target_host_id"`
+	}
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	result, err := h.HostService.PrecheckMigration(hostID, vmName, h.HostService.ResolveHostID(req.TargetHostID))
+	if err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func migrationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrMissingMigrationTarget):
+		return http.StatusBadRequest
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrMigrationBlocked), errors.Is(err, services.ErrMigrationInProgress),
+		errors.Is(err, services.ErrMigrationCompleted), errors.Is(err, libvirt.ErrDomainActive),
+		errors.Is(err, libvirt.ErrColdMigrationUnsupported), errors.Is(err, libvirt.ErrDomainNotRunning),
+		errors.Is(err, libvirt.ErrNoMigrationRunning), errors.Is(err, services.ErrPostCopyStarted):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// StartColdMigration moves a shut-off VM to a host without shared storage.
+func (h *APIHandler) StartColdMigration(w http.ResponseWriter, r *http.Request) {
+	hostID := h.hostParam(r)
+	vmName := chi.URLParam(r, "vmName")
+	var req services.ColdMigrationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.TargetHostID = h.HostService.ResolveHostID(req.TargetHostID)
+	if dryRun(r) {
+		plan, err := h.HostService.PlanColdMigration(hostID, vmName, req)
+		if err != nil {
+			writeError(w, err, migrationErrorStatus(err))
+			return
+		}
+		writeDryRunPlan(w, plan)
+		return
+	}
+	job, err := h.HostService.StartColdMigration(hostID, vmName, req)
+	if err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// StartLiveMigration moves a running VM to another host as a task.
+func (h *APIHandler) StartLiveMigration(w http.ResponseWriter, r *http.Request) {
+	var req services.LiveMigrationRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	req.TargetHostID = h.HostService.ResolveHostID(req.TargetHostID)
+	task, err := h.HostService.StartLiveMigration(h.hostParam(r), chi.URLParam(r, "vmName"), req)
+	if err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(task)
+}
+
+// UpdateLiveMigration adjusts the bandwidth or downtime of a running live
+// migration, or switches it to post-copy.
+func (h *APIHandler) UpdateLiveMigration(w http.ResponseWriter, r *http.Request) {
+	var req services.LiveMigrationUpdate
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if err := h.HostService.UpdateLiveMigration(h.hostParam(r), chi.URLParam(r, "vmName"), req); err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AbortLiveMigration cancels a running live migration.
+func (h *APIHandler) AbortLiveMigration(w http.ResponseWriter, r *http.Request) {
+	if err := h.HostService.AbortLiveMigration(h.hostParam(r), chi.URLParam(r, "vmName")); err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIHandler) GetMigrationJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.HostService.ListMigrationJobs()
+	if err != nil {
+		writeError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (h *APIHandler) GetMigrationJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.ParseUint(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid migration job ID", http.StatusBadRequest)
+		return
+	}
+	job, err := h.HostService.GetMigrationJob(uint(jobID))
+	if err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// ResumeMigrationJob runs a failed or interrupted migration job again.
+func (h *APIHandler) ResumeMigrationJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.ParseUint(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid migration job ID", http.StatusBadRequest)
+		return
+	}
+	job, err := h.HostService.ResumeMigrationJob(uint(jobID))
+	if err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// DiscardMigrationJob forgets an unfinished migration job.
+func (h *APIHandler) DiscardMigrationJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.ParseUint(chi.URLParam(r, "jobID"), 10, 64)
+	if err != nil {
+		writeErrorMessage(w, "Invalid migration job ID", http.StatusBadRequest)
+		return
+	}
+	if err := h.HostService.DiscardMigrationJob(uint(jobID)); err != nil {
+		writeError(w, err, migrationErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Terraform ---
+
+// terraformFilter reads the host_id, pool and name query parameters.
+func terraformFilter(r *http.Request) services.TerraformFilter {
+	query := r.URL.Query()
+	return services.TerraformFilter{HostID: query.Get("host_id"), Pool: query.Get("pool"), Name: query.Get("name")}
+}
+
+// writeTerraform answers a Terraform read, 404 when the resource is gone.
+func writeTerraform(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(w, err, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// parseTerraformID reads the numeric ID of a network or volume.
+func parseTerraformID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		writeErrorMessage(w, "Invalid ID", http.StatusNotFound)
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func (h *APIHandler) GetTerraformHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := h.HostService.TerraformHosts(r.URL.Query().Get("name"))
+	writeTerraform(w, hosts, err)
+}
+
+func (h *APIHandler) GetTerraformHost(w http.ResponseWriter, r *http.Request) {
+	host, err := h.HostService.TerraformHost(chi.URLParam(r, "id"))
+	writeTerraform(w, host, err)
+}
+
+func (h *APIHandler) GetTerraformVMs(w http.ResponseWriter, r *http.Request) {
+	vms, err := h.HostService.TerraformVMs(terraformFilter(r))
+	writeTerraform(w, vms, err)
+}
+
+func (h *APIHandler) GetTerraformVM(w http.ResponseWriter, r *http.Request) {
+	vm, err := h.HostService.TerraformVM(chi.URLParam(r, "id"))
+	writeTerraform(w, vm, err)
+}
+
+func (h *APIHandler) GetTerraformNetworks(w http.ResponseWriter, r *http.Request) {
+	networks, err := h.HostService.TerraformNetworks(terraformFilter(r))
+	writeTerraform(w, networks, err)
+}
+
+func (h *APIHandler) GetTerraformNetwork(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseTerraformID(w, r)
+	if !ok {
+		return
+	}
+	network, err := h.HostService.TerraformNetwork(id)
+	writeTerraform(w, network, err)
+}
+
+func (h *APIHandler) GetTerraformVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes, err := h.HostService.TerraformVolumes(terraformFilter(r))
+	writeTerraform(w, volumes, err)
+}
+
+func (h *APIHandler) GetTerraformVolume(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseTerraformID(w, r)
+	if !ok {
+		return
+	}
+	volume, err := h.HostService.TerraformVolume(id)
+	writeTerraform(w, volume, err)
 }
 
 // --- VM Actions ---
 
 func (h *APIHandler) StartVM(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := h.hostParam(r)
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.StartVM(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.StartVM(r.Context(), hostID, vmName); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, services.ErrDiskCompactionInProgress) || errors.Is(err, services.ErrMigrationInProgress) {
+			status = http.StatusConflict
+		}
+		writeError(w, err, status)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *APIHandler) ShutdownVM(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := h.hostParam(r)
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.ShutdownVM(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.ShutdownVM(r.Context(), hostID, vmName); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *APIHandler) RebootVM(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := h.hostParam(r)
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.RebootVM(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.RebootVM(r.Context(), hostID, vmName); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *APIHandler) ForceOffVM(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := h.hostParam(r)
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.ForceOffVM(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.ForceOffVM(r.Context(), hostID, vmName); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *APIHandler) ForceResetVM(w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := h.hostParam(r)
 	vmName := chi.URLParam(r, "vmName")
-	if err := h.HostService.ForceResetVM(hostID, vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.HostService.ForceResetVM(r.Context(), hostID, vmName); err != nil {
+		writeError(w, err, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
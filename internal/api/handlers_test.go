@@ -0,0 +1,368 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/services"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+const testPassword = "correct horse"
+
+type testEnv struct {
+	handler *APIHandler
+	service *services.HostService
+	db      *gorm.DB
+}
+
+// newTestEnv returns a handler on a fresh database with the default roles.
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	db, err := storage.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	hub := ws.NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	connector := libvirt.NewConnector()
+	service := services.NewHostService(db, connector, hub)
+	return &testEnv{handler: NewAPIHandler(service, hub, db, connector), service: service, db: db}
+}
+
+// addUser creates a user with testPassword and returns a session token.
+func (e *testEnv) addUser(t *testing.T, username, role string) (uint, string) {
+	t.Helper()
+	user, err := e.service.CreateUser(0, services.UserRequest{Username: username, Password: testPassword, Role: role})
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	login, err := e.service.Login(username, testPassword, "192.0.2.1", "test")
+	if err != nil {
+		t.Fatalf("Login(%s): %v", username, err)
+	}
+	return user.ID, login.Token
+}
+
+func serve(handler http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// okHandler answers 200, with X-Session set when the request has a session.
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value(sessionContextKey{}).(*requestSession); ok {
+		w.Header().Set("X-Session", "yes")
+	}
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestProjectAccessFor(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   projectAccess
+		ok     bool
+	}{
+		{http.MethodGet, "me", projectAccess{open: true}, true},
+		{http.MethodGet, "ws", projectAccess{open: true}, true},
+		{http.MethodPost, "notifications/3/read", projectAccess{open: true}, true},
+		{http.MethodGet, "hosts", projectAccess{open: true}, true},
+		{http.MethodPost, "hosts", projectAccess{}, false},
+		{http.MethodGet, "export/vms", projectAccess{open: true}, true},
+		{http.MethodGet, "tasks", projectAccess{}, false},
+		{http.MethodGet, "hosts/kvm-01/vms", projectAccess{hostVisible: true, host: "kvm-01"}, true},
+		{http.MethodGet, "hosts/kvm-01/vms/web", projectAccess{kind: services.ResourceVM, host: "kvm-01", key: "web", role: services.ProjectViewer}, true},
+		{http.MethodPost, "hosts/kvm-01/vms/web/start", projectAccess{kind: services.ResourceVM, host: "kvm-01", key: "web", role: services.ProjectOperator}, true},
+		{http.MethodGet, "hosts/kvm-01/vms/web/console", projectAccess{kind: services.ResourceVM, host: "kvm-01", key: "web", role: services.ProjectOperator}, true},
+		{http.MethodPost, "hosts/kvm-01/vms/web/migrate", projectAccess{}, false},
+		{http.MethodPost, "hosts/kvm-01/refresh", projectAccess{kind: services.ResourceHost, host: "kvm-01", role: services.ProjectOperator}, true},
+		{http.MethodGet, "hosts/kvm-01/networks", projectAccess{hostVisible: true, host: "kvm-01"}, true},
+		{http.MethodPost, "hosts/kvm-01/networks", projectAccess{kind: services.ResourceHost, host: "kvm-01", role: services.ProjectAdmin}, true},
+		{http.MethodDelete, "hosts/kvm-01/networks/lan", projectAccess{kind: services.ResourceNetwork, host: "kvm-01", key: "lan", role: services.ProjectOperator}, true},
+		{http.MethodGet, "hosts/kvm-01/pools/default/volumes", projectAccess{hostVisible: true, host: "kvm-01"}, true},
+		{http.MethodGet, "hosts/kvm-01/pools/default/volumes/disk.qcow2", projectAccess{kind: services.ResourceVolume, host: "kvm-01", key: "default/disk.qcow2", role: services.ProjectViewer}, true},
+		{http.MethodGet, "hosts/kvm-01/pools/default/volumes/disk.qcow2/download", projectAccess{kind: services.ResourceVolume, host: "kvm-01", key: "default/disk.qcow2", role: services.ProjectOperator}, true},
+		{http.MethodGet, "hosts/kvm-01/stats", projectAccess{kind: services.ResourceHost, host: "kvm-01", role: services.ProjectViewer}, true},
+		{http.MethodPost, "hosts/kvm-01/power", projectAccess{kind: services.ResourceHost, host: "kvm-01", role: services.ProjectAdmin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			got, ok := projectAccessFor(tt.method, strings.Split(tt.path, "/"))
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, %t; want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestScopeProjectsWithoutUsers(t *testing.T) {
+	e := newTestEnv(t)
+	w := serve(e.handler.ScopeProjects(okHandler), http.MethodDelete, "/api/v1/hosts/kvm-01", "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("got %d, want %d before any user exists", w.Code, http.StatusOK)
+	}
+}
+
+func TestScopeProjects(t *testing.T) {
+	e := newTestEnv(t)
+	e.service.EnsureDefaultUsers()
+	for _, host := range []storage.Host{{ID: "h1", Name: "kvm-01", URI: "test:///one"}, {ID: "h2", Name: "kvm-02", URI: "test:///two"}} {
+		if err := e.db.Create(&host).Error; err != nil {
+			t.Fatalf("creating host: %v", err)
+		}
+	}
+	_, admin := e.addUser(t, "root", "admin")
+	viewerID, viewer := e.addUser(t, "vera", "viewer")
+	operatorID, operator := e.addUser(t, "otto", "viewer")
+	_, outsider := e.addUser(t, "olga", "viewer")
+	_, newbie := e.addUser(t, "nina", "viewer")
+	e.db.Model(&storage.User{}).Where("username = ?", "nina").Update("must_change_password", true)
+
+	// Without projects, any session reaches everything.
+	scoped := e.handler.ScopeProjects(okHandler)
+	if w := serve(scoped, http.MethodGet, "/api/v1/tasks", outsider, ""); w.Code != http.StatusOK {
+		t.Fatalf("without projects: got %d, want %d", w.Code, http.StatusOK)
+	}
+
+	project, err := e.service.CreateProject(0, services.ProjectRequest{Name: "web"})
+	if err != nil {
+		t.Fatalf("CreateProject: %v", err)
+	}
+	if _, err := e.service.AssignProjectResource(0, project.ID, services.ProjectResourceRequest{Kind: services.ResourceHost, HostID: "h1"}); err != nil {
+		t.Fatalf("AssignProjectResource: %v", err)
+	}
+	for id, role := range map[uint]string{viewerID: services.ProjectViewer, operatorID: services.ProjectOperator} {
+		if err := e.service.SetProjectMember(0, project.ID, id, role); err != nil {
+			t.Fatalf("SetProjectMember: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		token   string
+		want    int
+		session bool
+	}{
+		{"public route without session", http.MethodGet, "/api/v1/health", "", http.StatusOK, false},
+		{"login without session", http.MethodPost, "/api/v1/auth/login", "", http.StatusOK, false},
+		{"no session", http.MethodGet, "/api/v1/hosts", "", http.StatusUnauthorized, false},
+		{"unknown token", http.MethodGet, "/api/v1/hosts", "bogus", http.StatusUnauthorized, false},
+		{"destructive route without session", http.MethodPost, "/api/v1/hosts/prepare", "", http.StatusUnauthorized, false},
+		{"unrestricted user outside projects", http.MethodGet, "/api/v1/hosts/h2/vms/db", admin, http.StatusOK, true},
+		{"unrestricted user on unknown route", http.MethodGet, "/api/v1/tasks", admin, http.StatusOK, true},
+		{"open route", http.MethodGet, "/api/v1/ws", outsider, http.StatusOK, true},
+		{"unknown route for scoped user", http.MethodGet, "/api/v1/tasks", viewer, http.StatusForbidden, false},
+		{"viewer reads VM", http.MethodGet, "/api/v1/hosts/h1/vms/web", viewer, http.StatusOK, true},
+		{"viewer reads VM by host name", http.MethodGet, "/api/v1/hosts/kvm-01/vms/web", viewer, http.StatusOK, true},
+		{"viewer starts VM", http.MethodPost, "/api/v1/hosts/h1/vms/web/start", viewer, http.StatusForbidden, false},
+		{"viewer opens console", http.MethodGet, "/api/v1/hosts/h1/vms/web/console", viewer, http.StatusForbidden, false},
+		{"operator starts VM", http.MethodPost, "/api/v1/hosts/h1/vms/web/start", operator, http.StatusOK, true},
+		{"operator opens console", http.MethodGet, "/api/v1/hosts/h1/vms/web/console", operator, http.StatusOK, true},
+		{"operator powers off host", http.MethodPost, "/api/v1/hosts/h1/power", operator, http.StatusForbidden, false},
+		{"viewer lists VMs of project host", http.MethodGet, "/api/v1/hosts/h1/vms", viewer, http.StatusOK, true},
+		{"viewer lists VMs of other host", http.MethodGet, "/api/v1/hosts/h2/vms", viewer, http.StatusForbidden, false},
+		{"viewer reads VM of other host", http.MethodGet, "/api/v1/hosts/h2/vms/db", viewer, http.StatusForbidden, false},
+		{"non-member reads VM", http.MethodGet, "/api/v1/hosts/h1/vms/web", outsider, http.StatusForbidden, false},
+		{"password change pending", http.MethodGet, "/api/v1/hosts", newbie, http.StatusForbidden, false},
+		{"password change route", http.MethodPost, "/api/v1/me/password", newbie, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(scoped, tt.method, tt.path, tt.token, "")
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if session := w.Header().Get("X-Session") != ""; session != tt.session {
+				t.Errorf("session in context = %t, want %t", session, tt.session)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	e := newTestEnv(t)
+	e.service.EnsureDefaultUsers()
+	_, admin := e.addUser(t, "root", "admin")
+	_, operator := e.addUser(t, "otto", "operator")
+	_, viewer := e.addUser(t, "vera", "viewer")
+
+	tests := []struct {
+		name   string
+		action string
+		token  string
+		want   int
+	}{
+		{"no session", services.PermissionManageHosts, "", http.StatusUnauthorized},
+		{"admin manages hosts", services.PermissionManageHosts, admin, http.StatusOK},
+		{"operator manages hosts", services.PermissionManageHosts, operator, http.StatusForbidden},
+		{"viewer manages hosts", services.PermissionManageHosts, viewer, http.StatusForbidden},
+		{"admin manages storage", services.PermissionManageStorage, admin, http.StatusOK},
+		{"operator manages storage", services.PermissionManageStorage, operator, http.StatusOK},
+		{"viewer manages storage", services.PermissionManageStorage, viewer, http.StatusForbidden},
+		{"admin manages captures", services.PermissionManageCaptures, admin, http.StatusOK},
+		{"operator manages captures", services.PermissionManageCaptures, operator, http.StatusForbidden},
+		{"unknown permission", "nothing.at.all", admin, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := e.handler.RequireSession(e.handler.RequirePermission(tt.action)(okHandler))
+			if w := serve(handler, http.MethodPost, "/api/v1/hosts/h1/power", tt.token, ""); w.Code != tt.want {
+				t.Errorf("got %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	type request struct {
+		method string
+		key    string
+		body   string
+		token  int // Index into the test's tokens, -1 for none
+	}
+	tests := []struct {
+		name         string
+		setCookie    bool
+		requests     []request
+		wantStatuses []int
+		wantCalls    int
+		wantReplayed []bool
+	}{
+		{
+			name:         "retry is replayed",
+			requests:     []request{{"POST", "k1", `{"a":1}`, 0}, {"POST", "k1", `{"a":1}`, 0}},
+			wantStatuses: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    1,
+			wantReplayed: []bool{false, true},
+		},
+		{
+			name:         "different body is refused",
+			requests:     []request{{"POST", "k1", `{"a":1}`, 0}, {"POST", "k1", `{"a":2}`, 0}},
+			wantStatuses: []int{http.StatusCreated, http.StatusUnprocessableEntity},
+			wantCalls:    1,
+			wantReplayed: []bool{false, false},
+		},
+		{
+			name:         "keys belong to their user",
+			requests:     []request{{"POST", "k1", `{"a":1}`, 0}, {"POST", "k1", `{"a":1}`, 1}},
+			wantStatuses: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    2,
+			wantReplayed: []bool{false, false},
+		},
+		{
+			name:         "requests without a key run every time",
+			requests:     []request{{"POST", "", `{"a":1}`, 0}, {"POST", "", `{"a":1}`, 0}},
+			wantStatuses: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    2,
+			wantReplayed: []bool{false, false},
+		},
+		{
+			name:         "other methods ignore the key",
+			requests:     []request{{"PUT", "k1", `{"a":1}`, 0}, {"PUT", "k1", `{"a":1}`, 0}},
+			wantStatuses: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    2,
+			wantReplayed: []bool{false, false},
+		},
+		{
+			name:         "responses with cookies are not kept",
+			setCookie:    true,
+			requests:     []request{{"POST", "k1", `{"a":1}`, -1}, {"POST", "k1", `{"a":1}`, -1}},
+			wantStatuses: []int{http.StatusCreated, http.StatusCreated},
+			wantCalls:    2,
+			wantReplayed: []bool{false, false},
+		},
+		{
+			name:         "overlong key",
+			requests:     []request{{"POST", strings.Repeat("k", services.MaxIdempotencyKeyLength+1), `{}`, 0}},
+			wantStatuses: []int{http.StatusBadRequest},
+			wantCalls:    0,
+			wantReplayed: []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			e.service.EnsureDefaultUsers()
+			_, alice := e.addUser(t, "alice", "viewer")
+			_, bob := e.addUser(t, "bob", "viewer")
+			tokens := []string{alice, bob}
+
+			calls := 0
+			handler := e.handler.Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if tt.setCookie {
+					http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "secret"})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"id":7}`))
+			}))
+			for i, req := range tt.requests {
+				r := httptest.NewRequest(req.method, "/api/v1/hosts/h1/vms", strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set("Idempotency-Key", req.key)
+				}
+				if req.token >= 0 {
+					r.Header.Set("Authorization", "Bearer "+tokens[req.token])
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != tt.wantStatuses[i] {
+					t.Errorf("request %d: got %d, want %d: %s", i+1, w.Code, tt.wantStatuses[i], w.Body.String())
+				}
+				if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed[i] {
+					t.Errorf("request %d: replayed = %t, want %t", i+1, replayed, tt.wantReplayed[i])
+				}
+				if tt.wantReplayed[i] && w.Body.String() != `{"id":7}` {
+					t.Errorf("request %d: replayed body %q", i+1, w.Body.String())
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	e := newTestEnv(t)
+	var inner *httptest.ResponseRecorder
+	var handler http.Handler
+	handler = e.handler.Idempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inner == nil {
+			// A retry arriving while the first request is still running.
+			inner = serveWithKey(handler, "k1")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	if w := serveWithKey(handler, "k1"); w.Code != http.StatusAccepted {
+		t.Fatalf("first request: got %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if inner.Code != http.StatusConflict {
+		t.Errorf("retry during the request: got %d, want %d", inner.Code, http.StatusConflict)
+	}
+}
+
+func serveWithKey(handler http.Handler, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/h1/vms", strings.NewReader(`{}`))
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
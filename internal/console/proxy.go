@@ -7,22 +7,20 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/capsali/virtumancer-flash/internal/libvirt"
 	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 	"gorm.io/gorm"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for now.
-		// In production, you'd want to restrict this.
-		return true
-	},
+	CheckOrigin:     ws.CheckOrigin,
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	// noVNC and SPICE require the "binary" subprotocol.
@@ -34,7 +32,8 @@ var upgrader = websocket.Upgrader{
 // io.Reader and io.Writer interfaces directly.
 type wsConnWrapper struct {
 	*websocket.Conn
-	reader io.Reader
+	reader    io.Reader
+	onMessage func() // Called for every message received, e.g. to extend the read deadline
 }
 
 // Read implements the io.Reader interface. It reads from the current websocket
@@ -59,6 +58,9 @@ func (w *wsConnWrapper) Read(p []byte) (n int, err error) {
 	if err != nil {
 		return 0, err
 	}
+	if w.onMessage != nil {
+		w.onMessage()
+	}
 
 	// We only proxy binary and text messages. Other types are ignored.
 	if mt != websocket.BinaryMessage && mt != websocket.TextMessage {
@@ -92,80 +94,162 @@ func (w *wsConnWrapper) Close() error {
 	return w.Conn.Close()
 }
 
-// HandleConsole finds the VM's VNC console details and proxies the connection.
-func HandleConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
-	vmName := chi.URLParam(r, "vmName")
-
-	wsConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade websocket for console: %v", err)
-		return
-	}
-	defer wsConn.Close()
-
-	// Wrap the websocket connection to make it an io.ReadWriteCloser
-	wrappedWsConn := &wsConnWrapper{Conn: wsConn}
+// Display is a graphics device of a VM that a console can attach to.
+type Display struct {
+	Index   int    `json:"index"`    // Position among the VM's graphics devices, for the display query parameter
+	Type    string `json:"type"`     // 'vnc' or 'spice'
+	Port    int    `json:"port"`     // 0 if the device has no plain port allocated, e.g. while the VM is off
+	TLSPort int    `json:"tls_port"` // SPICE only; 0 if the device has no TLS port
+	TLS     bool   `json:"tls"`      // Whether the device offers a TLS port
+	Listen  string `json:"listen"`   // Listen address as configured in the domain XML
+
+	// SPICE only: whether each channel must use the TLS port ('secure'), the
+	// plain port ('insecure') or either ('any'), by channel name.
+	DefaultMode string            `json:"default_mode,omitempty"`
+	Channels    map[string]string `json:"channels,omitempty"`
+}
 
-	// Get libvirt connection for the host
-	lvConn, err := connector.GetConnection(hostID)
-	if err != nil {
-		log.Printf("Console proxy error: could not get libvirt connection for host %s: %v", hostID, err)
-		return
-	}
+// usable reports whether the proxy has a port to connect to.
+func (d Display) usable() bool {
+	return d.Port > 0 || d.TLSPort > 0
+}
 
-	// Find the domain (VM)
-	domain, err := lvConn.DomainLookupByName(vmName)
+// ListDisplays returns all graphics devices of a VM in the order of its
+// domain XML. A VM can have several, e.g. both VNC and SPICE.
+func ListDisplays(connector *libvirt.Connector, hostID, vmName string) ([]Display, error) {
+	xmlDesc, err := connector.GetDomainXML(hostID, vmName)
 	if err != nil {
-		log.Printf("Console proxy error: could not find VM %s on host %s: %v", vmName, hostID, err)
-		return
+		return nil, err
 	}
 
-	// Get the VM's XML definition to find graphics details
-	xmlDesc, err := lvConn.DomainGetXMLDesc(domain, 0)
-	if err != nil {
-		log.Printf("Console proxy error: failed to get XML for %s: %v", vmName, err)
-		return
+	type Channel struct {
+		Name string `xml:"name,attr"`
+		Mode string `xml:"mode,attr"`
 	}
-
-	// Parse the XML to find the VNC port
 	type Graphics struct {
-		Type string `xml:"type,attr"`
-		Port string `xml:"port,attr"`
-		Host string `xml:"listen,attr"`
+		Type        string    `xml:"type,attr"`
+		Port        string    `xml:"port,attr"`
+		TlsPort     string    `xml:"tlsPort,attr"`
+		Listen      string    `xml:"listen,attr"`
+		DefaultMode string    `xml:"defaultMode,attr"`
+		Channels    []Channel `xml:"channel"`
 	}
 	type DomainDef struct {
 		Graphics []Graphics `xml:"devices>graphics"`
 	}
-
 	var def DomainDef
 	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
-		log.Printf("Console proxy error: failed to parse XML for %s: %v", vmName, err)
-		return
+		return nil, fmt.Errorf("failed to parse XML for %s: %w", vmName, err)
 	}
 
-	var vncPort, vncHost string
-	for _, g := range def.Graphics {
-		if strings.ToLower(g.Type) == "vnc" {
-			vncPort = g.Port
-			vncHost = g.Host
-			break
+	// Libvirt reports -1 for autoport until the VM runs; we can't connect to that.
+	port := func(value string) int {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	displays := make([]Display, 0, len(def.Graphics))
+	for i, g := range def.Graphics {
+		d := Display{
+			Index:   i,
+			Type:    strings.ToLower(g.Type),
+			Port:    port(g.Port),
+			TLSPort: port(g.TlsPort),
+			Listen:  g.Listen,
 		}
+		d.TLS = d.TLSPort > 0
+		if d.Type == "spice" {
+			d.DefaultMode = g.DefaultMode
+			if d.DefaultMode == "" {
+				d.DefaultMode = "any"
+			}
+			for _, c := range g.Channels {
+				if d.Channels == nil {
+					d.Channels = make(map[string]string)
+				}
+				d.Channels[c.Name] = c.Mode
+			}
+		}
+		displays = append(displays, d)
+	}
+	return displays, nil
+}
+
+// parseDisplayIndex reads the optional display query parameter, -1 if absent.
+func parseDisplayIndex(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("display")
+	if value == "" {
+		return -1, nil
+	}
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("invalid display %q", value)
+	}
+	return index, nil
+}
+
+// selectDisplay picks the display a console attaches to: the one at index,
+// which must be of the given type, or the first usable one of that type if
+// index is -1.
+func selectDisplay(displays []Display, kind string, index int) (*Display, error) {
+	if index >= 0 {
+		if index >= len(displays) {
+			return nil, fmt.Errorf("the VM has no display %d", index)
+		}
+		d := displays[index]
+		if d.Type != kind {
+			return nil, fmt.Errorf("display %d is a %s display, not %s", index, d.Type, kind)
+		}
+		if !d.usable() {
+			return nil, fmt.Errorf("display %d has no port allocated", index)
+		}
+		return &d, nil
+	}
+	for _, d := range displays {
+		if d.Type == kind && d.usable() {
+			return &d, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not configured or enabled", kind)
+}
+
+// HandleConsole finds the VM's VNC console details and proxies the connection.
+// The display query parameter selects one of several graphics devices.
+func HandleConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWriter, r *http.Request) {
+	hostID := storage.ResolveHostID(db, chi.URLParam(r, "hostID"))
+	vmName := chi.URLParam(r, "vmName")
+
+	index, err := parseDisplayIndex(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if vncPort == "" {
-		log.Printf("Console proxy error: VNC not configured or enabled for VM %s", vmName)
+	wsConn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade websocket for console: %v", err)
 		return
 	}
+	defer wsConn.Close()
 
-	// Libvirt reports -1 for autoport, but we can't connect to that.
-	if vncPort == "-1" {
-		log.Printf("Console proxy error: VNC port is set to autoport (-1), cannot connect for VM %s", vmName)
+	displays, err := ListDisplays(connector, hostID, vmName)
+	if err != nil {
+		log.Printf("Console proxy error: %v", err)
 		return
 	}
+	display, err := selectDisplay(displays, "vnc", index)
+	if err != nil {
+		log.Printf("Console proxy error: VM %s: %v", vmName, err)
+		return
+	}
+	vncPort := strconv.Itoa(display.Port)
+	vncHost := display.Listen
 
 	// *** FIX: If listen address is local, empty, or unspecified, use the host's actual address from the DB. ***
-	if vncHost == "" || vncHost == "127.0.0.1" || vncHost == "0.0.0.0" || vncHost == "::" {
+	// Hosts reached through an agent tunnel dial from the hypervisor itself, so local addresses are fine there.
+	if !connector.IsTunneled(hostID) && (vncHost == "" || vncHost == "127.0.0.1" || vncHost == "0.0.0.0" || vncHost == "::") {
 		var host storage.Host
 		if result := db.First(&host, "id = ?", hostID); result.Error != nil {
 			log.Printf("Console proxy error: could not find host %s in DB to determine address: %v", hostID, result.Error)
@@ -188,111 +272,54 @@ func HandleConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWri
 		log.Printf("VNC listen address was local; resolved to hypervisor address: %s", vncHost)
 	}
 
-	targetAddr := fmt.Sprintf("%s:%s", vncHost, vncPort)
+	targetAddr := net.JoinHostPort(vncHost, vncPort)
 	log.Printf("Proxying console for %s to VNC target %s", vmName, targetAddr)
 
 	// Dial the actual VNC service on the hypervisor
-	target, err := net.Dial("tcp", targetAddr)
+	target, err := connector.DialHostTCP(hostID, targetAddr)
 	if err != nil {
 		log.Printf("Console proxy error: failed to connect to VNC service at %s: %v", targetAddr, err)
 		return
 	}
 	defer target.Close()
 
-	// Start proxying data in both directions
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		io.Copy(target, wrappedWsConn)
-	}()
-	go func() {
-		defer wg.Done()
-		io.Copy(wrappedWsConn, target)
-	}()
-
-	wg.Wait()
-	log.Printf("VNC console proxy session ended for %s", vmName)
+	session := sessions.open(SessionInfo{HostID: hostID, VMName: vmName, Protocol: "vnc", Display: display.Index, Client: r.RemoteAddr})
+	proxySession(session, wsConn, target, LoadSettings(db))
 }
 
 // HandleSpiceConsole finds the VM's SPICE console details and proxies the connection.
+// The display query parameter selects one of several graphics devices.
 func HandleSpiceConsole(db *gorm.DB, connector *libvirt.Connector, w http.ResponseWriter, r *http.Request) {
-	hostID := chi.URLParam(r, "hostID")
+	hostID := storage.ResolveHostID(db, chi.URLParam(r, "hostID"))
 	vmName := chi.URLParam(r, "vmName")
 
-	wsConn, err := upgrader.Upgrade(w, r, nil)
+	index, err := parseDisplayIndex(r)
 	if err != nil {
-		log.Printf("Failed to upgrade websocket for SPICE console: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer wsConn.Close()
-
-	// Wrap the websocket connection to make it an io.ReadWriteCloser.
-	// SPICE-HTML5 client expects binary messages.
-	wrappedWsConn := &wsConnWrapper{Conn: wsConn}
 
-	// Get libvirt connection for the host
-	lvConn, err := connector.GetConnection(hostID)
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("SPICE proxy error: could not get libvirt connection for host %s: %v", hostID, err)
+		log.Printf("Failed to upgrade websocket for SPICE console: %v", err)
 		return
 	}
+	defer wsConn.Close()
 
-	// Find the domain (VM)
-	domain, err := lvConn.DomainLookupByName(vmName)
+	displays, err := ListDisplays(connector, hostID, vmName)
 	if err != nil {
-		log.Printf("SPICE proxy error: could not find VM %s on host %s: %v", vmName, hostID, err)
+		log.Printf("SPICE proxy error: %v", err)
 		return
 	}
-
-	// Get the VM's XML definition to find graphics details
-	xmlDesc, err := lvConn.DomainGetXMLDesc(domain, 0)
+	display, err := selectDisplay(displays, "spice", index)
 	if err != nil {
-		log.Printf("SPICE proxy error: failed to get XML for %s: %v", vmName, err)
-		return
-	}
-
-	// Parse the XML to find the SPICE port
-	type Graphics struct {
-		XMLName xml.Name `xml:"graphics"`
-		Type    string   `xml:"type,attr"`
-		Port    string   `xml:"port,attr"`
-		TlsPort string   `xml:"tlsPort,attr"`
-		Listen  string   `xml:"listen,attr"`
-	}
-	type DomainDef struct {
-		XMLName  xml.Name   `xml:"domain"`
-		Graphics []Graphics `xml:"devices>graphics"`
-	}
-
-	var def DomainDef
-	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
-		log.Printf("SPICE proxy error: failed to parse XML for %s: %v", vmName, err)
-		return
-	}
-
-	var spicePort, spiceHost string
-	// Prioritize TLS port if available, otherwise fall back to regular port.
-	for _, g := range def.Graphics {
-		if strings.ToLower(g.Type) == "spice" {
-			if g.TlsPort != "" && g.TlsPort != "-1" {
-				spicePort = g.TlsPort
-			} else if g.Port != "" && g.Port != "-1" {
-				spicePort = g.Port
-			}
-			spiceHost = g.Listen
-			break
-		}
-	}
-
-	if spicePort == "" {
-		log.Printf("SPICE proxy error: SPICE not configured or enabled for VM %s", vmName)
+		log.Printf("SPICE proxy error: VM %s: %v", vmName, err)
 		return
 	}
+	spiceHost := display.Listen
 
 	// If listen address is local, empty, or unspecified, use the host's actual address from the DB.
-	if spiceHost == "" || spiceHost == "127.0.0.1" || spiceHost == "0.0.0.0" || spiceHost == "::" {
+	if !connector.IsTunneled(hostID) && (spiceHost == "" || spiceHost == "127.0.0.1" || spiceHost == "0.0.0.0" || spiceHost == "::") {
 		var host storage.Host
 		if result := db.First(&host, "id = ?", hostID); result.Error != nil {
 			log.Printf("SPICE proxy error: could not find host %s in DB to determine address: %v", hostID, result.Error)
@@ -315,34 +342,50 @@ func HandleSpiceConsole(db *gorm.DB, connector *libvirt.Connector, w http.Respon
 		log.Printf("SPICE listen address was local; resolved to hypervisor address: %s", spiceHost)
 	}
 
-	targetAddr := fmt.Sprintf("%s:%s", spiceHost, spicePort)
-	log.Printf("Proxying console for %s to SPICE target %s", vmName, targetAddr)
+	// The link message tells which channel this connection is for, and so
+	// which port it has to use. It is passed on once connected.
+	wsConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	_, link, err := wsConn.ReadMessage()
+	if err != nil {
+		log.Printf("SPICE proxy error: no link message from client for %s: %v", vmName, err)
+		return
+	}
+	channel, err := spiceLinkChannel(link)
+	if err != nil {
+		log.Printf("SPICE proxy error: %s: %v", vmName, err)
+		return
+	}
+	spicePort, secure, err := spiceChannelPort(display, channel)
+	if err != nil {
+		log.Printf("SPICE proxy error: VM %s: %v", vmName, err)
+		return
+	}
+
+	targetAddr := net.JoinHostPort(spiceHost, strconv.Itoa(spicePort))
+	log.Printf("Proxying SPICE %s channel for %s to %s (TLS: %t)", channel, vmName, targetAddr, secure)
 
 	// Dial the actual SPICE service on the hypervisor.
-	// Note: This simple proxy does not handle TLS between the proxy and the SPICE server.
-	// For production, a TLS dialer would be needed if connecting to a TlsPort.
-	target, err := net.Dial("tcp", targetAddr)
+	target, err := connector.DialHostTCP(hostID, targetAddr)
 	if err != nil {
 		log.Printf("SPICE proxy error: failed to connect to SPICE service at %s: %v", targetAddr, err)
 		return
 	}
+	if secure {
+		if target, err = dialSpiceTLS(target, spiceHost); err != nil {
+			log.Printf("SPICE proxy error: %s: %v", targetAddr, err)
+			return
+		}
+	}
 	defer target.Close()
+	if _, err := target.Write(link); err != nil {
+		log.Printf("SPICE proxy error: failed to pass on link message to %s: %v", targetAddr, err)
+		return
+	}
 
-	// Start proxying data in both directions
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		io.Copy(target, wrappedWsConn)
-	}()
-	go func() {
-		defer wg.Done()
-		io.Copy(wrappedWsConn, target)
-	}()
-
-	wg.Wait()
-	log.Printf("SPICE console proxy session ended for %s", vmName)
+	// SPICE-HTML5 client expects binary messages, which the proxy sends.
+	session := sessions.open(SessionInfo{HostID: hostID, VMName: vmName, Protocol: "spice", Display: display.Index, Channel: channel, Client: r.RemoteAddr})
+	session.bytesIn.Add(uint64(len(link)))
+	proxySession(session, wsConn, target, LoadSettings(db))
 }
 
 
@@ -0,0 +1,239 @@
+package console
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+// DefaultPingInterval is how often idle console WebSockets are pinged unless
+// configured otherwise. It stays below the common 60 second idle timeout of
+// reverse proxies and load balancers.
+const DefaultPingInterval = 30 * time.Second
+
+// Settings are the keepalive and idle limits applied to new console sessions.
+type Settings struct {
+	PingInterval time.Duration
+	IdleTimeout  time.Duration // 0 keeps idle sessions open
+}
+
+// LoadSettings reads the console settings, falling back to the defaults.
+func LoadSettings(db *gorm.DB) Settings {
+	settings := Settings{PingInterval: DefaultPingInterval}
+	var row storage.ConsoleSettings
+	if err := db.Limit(1).Find(&row).Error; err != nil {
+		log.Printf("Warning: failed to load console settings, using defaults: %v", err)
+		return settings
+	}
+	if row.PingIntervalSeconds > 0 {
+		settings.PingInterval = time.Duration(row.PingIntervalSeconds) * time.Second
+	}
+	settings.IdleTimeout = time.Duration(row.IdleTimeoutSeconds) * time.Second
+	return settings
+}
+
+// SessionInfo describes an open console session.
+type SessionInfo struct {
+	ID           uint64    `json:"id"`
+	HostID       string    `json:"host_id"`
+	VMName       string    `json:"vm_name"`
+	Protocol     string    `json:"protocol"`          // 'vnc' or 'spice'
+	Display      int       `json:"display"`           // Index of the graphics device, see ListDisplays
+	Channel      string    `json:"channel,omitempty"` // SPICE channel, e.g. 'main' or 'playback'; one session per channel
+	Client       string    `json:"client"`            // Remote address of the browser
+	StartedAt    time.Time `json:"started_at"`
+	LastActivity time.Time `json:"last_activity"`
+	BytesIn      uint64    `json:"bytes_in"`  // From the client to the VM
+	BytesOut     uint64    `json:"bytes_out"` // From the VM to the client
+}
+
+// session is a proxied console connection and its traffic counters.
+type session struct {
+	info         SessionInfo
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	lastActivity atomic.Int64 // Unix nanoseconds
+}
+
+func (s *session) touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// sessionRegistry tracks open sessions and the totals of closed ones.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+
+	opened     atomic.Uint64
+	idleClosed atomic.Uint64
+	closedIn   atomic.Uint64 // Bytes of sessions that have ended
+	closedOut  atomic.Uint64
+}
+
+var sessions = &sessionRegistry{sessions: make(map[uint64]*session)}
+
+func (r *sessionRegistry) open(info SessionInfo) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	info.ID = r.nextID
+	info.StartedAt = time.Now()
+	s := &session{info: info}
+	s.touch()
+	r.sessions[info.ID] = s
+	r.opened.Add(1)
+	return s
+}
+
+func (r *sessionRegistry) close(s *session) {
+	r.mu.Lock()
+	delete(r.sessions, s.info.ID)
+	r.mu.Unlock()
+	r.closedIn.Add(s.bytesIn.Load())
+	r.closedOut.Add(s.bytesOut.Load())
+}
+
+func (s *session) snapshot() SessionInfo {
+	info := s.info
+	info.BytesIn = s.bytesIn.Load()
+	info.BytesOut = s.bytesOut.Load()
+	info.LastActivity = time.Unix(0, s.lastActivity.Load())
+	return info
+}
+
+// Sessions returns the open console sessions, oldest first.
+func Sessions() []SessionInfo {
+	sessions.mu.Lock()
+	list := make([]SessionInfo, 0, len(sessions.sessions))
+	for _, s := range sessions.sessions {
+		list = append(list, s.snapshot())
+	}
+	sessions.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// WriteMetrics writes the console proxy metrics in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) {
+	open := Sessions()
+	in, out := sessions.closedIn.Load(), sessions.closedOut.Load()
+	for _, s := range open {
+		in += s.BytesIn
+		out += s.BytesOut
+	}
+
+	fmt.Fprintln(w, "# HELP virtumancer_console_sessions Open console sessions.")
+	fmt.Fprintln(w, "# TYPE virtumancer_console_sessions gauge")
+	fmt.Fprintf(w, "virtumancer_console_sessions %d\n", len(open))
+	fmt.Fprintln(w, "# HELP virtumancer_console_sessions_opened_total Console sessions opened since startup.")
+	fmt.Fprintln(w, "# TYPE virtumancer_console_sessions_opened_total counter")
+	fmt.Fprintf(w, "virtumancer_console_sessions_opened_total %d\n", sessions.opened.Load())
+	fmt.Fprintln(w, "# HELP virtumancer_console_sessions_idle_closed_total Console sessions closed by the idle timeout.")
+	fmt.Fprintln(w, "# TYPE virtumancer_console_sessions_idle_closed_total counter")
+	fmt.Fprintf(w, "virtumancer_console_sessions_idle_closed_total %d\n", sessions.idleClosed.Load())
+	fmt.Fprintln(w, "# HELP virtumancer_console_bytes_total Bytes proxied by all console sessions since startup.")
+	fmt.Fprintln(w, "# TYPE virtumancer_console_bytes_total counter")
+	fmt.Fprintf(w, "virtumancer_console_bytes_total{direction=\"in\"} %d\n", in)
+	fmt.Fprintf(w, "virtumancer_console_bytes_total{direction=\"out\"} %d\n", out)
+	fmt.Fprintln(w, "# HELP virtumancer_console_session_bytes Bytes proxied by an open console session.")
+	fmt.Fprintln(w, "# TYPE virtumancer_console_session_bytes gauge")
+	for _, s := range open {
+		labels := fmt.Sprintf("session=\"%d\",host=%q,vm=%q,protocol=%q", s.ID, s.HostID, s.VMName, s.Protocol)
+		fmt.Fprintf(w, "virtumancer_console_session_bytes{%s,direction=\"in\"} %d\n", labels, s.BytesIn)
+		fmt.Fprintf(w, "virtumancer_console_session_bytes{%s,direction=\"out\"} %d\n", labels, s.BytesOut)
+	}
+}
+
+// countingWriter counts the bytes written through it into a session.
+type countingWriter struct {
+	w       io.Writer
+	count   *atomic.Uint64
+	session *session
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if n > 0 {
+		c.count.Add(uint64(n))
+		c.session.touch()
+	}
+	return n, err
+}
+
+// proxySession copies data between a console WebSocket and the VM's display
+// until either side goes away. The WebSocket is pinged to keep intermediate
+// proxies from dropping it, and is considered dead if the client stops
+// answering. With an idle timeout, sessions without traffic are closed.
+func proxySession(s *session, wsConn *websocket.Conn, target io.ReadWriteCloser, settings Settings) {
+	sessionLog := fmt.Sprintf("%s console session %d for %s", s.info.Protocol, s.info.ID, s.info.VMName)
+	defer func() {
+		sessions.close(s)
+		info := s.snapshot()
+		log.Printf("%s ended after %s (%d bytes in, %d bytes out)", sessionLog,
+			time.Since(info.StartedAt).Round(time.Second), info.BytesIn, info.BytesOut)
+	}()
+
+	// A client that misses two pings in a row is gone.
+	pongWait := 2 * settings.PingInterval
+	wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	wsConn.SetPongHandler(func(string) error {
+		return wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	wrappedWsConn := &wsConnWrapper{Conn: wsConn, onMessage: func() {
+		wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	}}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(settings.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if settings.IdleTimeout > 0 && time.Since(time.Unix(0, s.lastActivity.Load())) > settings.IdleTimeout {
+				log.Printf("%s idle for %s, closing", sessionLog, settings.IdleTimeout)
+				sessions.idleClosed.Add(1)
+				wsConn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"), time.Now().Add(time.Second))
+				wsConn.Close()
+				target.Close()
+				return
+			}
+			if err := wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Start proxying data in both directions; when one direction ends, close
+	// both ends so the other one does too.
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{w: target, count: &s.bytesIn, session: s}, wrappedWsConn)
+		target.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&countingWriter{w: wrappedWsConn, count: &s.bytesOut, session: s}, target)
+		wsConn.Close()
+	}()
+
+	wg.Wait()
+	close(done)
+}
@@ -0,0 +1,112 @@
+package libvirt
+
+import (
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// BalloonStats is the memory balloon of a running domain. Sizes are in bytes.
+type BalloonStats struct {
+	Name    string `json:"name"`
+	Current uint64 `json:"current"` // Memory the guest currently has
+	Maximum uint64 `json:"maximum"` // Memory the balloon can grow back to
+	Unused  uint64 `json:"unused"`  // Memory the guest reports as free
+	// The guest's balloon driver reports its free memory, so it can be
+	// shrunk without guessing at what it uses.
+	Cooperating bool `json:"cooperating"`
+}
+
+// HostMemory is the memory of a host available to new allocations. Page
+// cache and buffers count as available, as the kernel drops them on demand.
+type HostMemory struct {
+	Total     uint64 `json:"total"`
+	Available uint64 `json:"available"`
+}
+
+// GetBalloonStats returns the balloons of the running domains of a host in a
+// single call.
+func (c *Connector) GetBalloonStats(hostID string) ([]BalloonStats, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := l.ConnectGetAllDomainStats(nil, uint32(libvirt.DomainStatsBalloon),
+		uint32(libvirt.ConnectGetAllDomainsStatsRunning))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balloon stats for host %s: %w", hostID, err)
+	}
+
+	balloons := make([]BalloonStats, 0, len(records))
+	for _, record := range records {
+		values := make(map[string]interface{}, len(record.Params))
+		for _, p := range record.Params {
+			values[p.Field] = p.Value.I
+		}
+		_, reportsUnused := values["balloon.unused"]
+		balloons = append(balloons, BalloonStats{
+			Name:        record.Dom.Name,
+			Current:     paramUint(values, "balloon.current") * 1024,
+			Maximum:     paramUint(values, "balloon.maximum") * 1024,
+			Unused:      paramUint(values, "balloon.unused") * 1024,
+			Cooperating: reportsUnused,
+		})
+	}
+	return balloons, nil
+}
+
+// GetHostMemory returns the total and available memory of a host.
+func (c *Connector) GetHostMemory(hostID string) (*HostMemory, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	_, count, err := l.NodeGetMemoryStats(0, int32(libvirt.NodeMemoryStatsAllCells), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory stats for host %s: %w", hostID, err)
+	}
+	stats, _, err := l.NodeGetMemoryStats(count, int32(libvirt.NodeMemoryStatsAllCells), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory stats for host %s: %w", hostID, err)
+	}
+
+	kib := make(map[string]uint64, len(stats))
+	for _, s := range stats {
+		kib[s.Field] = s.Value
+	}
+	return &HostMemory{
+		Total:     kib["total"] * 1024,
+		Available: (kib["free"] + kib["buffers"] + kib["cached"]) * 1024,
+	}, nil
+}
+
+// SetBalloonTarget asks the balloon driver of a running domain to give the
+// guest the given amount of memory. The domain definition is left alone.
+func (c *Connector) SetBalloonTarget(hostID, vmName string, bytes uint64) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSetMemoryFlags(domain, bytes/1024, uint32(libvirt.DomainAffectLive)); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to set balloon target of %s: %w", vmName, err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package libvirt
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// FailedBlockJob is a block job (a copy, commit, pull or backup of a disk)
+// that libvirt reported as failed.
+type FailedBlockJob struct {
+	Disk     string    `json:"disk"` // Target of the disk, e.g. 'vda'
+	Type     string    `json:"type"` // 'pull', 'copy', 'commit', 'active-commit', 'backup' or 'unknown'
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// blockJobFailures remembers the failed block jobs of the domains of
+// watched hosts, by host, domain name and disk. A failure is forgotten when
+// a later job on the same disk ends well, when the domain is started again
+// or undefined, and with its host.
+type blockJobFailures struct {
+	mu       sync.Mutex
+	failures map[string]map[string]map[string]FailedBlockJob
+}
+
+func newBlockJobFailures() *blockJobFailures {
+	return &blockJobFailures{failures: make(map[string]map[string]map[string]FailedBlockJob)}
+}
+
+func blockJobTypeName(t libvirt.DomainBlockJobType) string {
+	switch t {
+	case libvirt.DomainBlockJobTypePull:
+		return "pull"
+	case libvirt.DomainBlockJobTypeCopy:
+		return "copy"
+	case libvirt.DomainBlockJobTypeCommit:
+		return "commit"
+	case libvirt.DomainBlockJobTypeActiveCommit:
+		return "active-commit"
+	case libvirt.DomainBlockJobTypeBackup:
+		return "backup"
+	}
+	return "unknown"
+}
+
+// track records what a domain event says about block jobs.
+func (b *blockJobFailures) track(hostID string, ev interface{}) {
+	switch e := ev.(type) {
+	case *libvirt.DomainEventBlockJob2Msg:
+		switch libvirt.ConnectDomainEventBlockJobStatus(e.Status) {
+		case libvirt.DomainBlockJobFailed:
+			b.record(hostID, e.Dom.Name, FailedBlockJob{
+				Disk:     e.Dst,
+				Type:     blockJobTypeName(libvirt.DomainBlockJobType(e.Type)),
+				FailedAt: time.Now(),
+			})
+		case libvirt.DomainBlockJobCompleted, libvirt.DomainBlockJobReady:
+			b.clearDisk(hostID, e.Dom.Name, e.Dst)
+		}
+	case *libvirt.DomainEventCallbackLifecycleMsg:
+		switch libvirt.DomainEventType(e.Msg.Event) {
+		case libvirt.DomainEventStarted, libvirt.DomainEventUndefined:
+			b.clearDomain(hostID, e.Msg.Dom.Name)
+		}
+	}
+}
+
+func (b *blockJobFailures) record(hostID, name string, job FailedBlockJob) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	domains := b.failures[hostID]
+	if domains == nil {
+		domains = make(map[string]map[string]FailedBlockJob)
+		b.failures[hostID] = domains
+	}
+	if domains[name] == nil {
+		domains[name] = make(map[string]FailedBlockJob)
+	}
+	domains[name][job.Disk] = job
+}
+
+func (b *blockJobFailures) clearDisk(hostID, name, disk string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if jobs := b.failures[hostID][name]; jobs != nil {
+		delete(jobs, disk)
+		if len(jobs) == 0 {
+			delete(b.failures[hostID], name)
+		}
+	}
+}
+
+func (b *blockJobFailures) clearDomain(hostID, name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures[hostID], name)
+}
+
+func (b *blockJobFailures) forgetHost(hostID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, hostID)
+}
+
+// FailedBlockJobs returns the block jobs of a VM that failed and have not
+// been superseded since, ordered by disk. Failures are only seen while the
+// host's domain events are watched.
+func (c *Connector) FailedBlockJobs(hostID, vmName string) []FailedBlockJob {
+	c.blockJobs.mu.Lock()
+	defer c.blockJobs.mu.Unlock()
+	jobs := make([]FailedBlockJob, 0, len(c.blockJobs.failures[hostID][vmName]))
+	for _, job := range c.blockJobs.failures[hostID][vmName] {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Disk < jobs[j].Disk })
+	return jobs
+}
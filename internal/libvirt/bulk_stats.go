@@ -0,0 +1,102 @@
+package libvirt
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// bulkStatsTypes are the stat groups read by GetAllDomainStats, matching what
+// GetDomainStats reports for a single domain.
+const bulkStatsTypes = libvirt.DomainStatsState | libvirt.DomainStatsCPUTotal | libvirt.DomainStatsBalloon |
+	libvirt.DomainStatsVCPU | libvirt.DomainStatsInterface | libvirt.DomainStatsBlock
+
+// GetAllDomainStats retrieves the statistics of every domain of a host in a
+// single call, keyed by domain name. Domains that are not running report
+// their state and sizes only, as GetDomainStats does.
+func (c *Connector) GetAllDomainStats(hostID string) (map[string]*VMStats, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := l.ConnectGetAllDomainStats(nil, uint32(bulkStatsTypes), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain stats for host %s: %w", hostID, err)
+	}
+
+	all := make(map[string]*VMStats, len(records))
+	for _, record := range records {
+		all[record.Dom.Name] = statsFromParams(record.Params)
+	}
+	return all, nil
+}
+
+// statsFromParams converts the typed parameters of a bulk stats record.
+func statsFromParams(params []libvirt.TypedParam) *VMStats {
+	values := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		values[p.Field] = p.Value.I
+	}
+	stats := &VMStats{
+		State:     libvirt.DomainState(paramUint(values, "state.state")),
+		MaxMem:    paramUint(values, "balloon.maximum"),
+		Vcpu:      uint(paramUint(values, "vcpu.current")),
+		DiskStats: []DomainDiskStats{},
+		NetStats:  []DomainNetworkStats{},
+	}
+	if stats.State != libvirt.DomainRunning {
+		return stats
+	}
+	stats.Memory = paramUint(values, "balloon.current")
+	stats.CpuTime = paramUint(values, "cpu.time")
+
+	for i := range paramUint(values, "block.count") {
+		prefix := "block." + strconv.FormatUint(i, 10) + "."
+		name, _ := values[prefix+"name"].(string)
+		if name == "" {
+			continue
+		}
+		stats.DiskStats = append(stats.DiskStats, DomainDiskStats{
+			Device:     name,
+			ReadBytes:  int64(paramUint(values, prefix+"rd.bytes")),
+			WriteBytes: int64(paramUint(values, prefix+"wr.bytes")),
+		})
+	}
+	for i := range paramUint(values, "net.count") {
+		prefix := "net." + strconv.FormatUint(i, 10) + "."
+		name, _ := values[prefix+"name"].(string)
+		if name == "" {
+			continue
+		}
+		stats.NetStats = append(stats.NetStats, DomainNetworkStats{
+			Device:     name,
+			ReadBytes:  int64(paramUint(values, prefix+"rx.bytes")),
+			WriteBytes: int64(paramUint(values, prefix+"tx.bytes")),
+		})
+	}
+	return stats
+}
+
+// paramUint reads a numeric typed parameter, or 0 when it is missing.
+func paramUint(values map[string]interface{}, field string) uint64 {
+	switch v := values[field].(type) {
+	case int32:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	case uint64:
+		return v
+	case float64:
+		return uint64(v)
+	}
+	return 0
+}
@@ -0,0 +1,205 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Defaults for retries and the per-host circuit breaker. Transient RPC
+// errors are retried a few times with a growing pause. After a run of failed
+// operations a host's breaker opens: operations on it fail at once instead
+// of each waiting for its timeout, while a probe checks on the host until it
+// answers again.
+const (
+	RPCRetryAttempts        = 3
+	RPCRetryBackoff         = 250 * time.Millisecond
+	BreakerFailureThreshold = 3
+	BreakerProbeInterval    = 15 * time.Second
+	BreakerProbeTimeout     = 10 * time.Second
+)
+
+// ErrHostUnavailable is returned while a host's circuit breaker is open.
+var ErrHostUnavailable = errors.New("host is not responding")
+
+// Circuit breaker states as reported in ConnectionStats.
+const (
+	CircuitClosed = "closed"
+	CircuitOpen   = "open"
+)
+
+// circuitBreaker tracks consecutive failed operations on a host.
+type circuitBreaker struct {
+	probe  func() error // A cheap call that tells whether the host answers
+	closed <-chan struct{}
+
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openedAt  time.Time
+	lastError string
+	trips     uint64
+}
+
+func newCircuitBreaker(probe func() error, closed <-chan struct{}) *circuitBreaker {
+	return &circuitBreaker{probe: probe, closed: closed}
+}
+
+// allow fails fast while the breaker is open.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		return fmt.Errorf("%w since %s: %s", ErrHostUnavailable, b.openedAt.Format(time.RFC3339), b.lastError)
+	}
+	return nil
+}
+
+// success resets the run of failures.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// failure counts a failed operation and opens the breaker once the run is
+// long enough.
+func (b *circuitBreaker) failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	if b.open || b.failures < BreakerFailureThreshold {
+		return
+	}
+	b.open = true
+	b.openedAt = time.Now()
+	b.trips++
+	log.Printf("Circuit breaker opened after %d failed operations: %v", b.failures, err)
+	go b.probeUntilClosed()
+}
+
+// probeUntilClosed probes the host until it answers, then closes the
+// breaker. It stops when the host is removed.
+func (b *circuitBreaker) probeUntilClosed() {
+	ticker := time.NewTicker(BreakerProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.closed:
+			return
+		}
+		err := b.runProbe()
+		b.mu.Lock()
+		if err != nil {
+			b.lastError = err.Error()
+			b.mu.Unlock()
+			continue
+		}
+		b.open = false
+		b.failures = 0
+		downFor := time.Since(b.openedAt).Round(time.Second)
+		b.mu.Unlock()
+		log.Printf("Circuit breaker closed: host answered again after %s", downFor)
+		return
+	}
+}
+
+// runProbe calls the probe, giving up after BreakerProbeTimeout. A probe
+// stuck on a hung connection is left behind.
+func (b *circuitBreaker) runProbe() error {
+	result := make(chan error, 1)
+	go func() { result <- b.probe() }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(BreakerProbeTimeout):
+		return fmt.Errorf("probe did not answer within %s", BreakerProbeTimeout)
+	case <-b.closed:
+		return errors.New("host was disconnected")
+	}
+}
+
+func (b *circuitBreaker) stats(stats *ConnectionStats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats.Circuit = CircuitClosed
+	if b.open {
+		stats.Circuit = CircuitOpen
+		openedAt := b.openedAt
+		stats.CircuitOpenedAt = &openedAt
+	}
+	stats.CircuitTrips = b.trips
+	stats.ConsecutiveFailures = b.failures
+	stats.LastError = b.lastError
+}
+
+// libvirtProbe asks a host for its libvirt version, which every daemon
+// answers without touching any domain.
+func libvirtProbe(l *libvirt.Libvirt) func() error {
+	return func() error {
+		_, err := l.ConnectGetLibVersion()
+		return err
+	}
+}
+
+// isTransientRPCError reports whether an error came from the connection to
+// the daemon rather than from the operation, so trying again may succeed.
+func isTransientRPCError(err error) bool {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, libvirt.ErrInterrupted), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.As(err, &netErr):
+		return true
+	}
+	return isLibvirtError(err, libvirt.ErrRPC)
+}
+
+// retryRPC runs a read-only operation on a host, trying again after
+// transient errors. Every attempt gets the host's current connection, so a
+// retry after the host was reconnected does not reuse the dead one. The
+// outcome is reported to the host's circuit breaker.
+func (c *Connector) retryRPC(hostID string, op func(*libvirt.Libvirt) error) error {
+	var err error
+	backoff := RPCRetryBackoff
+	for attempt := 1; ; attempt++ {
+		var l *libvirt.Libvirt
+		if l, err = c.GetConnection(hostID); err != nil {
+			return err
+		}
+		if err = op(l); !isTransientRPCError(err) || attempt == RPCRetryAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return c.reportRPC(hostID, err)
+}
+
+// reportRPC reports the outcome of an operation on a host to its circuit
+// breaker and returns err. Changes and long-running calls, which are not
+// retried, report through it directly. An error from the daemon still means
+// the host answered.
+func (c *Connector) reportRPC(hostID string, err error) error {
+	c.mu.RLock()
+	limiter := c.limiters[hostID]
+	c.mu.RUnlock()
+	if limiter == nil {
+		return err
+	}
+	if isTransientRPCError(err) {
+		limiter.breaker.failure(err)
+	} else {
+		limiter.breaker.success()
+	}
+	return err
+}
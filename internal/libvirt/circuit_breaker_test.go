@@ -0,0 +1,155 @@
+package libvirt
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// newTestConnector returns a connector with a connection and limiter for
+// one host. The connection is never dialed; tests only compare it.
+func newTestConnector(t *testing.T, hostID string) (*Connector, *rpcLimiter) {
+	t.Helper()
+	c := NewConnector()
+	limiter := newRPCLimiter(1, func() error { return nil })
+	c.connections[hostID] = &libvirt.Libvirt{}
+	c.limiters[hostID] = limiter
+	t.Cleanup(func() { close(limiter.closed) })
+	return c, limiter
+}
+
+func TestIsTransientRPCError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"EOF", io.EOF, true},
+		{"wrapped unexpected EOF", errors.Join(errors.New("reading reply"), io.ErrUnexpectedEOF), true},
+		{"interrupted", libvirt.ErrInterrupted, true},
+		{"RPC error from the daemon", libvirt.Error{Code: uint32(libvirt.ErrRPC), Message: "cannot write data"}, true},
+		{"domain not found", libvirt.Error{Code: uint32(libvirt.ErrNoDomain), Message: "no domain"}, false},
+		{"other error", errors.New("invalid XML"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientRPCError(tt.err); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryRPC(t *testing.T) {
+	noDomain := libvirt.Error{Code: uint32(libvirt.ErrNoDomain), Message: "no domain"}
+	invalidXML := errors.New("invalid XML")
+	tests := []struct {
+		name          string
+		priorFailures int     // Failures reported before the call
+		results       []error // What each attempt returns; the last one repeats
+		wantErr       error
+		wantAttempts  int
+		wantFailures  int // Consecutive failures of the breaker afterwards
+	}{
+		{"success", 1, []error{nil}, nil, 1, 0},
+		{"transient error then success", 1, []error{io.EOF, nil}, nil, 2, 0},
+		{"transient errors until the last attempt", 0, []error{io.EOF}, io.EOF, RPCRetryAttempts, 1},
+		{"daemon error is not retried", 2, []error{noDomain}, noDomain, 1, 0},
+		{"other error is not retried", 0, []error{invalidXML}, invalidXML, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, limiter := newTestConnector(t, "h1")
+			for range tt.priorFailures {
+				limiter.breaker.failure(io.EOF)
+			}
+			attempts := 0
+			err := c.retryRPC("h1", func(*libvirt.Libvirt) error {
+				result := tt.results[min(attempts, len(tt.results)-1)]
+				attempts++
+				return result
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("ran %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if stats := limiter.stats("h1"); stats.ConsecutiveFailures != tt.wantFailures {
+				t.Errorf("breaker counts %d failures, want %d", stats.ConsecutiveFailures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestRetryRPCUsesCurrentConnection(t *testing.T) {
+	c, _ := newTestConnector(t, "h1")
+	first := c.connections["h1"]
+	reconnected := &libvirt.Libvirt{}
+	var used []*libvirt.Libvirt
+	err := c.retryRPC("h1", func(l *libvirt.Libvirt) error {
+		used = append(used, l)
+		if len(used) == 1 {
+			// The host drops and is reconnected before the retry.
+			c.mu.Lock()
+			c.connections["h1"] = reconnected
+			c.mu.Unlock()
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("got error %v, want none", err)
+	}
+	if len(used) != 2 || used[0] != first || used[1] != reconnected {
+		t.Errorf("attempts used connections %p, want %p then %p", used, first, reconnected)
+	}
+}
+
+func TestRetryRPCNotConnected(t *testing.T) {
+	c, _ := newTestConnector(t, "h1")
+	ran := false
+	err := c.retryRPC("h2", func(*libvirt.Libvirt) error {
+		ran = true
+		return nil
+	})
+	if err == nil || ran {
+		t.Errorf("got error %v and ran = %t, want an error without running", err, ran)
+	}
+}
+
+func TestReportRPCOpensBreaker(t *testing.T) {
+	tests := []struct {
+		name     string
+		reports  []error
+		wantOpen bool
+	}{
+		{"transient errors up to the threshold", []error{io.EOF, io.EOF, io.EOF}, true},
+		{"too few transient errors", []error{io.EOF, io.EOF}, false},
+		{"success in between", []error{io.EOF, io.EOF, nil, io.EOF}, false},
+		{"daemon errors in between", []error{io.EOF, io.EOF, libvirt.Error{Code: uint32(libvirt.ErrNoDomain)}, io.EOF}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, limiter := newTestConnector(t, "h1")
+			for _, err := range tt.reports {
+				if got := c.reportRPC("h1", err); got != err {
+					t.Fatalf("reportRPC returned %v, want %v", got, err)
+				}
+			}
+			if open := limiter.stats("h1").Circuit == CircuitOpen; open != tt.wantOpen {
+				t.Errorf("breaker open = %t, want %t", open, tt.wantOpen)
+			}
+			release, err := c.acquireRPC("h1")
+			if err == nil {
+				release()
+			}
+			if open := errors.Is(err, ErrHostUnavailable); open != tt.wantOpen {
+				t.Errorf("acquireRPC error %v, want breaker open = %t", err, tt.wantOpen)
+			}
+		})
+	}
+}
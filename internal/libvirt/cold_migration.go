@@ -0,0 +1,551 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrDomainActive is returned when an operation needs a shut-off domain.
+	ErrDomainActive = errors.New("domain must be shut off")
+	// ErrColdMigrationUnsupported is returned for VMs whose storage cannot be
+	// copied to another host as is.
+	ErrColdMigrationUnsupported = errors.New("VM storage cannot be copied to another host")
+)
+
+// nvramDevice is the MigrationDisk device name of a UEFI variable store.
+const nvramDevice = "nvram"
+
+// filePoolTypes are pool types whose volumes are files rather than block
+// devices.
+var filePoolTypes = map[string]bool{"dir": true, "fs": true, "netfs": true}
+
+// libvirtAttrEscaper escapes attribute values the way libvirt writes them in
+// domain XML.
+var libvirtAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "'", "&apos;", `"`, "&quot;")
+
+// coldMigrationXML is the part of an inactive domain definition that a cold
+// migration has to carry over to the target.
+type coldMigrationXML struct {
+	Name string `xml:"name"`
+	UUID string `xml:"uuid"`
+	OS   struct {
+		NVRAM string `xml:"nvram"`
+	} `xml:"os"`
+	Devices struct {
+		Disks []struct {
+			chainDiskXML
+			Device string `xml:"device,attr"`
+		} `xml:"disk"`
+	} `xml:"devices"`
+}
+
+// ColdMigrationPlan is the definition of a shut-off VM and the images to
+// copy for moving it to another host.
+type ColdMigrationPlan struct {
+	DomainXML string
+	Disks     []storage.MigrationDisk
+}
+
+// poolType returns the type of a storage pool, e.g. 'dir' or 'logical'.
+func poolType(l *libvirt.Libvirt, pool libvirt.StoragePool) (string, error) {
+	poolXML, err := l.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML of storage pool '%s': %w", pool.Name, err)
+	}
+	var def storagePoolXML
+	if err := xml.Unmarshal([]byte(poolXML), &def); err != nil {
+		return "", fmt.Errorf("failed to parse XML of storage pool '%s': %w", pool.Name, err)
+	}
+	return def.Type, nil
+}
+
+func (c *Connector) hasSSHChannel(hostID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.sshClients[hostID]
+	return ok
+}
+
+// PlanColdMigration reads the definition of a shut-off VM and works out
+// where each of its disk images goes on the target. Images in storage pools
+// go to a volume of the same name in targetPool, or in the pool of the same
+// name when targetPool is empty; images outside pools, which are copied over
+// SSH, keep their path. CD-ROM and floppy media are not copied.
+func (c *Connector) PlanColdMigration(hostID, vmName, targetHostID, targetPool string) (*ColdMigrationPlan, error) {
+	plan, srcPoolTypes, err := c.readColdMigrationSource(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Disks, err = c.placeColdMigrationDisks(targetHostID, targetPool, plan.Disks, srcPoolTypes); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// readColdMigrationSource collects the disks of a shut-off VM, and the types
+// of the pools they are in.
+func (c *Connector) readColdMigrationSource(hostID, vmName string) (*ColdMigrationPlan, map[string]string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return nil, nil, fmt.Errorf("cannot copy the storage of %s: %w", vmName, ErrDomainActive)
+	}
+	if n, err := l.DomainSnapshotNum(domain, 0); err == nil && n > 0 {
+		return nil, nil, fmt.Errorf("%w: %s has %d snapshots; delete them first", ErrColdMigrationUnsupported, vmName, n)
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	plan := &ColdMigrationPlan{DomainXML: xmlDesc, Disks: []storage.MigrationDisk{}}
+	poolTypes := make(map[string]string)
+	for i := range def.Devices.Disks {
+		disk := &def.Devices.Disks[i]
+		if disk.Device != "" && disk.Device != "disk" || disk.Type == "network" {
+			continue
+		}
+		imagePath, err := diskSourcePath(l, &disk.chainDiskXML)
+		if err != nil {
+			return nil, nil, err
+		}
+		if imagePath == "" {
+			continue
+		}
+		md := storage.MigrationDisk{
+			Device:     disk.Target.Dev,
+			Type:       disk.Type,
+			SourcePath: imagePath,
+		}
+
+		if vol, err := l.StorageVolLookupByPath(imagePath); err == nil {
+			pool, err := l.StoragePoolLookupByVolume(vol)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to find the pool of %s: %w", imagePath, err)
+			}
+			if poolTypes[pool.Name], err = poolType(l, pool); err != nil {
+				return nil, nil, err
+			}
+			md.SourcePool, md.Volume = pool.Name, vol.Name
+		} else if disk.Type != "file" {
+			return nil, nil, fmt.Errorf("%w: %s of %s is a block device outside any storage pool", ErrColdMigrationUnsupported, md.Device, vmName)
+		}
+
+		layer, err := c.inspectChainLayer(l, hostID, imagePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to inspect %s: %w", imagePath, err)
+		}
+		if layer.BackingPath != "" {
+			return nil, nil, fmt.Errorf("%w: %s of %s has a backing image (%s); flatten it first",
+				ErrColdMigrationUnsupported, md.Device, vmName, layer.BackingPath)
+		}
+		md.Format, md.CapacityBytes = layer.Format, layer.CapacityBytes
+		plan.Disks = append(plan.Disks, md)
+	}
+
+	// Without its variable store the VM would still boot on the target, as
+	// libvirt creates a fresh one from the template, but its boot entries
+	// would be lost; copy it whenever both hosts allow it.
+	if def.OS.NVRAM != "" && c.hasSSHChannel(hostID) {
+		plan.Disks = append(plan.Disks, storage.MigrationDisk{
+			Device:     nvramDevice,
+			Type:       "file",
+			SourcePath: def.OS.NVRAM,
+		})
+	}
+	return plan, poolTypes, nil
+}
+
+// placeColdMigrationDisks picks the target of every disk and makes sure it
+// does not exist yet, so a migration never overwrites data on the target.
+// The NVRAM store is dropped when the target has no SSH channel.
+func (c *Connector) placeColdMigrationDisks(targetHostID, targetPool string, disks []storage.MigrationDisk, srcPoolTypes map[string]string) ([]storage.MigrationDisk, error) {
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		return nil, err
+	}
+
+	placed := make([]storage.MigrationDisk, 0, len(disks))
+	for _, disk := range disks {
+		if disk.SourcePool == "" {
+			if disk.Device == nvramDevice && !c.hasSSHChannel(targetHostID) {
+				continue
+			}
+			disk.TargetPath = disk.SourcePath
+			if _, err := c.RunHostCommand(targetHostID, "test -e "+ShellQuote(disk.TargetPath)); err == nil {
+				return nil, fmt.Errorf("%s already exists on host %s", disk.TargetPath, targetHostID)
+			} else if errors.Is(err, ErrNoSSHChannel) {
+				return nil, fmt.Errorf("%s is outside any storage pool and can only be copied over SSH: %w", disk.SourcePath, err)
+			}
+			placed = append(placed, disk)
+			continue
+		}
+
+		disk.TargetPool = targetPool
+		if disk.TargetPool == "" {
+			disk.TargetPool = disk.SourcePool
+		}
+		pool, err := l.StoragePoolLookupByName(disk.TargetPool)
+		if err != nil {
+			return nil, fmt.Errorf("storage pool '%s' does not exist on host %s: %w", disk.TargetPool, targetHostID, err)
+		}
+		if active, err := l.StoragePoolIsActive(pool); err != nil || active != 1 {
+			return nil, fmt.Errorf("storage pool '%s' is not active on host %s", disk.TargetPool, targetHostID)
+		}
+		if disk.Type != "volume" {
+			dstType, err := poolType(l, pool)
+			if err != nil {
+				return nil, err
+			}
+			if filePoolTypes[dstType] != filePoolTypes[srcPoolTypes[disk.SourcePool]] {
+				return nil, fmt.Errorf("%w: %s is in a %s pool and cannot move to the %s pool '%s'",
+					ErrColdMigrationUnsupported, disk.Device, srcPoolTypes[disk.SourcePool], dstType, disk.TargetPool)
+			}
+		}
+		if _, err := l.StorageVolLookupByName(pool, disk.Volume); err == nil {
+			return nil, fmt.Errorf("volume '%s' already exists in pool '%s' on host %s", disk.Volume, disk.TargetPool, targetHostID)
+		}
+		placed = append(placed, disk)
+	}
+	return placed, nil
+}
+
+// migrationVolumeXML is used for marshalling the target volume of a copy.
+// Pools such as LVM have no image formats, so the format is optional.
+type migrationVolumeXML struct {
+	XMLName    xml.Name `xml:"volume"`
+	Name       string   `xml:"name"`
+	Capacity   xmlSize  `xml:"capacity"`
+	Allocation xmlSize  `xml:"allocation"`
+	Format     *struct {
+		Type string `xml:"type,attr"`
+	} `xml:"target>format,omitempty"`
+}
+
+// pipeStreams feeds what produce writes into consume and returns the error
+// of whichever side failed first.
+func pipeStreams(produce func(io.Writer) error, consume func(io.Reader) error) error {
+	pr, pw := io.Pipe()
+	produced := make(chan error, 1)
+	go func() {
+		err := produce(pw)
+		pw.CloseWithError(err)
+		produced <- err
+	}()
+	err := consume(pr)
+	pr.CloseWithError(err)
+	if perr := <-produced; perr != nil && !errors.Is(perr, io.ErrClosedPipe) {
+		return perr
+	}
+	return err
+}
+
+// CreateMigrationTarget creates the target image of a disk copy and marks
+// it in disk.Created, so a retried copy reuses its own target and never
+// overwrites anything else. Images outside pools are created by the copy
+// itself.
+func (c *Connector) CreateMigrationTarget(targetHostID string, disk *storage.MigrationDisk) error {
+	if disk.SourcePool == "" {
+		disk.Created = true
+		return nil
+	}
+
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		return err
+	}
+	pool, err := l.StoragePoolLookupByName(disk.TargetPool)
+	if err != nil {
+		return fmt.Errorf("could not find storage pool '%s' on host %s: %w", disk.TargetPool, targetHostID, err)
+	}
+	if _, err := l.StorageVolLookupByName(pool, disk.Volume); err == nil {
+		if disk.Created {
+			return nil
+		}
+		return fmt.Errorf("volume '%s' already exists in pool '%s' on host %s", disk.Volume, disk.TargetPool, targetHostID)
+	}
+
+	def := migrationVolumeXML{
+		Name:       disk.Volume,
+		Capacity:   xmlSize{Unit: "bytes", Value: disk.CapacityBytes},
+		Allocation: xmlSize{Unit: "bytes"},
+	}
+	if disk.Format != "" {
+		def.Format = &struct {
+			Type string `xml:"type,attr"`
+		}{Type: disk.Format}
+	}
+	volXML, err := xml.Marshal(def)
+	if err != nil {
+		return fmt.Errorf("failed to build volume XML: %w", err)
+	}
+	vol, err := l.StorageVolCreateXML(pool, string(volXML), 0)
+	if c.reportRPC(targetHostID, err) != nil {
+		return fmt.Errorf("failed to create volume '%s' in pool '%s' on host %s: %w", disk.Volume, disk.TargetPool, targetHostID, err)
+	}
+	disk.Created = true
+	if disk.TargetPath, err = l.StorageVolGetPath(vol); err != nil {
+		return fmt.Errorf("failed to get the path of volume '%s' on host %s: %w", disk.Volume, targetHostID, err)
+	}
+	return nil
+}
+
+// CopyMigrationDisk copies a disk image of a shut-off VM into the target
+// made by CreateMigrationTarget. Pool volumes are streamed through libvirt
+// from one host to the other; images outside pools are streamed over the SSH
+// channels of both hosts.
+func (c *Connector) CopyMigrationDisk(hostID, targetHostID string, disk *storage.MigrationDisk) error {
+	if disk.SourcePool == "" {
+		write := fmt.Sprintf("mkdir -p %s && dd of=%s bs=4M conv=sparse status=none",
+			ShellQuote(path.Dir(disk.TargetPath)), ShellQuote(disk.TargetPath))
+		err := pipeStreams(
+			func(w io.Writer) error { return c.StreamHostCommand(hostID, "cat "+ShellQuote(disk.SourcePath), w) },
+			func(r io.Reader) error { return c.FeedHostCommand(targetHostID, write, r) },
+		)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to host %s: %w", disk.SourcePath, targetHostID, err)
+		}
+		disk.Copied = true
+		return nil
+	}
+
+	// The lookups take a slot on each host; the copy, which can run for
+	// hours, holds none
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	src, srcVol, err := c.getVolumeByName(hostID, disk.SourcePool, disk.Volume)
+	release()
+	if err != nil {
+		return err
+	}
+	release, err = c.acquireRPC(targetHostID)
+	if err != nil {
+		return err
+	}
+	dst, dstVol, err := c.getVolumeByName(targetHostID, disk.TargetPool, disk.Volume)
+	release()
+	if err != nil {
+		return err
+	}
+	err = pipeStreams(
+		func(w io.Writer) error { return c.reportRPC(hostID, src.StorageVolDownload(srcVol, w, 0, 0, 0)) },
+		func(r io.Reader) error { return c.reportRPC(targetHostID, dst.StorageVolUpload(dstVol, r, 0, 0, 0)) },
+	)
+	if err != nil {
+		return fmt.Errorf("failed to copy volume '%s' to host %s: %w", disk.Volume, targetHostID, err)
+	}
+	disk.Copied = true
+	return nil
+}
+
+// rewriteDiskSources points the disks of a domain definition at their copies
+// on the target host. Attributes are matched as libvirt formats them.
+func rewriteDiskSources(domainXML string, disks []storage.MigrationDisk) (string, error) {
+	for _, disk := range disks {
+		var from, to string
+		switch {
+		case disk.Device == nvramDevice:
+			continue
+		case disk.Type == "volume":
+			if disk.TargetPool == disk.SourcePool {
+				continue
+			}
+			from = fmt.Sprintf("pool='%s' volume='%s'", libvirtAttrEscaper.Replace(disk.SourcePool), libvirtAttrEscaper.Replace(disk.Volume))
+			to = fmt.Sprintf("pool='%s' volume='%s'", libvirtAttrEscaper.Replace(disk.TargetPool), libvirtAttrEscaper.Replace(disk.Volume))
+		default:
+			if disk.TargetPath == disk.SourcePath {
+				continue
+			}
+			attr := "file"
+			if disk.Type == "block" {
+				attr = "dev"
+			}
+			from = fmt.Sprintf("%s='%s'", attr, libvirtAttrEscaper.Replace(disk.SourcePath))
+			to = fmt.Sprintf("%s='%s'", attr, libvirtAttrEscaper.Replace(disk.TargetPath))
+		}
+		if !strings.Contains(domainXML, from) {
+			return "", fmt.Errorf("could not find the source of disk %s in the domain definition", disk.Device)
+		}
+		domainXML = strings.ReplaceAll(domainXML, from, to)
+	}
+	return domainXML, nil
+}
+
+// DefineMigratedDomain defines a VM on the target host from its source
+// definition, with its disks pointing at the copied images. It does nothing
+// if a domain with the VM's UUID is already defined there.
+func (c *Connector) DefineMigratedDomain(targetHostID, domainXML string, disks []storage.MigrationDisk) error {
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return fmt.Errorf("invalid domain UUID '%s': %w", def.UUID, err)
+	}
+	newXML, err := rewriteDiskSources(domainXML, disks)
+	if err != nil {
+		return err
+	}
+
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		return err
+	}
+	if _, err := l.DomainLookupByUUID(libvirt.UUID(domainUUID)); err == nil {
+		return nil
+	}
+	if _, err := l.DomainDefineXML(newXML); c.reportRPC(targetHostID, err) != nil {
+		return fmt.Errorf("failed to define %s on host %s: %w", def.Name, targetHostID, err)
+	}
+	return nil
+}
+
+// CheckMigrationSource makes sure the VM of a cold migration is still shut
+// off on its source host. It reports whether the VM is still defined there;
+// a VM that is running or paused is an ErrDomainActive.
+func (c *Connector) CheckMigrationSource(hostID, domainXML string) (bool, error) {
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return false, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return false, fmt.Errorf("invalid domain UUID '%s': %w", def.UUID, err)
+	}
+
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return false, err
+	}
+
+	domain, err := l.DomainLookupByUUID(libvirt.UUID(domainUUID))
+	if isLibvirtError(err, libvirt.ErrNoDomain) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up %s on host %s: %w", def.Name, hostID, err)
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to get domain state for %s: %w", def.Name, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return true, fmt.Errorf("%s on host %s: %w", def.Name, hostID, ErrDomainActive)
+	}
+	return true, nil
+}
+
+// RemoveMigratedSource undefines a migrated VM on its source host and
+// deletes the images that were copied away. Parts that are already gone are
+// skipped, so it can be retried. A VM that is no longer shut off is left
+// alone, with ErrDomainActive.
+func (c *Connector) RemoveMigratedSource(hostID, domainXML string, disks []storage.MigrationDisk) error {
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return fmt.Errorf("invalid domain UUID '%s': %w", def.UUID, err)
+	}
+
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+
+	domain, err := l.DomainLookupByUUID(libvirt.UUID(domainUUID))
+	switch {
+	case err == nil:
+		// A VM started since the job began must not lose its images.
+		state, _, err := l.DomainGetState(domain, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get domain state for %s: %w", def.Name, err)
+		}
+		if libvirt.DomainState(state) != libvirt.DomainShutoff {
+			return fmt.Errorf("cannot remove %s from host %s: %w", def.Name, hostID, ErrDomainActive)
+		}
+		if err := l.DomainUndefineFlags(domain, libvirt.DomainUndefineManagedSave|libvirt.DomainUndefineNvram); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to undefine %s on host %s: %w", def.Name, hostID, err)
+		}
+	case !isLibvirtError(err, libvirt.ErrNoDomain):
+		return fmt.Errorf("failed to look up %s on host %s: %w", def.Name, hostID, err)
+	}
+
+	for _, disk := range disks {
+		if disk.SourcePool == "" {
+			if output, err := c.RunHostCommand(hostID, "rm -f "+ShellQuote(disk.SourcePath)); err != nil {
+				return fmt.Errorf("failed to delete %s: %s", disk.SourcePath, lastOutputLine(output, err))
+			}
+			continue
+		}
+		pool, err := l.StoragePoolLookupByName(disk.SourcePool)
+		if err != nil {
+			return fmt.Errorf("could not find storage pool '%s': %w", disk.SourcePool, err)
+		}
+		vol, err := l.StorageVolLookupByName(pool, disk.Volume)
+		if isLibvirtError(err, libvirt.ErrNoStorageVol) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not find volume '%s' in pool '%s': %w", disk.Volume, disk.SourcePool, err)
+		}
+		if err := l.StorageVolDelete(vol, 0); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to delete volume '%s' from pool '%s': %w", disk.Volume, disk.SourcePool, err)
+		}
+	}
+	return nil
+}
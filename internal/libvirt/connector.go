@@ -1,6 +1,7 @@
 package libvirt
 
 import (
+	"context"
 	"encoding/xml"
 	"fmt"
 	"log"
@@ -11,7 +12,9 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/capsali/virtumancer-flash/internal/agent"
 	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/tracing"
 	"github.com/digitalocean/go-libvirt"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/ssh"
@@ -33,10 +36,21 @@ type VMInfo struct {
 	Memory     uint64              `json:"memory"`
 	Vcpu       uint                `json:"vcpu"`
 	CpuTime    uint64              `json:"cpu_time"`
-	Uptime     int64               `json:"uptime"`
 	Persistent bool                `json:"persistent"`
 	Autostart  bool                `json:"autostart"`
 	Graphics   GraphicsInfo        `json:"graphics"`
+	OS         OSInfo              `json:"os"`
+	// Read from the guest agent of a running VM; nil when it did not answer.
+	GuestFilesystems []storage.GuestFilesystem `json:"guest_filesystems,omitempty"`
+	// State of the guest agent of a running VM, 'connected' or
+	// 'disconnected'; empty when the VM is not running or has no agent
+	// channel.
+	GuestAgent string `json:"guest_agent,omitempty"`
+
+	Description string       `json:"description"`
+	CPUModel    string       `json:"cpu_model"`
+	CPUTopology *CPUTopology `json:"cpu_topology,omitempty"`
+	Tuning      DomainTuning `json:"tuning"`
 }
 
 // DomainDiskStats holds I/O statistics for a single disk device.
@@ -62,6 +76,9 @@ type VMStats struct {
 	CpuTime    uint64               `json:"cpu_time"`
 	DiskStats  []DomainDiskStats    `json:"disk_stats"`
 	NetStats   []DomainNetworkStats `json:"net_stats"`
+	// Filled in by the stats poller from the guest agent, less often than
+	// the other stats.
+	GuestFilesystems []storage.GuestFilesystem `json:"guest_filesystems,omitempty"`
 }
 
 // HardwareInfo holds the hardware configuration of a VM.
@@ -75,8 +92,9 @@ type DiskInfo struct {
 	Type   string `xml:"type,attr" json:"type"`
 	Device string `xml:"device,attr" json:"device"`
 	Driver struct {
-		Name string `xml:"name,attr" json:"driver_name"`
-		Type string `xml:"type,attr" json:"type"`
+		Name    string `xml:"name,attr" json:"driver_name"`
+		Type    string `xml:"type,attr" json:"type"`
+		Discard string `xml:"discard,attr" json:"discard,omitempty"`
 	} `xml:"driver" json:"driver"`
 	Source struct {
 		File string `xml:"file,attr"`
@@ -104,6 +122,25 @@ type NetworkInfo struct {
 	Target struct {
 		Dev string `xml:"dev,attr" json:"dev"`
 	} `xml:"target" json:"target"`
+	VLAN        *InterfaceVLAN `xml:"vlan" json:"vlan,omitempty"`
+	VirtualPort *struct {
+		Type string `xml:"type,attr" json:"type"`
+	} `xml:"virtualport" json:"virtualport,omitempty"`
+}
+
+// InterfaceVLAN is the VLAN an interface is an access port of.
+type InterfaceVLAN struct {
+	Tag struct {
+		ID uint `xml:"id,attr" json:"id"`
+	} `xml:"tag" json:"tag"`
+}
+
+// VLANID returns the interface's VLAN tag, or 0 if it is untagged.
+func (n NetworkInfo) VLANID() uint {
+	if n.VLAN == nil {
+		return 0
+	}
+	return n.VLAN.Tag.ID
 }
 
 // DomainHardwareXML is used for unmarshalling hardware info from the domain XML.
@@ -114,18 +151,74 @@ type DomainHardwareXML struct {
 	} `xml:"devices"`
 }
 
+// CPUTopology is the virtual CPU topology of a domain.
+type CPUTopology struct {
+	Sockets uint `xml:"sockets,attr" json:"sockets"`
+	Dies    uint `xml:"dies,attr" json:"dies,omitempty"`
+	Cores   uint `xml:"cores,attr" json:"cores"`
+	Threads uint `xml:"threads,attr" json:"threads"`
+}
+
+// domainConfigXML is the descriptive part of a domain XML that sync stores
+// alongside the VM.
+type domainConfigXML struct {
+	Description string `xml:"description"`
+	CPU         struct {
+		Mode     string       `xml:"mode,attr"`
+		Model    string       `xml:"model"`
+		Topology *CPUTopology `xml:"topology"`
+	} `xml:"cpu"`
+	CPUTune struct {
+		Shares uint64 `xml:"shares"`
+	} `xml:"cputune"`
+	BlkioTune struct {
+		Weight uint `xml:"weight"`
+	} `xml:"blkiotune"`
+	domainOSXML
+}
+
+// cpuModel returns the configured CPU model, or the CPU mode such as
+// host-passthrough when no named model is set.
+func (x *domainConfigXML) cpuModel() string {
+	if x.CPU.Model != "" {
+		return x.CPU.Model
+	}
+	return x.CPU.Mode
+}
+
 // HostInfo holds basic information and statistics about a hypervisor host.
 type HostInfo struct {
 	Hostname string `json:"hostname"`
 	CPU      uint   `json:"cpu"`
 	Memory   uint64 `json:"memory"`
-	Cores    uint   `json:"cores"`
-	Threads  uint   `json:"threads"`
+	Cores    uint   `json:"cores"`   // Per socket
+	Threads  uint   `json:"threads"` // Per core
+
+	FreeMemory uint64     `json:"free_memory"`
+	Sockets    uint       `json:"sockets"`
+	CPUMHz     uint       `json:"cpu_mhz"`
+	CPUArch    string     `json:"cpu_arch"`
+	CPUModel   string     `json:"cpu_model"`
+	CPUVendor  string     `json:"cpu_vendor"`
+	NUMACells  []NUMACell `json:"numa_cells"`
+
+	Hypervisor        string `json:"hypervisor"`         // e.g. 'QEMU'
+	HypervisorVersion string `json:"hypervisor_version"` // e.g. '8.2.2'
+	LibvirtVersion    string `json:"libvirt_version"`
+	Kernel            string `json:"kernel"` // Empty when the host cannot be reached over SSH
 }
 
 // Connector manages active connections to libvirt hosts.
 type Connector struct {
 	connections map[string]*libvirt.Libvirt
+	sshClients  map[string]*ssh.Client      // only populated for qemu+ssh hosts
+	agents      map[string]*agent.Session // reverse tunnels of agent-transport hosts
+	limiters    map[string]*rpcLimiter // per-host bound on concurrent operations
+	pageSizes   map[string]uint64      // base memory page size of each host, read once
+	domainCache *domainCache
+	blockJobs   *blockJobFailures
+	tickets     *consoleTickets
+	definitions chan DomainDefinitionEvent
 	mu          sync.RWMutex
 }
 
@@ -133,6 +226,14 @@ type Connector struct {
 func NewConnector() *Connector {
 	return &Connector{
 		connections: make(map[string]*libvirt.Libvirt),
+		sshClients:  make(map[string]*ssh.Client),
+		agents:      make(map[string]*agent.Session),
+		limiters:    make(map[string]*rpcLimiter),
+		pageSizes:   make(map[string]uint64),
+		domainCache: newDomainCache(),
+		blockJobs:   newBlockJobFailures(),
+		tickets:     newConsoleTickets(),
+		definitions: make(chan DomainDefinitionEvent, domainDefinitionBuffer),
 	}
 }
 
@@ -173,33 +274,29 @@ func (c *sshTunneledConn) Close() error {
 	return clientErr
 }
 
-// dialLibvirt establishes a network connection based on the URI.
-func dialLibvirt(uri string) (net.Conn, error) {
-	parsedURI, err := url.Parse(uri)
-	if err != nil {
-		return nil, fmt.Errorf("invalid URI: %w", err)
+// dialSSH opens an SSH client connection to the host named in an SSH
+// transport URI. If proxyJump is set, the connection is tunnelled through
+// each listed bastion in turn, like OpenSSH's ProxyJump option.
+func dialSSH(parsedURI *url.URL, proxyJump string) (*ssh.Client, error) {
+	user := "root" // default user
+	if parsedURI.User != nil {
+		user = parsedURI.User.Username()
 	}
 
-	switch parsedURI.Scheme {
-	case "qemu+ssh":
-		user := "root" // default user
-		if parsedURI.User != nil {
-			user = parsedURI.User.Username()
-		}
-
-		host := parsedURI.Hostname()
-		port := parsedURI.Port()
-		if port == "" {
-			port = "22" // default ssh port
-		}
-		sshAddr := fmt.Sprintf("%s:%s", host, port)
+	host := parsedURI.Hostname()
+	port := parsedURI.Port()
+	if port == "" {
+		port = "22" // default ssh port
+	}
+	sshAddr := net.JoinHostPort(host, port)
 
-		authMethod, err := sshKeyAuth()
-		if err != nil {
-			return nil, fmt.Errorf("SSH key authentication setup failed: %w", err)
-		}
+	authMethod, err := sshKeyAuth()
+	if err != nil {
+		return nil, fmt.Errorf("SSH key authentication setup failed: %w", err)
+	}
 
-		sshConfig := &ssh.ClientConfig{
+	newConfig := func(user string) *ssh.ClientConfig {
+		return &ssh.ClientConfig{
 			User: user,
 			Auth: []ssh.AuthMethod{
 				authMethod,
@@ -208,15 +305,104 @@ func dialLibvirt(uri string) (net.Conn, error) {
 			// Production systems might use a known_hosts file.
 			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 		}
+	}
 
-		log.Printf("Attempting SSH connection to %s for user %s", sshAddr, user)
-		sshClient, err := ssh.Dial("tcp", sshAddr, sshConfig)
+	hops, err := parseProxyJump(proxyJump, user)
+	if err != nil {
+		return nil, err
+	}
+	hops = append(hops, sshHop{user: user, addr: sshAddr})
+
+	var clients []*ssh.Client
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	for i, hop := range hops {
+		log.Printf("Attempting SSH connection to %s for user %s", hop.addr, hop.user)
+		var client *ssh.Client
+		if i == 0 {
+			client, err = ssh.Dial("tcp", hop.addr, newConfig(hop.user))
+		} else {
+			client, err = dialSSHThrough(clients[i-1], hop.addr, newConfig(hop.user))
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to dial SSH to %s: %w", sshAddr, err)
+			closeAll()
+			return nil, fmt.Errorf("failed to dial SSH to %s: %w", hop.addr, err)
+		}
+		clients = append(clients, client)
+	}
+
+	target := clients[len(clients)-1]
+	if len(clients) > 1 {
+		// Tear down the bastion connections once the target connection ends.
+		go func() {
+			target.Wait()
+			closeAll()
+		}()
+	}
+	return target, nil
+}
+
+// sshHop is a single SSH endpoint in a jump chain.
+type sshHop struct {
+	user string
+	addr string
+}
+
+// parseProxyJump parses a comma-separated list of [user@]host[:port] hops.
+func parseProxyJump(proxyJump, defaultUser string) ([]sshHop, error) {
+	var hops []sshHop
+	for _, spec := range strings.Split(proxyJump, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		hop := sshHop{user: defaultUser}
+		if user, rest, ok := strings.Cut(spec, "@"); ok {
+			hop.user = user
+			spec = rest
+		}
+		if _, _, err := net.SplitHostPort(spec); err != nil {
+			spec = net.JoinHostPort(spec, "22")
+		}
+		if host, _, _ := net.SplitHostPort(spec); host == "" {
+			return nil, fmt.Errorf("invalid jump host %q", spec)
+		}
+		hop.addr = spec
+		hops = append(hops, hop)
+	}
+	return hops, nil
+}
+
+// dialSSHThrough opens an SSH connection to addr tunnelled over an existing client.
+func dialSSHThrough(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, chans, reqs), nil
+}
+
+// dialLibvirt establishes a network connection to the libvirt daemon using
+// the transport named in the URI.
+func dialLibvirt(hostURI *HostURI, proxyJump string) (net.Conn, error) {
+	switch hostURI.Transport {
+	case TransportSSH:
+		sshClient, err := dialSSH(hostURI.URL, proxyJump)
+		if err != nil {
+			return nil, err
 		}
 
 		// Dial the libvirt socket on the remote machine through the SSH tunnel.
-		remoteSocketPath := "/var/run/libvirt/libvirt-sock"
+		remoteSocketPath := hostURI.SocketPath()
 		log.Printf("SSH connected. Dialing remote libvirt socket at %s", remoteSocketPath)
 		conn, err := sshClient.Dial("unix", remoteSocketPath)
 		if err != nil {
@@ -228,22 +414,18 @@ func dialLibvirt(uri string) (net.Conn, error) {
 			client: sshClient,
 		}, nil
 
-	case "qemu+tcp":
-		address := parsedURI.Host
-		if !strings.Contains(address, ":") {
-			address = address + ":16509" // Default libvirt tcp port
+	case TransportTCP:
+		address := hostURI.URL.Host
+		if hostURI.URL.Port() == "" {
+			address = net.JoinHostPort(hostURI.URL.Hostname(), "16509") // Default libvirt tcp port
 		}
 		return net.Dial("tcp", address)
 
-	case "qemu", "qemu+unix":
-		address := parsedURI.Path
-		if address == "" || address == "/system" {
-			address = "/var/run/libvirt/libvirt-sock"
-		}
-		return net.Dial("unix", address)
+	case TransportUnix:
+		return net.Dial("unix", hostURI.SocketPath())
 
 	default:
-		return nil, fmt.Errorf("unsupported scheme: %s", parsedURI.Scheme)
+		return nil, fmt.Errorf("unsupported transport: %s", hostURI.Transport)
 	}
 }
 
@@ -256,18 +438,37 @@ func (c *Connector) AddHost(host storage.Host) error {
 		return fmt.Errorf("host '%s' is already connected", host.ID)
 	}
 
-	conn, err := dialLibvirt(host.URI)
+	hostURI, err := ParseHostURI(host.URI)
+	if err != nil {
+		return fmt.Errorf("invalid URI for host '%s': %w", host.ID, err)
+	}
+
+	var conn net.Conn
+	if hostURI.Transport == TransportAgent {
+		session, ok := c.agents[host.ID]
+		if !ok {
+			return fmt.Errorf("agent for host '%s' is not connected", host.ID)
+		}
+		conn, err = session.Open(agent.TargetLibvirt)
+	} else {
+		conn, err = dialLibvirt(hostURI, host.ProxyJump)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to dial libvirt for host '%s': %w", host.ID, err)
 	}
 
 	l := libvirt.New(conn)
-	if err := l.Connect(); err != nil {
+	if err := l.ConnectToURI(libvirt.ConnectURI(hostURI.RemoteURI())); err != nil {
 		conn.Close() // Ensure the connection is closed on failure
 		return fmt.Errorf("failed to connect to libvirt rpc for host '%s': %w", host.ID, err)
 	}
 
 	c.connections[host.ID] = l
+	c.limiters[host.ID] = newRPCLimiter(host.MaxConcurrentRPCs, libvirtProbe(l))
+	if tunneled, ok := conn.(*sshTunneledConn); ok {
+		c.sshClients[host.ID] = tunneled.client
+	}
+	c.watchDomainEvents(host.ID, l)
 	log.Printf("Successfully connected to host: %s", host.ID)
 	return nil
 }
@@ -282,11 +483,23 @@ func (c *Connector) RemoveHost(hostID string) error {
 		return fmt.Errorf("host '%s' not found", hostID)
 	}
 
+	// Forget the connection even if the goodbye fails; a dead transport
+	// (e.g. a dropped agent tunnel) would otherwise pin it in the pool.
+	delete(c.connections, hostID)
+	delete(c.sshClients, hostID)
+	delete(c.pageSizes, hostID)
+	if limiter, ok := c.limiters[hostID]; ok {
+		close(limiter.closed)
+		delete(c.limiters, hostID)
+	}
+	c.domainCache.forgetHost(hostID)
+	c.blockJobs.forgetHost(hostID)
+	c.tickets.forgetHost(hostID)
+
 	if err := l.Disconnect(); err != nil {
 		return fmt.Errorf("failed to close connection to host '%s': %w", hostID, err)
 	}
 
-	delete(c.connections, hostID)
 	log.Printf("Disconnected from host: %s", hostID)
 	return nil
 }
@@ -303,14 +516,32 @@ func (c *Connector) GetConnection(hostID string) (*libvirt.Libvirt, error) {
 	return conn, nil
 }
 
+// ConnectedHostIDs returns the IDs of all hosts with an active connection.
+func (c *Connector) ConnectedHostIDs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ids := make([]string, 0, len(c.connections))
+	for id := range c.connections {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 // GetHostInfo retrieves statistics about the host itself.
 func (c *Connector) GetHostInfo(hostID string) (*HostInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	l, err := c.GetConnection(hostID)
 	if err != nil {
 		return nil, err
 	}
 
-	_, memory, cpus, _, _, _, cores, threads, err := l.NodeGetInfo()
+	_, memory, cpus, mhz, _, sockets, cores, threads, err := l.NodeGetInfo()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get node info for host %s: %w", hostID, err)
 	}
@@ -320,13 +551,19 @@ func (c *Connector) GetHostInfo(hostID string) (*HostInfo, error) {
 		return nil, fmt.Errorf("failed to get hostname for host %s: %w", hostID, err)
 	}
 
-	return &HostInfo{
+	info := &HostInfo{
 		Hostname: hostname,
 		CPU:      uint(cpus),
 		Memory:   uint64(memory) * 1024, // The library returns KiB, we want Bytes
 		Cores:    uint(cores),
 		Threads:  uint(threads),
-	}, nil
+		Sockets:  uint(sockets),
+		CPUMHz:   uint(mhz),
+	}
+	if err := c.readHostDetails(hostID, l, info); err != nil {
+		return nil, err
+	}
+	return info, nil
 }
 
 // parseGraphicsFromXML extracts VNC and SPICE availability from a domain's XML definition.
@@ -360,42 +597,23 @@ func parseGraphicsFromXML(xmlDesc string) (GraphicsInfo, error) {
 	return graphics, nil
 }
 
-// ListAllDomains lists all domains (VMs) on a specific host.
-func (c *Connector) ListAllDomains(hostID string) ([]VMInfo, error) {
-	l, err := c.GetConnection(hostID)
+// GetDomainInfo retrieves information for a single domain.
+func (c *Connector) GetDomainInfo(hostID, vmName string) (*VMInfo, error) {
+	release, err := c.acquireRPC(hostID)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	domains, err := l.Domains()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list domains: %w", err)
-	}
-
-	var vms []VMInfo
-	for _, domain := range domains {
-		vmInfo, err := c.domainToVMInfo(l, domain)
-		if err != nil {
-			log.Printf("Warning: could not get info for domain %s on host %s: %v", domain.Name, hostID, err)
-			continue
-		}
-		vms = append(vms, *vmInfo)
-	}
-
-	return vms, nil
-}
-
-// GetDomainInfo retrieves information for a single domain.
-func (c *Connector) GetDomainInfo(hostID, vmName string) (*VMInfo, error) {
 	l, domain, err := c.getDomainByName(hostID, vmName)
 	if err != nil {
 		return nil, err
 	}
-	return c.domainToVMInfo(l, domain)
+	return c.domainToVMInfo(hostID, l, domain)
 }
 
 // domainToVMInfo is a helper to convert a libvirt.Domain object to our VMInfo struct.
-func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*VMInfo, error) {
+func (c *Connector) domainToVMInfo(hostID string, l *libvirt.Libvirt, domain libvirt.Domain) (*VMInfo, error) {
 	stateInt, _, err := l.DomainGetState(domain, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get domain state for %s: %w", domain.Name, err)
@@ -407,14 +625,6 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 		return nil, fmt.Errorf("failed to get domain info for %s: %w", domain.Name, err)
 	}
 
-	var uptime int64 = -1
-	if state == libvirt.DomainRunning {
-		seconds, nanoseconds, err := l.DomainGetTime(domain, 0)
-		if err == nil {
-			uptime = int64(seconds) + int64(nanoseconds)/1_000_000_000
-		}
-	}
-
 	persistent, err := l.DomainIsPersistent(domain)
 	if err != nil {
 		persistent = 0
@@ -423,11 +633,7 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 	if err != nil {
 		autostart = 0
 	}
-	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
-	if err != nil {
-		return nil, err
-	}
-	graphics, err := parseGraphicsFromXML(xmlDesc)
+	def, err := c.domainDefinition(hostID, domain)
 	if err != nil {
 		return nil, err
 	}
@@ -443,6 +649,21 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 		uuidStr = parsedUUID.String()
 	}
 
+	// The guest agent knows the installed OS even when the domain was not
+	// created with libosinfo metadata, so prefer it when it is reachable.
+	osInfo := def.os
+	var filesystems []storage.GuestFilesystem
+	var agentState string
+	if state == libvirt.DomainRunning {
+		agentState = def.agentState
+	}
+	if state == libvirt.DomainRunning && def.agentConnected {
+		if agentOS, ok := guestAgentOSInfo(l, domain); ok {
+			osInfo = agentOS
+		}
+		filesystems, _ = guestAgentFilesystems(l, domain)
+	}
+
 	return &VMInfo{
 		ID:         uint32(domain.ID),
 		UUID:       uuidStr,
@@ -452,15 +673,29 @@ func (c *Connector) domainToVMInfo(l *libvirt.Libvirt, domain libvirt.Domain) (*
 		Memory:     uint64(memory),
 		Vcpu:       uint(nrVirtCPU),
 		CpuTime:    cpuTime,
-		Uptime:     uptime,
 		Persistent: persistent == 1,
 		Autostart:  autostart == 1,
-		Graphics:   graphics,
+		Graphics:   def.graphics,
+		OS:         osInfo,
+
+		GuestFilesystems: filesystems,
+		GuestAgent:       agentState,
+
+		Description: def.config.Description,
+		CPUModel:    def.config.cpuModel(),
+		CPUTopology: def.config.CPU.Topology,
+		Tuning:      DomainTuning{CPUShares: def.config.CPUTune.Shares, BlkioWeight: def.config.BlkioTune.Weight},
 	}, nil
 }
 
 // GetDomainStats retrieves real-time statistics for a single domain (VM).
 func (c *Connector) GetDomainStats(hostID, vmName string) (*VMStats, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	l, domain, err := c.getDomainByName(hostID, vmName)
 	if err != nil {
 		return nil, err
@@ -490,18 +725,13 @@ func (c *Connector) GetDomainStats(hostID, vmName string) (*VMStats, error) {
 		}, nil
 	}
 
-	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	def, err := c.domainDefinition(hostID, domain)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get XML for %s to find devices: %w", vmName, err)
-	}
-
-	var def DomainHardwareXML
-	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
-		return nil, fmt.Errorf("failed to parse domain XML for devices: %w", err)
+		return nil, err
 	}
 
 	var diskStats []DomainDiskStats
-	for _, disk := range def.Devices.Disks {
+	for _, disk := range def.devices.Devices.Disks {
 		if disk.Target.Dev == "" {
 			continue
 		}
@@ -521,7 +751,7 @@ func (c *Connector) GetDomainStats(hostID, vmName string) (*VMStats, error) {
 	}
 
 	var netStats []DomainNetworkStats
-	for _, iface := range def.Devices.Interfaces {
+	for _, iface := range def.devices.Devices.Interfaces {
 		if iface.Target.Dev == "" {
 			continue
 		}
@@ -552,24 +782,26 @@ func (c *Connector) GetDomainStats(hostID, vmName string) (*VMStats, error) {
 
 // GetDomainHardware retrieves the hardware configuration for a single domain (VM).
 func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, error) {
-	l, domain, err := c.getDomainByName(hostID, vmName)
+	release, err := c.acquireRPC(hostID)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
 
-	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	_, domain, err := c.getDomainByName(hostID, vmName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get XML for %s to read hardware: %w", vmName, err)
+		return nil, err
 	}
 
-	var def DomainHardwareXML
-	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
-		return nil, fmt.Errorf("failed to parse domain XML for hardware: %w", err)
+	def, err := c.domainDefinition(hostID, domain)
+	if err != nil {
+		return nil, err
 	}
 
+	// Copy the device lists; the definition may be shared through the cache.
 	hardware := &HardwareInfo{
-		Disks:    def.Devices.Disks,
-		Networks: def.Devices.Interfaces,
+		Disks:    append([]DiskInfo(nil), def.devices.Devices.Disks...),
+		Networks: append([]NetworkInfo(nil), def.devices.Devices.Interfaces...),
 	}
 
 	// Post-process disks to populate the unified 'Path' field.
@@ -587,54 +819,83 @@ func (c *Connector) GetDomainHardware(hostID, vmName string) (*HardwareInfo, err
 // --- VM Actions ---
 
 func (c *Connector) getDomainByName(hostID, vmName string) (*libvirt.Libvirt, libvirt.Domain, error) {
-	l, err := c.GetConnection(hostID)
-	if err != nil {
-		return nil, libvirt.Domain{}, err
-	}
-	domain, err := l.DomainLookupByName(vmName)
+	var l *libvirt.Libvirt
+	var domain libvirt.Domain
+	err := c.retryRPC(hostID, func(conn *libvirt.Libvirt) (err error) {
+		l = conn
+		domain, err = conn.DomainLookupByName(vmName)
+		return err
+	})
 	if err != nil {
 		return nil, libvirt.Domain{}, fmt.Errorf("could not find VM '%s' on host '%s': %w", vmName, hostID, err)
 	}
 	return l, domain, nil
 }
 
-func (c *Connector) StartDomain(hostID, vmName string) error {
-	l, domain, err := c.getDomainByName(hostID, vmName)
+// domainAction runs a power action on a domain. The wait for an operation
+// slot and the action show in the trace of ctx.
+func (c *Connector) domainAction(ctx context.Context, hostID, vmName, name string, action func(*libvirt.Libvirt, libvirt.Domain) error) (err error) {
+	ctx, span := tracing.Start(ctx, "libvirt."+name, tracing.Host(hostID), tracing.VM(vmName))
+	defer func() { tracing.End(span, err) }()
+
+	release, err := c.acquireRPCFor(ctx, hostID)
 	if err != nil {
 		return err
 	}
-	return l.DomainCreate(domain)
-}
+	defer release()
 
-func (c *Connector) ShutdownDomain(hostID, vmName string) error {
 	l, domain, err := c.getDomainByName(hostID, vmName)
 	if err != nil {
 		return err
 	}
-	return l.DomainShutdown(domain)
+	defer c.invalidateDomain(hostID, domain)
+	return c.reportRPC(hostID, action(l, domain))
 }
 
-func (c *Connector) RebootDomain(hostID, vmName string) error {
-	l, domain, err := c.getDomainByName(hostID, vmName)
-	if err != nil {
-		return err
-	}
-	return l.DomainReboot(domain, 0)
+func (c *Connector) StartDomain(ctx context.Context, hostID, vmName string) error {
+	return c.domainAction(ctx, hostID, vmName, "StartDomain", func(l *libvirt.Libvirt, domain libvirt.Domain) error {
+		return l.DomainCreate(domain)
+	})
 }
 
-func (c *Connector) DestroyDomain(hostID, vmName string) error {
-	l, domain, err := c.getDomainByName(hostID, vmName)
+func (c *Connector) ShutdownDomain(ctx context.Context, hostID, vmName string) error {
+	return c.domainAction(ctx, hostID, vmName, "ShutdownDomain", func(l *libvirt.Libvirt, domain libvirt.Domain) error {
+		return l.DomainShutdown(domain)
+	})
+}
+
+func (c *Connector) RebootDomain(ctx context.Context, hostID, vmName string) error {
+	return c.domainAction(ctx, hostID, vmName, "RebootDomain", func(l *libvirt.Libvirt, domain libvirt.Domain) error {
+		return l.DomainReboot(domain, 0)
+	})
+}
+
+func (c *Connector) DestroyDomain(ctx context.Context, hostID, vmName string) error {
+	return c.domainAction(ctx, hostID, vmName, "DestroyDomain", func(l *libvirt.Libvirt, domain libvirt.Domain) error {
+		return l.DomainDestroy(domain)
+	})
+}
+
+func (c *Connector) ResetDomain(ctx context.Context, hostID, vmName string) error {
+	return c.domainAction(ctx, hostID, vmName, "ResetDomain", func(l *libvirt.Libvirt, domain libvirt.Domain) error {
+		return l.DomainReset(domain, 0)
+	})
+}
+
+// PingGuestAgent checks that the QEMU guest agent of a running VM answers,
+// which is a sign that the guest has finished booting.
+func (c *Connector) PingGuestAgent(hostID, vmName string) error {
+	release, err := c.acquireRPC(hostID)
 	if err != nil {
 		return err
 	}
-	return l.DomainDestroy(domain)
-}
+	defer release()
 
-func (c *Connector) ResetDomain(hostID, vmName string) error {
 	l, domain, err := c.getDomainByName(hostID, vmName)
 	if err != nil {
 		return err
 	}
-	return l.DomainReset(domain, 0)
+	_, err = l.QEMUDomainAgentCommand(domain, `{"execute":"guest-ping"}`, 5, 0)
+	return err
 }
 
@@ -0,0 +1,210 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// consoleTicketGrace is how long a ticket keeps working after the first
+// client authenticated with it. SPICE clients authenticate each of their
+// channels separately, so the ticket cannot go at the first one.
+const consoleTicketGrace = 10 * time.Second
+
+// consoleTicket is a one-time password on the live displays of a domain,
+// with the displays as they were before, to put back once it is used or
+// expires.
+type consoleTicket struct {
+	standing []graphicsDeviceXML
+	timer    *time.Timer
+	used     bool
+}
+
+// consoleTickets holds the tickets that are still on a display, by domain.
+// Tickets of a host are only noticed being used while its domain events are
+// watched; otherwise they last until they expire.
+type consoleTickets struct {
+	mu      sync.Mutex
+	pending map[domainKey]*consoleTicket
+}
+
+func newConsoleTickets() *consoleTickets {
+	return &consoleTickets{pending: make(map[domainKey]*consoleTicket)}
+}
+
+// standing returns the displays a pending ticket of a domain replaced, or
+// nil if the domain has none.
+func (ct *consoleTickets) standing(key domainKey) []graphicsDeviceXML {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if t := ct.pending[key]; t != nil {
+		return t.standing
+	}
+	return nil
+}
+
+// put records a ticket, replacing the domain's earlier one.
+func (ct *consoleTickets) put(key domainKey, t *consoleTicket) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if old := ct.pending[key]; old != nil {
+		old.timer.Stop()
+	}
+	ct.pending[key] = t
+}
+
+// take forgets the ticket of a domain, if it is still t or, with a nil t,
+// whichever it is. It returns the ticket taken.
+func (ct *consoleTickets) take(key domainKey, t *consoleTicket) *consoleTicket {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	pending := ct.pending[key]
+	if pending == nil || (t != nil && pending != t) {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(ct.pending, key)
+	return pending
+}
+
+// markUsed flags the ticket of a domain as used and returns it, or nil if
+// the domain has no ticket or it was used before.
+func (ct *consoleTickets) markUsed(key domainKey) *consoleTicket {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	t := ct.pending[key]
+	if t == nil || t.used {
+		return nil
+	}
+	t.used = true
+	return t
+}
+
+func (ct *consoleTickets) forgetHost(hostID string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for key, t := range ct.pending {
+		if key.hostID == hostID {
+			t.timer.Stop()
+			delete(ct.pending, key)
+		}
+	}
+}
+
+// trackConsoleTicket ends the ticket of a domain shortly after a client
+// authenticated with it.
+func (c *Connector) trackConsoleTicket(hostID string, ev interface{}) {
+	e, ok := ev.(*libvirt.DomainEventCallbackGraphicsMsg)
+	if !ok || libvirt.DomainEventGraphicsPhase(e.Msg.Phase) != libvirt.DomainEventGraphicsInitialize {
+		return
+	}
+	key := domainKey{hostID: hostID, uuid: e.Msg.Dom.UUID}
+	if t := c.tickets.markUsed(key); t != nil {
+		t.timer.Reset(consoleTicketGrace)
+	}
+}
+
+// SetConsoleTicket puts a one-time password on the VNC and SPICE displays
+// of a running VM, in its live definition only, so a restart never keeps
+// it. Clients already connected stay connected. The displays get their
+// standing password back shortly after the first client authenticated with
+// the ticket, or once it expires at validTo. It returns the types of the
+// displays changed.
+func (c *Connector) SetConsoleTicket(hostID, vmName, ticket string, validTo time.Time) ([]string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidateDomain(hostID, domain)
+	if active, err := l.DomainIsActive(domain); err != nil || active != 1 {
+		return nil, fmt.Errorf("%w: %s is not running", ErrNoGraphics, vmName)
+	}
+
+	key := domainKey{hostID: hostID, uuid: domain.UUID}
+	standing := c.tickets.standing(key)
+	if standing == nil {
+		if standing, err = liveGraphicsDevices(l, domain); err != nil {
+			return nil, err
+		}
+	}
+	types, err := updateGraphicsPasswords(l, domain, libvirt.DomainXMLSecure, libvirt.DomainDeviceModifyLive,
+		ticket, validTo.UTC().Format("2006-01-02T15:04:05"), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoGraphics, vmName)
+	}
+
+	t := &consoleTicket{standing: standing}
+	t.timer = time.AfterFunc(time.Until(validTo), func() {
+		if c.tickets.take(key, t) != nil {
+			c.restoreStandingGraphics(hostID, domain, t.standing)
+		}
+	})
+	c.tickets.put(key, t)
+	return types, nil
+}
+
+// liveGraphicsDevices returns the VNC and SPICE displays of a running
+// domain as they are, passwords included.
+func liveGraphicsDevices(l *libvirt.Libvirt, domain libvirt.Domain) ([]graphicsDeviceXML, error) {
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLSecure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	var def struct {
+		Graphics []graphicsDeviceXML `xml:"devices>graphics"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	var devices []graphicsDeviceXML
+	for _, g := range def.Graphics {
+		if kind := strings.ToLower(g.attr("type")); kind == "vnc" || kind == "spice" {
+			devices = append(devices, g)
+		}
+	}
+	return devices, nil
+}
+
+// restoreStandingGraphics puts back the live displays of a domain as they
+// were before a ticket. Failures are only logged: the persistent definition
+// was never changed, so the next start restores them anyway.
+func (c *Connector) restoreStandingGraphics(hostID string, domain libvirt.Domain, devices []graphicsDeviceXML) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		log.Printf("Warning: could not restore the console password of %s on host %s: %v", domain.Name, hostID, err)
+		return
+	}
+	defer release()
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		log.Printf("Warning: could not restore the console password of %s on host %s: %v", domain.Name, hostID, err)
+		return
+	}
+	defer c.invalidateDomain(hostID, domain)
+	for _, g := range devices {
+		if strings.ToLower(g.attr("type")) == "spice" {
+			g.setAttr("connected", "keep")
+		}
+		deviceXML, err := xml.Marshal(&g)
+		if err == nil {
+			err = l.DomainUpdateDeviceFlags(domain, string(deviceXML), libvirt.DomainDeviceModifyLive)
+		}
+		if err != nil {
+			log.Printf("Warning: could not restore the console password of %s on host %s: %v", domain.Name, hostID, err)
+		}
+	}
+}
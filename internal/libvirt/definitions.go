@@ -0,0 +1,133 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// ErrDefinitionMismatch is returned when a definition to restore belongs to
+// another domain.
+var ErrDefinitionMismatch = errors.New("definition belongs to another domain")
+
+// GetDomainDefinition reads the inactive definition of a VM, without the
+// secrets libvirt only shows on request, such as display passwords.
+func (c *Connector) GetDomainDefinition(hostID, vmName string) (string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	return xmlDesc, nil
+}
+
+// GetDomainXML reads the current definition of a VM, which for a running VM
+// is the live one, e.g. with the ports its displays were given.
+func (c *Connector) GetDomainXML(hostID, vmName string) (string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	return xmlDesc, nil
+}
+
+// GetDomainDefinitionsWithoutSecrets reads the inactive definition of every
+// domain of a host like GetDomainDefinitions, but without display passwords
+// and other secrets.
+func (c *Connector) GetDomainDefinitionsWithoutSecrets(hostID string) (map[string]string, error) {
+	return c.domainDefinitions(hostID, libvirt.DomainXMLInactive)
+}
+
+// RedefineDomain replaces the persistent definition of a VM with an earlier
+// one read by GetDomainDefinition. The definition has no display password,
+// so the one the VM has now is set again. A running VM goes on with its
+// current configuration until it is next started.
+func (c *Connector) RedefineDomain(hostID, vmName, domainXML string) error {
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return fmt.Errorf("invalid domain UUID '%s': %w", def.UUID, err)
+	}
+
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if domainUUID != uuid.UUID(domain.UUID) {
+		return fmt.Errorf("%w: the definition is of domain %s, %s is %s", ErrDefinitionMismatch, domainUUID, vmName, uuid.UUID(domain.UUID))
+	}
+	current, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	password, expiry, err := graphicsPassword(current)
+	if err != nil {
+		return err
+	}
+
+	defer c.invalidateDomain(hostID, domain)
+	if _, err := l.DomainDefineXML(domainXML); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to redefine %s: %w", vmName, err)
+	}
+	if password == "" {
+		return nil
+	}
+	if _, err := updateGraphicsPasswords(l, domain, libvirt.DomainXMLSecure|libvirt.DomainXMLInactive, libvirt.DomainDeviceModifyConfig, password, expiry, false); err != nil {
+		return fmt.Errorf("%s was redefined, but setting its display password again failed: %w", vmName, err)
+	}
+	return nil
+}
+
+// graphicsPassword returns the password of the first VNC or SPICE display
+// of a secure domain definition, and its expiry. SetGraphicsPassword gives
+// all displays the same one.
+func graphicsPassword(domainXML string) (string, string, error) {
+	var def struct {
+		Graphics []graphicsDeviceXML `xml:"devices>graphics"`
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return "", "", fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	for i := range def.Graphics {
+		g := &def.Graphics[i]
+		switch strings.ToLower(g.attr("type")) {
+		case "vnc", "spice":
+			if password := g.attr("passwd"); password != "" {
+				return password, g.attr("passwdValidTo"), nil
+			}
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,155 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrCompactionUnsupported is returned for domains whose disks cannot be
+// compacted safely.
+var ErrCompactionUnsupported = errors.New("disks cannot be compacted")
+
+// Ways of compacting a disk image.
+const (
+	CompactionConvert  = "convert"  // Rewrite the image with qemu-img convert, leaving out unused clusters.
+	CompactionSparsify = "sparsify" // Punch the guest's free space out of the image with virt-sparsify.
+)
+
+// CompactableDisk is a file-backed disk of a shut-off domain.
+type CompactableDisk struct {
+	Target string `json:"target"`
+	Path   string `json:"path"`
+	Format string `json:"format"`
+}
+
+// compactionDiskXML is used for unmarshalling the disks of a domain.
+type compactionDiskXML struct {
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"target"`
+}
+
+// CompactionDisks lists the file-backed qcow2 and raw disks of a domain for
+// compaction. The domain must be shut off and have no snapshots: rewriting
+// an image drops its internal snapshots, and external ones are overlays on
+// top of it.
+func (c *Connector) CompactionDisks(hostID, vmName string) ([]CompactableDisk, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return nil, fmt.Errorf("cannot compact the disks of %s: %w", vmName, ErrDomainActive)
+	}
+	if n, err := l.DomainSnapshotNum(domain, 0); err == nil && n > 0 {
+		return nil, fmt.Errorf("%w: %s has %d snapshots; delete them first", ErrCompactionUnsupported, vmName, n)
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	var def struct {
+		Disks []compactionDiskXML `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	disks := []CompactableDisk{}
+	for _, disk := range def.Disks {
+		if disk.Device != "" && disk.Device != "disk" || disk.Source.File == "" {
+			continue
+		}
+		if disk.Driver.Type != "qcow2" && disk.Driver.Type != "raw" {
+			continue
+		}
+		disks = append(disks, CompactableDisk{Target: disk.Target.Dev, Path: disk.Source.File, Format: disk.Driver.Type})
+	}
+	return disks, nil
+}
+
+// imageInfo reads an image's format, sizes and backing file with qemu-img.
+func (c *Connector) imageInfo(hostID, imagePath string) (*qemuImgInfo, error) {
+	output, err := c.RunHostCommand(hostID, "qemu-img info --output=json -U "+ShellQuote(imagePath))
+	if err != nil {
+		if errors.Is(err, ErrNoSSHChannel) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("image %s cannot be read: %s", imagePath, lastOutputLine(output, err))
+	}
+	var info qemuImgInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		return nil, fmt.Errorf("failed to parse qemu-img output for %s: %w", imagePath, err)
+	}
+	return &info, nil
+}
+
+// CompactDisk reclaims the unused space of a disk image of a shut-off
+// domain over the host's SSH channel, and returns the space the image took
+// on the host before and after. convert rewrites the image next to itself
+// and moves the copy over it, so it needs free space for the copy; compress
+// only applies to qcow2 images. sparsify works in place but needs
+// virt-sparsify on the host.
+func (c *Connector) CompactDisk(hostID, imagePath, method string, compress bool) (before, after uint64, err error) {
+	info, err := c.imageInfo(hostID, imagePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if info.Format != "qcow2" && info.Format != "raw" {
+		return 0, 0, fmt.Errorf("%w: %s is a %s image", ErrCompactionUnsupported, imagePath, info.Format)
+	}
+
+	var command string
+	switch method {
+	case CompactionConvert:
+		args := "-O " + info.Format
+		if compress && info.Format == "qcow2" {
+			args += " -c"
+		}
+		if info.BackingFilename != "" {
+			// Keep the image an overlay of the same backing file, as written.
+			args += " -B " + ShellQuote(info.BackingFilename)
+			if info.BackingFormat != "" {
+				args += " -F " + info.BackingFormat
+			}
+		}
+		src := ShellQuote(imagePath)
+		tmp := ShellQuote(imagePath + ".compact")
+		command = fmt.Sprintf("set -e; trap 'rm -f %[2]s' EXIT; qemu-img convert %[3]s %[1]s %[2]s; "+
+			"chown --reference=%[1]s %[2]s; chmod --reference=%[1]s %[2]s; mv -f %[2]s %[1]s", src, tmp, args)
+	case CompactionSparsify:
+		command = "virt-sparsify --quiet --in-place " + ShellQuote(imagePath)
+	default:
+		return 0, 0, fmt.Errorf("unknown compaction method '%s'", method)
+	}
+	if output, err := c.RunHostCommand(hostID, command); err != nil {
+		return 0, 0, fmt.Errorf("failed to compact %s: %s", imagePath, lastOutputLine(output, err))
+	}
+
+	compacted, err := c.imageInfo(hostID, imagePath)
+	if err != nil {
+		return info.ActualSize, 0, err
+	}
+	return info.ActualSize, compacted.ActualSize, nil
+}
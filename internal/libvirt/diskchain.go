@@ -0,0 +1,225 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrDiskNotFound is returned when a VM has no disk with the requested target.
+var ErrDiskNotFound = errors.New("disk not found")
+
+// maxChainDepth bounds the backing chain walk in case of a loop.
+const maxChainDepth = 64
+
+// DiskChainLayer describes one image in a disk's backing chain, starting
+// with the image the VM writes to.
+type DiskChainLayer struct {
+	Path            string `json:"path"`
+	Format          string `json:"format"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	BackingPath     string `json:"backing_path,omitempty"`
+	Error           string `json:"error,omitempty"` // Set when the layer could not be inspected.
+}
+
+// DiskChain is the backing file chain of a VM disk. Broken is set when a
+// layer is missing or unreadable, which would prevent the VM from starting.
+// Incomplete is set when the walk stopped at an image outside libvirt's
+// storage pools on a host without an SSH channel to inspect it.
+type DiskChain struct {
+	Target     string           `json:"target"`
+	Layers     []DiskChainLayer `json:"layers"`
+	Broken     bool             `json:"broken"`
+	Incomplete bool             `json:"incomplete"`
+}
+
+// chainDiskXML is used for unmarshalling a disk's source from the domain XML.
+type chainDiskXML struct {
+	Type   string `xml:"type,attr"`
+	Source struct {
+		File   string `xml:"file,attr"`
+		Dev    string `xml:"dev,attr"`
+		Pool   string `xml:"pool,attr"`
+		Volume string `xml:"volume,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"target"`
+}
+
+// volumeBackingXML is used for unmarshalling a volume's backing store.
+type volumeBackingXML struct {
+	Target struct {
+		Format struct {
+			Type string `xml:"type,attr"`
+		} `xml:"format"`
+	} `xml:"target"`
+	BackingStore struct {
+		Path string `xml:"path"`
+	} `xml:"backingStore"`
+}
+
+// qemuImgInfo holds the fields of `qemu-img info --output=json` we use.
+type qemuImgInfo struct {
+	Format              string `json:"format"`
+	VirtualSize         uint64 `json:"virtual-size"`
+	ActualSize          uint64 `json:"actual-size"`
+	FullBackingFilename string `json:"full-backing-filename"`
+	BackingFilename     string `json:"backing-filename"`
+	BackingFormat       string `json:"backing-filename-format"`
+}
+
+// GetDiskBackingChain walks the backing chain of the disk attached at the
+// given target (e.g. "vda"). Layers are resolved through libvirt's storage
+// pools, falling back to qemu-img over SSH for images outside any pool.
+func (c *Connector) GetDiskBackingChain(hostID, vmName, target string) (*DiskChain, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	var def struct {
+		Disks []chainDiskXML `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	var disk *chainDiskXML
+	for i := range def.Disks {
+		if def.Disks[i].Target.Dev == target {
+			disk = &def.Disks[i]
+			break
+		}
+	}
+	if disk == nil {
+		return nil, fmt.Errorf("%w: %s has no disk '%s'", ErrDiskNotFound, vmName, target)
+	}
+
+	chain := &DiskChain{Target: target, Layers: []DiskChainLayer{}}
+	current, err := diskSourcePath(l, disk)
+	if err != nil {
+		chain.Broken = true
+		chain.Layers = append(chain.Layers, DiskChainLayer{Error: err.Error()})
+		return chain, nil
+	}
+	if current == "" {
+		// Empty removable media or a network disk; there is no chain to walk.
+		return chain, nil
+	}
+
+	visited := make(map[string]bool)
+	for current != "" {
+		if visited[current] || len(chain.Layers) >= maxChainDepth {
+			chain.Broken = true
+			chain.Layers = append(chain.Layers, DiskChainLayer{Path: current, Error: "backing chain loops or is too deep"})
+			break
+		}
+		visited[current] = true
+
+		layer, err := c.inspectChainLayer(l, hostID, current)
+		chain.Layers = append(chain.Layers, layer)
+		if errors.Is(err, ErrNoSSHChannel) {
+			chain.Incomplete = true
+			break
+		}
+		if err != nil {
+			chain.Broken = true
+			break
+		}
+		current = layer.BackingPath
+	}
+	return chain, nil
+}
+
+func diskSourcePath(l *libvirt.Libvirt, disk *chainDiskXML) (string, error) {
+	switch {
+	case disk.Source.File != "":
+		return disk.Source.File, nil
+	case disk.Source.Dev != "":
+		return disk.Source.Dev, nil
+	case disk.Source.Pool != "" && disk.Source.Volume != "":
+		pool, err := l.StoragePoolLookupByName(disk.Source.Pool)
+		if err != nil {
+			return "", fmt.Errorf("storage pool '%s' not found: %w", disk.Source.Pool, err)
+		}
+		vol, err := l.StorageVolLookupByName(pool, disk.Source.Volume)
+		if err != nil {
+			return "", fmt.Errorf("volume '%s' not found in pool '%s': %w", disk.Source.Volume, disk.Source.Pool, err)
+		}
+		return l.StorageVolGetPath(vol)
+	}
+	return "", nil
+}
+
+// inspectChainLayer reads a single image's format, size and backing file.
+// On failure the returned layer carries the error message as well.
+func (c *Connector) inspectChainLayer(l *libvirt.Libvirt, hostID, imagePath string) (DiskChainLayer, error) {
+	layer := DiskChainLayer{Path: imagePath}
+
+	if vol, err := l.StorageVolLookupByPath(imagePath); err == nil {
+		_, capacity, allocation, infoErr := l.StorageVolGetInfo(vol)
+		xmlDesc, xmlErr := l.StorageVolGetXMLDesc(vol, 0)
+		var def volumeBackingXML
+		if infoErr == nil && xmlErr == nil && xml.Unmarshal([]byte(xmlDesc), &def) == nil {
+			layer.Format = def.Target.Format.Type
+			layer.CapacityBytes = capacity
+			layer.AllocationBytes = allocation
+			layer.BackingPath = def.BackingStore.Path
+			return layer, nil
+		}
+	}
+
+	// Not in a pool (or unreadable through one): ask qemu-img directly.
+	output, err := c.RunHostCommand(hostID, "qemu-img info --output=json -U "+ShellQuote(imagePath))
+	if err != nil {
+		if errors.Is(err, ErrNoSSHChannel) {
+			layer.Error = "image is not in any storage pool and cannot be inspected without SSH"
+		} else {
+			err = fmt.Errorf("image cannot be read: %s", lastOutputLine(output, err))
+			layer.Error = err.Error()
+		}
+		return layer, err
+	}
+	var info qemuImgInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		layer.Error = fmt.Sprintf("failed to parse qemu-img output: %v", err)
+		return layer, err
+	}
+	layer.Format = info.Format
+	layer.CapacityBytes = info.VirtualSize
+	layer.AllocationBytes = info.ActualSize
+	layer.BackingPath = info.FullBackingFilename
+	if layer.BackingPath == "" && info.BackingFilename != "" {
+		layer.BackingPath = info.BackingFilename
+		if !path.IsAbs(layer.BackingPath) {
+			layer.BackingPath = path.Join(path.Dir(imagePath), layer.BackingPath)
+		}
+	}
+	return layer, nil
+}
+
+// lastOutputLine picks the most useful message from a failed command.
+func lastOutputLine(output string, err error) string {
+	output = strings.TrimSpace(output)
+	if output == "" {
+		return err.Error()
+	}
+	return output[strings.LastIndex(output, "\n")+1:]
+}
@@ -0,0 +1,180 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrNoFreeDiskTarget is returned when every device name for a bus is taken.
+var ErrNoFreeDiskTarget = errors.New("no free disk target")
+
+// DiskAttachSpec describes a disk to attach to a VM.
+type DiskAttachSpec struct {
+	Path     string // Image path on the host
+	Block    bool   // Path is a block device rather than a file
+	Format   string // Driver format, e.g. 'qcow2', 'raw'
+	Target   string // Guest device name, e.g. 'vdb'; chosen automatically when empty
+	Bus      string // 'virtio' (default), 'scsi', 'sata' or 'ide'
+	ReadOnly bool
+	Discard  string // 'unmap' or 'ignore'; empty leaves the hypervisor's default
+}
+
+// DiskDiscardModes are the accepted discard settings of a disk. 'unmap'
+// passes the guest's discards on to the image, freeing space on the host;
+// 'ignore' drops them.
+var DiskDiscardModes = map[string]bool{"unmap": true, "ignore": true}
+
+// diskTargetPrefixes maps a bus to the device name prefix libvirt expects.
+var diskTargetPrefixes = map[string]string{
+	"virtio": "vd",
+	"scsi":   "sd",
+	"sata":   "sd",
+	"usb":    "sd",
+	"ide":    "hd",
+}
+
+// newDiskXML is used for marshalling a disk device definition.
+type newDiskXML struct {
+	XMLName xml.Name `xml:"disk"`
+	Type    string   `xml:"type,attr"`
+	Device  string   `xml:"device,attr"`
+	Driver  struct {
+		Name    string `xml:"name,attr"`
+		Type    string `xml:"type,attr"`
+		Discard string `xml:"discard,attr,omitempty"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr,omitempty"`
+		Dev  string `xml:"dev,attr,omitempty"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+	ReadOnly *struct{} `xml:"readonly,omitempty"`
+}
+
+// AttachDisk adds a disk to a VM's persistent definition, and hot-plugs it
+// as well when the VM is running. It returns the target the disk was
+// attached at.
+func (c *Connector) AttachDisk(hostID, vmName string, spec DiskAttachSpec) (string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+
+	if spec.Bus == "" {
+		spec.Bus = "virtio"
+	}
+	prefix, ok := diskTargetPrefixes[spec.Bus]
+	if !ok {
+		return "", fmt.Errorf("unsupported disk bus %q", spec.Bus)
+	}
+	if spec.Target == "" {
+		spec.Target, err = nextDiskTarget(l, domain, prefix)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	def := newDiskXML{Device: "disk"}
+	def.Driver.Name = "qemu"
+	def.Driver.Type = spec.Format
+	def.Driver.Discard = spec.Discard
+	if spec.Block {
+		def.Type = "block"
+		def.Source.Dev = spec.Path
+	} else {
+		def.Type = "file"
+		def.Source.File = spec.Path
+	}
+	def.Target.Dev = spec.Target
+	def.Target.Bus = spec.Bus
+	if spec.ReadOnly {
+		def.ReadOnly = &struct{}{}
+	}
+	diskXML, err := xml.Marshal(def)
+	if err != nil {
+		return "", fmt.Errorf("failed to build disk XML: %w", err)
+	}
+
+	running, err := requireHotplug(l, domain, func(hc *HotplugCapabilities) HotplugSupport { return hc.DiskBuses[spec.Bus] })
+	if err != nil {
+		return "", err
+	}
+	flags := libvirt.DomainDeviceModifyConfig
+	if running {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	if err := l.DomainAttachDeviceFlags(domain, string(diskXML), uint32(flags)); c.reportRPC(hostID, err) != nil {
+		return "", fmt.Errorf("failed to attach disk to %s: %w", vmName, err)
+	}
+	c.invalidateDomain(hostID, domain)
+	return spec.Target, nil
+}
+
+// nextDiskTarget picks the first unused device name with the given prefix,
+// e.g. 'vdb' when 'vda' is taken.
+func nextDiskTarget(l *libvirt.Libvirt, domain libvirt.Domain, prefix string) (string, error) {
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	var def DomainHardwareXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return "", fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	used := make(map[string]bool)
+	for _, disk := range def.Devices.Disks {
+		used[disk.Target.Dev] = true
+	}
+	for ch := 'a'; ch <= 'z'; ch++ {
+		if target := prefix + string(ch); !used[target] {
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("%w for prefix %s on %s", ErrNoFreeDiskTarget, prefix, domain.Name)
+}
+
+// GetDomainDiskCapacity returns the summed virtual size of a VM's disks,
+// leaving out CD-ROMs and floppies. Disks whose size cannot be read, such as
+// network disks of a stopped VM, are skipped.
+func (c *Connector) GetDomainDiskCapacity(hostID, vmName string) (uint64, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return 0, err
+	}
+	def, err := c.domainDefinition(hostID, domain)
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, disk := range def.devices.Devices.Disks {
+		if disk.Device != "disk" || disk.Target.Dev == "" {
+			continue
+		}
+		_, capacity, _, err := l.DomainGetBlockInfo(domain, disk.Target.Dev, 0)
+		if err != nil {
+			continue
+		}
+		total += capacity
+	}
+	return total, nil
+}
@@ -0,0 +1,239 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// domainCacheEvents are the domain events after which a cached domain XML may
+// be stale: lifecycle changes (start, stop, define, ...), device hotplug,
+// media changes, block jobs that replace a disk's source and the guest agent
+// connecting or disconnecting. Graphics events do not invalidate anything;
+// they tell when a console ticket was used.
+var domainCacheEvents = []libvirt.DomainEventID{
+	libvirt.DomainEventIDLifecycle,
+	libvirt.DomainEventIDAgentLifecycle,
+	libvirt.DomainEventIDDeviceAdded,
+	libvirt.DomainEventIDDeviceRemoved,
+	libvirt.DomainEventIDDiskChange,
+	libvirt.DomainEventIDBlockJob2,
+	libvirt.DomainEventIDGraphics,
+}
+
+type domainKey struct {
+	hostID string
+	uuid   libvirt.UUID
+}
+
+// domainDefinition is the parsed part of a domain XML that is read on every
+// stats poll and sync.
+type domainDefinition struct {
+	devices        DomainHardwareXML
+	graphics       GraphicsInfo
+	config         domainConfigXML
+	os             OSInfo
+	agentState     string
+	agentConnected bool
+}
+
+// domainCache holds parsed domain definitions keyed by domain UUID. Entries
+// are only kept for hosts whose domain events are being watched, since
+// events are what invalidates them. Every invalidation bumps the domain's
+// generation; a definition fetched while an invalidation happened, or while
+// the host's watch was replaced, is not stored, so a slow fetch cannot put
+// stale XML back into the cache.
+type domainCache struct {
+	mu          sync.Mutex
+	entries     map[domainKey]*domainDefinition
+	generations map[domainKey]uint64
+	watched     map[string]*domainWatch
+}
+
+// domainWatch is the event subscription of one host connection.
+type domainWatch struct {
+	cancel context.CancelFunc
+}
+
+func newDomainCache() *domainCache {
+	return &domainCache{
+		entries:     make(map[domainKey]*domainDefinition),
+		generations: make(map[domainKey]uint64),
+		watched:     make(map[string]*domainWatch),
+	}
+}
+
+// cacheTicket records the state of the cache when a definition was looked up,
+// so that store can tell whether the definition fetched since is still valid.
+type cacheTicket struct {
+	watch      *domainWatch
+	generation uint64
+}
+
+// lookup returns the cached definition of a domain, or a ticket to pass to
+// store after fetching it.
+func (dc *domainCache) lookup(key domainKey) (*domainDefinition, cacheTicket) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.entries[key], cacheTicket{watch: dc.watched[key.hostID], generation: dc.generations[key]}
+}
+
+// store caches a definition unless the domain was invalidated, or the host's
+// event watch changed, since the lookup.
+func (dc *domainCache) store(key domainKey, ticket cacheTicket, def *domainDefinition) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if ticket.watch == nil || dc.watched[key.hostID] != ticket.watch || dc.generations[key] != ticket.generation {
+		return
+	}
+	dc.entries[key] = def
+}
+
+func (dc *domainCache) invalidate(key domainKey) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.generations[key]++
+	delete(dc.entries, key)
+}
+
+// forgetHost drops a host's entries and stops caching for it.
+func (dc *domainCache) forgetHost(hostID string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.unwatchLocked(hostID)
+}
+
+// unwatch stops caching for a host, unless a newer connection's watch has
+// replaced the given one.
+func (dc *domainCache) unwatch(hostID string, w *domainWatch) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.watched[hostID] == w {
+		dc.unwatchLocked(hostID)
+	}
+}
+
+func (dc *domainCache) unwatchLocked(hostID string) {
+	if w, ok := dc.watched[hostID]; ok {
+		w.cancel()
+		delete(dc.watched, hostID)
+	}
+	for key := range dc.entries {
+		if key.hostID == hostID {
+			delete(dc.entries, key)
+		}
+	}
+}
+
+// watchDomainEvents subscribes to the events that invalidate cached domain
+// XML on a host, and passes on those that define or undefine a domain. If
+// the subscription fails, or once the connection drops, the host's domains
+// are simply not cached.
+func (c *Connector) watchDomainEvents(hostID string, l *libvirt.Libvirt) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var streams []<-chan interface{}
+	for _, id := range domainCacheEvents {
+		events, err := l.SubscribeEvents(ctx, id, libvirt.OptDomain{})
+		if err != nil {
+			cancel()
+			log.Printf("Warning: could not subscribe to domain events on host %s; domain XML will not be cached: %v", hostID, err)
+			return
+		}
+		streams = append(streams, events)
+	}
+
+	w := &domainWatch{cancel: cancel}
+	c.domainCache.mu.Lock()
+	c.domainCache.unwatchLocked(hostID)
+	c.domainCache.watched[hostID] = w
+	c.domainCache.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, events := range streams {
+		wg.Add(1)
+		go func(events <-chan interface{}) {
+			defer wg.Done()
+			for ev := range events {
+				if dom, ok := eventDomain(ev); ok {
+					c.domainCache.invalidate(domainKey{hostID: hostID, uuid: dom.UUID})
+				}
+				c.publishDefinition(hostID, ev)
+				c.blockJobs.track(hostID, ev)
+				c.trackConsoleTicket(hostID, ev)
+			}
+		}(events)
+	}
+	go func() {
+		select {
+		case <-l.Disconnected():
+		case <-ctx.Done():
+		}
+		cancel()
+		wg.Wait()
+		c.domainCache.unwatch(hostID, w)
+	}()
+}
+
+// eventDomain returns the domain an invalidating event is about.
+func eventDomain(ev interface{}) (libvirt.Domain, bool) {
+	switch e := ev.(type) {
+	case *libvirt.DomainEventCallbackLifecycleMsg:
+		return e.Msg.Dom, true
+	case *libvirt.DomainEventCallbackAgentLifecycleMsg:
+		return e.Dom, true
+	case *libvirt.DomainEventCallbackDeviceAddedMsg:
+		return e.Dom, true
+	case *libvirt.DomainEventCallbackDeviceRemovedMsg:
+		return e.Msg.Dom, true
+	case *libvirt.DomainEventCallbackDiskChangeMsg:
+		return e.Msg.Dom, true
+	case *libvirt.DomainEventBlockJob2Msg:
+		return e.Dom, true
+	}
+	return libvirt.Domain{}, false
+}
+
+// invalidateDomain drops a domain's cached XML after Virtumancer changed the
+// domain itself, without waiting for the event to arrive.
+func (c *Connector) invalidateDomain(hostID string, domain libvirt.Domain) {
+	c.domainCache.invalidate(domainKey{hostID: hostID, uuid: domain.UUID})
+}
+
+// domainDefinition returns the parsed devices, configuration and OS of a
+// domain, served from the cache when the host's events are watched.
+func (c *Connector) domainDefinition(hostID string, domain libvirt.Domain) (*domainDefinition, error) {
+	key := domainKey{hostID: hostID, uuid: domain.UUID}
+	cached, ticket := c.domainCache.lookup(key)
+	if cached != nil {
+		return cached, nil
+	}
+
+	var xmlDesc string
+	err := c.retryRPC(hostID, func(l *libvirt.Libvirt) (err error) {
+		xmlDesc, err = l.DomainGetXMLDesc(domain, 0)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	def := &domainDefinition{}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def.devices); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML for devices: %w", err)
+	}
+	def.graphics, err = parseGraphicsFromXML(xmlDesc)
+	if err != nil {
+		return nil, err
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def.config); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML for configuration: %w", err)
+	}
+	def.os = osInfoFromLibosinfo(def.config.Libosinfo.ID)
+	def.agentState = def.config.agentState()
+	def.agentConnected = def.config.agentConnected()
+	c.domainCache.store(key, ticket, def)
+	return def, nil
+}
@@ -0,0 +1,382 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrDomainExists is returned when defining a domain under a name that is
+// already taken on the host.
+var ErrDomainExists = errors.New("a domain with this name already exists")
+
+// Guest profiles a new domain can be defined with.
+const (
+	GuestProfileLinux   = "linux"
+	GuestProfileWindows = "windows"
+)
+
+// Firmware a new domain can boot with.
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
+// DomainSpec describes a new domain. Disks boot before CD-ROMs, so an empty
+// boot disk falls through to the installer.
+type DomainSpec struct {
+	Name        string
+	Description string
+	Profile     string // GuestProfileLinux or GuestProfileWindows
+	VCPUs       uint
+	MemoryBytes uint64
+	Firmware    string // FirmwareBIOS or FirmwareEFI
+	SecureBoot  bool   // EFI only
+	TPM         bool   // Emulated TPM 2.0
+	Disks       []DiskAttachSpec
+	CDROMs      []string // ISO paths, attached on the sata bus
+}
+
+// hypervXML is the set of Hyper-V enlightenments Windows guests get; they
+// cut the cost of timers, interrupts and spinlocks under KVM.
+type hypervXML struct {
+	Mode      string       `xml:"mode,attr"`
+	Relaxed   stateXML     `xml:"relaxed"`
+	VAPIC     stateXML     `xml:"vapic"`
+	Spinlocks spinlocksXML `xml:"spinlocks"`
+	VPIndex   stateXML     `xml:"vpindex"`
+	Runtime   stateXML     `xml:"runtime"`
+	SynIC     stateXML     `xml:"synic"`
+	STimer    stateXML     `xml:"stimer"`
+	Reset     stateXML     `xml:"reset"`
+	Frequency stateXML     `xml:"frequencies"`
+	TLBFlush  stateXML     `xml:"tlbflush"`
+	IPI       stateXML     `xml:"ipi"`
+}
+
+type stateXML struct {
+	State string `xml:"state,attr"`
+}
+
+type spinlocksXML struct {
+	State   string `xml:"state,attr"`
+	Retries uint   `xml:"retries,attr"`
+}
+
+type firmwareFeatureXML struct {
+	Enabled string `xml:"enabled,attr"`
+	Name    string `xml:"name,attr"`
+}
+
+type loaderXML struct {
+	Secure string `xml:"secure,attr"`
+}
+
+type bootXML struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type tpmXML struct {
+	Model   string `xml:"model,attr"`
+	Backend struct {
+		Type    string `xml:"type,attr"`
+		Version string `xml:"version,attr"`
+	} `xml:"backend"`
+}
+
+type timerXML struct {
+	Name       string `xml:"name,attr"`
+	TickPolicy string `xml:"tickpolicy,attr,omitempty"`
+	Present    string `xml:"present,attr,omitempty"`
+}
+
+// newDomainXML is used for marshalling a new domain definition.
+type newDomainXML struct {
+	XMLName       xml.Name `xml:"domain"`
+	Type          string   `xml:"type,attr"`
+	Name          string   `xml:"name"`
+	Description   string   `xml:"description,omitempty"`
+	Memory        xmlSize  `xml:"memory"`
+	CurrentMemory xmlSize  `xml:"currentMemory"`
+	VCPU          uint     `xml:"vcpu"`
+	OS            struct {
+		Firmware string `xml:"firmware,attr,omitempty"`
+		Type     struct {
+			Arch    string `xml:"arch,attr"`
+			Machine string `xml:"machine,attr"`
+			Value   string `xml:",chardata"`
+		} `xml:"type"`
+		Features []firmwareFeatureXML `xml:"firmware>feature,omitempty"`
+		Loader   *loaderXML           `xml:"loader,omitempty"`
+		Boot     []bootXML            `xml:"boot"`
+	} `xml:"os"`
+	Features struct {
+		ACPI   *struct{}  `xml:"acpi"`
+		APIC   *struct{}  `xml:"apic"`
+		HyperV *hypervXML `xml:"hyperv,omitempty"`
+		SMM    *stateXML  `xml:"smm,omitempty"`
+	} `xml:"features"`
+	CPU struct {
+		Mode string `xml:"mode,attr"`
+	} `xml:"cpu"`
+	Clock struct {
+		Offset string     `xml:"offset,attr"`
+		Timers []timerXML `xml:"timer"`
+	} `xml:"clock"`
+	OnPoweroff string `xml:"on_poweroff"`
+	OnReboot   string `xml:"on_reboot"`
+	OnCrash    string `xml:"on_crash"`
+	Devices    struct {
+		Disks   []newDiskXML `xml:"disk"`
+		Channel struct {
+			Type   string `xml:"type,attr"`
+			Target struct {
+				Type string `xml:"type,attr"`
+				Name string `xml:"name,attr"`
+			} `xml:"target"`
+		} `xml:"channel"`
+		Serial struct {
+			Type string `xml:"type,attr"`
+		} `xml:"serial"`
+		Input struct {
+			Type string `xml:"type,attr"`
+			Bus  string `xml:"bus,attr"`
+		} `xml:"input"`
+		Graphics struct {
+			Type     string `xml:"type,attr"`
+			Port     int    `xml:"port,attr"`
+			AutoPort string `xml:"autoport,attr"`
+		} `xml:"graphics"`
+		Video struct {
+			Model struct {
+				Type string `xml:"type,attr"`
+			} `xml:"model"`
+		} `xml:"video"`
+		TPM        *tpmXML `xml:"tpm,omitempty"`
+		MemBalloon struct {
+			Model string `xml:"model,attr"`
+			Stats struct {
+				Period uint `xml:"period,attr"`
+			} `xml:"stats"`
+		} `xml:"memballoon"`
+		RNG struct {
+			Model   string `xml:"model,attr"`
+			Backend struct {
+				Model string `xml:"model,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"backend"`
+		} `xml:"rng"`
+	} `xml:"devices"`
+}
+
+// buildDomainXML turns a spec into a domain definition for a host with the
+// given architecture and hypervisor type.
+func buildDomainXML(spec DomainSpec, arch, domainType string) (string, error) {
+	windows := spec.Profile == GuestProfileWindows
+	on := stateXML{State: "on"}
+
+	var def newDomainXML
+	def.Type = domainType
+	def.Name = spec.Name
+	def.Description = spec.Description
+	memoryKiB := spec.MemoryBytes >> 10
+	def.Memory = xmlSize{Unit: "KiB", Value: memoryKiB}
+	def.CurrentMemory = xmlSize{Unit: "KiB", Value: memoryKiB}
+	def.VCPU = spec.VCPUs
+
+	def.OS.Type.Arch = arch
+	def.OS.Type.Machine = "q35"
+	def.OS.Type.Value = "hvm"
+	if spec.Firmware == FirmwareEFI {
+		def.OS.Firmware = "efi"
+		if spec.SecureBoot {
+			def.OS.Features = []firmwareFeatureXML{{Enabled: "yes", Name: "secure-boot"}, {Enabled: "yes", Name: "enrolled-keys"}}
+			def.OS.Loader = &loaderXML{Secure: "yes"}
+			// Secure boot keeps its variable store in SMM-only memory.
+			def.Features.SMM = &on
+		}
+	}
+	def.OS.Boot = []bootXML{{Dev: "hd"}, {Dev: "cdrom"}}
+
+	def.Features.ACPI = &struct{}{}
+	def.Features.APIC = &struct{}{}
+	def.CPU.Mode = "host-model"
+	def.Clock.Offset = "utc"
+	def.Clock.Timers = []timerXML{
+		{Name: "rtc", TickPolicy: "catchup"},
+		{Name: "pit", TickPolicy: "delay"},
+		{Name: "hpet", Present: "no"},
+	}
+	if windows {
+		def.Features.HyperV = &hypervXML{
+			Mode: "custom", Relaxed: on, VAPIC: on, Spinlocks: spinlocksXML{State: "on", Retries: 8191},
+			VPIndex: on, Runtime: on, SynIC: on, STimer: on, Reset: on, Frequency: on, TLBFlush: on, IPI: on,
+		}
+		// Windows keeps the RTC in local time.
+		def.Clock.Offset = "localtime"
+		def.Clock.Timers = append(def.Clock.Timers, timerXML{Name: "hypervclock", Present: "yes"})
+	}
+	def.OnPoweroff, def.OnReboot, def.OnCrash = "destroy", "restart", "destroy"
+
+	targets := make(map[string]bool)
+	for _, disk := range spec.Disks {
+		if disk.Bus == "" {
+			disk.Bus = "virtio"
+		}
+		prefix, ok := diskTargetPrefixes[disk.Bus]
+		if !ok {
+			return "", fmt.Errorf("unsupported disk bus %q", disk.Bus)
+		}
+		d := newDiskXML{Type: "file", Device: "disk"}
+		if disk.Block {
+			d.Type = "block"
+			d.Source.Dev = disk.Path
+		} else {
+			d.Source.File = disk.Path
+		}
+		d.Driver.Name = "qemu"
+		d.Driver.Type = disk.Format
+		d.Driver.Discard = disk.Discard
+		target, err := takeDiskTarget(prefix, targets)
+		if err != nil {
+			return "", err
+		}
+		d.Target.Dev = target
+		d.Target.Bus = disk.Bus
+		if disk.ReadOnly {
+			d.ReadOnly = &struct{}{}
+		}
+		def.Devices.Disks = append(def.Devices.Disks, d)
+	}
+	for _, path := range spec.CDROMs {
+		d := newDiskXML{Type: "file", Device: "cdrom"}
+		d.Source.File = path
+		d.Driver.Name = "qemu"
+		d.Driver.Type = "raw"
+		target, err := takeDiskTarget("sd", targets)
+		if err != nil {
+			return "", err
+		}
+		d.Target.Dev = target
+		d.Target.Bus = "sata"
+		d.ReadOnly = &struct{}{}
+		def.Devices.Disks = append(def.Devices.Disks, d)
+	}
+
+	def.Devices.Channel.Type = "unix"
+	def.Devices.Channel.Target.Type = "virtio"
+	def.Devices.Channel.Target.Name = "org.qemu.guest_agent.0"
+	def.Devices.Serial.Type = "pty"
+	def.Devices.Input.Type = "tablet"
+	def.Devices.Input.Bus = "usb"
+	def.Devices.Graphics.Type = "vnc"
+	def.Devices.Graphics.Port = -1
+	def.Devices.Graphics.AutoPort = "yes"
+	// Windows has no virtio-gpu driver in the box.
+	def.Devices.Video.Model.Type = "virtio"
+	if windows {
+		def.Devices.Video.Model.Type = "vga"
+	}
+	if spec.TPM {
+		def.Devices.TPM = &tpmXML{Model: "tpm-crb"}
+		def.Devices.TPM.Backend.Type = "emulator"
+		def.Devices.TPM.Backend.Version = "2.0"
+	}
+	// Balloon statistics feed the balloon policy.
+	def.Devices.MemBalloon.Model = "virtio"
+	def.Devices.MemBalloon.Stats.Period = 10
+	def.Devices.RNG.Model = "virtio"
+	def.Devices.RNG.Backend.Model = "random"
+	def.Devices.RNG.Backend.Value = "/dev/urandom"
+
+	out, err := xml.Marshal(def)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain XML: %w", err)
+	}
+	return string(out), nil
+}
+
+// takeDiskTarget returns the first device name with the prefix not taken
+// yet, and marks it as taken.
+func takeDiskTarget(prefix string, taken map[string]bool) (string, error) {
+	for ch := 'a'; ch <= 'z'; ch++ {
+		if target := prefix + string(ch); !taken[target] {
+			taken[target] = true
+			return target, nil
+		}
+	}
+	return "", fmt.Errorf("%w for prefix %s", ErrNoFreeDiskTarget, prefix)
+}
+
+// DefineDomain defines a new, shut-off domain on a host. It uses KVM when
+// the host offers it and plain emulation otherwise.
+func (c *Connector) DefineDomain(hostID string, spec DomainSpec) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.DomainLookupByName(spec.Name); err == nil {
+		return fmt.Errorf("%w: %s", ErrDomainExists, spec.Name)
+	} else if !isLibvirtError(err, libvirt.ErrNoDomain) {
+		return fmt.Errorf("failed to look up domain %s: %w", spec.Name, err)
+	}
+
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		return err
+	}
+	arch := caps.Host.CPU.Arch
+	domainType := "qemu"
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != arch {
+			continue
+		}
+		for _, d := range guest.Arch.Domains {
+			if d.Type == "kvm" {
+				domainType = "kvm"
+			}
+		}
+	}
+
+	domainXML, err := buildDomainXML(spec, arch, domainType)
+	if err != nil {
+		return err
+	}
+	if _, err := l.DomainDefineXML(domainXML); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to define %s on host %s: %w", spec.Name, hostID, err)
+	}
+	return nil
+}
+
+// UndefineDomain removes the definition of a shut-off domain along with its
+// NVRAM. Its disks are kept.
+func (c *Connector) UndefineDomain(hostID, vmName string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := requireShutoff(l, domain, vmName); err != nil {
+		return err
+	}
+	defer c.invalidateDomain(hostID, domain)
+	flags := libvirt.DomainUndefineManagedSave | libvirt.DomainUndefineSnapshotsMetadata |
+		libvirt.DomainUndefineNvram
+	if err := l.DomainUndefineFlags(domain, flags); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to undefine %s on host %s: %w", vmName, hostID, err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package libvirt
+
+import (
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainChange is how a domain's definition changed.
+type DomainChange string
+
+const (
+	DomainCreated DomainChange = "created" // Defined anew, or under a new name
+	DomainUpdated DomainChange = "updated" // Redefined, e.g. from a snapshot
+	DomainDeleted DomainChange = "deleted" // Undefined, or renamed away
+)
+
+// domainDefinitionBuffer is how many definition events are held for a slow
+// consumer before further ones are dropped. The periodic sync catches up
+// on what was dropped.
+const domainDefinitionBuffer = 256
+
+// DomainDefinitionEvent reports that a domain was defined or undefined on a
+// host, whether by Virtumancer or by someone else, e.g. with virsh.
+type DomainDefinitionEvent struct {
+	HostID string
+	Name   string
+	Change DomainChange
+}
+
+// DomainDefinitionEvents returns the definition events of the domains of all
+// connected hosts. There is a single stream, meant for one consumer.
+func (c *Connector) DomainDefinitionEvents() <-chan DomainDefinitionEvent {
+	return c.definitions
+}
+
+// publishDefinition passes on a lifecycle event that defined or undefined a
+// domain. Other lifecycle events are ignored.
+func (c *Connector) publishDefinition(hostID string, ev interface{}) {
+	e, ok := ev.(*libvirt.DomainEventCallbackLifecycleMsg)
+	if !ok {
+		return
+	}
+	event := DomainDefinitionEvent{HostID: hostID, Name: e.Msg.Dom.Name}
+	switch libvirt.DomainEventType(e.Msg.Event) {
+	case libvirt.DomainEventDefined:
+		event.Change = DomainUpdated
+		switch libvirt.DomainEventDefinedDetailType(e.Msg.Detail) {
+		case libvirt.DomainEventDefinedAdded, libvirt.DomainEventDefinedRenamed:
+			event.Change = DomainCreated
+		}
+	case libvirt.DomainEventUndefined:
+		event.Change = DomainDeleted
+	default:
+		return
+	}
+	select {
+	case c.definitions <- event:
+	default:
+		log.Printf("Warning: dropped %s event of domain %s on host %s; the periodic sync will pick it up", event.Change, event.Name, hostID)
+	}
+}
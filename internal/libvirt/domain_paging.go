@@ -0,0 +1,203 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Domain listings are served in pages so that hosts with thousands of
+// domains neither hold a connection for minutes nor time out the API. The
+// details of a page are gathered by a few workers, paced so a listing never
+// takes all of a host's operation slots.
+const (
+	DefaultDomainPageSize = 100
+	MaxDomainPageSize     = 1000
+	domainInfoWorkers     = 4
+	domainInfoRate        = 200 // Domains per second and listing
+)
+
+// ErrInvalidContinueToken is returned for a continuation token that was not
+// produced by a domain listing.
+var ErrInvalidContinueToken = errors.New("invalid continuation token")
+
+// DomainPage is one page of a host's domains, ordered by name.
+type DomainPage struct {
+	Domains []VMInfo `json:"domains"`
+	// Continue resumes the listing after this page; empty on the last page.
+	Continue string `json:"continue,omitempty"`
+	// Partial is set when the deadline ran out before the page was complete.
+	Partial bool `json:"partial"`
+	// Total is the number of domains on the host.
+	Total int `json:"total"`
+}
+
+// ListDomainsPage lists up to limit domains of a host, starting after the
+// continuation token of the previous page. Details are gathered until ctx is
+// done; the domains gathered by then are returned as a partial page whose
+// token continues with the rest.
+func (c *Connector) ListDomainsPage(ctx context.Context, hostID, token string, limit int) (*DomainPage, error) {
+	if limit <= 0 {
+		limit = DefaultDomainPageSize
+	}
+	if limit > MaxDomainPageSize {
+		limit = MaxDomainPageSize
+	}
+	after, err := decodeContinueToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	l, domains, err := c.listDomainHandles(ctx, hostID)
+	if err != nil {
+		return nil, err
+	}
+	start := sort.Search(len(domains), func(i int) bool { return domains[i].Name > after })
+	end := min(start+limit, len(domains))
+
+	infos, gathered := c.gatherDomainInfo(ctx, hostID, l, domains[start:end])
+	page := &DomainPage{Domains: []VMInfo{}, Total: len(domains)}
+	for _, info := range infos[:gathered] {
+		if info != nil {
+			page.Domains = append(page.Domains, *info)
+		}
+	}
+	page.Partial = start+gathered < end
+	if start+gathered < len(domains) && gathered > 0 {
+		page.Continue = encodeContinueToken(domains[start+gathered-1].Name)
+	} else if page.Partial {
+		// Nothing was gathered in time: retry from the same place.
+		page.Continue = token
+	}
+	return page, nil
+}
+
+// ListAllDomains lists all domains (VMs) on a specific host, one page at a
+// time.
+func (c *Connector) ListAllDomains(hostID string) ([]VMInfo, error) {
+	return c.ListAllDomainsContext(context.Background(), hostID)
+}
+
+// ListAllDomainsContext is ListAllDomains that gives up once ctx is done.
+func (c *Connector) ListAllDomainsContext(ctx context.Context, hostID string) ([]VMInfo, error) {
+	var vms []VMInfo
+	token := ""
+	for {
+		page, err := c.ListDomainsPage(ctx, hostID, token, MaxDomainPageSize)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		vms = append(vms, page.Domains...)
+		if page.Continue == "" {
+			return vms, nil
+		}
+		token = page.Continue
+	}
+}
+
+// listDomainHandles returns the handles of every domain of a host, ordered
+// by name. Only names and UUIDs are fetched, which is cheap even for huge
+// hosts.
+func (c *Connector) listDomainHandles(ctx context.Context, hostID string) (*libvirt.Libvirt, []libvirt.Domain, error) {
+	release, err := c.acquireRPCContext(ctx, hostID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var l *libvirt.Libvirt
+	var domains []libvirt.Domain
+	err = c.retryRPC(hostID, func(conn *libvirt.Libvirt) (err error) {
+		l = conn
+		domains, err = conn.Domains()
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	return l, domains, nil
+}
+
+// gatherDomainInfo fetches the details of domains with a small worker pool.
+// It returns them in order, nil for domains whose details could not be read,
+// and how many leading domains were handled before ctx was done.
+func (c *Connector) gatherDomainInfo(ctx context.Context, hostID string, l *libvirt.Libvirt, domains []libvirt.Domain) ([]*VMInfo, int) {
+	infos := make([]*VMInfo, len(domains))
+	done := make([]bool, len(domains))
+
+	ticker := time.NewTicker(time.Second / domainInfoRate)
+	defer ticker.Stop()
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for i := range domains {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case next <- i:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < min(domainInfoWorkers, len(domains)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				release, err := c.acquireRPCContext(ctx, hostID)
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Warning: could not get info for domain %s on host %s: %v", domains[i].Name, hostID, err)
+						done[i] = true
+					}
+					continue
+				}
+				info, err := c.domainToVMInfo(hostID, l, domains[i])
+				release()
+				if err != nil {
+					log.Printf("Warning: could not get info for domain %s on host %s: %v", domains[i].Name, hostID, err)
+				}
+				infos[i], done[i] = info, true
+			}
+		}()
+	}
+	wg.Wait()
+
+	gathered := 0
+	for gathered < len(done) && done[gathered] {
+		gathered++
+	}
+	return infos, gathered
+}
+
+func encodeContinueToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+func decodeContinueToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(name) == 0 {
+		return "", ErrInvalidContinueToken
+	}
+	return string(name), nil
+}
@@ -0,0 +1,87 @@
+package libvirt
+
+import (
+	"errors"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Kinds of libvirt errors, grouped by what a client can do about them.
+const (
+	ErrorKindNotFound     = "not_found"     // The object does not exist
+	ErrorKindInvalidState = "invalid_state" // Not possible in the object's current state, e.g. starting a running domain
+	ErrorKindExists       = "exists"        // An object with that name or UUID already exists
+	ErrorKindDenied       = "denied"        // Refused by libvirt's access control or authentication
+	ErrorKindInvalid      = "invalid"       // Bad argument or XML
+	ErrorKindUnsupported  = "unsupported"   // Not supported by the hypervisor or driver
+	ErrorKindTimeout      = "timeout"       // The daemon or guest agent did not answer in time
+	ErrorKindFailed       = "failed"        // Anything else
+)
+
+// ErrorInfo identifies an error reported by a libvirt daemon. The daemon also
+// reports which subsystem raised the error, but go-libvirt does not pass that
+// on, so only the error number is known.
+type ErrorInfo struct {
+	Code int    `json:"code"`           // virErrorNumber
+	Name string `json:"name,omitempty"` // e.g. VIR_ERR_OPERATION_INVALID; empty for numbers not listed here
+	Kind string `json:"kind"`           // One of the ErrorKind* constants
+}
+
+// libvirtErrors names the error numbers clients are most likely to act on.
+var libvirtErrors = map[libvirt.ErrorNumber]struct{ name, kind string }{
+	libvirt.ErrNoDomain:              {"VIR_ERR_NO_DOMAIN", ErrorKindNotFound},
+	libvirt.ErrNoNetwork:             {"VIR_ERR_NO_NETWORK", ErrorKindNotFound},
+	libvirt.ErrNoStoragePool:         {"VIR_ERR_NO_STORAGE_POOL", ErrorKindNotFound},
+	libvirt.ErrNoStorageVol:          {"VIR_ERR_NO_STORAGE_VOL", ErrorKindNotFound},
+	libvirt.ErrNoDomainSnapshot:      {"VIR_ERR_NO_DOMAIN_SNAPSHOT", ErrorKindNotFound},
+	libvirt.ErrNoInterface:           {"VIR_ERR_NO_INTERFACE", ErrorKindNotFound},
+	libvirt.ErrNoNodeDevice:          {"VIR_ERR_NO_NODE_DEVICE", ErrorKindNotFound},
+	libvirt.ErrNoSecret:              {"VIR_ERR_NO_SECRET", ErrorKindNotFound},
+	libvirt.ErrNoNwfilter:            {"VIR_ERR_NO_NWFILTER", ErrorKindNotFound},
+	libvirt.ErrDeviceMissing:         {"VIR_ERR_DEVICE_MISSING", ErrorKindNotFound},
+	libvirt.ErrOperationInvalid:      {"VIR_ERR_OPERATION_INVALID", ErrorKindInvalidState},
+	libvirt.ErrResourceBusy:          {"VIR_ERR_RESOURCE_BUSY", ErrorKindInvalidState},
+	libvirt.ErrBlockCopyActive:       {"VIR_ERR_BLOCK_COPY_ACTIVE", ErrorKindInvalidState},
+	libvirt.ErrStoragePoolBuilt:      {"VIR_ERR_STORAGE_POOL_BUILT", ErrorKindInvalidState},
+	libvirt.ErrAgentUnsynced:         {"VIR_ERR_AGENT_UNSYNCED", ErrorKindInvalidState},
+	libvirt.ErrDomExist:              {"VIR_ERR_DOM_EXIST", ErrorKindExists},
+	libvirt.ErrNetworkExist:          {"VIR_ERR_NETWORK_EXIST", ErrorKindExists},
+	libvirt.ErrStorageVolExist:       {"VIR_ERR_STORAGE_VOL_EXIST", ErrorKindExists},
+	libvirt.ErrOperationDenied:       {"VIR_ERR_OPERATION_DENIED", ErrorKindDenied},
+	libvirt.ErrAccessDenied:          {"VIR_ERR_ACCESS_DENIED", ErrorKindDenied},
+	libvirt.ErrAuthFailed:            {"VIR_ERR_AUTH_FAILED", ErrorKindDenied},
+	libvirt.ErrAuthCancelled:         {"VIR_ERR_AUTH_CANCELLED", ErrorKindDenied},
+	libvirt.ErrInvalidArg:            {"VIR_ERR_INVALID_ARG", ErrorKindInvalid},
+	libvirt.ErrXMLError:              {"VIR_ERR_XML_ERROR", ErrorKindInvalid},
+	libvirt.ErrXMLDetail:             {"VIR_ERR_XML_DETAIL", ErrorKindInvalid},
+	libvirt.ErrXMLInvalidSchema:      {"VIR_ERR_XML_INVALID_SCHEMA", ErrorKindInvalid},
+	libvirt.ErrInvalidMac:            {"VIR_ERR_INVALID_MAC", ErrorKindInvalid},
+	libvirt.ErrCPUIncompatible:       {"VIR_ERR_CPU_INCOMPATIBLE", ErrorKindInvalid},
+	libvirt.ErrNoSupport:             {"VIR_ERR_NO_SUPPORT", ErrorKindUnsupported},
+	libvirt.ErrConfigUnsupported:     {"VIR_ERR_CONFIG_UNSUPPORTED", ErrorKindUnsupported},
+	libvirt.ErrArgumentUnsupported:   {"VIR_ERR_ARGUMENT_UNSUPPORTED", ErrorKindUnsupported},
+	libvirt.ErrOperationUnsupported:  {"VIR_ERR_OPERATION_UNSUPPORTED", ErrorKindUnsupported},
+	libvirt.ErrOperationTimeout:      {"VIR_ERR_OPERATION_TIMEOUT", ErrorKindTimeout},
+	libvirt.ErrAgentUnresponsive:     {"VIR_ERR_AGENT_UNRESPONSIVE", ErrorKindTimeout},
+	libvirt.ErrOperationFailed:       {"VIR_ERR_OPERATION_FAILED", ErrorKindFailed},
+	libvirt.ErrInternalError:         {"VIR_ERR_INTERNAL_ERROR", ErrorKindFailed},
+	libvirt.ErrSystemError:           {"VIR_ERR_SYSTEM_ERROR", ErrorKindFailed},
+	libvirt.ErrOperationAborted:      {"VIR_ERR_OPERATION_ABORTED", ErrorKindFailed},
+	libvirt.ErrMigratePersistFailed:  {"VIR_ERR_MIGRATE_PERSIST_FAILED", ErrorKindFailed},
+	libvirt.ErrHookScriptFailed:      {"VIR_ERR_HOOK_SCRIPT_FAILED", ErrorKindFailed},
+	libvirt.ErrInvalidDomainSnapshot: {"VIR_ERR_INVALID_DOMAIN_SNAPSHOT", ErrorKindInvalid},
+}
+
+// ErrorDetails returns the libvirt error wrapped in err, or nil if err did
+// not come from a libvirt daemon.
+func ErrorDetails(err error) *ErrorInfo {
+	var lvErr libvirt.Error
+	if !errors.As(err, &lvErr) {
+		return nil
+	}
+	info := &ErrorInfo{Code: int(lvErr.Code), Kind: ErrorKindFailed}
+	if known, ok := libvirtErrors[libvirt.ErrorNumber(lvErr.Code)]; ok {
+		info.Name, info.Kind = known.name, known.kind
+	}
+	return info
+}
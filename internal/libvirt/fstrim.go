@@ -0,0 +1,70 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// fstrimTimeout bounds a guest-fstrim call, in seconds. The first trim of a
+// large filesystem can take minutes.
+const fstrimTimeout = 600
+
+// TrimmedFilesystem is the outcome of trimming one filesystem of a guest.
+type TrimmedFilesystem struct {
+	Path         string `json:"path"`
+	TrimmedBytes uint64 `json:"trimmed_bytes"`
+	Error        string `json:"error,omitempty"`
+}
+
+// guestFstrimResponse is the reply of the guest agent's guest-fstrim.
+type guestFstrimResponse struct {
+	Return struct {
+		Paths []struct {
+			Path    string `json:"path"`
+			Trimmed uint64 `json:"trimmed"`
+			Error   string `json:"error"`
+		} `json:"paths"`
+	} `json:"return"`
+}
+
+// TrimGuestFilesystems asks the guest agent of a running VM to discard the
+// unused blocks of its mounted filesystems. Free ranges smaller than
+// minimumBytes are left alone. The blocks only reach the host's storage
+// when the VM's disks pass discards on. Older agents do not report the
+// filesystems they trimmed.
+func (c *Connector) TrimGuestFilesystems(hostID, vmName string, minimumBytes uint64) ([]TrimmedFilesystem, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	// The trim itself may take minutes; it does not hold an operation slot.
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	command, err := json.Marshal(map[string]interface{}{
+		"execute":   "guest-fstrim",
+		"arguments": map[string]uint64{"minimum": minimumBytes},
+	})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := l.QEMUDomainAgentCommand(domain, string(command), fstrimTimeout, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to trim the filesystems of %s: %w", vmName, err)
+	}
+	trimmed := []TrimmedFilesystem{}
+	if len(reply) == 0 {
+		return trimmed, nil
+	}
+	var resp guestFstrimResponse
+	if err := json.Unmarshal([]byte(reply[0]), &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse guest-fstrim reply of %s: %w", vmName, err)
+	}
+	for _, path := range resp.Return.Paths {
+		trimmed = append(trimmed, TrimmedFilesystem{Path: path.Path, TrimmedBytes: path.Trimmed, Error: path.Error})
+	}
+	return trimmed, nil
+}
@@ -0,0 +1,132 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrNoGraphics is returned when a VM has no VNC or SPICE display.
+var ErrNoGraphics = errors.New("VM has no VNC or SPICE display")
+
+// graphicsDeviceXML keeps a graphics element as it is, so it can be sent back
+// with only its password attributes changed.
+type graphicsDeviceXML struct {
+	XMLName xml.Name   `xml:"graphics"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (g *graphicsDeviceXML) attr(name string) string {
+	for _, a := range g.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (g *graphicsDeviceXML) setAttr(name, value string) {
+	for i := range g.Attrs {
+		if g.Attrs[i].Name.Local == name {
+			g.Attrs = append(g.Attrs[:i], g.Attrs[i+1:]...)
+			break
+		}
+	}
+	if value != "" {
+		g.Attrs = append(g.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+	}
+}
+
+// SetGraphicsPassword sets the password of every VNC and SPICE display of a
+// VM, on the running guest and in its persistent definition, so it applies at
+// once and after a restart. A non-zero validTo makes QEMU refuse the password
+// from then on. With disconnect, SPICE clients connected with the old
+// password are dropped; VNC ones always keep their session. It returns the
+// types of the displays changed.
+func (c *Connector) SetGraphicsPassword(hostID, vmName, password string, validTo time.Time, disconnect bool) ([]string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defer c.invalidateDomain(hostID, domain)
+	// A pending console ticket must not put the old password back later
+	c.tickets.take(domainKey{hostID: hostID, uuid: domain.UUID}, nil)
+
+	expiry := ""
+	if !validTo.IsZero() {
+		expiry = validTo.UTC().Format("2006-01-02T15:04:05")
+	}
+
+	var types []string
+	if active, err := l.DomainIsActive(domain); err == nil && active == 1 {
+		if types, err = updateGraphicsPasswords(l, domain, libvirt.DomainXMLSecure, libvirt.DomainDeviceModifyLive, password, expiry, disconnect); err != nil {
+			return nil, err
+		}
+	}
+	if persistent, err := l.DomainIsPersistent(domain); err == nil && persistent == 1 {
+		configTypes, err := updateGraphicsPasswords(l, domain, libvirt.DomainXMLSecure|libvirt.DomainXMLInactive, libvirt.DomainDeviceModifyConfig, password, expiry, disconnect)
+		if err != nil {
+			return nil, err
+		}
+		if types == nil {
+			types = configTypes
+		}
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoGraphics, vmName)
+	}
+	return types, nil
+}
+
+// updateGraphicsPasswords rewrites the password of each graphics device in
+// the live or persistent definition of a domain.
+func updateGraphicsPasswords(l *libvirt.Libvirt, domain libvirt.Domain, xmlFlags libvirt.DomainXMLFlags, modify libvirt.DomainDeviceModifyFlags, password, expiry string, disconnect bool) ([]string, error) {
+	xmlDesc, err := l.DomainGetXMLDesc(domain, xmlFlags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	var def struct {
+		Graphics []graphicsDeviceXML `xml:"devices>graphics"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	var types []string
+	for i := range def.Graphics {
+		g := &def.Graphics[i]
+		kind := strings.ToLower(g.attr("type"))
+		if kind != "vnc" && kind != "spice" {
+			continue
+		}
+		g.setAttr("passwd", password)
+		g.setAttr("passwdValidTo", expiry)
+		if kind == "spice" {
+			connected := "keep"
+			if disconnect {
+				connected = "disconnect"
+			}
+			g.setAttr("connected", connected)
+		}
+		deviceXML, err := xml.Marshal(g)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build graphics XML: %w", err)
+		}
+		if err := l.DomainUpdateDeviceFlags(domain, string(deviceXML), modify); err != nil {
+			return nil, fmt.Errorf("failed to set the %s password of %s: %w", kind, domain.Name, err)
+		}
+		types = append(types, kind)
+	}
+	return types, nil
+}
@@ -0,0 +1,106 @@
+package libvirt
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/digitalocean/go-libvirt"
+)
+
+// guestAgentFilesystems asks the guest agent of a running domain for the
+// usage of its mounted filesystems, sorted by mount point. It returns false
+// if the agent did not answer.
+func guestAgentFilesystems(l *libvirt.Libvirt, domain libvirt.Domain) ([]storage.GuestFilesystem, bool) {
+	params, err := l.DomainGetGuestInfo(domain, uint32(libvirt.DomainGuestInfoFilesystem), 0)
+	if err != nil {
+		log.Printf("Warning: could not get filesystems from guest agent of %s: %v", domain.Name, err)
+		return nil, false
+	}
+
+	// Fields come as fs.<n>.<name> and fs.<n>.disk.<m>.<name>.
+	byIndex := make(map[int]*storage.GuestFilesystem)
+	for _, p := range params {
+		rest, ok := strings.CutPrefix(p.Field, "fs.")
+		if !ok {
+			continue
+		}
+		index, field, ok := strings.Cut(rest, ".")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil {
+			continue
+		}
+		fs := byIndex[n]
+		if fs == nil {
+			fs = &storage.GuestFilesystem{Disks: []string{}}
+			byIndex[n] = fs
+		}
+		switch {
+		case field == "mountpoint":
+			fs.Mountpoint, _ = p.Value.I.(string)
+		case field == "name":
+			fs.Name, _ = p.Value.I.(string)
+		case field == "fstype":
+			fs.Type, _ = p.Value.I.(string)
+		case field == "total-bytes":
+			fs.TotalBytes, _ = p.Value.I.(uint64)
+		case field == "used-bytes":
+			fs.UsedBytes, _ = p.Value.I.(uint64)
+		case strings.HasPrefix(field, "disk.") && strings.HasSuffix(field, ".alias"):
+			if alias, _ := p.Value.I.(string); alias != "" {
+				fs.Disks = append(fs.Disks, alias)
+			}
+		}
+	}
+
+	filesystems := make([]storage.GuestFilesystem, 0, len(byIndex))
+	for _, fs := range byIndex {
+		if fs.Mountpoint == "" {
+			continue
+		}
+		if fs.TotalBytes > 0 {
+			fs.UsedPercent = float64(fs.UsedBytes) * 100 / float64(fs.TotalBytes)
+		}
+		filesystems = append(filesystems, *fs)
+	}
+	sort.Slice(filesystems, func(i, j int) bool { return filesystems[i].Mountpoint < filesystems[j].Mountpoint })
+	return filesystems, true
+}
+
+// GetGuestFilesystems reads the usage of the filesystems mounted in a
+// running VM from its guest agent. It returns nil without an error when the
+// VM is not running or its agent is not connected.
+func (c *Connector) GetGuestFilesystems(hostID, vmName string) ([]storage.GuestFilesystem, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainRunning {
+		return nil, nil
+	}
+	def, err := c.domainDefinition(hostID, domain)
+	if err != nil {
+		return nil, err
+	}
+	if !def.agentConnected {
+		return nil, nil
+	}
+	filesystems, _ := guestAgentFilesystems(l, domain)
+	return filesystems, nil
+}
@@ -0,0 +1,200 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrHostFileNotFound is returned when a file or directory does not exist
+// on a host.
+var ErrHostFileNotFound = errors.New("no such file or directory on the host")
+
+// ErrHostFileExists is returned when renaming onto a path that is taken.
+var ErrHostFileExists = errors.New("a file with that name already exists on the host")
+
+// Host file commands are plain coreutils and findutils calls; a listing is
+// capped so a directory with millions of entries cannot exhaust memory.
+const (
+	hostFileCommandTimeout = 60 * time.Second
+	maxHostFileListing     = 16 << 20
+	missingPathStatus      = 44 // Exit status the file commands use for a missing path
+	takenPathStatus        = 45 // And for a rename target that exists
+)
+
+// Types of a HostFile.
+const (
+	HostFileRegular   = "file"
+	HostFileDirectory = "directory"
+	HostFileSymlink   = "symlink"
+	HostFileOther     = "other"
+)
+
+// HostFile is a directory entry on a host. Symbolic links are reported as
+// such, never followed.
+type HostFile struct {
+	Name            string    `json:"name"`
+	Type            string    `json:"type"` // 'file', 'directory', 'symlink' or 'other'
+	SizeBytes       uint64    `json:"size_bytes"`
+	AllocationBytes uint64    `json:"allocation_bytes"` // Space taken on disk, less than the size for sparse images
+	Mode            string    `json:"mode"`             // Permission bits in octal, e.g. '644'
+	Owner           string    `json:"owner"`
+	Group           string    `json:"group"`
+	ModifiedAt      time.Time `json:"modified_at"`
+	LinkTarget      string    `json:"link_target,omitempty"`
+}
+
+// hostFileFormat is the find -printf format of a HostFile: type, size, 512
+// byte blocks, mtime, mode, owner, group, link target and name, each ended
+// by a NUL, the one byte no file name contains.
+const hostFileFormat = `%y\0%s\0%b\0%T@\0%m\0%u\0%g\0%l\0%f\0`
+
+const hostFileFields = 9
+
+func hostFileType(t string) string {
+	switch t {
+	case "f":
+		return HostFileRegular
+	case "d":
+		return HostFileDirectory
+	case "l":
+		return HostFileSymlink
+	}
+	return HostFileOther
+}
+
+func parseHostFiles(output string) ([]HostFile, error) {
+	fields := strings.Split(output, "\x00")
+	if n := len(fields) - 1; n%hostFileFields != 0 || fields[n] != "" {
+		return nil, fmt.Errorf("unexpected file listing: %d fields", n)
+	}
+	files := make([]HostFile, 0, len(fields)/hostFileFields)
+	for i := 0; i+hostFileFields <= len(fields); i += hostFileFields {
+		f := fields[i : i+hostFileFields]
+		size, err := strconv.ParseUint(f[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected size %q of %s", f[1], f[8])
+		}
+		blocks, err := strconv.ParseUint(f[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected block count %q of %s", f[2], f[8])
+		}
+		mtime, err := strconv.ParseFloat(f[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected modification time %q of %s", f[3], f[8])
+		}
+		seconds, fraction := math.Modf(mtime)
+		files = append(files, HostFile{
+			Name:            f[8],
+			Type:            hostFileType(f[0]),
+			SizeBytes:       size,
+			AllocationBytes: blocks * 512,
+			Mode:            f[4],
+			Owner:           f[5],
+			Group:           f[6],
+			ModifiedAt:      time.Unix(int64(seconds), int64(fraction*1e9)),
+			LinkTarget:      f[7],
+		})
+	}
+	return files, nil
+}
+
+// runFileCommand runs a file command on a host and returns its stdout.
+func (c *Connector) runFileCommand(hostID, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hostFileCommandTimeout)
+	defer cancel()
+	result, err := c.ExecHostCommand(ctx, hostID, command, maxHostFileListing)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case result.TimedOut:
+		return "", fmt.Errorf("file command on host '%s' did not finish within %s", hostID, hostFileCommandTimeout)
+	case result.ExitCode == missingPathStatus:
+		return "", ErrHostFileNotFound
+	case result.ExitCode == takenPathStatus:
+		return "", ErrHostFileExists
+	case result.ExitCode != 0:
+		return "", fmt.Errorf("file command failed on host '%s': %s", hostID, strings.TrimSpace(result.Stderr))
+	case result.Truncated:
+		return "", fmt.Errorf("file listing on host '%s' exceeds %d bytes", hostID, maxHostFileListing)
+	}
+	return result.Stdout, nil
+}
+
+// existsTest is a shell test that exits with missingPathStatus unless the
+// path exists, as a file or as a dangling symbolic link.
+func existsTest(p string) string {
+	return fmt.Sprintf("{ [ -e %[1]s ] || [ -L %[1]s ]; } || exit %d; ", ShellQuote(p), missingPathStatus)
+}
+
+// HostRealDirectories resolves directories on a host to their physical
+// paths, following symbolic links, in the order given.
+func (c *Connector) HostRealDirectories(hostID string, dirs ...string) ([]string, error) {
+	var command strings.Builder
+	for _, dir := range dirs {
+		quoted := ShellQuote(dir)
+		fmt.Fprintf(&command, "[ -d %[1]s ] || exit %[2]d; cd -P -- %[1]s || exit 1; pwd -P; ", quoted, missingPathStatus)
+	}
+	output, err := c.runFileCommand(hostID, command.String())
+	if err != nil {
+		return nil, err
+	}
+	resolved := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	if len(resolved) != len(dirs) {
+		return nil, fmt.Errorf("unexpected output resolving directories on host '%s'", hostID)
+	}
+	return resolved, nil
+}
+
+// ListHostDirectory lists the entries of a directory on a host, unordered.
+func (c *Connector) ListHostDirectory(hostID, dir string) ([]HostFile, error) {
+	output, err := c.runFileCommand(hostID, existsTest(dir)+
+		"find -P "+ShellQuote(dir)+" -mindepth 1 -maxdepth 1 -printf '"+hostFileFormat+"'")
+	if err != nil {
+		return nil, err
+	}
+	return parseHostFiles(output)
+}
+
+// StatHostFile describes a file on a host, without following it if it is a
+// symbolic link.
+func (c *Connector) StatHostFile(hostID, file string) (*HostFile, error) {
+	output, err := c.runFileCommand(hostID, existsTest(file)+
+		"find -P "+ShellQuote(file)+" -maxdepth 0 -printf '"+hostFileFormat+"'")
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseHostFiles(output)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 {
+		return nil, fmt.Errorf("unexpected output describing %s on host '%s'", file, hostID)
+	}
+	files[0].Name = path.Base(file)
+	return &files[0], nil
+}
+
+// RemoveHostFile deletes a regular file on a host. Anything else, such as
+// a directory or a symbolic link, is reported as ErrHostFileNotFound.
+func (c *Connector) RemoveHostFile(hostID, file string) error {
+	quoted := ShellQuote(file)
+	_, err := c.runFileCommand(hostID, fmt.Sprintf("{ [ -f %[1]s ] && [ ! -L %[1]s ]; } || exit %[2]d; rm -- %[1]s",
+		quoted, missingPathStatus))
+	return err
+}
+
+// RenameHostFile moves a regular file to a path that is not taken on the
+// same host. Like RemoveHostFile, it only touches regular files.
+func (c *Connector) RenameHostFile(hostID, from, to string) error {
+	_, err := c.runFileCommand(hostID, fmt.Sprintf(
+		"{ [ -f %[1]s ] && [ ! -L %[1]s ]; } || exit %[3]d; { [ -e %[2]s ] || [ -L %[2]s ]; } && exit %[4]d; mv -n -T -- %[1]s %[2]s",
+		ShellQuote(from), ShellQuote(to), missingPathStatus, takenPathStatus))
+	return err
+}
@@ -0,0 +1,79 @@
+package libvirt
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// NUMACell is one NUMA node of a host.
+type NUMACell struct {
+	ID         uint   `json:"id"`
+	Memory     uint64 `json:"memory"`      // Bytes
+	FreeMemory uint64 `json:"free_memory"` // Bytes
+	CPUs       []uint `json:"cpus"`
+}
+
+// readHostDetails fills in the CPU model, NUMA layout, free memory and
+// versions of a host. The kernel release is only read over SSH; failing to
+// get it is not an error.
+func (c *Connector) readHostDetails(hostID string, l *libvirt.Libvirt, info *HostInfo) error {
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		return fmt.Errorf("failed to get capabilities of host %s: %w", hostID, err)
+	}
+	info.CPUArch = caps.Host.CPU.Arch
+	info.CPUModel = caps.Host.CPU.Model
+	info.CPUVendor = caps.Host.CPU.Vendor
+
+	if info.FreeMemory, err = l.NodeGetFreeMemory(); err != nil {
+		return fmt.Errorf("failed to get free memory of host %s: %w", hostID, err)
+	}
+	info.NUMACells = []NUMACell{}
+	var cellsFree []uint64
+	if n := len(caps.Host.Cells); n > 0 {
+		if cellsFree, err = l.NodeGetCellsFreeMemory(0, int32(n)); err != nil {
+			log.Printf("Warning: could not get free memory per NUMA cell of host %s: %v", hostID, err)
+		}
+	}
+	for i, cell := range caps.Host.Cells {
+		numa := NUMACell{ID: cell.ID, Memory: cell.Memory.Value, CPUs: make([]uint, len(cell.CPUs))}
+		if unit := cell.Memory.Unit; unit == "" || unit == "KiB" {
+			numa.Memory *= 1024
+		}
+		if i < len(cellsFree) {
+			numa.FreeMemory = cellsFree[i]
+		}
+		for j, cpu := range cell.CPUs {
+			numa.CPUs[j] = cpu.ID
+		}
+		info.NUMACells = append(info.NUMACells, numa)
+	}
+
+	if info.Hypervisor, err = l.ConnectGetType(); err != nil {
+		return fmt.Errorf("failed to get hypervisor type of host %s: %w", hostID, err)
+	}
+	hvVersion, err := l.ConnectGetVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get hypervisor version of host %s: %w", hostID, err)
+	}
+	info.HypervisorVersion = formatLibvirtVersion(hvVersion)
+	libVersion, err := l.ConnectGetLibVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get libvirt version of host %s: %w", hostID, err)
+	}
+	info.LibvirtVersion = formatLibvirtVersion(libVersion)
+
+	if kernel, err := c.RunHostCommand(hostID, "uname -r"); err == nil {
+		info.Kernel = strings.TrimSpace(kernel)
+	}
+	return nil
+}
+
+// formatLibvirtVersion turns libvirt's major*1,000,000 + minor*1,000 +
+// release encoding into 'major.minor.release'.
+func formatLibvirtVersion(v uint64) string {
+	return fmt.Sprintf("%d.%d.%d", v/1000000, v/1000%1000, v%1000)
+}
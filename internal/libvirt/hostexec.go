@@ -0,0 +1,232 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoSSHChannel is returned when a host-side command is requested for a
+// host that is not connected over an SSH transport.
+var ErrNoSSHChannel = errors.New("host is not connected over SSH")
+
+// RunHostCommand executes a shell command on the hypervisor, reusing the SSH
+// client that tunnels the host's libvirt connection. It returns the combined
+// stdout and stderr of the command.
+func (c *Connector) RunHostCommand(hostID, command string) (string, error) {
+	c.mu.RLock()
+	client, ok := c.sshClients[hostID]
+	c.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("cannot run command on host '%s': %w", hostID, ErrNoSSHChannel)
+	}
+
+	output, err := runSSHCommand(client, command)
+	if err != nil {
+		return output, fmt.Errorf("command failed on host '%s': %w", hostID, err)
+	}
+	return output, nil
+}
+
+// StreamHostCommand runs a command on the hypervisor over its SSH channel,
+// copying stdout to the given writer. It is meant for binary output, so
+// stderr is kept separate and only reported in the returned error.
+func (c *Connector) StreamHostCommand(hostID, command string, stdout io.Writer) error {
+	c.mu.RLock()
+	client, ok := c.sshClients[hostID]
+	c.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("cannot run command on host '%s': %w", hostID, ErrNoSSHChannel)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = stdout
+	session.Stderr = &stderr
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("command failed on host '%s': %w: %s", hostID, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// FeedHostCommand runs a command on the hypervisor over its SSH channel with
+// the given reader as its stdin, e.g. to write a file streamed from another
+// host.
+func (c *Connector) FeedHostCommand(hostID, command string, stdin io.Reader) error {
+	c.mu.RLock()
+	client, ok := c.sshClients[hostID]
+	c.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("cannot run command on host '%s': %w", hostID, ErrNoSSHChannel)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdin = stdin
+	session.Stderr = &stderr
+	if err := session.Run(command); err != nil {
+		return fmt.Errorf("command failed on host '%s': %w: %s", hostID, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// HostCommandResult is the outcome of a command run with ExecHostCommand.
+type HostCommandResult struct {
+	ExitCode  int    // -1 if the command was stopped or did not report one
+	Stdout    string // Up to the output limit
+	Stderr    string // Up to the output limit
+	Truncated bool   // Output beyond the limit was dropped
+	TimedOut  bool   // The context ended before the command did
+}
+
+// limitedBuffer keeps the first limit bytes written to it and drops the
+// rest, so a chatty command cannot exhaust the server's memory.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		p = p[:max(room, 0)]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// ExecHostCommand runs a command on the hypervisor over its SSH channel,
+// capturing up to maxOutput bytes of stdout and of stderr. When the context
+// ends first the command is killed and TimedOut is set. A non-zero exit is
+// reported in the result, not as an error; errors are reserved for failing
+// to run the command at all.
+func (c *Connector) ExecHostCommand(ctx context.Context, hostID, command string, maxOutput int) (*HostCommandResult, error) {
+	c.mu.RLock()
+	client, ok := c.sshClients[hostID]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("cannot run command on host '%s': %w", hostID, ErrNoSSHChannel)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	stdout := &limitedBuffer{limit: maxOutput}
+	stderr := &limitedBuffer{limit: maxOutput}
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return nil, fmt.Errorf("failed to start command on host '%s': %w", hostID, err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	result := &HostCommandResult{ExitCode: -1}
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Not every SSH server delivers signals, so closing the session is
+		// what actually ends the wait.
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		result.TimedOut = true
+		err = nil
+	}
+
+	result.Stdout, result.Stderr = stdout.buf.String(), stderr.buf.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	var exitErr *ssh.ExitError
+	var exitMissing *ssh.ExitMissingError
+	switch {
+	case result.TimedOut:
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitStatus()
+	case errors.As(err, &exitMissing):
+	default:
+		return result, fmt.Errorf("command failed on host '%s': %w", hostID, err)
+	}
+	return result, nil
+}
+
+// HostShell is a standalone SSH command channel to a machine that is not
+// (yet) managed through libvirt, e.g. while it is being provisioned.
+type HostShell struct {
+	client *ssh.Client
+}
+
+// DialHostShell opens an SSH session to the machine named in an SSH
+// transport URI such as qemu+ssh://root@host/system, optionally through
+// jump hosts.
+func DialHostShell(uri, proxyJump string) (*HostShell, error) {
+	hostURI, err := ParseHostURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if hostURI.Transport != TransportSSH {
+		return nil, fmt.Errorf("an SSH transport URI is required for shell access, got %q", hostURI.URL.Scheme)
+	}
+
+	client, err := dialSSH(hostURI.URL, proxyJump)
+	if err != nil {
+		return nil, err
+	}
+	return &HostShell{client: client}, nil
+}
+
+// Run executes a command and returns its combined output.
+func (h *HostShell) Run(command string) (string, error) {
+	return runSSHCommand(h.client, command)
+}
+
+// Close terminates the underlying SSH connection.
+func (h *HostShell) Close() error {
+	return h.client.Close()
+}
+
+func runSSHCommand(client *ssh.Client, command string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	defer session.Close()
+
+	output, err := session.CombinedOutput(command)
+	if err != nil {
+		var exitMissing *ssh.ExitMissingError
+		if errors.As(err, &exitMissing) {
+			// The remote end went away without reporting a status, which is
+			// expected for commands such as a host reboot.
+			return string(output), nil
+		}
+		return string(output), err
+	}
+	return string(output), nil
+}
+
+// ShellQuote quotes a value for safe interpolation into a POSIX shell command.
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
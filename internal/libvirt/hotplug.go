@@ -0,0 +1,284 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrHotplugUnsupported is returned when a device cannot be added to a
+// running domain. The message says what to change, usually while the VM is
+// shut off.
+var ErrHotplugUnsupported = errors.New("hotplug is not possible")
+
+// hotplugDiskBuses are the disk buses whose hotplug support is reported.
+var hotplugDiskBuses = []string{"virtio", "scsi", "sata", "ide", "usb"}
+
+// HotplugSupport says whether a kind of device can be added to the running
+// domain, and if not, why.
+type HotplugSupport struct {
+	Supported bool   `json:"supported"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// HotplugCapabilities describes what can be changed on a domain while it
+// runs. It is worked out from the current definition, so it can be shown
+// ahead of a start; it only restricts changes while the domain runs.
+type HotplugCapabilities struct {
+	Running          bool                      `json:"running"`
+	MachineType      string                    `json:"machine_type"`
+	DiskBuses        map[string]HotplugSupport `json:"disk_buses"`
+	NIC              HotplugSupport            `json:"nic"`
+	VCPU             HotplugSupport            `json:"vcpu"`
+	Memory           HotplugSupport            `json:"memory"`
+	CurrentVCPUs     uint                      `json:"current_vcpus"`
+	MaxVCPUs         uint                      `json:"max_vcpus"`
+	MemorySlots      uint                      `json:"memory_slots"`
+	MaxMemoryBytes   uint64                    `json:"max_memory_bytes"`
+	FreeHotplugPorts *int                      `json:"free_hotplug_ports,omitempty"` // q35 only: PCIe root ports without a device
+}
+
+// hotplugDomainXML is the part of a domain definition hotplug depends on.
+type hotplugDomainXML struct {
+	Type string `xml:"type,attr"`
+	VCPU struct {
+		Current uint `xml:"current,attr"`
+		Max     uint `xml:",chardata"`
+	} `xml:"vcpu"`
+	MaxMemory *struct {
+		Slots uint   `xml:"slots,attr"`
+		Unit  string `xml:"unit,attr"`
+		Value uint64 `xml:",chardata"`
+	} `xml:"maxMemory"`
+	OS struct {
+		Type struct {
+			Arch    string `xml:"arch,attr"`
+			Machine string `xml:"machine,attr"`
+		} `xml:"type"`
+	} `xml:"os"`
+	NUMACells []struct {
+		ID uint `xml:"id,attr"`
+	} `xml:"cpu>numa>cell"`
+	Devices struct {
+		Emulator string             `xml:"emulator"`
+		Devices  []hotplugDeviceXML `xml:",any"`
+	} `xml:"devices"`
+}
+
+type hotplugDeviceXML struct {
+	XMLName xml.Name
+	Type    string `xml:"type,attr"`
+	Model   string `xml:"model,attr"`
+	Index   string `xml:"index,attr"`
+	Address *struct {
+		Type string `xml:"type,attr"`
+		Bus  string `xml:"bus,attr"`
+	} `xml:"address"`
+}
+
+// domainDeviceCapsXML is the part of the domain capabilities listing what
+// the emulator offers for a machine type.
+type domainDeviceCapsXML struct {
+	VCPU struct {
+		Max uint `xml:"max,attr"`
+	} `xml:"vcpu"`
+	Devices struct {
+		Disk struct {
+			Supported string `xml:"supported,attr"`
+			Enums     []struct {
+				Name   string   `xml:"name,attr"`
+				Values []string `xml:"value"`
+			} `xml:"enum"`
+		} `xml:"disk"`
+	} `xml:"devices"`
+}
+
+// diskBuses returns the disk buses the emulator offers.
+func (caps *domainDeviceCapsXML) diskBuses() map[string]bool {
+	buses := make(map[string]bool)
+	for _, enum := range caps.Devices.Disk.Enums {
+		if enum.Name != "bus" {
+			continue
+		}
+		for _, bus := range enum.Values {
+			buses[bus] = true
+		}
+	}
+	return buses
+}
+
+// scaleToBytes converts a libvirt size with its unit to bytes.
+func scaleToBytes(value uint64, unit string) uint64 {
+	switch strings.ToLower(unit) {
+	case "b", "bytes":
+		return value
+	case "mib", "m":
+		return value << 20
+	case "gib", "g":
+		return value << 30
+	case "tib", "t":
+		return value << 40
+	default: // KiB, libvirt's default unit
+		return value << 10
+	}
+}
+
+// hotplugCapabilities works out what can be added to a domain while it
+// runs, from its current definition and what the emulator offers for its
+// machine type.
+func hotplugCapabilities(l *libvirt.Libvirt, domain libvirt.Domain) (*HotplugCapabilities, error) {
+	active, err := l.DomainIsActive(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get state of %s: %w", domain.Name, err)
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	var def hotplugDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	machine := def.OS.Type.Machine
+	capsXML, err := l.ConnectGetDomainCapabilities(optString(def.Devices.Emulator), optString(def.OS.Type.Arch),
+		optString(machine), optString(def.Type), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain capabilities for %s: %w", machine, err)
+	}
+	var caps domainDeviceCapsXML
+	if err := xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse domain capabilities: %w", err)
+	}
+
+	hc := &HotplugCapabilities{
+		Running:      active == 1,
+		MachineType:  machine,
+		DiskBuses:    make(map[string]HotplugSupport),
+		CurrentVCPUs: def.VCPU.Max,
+		MaxVCPUs:     def.VCPU.Max,
+	}
+	if def.VCPU.Current != 0 {
+		hc.CurrentVCPUs = def.VCPU.Current
+	}
+	if def.MaxMemory != nil {
+		hc.MemorySlots = def.MaxMemory.Slots
+		hc.MaxMemoryBytes = scaleToBytes(def.MaxMemory.Value, def.MaxMemory.Unit)
+	}
+
+	// PCI devices: q35 only hot-plugs into PCIe root ports that are still
+	// empty, while the i440fx root bus takes new devices directly.
+	pci := HotplugSupport{Supported: true}
+	if strings.Contains(machine, "q35") {
+		ports := make(map[uint64]bool)
+		used := make(map[uint64]bool)
+		for _, dev := range def.Devices.Devices {
+			if dev.XMLName.Local == "controller" && dev.Type == "pci" && dev.Model == "pcie-root-port" {
+				if index, err := strconv.ParseUint(dev.Index, 10, 32); err == nil {
+					ports[index] = true
+				}
+			}
+			if dev.Address != nil && dev.Address.Type == "pci" {
+				if bus, err := strconv.ParseUint(dev.Address.Bus, 0, 32); err == nil {
+					used[bus] = true
+				}
+			}
+		}
+		free := 0
+		for index := range ports {
+			if !used[index] {
+				free++
+			}
+		}
+		hc.FreeHotplugPorts = &free
+		if free == 0 {
+			pci = HotplugSupport{Reason: fmt.Sprintf("no free PCIe root port: %s only hot-plugs PCI devices into empty pcie-root-port controllers; add some while the VM is shut off", machine)}
+		}
+	}
+	hc.NIC = pci
+
+	hasController := func(kind string) bool {
+		for _, dev := range def.Devices.Devices {
+			if dev.XMLName.Local == "controller" && dev.Type == kind && dev.Model != "none" {
+				return true
+			}
+		}
+		return false
+	}
+	offered := caps.diskBuses()
+	for _, bus := range hotplugDiskBuses {
+		var support HotplugSupport
+		switch {
+		case caps.Devices.Disk.Supported == "yes" && !offered[bus]:
+			support.Reason = fmt.Sprintf("the %s bus is not available on machine type %s", bus, machine)
+		case bus == "virtio":
+			support = pci
+		case bus == "scsi" && !hasController("scsi"):
+			support.Reason = "scsi disks need a SCSI controller to hot-plug into; add one while the VM is shut off"
+		case bus == "usb" && !hasController("usb"):
+			support.Reason = "usb disks need a USB controller to hot-plug into; add one while the VM is shut off"
+		case bus == "scsi", bus == "usb":
+			support.Supported = true
+		default:
+			support.Reason = fmt.Sprintf("disks on the %s bus cannot be hot-plugged; use virtio or scsi, or attach it while the VM is shut off", bus)
+		}
+		hc.DiskBuses[bus] = support
+	}
+
+	switch {
+	case hc.CurrentVCPUs >= hc.MaxVCPUs:
+		hc.VCPU.Reason = fmt.Sprintf("vCPU hotplug requires a maximum above the %d vCPUs in use; raise the maximum while the VM is shut off", hc.CurrentVCPUs)
+	case caps.VCPU.Max != 0 && hc.MaxVCPUs > caps.VCPU.Max:
+		hc.VCPU.Reason = fmt.Sprintf("the maximum of %d vCPUs is above the %d that machine type %s allows", hc.MaxVCPUs, caps.VCPU.Max, machine)
+	default:
+		hc.VCPU.Supported = true
+	}
+
+	switch {
+	case hc.MemorySlots == 0:
+		hc.Memory.Reason = "memory hotplug requires maxMemory slots configured; set them while the VM is shut off"
+	case len(def.NUMACells) == 0:
+		hc.Memory.Reason = "memory hotplug requires a guest NUMA topology with at least one cell"
+	default:
+		hc.Memory.Supported = true
+	}
+	return hc, nil
+}
+
+// GetHotplugCapabilities reports which devices can be added to a VM while
+// it runs, and why not for the others.
+func (c *Connector) GetHotplugCapabilities(hostID, vmName string) (*HotplugCapabilities, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return hotplugCapabilities(l, domain)
+}
+
+// requireHotplug checks, for a running domain, that a device can be
+// hot-plugged, so the caller gets an actionable error instead of the
+// emulator's. It returns whether the domain runs.
+func requireHotplug(l *libvirt.Libvirt, domain libvirt.Domain, support func(*HotplugCapabilities) HotplugSupport) (bool, error) {
+	active, err := l.DomainIsActive(domain)
+	if err != nil || active != 1 {
+		return false, nil
+	}
+	hc, err := hotplugCapabilities(l, domain)
+	if err != nil {
+		// Leave the verdict to libvirt.
+		return true, nil
+	}
+	if s := support(hc); !s.Supported {
+		return true, fmt.Errorf("%w on %s: %s", ErrHotplugUnsupported, domain.Name, s.Reason)
+	}
+	return true, nil
+}
@@ -0,0 +1,170 @@
+package libvirt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ksmRunPath is the sysfs switch of kernel same-page merging. libvirt exposes
+// KSM's counters and tuning, but not this switch.
+const ksmRunPath = "/sys/kernel/mm/ksm/run"
+
+// KSMStats is the state of kernel same-page merging on a host, as reported
+// by libvirt's node memory parameters.
+type KSMStats struct {
+	PagesShared    uint64 `json:"pages_shared"`    // Distinct pages kept after merging
+	PagesSharing   uint64 `json:"pages_sharing"`   // Further pages pointing at them
+	PagesUnshared  uint64 `json:"pages_unshared"`  // Pages scanned but unique
+	PagesVolatile  uint64 `json:"pages_volatile"`  // Pages changing too fast to merge
+	FullScans      uint64 `json:"full_scans"`      // Completed scans of all mergeable memory
+	PagesToScan    uint64 `json:"pages_to_scan"`   // Pages scanned per wake-up
+	SleepMillisecs uint64 `json:"sleep_millisecs"` // Pause between wake-ups
+	// Whether pages of different NUMA nodes are merged; nil when the
+	// kernel does not report it.
+	MergeAcrossNodes *bool  `json:"merge_across_nodes"`
+	PageSize         uint64 `json:"page_size"`   // Bytes
+	SavedBytes       uint64 `json:"saved_bytes"` // Memory freed by merging: pages_sharing pages
+}
+
+// KSMTuning changes the fields of KSM's scanner that are set.
+type KSMTuning struct {
+	PagesToScan    *uint
+	SleepMillisecs *uint
+}
+
+// GetKSMStats reads the KSM counters of a host.
+func (c *Connector) GetKSMStats(hostID string) (*KSMStats, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	_, count, err := l.NodeGetMemoryParameters(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory parameters of host %s: %w", hostID, err)
+	}
+	params, _, err := l.NodeGetMemoryParameters(count, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory parameters of host %s: %w", hostID, err)
+	}
+	values := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		values[p.Field] = p.Value.I
+	}
+	if _, ok := values["shm_pages_shared"]; !ok {
+		return nil, fmt.Errorf("host %s does not report KSM statistics", hostID)
+	}
+
+	pageSize, err := c.pageSize(hostID, l)
+	if err != nil {
+		return nil, err
+	}
+	stats := &KSMStats{
+		PagesShared:    paramUint(values, "shm_pages_shared"),
+		PagesSharing:   paramUint(values, "shm_pages_sharing"),
+		PagesUnshared:  paramUint(values, "shm_pages_unshared"),
+		PagesVolatile:  paramUint(values, "shm_pages_volatile"),
+		FullScans:      paramUint(values, "shm_full_scans"),
+		PagesToScan:    paramUint(values, "shm_pages_to_scan"),
+		SleepMillisecs: paramUint(values, "shm_sleep_millisecs"),
+		PageSize:       pageSize,
+	}
+	if _, ok := values["shm_merge_across_nodes"]; ok {
+		merge := paramUint(values, "shm_merge_across_nodes") == 1
+		stats.MergeAcrossNodes = &merge
+	}
+	stats.SavedBytes = stats.PagesSharing * pageSize
+	return stats, nil
+}
+
+// SetKSMTuning changes how fast KSM scans memory.
+func (c *Connector) SetKSMTuning(hostID string, tuning KSMTuning) error {
+	var params []libvirt.TypedParam
+	if tuning.PagesToScan != nil {
+		params = append(params, libvirt.TypedParam{Field: "shm_pages_to_scan", Value: *libvirt.NewTypedParamValueUint(uint32(*tuning.PagesToScan))})
+	}
+	if tuning.SleepMillisecs != nil {
+		params = append(params, libvirt.TypedParam{Field: "shm_sleep_millisecs", Value: *libvirt.NewTypedParamValueUint(uint32(*tuning.SleepMillisecs))})
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+	if err := l.NodeSetMemoryParameters(params, 0); err != nil {
+		return fmt.Errorf("failed to set KSM parameters of host %s: %w", hostID, err)
+	}
+	return nil
+}
+
+// GetKSMRun reads KSM's run mode over the host's SSH channel: 0 stopped,
+// 1 merging, 2 stopped and unmerging all pages.
+func (c *Connector) GetKSMRun(hostID string) (uint, error) {
+	output, err := c.RunHostCommand(hostID, "cat "+ksmRunPath)
+	if err != nil {
+		return 0, err
+	}
+	run, err := strconv.ParseUint(strings.TrimSpace(output), 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected KSM run mode '%s' on host %s", strings.TrimSpace(output), hostID)
+	}
+	return uint(run), nil
+}
+
+// SetKSMRun sets KSM's run mode over the host's SSH channel, through sudo
+// when not logged in as root.
+func (c *Connector) SetKSMRun(hostID string, run uint) error {
+	cmd := fmt.Sprintf(`if [ "$(id -u)" = 0 ]; then echo %d > %s; else echo %d | sudo -n tee %s >/dev/null; fi`,
+		run, ksmRunPath, run, ksmRunPath)
+	if output, err := c.RunHostCommand(hostID, cmd); err != nil {
+		return fmt.Errorf("failed to set KSM run mode on host %s: %w: %s", hostID, err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// pageSize returns the base memory page size of a host, which is the unit
+// of KSM's counters. It is read from the capabilities once per host.
+func (c *Connector) pageSize(hostID string, l *libvirt.Libvirt) (uint64, error) {
+	c.mu.RLock()
+	size, ok := c.pageSizes[hostID]
+	c.mu.RUnlock()
+	if ok {
+		return size, nil
+	}
+
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		return 0, err
+	}
+	// The smallest page size listed is the base one; the others are huge
+	// pages, which KSM does not merge.
+	for _, pages := range caps.Host.CPU.Pages {
+		if bytes := pages.Size * 1024; bytes > 0 && (size == 0 || bytes < size) {
+			size = bytes
+		}
+	}
+	if size == 0 {
+		size = 4096
+	}
+	c.mu.Lock()
+	c.pageSizes[hostID] = size
+	c.mu.Unlock()
+	return size, nil
+}
@@ -0,0 +1,272 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrNoMigrationRunning is returned when a running migration is adjusted
+// but the domain has none.
+var ErrNoMigrationRunning = errors.New("no migration is running")
+
+// MigrationCompressionMethods are the compression methods QEMU offers for
+// migration streams.
+var MigrationCompressionMethods = map[string]bool{"xbzrle": true, "mt": true, "zlib": true, "zstd": true}
+
+// LiveMigrationOptions tunes a live migration. Zero values leave the
+// hypervisor's defaults.
+type LiveMigrationOptions struct {
+	MaxBandwidthMiB uint64   // MiB/s
+	MaxDowntimeMs   uint64   // Pause allowed for the final switch-over
+	AutoConverge    bool     // Throttle the guest's vCPUs while it dirties memory faster than it is copied
+	Compression     []string // Methods from MigrationCompressionMethods
+	PostCopy        bool     // Allow switching to post-copy with StartPostCopy
+}
+
+// LiveMigrationProgress is the state of a domain's outgoing migration, from
+// its job statistics. Sizes are in bytes, rates in bytes per second.
+type LiveMigrationProgress struct {
+	Active               bool   `json:"active"`
+	ElapsedMs            uint64 `json:"elapsed_ms"`
+	DataTotal            uint64 `json:"data_total"`
+	DataProcessed        uint64 `json:"data_processed"`
+	DataRemaining        uint64 `json:"data_remaining"`
+	MemoryDirtyRate      uint64 `json:"memory_dirty_rate"`
+	MemoryIteration      uint64 `json:"memory_iteration"` // Passes over guest memory so far
+	Bandwidth            uint64 `json:"bandwidth"`
+	ExpectedDowntimeMs   uint64 `json:"expected_downtime_ms"`
+	AutoConvergeThrottle uint64 `json:"auto_converge_throttle"` // Percent of vCPU time taken away
+}
+
+// liveMigrationParams builds the typed parameters shared by all phases of
+// a migration.
+func liveMigrationParams(vmName string, opts LiveMigrationOptions) []libvirt.TypedParam {
+	params := []libvirt.TypedParam{
+		{Field: libvirt.MigrateParamDestName, Value: *libvirt.NewTypedParamValueString(vmName)},
+	}
+	if opts.MaxBandwidthMiB > 0 {
+		params = append(params, libvirt.TypedParam{Field: libvirt.MigrateParamBandwidth, Value: *libvirt.NewTypedParamValueUllong(opts.MaxBandwidthMiB)})
+	}
+	for _, method := range opts.Compression {
+		params = append(params, libvirt.TypedParam{Field: libvirt.MigrateParamCompression, Value: *libvirt.NewTypedParamValueString(method)})
+	}
+	return params
+}
+
+// LiveMigrate moves a running domain to another host while it keeps
+// running, and makes it persistent there in place of the source. Both
+// hosts are driven from here, so they need no credentials for each other;
+// the target's hypervisor only has to be reachable from the source for the
+// memory stream. It returns once the migration has finished or failed.
+func (c *Connector) LiveMigrate(hostID, vmName, targetHostID string, opts LiveMigrationOptions) error {
+	flags := libvirt.MigrateLive | libvirt.MigratePersistDest | libvirt.MigrateUndefineSource
+	if opts.AutoConverge {
+		flags |= libvirt.MigrateAutoConverge
+	}
+	if len(opts.Compression) > 0 {
+		flags |= libvirt.MigrateCompressed
+	}
+	if opts.PostCopy {
+		flags |= libvirt.MigratePostcopy
+	}
+	params := liveMigrationParams(vmName, opts)
+
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	src, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		release()
+		return err
+	}
+	if opts.MaxDowntimeMs > 0 {
+		if err := src.DomainMigrateSetMaxDowntime(domain, opts.MaxDowntimeMs, 0); c.reportRPC(hostID, err) != nil {
+			release()
+			return fmt.Errorf("failed to set maximum downtime of %s: %w", vmName, err)
+		}
+	}
+	cookie, domainXML, err := src.DomainMigrateBegin3Params(domain, params, uint32(flags))
+	release()
+	if c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to begin migration of %s: %w", vmName, err)
+	}
+	defer c.invalidateDomain(hostID, domain)
+
+	release, err = c.acquireRPC(targetHostID)
+	if err != nil {
+		return err
+	}
+	dst, err := c.GetConnection(targetHostID)
+	if err != nil {
+		release()
+		return err
+	}
+	prepareParams := append(append([]libvirt.TypedParam{}, params...),
+		libvirt.TypedParam{Field: libvirt.MigrateParamDestXML, Value: *libvirt.NewTypedParamValueString(domainXML)})
+	cookie, uri, err := dst.DomainMigratePrepare3Params(prepareParams, cookie, uint32(flags))
+	release()
+	if c.reportRPC(targetHostID, err) != nil {
+		return fmt.Errorf("target host %s could not prepare for %s: %w", targetHostID, vmName, err)
+	}
+
+	performParams := params
+	if len(uri) > 0 && uri[0] != "" {
+		performParams = append(append([]libvirt.TypedParam{}, params...),
+			libvirt.TypedParam{Field: libvirt.MigrateParamURI, Value: *libvirt.NewTypedParamValueString(uri[0])})
+	}
+	// The source holds an operation slot for as long as the memory is copied.
+	// Without a free one the migration is cancelled rather than performed.
+	var performErr error
+	release, err = c.acquireRPC(hostID)
+	if err != nil {
+		performErr = err
+	} else {
+		cookie, performErr = src.DomainMigratePerform3Params(domain, nil, performParams, cookie, flags)
+		release()
+		c.reportRPC(hostID, performErr)
+	}
+
+	// Finish and Confirm always run once the target has prepared, or the
+	// target keeps a paused domain and the source its migration job. A host
+	// without a free slot is called anyway.
+	var cancelled int32
+	if performErr != nil {
+		cancelled = 1
+	}
+	release, finishSlotErr := c.acquireRPC(targetHostID)
+	_, cookie, finishErr := dst.DomainMigrateFinish3Params(params, cookie, uint32(flags), cancelled)
+	c.reportRPC(targetHostID, finishErr)
+	if finishSlotErr == nil {
+		release()
+	}
+	if finishErr != nil {
+		cancelled = 1
+	}
+
+	release, confirmSlotErr := c.acquireRPC(hostID)
+	confirmErr := c.reportRPC(hostID, src.DomainMigrateConfirm3Params(domain, params, cookie, uint32(flags), cancelled))
+	if confirmSlotErr == nil {
+		release()
+	}
+
+	var failure error
+	switch {
+	case performErr != nil:
+		failure = fmt.Errorf("migration of %s to %s failed: %w", vmName, targetHostID, performErr)
+	case finishErr != nil:
+		failure = fmt.Errorf("target host %s could not finish the migration of %s: %w", targetHostID, vmName, finishErr)
+	case confirmErr != nil:
+		failure = fmt.Errorf("source host %s could not confirm the migration of %s: %w", hostID, vmName, confirmErr)
+	}
+	if failure != nil {
+		return errors.Join(failure, finishSlotErr, confirmSlotErr)
+	}
+	return nil
+}
+
+// GetMigrationProgress reads the job statistics of a migrating domain.
+func (c *Connector) GetMigrationProgress(hostID, vmName string) (*LiveMigrationProgress, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	jobType, params, err := l.DomainGetJobStats(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job stats of %s: %w", vmName, err)
+	}
+	values := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		values[p.Field] = p.Value.I
+	}
+	pageSize := paramUint(values, "memory_page_size")
+	if pageSize == 0 {
+		pageSize = 4096
+	}
+	return &LiveMigrationProgress{
+		Active:               libvirt.DomainJobType(jobType) == libvirt.DomainJobUnbounded,
+		ElapsedMs:            paramUint(values, "time_elapsed"),
+		DataTotal:            paramUint(values, "data_total"),
+		DataProcessed:        paramUint(values, "data_processed"),
+		DataRemaining:        paramUint(values, "data_remaining"),
+		MemoryDirtyRate:      paramUint(values, "memory_dirty_rate") * pageSize,
+		MemoryIteration:      paramUint(values, "memory_iteration"),
+		Bandwidth:            paramUint(values, "memory_bps"),
+		ExpectedDowntimeMs:   paramUint(values, "downtime"),
+		AutoConvergeThrottle: paramUint(values, "auto_converge_throttle"),
+	}, nil
+}
+
+// SetMigrationLimits changes the bandwidth and maximum downtime of a
+// running migration. Nil values are left alone.
+func (c *Connector) SetMigrationLimits(hostID, vmName string, bandwidthMiB, downtimeMs *uint64) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if bandwidthMiB != nil {
+		if err := l.DomainMigrateSetMaxSpeed(domain, *bandwidthMiB, 0); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to set migration bandwidth of %s: %w", vmName, err)
+		}
+	}
+	if downtimeMs != nil {
+		if err := l.DomainMigrateSetMaxDowntime(domain, *downtimeMs, 0); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to set maximum downtime of %s: %w", vmName, err)
+		}
+	}
+	return nil
+}
+
+// StartPostCopy switches a running migration that allows it to post-copy:
+// the domain runs on the target at once and fetches the memory it still
+// lacks from the source on demand. The migration then always finishes, but
+// the domain is lost if either host fails before it does.
+func (c *Connector) StartPostCopy(hostID, vmName string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainMigrateStartPostCopy(domain, 0); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to switch the migration of %s to post-copy: %w", vmName, err)
+	}
+	return nil
+}
+
+// AbortMigration cancels the running migration of a domain, which keeps
+// running on the source.
+func (c *Connector) AbortMigration(hostID, vmName string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainAbortJob(domain); err != nil {
+		return fmt.Errorf("failed to abort the migration of %s: %w", vmName, err)
+	}
+	return nil
+}
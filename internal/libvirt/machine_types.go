@@ -0,0 +1,383 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+var (
+	// ErrUnknownMachineType is returned for a machine type the host's
+	// emulator does not offer.
+	ErrUnknownMachineType = errors.New("unknown machine type")
+	// ErrMachineTypeUpgradeBlocked is returned when a machine type change
+	// has blockers.
+	ErrMachineTypeUpgradeBlocked = errors.New("machine type change is blocked")
+)
+
+// MachineType is a QEMU machine type a host can run.
+type MachineType struct {
+	Name       string `json:"name"`
+	Alias      string `json:"alias,omitempty"` // e.g. 'pc' for the newest pc-i440fx version
+	Family     string `json:"family"`          // Name without its version, e.g. 'pc-q35'
+	Version    string `json:"version,omitempty"`
+	MaxCPUs    uint   `json:"max_cpus"`
+	Deprecated bool   `json:"deprecated"`
+}
+
+// MachineTypeUpgradePlan describes how a VM's definition changes when it
+// moves to another machine type. Blockers prevent the change.
+type MachineTypeUpgradePlan struct {
+	Current    string   `json:"current"`
+	Target     string   `json:"target"`
+	Deprecated bool     `json:"deprecated"` // The current machine type is deprecated
+	Changes    []string `json:"changes"`
+	Blockers   []string `json:"blockers"`
+}
+
+// machineVersion splits a versioned machine type such as 'pc-q35-8.2' or
+// 'pc-q35-rhel9.4.0' into its family and version.
+var machineVersion = regexp.MustCompile(`^(.+?)-((?:rhel)?\d+(?:\.\d+)*)$`)
+
+// Patterns of the definition parts that tie a domain to the i440fx chipset.
+var (
+	pciAddressElement    = regexp.MustCompile(`\s*<address type='pci'[^>]*/>`)
+	driveAddressElement  = regexp.MustCompile(`\s*<address type='drive'[^>]*/>`)
+	pciControllerElement = regexp.MustCompile(`(?s)\s*<controller type='(?:pci|ide)'[^>]*?(?:/>|>.*?</controller>)`)
+	diskElement          = regexp.MustCompile(`(?s)<disk\b.*?</disk>`)
+	diskTargetElement    = regexp.MustCompile(`<target dev='([^']*)' bus='([^']*)'`)
+)
+
+type machineDomainXML struct {
+	Type string `xml:"type,attr"`
+	VCPU uint   `xml:"vcpu"`
+	OS   struct {
+		Type struct {
+			Arch    string `xml:"arch,attr"`
+			Machine string `xml:"machine,attr"`
+		} `xml:"type"`
+	} `xml:"os"`
+}
+
+// splitMachineType returns the family and version of a machine type. Types
+// without a version are their own family.
+func splitMachineType(name string) (family, version string) {
+	if m := machineVersion.FindStringSubmatch(name); m != nil {
+		return m[1], m[2]
+	}
+	return name, ""
+}
+
+// compareMachineVersions orders versions such as '8.2' and 'rhel9.4.0'
+// numerically.
+func compareMachineVersions(a, b string) int {
+	pa := strings.Split(strings.TrimPrefix(a, "rhel"), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "rhel"), ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// ListMachineTypes returns the machine types the host's emulator offers for
+// its own architecture, newest first within each family.
+func (c *Connector) ListMachineTypes(hostID string) ([]MachineType, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		return nil, err
+	}
+	return machineTypes(caps, caps.Host.CPU.Arch, "kvm"), nil
+}
+
+// machineTypes collects the machine types offered for an architecture and
+// domain type, with aliases folded into the types they stand for.
+func machineTypes(caps *capabilitiesXML, arch, domainType string) []MachineType {
+	byName := make(map[string]*MachineType)
+	aliases := make(map[string]string)
+	var names []string
+	add := func(m capsMachineXML) {
+		if m.Canonical != "" {
+			aliases[m.Canonical] = m.Name
+			return
+		}
+		if _, ok := byName[m.Name]; ok {
+			return
+		}
+		family, version := splitMachineType(m.Name)
+		byName[m.Name] = &MachineType{
+			Name:       m.Name,
+			Family:     family,
+			Version:    version,
+			MaxCPUs:    m.MaxCPUs,
+			Deprecated: m.Deprecated == "yes",
+		}
+		names = append(names, m.Name)
+	}
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != arch {
+			continue
+		}
+		for _, m := range guest.Arch.Machines {
+			add(m)
+		}
+		for _, d := range guest.Arch.Domains {
+			if d.Type == domainType {
+				for _, m := range d.Machines {
+					add(m)
+				}
+			}
+		}
+	}
+
+	types := make([]MachineType, 0, len(names))
+	for _, name := range names {
+		mt := byName[name]
+		mt.Alias = aliases[name]
+		types = append(types, *mt)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Family != types[j].Family {
+			return types[i].Family < types[j].Family
+		}
+		return compareMachineVersions(types[i].Version, types[j].Version) > 0
+	})
+	return types
+}
+
+// PlanMachineTypeUpgrade describes the change of a VM to another machine
+// type without making it. An empty target picks the newest non-deprecated
+// version of the VM's current family.
+func (c *Connector) PlanMachineTypeUpgrade(hostID, vmName, target string) (*MachineTypeUpgradePlan, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	plan, _, err := planMachineType(l, xmlDesc, target)
+	return plan, err
+}
+
+// UpgradeMachineType moves a shut-off VM to another machine type, adjusting
+// its definition where the new chipset needs it. It returns the plan that
+// was applied and the previous definition, to roll back with
+// RestoreDomainDefinition.
+func (c *Connector) UpgradeMachineType(hostID, vmName, target string) (*MachineTypeUpgradePlan, string, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, "", err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := requireShutoff(l, domain, vmName); err != nil {
+		return nil, "", err
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	plan, newXML, err := planMachineType(l, xmlDesc, target)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(plan.Blockers) > 0 {
+		return plan, "", fmt.Errorf("%w: %s", ErrMachineTypeUpgradeBlocked, strings.Join(plan.Blockers, "; "))
+	}
+
+	defer c.invalidateDomain(hostID, domain)
+	if _, err := l.DomainDefineXML(newXML); c.reportRPC(hostID, err) != nil {
+		return plan, "", fmt.Errorf("failed to redefine %s as %s: %w", vmName, plan.Target, err)
+	}
+	return plan, xmlDesc, nil
+}
+
+// RestoreDomainDefinition puts back an earlier definition of a shut-off
+// VM, as kept by UpgradeMachineType.
+func (c *Connector) RestoreDomainDefinition(hostID, vmName, domainXML string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if err := requireShutoff(l, domain, vmName); err != nil {
+		return err
+	}
+	defer c.invalidateDomain(hostID, domain)
+	if _, err := l.DomainDefineXML(domainXML); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to restore the definition of %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// requireShutoff returns ErrDomainActive unless the domain is shut off.
+func requireShutoff(l *libvirt.Libvirt, domain libvirt.Domain, vmName string) error {
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return fmt.Errorf("cannot change the definition of %s: %w", vmName, ErrDomainActive)
+	}
+	return nil
+}
+
+// planMachineType works out the move of a domain definition to the target
+// machine type and returns the plan with the new definition.
+func planMachineType(l *libvirt.Libvirt, xmlDesc, target string) (*MachineTypeUpgradePlan, string, error) {
+	var def machineDomainXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, "", fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		return nil, "", err
+	}
+	types := machineTypes(caps, def.OS.Type.Arch, def.Type)
+
+	current := def.OS.Type.Machine
+	plan := &MachineTypeUpgradePlan{Current: current, Changes: []string{}, Blockers: []string{}}
+	var currentType *MachineType
+	for i := range types {
+		if types[i].Name == current || types[i].Alias == current {
+			currentType = &types[i]
+		}
+	}
+	if currentType != nil {
+		plan.Deprecated = currentType.Deprecated
+	}
+
+	var targetType *MachineType
+	if target == "" {
+		family, _ := splitMachineType(current)
+		if currentType != nil {
+			family = currentType.Family
+		}
+		// types is sorted newest first within a family.
+		for i := range types {
+			if types[i].Family == family && !types[i].Deprecated {
+				targetType = &types[i]
+				break
+			}
+		}
+		if targetType == nil {
+			return nil, "", fmt.Errorf("%w: no supported version of %s on this host", ErrUnknownMachineType, family)
+		}
+	} else {
+		for i := range types {
+			if types[i].Name == target || types[i].Alias == target {
+				targetType = &types[i]
+				break
+			}
+		}
+		if targetType == nil {
+			return nil, "", fmt.Errorf("%w: %s", ErrUnknownMachineType, target)
+		}
+	}
+	plan.Target = targetType.Name
+
+	if targetType.Name == current {
+		plan.Blockers = append(plan.Blockers, fmt.Sprintf("The VM already uses %s", current))
+	}
+	if targetType.Deprecated {
+		plan.Blockers = append(plan.Blockers, fmt.Sprintf("%s is deprecated", targetType.Name))
+	}
+	if targetType.MaxCPUs > 0 && def.VCPU > targetType.MaxCPUs {
+		plan.Blockers = append(plan.Blockers, fmt.Sprintf("The VM has %d vCPUs; %s supports at most %d", def.VCPU, targetType.Name, targetType.MaxCPUs))
+	}
+
+	fromFamily, _ := splitMachineType(current)
+	if currentType != nil {
+		fromFamily = currentType.Family
+	}
+	newXML := strings.Replace(xmlDesc, fmt.Sprintf("machine='%s'", current), fmt.Sprintf("machine='%s'", targetType.Name), 1)
+	plan.Changes = append(plan.Changes, fmt.Sprintf("Machine type %s becomes %s", current, targetType.Name))
+	switch {
+	case fromFamily == targetType.Family:
+	case fromFamily == "pc-i440fx" && targetType.Family == "pc-q35":
+		newXML = convertToQ35(newXML, plan)
+	default:
+		plan.Blockers = append(plan.Blockers, fmt.Sprintf("Changing the machine type family from %s to %s is not supported", fromFamily, targetType.Family))
+	}
+	return plan, newXML, nil
+}
+
+// convertToQ35 adjusts an i440fx definition for the q35 chipset: PCI
+// addresses and controllers are dropped for libvirt to lay out a PCIe
+// topology, and IDE disks, which q35 lacks, move to SATA.
+func convertToQ35(domainXML string, plan *MachineTypeUpgradePlan) string {
+	if n := len(pciAddressElement.FindAllString(domainXML, -1)); n > 0 {
+		domainXML = pciAddressElement.ReplaceAllString(domainXML, "")
+		plan.Changes = append(plan.Changes, fmt.Sprintf("%d PCI addresses are dropped for libvirt to reassign", n))
+	}
+	if n := len(pciControllerElement.FindAllString(domainXML, -1)); n > 0 {
+		domainXML = pciControllerElement.ReplaceAllString(domainXML, "")
+		plan.Changes = append(plan.Changes, fmt.Sprintf("%d PCI and IDE controllers are dropped for libvirt to recreate", n))
+	}
+
+	used := make(map[string]bool)
+	for _, m := range diskTargetElement.FindAllStringSubmatch(domainXML, -1) {
+		used[m[1]] = true
+	}
+	return diskElement.ReplaceAllStringFunc(domainXML, func(disk string) string {
+		m := diskTargetElement.FindStringSubmatch(disk)
+		if m == nil || m[2] != "ide" {
+			return disk
+		}
+		dev := m[1]
+		for ch := 'a'; ch <= 'z'; ch++ {
+			if candidate := "sd" + string(ch); !used[candidate] {
+				dev = candidate
+				break
+			}
+		}
+		used[dev] = true
+		plan.Changes = append(plan.Changes, fmt.Sprintf("IDE disk %s moves to SATA as %s", m[1], dev))
+		disk = strings.Replace(disk, m[0], fmt.Sprintf("<target dev='%s' bus='sata'", dev), 1)
+		return driveAddressElement.ReplaceAllString(disk, "")
+	})
+}
@@ -0,0 +1,452 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Categories of migration precheck findings.
+const (
+	MigrationCheckHost        = "host"
+	MigrationCheckCPU         = "cpu"
+	MigrationCheckMachineType = "machine-type"
+	MigrationCheckStorage     = "storage"
+	MigrationCheckNetwork     = "network"
+)
+
+// localPoolTypes are pool types whose volumes live on the host itself, so a
+// volume found at the same path on another host is not the same data.
+var localPoolTypes = map[string]bool{"dir": true, "fs": true, "logical": true, "disk": true, "zfs": true}
+
+// MigrationIssue is a single finding of a migration precheck.
+type MigrationIssue struct {
+	Check   string `json:"check"`            // One of the MigrationCheck constants
+	Device  string `json:"device,omitempty"` // Disk target or interface MAC the finding is about
+	Message string `json:"message"`
+}
+
+// MigrationPrecheck lists what would prevent a VM from running on another
+// host (blockers) and what could not be verified or may need attention
+// (warnings).
+type MigrationPrecheck struct {
+	SourceHostID string           `json:"source_host_id"`
+	TargetHostID string           `json:"target_host_id"`
+	Live         bool             `json:"live"` // The VM is running, so it would be migrated live
+	Blockers     []MigrationIssue `json:"blockers"`
+	Warnings     []MigrationIssue `json:"warnings"`
+}
+
+func (p *MigrationPrecheck) block(check, device, format string, args ...interface{}) {
+	p.Blockers = append(p.Blockers, MigrationIssue{Check: check, Device: device, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *MigrationPrecheck) warn(check, device, format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, MigrationIssue{Check: check, Device: device, Message: fmt.Sprintf(format, args...)})
+}
+
+// migrationCPUXML keeps a domain's <cpu> element verbatim, so it can be
+// handed to the target for comparison.
+type migrationCPUXML struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+func (x *migrationCPUXML) mode() string {
+	for _, a := range x.Attrs {
+		if a.Name.Local == "mode" {
+			return a.Value
+		}
+	}
+	return "custom"
+}
+
+// migrationDomainXML is the part of a domain XML that the target host must
+// be able to provide.
+type migrationDomainXML struct {
+	Type string `xml:"type,attr"`
+	OS   struct {
+		Type struct {
+			Arch    string `xml:"arch,attr"`
+			Machine string `xml:"machine,attr"`
+		} `xml:"type"`
+	} `xml:"os"`
+	CPU     *migrationCPUXML `xml:"cpu"`
+	Devices struct {
+		Emulator string `xml:"emulator"`
+		Disks    []struct {
+			chainDiskXML
+			Device string `xml:"device,attr"`
+		} `xml:"disk"`
+		Interfaces []struct {
+			Type   string `xml:"type,attr"`
+			Source struct {
+				Bridge  string `xml:"bridge,attr"`
+				Network string `xml:"network,attr"`
+				Dev     string `xml:"dev,attr"`
+			} `xml:"source"`
+			Mac struct {
+				Address string `xml:"address,attr"`
+			} `xml:"mac"`
+		} `xml:"interface"`
+	} `xml:"devices"`
+}
+
+// capabilitiesXML is the part of a host's capabilities used by the precheck
+// and the host details.
+type capabilitiesXML struct {
+	Host struct {
+		CPU struct {
+			Arch   string `xml:"arch"`
+			Model  string `xml:"model"`
+			Vendor string `xml:"vendor"`
+			Pages  []struct {
+				Unit string `xml:"unit,attr"`
+				Size uint64 `xml:"size,attr"`
+			} `xml:"pages"`
+		} `xml:"cpu"`
+		Cells []struct {
+			ID     uint `xml:"id,attr"`
+			Memory struct {
+				Value uint64 `xml:",chardata"`
+				Unit  string `xml:"unit,attr"`
+			} `xml:"memory"`
+			CPUs []struct {
+				ID uint `xml:"id,attr"`
+			} `xml:"cpus>cpu"`
+		} `xml:"topology>cells>cell"`
+	} `xml:"host"`
+	Guests []struct {
+		OSType string `xml:"os_type"`
+		Arch   struct {
+			Name     string           `xml:"name,attr"`
+			Machines []capsMachineXML `xml:"machine"`
+			Domains  []struct {
+				Type     string           `xml:"type,attr"`
+				Machines []capsMachineXML `xml:"machine"`
+			} `xml:"domain"`
+		} `xml:"arch"`
+	} `xml:"guest"`
+}
+
+// capsMachineXML is a machine type an emulator offers. Aliases such as 'pc'
+// name their versioned machine type in canonical.
+type capsMachineXML struct {
+	Name       string `xml:",chardata"`
+	Canonical  string `xml:"canonical,attr"`
+	MaxCPUs    uint   `xml:"maxCpus,attr"`
+	Deprecated string `xml:"deprecated,attr"`
+}
+
+func hostCapabilities(l *libvirt.Libvirt) (*capabilitiesXML, error) {
+	capsXML, err := l.ConnectGetCapabilities()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host capabilities: %w", err)
+	}
+	var caps capabilitiesXML
+	if err := xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse host capabilities: %w", err)
+	}
+	return &caps, nil
+}
+
+// optString wraps an optional RPC argument, leaving it unset when empty.
+func optString(s string) libvirt.OptString {
+	if s == "" {
+		return nil
+	}
+	return libvirt.OptString{s}
+}
+
+// isLibvirtError reports whether err is a libvirt error with the given code.
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	var lerr libvirt.Error
+	return errors.As(err, &lerr) && lerr.Code == uint32(code)
+}
+
+// migrationSource is what the precheck needs to know about the VM and the
+// host it currently runs on.
+type migrationSource struct {
+	def     migrationDomainXML
+	running bool
+	name    string
+	uuid    libvirt.UUID
+	hvType  string
+	caps    *capabilitiesXML
+}
+
+func (c *Connector) readMigrationSource(hostID, vmName string) (*migrationSource, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	// The migratable XML is what the target receives: host-model CPUs are
+	// expanded to the model and features the guest actually sees.
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLMigratable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	src := &migrationSource{
+		running: libvirt.DomainState(state) == libvirt.DomainRunning || libvirt.DomainState(state) == libvirt.DomainPaused,
+		name:    domain.Name,
+		uuid:    domain.UUID,
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &src.def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	if src.hvType, err = l.ConnectGetType(); err != nil {
+		return nil, fmt.Errorf("failed to get hypervisor type of host %s: %w", hostID, err)
+	}
+	if src.caps, err = hostCapabilities(l); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// PrecheckMigration compares what a VM needs with what the target host
+// offers: hypervisor, CPU model and features, machine type, visibility of
+// the VM's storage, and the bridges and networks its interfaces use.
+func (c *Connector) PrecheckMigration(hostID, vmName, targetHostID string) (*MigrationPrecheck, error) {
+	src, err := c.readMigrationSource(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	check := &MigrationPrecheck{
+		SourceHostID: hostID,
+		TargetHostID: targetHostID,
+		Live:         src.running,
+		Blockers:     []MigrationIssue{},
+		Warnings:     []MigrationIssue{},
+	}
+	if targetHostID == hostID {
+		check.block(MigrationCheckHost, "", "VM %s already runs on host %s", vmName, hostID)
+		return check, nil
+	}
+
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		check.block(MigrationCheckHost, "", "Target host %s is not available: %v", targetHostID, err)
+		return check, nil
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		check.block(MigrationCheckHost, "", "Target host %s is not available: %v", targetHostID, err)
+		return check, nil
+	}
+
+	if hvType, err := l.ConnectGetType(); err != nil {
+		check.warn(MigrationCheckHost, "", "Could not read the hypervisor type of the target: %v", err)
+	} else if !strings.EqualFold(hvType, src.hvType) {
+		check.block(MigrationCheckHost, "", "Hypervisor differs: %s on the source, %s on the target", src.hvType, hvType)
+	}
+	if _, err := l.DomainLookupByUUID(src.uuid); err == nil {
+		check.block(MigrationCheckHost, "", "A domain with the UUID of %s is already defined on the target", vmName)
+	} else if _, err := l.DomainLookupByName(src.name); err == nil {
+		check.block(MigrationCheckHost, "", "A domain named %s is already defined on the target", vmName)
+	}
+
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		check.warn(MigrationCheckMachineType, "", "Could not read target capabilities: %v", err)
+	} else {
+		checkMachineType(check, &src.def, caps)
+		checkCPU(check, l, src, caps)
+	}
+	checkStorage(check, c, l, targetHostID, &src.def)
+	checkInterfaces(check, l, &src.def)
+	return check, nil
+}
+
+func checkMachineType(check *MigrationPrecheck, def *migrationDomainXML, caps *capabilitiesXML) {
+	arch, machine := def.OS.Type.Arch, def.OS.Type.Machine
+	for _, guest := range caps.Guests {
+		if guest.Arch.Name != arch {
+			continue
+		}
+		domainOK := false
+		for _, d := range guest.Arch.Domains {
+			if d.Type == def.Type {
+				domainOK = true
+			}
+		}
+		if !domainOK {
+			continue
+		}
+		if machine == "" {
+			return
+		}
+		for _, m := range guest.Arch.Machines {
+			if m.Name == machine {
+				return
+			}
+		}
+		check.block(MigrationCheckMachineType, "", "Machine type %s is not supported by the target's emulator", machine)
+		return
+	}
+	check.block(MigrationCheckMachineType, "", "The target cannot run %s guests of type %s", arch, def.Type)
+}
+
+func checkCPU(check *MigrationPrecheck, l *libvirt.Libvirt, src *migrationSource, caps *capabilitiesXML) {
+	srcCPU, dstCPU := src.caps.Host.CPU, caps.Host.CPU
+	if srcCPU.Arch != dstCPU.Arch {
+		check.block(MigrationCheckCPU, "", "Host CPU architecture differs: %s on the source, %s on the target", srcCPU.Arch, dstCPU.Arch)
+		return
+	}
+	if src.def.CPU == nil {
+		return
+	}
+
+	switch src.def.CPU.mode() {
+	case "host-passthrough", "maximum":
+		// The guest sees the source CPU as is, so only an identical CPU is safe.
+		if srcCPU.Vendor != dstCPU.Vendor {
+			check.block(MigrationCheckCPU, "", "The VM passes the host CPU through, and the CPU vendor differs: %s on the source, %s on the target",
+				srcCPU.Vendor, dstCPU.Vendor)
+		} else if srcCPU.Model != dstCPU.Model {
+			check.warn(MigrationCheckCPU, "", "The VM passes the host CPU through, and the CPU model differs: %s on the source, %s on the target",
+				srcCPU.Model, dstCPU.Model)
+		}
+		return
+	case "host-model":
+		if !src.running {
+			// Expanded again from the target's CPU when the VM is started there.
+			return
+		}
+	}
+	compareGuestCPU(check, l, &src.def)
+}
+
+// compareGuestCPU checks that the target's hypervisor can provide the CPU
+// model and features a domain defines.
+func compareGuestCPU(check *MigrationPrecheck, l *libvirt.Libvirt, def *migrationDomainXML) {
+	cpuXML, err := xml.Marshal(def.CPU)
+	if err != nil {
+		check.warn(MigrationCheckCPU, "", "Could not encode the VM's CPU definition: %v", err)
+		return
+	}
+	result, err := l.ConnectCompareHypervisorCPU(optString(def.Devices.Emulator), optString(def.OS.Type.Arch),
+		optString(def.OS.Type.Machine), optString(def.Type), string(cpuXML), 0)
+	if err != nil {
+		check.warn(MigrationCheckCPU, "", "Could not compare the VM's CPU with the target: %v", err)
+		return
+	}
+	if libvirt.CPUCompareResult(result) == libvirt.CPUCompareIncompatible {
+		check.block(MigrationCheckCPU, "", "The target CPU does not provide the CPU model or features the VM uses")
+	}
+}
+
+func checkStorage(check *MigrationPrecheck, c *Connector, l *libvirt.Libvirt, targetHostID string, def *migrationDomainXML) {
+	for _, disk := range def.Devices.Disks {
+		device := disk.Target.Dev
+		switch disk.Type {
+		case "network":
+			// Network disks (RBD, iSCSI, NBD, ...) are reached from any host.
+			continue
+		case "volume":
+			pool, err := l.StoragePoolLookupByName(disk.Source.Pool)
+			if err != nil {
+				check.block(MigrationCheckStorage, device, "Storage pool %s does not exist on the target", disk.Source.Pool)
+				continue
+			}
+			if _, err := l.StorageVolLookupByName(pool, disk.Source.Volume); err != nil {
+				check.block(MigrationCheckStorage, device, "Volume %s is not in pool %s on the target", disk.Source.Volume, disk.Source.Pool)
+			}
+			continue
+		}
+
+		path := disk.Source.File
+		if path == "" {
+			path = disk.Source.Dev
+		}
+		if path == "" {
+			continue // Empty CD-ROM drive
+		}
+
+		vol, err := l.StorageVolLookupByPath(path)
+		if err == nil {
+			checkVolumeShared(check, l, vol, device, path)
+			continue
+		}
+		if !isLibvirtError(err, libvirt.ErrNoStorageVol) {
+			check.warn(MigrationCheckStorage, device, "Could not look up %s on the target: %v", path, err)
+			continue
+		}
+		// Images outside storage pools can still be on shared storage, e.g.
+		// an NFS mount without a pool; check for the file itself.
+		if _, err := c.RunHostCommand(targetHostID, "test -e "+ShellQuote(path)); err == nil {
+			check.warn(MigrationCheckStorage, device, "%s exists on the target outside any storage pool; make sure it is the same shared storage", path)
+		} else {
+			check.block(MigrationCheckStorage, device, "%s is not visible on the target; the storage is not shared", path)
+		}
+	}
+}
+
+func checkVolumeShared(check *MigrationPrecheck, l *libvirt.Libvirt, vol libvirt.StorageVol, device, path string) {
+	pool, err := l.StoragePoolLookupByVolume(vol)
+	if err != nil {
+		return
+	}
+	poolXML, err := l.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return
+	}
+	var def struct {
+		Type string `xml:"type,attr"`
+	}
+	if xml.Unmarshal([]byte(poolXML), &def) == nil && localPoolTypes[def.Type] {
+		check.warn(MigrationCheckStorage, device, "%s is in the local %s pool %s on the target; unless that directory is on shared storage, it is a different image",
+			path, def.Type, pool.Name)
+	}
+}
+
+func checkInterfaces(check *MigrationPrecheck, l *libvirt.Libvirt, def *migrationDomainXML) {
+	for _, iface := range def.Devices.Interfaces {
+		device := iface.Mac.Address
+		switch iface.Type {
+		case "bridge", "direct":
+			dev := iface.Source.Bridge
+			if iface.Type == "direct" {
+				dev = iface.Source.Dev
+			}
+			if dev == "" {
+				continue
+			}
+			_, err := l.InterfaceLookupByName(dev)
+			switch {
+			case err == nil:
+			case isLibvirtError(err, libvirt.ErrNoInterface):
+				check.block(MigrationCheckNetwork, device, "Host interface %s does not exist on the target", dev)
+			default:
+				check.warn(MigrationCheckNetwork, device, "Could not verify that host interface %s exists on the target: %v", dev, err)
+			}
+		case "network":
+			network, err := l.NetworkLookupByName(iface.Source.Network)
+			if err != nil {
+				if isLibvirtError(err, libvirt.ErrNoNetwork) {
+					check.block(MigrationCheckNetwork, device, "Network %s does not exist on the target", iface.Source.Network)
+				} else {
+					check.warn(MigrationCheckNetwork, device, "Could not look up network %s on the target: %v", iface.Source.Network, err)
+				}
+				continue
+			}
+			if active, err := l.NetworkIsActive(network); err == nil && active != 1 {
+				check.block(MigrationCheckNetwork, device, "Network %s is not active on the target", iface.Source.Network)
+			}
+		}
+	}
+}
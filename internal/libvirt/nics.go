@@ -0,0 +1,108 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// VirtualPortOVS is the virtual port type of interfaces on Open vSwitch bridges.
+const VirtualPortOVS = "openvswitch"
+
+// MaxVLANID is the highest usable 802.1Q VLAN ID.
+const MaxVLANID = 4094
+
+// NICAttachSpec describes a bridged network interface to attach to a VM.
+type NICAttachSpec struct {
+	MAC    string // MAC address of the new interface
+	Bridge string // Host bridge to connect to, e.g. 'br0'
+	Model  string // Device model, e.g. 'virtio' (default), 'e1000'
+
+	VirtualPortType string // 'openvswitch' for OVS bridges
+	VLANID          uint   // Access VLAN, 0 for untagged
+}
+
+// newInterfaceXML is used for marshalling an interface device definition.
+type newInterfaceXML struct {
+	XMLName xml.Name `xml:"interface"`
+	Type    string   `xml:"type,attr"`
+	Mac     struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Bridge string `xml:"bridge,attr"`
+	} `xml:"source"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+	VLAN        *InterfaceVLAN `xml:"vlan,omitempty"`
+	VirtualPort *struct {
+		Type string `xml:"type,attr"`
+	} `xml:"virtualport,omitempty"`
+}
+
+// AttachNIC adds a bridged interface to a VM's persistent definition, and
+// hot-plugs it as well when the VM is running.
+func (c *Connector) AttachNIC(hostID, vmName string, spec NICAttachSpec) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+
+	def := newInterfaceXML{Type: "bridge"}
+	def.Mac.Address = spec.MAC
+	def.Source.Bridge = spec.Bridge
+	def.Model.Type = spec.Model
+	if def.Model.Type == "" {
+		def.Model.Type = "virtio"
+	}
+	if spec.VirtualPortType != "" {
+		def.VirtualPort = &struct {
+			Type string `xml:"type,attr"`
+		}{Type: spec.VirtualPortType}
+	}
+	// libvirt only applies VLAN tags itself on Open vSwitch ports; ports on
+	// VLAN-filtering Linux bridges are tagged with SetBridgePortVLAN.
+	if spec.VLANID != 0 && spec.VirtualPortType == VirtualPortOVS {
+		def.VLAN = &InterfaceVLAN{}
+		def.VLAN.Tag.ID = spec.VLANID
+	}
+	ifaceXML, err := xml.Marshal(def)
+	if err != nil {
+		return fmt.Errorf("failed to build interface XML: %w", err)
+	}
+
+	running, err := requireHotplug(l, domain, func(hc *HotplugCapabilities) HotplugSupport { return hc.NIC })
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainDeviceModifyConfig
+	if running {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	if err := l.DomainAttachDeviceFlags(domain, string(ifaceXML), uint32(flags)); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to attach interface to %s: %w", vmName, err)
+	}
+	c.invalidateDomain(hostID, domain)
+	return nil
+}
+
+// SetBridgePortVLAN makes a running VM's tap device an untagged access port of
+// a VLAN on a VLAN-filtering Linux bridge. Taps are recreated whenever a VM
+// starts, so this has to be repeated after every start. The command runs over
+// the host's SSH channel.
+func (c *Connector) SetBridgePortVLAN(hostID, tapDev string, vlanID uint) error {
+	dev := ShellQuote(tapDev)
+	cmd := fmt.Sprintf("bridge vlan del dev %s vid 1 2>/dev/null; bridge vlan add dev %s vid %d pvid untagged", dev, dev, vlanID)
+	if _, err := c.RunHostCommand(hostID, cmd); err != nil {
+		return fmt.Errorf("failed to set VLAN %d on %s: %w", vlanID, tapDev, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package libvirt
+
+import (
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// OS families a guest is classified into, e.g. to pick an icon.
+const (
+	OSFamilyLinux   = "linux"
+	OSFamilyWindows = "windows"
+	OSFamilyBSD     = "bsd"
+	OSFamilyMacOS   = "macos"
+	OSFamilyOther   = "other"
+)
+
+// Where OS info was read from.
+const (
+	OSSourceGuestAgent = "guest-agent"
+	OSSourceDomainXML  = "domain-xml"
+)
+
+// guestAgentChannel is the name of the virtio channel of the QEMU guest agent.
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+// OSInfo describes the operating system of a guest. All fields are empty when
+// the OS is unknown.
+type OSInfo struct {
+	Family  string `json:"family"`  // One of the OSFamily constants
+	Variant string `json:"variant"` // Short ID such as "ubuntu22.04" or "win10"
+	Name    string `json:"name"`    // Human-readable name, only known from the guest agent
+	Source  string `json:"source"`  // One of the OSSource constants
+}
+
+// domainOSXML is the part of a domain XML that describes the guest OS: the
+// libosinfo metadata written by virt-install and virt-manager, and the guest
+// agent channel, whose state libvirt reports in the live XML.
+type domainOSXML struct {
+	Libosinfo struct {
+		ID string `xml:"id,attr"`
+	} `xml:"metadata>libosinfo>os"`
+	Channels []struct {
+		Target struct {
+			Name  string `xml:"name,attr"`
+			State string `xml:"state,attr"`
+		} `xml:"target"`
+	} `xml:"devices>channel"`
+}
+
+// States of the guest agent of a running domain.
+const (
+	GuestAgentConnected    = "connected"
+	GuestAgentDisconnected = "disconnected"
+)
+
+// agentState returns the state of the guest agent channel of a running
+// domain, or an empty string if the domain has no such channel.
+func (x *domainOSXML) agentState() string {
+	for _, ch := range x.Channels {
+		if ch.Target.Name == guestAgentChannel {
+			if ch.Target.State == GuestAgentConnected {
+				return GuestAgentConnected
+			}
+			return GuestAgentDisconnected
+		}
+	}
+	return ""
+}
+
+// agentConnected reports whether the guest agent of a running domain is up.
+func (x *domainOSXML) agentConnected() bool {
+	return x.agentState() == GuestAgentConnected
+}
+
+// osInfoFromLibosinfo builds OSInfo from a libosinfo ID such as
+// "http://ubuntu.com/ubuntu/22.04" or "http://microsoft.com/win/10".
+func osInfoFromLibosinfo(id string) OSInfo {
+	if id == "" {
+		return OSInfo{}
+	}
+	variant := id
+	if u, err := url.Parse(id); err == nil && u.Host != "" {
+		variant = strings.ReplaceAll(strings.Trim(u.Path, "/"), "/", "")
+	}
+	return OSInfo{
+		Family:  classifyOS(variant),
+		Variant: variant,
+		Source:  OSSourceDomainXML,
+	}
+}
+
+// guestAgentOSInfo asks the guest agent of a running domain for its OS. It
+// returns false if the agent did not answer.
+func guestAgentOSInfo(l *libvirt.Libvirt, domain libvirt.Domain) (OSInfo, bool) {
+	params, err := l.DomainGetGuestInfo(domain, uint32(libvirt.DomainGuestInfoOs), 0)
+	if err != nil {
+		log.Printf("Warning: could not get OS info from guest agent of %s: %v", domain.Name, err)
+		return OSInfo{}, false
+	}
+	fields := make(map[string]string)
+	for _, p := range params {
+		if s, ok := p.Value.I.(string); ok {
+			fields[p.Field] = s
+		}
+	}
+	id := fields["os.id"]
+	if id == "" {
+		return OSInfo{}, false
+	}
+	name := fields["os.pretty-name"]
+	if name == "" {
+		name = fields["os.name"]
+	}
+	return OSInfo{
+		Family:  classifyOS(id),
+		Variant: id + fields["os.version-id"],
+		Name:    name,
+		Source:  OSSourceGuestAgent,
+	}, true
+}
+
+// osFamilyPrefixes maps OS ID prefixes, as used by libosinfo and by the
+// os-release IDs the guest agent reports, to families.
+var osFamilyPrefixes = []struct {
+	prefix string
+	family string
+}{
+	{"mswindows", OSFamilyWindows},
+	{"win", OSFamilyWindows},
+	{"freebsd", OSFamilyBSD},
+	{"openbsd", OSFamilyBSD},
+	{"netbsd", OSFamilyBSD},
+	{"dragonfly", OSFamilyBSD},
+	{"macos", OSFamilyMacOS},
+	{"darwin", OSFamilyMacOS},
+	{"ubuntu", OSFamilyLinux},
+	{"debian", OSFamilyLinux},
+	{"fedora", OSFamilyLinux},
+	{"rhel", OSFamilyLinux},
+	{"centos", OSFamilyLinux},
+	{"rocky", OSFamilyLinux},
+	{"alma", OSFamilyLinux},
+	{"ol", OSFamilyLinux},
+	{"opensuse", OSFamilyLinux},
+	{"sle", OSFamilyLinux},
+	{"arch", OSFamilyLinux},
+	{"alpine", OSFamilyLinux},
+	{"gentoo", OSFamilyLinux},
+	{"linuxmint", OSFamilyLinux},
+	{"mint", OSFamilyLinux},
+	{"nixos", OSFamilyLinux},
+	{"fcos", OSFamilyLinux},
+	{"rhcos", OSFamilyLinux},
+	{"amzn", OSFamilyLinux},
+	{"kali", OSFamilyLinux},
+	{"manjaro", OSFamilyLinux},
+	{"linux", OSFamilyLinux},
+}
+
+// classifyOS returns the family of an OS ID, or OSFamilyOther if it is not
+// recognised.
+func classifyOS(id string) string {
+	id = strings.ToLower(id)
+	for _, p := range osFamilyPrefixes {
+		if strings.HasPrefix(id, p.prefix) {
+			return p.family
+		}
+	}
+	return OSFamilyOther
+}
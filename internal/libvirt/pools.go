@@ -0,0 +1,199 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// StoragePoolInfo holds the configuration and current usage of a storage pool.
+type StoragePoolInfo struct {
+	Name            string `json:"name"`
+	UUID            string `json:"uuid"`
+	Type            string `json:"type"`
+	Path            string `json:"path"`
+	Active          bool   `json:"active"`
+	Autostart       bool   `json:"autostart"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	AvailableBytes  uint64 `json:"available_bytes"`
+
+	// Thin provisioning: the backend (see the Backend constants), the space
+	// the pool's volumes could grow to, and backend specific usage.
+	Backend                string          `json:"backend"`
+	VirtualAllocationBytes uint64          `json:"virtual_allocation_bytes"`
+	ThinPools              []ThinPoolInfo  `json:"thin_pools,omitempty"`
+	Dataset                *ZFSDatasetInfo `json:"dataset,omitempty"`
+}
+
+// storagePoolXML is used for unmarshalling the parts of a pool definition we track.
+type storagePoolXML struct {
+	Type   string `xml:"type,attr"`
+	Source struct {
+		Name string `xml:"name"` // Volume group or ZFS pool name
+	} `xml:"source"`
+	Target struct {
+		Path string `xml:"path"`
+	} `xml:"target"`
+}
+
+// ListStoragePools returns all storage pools on a host. When refresh is set,
+// active pools are rescanned first so allocation reflects changes made
+// outside of libvirt.
+func (c *Connector) ListStoragePools(hostID string, refresh bool) ([]StoragePoolInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	pools, _, err := l.ConnectListAllStoragePools(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage pools: %w", err)
+	}
+
+	var infos []StoragePoolInfo
+	for _, pool := range pools {
+		info, err := c.storagePoolToInfo(l, hostID, pool, refresh)
+		if err != nil {
+			log.Printf("Warning: could not get info for storage pool %s on host %s: %v", pool.Name, hostID, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// GetStoragePool returns the configuration and usage of a single pool,
+// rescanning it first when refresh is set.
+func (c *Connector) GetStoragePool(hostID, poolName string, refresh bool) (*StoragePoolInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+	return c.storagePoolToInfo(l, hostID, pool, refresh)
+}
+
+func (c *Connector) storagePoolToInfo(l *libvirt.Libvirt, hostID string, pool libvirt.StoragePool, refresh bool) (*StoragePoolInfo, error) {
+	active, err := l.StoragePoolIsActive(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pool state: %w", err)
+	}
+	if refresh && active == 1 {
+		if err := l.StoragePoolRefresh(pool, 0); err != nil {
+			// A failed rescan still leaves the last known figures usable.
+			log.Printf("Warning: failed to refresh storage pool %s: %v", pool.Name, err)
+		}
+	}
+
+	autostart, err := l.StoragePoolGetAutostart(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pool autostart: %w", err)
+	}
+
+	_, capacity, allocation, available, err := l.StoragePoolGetInfo(pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pool info: %w", err)
+	}
+
+	xmlDesc, err := l.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pool XML: %w", err)
+	}
+	var def storagePoolXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse pool XML: %w", err)
+	}
+
+	uuidStr := fmt.Sprintf("%x", pool.UUID)
+	if parsedUUID, err := uuid.FromBytes(pool.UUID[:]); err == nil {
+		uuidStr = parsedUUID.String()
+	}
+
+	info := &StoragePoolInfo{
+		Name:            pool.Name,
+		UUID:            uuidStr,
+		Type:            def.Type,
+		Path:            def.Target.Path,
+		Active:          active == 1,
+		Autostart:       autostart == 1,
+		CapacityBytes:   capacity,
+		AllocationBytes: allocation,
+		AvailableBytes:  available,
+	}
+	c.addThinProvisioning(l, hostID, pool, info, def.Source.Name)
+	return info, nil
+}
+
+// SetStoragePoolAutostart sets whether a pool is started with libvirtd, which
+// VMs with disks in it rely on after the host reboots.
+func (c *Connector) SetStoragePoolAutostart(hostID, poolName string, autostart bool) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+	var flag int32
+	if autostart {
+		flag = 1
+	}
+	if err := l.StoragePoolSetAutostart(pool, flag); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to set autostart of storage pool '%s': %w", poolName, err)
+	}
+	return nil
+}
+
+// SetStoragePoolActive starts or stops a pool. Stopping a pool leaves its
+// volumes in place but makes them unusable until it is started again.
+func (c *Connector) SetStoragePoolActive(hostID, poolName string, active bool) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+	if active {
+		err = l.StoragePoolCreate(pool, 0)
+	} else {
+		err = l.StoragePoolDestroy(pool)
+	}
+	if c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to change state of storage pool '%s': %w", poolName, err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrDomainNotRunning is returned when process usage is requested for a VM
+// that has no running QEMU process.
+var ErrDomainNotRunning = errors.New("domain is not running")
+
+// processSampleWindow is how long CPU usage is measured over.
+const processSampleWindow = time.Second
+
+// Sources of process usage figures.
+const (
+	ProcessUsageProcfs  = "procfs"  // Read from /proc on the host over SSH
+	ProcessUsageLibvirt = "libvirt" // Derived from libvirt's domain statistics
+)
+
+// ProcessUsage is what a VM's QEMU process costs its host, as opposed to the
+// guest's own view of its resources.
+type ProcessUsage struct {
+	Source         string     `json:"source"`
+	PID            int        `json:"pid,omitempty"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	Threads        int        `json:"threads,omitempty"`
+	HostCPUs       int        `json:"host_cpus"`
+	CPUTimeSeconds float64    `json:"cpu_time_seconds"` // CPU time used since the process started
+	CPUPercent     float64    `json:"cpu_percent"`      // Over the sample window; 100 is one full host CPU
+	HostCPUPercent float64    `json:"host_cpu_percent"` // CPUPercent as a share of all host CPUs
+	RSSBytes       uint64     `json:"rss_bytes"`
+	SwapBytes      *uint64    `json:"swap_bytes,omitempty"`  // procfs only
+	ReadBytes      *uint64    `json:"read_bytes,omitempty"`  // Storage I/O of the process; procfs only, needs root
+	WriteBytes     *uint64    `json:"write_bytes,omitempty"` // Storage I/O of the process; procfs only, needs root
+}
+
+// GetDomainProcessUsage measures the host resources used by a running VM's
+// QEMU process. On hosts with an SSH channel the process is inspected through
+// /proc; otherwise CPU and resident memory come from libvirt's statistics.
+// Either way the call takes about a second to sample CPU usage.
+func (c *Connector) GetDomainProcessUsage(hostID, vmName string) (*ProcessUsage, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	active, err := l.DomainIsActive(domain)
+	if err != nil {
+		return nil, fmt.Errorf("could not get state for domain %s: %w", vmName, err)
+	}
+	if active != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrDomainNotRunning, vmName)
+	}
+
+	usage, err := c.procfsProcessUsage(hostID, vmName)
+	if errors.Is(err, ErrNoSSHChannel) {
+		return libvirtProcessUsage(l, domain)
+	}
+	return usage, err
+}
+
+// procfsProcessUsage finds the QEMU process through libvirt's pid file and
+// samples it twice, a second apart.
+func (c *Connector) procfsProcessUsage(hostID, vmName string) (*ProcessUsage, error) {
+	pidFile := ShellQuote("/run/libvirt/qemu/" + vmName + ".pid")
+	cmd := fmt.Sprintf(`pid=$(cat %s) || exit 1
+echo "pid $pid"; echo "clk $(getconf CLK_TCK)"; echo "cpus $(nproc)"; grep '^btime' /proc/stat
+echo "t1 $(date +%%s.%%N)"; echo "stat1 $(cat /proc/$pid/stat)"
+sleep %d
+echo "t2 $(date +%%s.%%N)"; echo "stat2 $(cat /proc/$pid/stat)"
+grep -E '^(VmRSS|VmSwap):' /proc/$pid/status; cat /proc/$pid/io 2>/dev/null; true`,
+		pidFile, int(processSampleWindow.Seconds()))
+
+	output, err := c.RunHostCommand(hostID, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect QEMU process of %s: %w", vmName, err)
+	}
+	return parseProcfsUsage(output)
+}
+
+// parseProcfsUsage turns the output of the procfs sampling command into usage figures.
+func parseProcfsUsage(output string) (*ProcessUsage, error) {
+	usage := &ProcessUsage{Source: ProcessUsageProcfs}
+	var clkTck, bootTime, t1, t2 float64
+	var stat1, stat2 []string
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value := strings.Join(fields[1:], " ")
+		switch fields[0] {
+		case "pid":
+			usage.PID, _ = strconv.Atoi(value)
+		case "clk":
+			clkTck, _ = strconv.ParseFloat(value, 64)
+		case "cpus":
+			usage.HostCPUs, _ = strconv.Atoi(value)
+		case "btime":
+			bootTime, _ = strconv.ParseFloat(value, 64)
+		case "t1":
+			t1, _ = strconv.ParseFloat(value, 64)
+		case "t2":
+			t2, _ = strconv.ParseFloat(value, 64)
+		case "stat1":
+			stat1 = procStatFields(value)
+		case "stat2":
+			stat2 = procStatFields(value)
+		case "VmRSS:":
+			usage.RSSBytes = parseKiB(value)
+		case "VmSwap:":
+			swap := parseKiB(value)
+			usage.SwapBytes = &swap
+		case "read_bytes:":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			usage.ReadBytes = &n
+		case "write_bytes:":
+			n, _ := strconv.ParseUint(value, 10, 64)
+			usage.WriteBytes = &n
+		}
+	}
+
+	// Fields after the command name: utime and stime are the 12th and 13th,
+	// num_threads the 18th and starttime the 20th.
+	if usage.PID == 0 || clkTck == 0 || len(stat1) < 20 || len(stat2) < 20 {
+		return nil, fmt.Errorf("unexpected output while inspecting QEMU process: %q", output)
+	}
+	cpuTicks := func(fields []string) float64 {
+		utime, _ := strconv.ParseFloat(fields[11], 64)
+		stime, _ := strconv.ParseFloat(fields[12], 64)
+		return utime + stime
+	}
+	usage.Threads, _ = strconv.Atoi(stat2[17])
+	usage.CPUTimeSeconds = cpuTicks(stat2) / clkTck
+	if window := t2 - t1; window > 0 {
+		usage.CPUPercent = (cpuTicks(stat2) - cpuTicks(stat1)) / clkTck / window * 100
+	}
+	if startTicks, err := strconv.ParseFloat(stat2[19], 64); err == nil && bootTime > 0 {
+		started := time.Unix(0, int64((bootTime+startTicks/clkTck)*float64(time.Second)))
+		usage.StartedAt = &started
+	}
+	if usage.HostCPUs > 0 {
+		usage.HostCPUPercent = usage.CPUPercent / float64(usage.HostCPUs)
+	}
+	return usage, nil
+}
+
+// procStatFields splits /proc/<pid>/stat after the command name, which may
+// itself contain spaces.
+func procStatFields(stat string) []string {
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(stat[i+1:])
+}
+
+// parseKiB parses a '/proc/<pid>/status' value such as '123456 kB'.
+func parseKiB(value string) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimSuffix(value, " kB"), 10, 64)
+	return n * 1024
+}
+
+// libvirtProcessUsage measures a domain from libvirt's statistics. The CPU
+// time libvirt reports covers all of the QEMU process's threads, and the RSS
+// memory statistic is read from the process by libvirt.
+func libvirtProcessUsage(l *libvirt.Libvirt, domain libvirt.Domain) (*ProcessUsage, error) {
+	usage := &ProcessUsage{Source: ProcessUsageLibvirt}
+	if _, _, cpus, _, _, _, _, _, err := l.NodeGetInfo(); err == nil {
+		usage.HostCPUs = int(cpus)
+	}
+
+	_, _, _, _, cpu1, err := l.DomainGetInfo(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info for domain %s: %w", domain.Name, err)
+	}
+	start := time.Now()
+	time.Sleep(processSampleWindow)
+	_, _, _, _, cpu2, err := l.DomainGetInfo(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get info for domain %s: %w", domain.Name, err)
+	}
+	window := time.Since(start)
+
+	usage.CPUTimeSeconds = float64(cpu2) / float64(time.Second)
+	usage.CPUPercent = float64(cpu2-cpu1) / float64(window) * 100
+	if usage.HostCPUs > 0 {
+		usage.HostCPUPercent = usage.CPUPercent / float64(usage.HostCPUs)
+	}
+
+	stats, err := l.DomainMemoryStats(domain, uint32(libvirt.DomainMemoryStatNr), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory stats for domain %s: %w", domain.Name, err)
+	}
+	for _, stat := range stats {
+		if stat.Tag == int32(libvirt.DomainMemoryStatRss) {
+			usage.RSSBytes = stat.Val * 1024
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,176 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// GetDomainDefinitions reads the inactive definition of every domain of a
+// host, keyed by domain UUID, so the domains can be defined on another host
+// should this one die. Domains that vanish while they are read are left out.
+func (c *Connector) GetDomainDefinitions(hostID string) (map[string]string, error) {
+	return c.domainDefinitions(hostID, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+}
+
+// domainDefinitions reads the definition of every domain of a host with the
+// given flags, keyed by domain UUID.
+func (c *Connector) domainDefinitions(hostID string, flags libvirt.DomainXMLFlags) (map[string]string, error) {
+	l, domains, err := c.listDomainHandles(context.Background(), hostID)
+	if err != nil {
+		return nil, err
+	}
+	defs := make(map[string]string, len(domains))
+	for _, domain := range domains {
+		release, err := c.acquireRPC(hostID)
+		if err != nil {
+			return nil, err
+		}
+		xmlDesc, err := l.DomainGetXMLDesc(domain, flags)
+		release()
+		if err != nil {
+			if isLibvirtError(err, libvirt.ErrNoDomain) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+		}
+		defs[uuid.UUID(domain.UUID).String()] = xmlDesc
+	}
+	return defs, nil
+}
+
+// PrecheckRecovery checks whether a VM of a dead host, known only by its
+// saved definition, can run on another host. The CPU is compared with the
+// target's alone, as the dead host cannot be asked.
+func (c *Connector) PrecheckRecovery(hostID, targetHostID, domainXML string) (*MigrationPrecheck, error) {
+	var def migrationDomainXML
+	var ids coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	if err := xml.Unmarshal([]byte(domainXML), &ids); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(ids.UUID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid domain UUID '%s': %w", ids.UUID, err)
+	}
+	check := &MigrationPrecheck{
+		SourceHostID: hostID,
+		TargetHostID: targetHostID,
+		Blockers:     []MigrationIssue{},
+		Warnings:     []MigrationIssue{},
+	}
+
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		check.block(MigrationCheckHost, "", "Target host %s is not available: %v", targetHostID, err)
+		return check, nil
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		check.block(MigrationCheckHost, "", "Target host %s is not available: %v", targetHostID, err)
+		return check, nil
+	}
+	if _, err := l.DomainLookupByUUID(libvirt.UUID(domainUUID)); err == nil {
+		check.block(MigrationCheckHost, "", "A domain with the UUID of %s is already defined on the target", ids.Name)
+	} else if _, err := l.DomainLookupByName(ids.Name); err == nil {
+		check.block(MigrationCheckHost, "", "A domain named %s is already defined on the target", ids.Name)
+	}
+
+	caps, err := hostCapabilities(l)
+	if err != nil {
+		check.warn(MigrationCheckMachineType, "", "Could not read target capabilities: %v", err)
+	} else {
+		checkMachineType(check, &def, caps)
+	}
+	if def.CPU != nil {
+		switch def.CPU.mode() {
+		case "host-passthrough", "maximum":
+			check.warn(MigrationCheckCPU, "", "The VM passes the host CPU through; it sees the target's CPU after the recovery")
+		case "host-model":
+			// Expanded from the target's CPU when the VM is started there.
+		default:
+			compareGuestCPU(check, l, &def)
+		}
+	}
+	checkStorage(check, c, l, targetHostID, &def)
+	checkInterfaces(check, l, &def)
+	return check, nil
+}
+
+// DefineRecoveredDomain defines a VM of a dead host on another host from
+// its saved definition. It does nothing if a domain with the VM's UUID is
+// already defined there.
+func (c *Connector) DefineRecoveredDomain(targetHostID, domainXML string) error {
+	var def coldMigrationXML
+	if err := xml.Unmarshal([]byte(domainXML), &def); err != nil {
+		return fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	domainUUID, err := uuid.Parse(def.UUID)
+	if err != nil {
+		return fmt.Errorf("invalid domain UUID '%s': %w", def.UUID, err)
+	}
+
+	release, err := c.acquireRPC(targetHostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(targetHostID)
+	if err != nil {
+		return err
+	}
+	if _, err := l.DomainLookupByUUID(libvirt.UUID(domainUUID)); err == nil {
+		return nil
+	}
+	if _, err := l.DomainDefineXML(domainXML); c.reportRPC(targetHostID, err) != nil {
+		return fmt.Errorf("failed to define %s on host %s: %w", def.Name, targetHostID, err)
+	}
+	return nil
+}
+
+// RemoveRecoveredDomain stops and undefines, on a host that came back, a
+// domain that was recovered on another host while it was down. Its storage
+// is shared with the recovered VM, so it is kept.
+func (c *Connector) RemoveRecoveredDomain(hostID, domainUUID string) error {
+	parsed, err := uuid.Parse(domainUUID)
+	if err != nil {
+		return fmt.Errorf("invalid domain UUID '%s': %w", domainUUID, err)
+	}
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+
+	domain, err := l.DomainLookupByUUID(libvirt.UUID(parsed))
+	if isLibvirtError(err, libvirt.ErrNoDomain) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %s on host %s: %w", domainUUID, hostID, err)
+	}
+	defer c.invalidateDomain(hostID, domain)
+	if active, err := l.DomainIsActive(domain); err == nil && active == 1 {
+		if err := l.DomainDestroy(domain); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to stop %s on host %s: %w", domain.Name, hostID, err)
+		}
+	}
+	// Snapshot metadata is the old host's own; the NVRAM may be the shared
+	// one the recovered VM uses.
+	flags := libvirt.DomainUndefineManagedSave | libvirt.DomainUndefineSnapshotsMetadata |
+		libvirt.DomainUndefineCheckpointsMetadata | libvirt.DomainUndefineKeepNvram
+	if err := l.DomainUndefineFlags(domain, flags); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to undefine %s on host %s: %w", domain.Name, hostID, err)
+	}
+	return nil
+}
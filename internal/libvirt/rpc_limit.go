@@ -0,0 +1,178 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/tracing"
+)
+
+// Defaults for the per-host limit on concurrent libvirt operations. Bulk
+// actions and concurrent API requests beyond the limit wait in a queue rather
+// than all hitting libvirtd at once.
+const (
+	DefaultMaxConcurrentRPCs = 8
+	RPCQueueTimeout          = 30 * time.Second
+)
+
+// ErrHostBusy is returned when an operation waited too long for a free slot
+// on a host.
+var ErrHostBusy = errors.New("host is busy: too many concurrent libvirt operations")
+
+// rpcLimiter bounds the number of operations running against one host.
+type rpcLimiter struct {
+	slots   chan struct{}
+	closed  chan struct{}
+	breaker *circuitBreaker
+
+	waiting  atomic.Int64
+	calls    atomic.Uint64
+	queued   atomic.Uint64
+	timedOut atomic.Uint64
+
+	mu        sync.Mutex
+	totalWait time.Duration
+	maxWait   time.Duration
+}
+
+// newRPCLimiter creates the limiter of a host. The probe is used to check on
+// the host while its circuit breaker is open.
+func newRPCLimiter(max int, probe func() error) *rpcLimiter {
+	if max <= 0 {
+		max = DefaultMaxConcurrentRPCs
+	}
+	r := &rpcLimiter{
+		slots:  make(chan struct{}, max),
+		closed: make(chan struct{}),
+	}
+	r.breaker = newCircuitBreaker(probe, r.closed)
+	return r
+}
+
+// acquire waits for a free slot until ctx is done or the host is removed.
+// It fails at once while the host's circuit breaker is open. Running out of
+// time counts as a failure for the breaker, as the slots are usually all
+// held by operations the host does not answer.
+func (r *rpcLimiter) acquire(ctx context.Context) (func(), error) {
+	if err := r.breaker.allow(); err != nil {
+		return nil, err
+	}
+	r.calls.Add(1)
+	release := func() { <-r.slots }
+
+	select {
+	case r.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	r.queued.Add(1)
+	r.waiting.Add(1)
+	defer r.waiting.Add(-1)
+	start := time.Now()
+	select {
+	case r.slots <- struct{}{}:
+		r.recordWait(time.Since(start))
+		return release, nil
+	case <-ctx.Done():
+		r.timedOut.Add(1)
+		err := fmt.Errorf("%w: %v", ErrHostBusy, ctx.Err())
+		r.breaker.failure(err)
+		return nil, err
+	case <-r.closed:
+		return nil, errors.New("host was disconnected while waiting")
+	}
+}
+
+func (r *rpcLimiter) recordWait(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totalWait += d
+	if d > r.maxWait {
+		r.maxWait = d
+	}
+}
+
+// ConnectionStats describes the load on a host connection.
+type ConnectionStats struct {
+	HostID        string  `json:"host_id"`
+	MaxConcurrent int     `json:"max_concurrent"`
+	InFlight      int     `json:"in_flight"`
+	QueueDepth    int64   `json:"queue_depth"`
+	Calls         uint64  `json:"calls"`
+	QueuedCalls   uint64  `json:"queued_calls"` // Calls that had to wait for a slot
+	TimedOut      uint64  `json:"timed_out"`
+	AvgWaitMs     float64 `json:"avg_wait_ms"` // Over queued calls
+	MaxWaitMs     float64 `json:"max_wait_ms"`
+
+	Circuit             string     `json:"circuit"` // CircuitClosed or CircuitOpen
+	CircuitOpenedAt     *time.Time `json:"circuit_opened_at,omitempty"`
+	CircuitTrips        uint64     `json:"circuit_trips"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+func (r *rpcLimiter) stats(hostID string) ConnectionStats {
+	stats := ConnectionStats{
+		HostID:        hostID,
+		MaxConcurrent: cap(r.slots),
+		InFlight:      len(r.slots),
+		QueueDepth:    r.waiting.Load(),
+		Calls:         r.calls.Load(),
+		QueuedCalls:   r.queued.Load(),
+		TimedOut:      r.timedOut.Load(),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if waited := stats.QueuedCalls - stats.TimedOut; waited > 0 {
+		stats.AvgWaitMs = float64(r.totalWait.Microseconds()) / float64(waited) / 1000
+	}
+	stats.MaxWaitMs = float64(r.maxWait.Microseconds()) / 1000
+	r.breaker.stats(&stats)
+	return stats
+}
+
+// acquireRPC takes one of a host's operation slots, waiting up to
+// RPCQueueTimeout for one to free up. The returned function releases it.
+func (c *Connector) acquireRPC(hostID string) (func(), error) {
+	return c.acquireRPCFor(context.Background(), hostID)
+}
+
+// acquireRPCFor is acquireRPC on behalf of a request: it also gives up once
+// ctx is done, and the wait shows in the request's trace.
+func (c *Connector) acquireRPCFor(ctx context.Context, hostID string) (func(), error) {
+	ctx, span := tracing.Start(ctx, "libvirt.acquire", tracing.Host(hostID))
+	ctx, cancel := context.WithTimeout(ctx, RPCQueueTimeout)
+	defer cancel()
+	release, err := c.acquireRPCContext(ctx, hostID)
+	tracing.End(span, err)
+	return release, err
+}
+
+// acquireRPCContext is acquireRPC with the caller's deadline.
+func (c *Connector) acquireRPCContext(ctx context.Context, hostID string) (func(), error) {
+	c.mu.RLock()
+	limiter, ok := c.limiters[hostID]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("not connected to host '%s'", hostID)
+	}
+	return limiter.acquire(ctx)
+}
+
+// ConnectionStats returns the load on every connected host, ordered by host ID.
+func (c *Connector) ConnectionStats() []ConnectionStats {
+	c.mu.RLock()
+	stats := make([]ConnectionStats, 0, len(c.limiters))
+	for hostID, limiter := range c.limiters {
+		stats = append(stats, limiter.stats(hostID))
+	}
+	c.mu.RUnlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].HostID < stats[j].HostID })
+	return stats
+}
@@ -0,0 +1,135 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// GetDomainScreenshot captures the primary display of a running domain and
+// returns it encoded as PNG.
+func (c *Connector) GetDomainScreenshot(hostID, vmName string) ([]byte, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	mime, err := l.DomainScreenshot(domain, &raw, 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take screenshot of %s: %w", vmName, err)
+	}
+
+	mimeType := ""
+	if len(mime) > 0 {
+		mimeType = mime[0]
+	}
+
+	// QEMU normally hands back a PPM image. Pass PNG through untouched.
+	if mimeType == "image/png" {
+		return raw.Bytes(), nil
+	}
+
+	img, err := decodePPM(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode screenshot (%s) of %s: %w", mimeType, vmName, err)
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		return nil, fmt.Errorf("failed to encode screenshot of %s as PNG: %w", vmName, err)
+	}
+	return out.Bytes(), nil
+}
+
+// decodePPM decodes a binary (P6) portable pixmap image.
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	var header [4]int // magic placeholder, width, height, maxval
+	for i := 0; i < 4; i++ {
+		token, err := readPPMToken(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PPM header: %w", err)
+		}
+		if i == 0 {
+			if token != "P6" {
+				return nil, fmt.Errorf("unsupported PPM format %q", token)
+			}
+			continue
+		}
+		var v int
+		if _, err := fmt.Sscanf(token, "%d", &v); err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid PPM header value %q", token)
+		}
+		header[i] = v
+	}
+
+	width, height, maxVal := header[1], header[2], header[3]
+	if maxVal > 65535 {
+		return nil, fmt.Errorf("invalid PPM max value %d", maxVal)
+	}
+
+	bytesPerSample := 1
+	if maxVal > 255 {
+		bytesPerSample = 2
+	}
+
+	row := make([]byte, width*3*bytesPerSample)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, fmt.Errorf("truncated PPM data: %w", err)
+		}
+		for x := 0; x < width; x++ {
+			var rgb [3]uint8
+			for ch := 0; ch < 3; ch++ {
+				offset := (x*3 + ch) * bytesPerSample
+				sample := int(row[offset])
+				if bytesPerSample == 2 {
+					sample = sample<<8 | int(row[offset+1])
+				}
+				rgb[ch] = uint8(sample * 255 / maxVal)
+			}
+			img.SetRGBA(x, y, color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255})
+		}
+	}
+
+	return img, nil
+}
+
+// readPPMToken reads the next whitespace-delimited header token, skipping
+// comments. It consumes exactly one whitespace byte after the token, as
+// required before the raster data.
+func readPPMToken(br *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == '#' && sb.Len() == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r':
+			if sb.Len() > 0 {
+				return sb.String(), nil
+			}
+		default:
+			sb.WriteByte(b)
+		}
+	}
+}
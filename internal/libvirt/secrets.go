@@ -0,0 +1,249 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// Usage types of secrets, as named in the secret XML.
+const (
+	SecretUsageNone   = "none"
+	SecretUsageVolume = "volume"
+	SecretUsageCeph   = "ceph"
+	SecretUsageISCSI  = "iscsi"
+	SecretUsageTLS    = "tls"
+	SecretUsageVTPM   = "vtpm"
+)
+
+var secretUsageNames = map[libvirt.SecretUsageType]string{
+	libvirt.SecretUsageTypeNone:   SecretUsageNone,
+	libvirt.SecretUsageTypeVolume: SecretUsageVolume,
+	libvirt.SecretUsageTypeCeph:   SecretUsageCeph,
+	libvirt.SecretUsageTypeIscsi:  SecretUsageISCSI,
+	libvirt.SecretUsageTypeTLS:    SecretUsageTLS,
+	libvirt.SecretUsageTypeVtpm:   SecretUsageVTPM,
+}
+
+// SecretInfo describes a libvirt secret. Its value is never returned.
+type SecretInfo struct {
+	UUID        string `json:"uuid"`
+	UsageType   string `json:"usage_type"` // One of the SecretUsage* constants
+	UsageID     string `json:"usage_id"`   // Ceph or TLS name, iSCSI target or volume path the secret is for
+	Description string `json:"description"`
+	Ephemeral   bool   `json:"ephemeral"` // Kept in memory only
+	Private     bool   `json:"private"`   // libvirt never reveals the value
+	// Whether a value is stored; nil for private secrets, whose value
+	// libvirt does not reveal even to check that it is there.
+	ValueSet *bool `json:"value_set"`
+}
+
+// SecretDefinition is what DefineSecret needs to create a secret.
+type SecretDefinition struct {
+	UUID        string // Generated by libvirt when empty
+	UsageType   string
+	UsageID     string
+	Description string
+	Ephemeral   bool
+	Private     bool
+}
+
+// secretXML is a secret definition. The element holding the usage ID
+// depends on the usage type.
+type secretXML struct {
+	XMLName     xml.Name        `xml:"secret"`
+	Ephemeral   string          `xml:"ephemeral,attr"`
+	Private     string          `xml:"private,attr"`
+	UUID        string          `xml:"uuid,omitempty"`
+	Description string          `xml:"description,omitempty"`
+	Usage       *secretUsageXML `xml:"usage"`
+}
+
+type secretUsageXML struct {
+	Type   string `xml:"type,attr"`
+	Name   string `xml:"name,omitempty"`
+	Target string `xml:"target,omitempty"`
+	Volume string `xml:"volume,omitempty"`
+}
+
+// ListSecrets returns the secrets defined on a host.
+func (c *Connector) ListSecrets(hostID string) ([]SecretInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	secrets, _, err := l.ConnectListAllSecrets(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secrets: %w", err)
+	}
+
+	infos := []SecretInfo{}
+	for _, secret := range secrets {
+		info, err := secretToInfo(l, secret)
+		if err != nil {
+			log.Printf("Warning: could not get info for secret %s on host %s: %v", secretUUID(secret), hostID, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// GetSecret returns a single secret by UUID.
+func (c *Connector) GetSecret(hostID, secretID string) (*SecretInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, secret, err := c.lookupSecret(hostID, secretID)
+	if err != nil {
+		return nil, err
+	}
+	return secretToInfo(l, secret)
+}
+
+// DefineSecret creates a secret, or redefines the one with the same UUID,
+// and sets its value unless value is nil.
+func (c *Connector) DefineSecret(hostID string, def SecretDefinition, value []byte) (*SecretInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	xmlDesc, err := secretDefinitionXML(def)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := l.SecretDefineXML(xmlDesc, 0)
+	if c.reportRPC(hostID, err) != nil {
+		return nil, fmt.Errorf("failed to define secret: %w", err)
+	}
+	if value != nil {
+		if err := l.SecretSetValue(secret, value, 0); c.reportRPC(hostID, err) != nil {
+			return nil, fmt.Errorf("failed to set value of secret %s: %w", secretUUID(secret), err)
+		}
+	}
+	return secretToInfo(l, secret)
+}
+
+// DeleteSecret undefines a secret. Disks that authenticate with it fail to
+// open from then on.
+func (c *Connector) DeleteSecret(hostID, secretID string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, secret, err := c.lookupSecret(hostID, secretID)
+	if err != nil {
+		return err
+	}
+	if err := l.SecretUndefine(secret); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to delete secret %s: %w", secretID, err)
+	}
+	return nil
+}
+
+func (c *Connector) lookupSecret(hostID, secretID string) (*libvirt.Libvirt, libvirt.Secret, error) {
+	parsed, err := uuid.Parse(secretID)
+	if err != nil {
+		return nil, libvirt.Secret{}, fmt.Errorf("invalid secret UUID '%s': %w", secretID, err)
+	}
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, libvirt.Secret{}, err
+	}
+	secret, err := l.SecretLookupByUUID(libvirt.UUID(parsed))
+	if err != nil {
+		return nil, libvirt.Secret{}, fmt.Errorf("could not find secret '%s': %w", secretID, err)
+	}
+	return l, secret, nil
+}
+
+func secretToInfo(l *libvirt.Libvirt, secret libvirt.Secret) (*SecretInfo, error) {
+	xmlDesc, err := l.SecretGetXMLDesc(secret, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret XML: %w", err)
+	}
+	var def secretXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse secret XML: %w", err)
+	}
+
+	info := &SecretInfo{
+		UUID:        secretUUID(secret),
+		UsageType:   secretUsageNames[libvirt.SecretUsageType(secret.UsageType)],
+		UsageID:     secret.UsageID,
+		Description: def.Description,
+		Ephemeral:   def.Ephemeral == "yes",
+		Private:     def.Private == "yes",
+	}
+	if info.UsageType == "" {
+		info.UsageType = fmt.Sprintf("unknown (%d)", secret.UsageType)
+	}
+	if !info.Private {
+		// The value is only read to tell whether there is one.
+		value, err := l.SecretGetValue(secret, 0)
+		set := err == nil && len(value) > 0
+		info.ValueSet = &set
+	}
+	return info, nil
+}
+
+func secretDefinitionXML(def SecretDefinition) (string, error) {
+	doc := secretXML{
+		Ephemeral:   yesNo(def.Ephemeral),
+		Private:     yesNo(def.Private),
+		UUID:        def.UUID,
+		Description: def.Description,
+	}
+	if def.UsageType != SecretUsageNone && def.UsageType != "" {
+		doc.Usage = &secretUsageXML{Type: def.UsageType}
+		switch def.UsageType {
+		case SecretUsageVolume:
+			doc.Usage.Volume = def.UsageID
+		case SecretUsageISCSI:
+			doc.Usage.Target = def.UsageID
+		case SecretUsageCeph, SecretUsageTLS, SecretUsageVTPM:
+			doc.Usage.Name = def.UsageID
+		default:
+			return "", fmt.Errorf("unknown secret usage type '%s'", def.UsageType)
+		}
+	}
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to build secret XML: %w", err)
+	}
+	return string(out), nil
+}
+
+func secretUUID(secret libvirt.Secret) string {
+	if parsed, err := uuid.FromBytes(secret.UUID[:]); err == nil {
+		return parsed.String()
+	}
+	return fmt.Sprintf("%x", secret.UUID)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
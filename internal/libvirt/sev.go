@@ -0,0 +1,298 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrSEVUnsupported is returned when launch security is enabled on a host
+// without AMD SEV.
+var ErrSEVUnsupported = errors.New("host does not support AMD SEV")
+
+// SEVPolicyES is the guest policy bit that asks for SEV-ES, which also
+// encrypts the guest's CPU register state.
+const SEVPolicyES = 0x04
+
+// SEVCapability is the AMD SEV support of a host, from its domain
+// capabilities and the SEV firmware.
+type SEVCapability struct {
+	Supported       bool `json:"supported"`
+	ES              bool `json:"es"` // SEV-ES guests can be started
+	CBitPos         uint `json:"cbitpos"`
+	ReducedPhysBits uint `json:"reduced_phys_bits"`
+	MaxGuests       uint `json:"max_guests"`    // Encryption keys for SEV guests; 0 if unknown
+	MaxESGuests     uint `json:"max_es_guests"` // Encryption keys for SEV-ES guests; 0 if unknown
+	// Platform Diffie-Hellman key and certificate chain, base64 encoded, for
+	// a guest owner to build a launch session for this host.
+	PDH       string `json:"pdh,omitempty"`
+	CertChain string `json:"cert_chain,omitempty"`
+	CPU0ID    string `json:"cpu0_id,omitempty"` // Identifies the chip to AMD's key server
+}
+
+// LaunchSecurity is the SEV configuration of a domain.
+type LaunchSecurity struct {
+	Policy          uint32 `json:"policy"`
+	CBitPos         uint   `json:"cbitpos"`
+	ReducedPhysBits uint   `json:"reduced_phys_bits"`
+	// Guest owner's Diffie-Hellman key and launch session blob, base64
+	// encoded; empty for a launch without an owner-provided session.
+	DHCert  string `json:"dh_cert,omitempty"`
+	Session string `json:"session,omitempty"`
+}
+
+// LaunchSecurityInfo is what a running SEV guest reports for attestation.
+type LaunchSecurityInfo struct {
+	Measurement string `json:"measurement"` // Base64 launch measurement
+	APIMajor    uint   `json:"api_major"`
+	APIMinor    uint   `json:"api_minor"`
+	BuildID     uint   `json:"build_id"`
+	Policy      uint32 `json:"policy"`
+}
+
+type domainCapsXML struct {
+	Features struct {
+		SEV struct {
+			Supported       string `xml:"supported,attr"`
+			CBitPos         uint   `xml:"cbitpos"`
+			ReducedPhysBits uint   `xml:"reducedPhysBits"`
+			MaxGuests       uint   `xml:"maxGuests"`
+			MaxESGuests     uint   `xml:"maxESGuests"`
+		} `xml:"sev"`
+	} `xml:"features"`
+}
+
+type launchSecurityXML struct {
+	XMLName         xml.Name `xml:"launchSecurity"`
+	Type            string   `xml:"type,attr"`
+	CBitPos         uint     `xml:"cbitpos,omitempty"`
+	ReducedPhysBits uint     `xml:"reducedPhysBits,omitempty"`
+	Policy          string   `xml:"policy"`
+	DHCert          string   `xml:"dhCert,omitempty"`
+	Session         string   `xml:"session,omitempty"`
+}
+
+type domainLaunchSecurityXML struct {
+	LaunchSecurity *launchSecurityXML `xml:"launchSecurity"`
+}
+
+// launchSecurityElement matches the <launchSecurity> element of a domain
+// definition, in either of its forms.
+var launchSecurityElement = regexp.MustCompile(`(?s)\s*<launchSecurity\b[^>]*?(/>|>.*?</launchSecurity>)`)
+
+// GetSEVCapability reports whether a host can run SEV guests, and the
+// platform certificates a guest owner needs to attest them.
+func (c *Connector) GetSEVCapability(hostID string) (*SEVCapability, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	sev, err := sevCapability(l)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain capabilities of host %s: %w", hostID, err)
+	}
+	if !sev.Supported {
+		return sev, nil
+	}
+
+	_, count, err := l.NodeGetSevInfo(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SEV info of host %s: %w", hostID, err)
+	}
+	params, _, err := l.NodeGetSevInfo(count, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SEV info of host %s: %w", hostID, err)
+	}
+	for _, p := range params {
+		switch p.Field {
+		case "pdh":
+			sev.PDH, _ = p.Value.I.(string)
+		case "cert-chain":
+			sev.CertChain, _ = p.Value.I.(string)
+		case "cpu0-id":
+			sev.CPU0ID, _ = p.Value.I.(string)
+		}
+	}
+	return sev, nil
+}
+
+// sevCapability reads the SEV feature of the host's default emulator.
+func sevCapability(l *libvirt.Libvirt) (*SEVCapability, error) {
+	capsXML, err := l.ConnectGetDomainCapabilities(nil, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var caps domainCapsXML
+	if err := xml.Unmarshal([]byte(capsXML), &caps); err != nil {
+		return nil, fmt.Errorf("failed to parse domain capabilities: %w", err)
+	}
+	feature := caps.Features.SEV
+	return &SEVCapability{
+		Supported:       feature.Supported == "yes",
+		ES:              feature.Supported == "yes" && feature.MaxESGuests > 0,
+		CBitPos:         feature.CBitPos,
+		ReducedPhysBits: feature.ReducedPhysBits,
+		MaxGuests:       feature.MaxGuests,
+		MaxESGuests:     feature.MaxESGuests,
+	}, nil
+}
+
+// GetDomainLaunchSecurity returns the SEV configuration of a domain, or nil
+// if it has none.
+func (c *Connector) GetDomainLaunchSecurity(hostID, vmName string) (*LaunchSecurity, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	var def domainLaunchSecurityXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	ls := def.LaunchSecurity
+	if ls == nil || ls.Type != "sev" {
+		return nil, nil
+	}
+	policy, err := strconv.ParseUint(strings.TrimSpace(ls.Policy), 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SEV policy '%s' in the definition of %s", ls.Policy, vmName)
+	}
+	return &LaunchSecurity{
+		Policy:          uint32(policy),
+		CBitPos:         ls.CBitPos,
+		ReducedPhysBits: ls.ReducedPhysBits,
+		DHCert:          ls.DHCert,
+		Session:         ls.Session,
+	}, nil
+}
+
+// SetDomainLaunchSecurity enables SEV memory encryption on a shut-off
+// domain, or disables it when config is nil. The C-bit position and reduced
+// physical address bits default to the host's. The change takes effect on the
+// next start.
+func (c *Connector) SetDomainLaunchSecurity(hostID, vmName string, config *LaunchSecurity) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	state, _, err := l.DomainGetState(domain, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get domain state for %s: %w", vmName, err)
+	}
+	if libvirt.DomainState(state) != libvirt.DomainShutoff {
+		return fmt.Errorf("cannot change launch security of %s: %w", vmName, ErrDomainActive)
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return fmt.Errorf("failed to get XML for %s: %w", vmName, err)
+	}
+	newXML := launchSecurityElement.ReplaceAllString(xmlDesc, "")
+
+	if config != nil {
+		sev, err := sevCapability(l)
+		if err != nil {
+			return fmt.Errorf("failed to get domain capabilities of host %s: %w", hostID, err)
+		}
+		if !sev.Supported {
+			return fmt.Errorf("cannot enable SEV on %s: %w", vmName, ErrSEVUnsupported)
+		}
+		if config.Policy&SEVPolicyES != 0 && !sev.ES {
+			return fmt.Errorf("cannot enable SEV-ES on %s: %w", vmName, ErrSEVUnsupported)
+		}
+		element := launchSecurityXML{
+			Type:            "sev",
+			CBitPos:         config.CBitPos,
+			ReducedPhysBits: config.ReducedPhysBits,
+			Policy:          fmt.Sprintf("0x%04x", config.Policy),
+			DHCert:          config.DHCert,
+			Session:         config.Session,
+		}
+		if element.CBitPos == 0 {
+			element.CBitPos = sev.CBitPos
+		}
+		if element.ReducedPhysBits == 0 {
+			element.ReducedPhysBits = sev.ReducedPhysBits
+		}
+		out, err := xml.MarshalIndent(element, "  ", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to build launch security XML: %w", err)
+		}
+		end := strings.LastIndex(newXML, "</domain>")
+		if end < 0 {
+			return fmt.Errorf("failed to parse domain XML of %s", vmName)
+		}
+		newXML = newXML[:end] + "  " + string(out) + "\n" + newXML[end:]
+	}
+
+	defer c.invalidateDomain(hostID, domain)
+	if _, err := l.DomainDefineXML(newXML); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to redefine %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// GetDomainLaunchSecurityInfo returns the launch measurement and firmware
+// version of a running SEV guest, which a guest owner checks before giving
+// it secrets.
+func (c *Connector) GetDomainLaunchSecurityInfo(hostID, vmName string) (*LaunchSecurityInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	active, err := l.DomainIsActive(domain)
+	if err != nil {
+		return nil, fmt.Errorf("could not get state for domain %s: %w", vmName, err)
+	}
+	if active != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrDomainNotRunning, vmName)
+	}
+	params, err := l.DomainGetLaunchSecurityInfo(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get launch security info of %s: %w", vmName, err)
+	}
+
+	values := make(map[string]interface{}, len(params))
+	for _, p := range params {
+		values[p.Field] = p.Value.I
+	}
+	info := &LaunchSecurityInfo{
+		APIMajor: uint(paramUint(values, "sev-api-major")),
+		APIMinor: uint(paramUint(values, "sev-api-minor")),
+		BuildID:  uint(paramUint(values, "sev-build-id")),
+		Policy:   uint32(paramUint(values, "sev-policy")),
+	}
+	info.Measurement, _ = values["sev-measurement"].(string)
+	return info, nil
+}
@@ -0,0 +1,352 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Where the memory of a running VM is saved by a snapshot.
+const (
+	SnapshotMemoryInternal = "internal" // inside the qcow2 disk images
+	SnapshotMemoryExternal = "external" // in a separate state file, with the disks switched to overlays
+	SnapshotMemoryNone     = "no"       // disk-only snapshot of a shut-off VM
+)
+
+var (
+	// ErrSnapshotNotFound is returned when a VM has no snapshot with the
+	// requested name.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrSnapshotUnsupported is returned when a VM's disks cannot hold the
+	// requested kind of snapshot.
+	ErrSnapshotUnsupported = errors.New("snapshot not supported for this VM")
+)
+
+// SnapshotInfo describes a snapshot of a VM as libvirt knows it.
+type SnapshotInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Parent      string    `json:"parent,omitempty"`
+	State       string    `json:"state"`  // Domain state when taken, e.g. 'running' or 'shutoff'
+	Memory      string    `json:"memory"` // One of the SnapshotMemory* constants
+	MemoryFile  string    `json:"memory_file,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Current     bool      `json:"current"`
+}
+
+// SnapshotDisk is a disk of a VM as seen by a snapshot.
+type SnapshotDisk struct {
+	Target string `json:"target"`
+	Type   string `json:"type"`   // 'file', 'block', 'network' or 'volume'
+	Format string `json:"format"` // Driver format, e.g. 'qcow2', 'raw'
+	Path   string `json:"path,omitempty"`
+}
+
+// SnapshotSource is what a snapshot of a VM would capture: its writable
+// disks and, while it runs, its memory.
+type SnapshotSource struct {
+	Running     bool           `json:"running"`
+	MemoryBytes uint64         `json:"memory_bytes"` // Memory currently assigned to the guest
+	Disks       []SnapshotDisk `json:"disks"`
+	// StateDir is the directory of the first writable disk, where an
+	// external memory state is written, and FreeBytes the free space of its
+	// pool; zero when the disk is outside any pool.
+	StateDir  string `json:"state_dir,omitempty"`
+	FreeBytes uint64 `json:"free_bytes,omitempty"`
+}
+
+// SnapshotSpec describes a snapshot to take.
+type SnapshotSpec struct {
+	Name        string
+	Description string
+	Memory      string // SnapshotMemoryInternal or SnapshotMemoryExternal; ignored for shut-off VMs
+}
+
+// snapshotDiskXML is used for unmarshalling the disks a snapshot may cover.
+type snapshotDiskXML struct {
+	chainDiskXML
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	ReadOnly *struct{} `xml:"readonly"`
+}
+
+// snapshotXML is used for unmarshalling a snapshot definition.
+type snapshotXML struct {
+	Name         string `xml:"name"`
+	Description  string `xml:"description"`
+	State        string `xml:"state"`
+	CreationTime int64  `xml:"creationTime"`
+	Parent       struct {
+		Name string `xml:"name"`
+	} `xml:"parent"`
+	Memory struct {
+		Snapshot string `xml:"snapshot,attr"`
+		File     string `xml:"file,attr"`
+	} `xml:"memory"`
+}
+
+// GetSnapshotSource returns the disks and memory a snapshot of a VM would
+// capture.
+func (c *Connector) GetSnapshotSource(hostID, vmName string) (*SnapshotSource, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotSource(l, domain)
+}
+
+func snapshotSource(l *libvirt.Libvirt, domain libvirt.Domain) (*SnapshotSource, error) {
+	state, _, memory, _, _, err := l.DomainGetInfo(domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain info for %s: %w", domain.Name, err)
+	}
+	xmlDesc, err := l.DomainGetXMLDesc(domain, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get XML for %s: %w", domain.Name, err)
+	}
+	var def struct {
+		Disks []snapshotDiskXML `xml:"devices>disk"`
+	}
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	source := &SnapshotSource{Running: libvirt.DomainState(state) == libvirt.DomainRunning, Disks: []SnapshotDisk{}}
+	if source.Running {
+		source.MemoryBytes = memory * 1024
+	}
+	// libvirt leaves read-only disks and CD-ROMs out of snapshots.
+	for i := range def.Disks {
+		disk := &def.Disks[i]
+		if disk.Device == "cdrom" || disk.Device == "floppy" || disk.ReadOnly != nil {
+			continue
+		}
+		sd := SnapshotDisk{Target: disk.Target.Dev, Type: disk.Type, Format: disk.Driver.Type}
+		if disk.Type != "network" {
+			if sd.Path, err = diskSourcePath(l, &disk.chainDiskXML); err != nil {
+				return nil, err
+			}
+		}
+		source.Disks = append(source.Disks, sd)
+	}
+
+	for _, disk := range source.Disks {
+		if disk.Path == "" {
+			continue
+		}
+		source.StateDir = path.Dir(disk.Path)
+		if vol, err := l.StorageVolLookupByPath(disk.Path); err == nil {
+			if pool, err := l.StoragePoolLookupByVolume(vol); err == nil {
+				if _, _, _, available, err := l.StoragePoolGetInfo(pool); err == nil {
+					source.FreeBytes = available
+				}
+			}
+		}
+		break
+	}
+	return source, nil
+}
+
+// CheckSnapshotSupport lists why a snapshot with the given memory mode
+// cannot be taken of a VM, or nothing when it can. Internal snapshots live
+// inside the disk images, so every disk must be qcow2; external ones turn
+// each disk into a qcow2 overlay, which needs file-backed disks. Raw disks
+// are refused in both modes; convert them to qcow2 first.
+func CheckSnapshotSupport(source *SnapshotSource, memory string) []string {
+	var blockers []string
+	if !source.Running && memory == SnapshotMemoryExternal {
+		blockers = append(blockers, "external snapshots are only taken of running VMs")
+	}
+	for _, disk := range source.Disks {
+		switch {
+		case disk.Format == "raw":
+			blockers = append(blockers, fmt.Sprintf("disk %s is raw; snapshots need qcow2 disks", disk.Target))
+		case memory == SnapshotMemoryExternal && disk.Type != "file":
+			blockers = append(blockers, fmt.Sprintf("disk %s is not a file (%s); external snapshots need file-backed disks", disk.Target, disk.Type))
+		case memory != SnapshotMemoryExternal && disk.Format != "qcow2":
+			blockers = append(blockers, fmt.Sprintf("disk %s is %s; internal snapshots need qcow2 disks", disk.Target, valueOrUnknown(disk.Format)))
+		}
+	}
+	return blockers
+}
+
+func valueOrUnknown(s string) string {
+	if s == "" {
+		return "of unknown format"
+	}
+	return s
+}
+
+// ListSnapshots returns the snapshots of a VM, oldest first.
+func (c *Connector) ListSnapshots(hostID, vmName string) ([]SnapshotInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	snaps, _, err := l.DomainListAllSnapshots(domain, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of %s: %w", vmName, err)
+	}
+
+	infos := make([]SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		xmlDesc, err := l.DomainSnapshotGetXMLDesc(snap, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get XML of snapshot %s: %w", snap.Name, err)
+		}
+		var def snapshotXML
+		if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+			return nil, fmt.Errorf("failed to parse XML of snapshot %s: %w", snap.Name, err)
+		}
+		current, err := l.DomainSnapshotIsCurrent(snap, 0)
+		if err != nil {
+			current = 0
+		}
+		infos = append(infos, SnapshotInfo{
+			Name:        def.Name,
+			Description: def.Description,
+			Parent:      def.Parent.Name,
+			State:       def.State,
+			Memory:      def.Memory.Snapshot,
+			MemoryFile:  def.Memory.File,
+			CreatedAt:   time.Unix(def.CreationTime, 0),
+			Current:     current == 1,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos, nil
+}
+
+// CreateSnapshot takes a snapshot of a VM. A running VM's memory is saved
+// with it: internally, pausing the guest until the state is written, or to a
+// state file next to its first disk while the guest keeps running.
+func (c *Connector) CreateSnapshot(hostID, vmName string, spec SnapshotSpec) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	source, err := snapshotSource(l, domain)
+	if err != nil {
+		return err
+	}
+	memory := spec.Memory
+	if !source.Running {
+		memory = SnapshotMemoryNone
+	}
+	if blockers := CheckSnapshotSupport(source, memory); len(blockers) > 0 {
+		return fmt.Errorf("%w: %s", ErrSnapshotUnsupported, strings.Join(blockers, "; "))
+	}
+
+	var b strings.Builder
+	b.WriteString("<domainsnapshot><name>" + libvirtAttrEscaper.Replace(spec.Name) + "</name>")
+	if spec.Description != "" {
+		b.WriteString("<description>" + libvirtAttrEscaper.Replace(spec.Description) + "</description>")
+	}
+	flags := libvirt.DomainSnapshotCreateAtomic
+	switch memory {
+	case SnapshotMemoryExternal:
+		stateFile := path.Join(source.StateDir, fmt.Sprintf("%s.%s.mem", vmName, spec.Name))
+		fmt.Fprintf(&b, "<memory snapshot='external' file='%s'/><disks>", libvirtAttrEscaper.Replace(stateFile))
+		for _, disk := range source.Disks {
+			// libvirt names each overlay after its image and the snapshot.
+			fmt.Fprintf(&b, "<disk name='%s' snapshot='external'/>", libvirtAttrEscaper.Replace(disk.Target))
+		}
+		b.WriteString("</disks>")
+		flags |= libvirt.DomainSnapshotCreateLive
+	case SnapshotMemoryInternal:
+		b.WriteString("<memory snapshot='internal'/>")
+	}
+	b.WriteString("</domainsnapshot>")
+
+	if _, err := l.DomainSnapshotCreateXML(domain, b.String(), uint32(flags)); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", vmName, err)
+	}
+	return nil
+}
+
+// lookupSnapshot finds a snapshot of a domain by name.
+func lookupSnapshot(l *libvirt.Libvirt, domain libvirt.Domain, name string) (libvirt.DomainSnapshot, error) {
+	snaps, _, err := l.DomainListAllSnapshots(domain, 1, 0)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, fmt.Errorf("failed to list snapshots of %s: %w", domain.Name, err)
+	}
+	for _, snap := range snaps {
+		if snap.Name == name {
+			return snap, nil
+		}
+	}
+	return libvirt.DomainSnapshot{}, fmt.Errorf("%w: %s has no snapshot '%s'", ErrSnapshotNotFound, domain.Name, name)
+}
+
+// RevertSnapshot puts a VM back to a snapshot. A snapshot with memory brings
+// the VM back running exactly where it was; one without leaves it shut off.
+func (c *Connector) RevertSnapshot(hostID, vmName, name string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	snap, err := lookupSnapshot(l, domain, name)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainRevertToSnapshot(snap, 0); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to revert %s to snapshot %s: %w", vmName, name, err)
+	}
+	c.invalidateDomain(hostID, domain)
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot of a VM. Its children are kept and
+// become children of its parent.
+func (c *Connector) DeleteSnapshot(hostID, vmName, name string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	snap, err := lookupSnapshot(l, domain, name)
+	if err != nil {
+		return err
+	}
+	if err := l.DomainSnapshotDelete(snap, 0); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to delete snapshot %s of %s: %w", name, vmName, err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Storage backends reported for pools. Most match libvirt's pool type; LVM
+// volume groups that contain thin pools are reported separately.
+const (
+	BackendDir        = "dir"
+	BackendLVM        = "logical"
+	BackendLVMThin    = "lvm-thin"
+	BackendZFS        = "zfs"         // libvirt zfs pool of zvols
+	BackendZFSDataset = "zfs-dataset" // directory pool stored on a ZFS dataset
+)
+
+// ThinPoolInfo holds the usage of an LVM thin pool within a volume group.
+type ThinPoolInfo struct {
+	Name          string `json:"name"`
+	SizeBytes     uint64 `json:"size_bytes"`      // Physical data space of the thin pool
+	DataUsedBytes uint64 `json:"data_used_bytes"` // Physical data space in use
+	VirtualBytes  uint64 `json:"virtual_bytes"`   // Sum of the sizes of the thin volumes in it
+}
+
+// ZFSDatasetInfo holds the space accounting of the ZFS dataset backing a
+// directory pool.
+type ZFSDatasetInfo struct {
+	Name             string  `json:"name"`
+	UsedBytes        uint64  `json:"used_bytes"`         // Physical space used, after compression
+	AvailableBytes   uint64  `json:"available_bytes"`    // Space left, honouring quotas
+	LogicalUsedBytes uint64  `json:"logical_used_bytes"` // Space used before compression
+	CompressRatio    float64 `json:"compress_ratio"`
+}
+
+// addThinProvisioning fills in the virtual allocation of a pool and, for LVM
+// pools, the thin pools in its volume group, or for directory pools, the ZFS
+// dataset they live on. These details are read over SSH and are left out for
+// hosts without an SSH channel.
+func (c *Connector) addThinProvisioning(l *libvirt.Libvirt, hostID string, pool libvirt.StoragePool, info *StoragePoolInfo, sourceName string) {
+	info.Backend = info.Type
+	if !info.Active {
+		return
+	}
+
+	vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		log.Printf("Warning: could not list volumes of pool %s on host %s: %v", info.Name, hostID, err)
+		return
+	}
+	for _, vol := range vols {
+		if _, capacity, _, err := l.StorageVolGetInfo(vol); err == nil {
+			info.VirtualAllocationBytes += capacity
+		}
+	}
+
+	switch {
+	case info.Type == BackendLVM && sourceName != "":
+		thinPools, err := c.lvmThinPools(hostID, sourceName)
+		if err != nil {
+			if !errors.Is(err, ErrNoSSHChannel) {
+				log.Printf("Warning: could not read LVM thin pools of %s on host %s: %v", sourceName, hostID, err)
+			}
+			return
+		}
+		if len(thinPools) > 0 {
+			info.Backend = BackendLVMThin
+			info.ThinPools = thinPools
+		}
+	case info.Type == BackendDir && info.Path != "":
+		dataset, err := c.zfsDatasetFor(hostID, info.Path)
+		if err != nil {
+			if !errors.Is(err, ErrNoSSHChannel) {
+				log.Printf("Warning: could not inspect filesystem of pool %s on host %s: %v", info.Name, hostID, err)
+			}
+			return
+		}
+		if dataset != nil {
+			info.Backend = BackendZFSDataset
+			info.Dataset = dataset
+		}
+	}
+}
+
+// zfsDatasetFor returns the ZFS dataset a path is stored on, or nil if the
+// path is on another filesystem.
+func (c *Connector) zfsDatasetFor(hostID, path string) (*ZFSDatasetInfo, error) {
+	output, err := c.RunHostCommand(hostID, "findmnt -n -o FSTYPE,SOURCE --target "+ShellQuote(path))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(output)
+	if len(fields) != 2 || fields[0] != "zfs" {
+		return nil, nil
+	}
+
+	dataset := &ZFSDatasetInfo{Name: fields[1]}
+	output, err = c.RunHostCommand(hostID, "zfs get -Hp -o value used,available,logicalused,compressratio "+ShellQuote(dataset.Name))
+	if err != nil {
+		return nil, err
+	}
+	values := strings.Fields(output)
+	if len(values) != 4 {
+		return nil, fmt.Errorf("unexpected zfs get output: %q", output)
+	}
+	dataset.UsedBytes, _ = strconv.ParseUint(values[0], 10, 64)
+	dataset.AvailableBytes, _ = strconv.ParseUint(values[1], 10, 64)
+	dataset.LogicalUsedBytes, _ = strconv.ParseUint(values[2], 10, 64)
+	dataset.CompressRatio, _ = strconv.ParseFloat(strings.TrimSuffix(values[3], "x"), 64)
+	return dataset, nil
+}
+
+// lvmThinPools lists the thin pools of a volume group along with the total
+// size of the thin volumes provisioned from each.
+func (c *Connector) lvmThinPools(hostID, vgName string) ([]ThinPoolInfo, error) {
+	output, err := c.RunHostCommand(hostID, "lvs --noheadings --nosuffix --units b --separator '|' -o lv_name,lv_attr,lv_size,data_percent,pool_lv "+ShellQuote(vgName))
+	if err != nil {
+		return nil, err
+	}
+	return parseLVMThinPools(output)
+}
+
+func parseLVMThinPools(output string) ([]ThinPoolInfo, error) {
+	var pools []ThinPoolInfo
+	index := make(map[string]int)
+	virtual := make(map[string]uint64)
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), "|")
+		if len(fields) != 5 || fields[1] == "" {
+			continue
+		}
+		name, attr, poolLV := fields[0], fields[1], fields[4]
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected size %q for LV %s", fields[2], name)
+		}
+
+		switch attr[0] {
+		case 't': // thin pool
+			percent, _ := strconv.ParseFloat(strings.Replace(fields[3], ",", ".", 1), 64)
+			index[name] = len(pools)
+			pools = append(pools, ThinPoolInfo{
+				Name:          name,
+				SizeBytes:     size,
+				DataUsedBytes: uint64(float64(size) * percent / 100),
+			})
+		case 'V': // thin volume
+			virtual[poolLV] += size
+		}
+	}
+
+	for name, bytes := range virtual {
+		if i, ok := index[name]; ok {
+			pools[i].VirtualBytes = bytes
+		}
+	}
+	return pools, nil
+}
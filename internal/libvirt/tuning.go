@@ -0,0 +1,59 @@
+package libvirt
+
+import (
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainTuning is the relative share of host CPU time and disk bandwidth a
+// domain gets when it competes with the other domains of its host. 0 means
+// the hypervisor's default.
+type DomainTuning struct {
+	CPUShares   uint64 `json:"cpu_shares"`   // <cputune><shares>
+	BlkioWeight uint   `json:"blkio_weight"` // <blkiotune><weight>
+}
+
+// DomainTuningUpdate changes the fields of a DomainTuning that are set.
+type DomainTuningUpdate struct {
+	CPUShares   *uint64
+	BlkioWeight *uint
+}
+
+// SetDomainTuning applies CPU shares and block I/O weight to a domain. A
+// running domain gets them at once; a persistent one also keeps them in its
+// definition, so they survive a restart.
+func (c *Connector) SetDomainTuning(hostID, vmName string, update DomainTuningUpdate) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, domain, err := c.getDomainByName(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	var flags libvirt.DomainModificationImpact
+	if active, err := l.DomainIsActive(domain); err == nil && active == 1 {
+		flags |= libvirt.DomainAffectLive
+	}
+	if persistent, err := l.DomainIsPersistent(domain); err == nil && persistent == 1 {
+		flags |= libvirt.DomainAffectConfig
+	}
+	defer c.invalidateDomain(hostID, domain)
+
+	if update.CPUShares != nil {
+		params := []libvirt.TypedParam{{Field: "cpu_shares", Value: *libvirt.NewTypedParamValueUllong(*update.CPUShares)}}
+		if err := l.DomainSetSchedulerParametersFlags(domain, params, uint32(flags)); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to set CPU shares of %s: %w", vmName, err)
+		}
+	}
+	if update.BlkioWeight != nil {
+		params := []libvirt.TypedParam{{Field: "weight", Value: *libvirt.NewTypedParamValueUint(uint32(*update.BlkioWeight))}}
+		if err := l.DomainSetBlkioParameters(domain, params, uint32(flags)); c.reportRPC(hostID, err) != nil {
+			return fmt.Errorf("failed to set block I/O weight of %s: %w", vmName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package libvirt
+
+import (
+	"net"
+
+	"github.com/capsali/virtumancer-flash/internal/agent"
+)
+
+// RegisterAgent makes a host's reverse tunnel available for dialling.
+func (c *Connector) RegisterAgent(hostID string, session *agent.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.agents[hostID]; ok && old != session {
+		old.Close()
+	}
+	c.agents[hostID] = session
+}
+
+// UnregisterAgent forgets a host's reverse tunnel if it is still the current one.
+func (c *Connector) UnregisterAgent(hostID string, session *agent.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.agents[hostID] == session {
+		delete(c.agents, hostID)
+	}
+}
+
+// IsTunneled reports whether a host is reached through an agent tunnel. For
+// such hosts, loopback addresses are relative to the hypervisor itself.
+func (c *Connector) IsTunneled(hostID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.agents[hostID]
+	return ok
+}
+
+// DialHostTCP opens a TCP connection to an address on or near a host, such as
+// a VNC or SPICE listener, going through the agent tunnel when there is one.
+func (c *Connector) DialHostTCP(hostID, address string) (net.Conn, error) {
+	c.mu.RLock()
+	session, ok := c.agents[hostID]
+	c.mu.RUnlock()
+	if ok {
+		return session.Open(agent.TargetTCPPrefix + address)
+	}
+	return net.Dial("tcp", address)
+}
@@ -0,0 +1,100 @@
+package libvirt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Hypervisor drivers understood by Virtumancer.
+const (
+	DriverQEMU  = "qemu"
+	DriverLXC   = "lxc"
+	DriverXen   = "xen"
+	DriverBhyve = "bhyve"
+	DriverTest  = "test"
+)
+
+// Transports used to reach the libvirt daemon.
+const (
+	TransportUnix = "unix"
+	TransportSSH  = "ssh"
+	TransportTCP  = "tcp"
+	// TransportAgent reaches hosts through a reverse tunnel opened by the
+	// Virtumancer agent running on them, e.g. qemu+agent://<host-id>/system.
+	TransportAgent = "agent"
+)
+
+var supportedDrivers = map[string]bool{
+	DriverQEMU:  true,
+	DriverLXC:   true,
+	DriverXen:   true,
+	DriverBhyve: true,
+	DriverTest:  true,
+}
+
+const defaultSocketPath = "/var/run/libvirt/libvirt-sock"
+
+// HostURI is a parsed libvirt connection URI of the form
+// driver[+transport]://[user@][host][:port]/path[?socket=...].
+type HostURI struct {
+	Driver    string
+	Transport string
+	URL       *url.URL
+}
+
+// ParseHostURI splits a libvirt URI into its driver and transport parts.
+func ParseHostURI(uri string) (*HostURI, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URI: %w", err)
+	}
+
+	driver, transport, _ := strings.Cut(parsed.Scheme, "+")
+	if !supportedDrivers[driver] {
+		return nil, fmt.Errorf("unsupported hypervisor driver: %q", driver)
+	}
+
+	if transport == "" {
+		// libvirt defaults to TLS for remote URIs without an explicit transport.
+		if parsed.Host != "" {
+			return nil, fmt.Errorf("TLS transport is not supported; use %s+ssh or %s+tcp", driver, driver)
+		}
+		transport = TransportUnix
+	}
+
+	switch transport {
+	case TransportUnix, TransportSSH, TransportTCP, TransportAgent:
+	default:
+		return nil, fmt.Errorf("unsupported transport: %q", transport)
+	}
+
+	return &HostURI{Driver: driver, Transport: transport, URL: parsed}, nil
+}
+
+// SocketPath returns the libvirt daemon socket to dial, honouring the
+// socket query parameter.
+func (u *HostURI) SocketPath() string {
+	if socket := u.URL.Query().Get("socket"); socket != "" {
+		return socket
+	}
+	return defaultSocketPath
+}
+
+// RemoteURI is the URI handed to the daemon once the socket is established.
+// All connections are local from libvirtd's point of view, so only the
+// driver and path are kept (e.g. qemu+ssh://host/system -> qemu:///system).
+func (u *HostURI) RemoteURI() string {
+	path := u.URL.Path
+	if path == "" || path == "/" {
+		switch u.Driver {
+		case DriverTest:
+			path = "/default"
+		case DriverXen:
+			path = "/"
+		default:
+			path = "/system"
+		}
+	}
+	return (&url.URL{Scheme: u.Driver, Path: path}).String()
+}
@@ -0,0 +1,153 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/google/uuid"
+)
+
+// VirtualNetworkInfo is a network defined in libvirt, such as the 'default'
+// NAT network, as opposed to a plain bridge.
+type VirtualNetworkInfo struct {
+	Name       string `json:"name"`
+	UUID       string `json:"uuid"`
+	Bridge     string `json:"bridge"`
+	Forward    string `json:"forward"` // Forward mode, e.g. 'nat', 'route' or 'bridge'; empty for isolated networks
+	Active     bool   `json:"active"`
+	Autostart  bool   `json:"autostart"`
+	Persistent bool   `json:"persistent"`
+}
+
+// virtualNetworkXML is the part of a network definition we track.
+type virtualNetworkXML struct {
+	Bridge struct {
+		Name string `xml:"name,attr"`
+	} `xml:"bridge"`
+	Forward struct {
+		Mode string `xml:"mode,attr"`
+	} `xml:"forward"`
+}
+
+// ListVirtualNetworks returns the libvirt networks of a host.
+func (c *Connector) ListVirtualNetworks(hostID string) ([]VirtualNetworkInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	networks, _, err := l.ConnectListAllNetworks(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+
+	infos := []VirtualNetworkInfo{}
+	for _, network := range networks {
+		info, err := virtualNetworkToInfo(l, network)
+		if err != nil {
+			log.Printf("Warning: could not get info for network %s on host %s: %v", network.Name, hostID, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+func virtualNetworkToInfo(l *libvirt.Libvirt, network libvirt.Network) (*VirtualNetworkInfo, error) {
+	active, err := l.NetworkIsActive(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network state: %w", err)
+	}
+	autostart, err := l.NetworkGetAutostart(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network autostart: %w", err)
+	}
+	persistent, err := l.NetworkIsPersistent(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network persistence: %w", err)
+	}
+	xmlDesc, err := l.NetworkGetXMLDesc(network, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network XML: %w", err)
+	}
+	var def virtualNetworkXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse network XML: %w", err)
+	}
+
+	uuidStr := fmt.Sprintf("%x", network.UUID)
+	if parsedUUID, err := uuid.FromBytes(network.UUID[:]); err == nil {
+		uuidStr = parsedUUID.String()
+	}
+	return &VirtualNetworkInfo{
+		Name:       network.Name,
+		UUID:       uuidStr,
+		Bridge:     def.Bridge.Name,
+		Forward:    def.Forward.Mode,
+		Active:     active == 1,
+		Autostart:  autostart == 1,
+		Persistent: persistent == 1,
+	}, nil
+}
+
+// SetNetworkAutostart sets whether a libvirt network is started with
+// libvirtd.
+func (c *Connector) SetNetworkAutostart(hostID, name string, autostart bool) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+	network, err := l.NetworkLookupByName(name)
+	if err != nil {
+		return fmt.Errorf("could not find network '%s': %w", name, err)
+	}
+	var flag int32
+	if autostart {
+		flag = 1
+	}
+	if err := l.NetworkSetAutostart(network, flag); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to set autostart of network '%s': %w", name, err)
+	}
+	return nil
+}
+
+// SetNetworkActive starts or stops a libvirt network. Stopping it cuts off
+// the VMs attached to it.
+func (c *Connector) SetNetworkActive(hostID, name string, active bool) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return err
+	}
+	network, err := l.NetworkLookupByName(name)
+	if err != nil {
+		return fmt.Errorf("could not find network '%s': %w", name, err)
+	}
+	if active {
+		err = l.NetworkCreate(network)
+	} else {
+		err = l.NetworkDestroy(network)
+	}
+	if c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to change state of network '%s': %w", name, err)
+	}
+	return nil
+}
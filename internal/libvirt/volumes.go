@@ -0,0 +1,415 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrUnknownWipeAlgorithm is returned for wipe algorithm names libvirt does not support.
+var ErrUnknownWipeAlgorithm = errors.New("unknown wipe algorithm")
+
+// ErrInvalidVolumeSpec is returned when a new volume's parameters are inconsistent.
+var ErrInvalidVolumeSpec = errors.New("invalid volume specification")
+
+// Preallocation modes for new volumes.
+const (
+	PreallocOff      = "off"      // Sparse; space is allocated on write.
+	PreallocMetadata = "metadata" // qcow2 only; metadata is allocated upfront.
+	PreallocFull     = "full"     // All space is allocated upfront (fallocate where supported).
+)
+
+// wipeAlgorithms maps the names used by virsh vol-wipe to libvirt's enum.
+var wipeAlgorithms = map[string]libvirt.StorageVolWipeAlgorithm{
+	"zero":       libvirt.StorageVolWipeAlgZero,
+	"nnsa":       libvirt.StorageVolWipeAlgNnsa,
+	"dod":        libvirt.StorageVolWipeAlgDod,
+	"bsi":        libvirt.StorageVolWipeAlgBsi,
+	"gutmann":    libvirt.StorageVolWipeAlgGutmann,
+	"schneier":   libvirt.StorageVolWipeAlgSchneier,
+	"pfitzner7":  libvirt.StorageVolWipeAlgPfitzner7,
+	"pfitzner33": libvirt.StorageVolWipeAlgPfitzner33,
+	"random":     libvirt.StorageVolWipeAlgRandom,
+	"trim":       libvirt.StorageVolWipeAlgTrim,
+}
+
+// ValidateWipeAlgorithm checks that a wipe algorithm name is supported.
+// An empty name selects zero filling.
+func ValidateWipeAlgorithm(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := wipeAlgorithms[name]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownWipeAlgorithm, name)
+	}
+	return nil
+}
+
+// VolumeInfo holds details about a storage volume.
+type VolumeInfo struct {
+	Name            string `json:"name"`
+	Path            string `json:"path"`
+	Type            string `json:"type"`
+	Format          string `json:"format"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	BackingPath     string `json:"backing_path,omitempty"`
+}
+
+// volumeXML is used for unmarshalling the parts of a volume definition we track.
+type volumeXML struct {
+	Target struct {
+		Path   string `xml:"path"`
+		Format struct {
+			Type string `xml:"type,attr"`
+		} `xml:"format"`
+	} `xml:"target"`
+	BackingStore struct {
+		Path string `xml:"path"`
+	} `xml:"backingStore"`
+}
+
+var volumeTypeNames = map[libvirt.StorageVolType]string{
+	libvirt.StorageVolFile:    "file",
+	libvirt.StorageVolBlock:   "block",
+	libvirt.StorageVolDir:     "dir",
+	libvirt.StorageVolNetwork: "network",
+	libvirt.StorageVolNetdir:  "netdir",
+	libvirt.StorageVolPloop:   "ploop",
+}
+
+// ListVolumes lists the volumes of a storage pool.
+func (c *Connector) ListVolumes(hostID, poolName string) ([]VolumeInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+
+	vols, _, err := l.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes of pool '%s': %w", poolName, err)
+	}
+
+	var infos []VolumeInfo
+	for _, vol := range vols {
+		info, err := volumeToInfo(l, vol)
+		if err != nil {
+			log.Printf("Warning: could not get info for volume %s in pool %s on host %s: %v", vol.Name, poolName, hostID, err)
+			continue
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+func volumeToInfo(l *libvirt.Libvirt, vol libvirt.StorageVol) (*VolumeInfo, error) {
+	volType, capacity, allocation, err := l.StorageVolGetInfo(vol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume info: %w", err)
+	}
+	xmlDesc, err := l.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume XML: %w", err)
+	}
+	var def volumeXML
+	if err := xml.Unmarshal([]byte(xmlDesc), &def); err != nil {
+		return nil, fmt.Errorf("failed to parse volume XML: %w", err)
+	}
+
+	return &VolumeInfo{
+		Name:            vol.Name,
+		Path:            def.Target.Path,
+		Type:            volumeTypeNames[libvirt.StorageVolType(volType)],
+		Format:          def.Target.Format.Type,
+		CapacityBytes:   capacity,
+		AllocationBytes: allocation,
+		BackingPath:     def.BackingStore.Path,
+	}, nil
+}
+
+func (c *Connector) getVolumeByName(hostID, poolName, volName string) (*libvirt.Libvirt, libvirt.StorageVol, error) {
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, libvirt.StorageVol{}, err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, libvirt.StorageVol{}, fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+	vol, err := l.StorageVolLookupByName(pool, volName)
+	if err != nil {
+		return nil, libvirt.StorageVol{}, fmt.Errorf("could not find volume '%s' in pool '%s': %w", volName, poolName, err)
+	}
+	return l, vol, nil
+}
+
+// WipeVolume overwrites a volume's contents using the named algorithm
+// (see ValidateWipeAlgorithm). It blocks until the wipe completes.
+func (c *Connector) WipeVolume(hostID, poolName, volName, algorithm string) error {
+	if err := ValidateWipeAlgorithm(algorithm); err != nil {
+		return err
+	}
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	if err != nil {
+		return err
+	}
+	if algorithm == "" {
+		return c.reportRPC(hostID, l.StorageVolWipe(vol, 0))
+	}
+	return c.reportRPC(hostID, l.StorageVolWipePattern(vol, uint32(wipeAlgorithms[algorithm]), 0))
+}
+
+// DeleteVolume removes a volume from its pool.
+func (c *Connector) DeleteVolume(hostID, poolName, volName string) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	if err != nil {
+		return err
+	}
+	return c.reportRPC(hostID, l.StorageVolDelete(vol, libvirt.StorageVolDeleteNormal))
+}
+
+// VolumeSpec describes a volume to create.
+type VolumeSpec struct {
+	Name             string `json:"name"`
+	Format           string `json:"format"`             // 'qcow2' (default) or 'raw'
+	CapacityBytes    uint64 `json:"capacity_bytes"`     // Virtual size
+	Preallocation    string `json:"preallocation"`      // 'off' (default), 'metadata' or 'full'
+	ClusterSizeBytes uint64 `json:"cluster_size_bytes"` // qcow2 only; 0 keeps qemu's default (64 KiB)
+}
+
+// newVolumeXML is used for marshalling a volume definition.
+type newVolumeXML struct {
+	XMLName    xml.Name `xml:"volume"`
+	Name       string   `xml:"name"`
+	Capacity   xmlSize  `xml:"capacity"`
+	Allocation xmlSize  `xml:"allocation"`
+	Target     struct {
+		Format struct {
+			Type string `xml:"type,attr"`
+		} `xml:"format"`
+		ClusterSize *xmlSize `xml:"clusterSize,omitempty"`
+	} `xml:"target"`
+}
+
+type xmlSize struct {
+	Unit  string `xml:"unit,attr"`
+	Value uint64 `xml:",chardata"`
+}
+
+func (spec *VolumeSpec) normalize() error {
+	if spec.Name == "" {
+		return fmt.Errorf("%w: a name is required", ErrInvalidVolumeSpec)
+	}
+	if spec.CapacityBytes == 0 {
+		return fmt.Errorf("%w: capacity must be greater than zero", ErrInvalidVolumeSpec)
+	}
+	if spec.Format == "" {
+		spec.Format = "qcow2"
+	}
+	if spec.Preallocation == "" {
+		spec.Preallocation = PreallocOff
+	}
+
+	switch spec.Format {
+	case "qcow2":
+		if c := spec.ClusterSizeBytes; c != 0 && (c < 512 || c > 2<<20 || c&(c-1) != 0) {
+			return fmt.Errorf("%w: cluster size must be a power of two between 512 bytes and 2 MiB", ErrInvalidVolumeSpec)
+		}
+	case "raw":
+		if spec.ClusterSizeBytes != 0 {
+			return fmt.Errorf("%w: cluster size only applies to qcow2", ErrInvalidVolumeSpec)
+		}
+		if spec.Preallocation == PreallocMetadata {
+			return fmt.Errorf("%w: metadata preallocation only applies to qcow2", ErrInvalidVolumeSpec)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported format %q", ErrInvalidVolumeSpec, spec.Format)
+	}
+
+	switch spec.Preallocation {
+	case PreallocOff, PreallocMetadata, PreallocFull:
+	default:
+		return fmt.Errorf("%w: unsupported preallocation mode %q", ErrInvalidVolumeSpec, spec.Preallocation)
+	}
+	return nil
+}
+
+// CreateVolume creates a new volume in a pool. Full preallocation of large
+// volumes can take a while, as the call blocks until the space is allocated.
+func (c *Connector) CreateVolume(hostID, poolName string, spec VolumeSpec) (*VolumeInfo, error) {
+	if err := spec.normalize(); err != nil {
+		return nil, err
+	}
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, err := c.GetConnection(hostID)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+
+	def := newVolumeXML{
+		Name:       spec.Name,
+		Capacity:   xmlSize{Unit: "bytes", Value: spec.CapacityBytes},
+		Allocation: xmlSize{Unit: "bytes"},
+	}
+	def.Target.Format.Type = spec.Format
+	var flags libvirt.StorageVolCreateFlags
+	switch spec.Preallocation {
+	case PreallocFull:
+		def.Allocation = xmlSize{Unit: "bytes", Value: spec.CapacityBytes}
+	case PreallocMetadata:
+		flags |= libvirt.StorageVolCreatePreallocMetadata
+	}
+	if spec.ClusterSizeBytes != 0 {
+		def.Target.ClusterSize = &xmlSize{Unit: "bytes", Value: spec.ClusterSizeBytes}
+	}
+
+	volXML, err := xml.Marshal(def)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build volume XML: %w", err)
+	}
+	vol, err := l.StorageVolCreateXML(pool, string(volXML), flags)
+	if c.reportRPC(hostID, err) != nil {
+		return nil, fmt.Errorf("failed to create volume '%s' in pool '%s': %w", spec.Name, poolName, err)
+	}
+	return volumeToInfo(l, vol)
+}
+
+// GetVolume returns details about a single volume.
+func (c *Connector) GetVolume(hostID, poolName, volName string) (*VolumeInfo, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	if err != nil {
+		return nil, err
+	}
+	return volumeToInfo(l, vol)
+}
+
+// GetVolumeImageSize returns the size of the data a download of a volume
+// streams: the length of its image file or device, which for qcow2 differs
+// from the virtual size.
+func (c *Connector) GetVolumeImageSize(hostID, poolName, volName string) (uint64, error) {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	if err != nil {
+		return 0, err
+	}
+	_, _, physical, err := l.StorageVolGetInfoFlags(vol, uint32(libvirt.StorageVolGetPhysical))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of volume '%s': %w", volName, err)
+	}
+	return physical, nil
+}
+
+// DownloadVolume streams length bytes of a volume's image from offset into
+// w; a length of 0 streams up to the end. The stream goes as fast as the
+// client reads it, so it only holds one of the host's operation slots while
+// looking up the volume, not for as long as it runs.
+func (c *Connector) DownloadVolume(hostID, poolName, volName string, offset, length uint64, w io.Writer) error {
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return err
+	}
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	release()
+	if err != nil {
+		return err
+	}
+	if err := l.StorageVolDownload(vol, w, offset, length, 0); c.reportRPC(hostID, err) != nil {
+		return fmt.Errorf("failed to download volume '%s': %w", volName, err)
+	}
+	return nil
+}
+
+// UploadVolume creates a raw volume of size bytes and fills it with the
+// image read from r. The volume is removed again if the upload fails. Images
+// in other formats, such as qcow2, are stored as they are; the pool is
+// refreshed afterwards so libvirt detects their format. Like a download, the
+// stream runs without holding one of the host's operation slots.
+func (c *Connector) UploadVolume(hostID, poolName, volName string, size uint64, r io.Reader) (*VolumeInfo, error) {
+	if _, err := c.CreateVolume(hostID, poolName, VolumeSpec{Name: volName, Format: "raw", CapacityBytes: size}); err != nil {
+		return nil, err
+	}
+	release, err := c.acquireRPC(hostID)
+	if err != nil {
+		return nil, err
+	}
+	l, vol, err := c.getVolumeByName(hostID, poolName, volName)
+	release()
+	if err != nil {
+		return nil, err
+	}
+	uploadErr := c.reportRPC(hostID, l.StorageVolUpload(vol, r, 0, size, 0))
+
+	// Removing a failed upload and refreshing the pool take a slot again
+	if release, err = c.acquireRPC(hostID); err != nil {
+		if uploadErr != nil {
+			log.Printf("Warning: could not remove volume %s/%s after failed upload: %v", poolName, volName, err)
+			return nil, fmt.Errorf("failed to upload volume '%s': %w", volName, uploadErr)
+		}
+		return nil, err
+	}
+	defer release()
+	if uploadErr != nil {
+		if delErr := l.StorageVolDelete(vol, libvirt.StorageVolDeleteNormal); delErr != nil {
+			log.Printf("Warning: failed to remove volume %s/%s after failed upload: %v", poolName, volName, delErr)
+		}
+		return nil, fmt.Errorf("failed to upload volume '%s': %w", volName, uploadErr)
+	}
+
+	pool, err := l.StoragePoolLookupByName(poolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not find storage pool '%s': %w", poolName, err)
+	}
+	if err := l.StoragePoolRefresh(pool, 0); err != nil {
+		log.Printf("Warning: failed to refresh pool %s after uploading %s: %v", poolName, volName, err)
+	}
+	if vol, err = l.StorageVolLookupByName(pool, volName); err != nil {
+		return nil, fmt.Errorf("could not find volume '%s' in pool '%s': %w", volName, poolName, err)
+	}
+	return volumeToInfo(l, vol)
+}
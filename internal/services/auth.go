@@ -0,0 +1,306 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// sessionIdleLifetime is how long a session stays valid without use.
+	sessionIdleLifetime = 24 * time.Hour
+	// sessionTouchPeriod limits how often use of a session is written back.
+	sessionTouchPeriod = time.Minute
+	// MinPasswordLength is the shortest password accepted.
+	MinPasswordLength = 8
+)
+
+var (
+	// ErrInvalidCredentials is returned for an unknown user or a wrong password.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUnauthenticated is returned for a missing, unknown or expired session token.
+	ErrUnauthenticated = errors.New("not logged in")
+	// ErrWeakPassword is returned for a new password that is too short.
+	ErrWeakPassword = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	// ErrAccountDisabled is returned when a disabled user tries to log in.
+	ErrAccountDisabled = errors.New("account is disabled")
+	// ErrAccountLocked is returned when a locked user tries to log in.
+	ErrAccountLocked = errors.New("account is locked")
+	// ErrPasswordChangeRequired is returned for requests of a user who must
+	// change their password first.
+	ErrPasswordChangeRequired = errors.New("password must be changed first")
+)
+
+// UserProfile is what a user sees of their own account.
+type UserProfile struct {
+	ID                 uint       `json:"id"`
+	Username           string     `json:"username"`
+	Role               string     `json:"role"`
+	Permissions        []string   `json:"permissions"`
+	CreatedAt          time.Time  `json:"created_at"`
+	PasswordChangedAt  *time.Time `json:"password_changed_at"`
+	MustChangePassword bool       `json:"must_change_password"` // Set after an admin reset the password
+}
+
+// LoginResult carries the token of a new session. The token is only ever
+// returned here.
+type LoginResult struct {
+	Token     string       `json:"token"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	User      *UserProfile `json:"user"`
+}
+
+// UserSessionView is a session as listed to its user.
+type UserSessionView struct {
+	ID         uint      `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	Current    bool      `json:"current"` // The session making the request
+}
+
+// dummyPasswordHash is compared against for unknown usernames, so that a
+// login takes as long whether the user exists or not.
+const dummyPasswordHash = "$2a$10$UmnuKUm74ZftVt0zpYq1hevQtenEbq9.KaiP8LDoMHSur3G/uHT52"
+
+func hashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrWeakPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Login checks a user's password and opens a session for them. Every
+// attempt is recorded, and wrong passwords count towards the lockout policy.
+func (s *HostService) Login(username, password, ipAddress, userAgent string) (*LoginResult, error) {
+	var user storage.User
+	if err := s.db.Where("username = ?", username).Limit(1).Find(&user).Error; err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		bcrypt.CompareHashAndPassword([]byte(dummyPasswordHash), []byte(password))
+		s.recordLoginAttempt(username, 0, LoginFailedCredentials, ipAddress, userAgent)
+		return nil, ErrInvalidCredentials
+	}
+	// Locked accounts are refused before the password is checked, so guessing
+	// cannot go on during the lockout.
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		s.recordLoginAttempt(username, user.ID, LoginFailedLocked, ipAddress, userAgent)
+		return nil, ErrAccountLocked
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		s.recordLoginAttempt(username, user.ID, LoginFailedCredentials, ipAddress, userAgent)
+		s.registerLoginFailure(&user, ipAddress)
+		return nil, ErrInvalidCredentials
+	}
+	if user.Disabled {
+		s.recordLoginAttempt(username, user.ID, LoginFailedDisabled, ipAddress, userAgent)
+		return nil, ErrAccountDisabled
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now()
+	session := storage.UserSession{
+		UserID:     user.ID,
+		TokenHash:  hashSessionToken(token),
+		IPAddress:  ipAddress,
+		UserAgent:  userAgent,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionIdleLifetime),
+	}
+	if err := s.db.Create(&session).Error; err != nil {
+		return nil, fmt.Errorf("failed to save session: %w", err)
+	}
+	// Clean up the user's sessions that ran out in the meantime.
+	s.db.Unscoped().Where("user_id = ? AND expires_at < ?", user.ID, now).Delete(&storage.UserSession{})
+	s.db.Model(&user).Updates(map[string]interface{}{"last_login_at": now, "failed_logins": 0})
+	s.recordLoginAttempt(username, user.ID, "", ipAddress, userAgent)
+
+	profile, err := s.GetUserProfile(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.recordUserAudit(user.ID, "user.login", "user", user.Username, fmt.Sprintf("ip=%s", ipAddress))
+	return &LoginResult{Token: token, ExpiresAt: session.ExpiresAt, User: profile}, nil
+}
+
+// Logout ends the session of a token.
+func (s *HostService) Logout(token string) error {
+	user, session, err := s.AuthenticateSession(token)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Unscoped().Delete(session).Error; err != nil {
+		return err
+	}
+	s.recordUserAudit(user.ID, "user.logout", "user", user.Username, "")
+	return nil
+}
+
+// AuthenticateSession returns the user and session of a session token and
+// keeps the session alive.
+func (s *HostService) AuthenticateSession(token string) (*storage.User, *storage.UserSession, error) {
+	if token == "" {
+		return nil, nil, ErrUnauthenticated
+	}
+	var session storage.UserSession
+	if err := s.db.Where("token_hash = ?", hashSessionToken(token)).Limit(1).Find(&session).Error; err != nil {
+		return nil, nil, err
+	}
+	if session.ID == 0 {
+		return nil, nil, ErrUnauthenticated
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		s.db.Unscoped().Delete(&session)
+		return nil, nil, ErrUnauthenticated
+	}
+	var user storage.User
+	if err := s.db.First(&user, session.UserID).Error; err != nil || user.Disabled {
+		return nil, nil, ErrUnauthenticated
+	}
+	if now.Sub(session.LastSeenAt) > sessionTouchPeriod {
+		session.LastSeenAt = now
+		session.ExpiresAt = now.Add(sessionIdleLifetime)
+		s.db.Model(&session).Updates(map[string]interface{}{
+			"last_seen_at": session.LastSeenAt,
+			"expires_at":   session.ExpiresAt,
+		})
+	}
+	return &user, &session, nil
+}
+
+// GetUserProfile returns a user's account details and permissions.
+func (s *HostService) GetUserProfile(userID uint) (*UserProfile, error) {
+	var user storage.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, fmt.Errorf("could not find user %d: %w", userID, err)
+	}
+	profile := &UserProfile{
+		ID:                 user.ID,
+		Username:           user.Username,
+		Permissions:        []string{},
+		CreatedAt:          user.CreatedAt,
+		PasswordChangedAt:  user.PasswordChangedAt,
+		MustChangePassword: user.MustChangePassword,
+	}
+	if user.RoleID != 0 {
+		var role storage.Role
+		err := s.db.Preload("Permissions").Where("id = ?", user.RoleID).Limit(1).Find(&role).Error
+		if err != nil {
+			return nil, err
+		}
+		profile.Role = role.Name
+		for _, p := range role.Permissions {
+			profile.Permissions = append(profile.Permissions, p.Action)
+		}
+	}
+	return profile, nil
+}
+
+// ChangePassword sets a new password after checking the current one. The
+// user's other sessions are ended, so a stolen session does not outlive the
+// change. A wrong current password is recorded and counts towards the
+// lockout policy like a failed login, so a session cannot be used to guess
+// the password.
+func (s *HostService) ChangePassword(userID, sessionID uint, currentPassword, newPassword, ipAddress, userAgent string) error {
+	var user storage.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return fmt.Errorf("could not find user %d: %w", userID, err)
+	}
+	if user.LockedUntil != nil && time.Now().Before(*user.LockedUntil) {
+		s.recordLoginAttempt(user.Username, user.ID, LoginFailedLocked, ipAddress, userAgent)
+		return ErrAccountLocked
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(currentPassword)) != nil {
+		s.recordLoginAttempt(user.Username, user.ID, LoginFailedCredentials, ipAddress, userAgent)
+		s.registerLoginFailure(&user, ipAddress)
+		return ErrInvalidCredentials
+	}
+	hash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = s.db.Model(&user).Updates(map[string]interface{}{
+		"password_hash":        hash,
+		"password_changed_at":  now,
+		"must_change_password": false,
+	}).Error
+	if err != nil {
+		return err
+	}
+	revoked, err := s.RevokeOtherUserSessions(userID, sessionID)
+	if err != nil {
+		return err
+	}
+	s.recordUserAudit(userID, "user.password.change", "user", user.Username, fmt.Sprintf("sessions_revoked=%d", revoked))
+	return nil
+}
+
+// ListUserSessions returns a user's sessions that have not expired, most
+// recently used first.
+func (s *HostService) ListUserSessions(userID, currentSessionID uint) ([]UserSessionView, error) {
+	var rows []storage.UserSession
+	if err := s.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Order("last_seen_at desc").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	views := make([]UserSessionView, 0, len(rows))
+	for _, row := range rows {
+		views = append(views, UserSessionView{
+			ID:         row.ID,
+			CreatedAt:  row.CreatedAt,
+			LastSeenAt: row.LastSeenAt,
+			ExpiresAt:  row.ExpiresAt,
+			IPAddress:  row.IPAddress,
+			UserAgent:  row.UserAgent,
+			Current:    row.ID == currentSessionID,
+		})
+	}
+	return views, nil
+}
+
+// RevokeUserSession ends one of a user's sessions.
+func (s *HostService) RevokeUserSession(userID, sessionID uint) error {
+	result := s.db.Unscoped().Where("id = ? AND user_id = ?", sessionID, userID).Delete(&storage.UserSession{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find session %d: %w", sessionID, gorm.ErrRecordNotFound)
+	}
+	s.recordUserAudit(userID, "user.session.revoke", "user", fmt.Sprint(userID), fmt.Sprintf("session=%d", sessionID))
+	return nil
+}
+
+// RevokeOtherUserSessions ends all of a user's sessions except one and
+// returns how many were ended.
+func (s *HostService) RevokeOtherUserSessions(userID, keepSessionID uint) (int64, error) {
+	result := s.db.Unscoped().Where("user_id = ? AND id <> ?", userID, keepSessionID).Delete(&storage.UserSession{})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	return result.RowsAffected, nil
+}
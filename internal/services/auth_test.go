@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+const testPassword = "correct horse"
+
+// newTestService returns a host service on a fresh database with the default
+// roles and no hosts.
+func newTestService(t *testing.T) *HostService {
+	t.Helper()
+	db, err := storage.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	hub := ws.NewHub()
+	go hub.Run()
+	t.Cleanup(hub.Close)
+	s := NewHostService(db, libvirt.NewConnector(), hub)
+	for name, actions := range defaultRoles {
+		role := storage.Role{Name: name}
+		if err := db.Create(&role).Error; err != nil {
+			t.Fatalf("creating role %s: %v", name, err)
+		}
+		for _, action := range actions {
+			var perm storage.Permission
+			if err := db.Where("action = ?", action).FirstOrCreate(&perm, storage.Permission{Action: action}).Error; err != nil {
+				t.Fatalf("creating permission %s: %v", action, err)
+			}
+			if err := db.Model(&role).Association("Permissions").Append(&perm); err != nil {
+				t.Fatalf("granting %s: %v", action, err)
+			}
+		}
+	}
+	return s
+}
+
+// createTestUser adds a user with testPassword and returns its ID.
+func createTestUser(t *testing.T, s *HostService, username, role string) uint {
+	t.Helper()
+	view, err := s.CreateUser(0, UserRequest{Username: username, Password: testPassword, Role: role})
+	if err != nil {
+		t.Fatalf("CreateUser(%s): %v", username, err)
+	}
+	return view.ID
+}
+
+func loadUser(t *testing.T, s *HostService, id uint) storage.User {
+	t.Helper()
+	var user storage.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		t.Fatalf("loading user %d: %v", id, err)
+	}
+	return user
+}
+
+func countLoginAttempts(t *testing.T, s *HostService, username, reason string) int64 {
+	t.Helper()
+	var count int64
+	if err := s.db.Model(&storage.LoginAttempt{}).Where("username = ? AND reason = ?", username, reason).Count(&count).Error; err != nil {
+		t.Fatalf("counting login attempts: %v", err)
+	}
+	return count
+}
+
+func TestLoginLockout(t *testing.T) {
+	tests := []struct {
+		name        string
+		threshold   uint
+		passwords   []string // Tried in order
+		wantErrs    []error
+		wantLocked  bool
+		wantFailed  uint
+		wantRecords map[string]int64 // Login attempts by reason, "" for successes
+	}{
+		{
+			name:        "success resets the count",
+			threshold:   3,
+			passwords:   []string{"wrong", "wrong", testPassword},
+			wantErrs:    []error{ErrInvalidCredentials, ErrInvalidCredentials, nil},
+			wantFailed:  0,
+			wantRecords: map[string]int64{LoginFailedCredentials: 2, "": 1},
+		},
+		{
+			name:        "threshold locks the account",
+			threshold:   3,
+			passwords:   []string{"wrong", "wrong", "wrong"},
+			wantErrs:    []error{ErrInvalidCredentials, ErrInvalidCredentials, ErrInvalidCredentials},
+			wantLocked:  true,
+			wantRecords: map[string]int64{LoginFailedCredentials: 3},
+		},
+		{
+			name:        "locked account refuses the right password",
+			threshold:   2,
+			passwords:   []string{"wrong", "wrong", testPassword},
+			wantErrs:    []error{ErrInvalidCredentials, ErrInvalidCredentials, ErrAccountLocked},
+			wantLocked:  true,
+			wantRecords: map[string]int64{LoginFailedCredentials: 2, LoginFailedLocked: 1, "": 0},
+		},
+		{
+			name:        "threshold 0 never locks",
+			threshold:   0,
+			passwords:   []string{"wrong", "wrong", "wrong", testPassword},
+			wantErrs:    []error{ErrInvalidCredentials, ErrInvalidCredentials, ErrInvalidCredentials, nil},
+			wantRecords: map[string]int64{LoginFailedCredentials: 3, "": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			if _, err := s.SetSecuritySettings(0, SecuritySettingsView{LockoutThreshold: tt.threshold, LockoutMinutes: 15}); err != nil {
+				t.Fatalf("SetSecuritySettings: %v", err)
+			}
+			id := createTestUser(t, s, "alice", "viewer")
+			for i, password := range tt.passwords {
+				_, err := s.Login("alice", password, "192.0.2.1", "test")
+				if !errors.Is(err, tt.wantErrs[i]) {
+					t.Fatalf("login %d: got error %v, want %v", i+1, err, tt.wantErrs[i])
+				}
+			}
+			user := loadUser(t, s, id)
+			if locked := user.LockedUntil != nil && time.Now().Before(*user.LockedUntil); locked != tt.wantLocked {
+				t.Errorf("locked = %t, want %t", locked, tt.wantLocked)
+			}
+			if user.FailedLogins != tt.wantFailed {
+				t.Errorf("failed_logins = %d, want %d", user.FailedLogins, tt.wantFailed)
+			}
+			for reason, want := range tt.wantRecords {
+				if got := countLoginAttempts(t, s, "alice", reason); got != want {
+					t.Errorf("login attempts with reason %q = %d, want %d", reason, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoginUnknownUser(t *testing.T) {
+	s := newTestService(t)
+	if _, err := s.Login("nobody", testPassword, "192.0.2.1", "test"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidCredentials)
+	}
+	if got := countLoginAttempts(t, s, "nobody", LoginFailedCredentials); got != 1 {
+		t.Errorf("login attempts = %d, want 1", got)
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	tests := []struct {
+		name       string
+		current    []string // Current passwords given, in order
+		wantErrs   []error
+		wantLocked bool
+		wantFailed uint
+	}{
+		{
+			name:     "right password changes it",
+			current:  []string{testPassword},
+			wantErrs: []error{nil},
+		},
+		{
+			name:       "wrong password counts as a failed login",
+			current:    []string{"wrong"},
+			wantErrs:   []error{ErrInvalidCredentials},
+			wantFailed: 1,
+		},
+		{
+			name:       "wrong passwords lock the account",
+			current:    []string{"wrong", "wrong", testPassword},
+			wantErrs:   []error{ErrInvalidCredentials, ErrInvalidCredentials, ErrAccountLocked},
+			wantLocked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			if _, err := s.SetSecuritySettings(0, SecuritySettingsView{LockoutThreshold: 2, LockoutMinutes: 15}); err != nil {
+				t.Fatalf("SetSecuritySettings: %v", err)
+			}
+			id := createTestUser(t, s, "alice", "viewer")
+			for i, current := range tt.current {
+				err := s.ChangePassword(id, 0, current, "new password", "192.0.2.1", "test")
+				if !errors.Is(err, tt.wantErrs[i]) {
+					t.Fatalf("change %d: got error %v, want %v", i+1, err, tt.wantErrs[i])
+				}
+			}
+			user := loadUser(t, s, id)
+			if locked := user.LockedUntil != nil && time.Now().Before(*user.LockedUntil); locked != tt.wantLocked {
+				t.Errorf("locked = %t, want %t", locked, tt.wantLocked)
+			}
+			if user.FailedLogins != tt.wantFailed {
+				t.Errorf("failed_logins = %d, want %d", user.FailedLogins, tt.wantFailed)
+			}
+			var wrong int
+			for _, err := range tt.wantErrs {
+				if errors.Is(err, ErrInvalidCredentials) {
+					wrong++
+				}
+			}
+			if got := countLoginAttempts(t, s, "alice", LoginFailedCredentials); got != int64(wrong) {
+				t.Errorf("failed login attempts = %d, want %d", got, wrong)
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// AvailabilityFilter selects the time range of an availability report. A
+// zero To is now and a zero From is 30 days before To.
+type AvailabilityFilter struct {
+	From time.Time
+	To   time.Time
+}
+
+// AvailabilityPeriod is a stretch of time within an availability report.
+type AvailabilityPeriod struct {
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Seconds float64         `json:"seconds"`
+	State   storage.VMState `json:"state,omitempty"` // For outages, the state the VM went down to
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// VMAvailability is how long a VM was running over a time range. Time in
+// maintenance, with its host in maintenance mode or in a maintenance window
+// covering it, counts as neither up nor down.
+type VMAvailability struct {
+	VMUUID              string               `json:"vm_uuid"`
+	VMName              string               `json:"vm_name"`
+	HostID              string               `json:"host_id"`
+	From                time.Time            `json:"from"` // The start of the range, or when the VM was created if later
+	To                  time.Time            `json:"to"`
+	TotalSeconds        float64              `json:"total_seconds"`
+	ExcludedSeconds     float64              `json:"excluded_seconds"`
+	UpSeconds           float64              `json:"up_seconds"`
+	DownSeconds         float64              `json:"down_seconds"`
+	AvailabilityPercent float64              `json:"availability_percent"`
+	Outages             []AvailabilityPeriod `json:"outages"`
+	Exclusions          []AvailabilityPeriod `json:"exclusions"`
+}
+
+// AvailabilityReport is the availability of every VM over a time range.
+type AvailabilityReport struct {
+	From time.Time        `json:"from"`
+	To   time.Time        `json:"to"`
+	VMs  []VMAvailability `json:"vms"`
+}
+
+func (f *AvailabilityFilter) normalize() error {
+	if f.To.IsZero() {
+		f.To = time.Now()
+	}
+	if f.From.IsZero() {
+		f.From = f.To.Add(-defaultReportRange)
+	}
+	// Timestamps are stored as text in local time, so bounds must be in local
+	// time too for the comparison to hold.
+	f.From, f.To = f.From.Local(), f.To.Local()
+	var v validator
+	if !f.From.Before(f.To) {
+		v.add("from", "must be before to")
+	}
+	return v.err()
+}
+
+// GetVMAvailability computes how long a VM was running over a time range
+// from its recorded state changes.
+func (s *HostService) GetVMAvailability(hostID, vmName string, filter AvailabilityFilter) (*VMAvailability, error) {
+	if err := filter.normalize(); err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := s.availabilityExclusions(filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.vmAvailability(vm, filter, exclusions)
+}
+
+// GetAvailabilityReport computes the availability of every VM, leaving out
+// templates, ordered from the least to the most available.
+func (s *HostService) GetAvailabilityReport(filter AvailabilityFilter) (*AvailabilityReport, error) {
+	if err := filter.normalize(); err != nil {
+		return nil, err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("is_template = ?", false).Order("name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	exclusions, err := s.availabilityExclusions(filter)
+	if err != nil {
+		return nil, err
+	}
+	report := &AvailabilityReport{From: filter.From, To: filter.To, VMs: []VMAvailability{}}
+	for i := range vms {
+		availability, err := s.vmAvailability(&vms[i], filter, exclusions)
+		if err != nil {
+			return nil, err
+		}
+		report.VMs = append(report.VMs, *availability)
+	}
+	sort.SliceStable(report.VMs, func(i, j int) bool {
+		return report.VMs[i].AvailabilityPercent < report.VMs[j].AvailabilityPercent
+	})
+	return report, nil
+}
+
+// vmAvailability replays the state changes of a VM over a time range. The
+// state at the start is that of the last change before it or, without one,
+// the state the first change in the range left; a VM that never changed
+// state has been in its current state all along.
+func (s *HostService) vmAvailability(vm *storage.VirtualMachine, filter AvailabilityFilter, exclusions *availabilityExclusions) (*VMAvailability, error) {
+	from, to := filter.From, filter.To
+	if vm.CreatedAt.After(from) {
+		from = vm.CreatedAt
+	}
+	result := &VMAvailability{
+		VMUUID:              vm.UUID,
+		VMName:              vm.Name,
+		HostID:              vm.HostID,
+		From:                from,
+		To:                  to,
+		AvailabilityPercent: 100,
+		Outages:             []AvailabilityPeriod{},
+		Exclusions:          []AvailabilityPeriod{},
+	}
+	if !from.Before(to) {
+		result.From = to
+		return result, nil
+	}
+
+	var before []storage.VMStateChange
+	err := s.db.Where("vm_uuid = ? AND created_at <= ?", vm.UUID, from).
+		Order("created_at DESC, id DESC").Limit(1).Find(&before).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state changes of VM %s: %w", vm.Name, err)
+	}
+	var changes []storage.VMStateChange
+	err = s.db.Where("vm_uuid = ? AND created_at > ? AND created_at < ?", vm.UUID, from, to).
+		Order("created_at, id").Find(&changes).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state changes of VM %s: %w", vm.Name, err)
+	}
+	state := vm.State
+	switch {
+	case len(before) > 0:
+		state = before[0].State
+	case len(changes) > 0:
+		state = changes[0].PreviousState
+	}
+
+	excluded, err := s.excludedPeriods(vm, exclusions)
+	if err != nil {
+		return nil, err
+	}
+	for _, period := range mergePeriods(excluded) {
+		if period.To.After(from) && period.From.Before(to) {
+			period.From, period.To = laterTime(period.From, from), earlierTime(period.To, to)
+			period.Seconds = period.To.Sub(period.From).Seconds()
+			result.Exclusions = append(result.Exclusions, period)
+			result.ExcludedSeconds += period.Seconds
+		}
+	}
+
+	start := from
+	for i := 0; i <= len(changes); i++ {
+		end := to
+		if i < len(changes) {
+			end = changes[i].CreatedAt
+		}
+		for _, part := range subtractPeriods(start, end, result.Exclusions) {
+			seconds := part.To.Sub(part.From).Seconds()
+			if state == storage.StateActive {
+				result.UpSeconds += seconds
+				continue
+			}
+			result.DownSeconds += seconds
+			if n := len(result.Outages); n > 0 && result.Outages[n-1].To.Equal(part.From) {
+				result.Outages[n-1].To = part.To
+				result.Outages[n-1].Seconds += seconds
+				continue
+			}
+			result.Outages = append(result.Outages, AvailabilityPeriod{From: part.From, To: part.To, Seconds: seconds, State: state})
+		}
+		if i < len(changes) {
+			start, state = end, changes[i].State
+		}
+	}
+
+	result.TotalSeconds = to.Sub(from).Seconds()
+	if counted := result.UpSeconds + result.DownSeconds; counted > 0 {
+		result.AvailabilityPercent = math.Round(result.UpSeconds/counted*100*1000) / 1000
+	}
+	return result, nil
+}
+
+// availabilityExclusions is the time left out of availability reports: when
+// hosts were in maintenance mode and the maintenance windows.
+type availabilityExclusions struct {
+	hosts   map[string][]AvailabilityPeriod
+	windows []storage.MaintenanceWindow
+}
+
+func (s *HostService) availabilityExclusions(filter AvailabilityFilter) (*availabilityExclusions, error) {
+	hosts, err := s.maintenancePeriods(filter.From, filter.To)
+	if err != nil {
+		return nil, err
+	}
+	windows, err := s.maintenanceWindowsBetween(filter.From, filter.To)
+	if err != nil {
+		return nil, err
+	}
+	return &availabilityExclusions{hosts: hosts, windows: windows}, nil
+}
+
+// excludedPeriods returns the time left out for a VM, unordered. Windows
+// scoped by label selector are matched against the VM's current labels.
+func (s *HostService) excludedPeriods(vm *storage.VirtualMachine, exclusions *availabilityExclusions) ([]AvailabilityPeriod, error) {
+	periods := slices.Clone(exclusions.hosts[vm.HostID])
+	var labels map[string]string
+	for _, window := range exclusions.windows {
+		if window.Selector != "" && labels == nil {
+			var err error
+			if labels, err = labelsOf(s.db, vm.ID); err != nil {
+				return nil, err
+			}
+		}
+		if maintenanceWindowCovers(window, vm.HostID, vm, labels) {
+			periods = append(periods, AvailabilityPeriod{From: window.StartsAt, To: window.EndsAt, Reason: "maintenance window " + window.Name})
+		}
+	}
+	return periods, nil
+}
+
+// mergePeriods orders periods and joins the ones that overlap or touch,
+// along with their reasons.
+func mergePeriods(periods []AvailabilityPeriod) []AvailabilityPeriod {
+	sort.Slice(periods, func(i, j int) bool { return periods[i].From.Before(periods[j].From) })
+	var merged []AvailabilityPeriod
+	for _, period := range periods {
+		n := len(merged)
+		if n == 0 || period.From.After(merged[n-1].To) {
+			merged = append(merged, period)
+			continue
+		}
+		merged[n-1].To = laterTime(merged[n-1].To, period.To)
+		if !strings.Contains(merged[n-1].Reason, period.Reason) {
+			merged[n-1].Reason += ", " + period.Reason
+		}
+	}
+	return merged
+}
+
+// maintenancePeriods returns, per host, when hosts were in maintenance mode
+// over a time range, from the audit log. A host still in maintenance is in
+// it until the end of the range.
+func (s *HostService) maintenancePeriods(from, to time.Time) (map[string][]AvailabilityPeriod, error) {
+	var entries []storage.AuditLog
+	err := s.db.Where("action = ? AND created_at < ?", "host.maintenance", to).
+		Order("created_at, id").Find(&entries).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load host maintenance history: %w", err)
+	}
+	started := make(map[string]time.Time)
+	periods := make(map[string][]AvailabilityPeriod)
+	for _, entry := range entries {
+		_, open := started[entry.TargetID]
+		switch {
+		case entry.Details == "enabled=true" && !open:
+			started[entry.TargetID] = entry.CreatedAt
+		case entry.Details == "enabled=false" && open:
+			if entry.CreatedAt.After(from) {
+				periods[entry.TargetID] = append(periods[entry.TargetID],
+					AvailabilityPeriod{From: started[entry.TargetID], To: entry.CreatedAt, Reason: "host maintenance"})
+			}
+			delete(started, entry.TargetID)
+		}
+	}
+	for hostID, start := range started {
+		periods[hostID] = append(periods[hostID], AvailabilityPeriod{From: start, To: to, Reason: "host maintenance"})
+	}
+	return periods, nil
+}
+
+// subtractPeriods returns the parts of [from, to) outside the given periods,
+// which must be ordered and not overlap.
+func subtractPeriods(from, to time.Time, periods []AvailabilityPeriod) []AvailabilityPeriod {
+	var parts []AvailabilityPeriod
+	if !from.Before(to) {
+		return parts
+	}
+	for _, period := range periods {
+		if !period.To.After(from) || !period.From.Before(to) {
+			continue
+		}
+		if period.From.After(from) {
+			parts = append(parts, AvailabilityPeriod{From: from, To: period.From})
+		}
+		from = period.To
+		if !from.Before(to) {
+			return parts
+		}
+	}
+	return append(parts, AvailabilityPeriod{From: from, To: to})
+}
+
+func laterTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func earlierTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,349 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+// Defaults of a host's balloon policy.
+const (
+	DefaultBalloonLowFreePercent      = 10.0
+	DefaultBalloonHighFreePercent     = 25.0
+	DefaultBalloonMinGuaranteePercent = 50.0
+)
+
+const (
+	// balloonStepPercent bounds one adjustment, in percent of the VM's
+	// maximum memory, so guests have time to react between rounds.
+	balloonStepPercent = 10
+	// balloonHeadroomPercent of its current memory is left unused in a guest
+	// when reclaiming, so it does not start swapping.
+	balloonHeadroomPercent = 10
+	// balloonMinAdjustment is the smallest change worth making.
+	balloonMinAdjustment = 64 << 20
+)
+
+// EventBalloonAdjusted is recorded and broadcast for every balloon change
+// made by a policy.
+const EventBalloonAdjusted = "balloon-adjusted"
+
+// BalloonPolicyRequest configures the balloon policy of a host. Zero
+// percentages select the defaults.
+type BalloonPolicyRequest struct {
+	Enabled             bool    `json:"enabled"`
+	LowFreePercent      float64 `json:"low_free_percent"`
+	HighFreePercent     float64 `json:"high_free_percent"`
+	MinGuaranteePercent float64 `json:"min_guarantee_percent"`
+}
+
+// balloonAdjustment is one balloon change decided by a policy round.
+type balloonAdjustment struct {
+	balloon libvirt.BalloonStats
+	vmID    uint
+	target  uint64
+	reason  string
+}
+
+// GetBalloonPolicy returns the balloon policy of a host, or a disabled one
+// with the defaults if none was set.
+func (s *HostService) GetBalloonPolicy(hostID string) (*storage.BalloonPolicy, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	policy := storage.BalloonPolicy{HostID: hostID}
+	if err := s.db.Where("host_id = ?", hostID).Limit(1).Find(&policy).Error; err != nil {
+		return nil, err
+	}
+	applyBalloonDefaults(&policy)
+	return &policy, nil
+}
+
+// SetBalloonPolicy enables, disables or reconfigures the balloon policy of
+// a host. Disabling it leaves the balloons where they are.
+func (s *HostService) SetBalloonPolicy(hostID string, req BalloonPolicyRequest) (*storage.BalloonPolicy, error) {
+	policy := storage.BalloonPolicy{
+		HostID:              hostID,
+		Enabled:             req.Enabled,
+		LowFreePercent:      req.LowFreePercent,
+		HighFreePercent:     req.HighFreePercent,
+		MinGuaranteePercent: req.MinGuaranteePercent,
+	}
+	applyBalloonDefaults(&policy)
+	var v validator
+	if policy.LowFreePercent <= 0 || policy.LowFreePercent >= 100 {
+		v.add("low_free_percent", "must be between 0 and 100")
+	}
+	if policy.HighFreePercent <= policy.LowFreePercent || policy.HighFreePercent >= 100 {
+		v.add("high_free_percent", "must be above low_free_percent and below 100")
+	}
+	if policy.MinGuaranteePercent <= 0 || policy.MinGuaranteePercent > 100 {
+		v.add("min_guarantee_percent", "must be above 0 and at most 100")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	if err := s.db.Save(&policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to save balloon policy: %w", err)
+	}
+	s.recordAudit("host.balloon_policy.update", "host", hostID,
+		fmt.Sprintf("enabled=%t low=%g high=%g guarantee=%g", policy.Enabled, policy.LowFreePercent,
+			policy.HighFreePercent, policy.MinGuaranteePercent))
+	return &policy, nil
+}
+
+// SetVMBalloonGuarantee sets the memory the balloon policy leaves a VM at
+// least. 0 reverts to the policy's guarantee.
+func (s *HostService) SetVMBalloonGuarantee(hostID, vmName string, minBytes uint64) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if minBytes > vm.MemoryBytes {
+		return &ValidationError{Fields: []FieldError{{
+			Field:   "min_bytes",
+			Message: fmt.Sprintf("must be at most the VM's memory of %d MiB", vm.MemoryBytes>>20),
+		}}}
+	}
+	if err := s.db.Model(vm).Update("balloon_min_bytes", minBytes).Error; err != nil {
+		return err
+	}
+	s.recordAudit("vm.balloon_guarantee.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("min=%dMiB", minBytes>>20))
+	return nil
+}
+
+func applyBalloonDefaults(policy *storage.BalloonPolicy) {
+	if policy.LowFreePercent == 0 {
+		policy.LowFreePercent = DefaultBalloonLowFreePercent
+	}
+	if policy.HighFreePercent == 0 {
+		policy.HighFreePercent = DefaultBalloonHighFreePercent
+	}
+	if policy.MinGuaranteePercent == 0 {
+		policy.MinGuaranteePercent = DefaultBalloonMinGuaranteePercent
+	}
+}
+
+// StartBalloonPolicies runs the enabled balloon policies of connected hosts
+// once per interval, unless the auto-ballooning feature is off. It blocks,
+// so run it in its own goroutine.
+func (s *HostService) StartBalloonPolicies(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.featureEnabled(FeatureAutoBallooning) {
+			continue
+		}
+		var policies []storage.BalloonPolicy
+		if err := s.db.Where("enabled = ?", true).Find(&policies).Error; err != nil {
+			log.Printf("Warning: failed to load balloon policies: %v", err)
+			continue
+		}
+		connected := make(map[string]bool)
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			connected[hostID] = true
+		}
+		for i := range policies {
+			if !connected[policies[i].HostID] {
+				continue
+			}
+			if err := s.runBalloonPolicy(&policies[i]); err != nil {
+				log.Printf("Warning: balloon policy of host %s failed: %v", policies[i].HostID, err)
+			}
+		}
+	}
+}
+
+// runBalloonPolicy makes one round of balloon adjustments on a host. Below
+// the low watermark, memory the guests report as unused is reclaimed, from
+// the guests with the most unused memory first. Above the high watermark,
+// reclaimed memory is given back, to the most squeezed guests first. In
+// between nothing changes, so the balloons do not oscillate.
+func (s *HostService) runBalloonPolicy(policy *storage.BalloonPolicy) error {
+	hostID := policy.HostID
+	memory, err := s.connector.GetHostMemory(hostID)
+	if err != nil {
+		return err
+	}
+	if memory.Total == 0 {
+		return nil
+	}
+	balloons, err := s.connector.GetBalloonStats(hostID)
+	if err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ?", hostID).Find(&vms).Error; err != nil {
+		return err
+	}
+	byName := make(map[string]*storage.VirtualMachine, len(vms))
+	for i := range vms {
+		byName[vms[i].Name] = &vms[i]
+	}
+
+	// Memory reclaimed from VMs that stopped came back with them.
+	running := make(map[string]bool, len(balloons))
+	for _, b := range balloons {
+		running[b.Name] = true
+	}
+	for _, vm := range vms {
+		if vm.BalloonReclaimedBytes > 0 && !running[vm.Name] {
+			s.db.Model(&vm).Update("balloon_reclaimed_bytes", 0)
+		}
+	}
+
+	freePercent := float64(memory.Available) / float64(memory.Total) * 100
+	var adjustments []balloonAdjustment
+	switch {
+	case freePercent < policy.LowFreePercent:
+		need := uint64(policy.LowFreePercent/100*float64(memory.Total)) - memory.Available
+		adjustments = planBalloonReclaim(policy, balloons, byName, need, freePercent)
+	case freePercent > policy.HighFreePercent:
+		spare := memory.Available - uint64(policy.HighFreePercent/100*float64(memory.Total))
+		adjustments = planBalloonRelease(policy, balloons, byName, spare, freePercent)
+	}
+
+	for _, adj := range adjustments {
+		if err := s.applyBalloonAdjustment(hostID, adj, memory); err != nil {
+			log.Printf("Warning: could not adjust balloon of VM %s on host %s: %v", adj.balloon.Name, hostID, err)
+		}
+	}
+	return nil
+}
+
+func planBalloonReclaim(policy *storage.BalloonPolicy, balloons []libvirt.BalloonStats, vms map[string]*storage.VirtualMachine, need uint64, freePercent float64) []balloonAdjustment {
+	candidates := make([]libvirt.BalloonStats, 0, len(balloons))
+	for _, b := range balloons {
+		if b.Cooperating && vms[b.Name] != nil {
+			candidates = append(candidates, b)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Unused > candidates[j].Unused })
+
+	var adjustments []balloonAdjustment
+	for _, b := range candidates {
+		if need == 0 {
+			break
+		}
+		vm := vms[b.Name]
+		floor := vm.BalloonMinBytes
+		if floor == 0 {
+			floor = uint64(policy.MinGuaranteePercent / 100 * float64(b.Maximum))
+		}
+		headroom := b.Current * balloonHeadroomPercent / 100
+		if b.Unused <= headroom || b.Current <= floor {
+			continue
+		}
+		give := min(b.Unused-headroom, b.Current-floor, b.Maximum*balloonStepPercent/100, need)
+		if give < balloonMinAdjustment {
+			continue
+		}
+		need -= give
+		adjustments = append(adjustments, balloonAdjustment{
+			balloon: b,
+			vmID:    vm.ID,
+			target:  b.Current - give,
+			reason: fmt.Sprintf("host has %.1f%% of its memory available, below the %g%% low watermark; the guest had %d MiB unused",
+				freePercent, policy.LowFreePercent, b.Unused>>20),
+		})
+	}
+	return adjustments
+}
+
+func planBalloonRelease(policy *storage.BalloonPolicy, balloons []libvirt.BalloonStats, vms map[string]*storage.VirtualMachine, spare uint64, freePercent float64) []balloonAdjustment {
+	candidates := make([]libvirt.BalloonStats, 0, len(balloons))
+	for _, b := range balloons {
+		if vm := vms[b.Name]; vm != nil && vm.BalloonReclaimedBytes > 0 && b.Current < b.Maximum {
+			candidates = append(candidates, b)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return float64(candidates[i].Current)/float64(candidates[i].Maximum) < float64(candidates[j].Current)/float64(candidates[j].Maximum)
+	})
+
+	var adjustments []balloonAdjustment
+	for _, b := range candidates {
+		if spare == 0 {
+			break
+		}
+		vm := vms[b.Name]
+		give := min(vm.BalloonReclaimedBytes, b.Maximum-b.Current, b.Maximum*balloonStepPercent/100, spare)
+		if give < balloonMinAdjustment && give < vm.BalloonReclaimedBytes {
+			continue
+		}
+		spare -= give
+		adjustments = append(adjustments, balloonAdjustment{
+			balloon: b,
+			vmID:    vm.ID,
+			target:  b.Current + give,
+			reason: fmt.Sprintf("host has %.1f%% of its memory available, above the %g%% high watermark; returning memory reclaimed earlier",
+				freePercent, policy.HighFreePercent),
+		})
+	}
+	return adjustments
+}
+
+// applyBalloonAdjustment sets a balloon target, tracks what the policy has
+// reclaimed from the VM, and records an event explaining the change.
+func (s *HostService) applyBalloonAdjustment(hostID string, adj balloonAdjustment, memory *libvirt.HostMemory) error {
+	b := adj.balloon
+	if err := s.connector.SetBalloonTarget(hostID, b.Name, adj.target); err != nil {
+		return err
+	}
+
+	var vm storage.VirtualMachine
+	if err := s.db.First(&vm, adj.vmID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	reclaimed := vm.BalloonReclaimedBytes
+	var message string
+	if adj.target < b.Current {
+		reclaimed += b.Current - adj.target
+		message = fmt.Sprintf("Reclaimed %d MiB from %s: %s", (b.Current-adj.target)>>20, b.Name, adj.reason)
+	} else {
+		reclaimed -= min(reclaimed, adj.target-b.Current)
+		message = fmt.Sprintf("Returned %d MiB to %s: %s", (adj.target-b.Current)>>20, b.Name, adj.reason)
+	}
+	if err := s.db.Model(&vm).Update("balloon_reclaimed_bytes", reclaimed).Error; err != nil {
+		log.Printf("Warning: failed to record reclaimed memory of VM %s: %v", b.Name, err)
+	}
+
+	details := map[string]interface{}{
+		"previous_bytes":       b.Current,
+		"target_bytes":         adj.target,
+		"maximum_bytes":        b.Maximum,
+		"unused_bytes":         b.Unused,
+		"reclaimed_bytes":      reclaimed,
+		"host_available_bytes": memory.Available,
+		"host_total_bytes":     memory.Total,
+	}
+	s.recordEvent(EventBalloonAdjusted, hostID, b.Name, message, details)
+	s.hub.BroadcastMessage(ws.Message{
+		Type: EventBalloonAdjusted,
+		Payload: ws.MessagePayload{
+			"hostId":  hostID,
+			"vmName":  b.Name,
+			"message": message,
+			"details": details,
+		},
+	})
+	return nil
+}
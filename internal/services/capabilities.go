@@ -0,0 +1,124 @@
+package services
+
+import (
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Version is the release of the server, set when building with
+// -ldflags "-X github.com/capsali/virtumancer-flash/internal/services.Version=1.4.0".
+var Version = ""
+
+// Ways the API authenticates requests.
+const (
+	// AuthModeOpen is used while no user exists: only the user endpoints
+	// need a session.
+	AuthModeOpen = "open"
+	// AuthModeSession is used once a user exists: every endpoint but a few
+	// public ones needs a session.
+	AuthModeSession = "session"
+)
+
+// Capabilities describes what the server offers, so that the web UI can
+// adapt to it. Nothing in it is secret; it is served without logging in.
+type Capabilities struct {
+	Version      string                  `json:"version"`
+	GoVersion    string                  `json:"go_version"`
+	Auth         AuthCapabilities        `json:"auth"`
+	Integrations IntegrationCapabilities `json:"integrations"`
+	// Experimental features and whether they are turned on.
+	Experimental map[string]bool `json:"experimental"`
+}
+
+// AuthCapabilities describes how users log in.
+type AuthCapabilities struct {
+	Mode               string   `json:"mode"`           // 'open' or 'session'
+	Methods            []string `json:"methods"`        // Ways of logging in, e.g. 'password'
+	SessionCookie      string   `json:"session_cookie"` // Name of the cookie browsers get the session in
+	SessionIdleSeconds float64  `json:"session_idle_seconds"`
+	MinPasswordLength  int      `json:"min_password_length"`
+	ProjectsEnabled    bool     `json:"projects_enabled"`
+}
+
+// IntegrationCapabilities tells which integrations are set up.
+type IntegrationCapabilities struct {
+	Email      bool `json:"email"`       // Sending alerts and reports is enabled
+	Tracing    bool `json:"tracing"`     // Spans are exported to a collector
+	Discovery  bool `json:"discovery"`   // Subnets are scanned for hosts periodically
+	MDNS       bool `json:"mdns"`        // avahi-browse is installed for mDNS discovery
+	Metrics    bool `json:"metrics"`     // /metrics is served for Prometheus
+	Terraform  bool `json:"terraform"`   // The reads of the Terraform provider are served
+	AgentHosts bool `json:"agent_hosts"` // Hosts can connect through the reverse-tunnel agent
+}
+
+// serverVersion returns the version set at build time or, without one, the
+// version of the main module, which is "(devel)" for builds from a checkout.
+func serverVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// GetCapabilities reports the version of the server, how users log in, the
+// integrations that are set up and the experimental features, as far as they
+// are on for a user, who is nil without logging in.
+func (s *HostService) GetCapabilities(user *storage.User) (*Capabilities, error) {
+	users, err := s.UsersExist()
+	if err != nil {
+		return nil, err
+	}
+	projects, err := s.ProjectsEnabled()
+	if err != nil {
+		return nil, err
+	}
+	email, err := s.loadEmailSettings()
+	if err != nil {
+		return nil, err
+	}
+	tracing, err := s.GetTracingSettings()
+	if err != nil {
+		return nil, err
+	}
+	discovery, err := s.loadDiscoverySettings()
+	if err != nil {
+		return nil, err
+	}
+	_, avahiErr := exec.LookPath("avahi-browse")
+	experimental, err := s.experimentalFeatures(user)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &Capabilities{
+		Version:   serverVersion(),
+		GoVersion: runtime.Version(),
+		Auth: AuthCapabilities{
+			Mode:               AuthModeOpen,
+			Methods:            []string{"password"},
+			SessionIdleSeconds: sessionIdleLifetime.Seconds(),
+			MinPasswordLength:  MinPasswordLength,
+			ProjectsEnabled:    projects,
+		},
+		Integrations: IntegrationCapabilities{
+			Email:      email.Enabled,
+			Tracing:    tracing.Enabled,
+			Discovery:  discovery.Enabled && s.featureEnabled(FeatureDiscovery),
+			MDNS:       avahiErr == nil,
+			Metrics:    true,
+			Terraform:  true,
+			AgentHosts: true,
+		},
+		Experimental: experimental,
+	}
+	if users {
+		caps.Auth.Mode = AuthModeSession
+	}
+	return caps, nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/console"
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// consoleTicketLifetime is how long a console ticket can be used to connect.
+// Connections made in time stay open after it expires.
+const consoleTicketLifetime = 2 * time.Minute
+
+var (
+	// ErrConsoleUnavailable is returned when a VM has no display a native
+	// client could connect to, e.g. because it is shut off.
+	ErrConsoleUnavailable = errors.New("no console available")
+	// ErrConsoleNotReachable is returned when the display cannot be reached
+	// from outside the host, e.g. because it only listens on localhost.
+	ErrConsoleNotReachable = errors.New("console not reachable from outside the host; use the browser console")
+)
+
+// ConsoleInfo tells a native client such as remote-viewer how to connect to
+// a VM's display.
+type ConsoleInfo struct {
+	VMName          string    `json:"vm_name"`
+	Protocol        string    `json:"protocol"` // 'spice' or 'vnc'
+	Display         int       `json:"display"`  // Index of the graphics device, see ListDisplays
+	Host            string    `json:"host"`
+	Port            int       `json:"port,omitempty"`     // Plain port; 0 if only TLS is offered
+	TLSPort         int       `json:"tls_port,omitempty"` // SPICE only
+	TLS             bool      `json:"tls"`
+	Ticket          string    `json:"ticket"` // Password for this connection only
+	TicketExpiresAt time.Time `json:"ticket_expires_at"`
+}
+
+// VirtViewerFile renders the connection as a virt-viewer (.vv) file.
+func (ci *ConsoleInfo) VirtViewerFile() string {
+	var b strings.Builder
+	b.WriteString("[virt-viewer]\n")
+	fmt.Fprintf(&b, "type=%s\n", ci.Protocol)
+	fmt.Fprintf(&b, "host=%s\n", ci.Host)
+	if ci.Port > 0 {
+		fmt.Fprintf(&b, "port=%d\n", ci.Port)
+	}
+	if ci.TLSPort > 0 {
+		fmt.Fprintf(&b, "tls-port=%d\n", ci.TLSPort)
+	}
+	fmt.Fprintf(&b, "password=%s\n", ci.Ticket)
+	fmt.Fprintf(&b, "title=%s\n", ci.VMName)
+	b.WriteString("delete-this-file=1\n")
+	return b.String()
+}
+
+// consoleHost picks the address a native client connects to: the display's
+// listen address when it is a specific one, otherwise the host's address.
+// Local hosts are reached through the address the request came in on.
+func consoleHost(host *storage.Host, listen, serverHost string) (string, error) {
+	ip := net.ParseIP(listen)
+	switch {
+	case listen == "localhost", ip != nil && ip.IsLoopback():
+		return "", fmt.Errorf("%w: the display listens on %s", ErrConsoleNotReachable, listen)
+	case ip != nil && !ip.IsUnspecified():
+		return listen, nil
+	}
+	uri, err := libvirt.ParseHostURI(host.URI)
+	if err != nil {
+		return "", err
+	}
+	switch uri.Transport {
+	case libvirt.TransportUnix:
+		return serverHost, nil
+	case libvirt.TransportAgent:
+		return "", fmt.Errorf("%w: host %s is reached through its agent", ErrConsoleNotReachable, host.ID)
+	default:
+		return uri.URL.Hostname(), nil
+	}
+}
+
+// GetConsoleInfo returns how to connect a native client to a VM's display
+// along with a one-time ticket. The ticket replaces the password of the
+// running VM's displays until a client connects with it or it expires
+// shortly; the standing password is then put back and stays in the VM's
+// definition throughout. Clients already connected keep their sessions. The
+// display with the given index is used, or the first SPICE display, or the
+// first VNC one, if index is -1. serverHost is the address the request came
+// in on.
+func (s *HostService) GetConsoleInfo(hostID, vmName string, index int, serverHost string) (*ConsoleInfo, error) {
+	if _, err := s.findVM(hostID, vmName); err != nil {
+		return nil, err
+	}
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	displays, err := console.ListDisplays(s.connector, hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	var display *console.Display
+	hasVNC := false
+	for i := range displays {
+		d := &displays[i]
+		hasVNC = hasVNC || d.Type == "vnc"
+		if d.Port == 0 && d.TLSPort == 0 {
+			continue
+		}
+		if index >= 0 {
+			if d.Index == index {
+				display = d
+			}
+		} else if display == nil || (display.Type == "vnc" && d.Type == "spice") {
+			display = d
+		}
+	}
+	if display == nil {
+		if index >= 0 {
+			return nil, fmt.Errorf("%w: display %d of %s does not exist or has no port; the VM must be running", ErrConsoleUnavailable, index, vmName)
+		}
+		return nil, fmt.Errorf("%w: %s has no VNC or SPICE display with a port; the VM must be running", ErrConsoleUnavailable, vmName)
+	}
+	address, err := consoleHost(&host, display.Listen, serverHost)
+	if err != nil {
+		return nil, err
+	}
+
+	length := maxGraphicsPasswordLength
+	if hasVNC {
+		length = maxVNCPasswordLength
+	}
+	ticket, err := randomGraphicsPassword(length)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(consoleTicketLifetime).Truncate(time.Second)
+	if _, err := s.connector.SetConsoleTicket(hostID, vmName, ticket, expiresAt); err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.console-ticket", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("protocol=%s display=%d", display.Type, display.Index))
+
+	return &ConsoleInfo{
+		VMName:          vmName,
+		Protocol:        display.Type,
+		Display:         display.Index,
+		Host:            address,
+		Port:            display.Port,
+		TLSPort:         display.TLSPort,
+		TLS:             display.TLS,
+		Ticket:          ticket,
+		TicketExpiresAt: expiresAt,
+	}, nil
+}
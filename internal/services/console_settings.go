@@ -0,0 +1,57 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/console"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Bounds for the console keepalive and idle timeout.
+const (
+	MinConsolePingInterval = 5 * time.Second
+	MaxConsolePingInterval = 5 * time.Minute
+	MinConsoleIdleTimeout  = time.Minute
+	MaxConsoleIdleTimeout  = 24 * time.Hour
+)
+
+// ErrInvalidConsoleSettings is returned for a ping interval or idle timeout
+// outside the allowed range.
+var ErrInvalidConsoleSettings = fmt.Errorf("ping_interval_seconds must be 0 (default) or between %v and %v, idle_timeout_seconds 0 (never) or between %v and %v",
+	MinConsolePingInterval.Seconds(), MaxConsolePingInterval.Seconds(), MinConsoleIdleTimeout.Seconds(), MaxConsoleIdleTimeout.Seconds())
+
+// ConsoleSettingsView is the console configuration that applies to new
+// sessions.
+type ConsoleSettingsView struct {
+	PingIntervalSeconds float64 `json:"ping_interval_seconds"`
+	IdleTimeoutSeconds  float64 `json:"idle_timeout_seconds"` // 0 keeps idle sessions open
+}
+
+// GetConsoleSettings returns the keepalive and idle timeout of console
+// sessions.
+func (s *HostService) GetConsoleSettings() *ConsoleSettingsView {
+	settings := console.LoadSettings(s.db)
+	return &ConsoleSettingsView{
+		PingIntervalSeconds: settings.PingInterval.Seconds(),
+		IdleTimeoutSeconds:  settings.IdleTimeout.Seconds(),
+	}
+}
+
+// SetConsoleSettings changes the keepalive and idle timeout. Open sessions
+// keep the settings they started with.
+func (s *HostService) SetConsoleSettings(pingIntervalSeconds, idleTimeoutSeconds uint) (*ConsoleSettingsView, error) {
+	ping := time.Duration(pingIntervalSeconds) * time.Second
+	idle := time.Duration(idleTimeoutSeconds) * time.Second
+	if (ping != 0 && (ping < MinConsolePingInterval || ping > MaxConsolePingInterval)) ||
+		(idle != 0 && (idle < MinConsoleIdleTimeout || idle > MaxConsoleIdleTimeout)) {
+		return nil, ErrInvalidConsoleSettings
+	}
+	row := storage.ConsoleSettings{ID: 1, PingIntervalSeconds: pingIntervalSeconds, IdleTimeoutSeconds: idleTimeoutSeconds}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save console settings: %w", err)
+	}
+	s.recordAudit("console.update", "console", "global",
+		fmt.Sprintf("ping_interval=%ds idle_timeout=%ds", pingIntervalSeconds, idleTimeoutSeconds))
+	return s.GetConsoleSettings(), nil
+}
@@ -0,0 +1,320 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// PermissionManageCosts allows changing the unit costs of showback reports.
+const PermissionManageCosts = "costs.manage"
+
+// VM usage is sampled at a fixed interval; each sample accounts for the
+// interval before it. Samples are kept long enough for yearly reports.
+const (
+	UsageSampleInterval = 15 * time.Minute
+	usageRetention      = 400 * 24 * time.Hour
+	defaultReportRange  = 30 * 24 * time.Hour
+)
+
+// Ways of grouping a cost report. Labels are grouped by with 'label:<key>'.
+const (
+	CostGroupVM          = "vm"
+	CostGroupHost        = "host"
+	CostGroupOwner       = "owner"
+	costGroupLabelPrefix = "label:"
+)
+
+// ownerField is the custom field naming the owner of a VM.
+const ownerField = "owner"
+
+const bytesPerGB = 1 << 30
+
+// CostReportFilter selects the usage a report covers. A zero To is now and a
+// zero From is 30 days before To.
+type CostReportFilter struct {
+	From    time.Time
+	To      time.Time
+	GroupBy string // 'vm' (default), 'host', 'owner' or 'label:<key>'
+}
+
+// CostReportRow is the usage and cost of one group of VMs.
+type CostReportRow struct {
+	Group          string  `json:"group"`             // VM name, host name, owner or label value; empty for VMs without one
+	VMUUID         string  `json:"vm_uuid,omitempty"` // Only when grouping by VM
+	HostID         string  `json:"host_id,omitempty"` // Only when grouping by VM or host
+	VMs            int     `json:"vms"`
+	VCPUHours      float64 `json:"vcpu_hours"`
+	MemoryGBHours  float64 `json:"memory_gb_hours"`
+	StorageGBHours float64 `json:"storage_gb_hours"`
+	VCPUCost       float64 `json:"vcpu_cost"`
+	MemoryCost     float64 `json:"memory_cost"`
+	StorageCost    float64 `json:"storage_cost"`
+	Cost           float64 `json:"cost"`
+}
+
+// CostReport is the usage and cost of all VMs over a time range.
+type CostReport struct {
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	GroupBy  string            `json:"group_by"`
+	Currency string            `json:"currency"`
+	Rates    storage.CostRates `json:"rates"`
+	Rows     []CostReportRow   `json:"rows"`
+	Total    CostReportRow     `json:"total"`
+}
+
+// StartUsageRecorder samples the resources of the VMs on every connected host
+// and expires old samples. It blocks, so run it in its own goroutine.
+func (s *HostService) StartUsageRecorder() {
+	ticker := time.NewTicker(UsageSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			s.recordVMUsage(hostID)
+		}
+		cutoff := time.Now().Add(-usageRetention)
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&storage.VMUsageSample{}).Error; err != nil {
+			log.Printf("Warning: failed to prune VM usage history: %v", err)
+		}
+	}
+}
+
+// recordVMUsage stores a usage sample for each VM of a host. When the disks
+// of a VM cannot be read, its previous storage size is carried over.
+func (s *HostService) recordVMUsage(hostID string) {
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ?", hostID).Find(&vms).Error; err != nil {
+		log.Printf("Warning: failed to list VMs of host %s for usage sampling: %v", hostID, err)
+		return
+	}
+	for _, vm := range vms {
+		storageBytes, err := s.connector.GetDomainDiskCapacity(hostID, vm.Name)
+		if err != nil {
+			var previous storage.VMUsageSample
+			s.db.Where("vm_uuid = ?", vm.UUID).Order("created_at DESC").Limit(1).Find(&previous)
+			storageBytes = previous.StorageBytes
+		}
+		sample := storage.VMUsageSample{
+			VMUUID:       vm.UUID,
+			VMName:       vm.Name,
+			HostID:       hostID,
+			Running:      vm.State == storage.StateActive || vm.State == storage.StatePaused,
+			VCPUs:        vm.VCPUCount,
+			MemoryBytes:  vm.MemoryBytes,
+			StorageBytes: storageBytes,
+		}
+		if err := s.db.Create(&sample).Error; err != nil {
+			log.Printf("Warning: failed to record usage of VM %s on host %s: %v", vm.Name, hostID, err)
+		}
+	}
+}
+
+// GetCostRates returns the unit costs of showback reports.
+func (s *HostService) GetCostRates() (*storage.CostRates, error) {
+	var rates storage.CostRates
+	if err := s.db.Limit(1).Find(&rates).Error; err != nil {
+		return nil, err
+	}
+	return &rates, nil
+}
+
+// SetCostRates changes the unit costs. Reports always use the current rates,
+// also for past usage.
+func (s *HostService) SetCostRates(rates storage.CostRates) (*storage.CostRates, error) {
+	var v validator
+	for _, rate := range []struct {
+		field string
+		value float64
+	}{{"vcpu_hour", rates.VCPUHour}, {"memory_gb_hour", rates.MemoryGBHour}, {"storage_gb_hour", rates.StorageGBHour}} {
+		if rate.value < 0 || math.IsInf(rate.value, 0) {
+			v.add(rate.field, "must be zero or more")
+		}
+	}
+	rates.Currency = strings.TrimSpace(rates.Currency)
+	if len(rates.Currency) > 8 {
+		v.add("currency", "must be at most 8 characters")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	rates.ID = 1
+	if err := s.db.Save(&rates).Error; err != nil {
+		return nil, fmt.Errorf("failed to save cost rates: %w", err)
+	}
+	s.recordAudit("costs.update", "costs", "global", fmt.Sprintf("vcpu_hour=%g memory_gb_hour=%g storage_gb_hour=%g currency=%s",
+		rates.VCPUHour, rates.MemoryGBHour, rates.StorageGBHour, rates.Currency))
+	return s.GetCostRates()
+}
+
+// vmUsageTotals is the summed usage samples of one VM.
+type vmUsageTotals struct {
+	VMUUID       string
+	VMName       string
+	HostID       string
+	VCPUs        float64 `gorm:"column:vcpus"` // Summed over running samples
+	MemoryBytes  float64 // Summed over running samples
+	StorageBytes float64 // Summed over all samples
+}
+
+// GetCostReport sums the sampled usage of every VM over a time range,
+// including VMs deleted since, and prices it at the current rates. VMs are
+// grouped by their current, or last known, owner or label.
+func (s *HostService) GetCostReport(filter CostReportFilter) (*CostReport, error) {
+	if filter.To.IsZero() {
+		filter.To = time.Now()
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultReportRange)
+	}
+	if filter.GroupBy == "" {
+		filter.GroupBy = CostGroupVM
+	}
+	var v validator
+	if !filter.From.Before(filter.To) {
+		v.add("from", "must be before to")
+	}
+	labelKey, byLabel := strings.CutPrefix(filter.GroupBy, costGroupLabelPrefix)
+	switch {
+	case byLabel:
+		v.labelKey("group_by", labelKey)
+	case filter.GroupBy != CostGroupVM && filter.GroupBy != CostGroupHost && filter.GroupBy != CostGroupOwner:
+		v.add("group_by", "must be vm, host, owner or label:<key>")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	rates, err := s.GetCostRates()
+	if err != nil {
+		return nil, err
+	}
+	var totals []vmUsageTotals
+	err = s.db.Model(&storage.VMUsageSample{}).
+		Select("vm_uuid, MAX(vm_name) AS vm_name, MAX(host_id) AS host_id, "+
+			"SUM(CASE WHEN running THEN vcpus ELSE 0 END) AS vcpus, "+
+			"SUM(CASE WHEN running THEN memory_bytes ELSE 0 END) AS memory_bytes, "+
+			"SUM(storage_bytes) AS storage_bytes").
+		Where("created_at > ? AND created_at <= ?", filter.From, filter.To).
+		Group("vm_uuid").
+		Scan(&totals).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to sum VM usage: %w", err)
+	}
+
+	groupOf, err := s.costGroups(filter.GroupBy, labelKey, byLabel, totals)
+	if err != nil {
+		return nil, err
+	}
+
+	hours := UsageSampleInterval.Hours()
+	rows := make(map[string]*CostReportRow)
+	report := &CostReport{
+		From:     filter.From,
+		To:       filter.To,
+		GroupBy:  filter.GroupBy,
+		Currency: rates.Currency,
+		Rates:    *rates,
+		Rows:     []CostReportRow{},
+		Total:    CostReportRow{Group: "total"},
+	}
+	for _, t := range totals {
+		key := groupOf(t)
+		row := rows[key]
+		if row == nil {
+			row = &CostReportRow{Group: key}
+			switch filter.GroupBy {
+			case CostGroupVM:
+				row.Group, row.VMUUID, row.HostID = t.VMName, t.VMUUID, t.HostID
+			case CostGroupHost:
+				row.Group, row.HostID = s.hostName(t.HostID), t.HostID
+			}
+			rows[key] = row
+		}
+		for _, r := range []*CostReportRow{row, &report.Total} {
+			r.VMs++
+			r.VCPUHours += t.VCPUs * hours
+			r.MemoryGBHours += t.MemoryBytes / bytesPerGB * hours
+			r.StorageGBHours += t.StorageBytes / bytesPerGB * hours
+		}
+	}
+	for _, row := range rows {
+		report.Rows = append(report.Rows, row.priced(rates))
+	}
+	report.Total = report.Total.priced(rates)
+	sort.Slice(report.Rows, func(i, j int) bool {
+		if report.Rows[i].Cost != report.Rows[j].Cost {
+			return report.Rows[i].Cost > report.Rows[j].Cost
+		}
+		return report.Rows[i].Group < report.Rows[j].Group
+	})
+	return report, nil
+}
+
+// costGroups returns a function giving the group key of a VM's usage.
+func (s *HostService) costGroups(groupBy, labelKey string, byLabel bool, totals []vmUsageTotals) (func(vmUsageTotals) string, error) {
+	switch {
+	case groupBy == CostGroupVM:
+		return func(t vmUsageTotals) string { return t.VMUUID }, nil
+	case groupBy == CostGroupHost:
+		return func(t vmUsageTotals) string { return t.HostID }, nil
+	}
+
+	uuids := make([]string, len(totals))
+	for i, t := range totals {
+		uuids[i] = t.VMUUID
+	}
+	var values []struct {
+		UUID  string
+		Value string
+	}
+	query := s.db.Table("virtual_machines").Where("virtual_machines.uuid IN ?", uuids)
+	if byLabel {
+		query = query.Select("virtual_machines.uuid, vm_labels.value").
+			Joins("JOIN vm_labels ON vm_labels.vm_id = virtual_machines.id AND vm_labels.key = ?", labelKey)
+	} else {
+		query = query.Select("virtual_machines.uuid, vm_custom_fields.value").
+			Joins("JOIN vm_custom_fields ON vm_custom_fields.vm_id = virtual_machines.id AND vm_custom_fields.name = ?", ownerField)
+	}
+	if err := query.Scan(&values).Error; err != nil {
+		return nil, fmt.Errorf("failed to look up VM groups: %w", err)
+	}
+	byUUID := make(map[string]string, len(values))
+	for _, value := range values {
+		byUUID[value.UUID] = value.Value
+	}
+	return func(t vmUsageTotals) string { return byUUID[t.VMUUID] }, nil
+}
+
+// hostName returns the name of a host, or its ID once it is removed.
+func (s *HostService) hostName(hostID string) string {
+	var host storage.Host
+	if err := s.db.Select("name").Where("id = ?", hostID).Limit(1).Find(&host).Error; err != nil || host.Name == "" {
+		return hostID
+	}
+	return host.Name
+}
+
+// priced fills in the costs of a row's usage, rounding to cents.
+func (row CostReportRow) priced(rates *storage.CostRates) CostReportRow {
+	row.VCPUCost = roundCents(row.VCPUHours * rates.VCPUHour)
+	row.MemoryCost = roundCents(row.MemoryGBHours * rates.MemoryGBHour)
+	row.StorageCost = roundCents(row.StorageGBHours * rates.StorageGBHour)
+	row.Cost = roundCents(row.VCPUHours*rates.VCPUHour + row.MemoryGBHours*rates.MemoryGBHour + row.StorageGBHours*rates.StorageGBHour)
+	row.VCPUHours = roundCents(row.VCPUHours)
+	row.MemoryGBHours = roundCents(row.MemoryGBHours)
+	row.StorageGBHours = roundCents(row.StorageGBHours)
+	return row
+}
+
+func roundCents(x float64) float64 {
+	return math.Round(x*100) / 100
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// orphanCheck finds rows of a table that belong to nothing: their owner was
+// deleted, or they were soft-deleted themselves and are never read again.
+type orphanCheck struct {
+	name        string
+	table       string
+	description string
+	where       string
+}
+
+const (
+	liveVMs             = "SELECT id FROM virtual_machines WHERE deleted_at IS NULL"
+	liveGraphicsDevices = "SELECT id FROM graphics_devices WHERE deleted_at IS NULL"
+	liveVolumes         = "SELECT id FROM volumes WHERE deleted_at IS NULL"
+	livePorts           = "SELECT id FROM ports WHERE deleted_at IS NULL"
+	liveNetworks        = "SELECT id FROM networks WHERE deleted_at IS NULL"
+)
+
+// orphanChecks are run in order, so that rows orphaned by an earlier check's
+// deletions are found by a later one. Soft-deleted ports are not orphans:
+// they keep their MAC address from being handed out again.
+var orphanChecks = []orphanCheck{
+	{
+		name:        "graphics-device-attachments",
+		table:       "graphics_device_attachments",
+		description: "Graphics device attachments that were deleted, or whose VM or device is gone",
+		where:       "deleted_at IS NOT NULL OR vm_id NOT IN (" + liveVMs + ") OR graphics_device_id NOT IN (" + liveGraphicsDevices + ")",
+	},
+	{
+		name:        "graphics-devices",
+		table:       "graphics_devices",
+		description: "Graphics devices that were deleted, belong to a deleted VM or are attached to none",
+		where:       "deleted_at IS NOT NULL OR vm_id NOT IN (" + liveVMs + ") OR id NOT IN (SELECT graphics_device_id FROM graphics_device_attachments WHERE deleted_at IS NULL)",
+	},
+	{
+		name:        "volume-attachments",
+		table:       "volume_attachments",
+		description: "Volume attachments that were deleted, or whose VM or volume is gone",
+		where:       "deleted_at IS NOT NULL OR vm_id NOT IN (" + liveVMs + ") OR volume_id NOT IN (" + liveVolumes + ")",
+	},
+	{
+		name:        "port-bindings",
+		table:       "port_bindings",
+		description: "Port bindings that were deleted, or whose port or network is gone",
+		where:       "deleted_at IS NOT NULL OR port_id NOT IN (" + livePorts + ") OR network_id NOT IN (" + liveNetworks + ")",
+	},
+	{
+		name:        "vm-custom-fields",
+		table:       "vm_custom_fields",
+		description: "Custom fields of deleted VMs",
+		where:       "vm_id NOT IN (" + liveVMs + ")",
+	},
+	{
+		name:        "vm-labels",
+		table:       "vm_labels",
+		description: "Labels of deleted VMs",
+		where:       "vm_id NOT IN (" + liveVMs + ")",
+	},
+}
+
+// OrphanCount is the number of orphaned rows one check found, or removed.
+type OrphanCount struct {
+	Check       string `json:"check"`
+	Table       string `json:"table"`
+	Description string `json:"description"`
+	Rows        int64  `json:"rows"`
+}
+
+// DBConsistencyReport lists the orphaned rows of the database.
+type DBConsistencyReport struct {
+	CheckedAt time.Time     `json:"checked_at"`
+	Orphans   []OrphanCount `json:"orphans"`
+	Total     int64         `json:"total"`
+}
+
+// CheckDBConsistency counts the orphaned rows of the database without
+// changing anything. The garbage collection removes them periodically.
+func (s *HostService) CheckDBConsistency() (*DBConsistencyReport, error) {
+	report := &DBConsistencyReport{CheckedAt: time.Now(), Orphans: []OrphanCount{}}
+	for _, check := range orphanChecks {
+		var rows int64
+		if err := s.db.Table(check.table).Where(check.where).Count(&rows).Error; err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", check.table, err)
+		}
+		report.add(check, rows)
+	}
+	return report, nil
+}
+
+// CollectDBGarbage deletes the orphaned rows of the database and reports
+// how many were removed.
+func (s *HostService) CollectDBGarbage() (*DBConsistencyReport, error) {
+	report := &DBConsistencyReport{CheckedAt: time.Now(), Orphans: []OrphanCount{}}
+	for _, check := range orphanChecks {
+		result := s.db.Exec("DELETE FROM " + check.table + " WHERE " + check.where)
+		if result.Error != nil {
+			return nil, fmt.Errorf("failed to clean up %s: %w", check.table, result.Error)
+		}
+		report.add(check, result.RowsAffected)
+	}
+	return report, nil
+}
+
+func (r *DBConsistencyReport) add(check orphanCheck, rows int64) {
+	r.Orphans = append(r.Orphans, OrphanCount{
+		Check:       check.name,
+		Table:       check.table,
+		Description: check.description,
+		Rows:        rows,
+	})
+	r.Total += rows
+}
+
+// StartDBGarbageCollection deletes orphaned rows every interval.
+func (s *HostService) StartDBGarbageCollection(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := s.CollectDBGarbage()
+		if err != nil {
+			log.Printf("Warning: database garbage collection failed: %v", err)
+			continue
+		}
+		if report.Total > 0 {
+			log.Printf("Database garbage collection removed %d orphaned rows", report.Total)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+// PermissionViewDiagnostics allows reading runtime diagnostics and profiles.
+const PermissionViewDiagnostics = "diagnostics.view"
+
+// MonitorStats counts the live stats subscriptions and their pollers.
+type MonitorStats struct {
+	VMSubscriptions   int `json:"vm_subscriptions"`     // VMs polled for a client; one poller each
+	VMSubscribers     int `json:"vm_subscribers"`       // Client subscriptions over all VMs
+	HostSubscriptions int `json:"host_subscriptions"`   // Hosts whose VMs are polled in bulk
+	HostSubscribers   int `json:"host_subscribers"`     // Client subscriptions over all hosts
+	CachedHostVMStats int `json:"cached_host_vm_stats"` // VM stats kept by the host pollers
+}
+
+func (m *MonitoringManager) stats() MonitorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := MonitorStats{
+		VMSubscriptions:   len(m.subscriptions),
+		HostSubscriptions: len(m.hostSubscriptions),
+	}
+	for _, sub := range m.subscriptions {
+		stats.VMSubscribers += len(sub.clients)
+	}
+	for _, sub := range m.hostSubscriptions {
+		stats.HostSubscribers += len(sub.clients)
+		stats.CachedHostVMStats += len(sub.lastStats)
+	}
+	return stats
+}
+
+// RuntimeDiagnostics is a snapshot of the process, for tracking down leaks
+// in long-running deployments.
+type RuntimeDiagnostics struct {
+	StartedAt     time.Time    `json:"started_at"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	GoVersion     string       `json:"go_version"`
+	Goroutines    int          `json:"goroutines"`
+	CPUs          int          `json:"cpus"`
+	Heap          HeapStats    `json:"heap"`
+	Hub           ws.HubStats  `json:"hub"`
+	Monitor       MonitorStats `json:"monitor"`
+}
+
+// HeapStats is the part of runtime.MemStats that shows a leak.
+type HeapStats struct {
+	AllocBytes     uint64     `json:"alloc_bytes"` // Live heap objects
+	InuseBytes     uint64     `json:"inuse_bytes"` // Heap spans in use
+	SysBytes       uint64     `json:"sys_bytes"`   // Memory obtained from the OS for everything
+	Objects        uint64     `json:"objects"`     // Live heap objects
+	NumGC          uint32     `json:"num_gc"`      // Completed GC cycles
+	LastGC         *time.Time `json:"last_gc,omitempty"`
+	PauseTotalSecs float64    `json:"pause_total_seconds"`
+}
+
+var processStart = time.Now()
+
+// GetRuntimeDiagnostics reports goroutines, heap usage, WebSocket queues and
+// stats subscriptions. Reading the heap statistics briefly stops the world.
+func (s *HostService) GetRuntimeDiagnostics() *RuntimeDiagnostics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	diag := &RuntimeDiagnostics{
+		StartedAt:     processStart,
+		UptimeSeconds: time.Since(processStart).Seconds(),
+		GoVersion:     runtime.Version(),
+		Goroutines:    runtime.NumGoroutine(),
+		CPUs:          runtime.NumCPU(),
+		Heap: HeapStats{
+			AllocBytes:     mem.HeapAlloc,
+			InuseBytes:     mem.HeapInuse,
+			SysBytes:       mem.Sys,
+			Objects:        mem.HeapObjects,
+			NumGC:          mem.NumGC,
+			PauseTotalSecs: time.Duration(mem.PauseTotalNs).Seconds(),
+		},
+		Hub:     s.hub.Stats(),
+		Monitor: s.monitor.stats(),
+	}
+	if mem.LastGC != 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC))
+		diag.Heap.LastGC = &lastGC
+	}
+	return diag
+}
+
+// WriteMetrics writes the stats subscriptions in the Prometheus text
+// exposition format. The WebSocket topics are the stats of single VMs and
+// of all VMs of a host.
+func (s *HostService) WriteMetrics(w io.Writer) {
+	stats := s.monitor.stats()
+	fmt.Fprintln(w, "# HELP virtumancer_ws_topic_clients Client subscriptions to a WebSocket topic.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_topic_clients gauge")
+	fmt.Fprintf(w, "virtumancer_ws_topic_clients{topic=\"vm-stats\"} %d\n", stats.VMSubscribers)
+	fmt.Fprintf(w, "virtumancer_ws_topic_clients{topic=\"host-vms-stats\"} %d\n", stats.HostSubscribers)
+	fmt.Fprintln(w, "# HELP virtumancer_ws_topic_subscriptions VMs or hosts polled for the subscribers of a WebSocket topic.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_topic_subscriptions gauge")
+	fmt.Fprintf(w, "virtumancer_ws_topic_subscriptions{topic=\"vm-stats\"} %d\n", stats.VMSubscriptions)
+	fmt.Fprintf(w, "virtumancer_ws_topic_subscriptions{topic=\"host-vms-stats\"} %d\n", stats.HostSubscriptions)
+}
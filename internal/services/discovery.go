@@ -0,0 +1,521 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+// Host discovery probes subnets for the ports of SSH and of libvirtd's
+// unauthenticated TCP listener, and optionally browses mDNS records through
+// avahi, to offer machines that can be added as hosts.
+const (
+	DefaultDiscoveryInterval = 5 * time.Minute
+	MinDiscoveryInterval     = time.Minute
+	MaxDiscoveryInterval     = 24 * time.Hour
+
+	// maxDiscoveryAddresses bounds the addresses probed per scan, e.g. a
+	// single /20 or sixteen /24s.
+	maxDiscoveryAddresses = 4096
+	discoveryProbeTimeout = 500 * time.Millisecond
+	discoveryConcurrency  = 64
+	discoveryMDNSTimeout  = 5 * time.Second
+
+	sshPort        = 22
+	libvirtTCPPort = 16509
+)
+
+// mdnsServiceTypes are the mDNS services browsed for hosts: SSH servers and
+// libvirt daemons that advertise themselves.
+var mdnsServiceTypes = []string{"_ssh._tcp", "_sftp-ssh._tcp", "_libvirt._tcp"}
+
+var (
+	// ErrDiscoveryBusy is returned when a scan is requested while one runs.
+	ErrDiscoveryBusy = errors.New("a discovery scan is already running")
+	// ErrCandidateNotFound is returned for an address the last scan did not
+	// find.
+	ErrCandidateNotFound = errors.New("no discovered host with this address")
+)
+
+// DiscoveredHost is a machine found by discovery that could be added as a
+// host.
+type DiscoveredHost struct {
+	Address      string    `json:"address"`
+	Hostname     string    `json:"hostname,omitempty"` // From reverse DNS or mDNS
+	SSH          bool      `json:"ssh"`
+	SSHBanner    string    `json:"ssh_banner,omitempty"` // e.g. 'SSH-2.0-OpenSSH_9.2p1 Debian-2'
+	LibvirtTCP   bool      `json:"libvirt_tcp"`          // libvirtd listens on its plain TCP port
+	Sources      []string  `json:"sources"`              // 'scan' and/or 'mdns'
+	SuggestedURI string    `json:"suggested_uri"`
+	KnownHostID  string    `json:"known_host_id,omitempty"` // Set when a host with this address is already added
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// DiscoveryStatus is the state of host discovery and its latest results.
+type DiscoveryStatus struct {
+	Enabled    bool             `json:"enabled"`
+	Scanning   bool             `json:"scanning"`
+	LastScanAt *time.Time       `json:"last_scan_at"`
+	LastError  string           `json:"last_error,omitempty"`
+	Candidates []DiscoveredHost `json:"candidates"`
+}
+
+// DiscoverySettingsView is the discovery configuration with its defaults
+// filled in.
+type DiscoverySettingsView struct {
+	Enabled         bool     `json:"enabled"`
+	Subnets         []string `json:"subnets"`
+	MDNS            bool     `json:"mdns"`
+	IntervalSeconds uint     `json:"interval_seconds"`
+}
+
+// DiscoveryAdoptRequest adds a discovered machine as a host.
+type DiscoveryAdoptRequest struct {
+	Name      string `json:"name"`       // Defaults to the short hostname or the address
+	URI       string `json:"uri"`        // Defaults to the suggested URI
+	ProxyJump string `json:"proxy_jump"` // Optional bastion chain for SSH URIs
+}
+
+// discoveryState holds the results of the latest scan.
+type discoveryState struct {
+	mu         sync.Mutex
+	scanning   bool
+	lastScanAt time.Time
+	lastError  string
+	candidates map[string]*DiscoveredHost // keyed by address
+	trigger    chan struct{}
+}
+
+func newDiscoveryState() *discoveryState {
+	return &discoveryState{
+		candidates: make(map[string]*DiscoveredHost),
+		trigger:    make(chan struct{}, 1),
+	}
+}
+
+// loadDiscoverySettings returns the stored settings with defaults applied.
+func (s *HostService) loadDiscoverySettings() (*DiscoverySettingsView, error) {
+	var settings storage.DiscoverySettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	view := &DiscoverySettingsView{
+		Enabled:         settings.Enabled,
+		Subnets:         settings.Subnets,
+		MDNS:            settings.MDNS,
+		IntervalSeconds: settings.IntervalSeconds,
+	}
+	if view.Subnets == nil {
+		view.Subnets = []string{}
+	}
+	if view.IntervalSeconds == 0 {
+		view.IntervalSeconds = uint(DefaultDiscoveryInterval.Seconds())
+	}
+	return view, nil
+}
+
+// GetDiscoverySettings returns the discovery configuration.
+func (s *HostService) GetDiscoverySettings() (*DiscoverySettingsView, error) {
+	return s.loadDiscoverySettings()
+}
+
+// SetDiscoverySettings changes the discovery configuration. Enabling it
+// starts a scan right away.
+func (s *HostService) SetDiscoverySettings(req DiscoverySettingsView) (*DiscoverySettingsView, error) {
+	var v validator
+	total := 0
+	for i, subnet := range req.Subnets {
+		field := fmt.Sprintf("subnets[%d]", i)
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(subnet))
+		if err != nil || !prefix.Addr().Is4() {
+			v.add(field, "must be an IPv4 CIDR such as 192.168.1.0/24")
+			continue
+		}
+		req.Subnets[i] = prefix.Masked().String()
+		total += 1 << (32 - prefix.Bits())
+	}
+	if total > maxDiscoveryAddresses {
+		v.add("subnets", "cover %d addresses; at most %d can be probed", total, maxDiscoveryAddresses)
+	}
+	if req.Enabled && len(req.Subnets) == 0 && !req.MDNS {
+		v.add("subnets", "are required to enable discovery without mDNS")
+	}
+	interval := time.Duration(req.IntervalSeconds) * time.Second
+	if interval != 0 && (interval < MinDiscoveryInterval || interval > MaxDiscoveryInterval) {
+		v.add("interval_seconds", "must be 0 (default) or between %v and %v", MinDiscoveryInterval.Seconds(), MaxDiscoveryInterval.Seconds())
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	row := storage.DiscoverySettings{ID: 1, Enabled: req.Enabled, Subnets: req.Subnets, MDNS: req.MDNS, IntervalSeconds: req.IntervalSeconds}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save discovery settings: %w", err)
+	}
+	s.recordAudit("discovery.update", "discovery", "global",
+		fmt.Sprintf("enabled=%t subnets=%s mdns=%t", req.Enabled, strings.Join(req.Subnets, ","), req.MDNS))
+	if req.Enabled {
+		s.requestDiscoveryScan()
+	}
+	return s.loadDiscoverySettings()
+}
+
+// GetDiscoveryStatus returns the hosts found by the latest scan, ordered by
+// address.
+func (s *HostService) GetDiscoveryStatus() (*DiscoveryStatus, error) {
+	settings, err := s.loadDiscoverySettings()
+	if err != nil {
+		return nil, err
+	}
+	known, err := s.knownHostAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	d := s.discovery
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := &DiscoveryStatus{
+		Enabled:    settings.Enabled,
+		Scanning:   d.scanning,
+		LastError:  d.lastError,
+		Candidates: make([]DiscoveredHost, 0, len(d.candidates)),
+	}
+	if !d.lastScanAt.IsZero() {
+		lastScanAt := d.lastScanAt
+		status.LastScanAt = &lastScanAt
+	}
+	for _, candidate := range d.candidates {
+		c := *candidate
+		c.KnownHostID = known[c.Address]
+		if c.KnownHostID == "" && c.Hostname != "" {
+			c.KnownHostID = known[c.Hostname]
+		}
+		status.Candidates = append(status.Candidates, c)
+	}
+	sort.Slice(status.Candidates, func(i, j int) bool {
+		a, _ := netip.ParseAddr(status.Candidates[i].Address)
+		b, _ := netip.ParseAddr(status.Candidates[j].Address)
+		return a.Less(b)
+	})
+	return status, nil
+}
+
+// knownHostAddresses maps the machine named in each host's URI to the host.
+func (s *HostService) knownHostAddresses() (map[string]string, error) {
+	var hosts []storage.Host
+	if err := s.db.Select("id", "uri").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	known := make(map[string]string, len(hosts))
+	for _, host := range hosts {
+		if uri, err := libvirt.ParseHostURI(host.URI); err == nil && uri.URL.Hostname() != "" {
+			known[strings.TrimSuffix(uri.URL.Hostname(), ".")] = host.ID
+		}
+	}
+	return known, nil
+}
+
+// ScanForHosts starts a discovery scan now, whether or not periodic scans
+// are enabled.
+func (s *HostService) ScanForHosts() error {
+	d := s.discovery
+	d.mu.Lock()
+	scanning := d.scanning
+	d.mu.Unlock()
+	if scanning {
+		return ErrDiscoveryBusy
+	}
+	s.requestDiscoveryScan()
+	return nil
+}
+
+func (s *HostService) requestDiscoveryScan() {
+	select {
+	case s.discovery.trigger <- struct{}{}:
+	default: // A scan is already pending
+	}
+}
+
+// StartDiscovery runs discovery scans when enabled and the discovery feature
+// is on, every configured interval, and whenever one is requested.
+func (s *HostService) StartDiscovery() {
+	ticker := time.NewTicker(MinDiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		manual := false
+		select {
+		case <-ticker.C:
+		case <-s.discovery.trigger:
+			manual = true
+		}
+		settings, err := s.loadDiscoverySettings()
+		if err != nil {
+			log.Printf("Warning: failed to load discovery settings: %v", err)
+			continue
+		}
+		s.discovery.mu.Lock()
+		due := time.Since(s.discovery.lastScanAt) >= time.Duration(settings.IntervalSeconds)*time.Second
+		s.discovery.mu.Unlock()
+		if manual || (settings.Enabled && due && s.featureEnabled(FeatureDiscovery)) {
+			s.runDiscoveryScan(settings)
+		}
+	}
+}
+
+// runDiscoveryScan probes the configured subnets and mDNS records and
+// replaces the candidates with what was found.
+func (s *HostService) runDiscoveryScan(settings *DiscoverySettingsView) {
+	d := s.discovery
+	d.mu.Lock()
+	d.scanning = true
+	d.mu.Unlock()
+	s.broadcastDiscoveryChanged()
+
+	found := make(map[string]*DiscoveredHost)
+	var problems []string
+	for _, subnet := range settings.Subnets {
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", subnet, err))
+			continue
+		}
+		for _, candidate := range probeSubnet(prefix) {
+			found[candidate.Address] = candidate
+		}
+	}
+	if settings.MDNS {
+		records, err := browseMDNS()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("mDNS: %v", err))
+		}
+		for _, record := range records {
+			candidate, ok := found[record.Address]
+			if !ok {
+				candidate = &DiscoveredHost{Address: record.Address}
+				found[record.Address] = candidate
+			}
+			if !slices.Contains(candidate.Sources, "mdns") {
+				candidate.Sources = append(candidate.Sources, "mdns")
+			}
+			if candidate.Hostname == "" {
+				candidate.Hostname = record.Hostname
+			}
+			switch record.Service {
+			case "_libvirt._tcp":
+				candidate.LibvirtTCP = candidate.LibvirtTCP || record.Port == libvirtTCPPort
+			default:
+				candidate.SSH = true
+			}
+		}
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	for address, candidate := range found {
+		candidate.FirstSeen, candidate.LastSeen = now, now
+		if previous, ok := d.candidates[address]; ok {
+			candidate.FirstSeen = previous.FirstSeen
+		}
+		candidate.SuggestedURI = suggestedHostURI(candidate)
+	}
+	d.candidates = found
+	d.scanning = false
+	d.lastScanAt = now
+	d.lastError = strings.Join(problems, "; ")
+	d.mu.Unlock()
+
+	if len(problems) > 0 {
+		log.Printf("Warning: host discovery: %s", strings.Join(problems, "; "))
+	}
+	s.broadcastDiscoveryChanged()
+}
+
+func (s *HostService) broadcastDiscoveryChanged() {
+	s.hub.BroadcastMessage(ws.Message{Type: "discovery-changed"})
+}
+
+// suggestedHostURI is the URI a discovered machine would most likely be
+// added with: SSH as root when it runs an SSH server, plain TCP otherwise.
+func suggestedHostURI(candidate *DiscoveredHost) string {
+	address := candidate.Address
+	if candidate.SSH || !candidate.LibvirtTCP {
+		return fmt.Sprintf("qemu+ssh://root@%s/system", address)
+	}
+	return fmt.Sprintf("qemu+tcp://%s/system", address)
+}
+
+// probeSubnet checks every host address of a subnet for the SSH and libvirt
+// TCP ports.
+func probeSubnet(prefix netip.Prefix) []*DiscoveredHost {
+	addresses := make(chan netip.Addr)
+	results := make(chan *DiscoveredHost)
+	var wg sync.WaitGroup
+	for i := 0; i < discoveryConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for addr := range addresses {
+				if candidate := probeAddress(addr); candidate != nil {
+					results <- candidate
+				}
+			}
+		}()
+	}
+	go func() {
+		prefix = prefix.Masked()
+		for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+			if prefix.Bits() < 31 && (addr == prefix.Addr() || isBroadcast(prefix, addr)) {
+				continue
+			}
+			addresses <- addr
+		}
+		close(addresses)
+		wg.Wait()
+		close(results)
+	}()
+
+	var found []*DiscoveredHost
+	for candidate := range results {
+		found = append(found, candidate)
+	}
+	return found
+}
+
+// isBroadcast reports whether addr is the broadcast address of an IPv4
+// subnet.
+func isBroadcast(prefix netip.Prefix, addr netip.Addr) bool {
+	a := addr.As4()
+	hostBits := uint32(1)<<(32-prefix.Bits()) - 1
+	return binary.BigEndian.Uint32(a[:])&hostBits == hostBits
+}
+
+// probeAddress connects to the SSH and libvirt ports of one address. It
+// returns nil when neither is open.
+func probeAddress(addr netip.Addr) *DiscoveredHost {
+	candidate := &DiscoveredHost{Address: addr.String(), Sources: []string{"scan"}}
+	if conn, err := net.DialTimeout("tcp", netip.AddrPortFrom(addr, sshPort).String(), discoveryProbeTimeout); err == nil {
+		candidate.SSH = true
+		conn.SetReadDeadline(time.Now().Add(discoveryProbeTimeout))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil && strings.HasPrefix(line, "SSH-") {
+			candidate.SSHBanner = strings.TrimSpace(line)
+		}
+		conn.Close()
+	}
+	if conn, err := net.DialTimeout("tcp", netip.AddrPortFrom(addr, libvirtTCPPort).String(), discoveryProbeTimeout); err == nil {
+		candidate.LibvirtTCP = true
+		conn.Close()
+	}
+	if !candidate.SSH && !candidate.LibvirtTCP {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryProbeTimeout)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, candidate.Address); err == nil && len(names) > 0 {
+		candidate.Hostname = strings.TrimSuffix(names[0], ".")
+	}
+	return candidate
+}
+
+// mdnsRecord is a resolved service advertised over mDNS.
+type mdnsRecord struct {
+	Service  string
+	Hostname string
+	Address  string
+	Port     int
+}
+
+// browseMDNS lists the IPv4 SSH and libvirt services advertised on the local
+// network, using avahi-browse.
+func browseMDNS() ([]mdnsRecord, error) {
+	if _, err := exec.LookPath("avahi-browse"); err != nil {
+		return nil, errors.New("avahi-browse is not installed")
+	}
+	var records []mdnsRecord
+	for _, service := range mdnsServiceTypes {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryMDNSTimeout)
+		output, err := exec.CommandContext(ctx, "avahi-browse", "--parsable", "--resolve", "--terminate", "--no-db-lookup", service).Output()
+		cancel()
+		if err != nil && len(output) == 0 {
+			return records, fmt.Errorf("avahi-browse %s: %w", service, err)
+		}
+		records = append(records, parseAvahiBrowse(output)...)
+	}
+	return records, nil
+}
+
+// parseAvahiBrowse reads the resolved IPv4 entries of avahi-browse's
+// parsable output: =;iface;IPv4;name;type;domain;hostname;address;port;txt
+func parseAvahiBrowse(output []byte) []mdnsRecord {
+	var records []mdnsRecord
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ";")
+		if len(fields) < 9 || fields[0] != "=" || fields[2] != "IPv4" {
+			continue
+		}
+		port, err := strconv.Atoi(fields[8])
+		if err != nil {
+			continue
+		}
+		records = append(records, mdnsRecord{
+			Service:  fields[4],
+			Hostname: strings.TrimSuffix(fields[6], "."),
+			Address:  fields[7],
+			Port:     port,
+		})
+	}
+	return records
+}
+
+// AdoptDiscoveredHost adds a machine found by discovery as a host, with the
+// suggested URI unless another is given.
+func (s *HostService) AdoptDiscoveredHost(address string, req DiscoveryAdoptRequest) (*storage.Host, error) {
+	d := s.discovery
+	d.mu.Lock()
+	candidate, ok := d.candidates[address]
+	var found DiscoveredHost
+	if ok {
+		found = *candidate
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCandidateNotFound, address)
+	}
+
+	host := storage.Host{Name: req.Name, URI: req.URI, ProxyJump: req.ProxyJump}
+	if host.URI == "" {
+		host.URI = found.SuggestedURI
+	}
+	if host.Name == "" {
+		host.Name = strings.ReplaceAll(address, ".", "-")
+		if short, _, _ := strings.Cut(found.Hostname, "."); hostNamePattern.MatchString(short) {
+			host.Name = short
+		}
+	}
+	added, err := s.AddHost(host)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("discovery.adopt", "host", added.ID, fmt.Sprintf("address=%s uri=%s", address, added.URI))
+	return added, nil
+}
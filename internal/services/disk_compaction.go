@@ -0,0 +1,303 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrDiskCompactionInProgress is returned when the disks of a VM are being
+// compacted, which keeps the VM from starting.
+var ErrDiskCompactionInProgress = errors.New("disks are being compacted")
+
+// DefaultDiskCompactionIntervalHours is the time between two runs of a
+// host's compaction policy unless it sets its own.
+const DefaultDiskCompactionIntervalHours = 168
+
+// DiskCompactionRequest compacts the disks of a shut-off VM. An empty
+// method selects convert; no disks selects all of them.
+type DiskCompactionRequest struct {
+	Method   string   `json:"method"`
+	Compress bool     `json:"compress"`
+	Disks    []string `json:"disks"` // Targets, e.g. "vda".
+}
+
+// DiskCompactionPolicyRequest configures the compaction policy of a host.
+// An empty method and a zero interval select the defaults.
+type DiskCompactionPolicyRequest struct {
+	Enabled       bool   `json:"enabled"`
+	Method        string `json:"method"`
+	Compress      bool   `json:"compress"`
+	IntervalHours uint   `json:"interval_hours"`
+}
+
+// DiskCompactionResult is the outcome of compacting one disk, reported in
+// the metrics of the compaction task.
+type DiskCompactionResult struct {
+	Target      string `json:"target"`
+	Path        string `json:"path"`
+	BeforeBytes uint64 `json:"before_bytes"`
+	AfterBytes  uint64 `json:"after_bytes"`
+	Error       string `json:"error,omitempty"`
+}
+
+// diskCompaction is a compaction of a VM's disks ready to run.
+type diskCompaction struct {
+	hostID   string
+	vmName   string
+	method   string
+	compress bool
+	disks    []libvirt.CompactableDisk
+	task     *storage.Task
+}
+
+func diskCompactionKey(hostID, vmName string) string {
+	return hostID + "/" + vmName
+}
+
+func validateCompactionMethod(v *validator, method string, compress bool) {
+	switch method {
+	case libvirt.CompactionConvert:
+	case libvirt.CompactionSparsify:
+		if compress {
+			v.add("compress", "only applies to the convert method")
+		}
+	default:
+		v.add("method", "must be '%s' or '%s'", libvirt.CompactionConvert, libvirt.CompactionSparsify)
+	}
+}
+
+// CompactVMDisks reclaims the space freed inside the disk images of a
+// shut-off VM as a task. The VM cannot be started until the task ends. The
+// task reports the size of each image before and after in its metrics.
+func (s *HostService) CompactVMDisks(hostID, vmName string, req DiskCompactionRequest) (*storage.Task, error) {
+	c, err := s.beginDiskCompaction(hostID, vmName, req, "")
+	if err != nil {
+		return nil, err
+	}
+	started := copyTask(c.task)
+	go s.runDiskCompaction(c)
+	return started, nil
+}
+
+// beginDiskCompaction checks a compaction request, marks the VM as being
+// compacted and starts its task.
+func (s *HostService) beginDiskCompaction(hostID, vmName string, req DiskCompactionRequest, trigger string) (*diskCompaction, error) {
+	if req.Method == "" {
+		req.Method = libvirt.CompactionConvert
+	}
+	var v validator
+	validateCompactionMethod(&v, req.Method, req.Compress)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	// Registered before the VM's state is checked, so StartVM cannot slip in
+	// between.
+	key := diskCompactionKey(hostID, vmName)
+	if _, running := s.diskCompactions.LoadOrStore(key, true); running {
+		return nil, fmt.Errorf("%w: %s", ErrDiskCompactionInProgress, vmName)
+	}
+	disks, err := s.connector.CompactionDisks(hostID, vmName)
+	if err != nil {
+		s.diskCompactions.Delete(key)
+		return nil, err
+	}
+	if len(req.Disks) > 0 {
+		selected := make([]libvirt.CompactableDisk, 0, len(req.Disks))
+		for _, target := range req.Disks {
+			found := false
+			for _, disk := range disks {
+				if disk.Target == target {
+					selected = append(selected, disk)
+					found = true
+					break
+				}
+			}
+			if !found {
+				v.add("disks", "%s has no file-backed qcow2 or raw disk '%s'", vmName, target)
+			}
+		}
+		disks = selected
+	} else if len(disks) == 0 {
+		v.add("disks", "%s has no file-backed qcow2 or raw disks", vmName)
+	}
+	if err := v.err(); err != nil {
+		s.diskCompactions.Delete(key)
+		return nil, err
+	}
+
+	details := fmt.Sprintf("Compacting %d disks of %s with %s", len(disks), vmName, req.Method)
+	if trigger != "" {
+		details += " (" + trigger + ")"
+	}
+	task, err := s.tasks.Start("vm.disk.compact", details)
+	if err != nil {
+		s.diskCompactions.Delete(key)
+		return nil, err
+	}
+	targets := make([]string, len(disks))
+	for i, disk := range disks {
+		targets[i] = disk.Target
+	}
+	s.recordAudit("vm.disk.compact", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("method=%s compress=%t disks=%s", req.Method, req.Compress, strings.Join(targets, ",")))
+	return &diskCompaction{hostID: hostID, vmName: vmName, method: req.Method, compress: req.Compress, disks: disks, task: task}, nil
+}
+
+// runDiskCompaction compacts the disks one after another. A disk that fails
+// is left as it was and the others are still compacted.
+func (s *HostService) runDiskCompaction(c *diskCompaction) {
+	defer s.diskCompactions.Delete(diskCompactionKey(c.hostID, c.vmName))
+
+	results := make([]DiskCompactionResult, 0, len(c.disks))
+	var reclaimed uint64
+	var failed []string
+	for i, disk := range c.disks {
+		s.tasks.Step(c.task, 100*i/len(c.disks), fmt.Sprintf("Compacting %s (%s)", disk.Target, disk.Path))
+		result := DiskCompactionResult{Target: disk.Target, Path: disk.Path}
+		before, after, err := s.connector.CompactDisk(c.hostID, disk.Path, c.method, c.compress)
+		result.BeforeBytes, result.AfterBytes = before, after
+		if err != nil {
+			result.Error = err.Error()
+			failed = append(failed, disk.Target)
+			s.tasks.Step(c.task, c.task.Progress, fmt.Sprintf("Could not compact %s: %v", disk.Target, err))
+		} else if before > after {
+			reclaimed += before - after
+		}
+		results = append(results, result)
+		s.tasks.Report(c.task, 100*(i+1)/len(c.disks), map[string]interface{}{
+			"disks":           results,
+			"reclaimed_bytes": reclaimed,
+		})
+	}
+
+	var err error
+	if len(failed) > 0 {
+		err = fmt.Errorf("%d of %d disks of %s could not be compacted: %s", len(failed), len(c.disks), c.vmName, strings.Join(failed, ", "))
+		log.Printf("Disk compaction of %s on host %s incomplete: %v", c.vmName, c.hostID, err)
+	} else {
+		s.tasks.Step(c.task, 100, fmt.Sprintf("Reclaimed %d MiB", reclaimed>>20))
+	}
+	s.tasks.Finish(c.task, err)
+	if err := s.RefreshStoragePools(c.hostID); err != nil {
+		log.Printf("Warning: failed to refresh storage pools for host %s: %v", c.hostID, err)
+	}
+}
+
+// GetDiskCompactionPolicy returns the disk compaction policy of a host, or
+// a disabled one with the defaults if none was set.
+func (s *HostService) GetDiskCompactionPolicy(hostID string) (*storage.DiskCompactionPolicy, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	policy := storage.DiskCompactionPolicy{HostID: hostID}
+	if err := s.db.Where("host_id = ?", hostID).Limit(1).Find(&policy).Error; err != nil {
+		return nil, err
+	}
+	applyDiskCompactionDefaults(&policy)
+	return &policy, nil
+}
+
+// SetDiskCompactionPolicy enables, disables or reconfigures the disk
+// compaction policy of a host. The time of the last run is kept.
+func (s *HostService) SetDiskCompactionPolicy(hostID string, req DiskCompactionPolicyRequest) (*storage.DiskCompactionPolicy, error) {
+	policy, err := s.GetDiskCompactionPolicy(hostID)
+	if err != nil {
+		return nil, err
+	}
+	policy.Enabled = req.Enabled
+	policy.Method = req.Method
+	policy.Compress = req.Compress
+	policy.IntervalHours = req.IntervalHours
+	applyDiskCompactionDefaults(policy)
+	var v validator
+	validateCompactionMethod(&v, policy.Method, policy.Compress)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Save(policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to save disk compaction policy: %w", err)
+	}
+	s.recordAudit("host.disk_compaction_policy.update", "host", hostID,
+		fmt.Sprintf("enabled=%t method=%s compress=%t interval=%dh", policy.Enabled, policy.Method,
+			policy.Compress, policy.IntervalHours))
+	return policy, nil
+}
+
+func applyDiskCompactionDefaults(policy *storage.DiskCompactionPolicy) {
+	if policy.Method == "" {
+		policy.Method = libvirt.CompactionConvert
+	}
+	if policy.IntervalHours == 0 {
+		policy.IntervalHours = DefaultDiskCompactionIntervalHours
+	}
+}
+
+// StartDiskCompactionPolicies checks once per interval for enabled disk
+// compaction policies of connected hosts that are due, and runs them. It
+// blocks, so run it in its own goroutine.
+func (s *HostService) StartDiskCompactionPolicies(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var policies []storage.DiskCompactionPolicy
+		if err := s.db.Where("enabled = ?", true).Find(&policies).Error; err != nil {
+			log.Printf("Warning: failed to load disk compaction policies: %v", err)
+			continue
+		}
+		connected := make(map[string]bool)
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			connected[hostID] = true
+		}
+		for i := range policies {
+			policy := &policies[i]
+			if !connected[policy.HostID] {
+				continue
+			}
+			if policy.LastRunAt != nil && time.Since(*policy.LastRunAt) < time.Duration(policy.IntervalHours)*time.Hour {
+				continue
+			}
+			if err := s.runDiskCompactionPolicy(policy); err != nil {
+				log.Printf("Warning: disk compaction policy of host %s failed: %v", policy.HostID, err)
+			}
+		}
+	}
+}
+
+// runDiskCompactionPolicy compacts the disks of a host's shut-off VMs, one
+// VM at a time so the host's storage is not saturated. VMs whose disks
+// cannot be compacted, or that were started meanwhile, are skipped.
+func (s *HostService) runDiskCompactionPolicy(policy *storage.DiskCompactionPolicy) error {
+	now := time.Now()
+	if err := s.db.Model(policy).Update("last_run_at", &now).Error; err != nil {
+		return err
+	}
+	s.SyncVMsForHost(policy.HostID)
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND state = ?", policy.HostID, storage.StateStopped).Order("name").Find(&vms).Error; err != nil {
+		return err
+	}
+	req := DiskCompactionRequest{Method: policy.Method, Compress: policy.Compress}
+	for _, vm := range vms {
+		c, err := s.beginDiskCompaction(policy.HostID, vm.Name, req, "scheduled")
+		if err != nil {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) && !errors.Is(err, libvirt.ErrCompactionUnsupported) &&
+				!errors.Is(err, libvirt.ErrDomainActive) && !errors.Is(err, ErrDiskCompactionInProgress) {
+				log.Printf("Warning: could not compact the disks of %s on host %s: %v", vm.Name, policy.HostID, err)
+			}
+			continue
+		}
+		s.runDiskCompaction(c)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package services
+
+import (
+	"errors"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+// StartDomainEventSync syncs a VM as soon as libvirt reports that it was
+// defined or undefined, so VMs created or deleted outside Virtumancer show
+// up within seconds instead of at the next periodic sync. Events are
+// handled one at a time, in the order they happened.
+func (s *HostService) StartDomainEventSync() {
+	for event := range s.connector.DomainDefinitionEvents() {
+		s.handleDomainDefinition(event)
+	}
+}
+
+// handleDomainDefinition syncs the VM of a definition event, archives its
+// new definition and announces VMs that appeared or disappeared. A domain
+// that was undefined while running lives on as a transient domain and is
+// kept.
+func (s *HostService) handleDomainDefinition(event libvirt.DomainDefinitionEvent) {
+	changed, err := s.syncSingleVM(event.HostID, event.Name)
+	if err != nil {
+		if event.Change == libvirt.DomainDeleted || errors.Is(err, ErrHostGone) {
+			// The VM was not in the database, e.g. as it was deleted
+			// through Virtumancer, or its host is being removed.
+			return
+		}
+		log.Printf("Warning: failed to sync VM %s on host %s after it was %s: %v", event.Name, event.HostID, event.Change, err)
+		return
+	}
+
+	var vm storage.VirtualMachine
+	err = s.db.Where("host_id = ? AND name = ?", event.HostID, event.Name).Limit(1).Find(&vm).Error
+	if err != nil {
+		log.Printf("Warning: could not load VM %s on host %s: %v", event.Name, event.HostID, err)
+		return
+	}
+	exists := vm.ID != 0
+	if exists {
+		if _, err := s.archiveVMDefinition(event.HostID, event.Name, DefinitionSourceSync, ""); err != nil {
+			log.Printf("Warning: failed to archive the definition of VM %s on host %s: %v", event.Name, event.HostID, err)
+		}
+	}
+	switch {
+	case event.Change == libvirt.DomainCreated && exists:
+		s.recordEvent(EventVMCreated, event.HostID, event.Name, "VM defined on host", nil)
+		s.hub.BroadcastMessage(ws.Message{
+			Type:    EventVMCreated,
+			Payload: ws.MessagePayload{"hostId": event.HostID, "vmName": event.Name, "vm": s.vmToView(vm)},
+		})
+	case event.Change == libvirt.DomainDeleted && !exists:
+		s.recordEvent(EventVMDeleted, event.HostID, event.Name, "VM undefined on host", nil)
+		s.hub.BroadcastMessage(ws.Message{
+			Type:    EventVMDeleted,
+			Payload: ws.MessagePayload{"hostId": event.HostID, "vmName": event.Name},
+		})
+	}
+	if changed {
+		s.broadcastVMsChanged(event.HostID)
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Kinds of planned changes.
+const (
+	ChangeDelete   = "delete"
+	ChangeUpdate   = "update"
+	ChangeCopy     = "copy"
+	ChangeDefine   = "define"
+	ChangeUndefine = "undefine"
+	ChangePower    = "power"
+)
+
+// PlannedChange is one step a destructive operation would take.
+type PlannedChange struct {
+	Kind    string `json:"kind"`              // One of the Change* constants
+	Type    string `json:"type"`              // What is changed, e.g. 'vm', 'volume' or 'host'
+	Target  string `json:"target"`            // Which one, e.g. 'host/vm' or a volume path
+	Details string `json:"details,omitempty"` // Human-readable specifics
+}
+
+// DryRunPlan describes what an operation would do. A dry run fails with the
+// same error as the real request would, so getting a plan means the
+// preconditions hold right now.
+type DryRunPlan struct {
+	Action   string          `json:"action"`
+	Target   string          `json:"target"`
+	Changes  []PlannedChange `json:"changes"` // In the order they would happen
+	Warnings []string        `json:"warnings"`
+}
+
+func newDryRunPlan(action, target string) *DryRunPlan {
+	return &DryRunPlan{Action: action, Target: target, Changes: []PlannedChange{}, Warnings: []string{}}
+}
+
+func (p *DryRunPlan) add(kind, changeType, target, details string) {
+	p.Changes = append(p.Changes, PlannedChange{Kind: kind, Type: changeType, Target: target, Details: details})
+}
+
+// PlanRemoveHost describes what removing a host would do. Only Virtumancer's
+// records go; the host and its VMs are left alone.
+func (s *HostService) PlanRemoveHost(hostID string) (*DryRunPlan, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	plan := newDryRunPlan("host.delete", hostID)
+	plan.add(ChangeUpdate, "connection", hostID, "Disconnect from the host")
+
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ?", hostID).Order("name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		plan.add(ChangeDelete, "vm-record", hostID+"/"+vm.Name, "Forget the VM; its domain stays defined on the host")
+	}
+	var pools []storage.StoragePool
+	if err := s.db.Where("host_id = ?", hostID).Order("name").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		plan.add(ChangeDelete, "pool-record", hostID+"/"+pool.Name, "Forget the storage pool and its usage history")
+	}
+	var alerts int64
+	if err := s.db.Model(&storage.Alert{}).Where("host_id = ? AND resolved_at IS NULL", hostID).Count(&alerts).Error; err != nil {
+		return nil, err
+	}
+	if alerts > 0 {
+		plan.add(ChangeUpdate, "alert", hostID, fmt.Sprintf("Resolve %d open alert(s)", alerts))
+	}
+	plan.add(ChangeDelete, "host", hostID, "Remove the host from Virtumancer")
+
+	var running int
+	for _, vm := range vms {
+		if vm.State == storage.StateActive {
+			running++
+		}
+	}
+	if running > 0 {
+		plan.Warnings = append(plan.Warnings, fmt.Sprintf("%d VM(s) are running and will no longer be managed", running))
+	}
+	return plan, nil
+}
+
+// PlanDeleteVolume describes what deleting a volume would do, and warns if a
+// VM still uses it.
+func (s *HostService) PlanDeleteVolume(hostID, poolName, volName string, opts VolumeDeleteOptions) (*DryRunPlan, error) {
+	if opts.Wipe {
+		if err := libvirt.ValidateWipeAlgorithm(opts.WipeAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+	volumes, err := s.connector.ListVolumes(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	var volume *libvirt.VolumeInfo
+	for i := range volumes {
+		if volumes[i].Name == volName {
+			volume = &volumes[i]
+			break
+		}
+	}
+	if volume == nil {
+		return nil, fmt.Errorf("could not find volume %s in pool %s on host %s: %w", volName, poolName, hostID, gorm.ErrRecordNotFound)
+	}
+
+	target := fmt.Sprintf("%s/%s/%s", hostID, poolName, volName)
+	plan := newDryRunPlan("volume.delete", target)
+	if opts.Wipe {
+		plan.add(ChangeUpdate, "volume", volume.Path, fmt.Sprintf("Wipe %d bytes using the %s algorithm, as a task",
+			volume.CapacityBytes, valueOr(opts.WipeAlgorithm, "zero")))
+	}
+	plan.add(ChangeDelete, "volume", volume.Path, fmt.Sprintf("Delete the %s volume (%d bytes allocated)", volume.Format, volume.AllocationBytes))
+
+	var users []string
+	err = s.db.Table("volume_attachments").
+		Joins("JOIN volumes ON volumes.id = volume_attachments.volume_id").
+		Joins("JOIN virtual_machines ON virtual_machines.id = volume_attachments.vm_id AND virtual_machines.deleted_at IS NULL").
+		Where("virtual_machines.host_id = ? AND volumes.name = ? AND volume_attachments.deleted_at IS NULL", hostID, volume.Path).
+		Pluck("virtual_machines.name", &users).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		plan.Warnings = append(plan.Warnings, "The volume is attached to "+strings.Join(users, ", "))
+	}
+	for _, vol := range volumes {
+		if vol.BackingPath == volume.Path {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("The volume is the backing file of %s", vol.Name))
+		}
+	}
+	return plan, nil
+}
+
+// PlanDeleteNetwork describes what deleting a network would do.
+func (s *HostService) PlanDeleteNetwork(hostID, name string) (*DryRunPlan, error) {
+	network, err := s.deletableNetwork(hostID, name)
+	if err != nil {
+		return nil, err
+	}
+	target := fmt.Sprintf("%s/%s", hostID, name)
+	plan := newDryRunPlan("network.delete", target)
+	plan.add(ChangeDelete, "network", target, fmt.Sprintf("Delete the network on bridge %s", network.BridgeName))
+	return plan, nil
+}
+
+// PlanColdMigration describes the steps of a cold migration: the disk
+// images that would be copied, where to, and what is removed afterwards.
+func (s *HostService) PlanColdMigration(hostID, vmName string, req ColdMigrationRequest) (*DryRunPlan, error) {
+	_, precheck, migration, err := s.prepareColdMigration(hostID, vmName, req)
+	if err != nil {
+		return nil, err
+	}
+	source := fmt.Sprintf("%s/%s", hostID, vmName)
+	plan := newDryRunPlan("vm.migrate", source)
+	for _, disk := range migration.Disks {
+		plan.add(ChangeCopy, "disk", disk.SourcePath, fmt.Sprintf("Copy %s (%d bytes) to %s on %s",
+			disk.Device, disk.CapacityBytes, disk.TargetPath, req.TargetHostID))
+	}
+	plan.add(ChangeDefine, "vm", fmt.Sprintf("%s/%s", req.TargetHostID, vmName), "Define the VM on the target host")
+	plan.add(ChangeUndefine, "vm", source, "Undefine the VM on the source host")
+	for _, disk := range migration.Disks {
+		plan.add(ChangeDelete, "disk", disk.SourcePath, "Delete the source image")
+	}
+
+	for _, issue := range precheck.Warnings {
+		plan.Warnings = append(plan.Warnings, issue.Message)
+	}
+	return plan, nil
+}
+
+// PlanOrchestrationRun describes which VMs a group start or stop would power
+// on or off, in order. VMs already in the wanted state, as last synced, are
+// left out.
+func (s *HostService) PlanOrchestrationRun(action string, req OrchestrationRequest) (*DryRunPlan, error) {
+	steps, err := s.PlanOrchestration(action, req)
+	if err != nil {
+		return nil, err
+	}
+	plan := newDryRunPlan("vm.group-"+action, strings.Join(req.VMUUIDs, ","))
+	for _, step := range steps {
+		target := fmt.Sprintf("%s/%s", step.HostID, step.VMName)
+		switch {
+		case action == OrchestrationStart && step.State == string(storage.StateActive),
+			action == OrchestrationStop && step.State == string(storage.StateStopped):
+			continue
+		case action == OrchestrationStart:
+			details := "Start"
+			if len(step.DependsOn) > 0 {
+				details += " after " + strings.Join(step.DependsOn, ", ")
+			}
+			plan.add(ChangePower, "vm", target, details)
+		default:
+			plan.add(ChangePower, "vm", target, "Shut down")
+		}
+		if !step.Requested {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s is included through its dependencies", step.VMName))
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,434 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// PermissionManageEmail allows configuring email and sending reports.
+const PermissionManageEmail = "email.manage"
+
+// Ways of securing the connection to the SMTP server.
+const (
+	EmailSecurityStartTLS = "starttls"
+	EmailSecurityTLS      = "tls"
+	EmailSecurityNone     = "none"
+)
+
+// defaultEmailPorts are used when no port is configured.
+var defaultEmailPorts = map[string]uint{EmailSecurityStartTLS: 587, EmailSecurityTLS: 465, EmailSecurityNone: 25}
+
+const (
+	// emailTimeout bounds a whole SMTP conversation.
+	emailTimeout = 30 * time.Second
+	// weeklyReportInterval is the time between capacity summaries.
+	weeklyReportInterval = 7 * 24 * time.Hour
+	// maxEmailRecipients bounds each recipient list.
+	maxEmailRecipients = 50
+)
+
+var (
+	// ErrEmailDisabled is returned when an email is needed but sending
+	// email is not enabled.
+	ErrEmailDisabled = errors.New("email is not enabled")
+	// ErrEmailFailed is returned when the SMTP server could not be reached or
+	// refused a message.
+	ErrEmailFailed = errors.New("failed to send email")
+)
+
+// EmailSettingsRequest changes the email configuration. A nil password
+// keeps the stored one.
+type EmailSettingsRequest struct {
+	Enabled          bool     `json:"enabled"`
+	Host             string   `json:"host"`
+	Port             uint     `json:"port"`
+	Security         string   `json:"security"`
+	Username         string   `json:"username"`
+	Password         *string  `json:"password"`
+	From             string   `json:"from"`
+	AlertRecipients  []string `json:"alert_recipients"`
+	ReportRecipients []string `json:"report_recipients"`
+	WeeklyReport     bool     `json:"weekly_report"`
+}
+
+// EmailSettingsView is the email configuration without the password.
+type EmailSettingsView struct {
+	storage.EmailSettings
+	PasswordSet bool `json:"password_set"`
+}
+
+func (s *HostService) loadEmailSettings() (*storage.EmailSettings, error) {
+	var row storage.EmailSettings
+	if err := s.db.Limit(1).Find(&row).Error; err != nil {
+		return nil, err
+	}
+	if row.ID == 0 {
+		row.Security = EmailSecurityStartTLS
+	}
+	if row.Port == 0 {
+		row.Port = defaultEmailPorts[row.Security]
+	}
+	if row.AlertRecipients == nil {
+		row.AlertRecipients = []string{}
+	}
+	if row.ReportRecipients == nil {
+		row.ReportRecipients = []string{}
+	}
+	return &row, nil
+}
+
+// GetEmailSettings returns the email configuration.
+func (s *HostService) GetEmailSettings() (*EmailSettingsView, error) {
+	row, err := s.loadEmailSettings()
+	if err != nil {
+		return nil, err
+	}
+	return &EmailSettingsView{EmailSettings: *row, PasswordSet: row.Password != ""}, nil
+}
+
+// emailAddresses checks a list of recipients, recording problems under the
+// given field, and returns the bare addresses.
+func (v *validator) emailAddresses(field string, recipients []string) []string {
+	if len(recipients) > maxEmailRecipients {
+		v.add(field, "can have at most %d addresses", maxEmailRecipients)
+	}
+	addresses := make([]string, 0, len(recipients))
+	for i, recipient := range recipients {
+		addr, err := mail.ParseAddress(strings.TrimSpace(recipient))
+		if err != nil {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "'%s' is not an email address", recipient)
+			continue
+		}
+		addresses = append(addresses, addr.Address)
+	}
+	return addresses
+}
+
+// SetEmailSettings changes the email configuration.
+func (s *HostService) SetEmailSettings(actorID uint, req EmailSettingsRequest) (*EmailSettingsView, error) {
+	row, err := s.loadEmailSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	var v validator
+	req.Host = strings.TrimSpace(req.Host)
+	if req.Security == "" {
+		req.Security = EmailSecurityStartTLS
+	}
+	if _, ok := defaultEmailPorts[req.Security]; !ok {
+		v.add("security", "must be starttls, tls or none")
+	}
+	if req.Port > 65535 {
+		v.add("port", "must be at most 65535")
+	}
+	if req.Enabled {
+		v.required("host", req.Host)
+	}
+	if req.From != "" {
+		if _, err := mail.ParseAddress(req.From); err != nil {
+			v.add("from", "'%s' is not an email address", req.From)
+		}
+	} else if req.Enabled {
+		v.add("from", "is required")
+	}
+	password := row.Password
+	if req.Password != nil {
+		password = *req.Password
+	}
+	if req.Username != "" && password != "" && req.Security == EmailSecurityNone {
+		v.add("security", "must be starttls or tls to send a password")
+	}
+	alertRecipients := v.emailAddresses("alert_recipients", req.AlertRecipients)
+	reportRecipients := v.emailAddresses("report_recipients", req.ReportRecipients)
+	if req.WeeklyReport && len(req.ReportRecipients) == 0 {
+		v.add("report_recipients", "are required for the weekly report")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	port := req.Port
+	if port == 0 {
+		port = defaultEmailPorts[req.Security]
+	}
+	*row = storage.EmailSettings{
+		ID:               1,
+		Enabled:          req.Enabled,
+		Host:             req.Host,
+		Port:             port,
+		Security:         req.Security,
+		Username:         req.Username,
+		Password:         password,
+		From:             req.From,
+		AlertRecipients:  alertRecipients,
+		ReportRecipients: reportRecipients,
+		WeeklyReport:     req.WeeklyReport,
+		LastReportAt:     row.LastReportAt,
+	}
+	if err := s.db.Save(row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save email settings: %w", err)
+	}
+	s.recordUserAudit(actorID, "email.update", "email", "global",
+		fmt.Sprintf("enabled=%t host=%s port=%d security=%s weekly_report=%t", req.Enabled, req.Host, port, req.Security, req.WeeklyReport))
+	return s.GetEmailSettings()
+}
+
+// sendEmail sends a plain text message through the configured SMTP server.
+func (s *HostService) sendEmail(to []string, subject, body string) error {
+	settings, err := s.loadEmailSettings()
+	if err != nil {
+		return err
+	}
+	if !settings.Enabled {
+		return ErrEmailDisabled
+	}
+	if err := deliverEmail(settings, to, subject, body); err != nil {
+		return fmt.Errorf("%w to %s: %v", ErrEmailFailed, strings.Join(to, ", "), err)
+	}
+	return nil
+}
+
+// sendEmailInBackground sends a message without holding up the caller.
+// Failures are logged.
+func (s *HostService) sendEmailInBackground(to []string, subject, body string) {
+	go func() {
+		if err := s.sendEmail(to, subject, body); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+}
+
+// deliverEmail runs one SMTP conversation.
+func deliverEmail(settings *storage.EmailSettings, to []string, subject, body string) error {
+	from, err := mail.ParseAddress(settings.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender: %w", err)
+	}
+	message, err := composeEmail(from, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(settings.Host, strconv.Itoa(int(settings.Port)))
+	dialer := &net.Dialer{Timeout: emailTimeout}
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+	var conn net.Conn
+	if settings.Security == EmailSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(emailTimeout))
+
+	client, err := smtp.NewClient(conn, settings.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if settings.Security == EmailSecurityStartTLS {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if settings.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", settings.Username, settings.Password, settings.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// composeEmail builds a plain text message with its headers.
+func composeEmail(from *mail.Address, to []string, subject, body string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SendTestEmail sends a short message to check the email configuration.
+func (s *HostService) SendTestEmail(actorID uint, to string) error {
+	var v validator
+	addresses := v.emailAddresses("to", []string{to})
+	if err := v.err(); err != nil {
+		return err
+	}
+	err := s.sendEmail(addresses, "Virtumancer test email", "This is a test email from Virtumancer. Email is set up correctly.\n")
+	if err != nil {
+		return err
+	}
+	s.recordUserAudit(actorID, "email.test", "email", "global", "to="+addresses[0])
+	return nil
+}
+
+// emailAlert tells the alert recipients that an alert was raised or
+// resolved. Failures are logged but never block the alerting.
+func (s *HostService) emailAlert(alert *storage.Alert, event string) {
+	settings, err := s.loadEmailSettings()
+	if err != nil || !settings.Enabled || len(settings.AlertRecipients) == 0 {
+		return
+	}
+	hostName := alert.HostID
+	var host storage.Host
+	if s.db.Where("id = ?", alert.HostID).Limit(1).Find(&host).Error == nil && host.ID != "" {
+		hostName = host.Name
+	}
+	status := string(alert.Severity)
+	if event == EventAlertResolved {
+		status = "Resolved"
+	}
+	subject := fmt.Sprintf("[Virtumancer] %s: %s", status, alert.Message)
+	body := fmt.Sprintf("%s\n\nHost: %s\nSeverity: %s\nSource: %s %s\nRaised: %s\n",
+		alert.Message, hostName, alert.Severity, alert.Source, alert.SourceID, alert.CreatedAt.Format(time.RFC1123))
+	if alert.ResolvedAt != nil {
+		body += fmt.Sprintf("Resolved: %s\n", alert.ResolvedAt.Format(time.RFC1123))
+	}
+	s.sendEmailInBackground(settings.AlertRecipients, subject, body)
+}
+
+// capacityReport summarizes the capacity of the connected hosts, the usage
+// of their storage pools and the open alerts.
+func (s *HostService) capacityReport() (string, error) {
+	capacities, err := s.ListHostCapacities()
+	if err != nil {
+		return "", err
+	}
+	var pools []storage.StoragePool
+	if err := s.db.Order("host_id, name").Find(&pools).Error; err != nil {
+		return "", err
+	}
+	var openAlerts int64
+	if err := s.db.Model(&storage.Alert{}).Where("resolved_at IS NULL").Count(&openAlerts).Error; err != nil {
+		return "", err
+	}
+
+	const gib = 1 << 30
+	var b strings.Builder
+	fmt.Fprintf(&b, "Capacity summary of %s\n\nHosts\n", time.Now().Format("Monday, 2 January 2006"))
+	if len(capacities) == 0 {
+		b.WriteString("  No hosts are connected.\n")
+	}
+	hostNames := make(map[string]string, len(capacities))
+	for _, c := range capacities {
+		hostNames[c.HostID] = c.HostName
+		fmt.Fprintf(&b, "  %s: %d of %d vCPUs allocated (%.2f per CPU), %.1f of %.1f GiB memory allocated\n",
+			c.HostName, c.AllocatedVCPUs, c.AllocatableCPUs, c.CPUOvercommitRatio,
+			float64(c.AllocatedMemoryBytes)/gib, float64(c.AllocatableMemoryBytes)/gib)
+	}
+	b.WriteString("\nStorage pools\n")
+	if len(pools) == 0 {
+		b.WriteString("  No storage pools are known.\n")
+	}
+	for i := range pools {
+		host := hostNames[pools[i].HostID]
+		if host == "" {
+			host = pools[i].HostID
+		}
+		fmt.Fprintf(&b, "  %s/%s: %.1f%% of %.1f GiB used\n", host, pools[i].Name, poolUsagePercent(&pools[i]), float64(pools[i].CapacityBytes)/gib)
+	}
+	fmt.Fprintf(&b, "\nOpen alerts: %d\n", openAlerts)
+	return b.String(), nil
+}
+
+// SendCapacityReport emails the capacity summary to the report recipients
+// right away.
+func (s *HostService) SendCapacityReport(actorID uint) error {
+	settings, err := s.loadEmailSettings()
+	if err != nil {
+		return err
+	}
+	if len(settings.ReportRecipients) == 0 {
+		var v validator
+		v.add("report_recipients", "are required to send the report")
+		return v.err()
+	}
+	if err := s.sendCapacityReport(settings.ReportRecipients); err != nil {
+		return err
+	}
+	s.recordUserAudit(actorID, "email.report", "email", "global", "to="+strings.Join(settings.ReportRecipients, ","))
+	return nil
+}
+
+func (s *HostService) sendCapacityReport(to []string) error {
+	report, err := s.capacityReport()
+	if err != nil {
+		return err
+	}
+	if err := s.sendEmail(to, "[Virtumancer] Weekly capacity summary", report); err != nil {
+		return err
+	}
+	return s.db.Model(&storage.EmailSettings{}).Where("id = ?", 1).Update("last_report_at", time.Now()).Error
+}
+
+// StartEmailReports sends the weekly capacity summary when it is enabled and
+// due. It blocks, so run it in its own goroutine.
+func (s *HostService) StartEmailReports(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		settings, err := s.loadEmailSettings()
+		if err != nil {
+			log.Printf("Warning: failed to load email settings: %v", err)
+			continue
+		}
+		if !settings.Enabled || !settings.WeeklyReport || len(settings.ReportRecipients) == 0 {
+			continue
+		}
+		if settings.LastReportAt != nil && time.Since(*settings.LastReportAt) < weeklyReportInterval {
+			continue
+		}
+		if err := s.sendCapacityReport(settings.ReportRecipients); err != nil {
+			log.Printf("Warning: failed to send the weekly capacity report: %v", err)
+		}
+	}
+}
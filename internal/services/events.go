@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Types of recorded events. Events that are also pushed over the WebSocket
+// use the same name as the message.
+const (
+	EventVMStateChanged       = "vm-state-changed"
+	EventVMCreated            = "vm-created"
+	EventVMDeleted            = "vm-deleted"
+	EventVMsSynced            = "vms-synced"
+	EventVMMigrated           = "vm-migrated"
+	EventVMRecovered          = "vm-recovered"
+	EventSyncFailed           = "sync-failed"
+	EventHostConnected        = "host-connected"
+	EventHostConnectionFailed = "host-connection-failed"
+	EventHostDisconnected     = "host-disconnected"
+	EventHostRemoved          = "host-removed"
+	EventHostDead             = "host-dead"
+	EventHostFenced           = "host-fenced"
+	EventAlertRaised          = "alert-raised"
+	EventAlertResolved        = "alert-resolved"
+	EventTaskInterrupted      = "task-interrupted"
+	EventRunbookNotification  = "runbook-notification"
+)
+
+// eventRetention is how long events are kept.
+const eventRetention = 30 * 24 * time.Hour
+
+// Bounds on the number of events returned by one history query.
+const (
+	defaultEventLimit = 100
+	maxEventLimit     = 1000
+)
+
+// EventFilter selects events from the history. Zero fields match everything.
+type EventFilter struct {
+	HostID string
+	VMName string
+	Types  []string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// recordEvent persists an event and notifies its subscribers, unless a
+// maintenance window covers it. Failures are logged but never block the
+// operation that raised the event.
+func (s *HostService) recordEvent(eventType, hostID, vmName, message string, details map[string]interface{}) {
+	quiet := false
+	if slices.Contains(maintenanceQuietEvents, eventType) {
+		if window := s.activeMaintenanceWindow(hostID, vmName); window != nil {
+			if details == nil {
+				details = make(map[string]interface{})
+			}
+			details["maintenance_window"] = window.Name
+			quiet = true
+		}
+	}
+	s.saveEvent(eventType, hostID, vmName, message, details, quiet)
+}
+
+// saveEvent persists an event and, unless it is quiet, notifies its
+// subscribers.
+func (s *HostService) saveEvent(eventType, hostID, vmName, message string, details map[string]interface{}, quiet bool) {
+	event := storage.Event{
+		Type:    eventType,
+		HostID:  hostID,
+		VMName:  vmName,
+		Message: message,
+	}
+	if len(details) > 0 {
+		encoded, err := json.Marshal(details)
+		if err != nil {
+			log.Printf("Warning: failed to encode details of %s event: %v", eventType, err)
+		} else {
+			event.Details = string(encoded)
+		}
+	}
+	if err := s.db.Create(&event).Error; err != nil {
+		log.Printf("Warning: failed to record %s event for host %s: %v", eventType, hostID, err)
+		return
+	}
+	if !quiet {
+		s.notifySubscribers(event)
+	}
+}
+
+// ListEvents returns recorded events matching the filter, newest first.
+func (s *HostService) ListEvents(filter EventFilter) ([]storage.Event, error) {
+	query := s.db.Order("created_at desc, id desc")
+	if filter.HostID != "" {
+		query = query.Where("host_id = ?", filter.HostID)
+	}
+	if filter.VMName != "" {
+		query = query.Where("vm_name = ?", filter.VMName)
+	}
+	if len(filter.Types) > 0 {
+		query = query.Where("type IN ?", filter.Types)
+	}
+	// Timestamps are stored as text in local time, so bounds must be in local
+	// time too for the comparison to hold.
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since.Local())
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at <= ?", filter.Until.Local())
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultEventLimit
+	}
+	if limit > maxEventLimit {
+		limit = maxEventLimit
+	}
+
+	events := []storage.Event{}
+	if err := query.Limit(limit).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// StartEventRetention periodically deletes events, notifications, VM state
+// changes and login attempts older than their retention periods. It blocks,
+// so run it in its own goroutine.
+func (s *HostService) StartEventRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().Add(-eventRetention)
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&storage.Event{}).Error; err != nil {
+			log.Printf("Warning: failed to prune event history: %v", err)
+		}
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&storage.Notification{}).Error; err != nil {
+			log.Printf("Warning: failed to prune notifications: %v", err)
+		}
+		if err := s.db.Where("created_at < ?", time.Now().Add(-usageRetention)).Delete(&storage.VMStateChange{}).Error; err != nil {
+			log.Printf("Warning: failed to prune VM state changes: %v", err)
+		}
+		cutoff = time.Now().Add(-loginAttemptRetention)
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&storage.LoginAttempt{}).Error; err != nil {
+			log.Printf("Warning: failed to prune login attempts: %v", err)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// defaultUsageRange is how far back usage history goes when no start is given.
+const defaultUsageRange = 7 * 24 * time.Hour
+
+// UsageFilter selects usage samples. Empty fields match everything; a zero
+// To is now and a zero From is 7 days before To.
+type UsageFilter struct {
+	HostID string
+	Name   string // VM or pool name
+	From   time.Time
+	To     time.Time
+}
+
+func (f *UsageFilter) normalize() {
+	if f.To.IsZero() {
+		f.To = time.Now()
+	}
+	if f.From.IsZero() {
+		f.From = f.To.Add(-defaultUsageRange)
+	}
+}
+
+// PoolUsageRow is a storage pool usage sample with the pool it belongs to.
+type PoolUsageRow struct {
+	HostID          string    `json:"host_id"`
+	Pool            string    `json:"pool"`
+	CapacityBytes   uint64    `json:"capacity_bytes"`
+	AllocationBytes uint64    `json:"allocation_bytes"`
+	AvailableBytes  uint64    `json:"available_bytes"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// ListHostCapacities returns the capacity of every connected host, ordered
+// by name. Hosts that cannot be queried are left out.
+func (s *HostService) ListHostCapacities() ([]HostCapacity, error) {
+	var hosts []storage.Host
+	if err := s.db.Where("id IN ?", s.connector.ConnectedHostIDs()).Order("name").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	capacities := []HostCapacity{}
+	for i := range hosts {
+		info, err := s.connector.GetHostInfo(hosts[i].ID)
+		if err != nil {
+			log.Printf("Warning: failed to get info of host %s for its capacity: %v", hosts[i].Name, err)
+			continue
+		}
+		capacity, err := s.hostCapacity(&hosts[i], info)
+		if err != nil {
+			return nil, err
+		}
+		capacities = append(capacities, *capacity)
+	}
+	return capacities, nil
+}
+
+// ListVMUsage returns the recorded VM usage samples, oldest first.
+func (s *HostService) ListVMUsage(filter UsageFilter) ([]storage.VMUsageSample, error) {
+	filter.normalize()
+	query := s.db.Where("created_at >= ? AND created_at <= ?", filter.From, filter.To)
+	if filter.HostID != "" {
+		query = query.Where("host_id = ?", filter.HostID)
+	}
+	if filter.Name != "" {
+		query = query.Where("vm_name = ?", filter.Name)
+	}
+	samples := []storage.VMUsageSample{}
+	if err := query.Order("created_at, vm_name").Find(&samples).Error; err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// ListPoolUsage returns the recorded storage pool usage samples, oldest
+// first.
+func (s *HostService) ListPoolUsage(filter UsageFilter) ([]PoolUsageRow, error) {
+	filter.normalize()
+	query := s.db.Table("storage_pool_usage_samples").
+		Select("storage_pools.host_id, storage_pools.name AS pool, storage_pool_usage_samples.capacity_bytes, "+
+			"storage_pool_usage_samples.allocation_bytes, storage_pool_usage_samples.available_bytes, storage_pool_usage_samples.created_at").
+		Joins("JOIN storage_pools ON storage_pools.id = storage_pool_usage_samples.storage_pool_id").
+		Where("storage_pool_usage_samples.created_at >= ? AND storage_pool_usage_samples.created_at <= ?", filter.From, filter.To)
+	if filter.HostID != "" {
+		query = query.Where("storage_pools.host_id = ?", filter.HostID)
+	}
+	if filter.Name != "" {
+		query = query.Where("storage_pools.name = ?", filter.Name)
+	}
+	rows := []PoolUsageRow{}
+	if err := query.Order("storage_pool_usage_samples.created_at, storage_pools.name").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
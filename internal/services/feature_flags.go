@@ -0,0 +1,261 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// PermissionManageFeatures allows turning feature flags on and off.
+const PermissionManageFeatures = "features.manage"
+
+// Feature flags wrap subsystems that are new or risky, so that operators can
+// turn them on step by step: for everyone, for some roles first, or not at
+// all. A disabled feature's background work pauses and its endpoints
+// answer 403.
+const (
+	FeatureHA             = "ha"              // Fencing dead hosts and recovering their VMs elsewhere
+	FeatureAutoBallooning = "auto-ballooning" // Balloon policies moving memory between guests
+	FeatureDiscovery      = "discovery"       // Scanning the network for machines to add as hosts
+)
+
+// FeaturesEnv names the environment variable with the configured defaults
+// of the feature flags, e.g. "ha=off,discovery=on".
+const FeaturesEnv = "VIRTUMANCER_FEATURES"
+
+type featureDefinition struct {
+	description  string
+	enabled      bool // Built-in default
+	experimental bool
+}
+
+var featureDefinitions = map[string]featureDefinition{
+	FeatureHA:             {description: "Fence hosts that stay unreachable and recover their VMs on other hosts", enabled: true, experimental: true},
+	FeatureAutoBallooning: {description: "Move memory between the guests of hosts with a balloon policy", enabled: true, experimental: true},
+	FeatureDiscovery:      {description: "Scan subnets and mDNS for machines to add as hosts", enabled: true},
+}
+
+var (
+	// ErrFeatureNotFound is returned for a feature flag that does not exist.
+	ErrFeatureNotFound = errors.New("no such feature flag")
+	// ErrFeatureDisabled is returned when a feature is off, or not on for the
+	// user's role.
+	ErrFeatureDisabled = errors.New("feature is disabled")
+)
+
+// FeatureFlagRequest overrides a feature flag. A nil Enabled keeps the
+// default.
+type FeatureFlagRequest struct {
+	Enabled *bool    `json:"enabled"`
+	Roles   []string `json:"roles"`
+}
+
+// FeatureFlagView is a feature flag with its default and its override.
+type FeatureFlagView struct {
+	Name         string     `json:"name"`
+	Description  string     `json:"description"`
+	Experimental bool       `json:"experimental"`
+	Default      bool       `json:"default"`  // Built in, or from the configuration
+	Override     *bool      `json:"override"` // Set through the API
+	Enabled      bool       `json:"enabled"`
+	Roles        []string   `json:"roles"` // Roles that may use the feature; empty for all
+	UpdatedAt    *time.Time `json:"updated_at"`
+}
+
+// ConfigureFeatures sets the defaults of feature flags from a list such as
+// "ha=off,discovery=on". Overrides stored through the API take precedence.
+func (s *HostService) ConfigureFeatures(spec string) error {
+	defaults := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(item, "=")
+		if _, ok := featureDefinitions[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrFeatureNotFound, name)
+		}
+		switch strings.ToLower(value) {
+		case "on", "true", "1", "":
+			defaults[name] = true
+		case "off", "false", "0":
+			defaults[name] = false
+		default:
+			return fmt.Errorf("feature flag %s must be on or off, not %q", name, value)
+		}
+	}
+	s.featureDefaults = defaults
+	return nil
+}
+
+func (s *HostService) featureDefault(name string) bool {
+	if enabled, ok := s.featureDefaults[name]; ok {
+		return enabled
+	}
+	return featureDefinitions[name].enabled
+}
+
+func (s *HostService) featureView(name string, row *storage.FeatureFlag) FeatureFlagView {
+	def := featureDefinitions[name]
+	view := FeatureFlagView{
+		Name:         name,
+		Description:  def.description,
+		Experimental: def.experimental,
+		Default:      s.featureDefault(name),
+		Roles:        []string{},
+	}
+	view.Enabled = view.Default
+	if row != nil {
+		view.Override = row.Enabled
+		if row.Enabled != nil {
+			view.Enabled = *row.Enabled
+		}
+		if row.Roles != nil {
+			view.Roles = row.Roles
+		}
+		view.UpdatedAt = &row.UpdatedAt
+	}
+	return view
+}
+
+// ListFeatureFlags returns every feature flag, ordered by name.
+func (s *HostService) ListFeatureFlags() ([]FeatureFlagView, error) {
+	var rows []storage.FeatureFlag
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	overrides := make(map[string]*storage.FeatureFlag, len(rows))
+	for i := range rows {
+		overrides[rows[i].Name] = &rows[i]
+	}
+	flags := make([]FeatureFlagView, 0, len(featureDefinitions))
+	for name := range featureDefinitions {
+		flags = append(flags, s.featureView(name, overrides[name]))
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags, nil
+}
+
+// GetFeatureFlag returns a feature flag.
+func (s *HostService) GetFeatureFlag(name string) (*FeatureFlagView, error) {
+	if _, ok := featureDefinitions[name]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFeatureNotFound, name)
+	}
+	var rows []storage.FeatureFlag
+	if err := s.db.Where("name = ?", name).Limit(1).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var row *storage.FeatureFlag
+	if len(rows) > 0 {
+		row = &rows[0]
+	}
+	view := s.featureView(name, row)
+	return &view, nil
+}
+
+// SetFeatureFlag overrides whether a feature is on and which roles may use
+// it.
+func (s *HostService) SetFeatureFlag(name string, req FeatureFlagRequest) (*FeatureFlagView, error) {
+	if _, ok := featureDefinitions[name]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFeatureNotFound, name)
+	}
+	roles, err := s.roleNames()
+	if err != nil {
+		return nil, err
+	}
+	known := slices.Collect(maps.Values(roles))
+	var v validator
+	for i, role := range req.Roles {
+		if !slices.Contains(known, role) {
+			v.add(fmt.Sprintf("roles[%d]", i), "'%s' is not a role", role)
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(req.Roles)
+	req.Roles = slices.Compact(req.Roles)
+
+	row := storage.FeatureFlag{Name: name, Enabled: req.Enabled, Roles: req.Roles}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save feature flag %s: %w", name, err)
+	}
+	enabled := "default"
+	if req.Enabled != nil {
+		enabled = fmt.Sprintf("%t", *req.Enabled)
+	}
+	s.recordAudit("feature.update", "feature", name, fmt.Sprintf("enabled=%s roles=%s", enabled, strings.Join(req.Roles, ",")))
+	return s.GetFeatureFlag(name)
+}
+
+// ResetFeatureFlag removes the override of a feature flag, so that its
+// default applies to all roles again.
+func (s *HostService) ResetFeatureFlag(name string) (*FeatureFlagView, error) {
+	if _, ok := featureDefinitions[name]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrFeatureNotFound, name)
+	}
+	if err := s.db.Where("name = ?", name).Delete(&storage.FeatureFlag{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to reset feature flag %s: %w", name, err)
+	}
+	s.recordAudit("feature.reset", "feature", name, "")
+	return s.GetFeatureFlag(name)
+}
+
+// featureEnabled reports whether a feature is on, for background work. Role
+// restrictions only apply to the API.
+func (s *HostService) featureEnabled(name string) bool {
+	flag, err := s.GetFeatureFlag(name)
+	if err != nil {
+		return s.featureDefault(name)
+	}
+	return flag.Enabled
+}
+
+// CheckFeature returns ErrFeatureDisabled unless a feature is on for a user.
+// A nil user, as without logging in, only passes features open to all
+// roles.
+func (s *HostService) CheckFeature(name string, user *storage.User) error {
+	flag, err := s.GetFeatureFlag(name)
+	if err != nil {
+		return err
+	}
+	if !flag.Enabled {
+		return fmt.Errorf("%w: %s is turned off", ErrFeatureDisabled, name)
+	}
+	if len(flag.Roles) == 0 {
+		return nil
+	}
+	if user != nil {
+		roles, err := s.roleNames()
+		if err != nil {
+			return err
+		}
+		if slices.Contains(flag.Roles, roles[user.RoleID]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is only on for the roles %s", ErrFeatureDisabled, name, strings.Join(flag.Roles, ", "))
+}
+
+// experimentalFeatures returns whether each experimental feature is on for
+// a user, who may be nil.
+func (s *HostService) experimentalFeatures(user *storage.User) (map[string]bool, error) {
+	features := make(map[string]bool)
+	for name, def := range featureDefinitions {
+		if !def.experimental {
+			continue
+		}
+		err := s.CheckFeature(name, user)
+		if err != nil && !errors.Is(err, ErrFeatureDisabled) {
+			return nil, err
+		}
+		features[name] = err == nil
+	}
+	return features, nil
+}
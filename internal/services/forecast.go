@@ -0,0 +1,433 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Methods fitting a trend to usage history.
+const (
+	ForecastLinear = "linear" // Least-squares line through the history
+	ForecastHolt   = "holt"   // Holt's double exponential smoothing, following recent changes more closely
+)
+
+// Statuses of a resource forecast.
+const (
+	ForecastOK               = "ok"
+	ForecastExhausting       = "exhausting" // Runs out within the longest horizon
+	ForecastExhausted        = "exhausted"  // Already used up
+	ForecastInsufficientData = "insufficient-data"
+	ForecastUnknownCapacity  = "unknown-capacity" // The host is not connected
+)
+
+const (
+	defaultForecastHistoryDays = 30
+	maxForecastDays            = 365
+	maxForecastHorizons        = 5
+	// forecastBucket is the step usage history is averaged over before a
+	// trend is fitted to it.
+	forecastBucket = time.Hour
+	// minForecastBuckets is how many steps of history a forecast needs.
+	minForecastBuckets = 6
+	// Smoothing factors of the level and the trend for Holt's method.
+	holtAlpha = 0.3
+	holtBeta  = 0.1
+)
+
+var defaultForecastHorizons = []uint{7, 30, 90}
+
+// ForecastSettingsView is the forecast configuration with its defaults
+// filled in.
+type ForecastSettingsView struct {
+	HorizonsDays []uint `json:"horizons_days"`
+	HistoryDays  uint   `json:"history_days"`
+	Method       string `json:"method"`
+}
+
+// HorizonForecast is the usage a resource is expected to reach some days
+// ahead.
+type HorizonForecast struct {
+	Days    uint    `json:"days"`
+	Value   float64 `json:"value"`
+	Percent float64 `json:"percent"` // Of the capacity; 0 when it is unknown
+}
+
+// ResourceForecast projects the usage of the CPU, memory or storage of a
+// host or pool. Host CPU and memory are what running VMs are allocated,
+// against what the host can offer after its reservation; pool storage is the
+// space allocated in the pool.
+type ResourceForecast struct {
+	Kind        string            `json:"kind"` // 'host' or 'pool'
+	HostID      string            `json:"host_id"`
+	HostName    string            `json:"host_name"`
+	Pool        string            `json:"pool,omitempty"`
+	Resource    string            `json:"resource"` // 'cpu' (vCPUs), 'memory' or 'storage' (bytes)
+	Capacity    float64           `json:"capacity"`
+	Current     float64           `json:"current"`
+	TrendPerDay float64           `json:"trend_per_day"`
+	Forecasts   []HorizonForecast `json:"forecasts"`
+	ExhaustsAt  *time.Time        `json:"exhausts_at"`
+	DaysLeft    *float64          `json:"days_left"`
+	Points      int               `json:"points"` // Hours of history the trend is fitted to
+	Status      string            `json:"status"`
+}
+
+// Forecast projects the usage of every host and pool.
+type Forecast struct {
+	GeneratedAt  time.Time          `json:"generated_at"`
+	Method       string             `json:"method"`
+	HistoryDays  uint               `json:"history_days"`
+	HorizonsDays []uint             `json:"horizons_days"`
+	Resources    []ResourceForecast `json:"resources"` // Those running out first come first
+}
+
+// usagePoint is the average usage over one bucket.
+type usagePoint struct {
+	at    time.Time
+	value float64
+}
+
+// GetForecastSettings returns the forecast configuration.
+func (s *HostService) GetForecastSettings() (*ForecastSettingsView, error) {
+	var settings storage.ForecastSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	view := &ForecastSettingsView{
+		HorizonsDays: settings.HorizonsDays,
+		HistoryDays:  settings.HistoryDays,
+		Method:       settings.Method,
+	}
+	if len(view.HorizonsDays) == 0 {
+		view.HorizonsDays = defaultForecastHorizons
+	}
+	if view.HistoryDays == 0 {
+		view.HistoryDays = defaultForecastHistoryDays
+	}
+	if view.Method == "" {
+		view.Method = ForecastLinear
+	}
+	return view, nil
+}
+
+func validateForecastSettings(req ForecastSettingsView) (ForecastSettingsView, error) {
+	var v validator
+	if len(req.HorizonsDays) > maxForecastHorizons {
+		v.add("horizons_days", "must have at most %d horizons", maxForecastHorizons)
+	}
+	for i, days := range req.HorizonsDays {
+		if days == 0 || days > maxForecastDays {
+			v.add(fmt.Sprintf("horizons_days[%d]", i), "must be between 1 and %d", maxForecastDays)
+		}
+	}
+	if req.HistoryDays > maxForecastDays {
+		v.add("history_days", "must be 0 (default) or between 1 and %d", maxForecastDays)
+	}
+	if req.Method != "" && req.Method != ForecastLinear && req.Method != ForecastHolt {
+		v.add("method", "must be '%s' or '%s'", ForecastLinear, ForecastHolt)
+	}
+	req.HorizonsDays = slices.Compact(slices.Sorted(slices.Values(req.HorizonsDays)))
+	return req, v.err()
+}
+
+// SetForecastSettings changes the horizons, history and method of
+// forecasts. Zero values select the defaults.
+func (s *HostService) SetForecastSettings(req ForecastSettingsView) (*ForecastSettingsView, error) {
+	req, err := validateForecastSettings(req)
+	if err != nil {
+		return nil, err
+	}
+	row := storage.ForecastSettings{ID: 1, HorizonsDays: req.HorizonsDays, HistoryDays: req.HistoryDays, Method: req.Method}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save forecast settings: %w", err)
+	}
+	horizons := make([]string, len(req.HorizonsDays))
+	for i, days := range req.HorizonsDays {
+		horizons[i] = fmt.Sprint(days)
+	}
+	s.recordAudit("forecast.update", "forecast", "global",
+		fmt.Sprintf("horizons_days=%s history_days=%d method=%s", strings.Join(horizons, ","), req.HistoryDays, req.Method))
+	return s.GetForecastSettings()
+}
+
+// GetForecast fits a trend to the usage history of every host's CPU and
+// memory and every pool's storage, and predicts when each runs out. The
+// request overrides the configured settings where it sets them.
+func (s *HostService) GetForecast(req ForecastSettingsView) (*Forecast, error) {
+	req, err := validateForecastSettings(req)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := s.GetForecastSettings()
+	if err != nil {
+		return nil, err
+	}
+	if len(req.HorizonsDays) > 0 {
+		settings.HorizonsDays = req.HorizonsDays
+	}
+	if req.HistoryDays > 0 {
+		settings.HistoryDays = req.HistoryDays
+	}
+	if req.Method != "" {
+		settings.Method = req.Method
+	}
+
+	now := time.Now()
+	since := now.Add(-time.Duration(settings.HistoryDays) * 24 * time.Hour)
+	forecast := &Forecast{
+		GeneratedAt:  now,
+		Method:       settings.Method,
+		HistoryDays:  settings.HistoryDays,
+		HorizonsDays: settings.HorizonsDays,
+		Resources:    []ResourceForecast{},
+	}
+	var hosts []storage.Host
+	if err := s.db.Order("name").Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	hostForecasts, err := s.hostForecasts(settings, hosts, now, since)
+	if err != nil {
+		return nil, err
+	}
+	poolForecasts, err := s.poolForecasts(settings, hosts, now, since)
+	if err != nil {
+		return nil, err
+	}
+	forecast.Resources = append(append(forecast.Resources, hostForecasts...), poolForecasts...)
+
+	rank := map[string]int{ForecastExhausted: 0, ForecastExhausting: 1, ForecastOK: 2}
+	sort.SliceStable(forecast.Resources, func(i, j int) bool {
+		a, b := forecast.Resources[i], forecast.Resources[j]
+		ra, oka := rank[a.Status]
+		rb, okb := rank[b.Status]
+		if !oka {
+			ra = len(rank)
+		}
+		if !okb {
+			rb = len(rank)
+		}
+		if ra != rb {
+			return ra < rb
+		}
+		if a.DaysLeft != nil && b.DaysLeft != nil && *a.DaysLeft != *b.DaysLeft {
+			return *a.DaysLeft < *b.DaysLeft
+		}
+		return false
+	})
+	return forecast, nil
+}
+
+// hostForecasts projects the vCPUs and memory allocated to the running VMs
+// of each host, from the VM usage samples.
+func (s *HostService) hostForecasts(settings *ForecastSettingsView, hosts []storage.Host, now, since time.Time) ([]ResourceForecast, error) {
+	var samples []storage.VMUsageSample
+	if err := s.db.Where("created_at >= ?", since).Order("created_at").Find(&samples).Error; err != nil {
+		return nil, err
+	}
+	byHost := make(map[string][]storage.VMUsageSample)
+	for _, sample := range samples {
+		byHost[sample.HostID] = append(byHost[sample.HostID], sample)
+	}
+
+	var forecasts []ResourceForecast
+	for i := range hosts {
+		host := &hosts[i]
+		cpu, memory := hostUsageSeries(byHost[host.ID])
+		var cpuCapacity, memoryCapacity float64
+		if info, err := s.connector.GetHostInfo(host.ID); err == nil {
+			capacity, err := s.hostCapacity(host, info)
+			if err != nil {
+				return nil, err
+			}
+			cpuCapacity = float64(capacity.AllocatableCPUs)
+			memoryCapacity = float64(capacity.AllocatableMemoryBytes)
+		}
+		for _, f := range []ResourceForecast{
+			projectUsage(settings, now, "cpu", cpu, cpuCapacity),
+			projectUsage(settings, now, "memory", memory, memoryCapacity),
+		} {
+			f.Kind = "host"
+			f.HostID = host.ID
+			f.HostName = host.Name
+			forecasts = append(forecasts, f)
+		}
+	}
+	return forecasts, nil
+}
+
+// hostUsageSeries adds up the running VMs of each sampling pass of a host,
+// and averages the passes per bucket. Samples of one pass are taken within
+// moments of each other, far less than the sampling interval apart.
+func hostUsageSeries(samples []storage.VMUsageSample) (cpu, memory []usagePoint) {
+	var passCPU, passMemory []usagePoint
+	for i, sample := range samples {
+		if i == 0 || sample.CreatedAt.Sub(samples[i-1].CreatedAt) > UsageSampleInterval/2 {
+			passCPU = append(passCPU, usagePoint{at: sample.CreatedAt})
+			passMemory = append(passMemory, usagePoint{at: sample.CreatedAt})
+		}
+		if sample.Running {
+			passCPU[len(passCPU)-1].value += float64(sample.VCPUs)
+			passMemory[len(passMemory)-1].value += float64(sample.MemoryBytes)
+		}
+	}
+	return bucketUsage(passCPU), bucketUsage(passMemory)
+}
+
+// poolForecasts projects the space allocated in each pool, from the pool
+// usage samples.
+func (s *HostService) poolForecasts(settings *ForecastSettingsView, hosts []storage.Host, now, since time.Time) ([]ResourceForecast, error) {
+	var pools []storage.StoragePool
+	if err := s.db.Order("host_id, name").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(hosts))
+	for _, host := range hosts {
+		names[host.ID] = host.Name
+	}
+	var forecasts []ResourceForecast
+	for _, pool := range pools {
+		var samples []storage.StoragePoolUsageSample
+		err := s.db.Where("storage_pool_id = ? AND created_at >= ?", pool.ID, since).Order("created_at").Find(&samples).Error
+		if err != nil {
+			return nil, err
+		}
+		points := make([]usagePoint, 0, len(samples))
+		for _, sample := range samples {
+			points = append(points, usagePoint{at: sample.CreatedAt, value: float64(sample.AllocationBytes)})
+		}
+		f := projectUsage(settings, now, "storage", bucketUsage(points), float64(pool.CapacityBytes))
+		f.Kind = "pool"
+		f.HostID = pool.HostID
+		f.HostName = names[pool.HostID]
+		f.Pool = pool.Name
+		forecasts = append(forecasts, f)
+	}
+	return forecasts, nil
+}
+
+// bucketUsage averages points in time order per bucket.
+func bucketUsage(points []usagePoint) []usagePoint {
+	var buckets []usagePoint
+	count := 0
+	for _, p := range points {
+		at := p.at.Truncate(forecastBucket)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].at.Equal(at) {
+			buckets = append(buckets, usagePoint{at: at})
+			count = 0
+		}
+		b := &buckets[len(buckets)-1]
+		count++
+		b.value += (p.value - b.value) / float64(count)
+	}
+	return buckets
+}
+
+// projectUsage fits a trend to the bucketed history of a resource and
+// projects it over the horizons. A zero capacity is unknown.
+func projectUsage(settings *ForecastSettingsView, now time.Time, resource string, points []usagePoint, capacity float64) ResourceForecast {
+	f := ResourceForecast{
+		Resource:  resource,
+		Capacity:  capacity,
+		Forecasts: []HorizonForecast{},
+		Points:    len(points),
+		Status:    ForecastOK,
+	}
+	if len(points) > 0 {
+		f.Current = points[len(points)-1].value
+	}
+	if len(points) < minForecastBuckets {
+		f.Status = ForecastInsufficientData
+		return f
+	}
+
+	var predict func(at time.Time) float64
+	var perBucket float64
+	if settings.Method == ForecastHolt {
+		predict, perBucket = holtTrend(points)
+	} else {
+		predict, perBucket = linearTrend(points)
+	}
+	f.TrendPerDay = perBucket * float64(24*time.Hour/forecastBucket)
+	for _, days := range settings.HorizonsDays {
+		h := HorizonForecast{Days: days, Value: math.Max(0, predict(now.Add(time.Duration(days)*24*time.Hour)))}
+		if capacity > 0 {
+			h.Percent = 100 * h.Value / capacity
+		}
+		f.Forecasts = append(f.Forecasts, h)
+	}
+
+	switch {
+	case capacity == 0:
+		f.Status = ForecastUnknownCapacity
+	case f.Current >= capacity:
+		f.Status = ForecastExhausted
+		zero := 0.0
+		f.DaysLeft = &zero
+	case f.TrendPerDay > 0:
+		days := (capacity - predict(now)) / f.TrendPerDay
+		days = math.Max(0, days)
+		if days > maxForecastDays*10 {
+			break
+		}
+		at := now.Add(time.Duration(days * float64(24*time.Hour)))
+		f.ExhaustsAt = &at
+		f.DaysLeft = &days
+		if longest := settings.HorizonsDays[len(settings.HorizonsDays)-1]; days <= float64(longest) {
+			f.Status = ForecastExhausting
+		}
+	}
+	return f
+}
+
+// linearTrend fits a least-squares line through the points, and returns it
+// with its slope per bucket.
+func linearTrend(points []usagePoint) (func(time.Time) float64, float64) {
+	origin := points[0].at
+	x := func(at time.Time) float64 { return float64(at.Sub(origin)) / float64(forecastBucket) }
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		px := x(p.at)
+		sumX += px
+		sumY += p.value
+		sumXY += px * p.value
+		sumXX += px * px
+	}
+	n := float64(len(points))
+	slope := 0.0
+	if d := n*sumXX - sumX*sumX; d != 0 {
+		slope = (n*sumXY - sumX*sumY) / d
+	}
+	intercept := (sumY - slope*sumX) / n
+	return func(at time.Time) float64 { return intercept + slope*x(at) }, slope
+}
+
+// holtTrend smooths the level and trend of the points, one bucket at a
+// time, and returns the projection from the last level with its trend per
+// bucket. Buckets without samples carry the previous value.
+func holtTrend(points []usagePoint) (func(time.Time) float64, float64) {
+	level := points[0].value
+	trend := (points[len(points)-1].value - points[0].value) /
+		math.Max(1, float64(points[len(points)-1].at.Sub(points[0].at)/forecastBucket))
+	last := points[0]
+	for _, p := range points[1:] {
+		for at := last.at.Add(forecastBucket); !at.After(p.at); at = at.Add(forecastBucket) {
+			value := last.value
+			if at.Equal(p.at) {
+				value = p.value
+			}
+			previous := level
+			level = holtAlpha*value + (1-holtAlpha)*(level+trend)
+			trend = holtBeta*(level-previous) + (1-holtBeta)*trend
+		}
+		last = p
+	}
+	return func(at time.Time) float64 {
+		return level + trend*float64(at.Sub(last.at))/float64(forecastBucket)
+	}, trend
+}
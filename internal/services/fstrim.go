@@ -0,0 +1,166 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// DefaultFstrimIntervalHours is the time between two runs of a host's
+// fstrim policy unless it sets its own.
+const DefaultFstrimIntervalHours = 24
+
+// FstrimRequest trims the filesystems of a running VM through its guest
+// agent. Free ranges smaller than MinimumBytes are left alone.
+type FstrimRequest struct {
+	MinimumBytes uint64 `json:"minimum_bytes"`
+}
+
+// FstrimResult reports what a trim freed. Disks that do not pass discards
+// on keep the trimmed blocks allocated on the host.
+type FstrimResult struct {
+	Filesystems       []libvirt.TrimmedFilesystem `json:"filesystems"`
+	TrimmedBytes      uint64                      `json:"trimmed_bytes"`
+	DisksWithoutUnmap []string                    `json:"disks_without_unmap"`
+}
+
+// FstrimPolicyRequest configures the fstrim policy of a host. A zero
+// interval selects the default.
+type FstrimPolicyRequest struct {
+	Enabled       bool   `json:"enabled"`
+	IntervalHours uint   `json:"interval_hours"`
+	MinimumBytes  uint64 `json:"minimum_bytes"`
+}
+
+// TrimVMFilesystems asks the guest agent of a running VM to discard the
+// unused blocks of its filesystems, so thin-provisioned images shrink.
+func (s *HostService) TrimVMFilesystems(hostID, vmName string, req FstrimRequest) (*FstrimResult, error) {
+	result, err := s.trimVM(hostID, vmName, req.MinimumBytes)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.fstrim", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("minimum=%d trimmed=%d", req.MinimumBytes, result.TrimmedBytes))
+	return result, nil
+}
+
+func (s *HostService) trimVM(hostID, vmName string, minimumBytes uint64) (*FstrimResult, error) {
+	filesystems, err := s.connector.TrimGuestFilesystems(hostID, vmName, minimumBytes)
+	if err != nil {
+		return nil, err
+	}
+	result := &FstrimResult{Filesystems: filesystems, DisksWithoutUnmap: []string{}}
+	for _, fs := range filesystems {
+		result.TrimmedBytes += fs.TrimmedBytes
+	}
+	if hardware, err := s.connector.GetDomainHardware(hostID, vmName); err == nil {
+		for _, disk := range hardware.Disks {
+			if disk.Device == "disk" && disk.Driver.Discard != "unmap" {
+				result.DisksWithoutUnmap = append(result.DisksWithoutUnmap, disk.Target.Dev)
+			}
+		}
+	}
+	return result, nil
+}
+
+// GetFstrimPolicy returns the fstrim policy of a host, or a disabled one
+// with the defaults if none was set.
+func (s *HostService) GetFstrimPolicy(hostID string) (*storage.FstrimPolicy, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	policy := storage.FstrimPolicy{HostID: hostID}
+	if err := s.db.Where("host_id = ?", hostID).Limit(1).Find(&policy).Error; err != nil {
+		return nil, err
+	}
+	applyFstrimDefaults(&policy)
+	return &policy, nil
+}
+
+// SetFstrimPolicy enables, disables or reconfigures the fstrim policy of a
+// host. The time of the last run is kept.
+func (s *HostService) SetFstrimPolicy(hostID string, req FstrimPolicyRequest) (*storage.FstrimPolicy, error) {
+	policy, err := s.GetFstrimPolicy(hostID)
+	if err != nil {
+		return nil, err
+	}
+	policy.Enabled = req.Enabled
+	policy.IntervalHours = req.IntervalHours
+	policy.MinimumBytes = req.MinimumBytes
+	applyFstrimDefaults(policy)
+
+	if err := s.db.Save(policy).Error; err != nil {
+		return nil, fmt.Errorf("failed to save fstrim policy: %w", err)
+	}
+	s.recordAudit("host.fstrim_policy.update", "host", hostID,
+		fmt.Sprintf("enabled=%t interval=%dh minimum=%d", policy.Enabled, policy.IntervalHours, policy.MinimumBytes))
+	return policy, nil
+}
+
+func applyFstrimDefaults(policy *storage.FstrimPolicy) {
+	if policy.IntervalHours == 0 {
+		policy.IntervalHours = DefaultFstrimIntervalHours
+	}
+}
+
+// StartFstrimPolicies checks once per interval for enabled fstrim policies
+// of connected hosts that are due, and runs them. It blocks, so run it in
+// its own goroutine.
+func (s *HostService) StartFstrimPolicies(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var policies []storage.FstrimPolicy
+		if err := s.db.Where("enabled = ?", true).Find(&policies).Error; err != nil {
+			log.Printf("Warning: failed to load fstrim policies: %v", err)
+			continue
+		}
+		connected := make(map[string]bool)
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			connected[hostID] = true
+		}
+		for i := range policies {
+			policy := &policies[i]
+			if !connected[policy.HostID] {
+				continue
+			}
+			if policy.LastRunAt != nil && time.Since(*policy.LastRunAt) < time.Duration(policy.IntervalHours)*time.Hour {
+				continue
+			}
+			if err := s.runFstrimPolicy(policy); err != nil {
+				log.Printf("Warning: fstrim policy of host %s failed: %v", policy.HostID, err)
+			}
+		}
+	}
+}
+
+// runFstrimPolicy trims the filesystems of a host's running VMs one after
+// another. VMs without a responding guest agent are skipped.
+func (s *HostService) runFstrimPolicy(policy *storage.FstrimPolicy) error {
+	now := time.Now()
+	if err := s.db.Model(policy).Update("last_run_at", &now).Error; err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND state = ?", policy.HostID, storage.StateActive).Order("name").Find(&vms).Error; err != nil {
+		return err
+	}
+	var trimmed uint64
+	var done, skipped int
+	for _, vm := range vms {
+		result, err := s.trimVM(policy.HostID, vm.Name, policy.MinimumBytes)
+		if err != nil {
+			skipped++
+			continue
+		}
+		done++
+		trimmed += result.TrimmedBytes
+	}
+	log.Printf("Fstrim policy of host %s trimmed %d MiB in %d VMs; %d VMs skipped", policy.HostID, trimmed>>20, done, skipped)
+	return nil
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/console"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Limits of console passwords. VNC authentication only looks at the first
+// eight characters, so longer passwords are refused for VMs with VNC.
+const (
+	maxVNCPasswordLength      = 8
+	maxGraphicsPasswordLength = 64
+	maxGraphicsPasswordExpiry = 30 * 24 * 60 * 60
+)
+
+// ErrInvalidGraphicsPassword is returned for a console password or expiry out
+// of range.
+var ErrInvalidGraphicsPassword = errors.New("invalid graphics password request")
+
+// GraphicsPasswordRequest sets the console password of a VM.
+type GraphicsPasswordRequest struct {
+	Password         string `json:"password"`           // Generated when empty
+	ExpiresInSeconds int    `json:"expires_in_seconds"` // 0 keeps the password valid until it is changed
+}
+
+// GraphicsPasswordResult is the outcome of setting a console password. The
+// password is only ever returned here.
+type GraphicsPasswordResult struct {
+	Password  string     `json:"password"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Displays  []string   `json:"displays"` // Types of the displays changed, e.g. 'vnc'
+}
+
+// GraphicsPasswordStatus tells whether a VM's consoles are password
+// protected, without revealing the password.
+type GraphicsPasswordStatus struct {
+	Set       bool       `json:"set"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Expired   bool       `json:"expired"`
+	Revoked   bool       `json:"revoked"`
+}
+
+// randomGraphicsPassword returns a random password of the given length.
+func randomGraphicsPassword(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)[:length], nil
+}
+
+// GetGraphicsPasswordStatus tells whether a VM's consoles have a password
+// set through Virtumancer and whether it is still valid.
+func (s *HostService) GetGraphicsPasswordStatus(hostID, vmName string) (*GraphicsPasswordStatus, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	var record storage.VMGraphicsPassword
+	if err := s.db.Where("vm_id = ?", vm.ID).Limit(1).Find(&record).Error; err != nil {
+		return nil, err
+	}
+	status := &GraphicsPasswordStatus{}
+	if record.ID == 0 {
+		return status, nil
+	}
+	status.Set = true
+	status.UpdatedAt = &record.UpdatedAt
+	status.ExpiresAt = record.ExpiresAt
+	status.Revoked = record.Revoked
+	status.Expired = record.Revoked || (record.ExpiresAt != nil && record.ExpiresAt.Before(time.Now()))
+	return status, nil
+}
+
+// SetGraphicsPassword sets or rotates the password of a VM's VNC and SPICE
+// displays without restarting it. The old password stops working at once
+// and only a hash of the new one is stored.
+func (s *HostService) SetGraphicsPassword(hostID, vmName string, req GraphicsPasswordRequest) (*GraphicsPasswordResult, error) {
+	if req.ExpiresInSeconds < 0 || req.ExpiresInSeconds > maxGraphicsPasswordExpiry {
+		return nil, fmt.Errorf("%w: expires_in_seconds must be 0-%d", ErrInvalidGraphicsPassword, maxGraphicsPasswordExpiry)
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	displays, err := console.ListDisplays(s.connector, hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	maxLength := maxGraphicsPasswordLength
+	for _, d := range displays {
+		if d.Type == "vnc" {
+			maxLength = maxVNCPasswordLength
+		}
+	}
+	if req.Password == "" {
+		if req.Password, err = randomGraphicsPassword(maxLength); err != nil {
+			return nil, err
+		}
+	}
+	if len(req.Password) > maxLength {
+		return nil, fmt.Errorf("%w: the password can be at most %d characters for this VM", ErrInvalidGraphicsPassword, maxLength)
+	}
+
+	result := &GraphicsPasswordResult{Password: req.Password}
+	var validTo time.Time
+	if req.ExpiresInSeconds > 0 {
+		validTo = time.Now().Add(time.Duration(req.ExpiresInSeconds) * time.Second).Truncate(time.Second)
+		result.ExpiresAt = &validTo
+	}
+	if result.Displays, err = s.applyGraphicsPassword(vm, req.Password, validTo, false, true); err != nil {
+		return nil, err
+	}
+	details := "expires=never"
+	if result.ExpiresAt != nil {
+		details = "expires=" + result.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	s.recordAudit("vm.graphics-password.set", "vm", fmt.Sprintf("%s/%s", hostID, vmName), details)
+	return result, nil
+}
+
+// RevokeGraphicsPassword locks everyone out of a VM's consoles by replacing
+// the password with an unknown one that has already expired. SPICE clients
+// are disconnected; VNC clients already connected keep their session.
+func (s *HostService) RevokeGraphicsPassword(hostID, vmName string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	password, err := randomGraphicsPassword(maxVNCPasswordLength)
+	if err != nil {
+		return err
+	}
+	if _, err := s.applyGraphicsPassword(vm, password, time.Now(), true, true); err != nil {
+		return err
+	}
+	s.recordAudit("vm.graphics-password.revoke", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "")
+	return nil
+}
+
+// applyGraphicsPassword sets the password on the host and records its hash.
+// With disconnect, SPICE clients using the old password are dropped. It
+// returns the types of the displays changed.
+func (s *HostService) applyGraphicsPassword(vm *storage.VirtualMachine, password string, validTo time.Time, revoked, disconnect bool) ([]string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	displays, err := s.connector.SetGraphicsPassword(vm.HostID, vm.Name, password, validTo, disconnect)
+	if err != nil {
+		return nil, err
+	}
+
+	var record storage.VMGraphicsPassword
+	if err := s.db.Where("vm_id = ?", vm.ID).Limit(1).Find(&record).Error; err != nil {
+		return nil, err
+	}
+	record.VMID = vm.ID
+	record.PasswordHash = string(hash)
+	record.ExpiresAt = nil
+	if !validTo.IsZero() {
+		record.ExpiresAt = &validTo
+	}
+	record.Revoked = revoked
+	if err := s.db.Save(&record).Error; err != nil {
+		return nil, fmt.Errorf("failed to save graphics password: %w", err)
+	}
+	return displays, nil
+}
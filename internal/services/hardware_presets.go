@@ -0,0 +1,268 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrHardwarePresetExists is returned when a preset name is already taken.
+var ErrHardwarePresetExists = errors.New("hardware preset already exists")
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func boolPtr(b bool) *bool       { return &b }
+func uint64Ptr(n uint64) *uint64 { return &n }
+func uintPtr(n uint) *uint       { return &n }
+
+// defaultHardwarePresets fill an empty preset list at startup.
+var defaultHardwarePresets = []storage.HardwarePreset{
+	{
+		Name:        "linux-server",
+		Description: "Linux server with virtio devices and discards passed on to the image",
+		Profile:     libvirt.GuestProfileLinux,
+		VCPUs:       2,
+		MemoryBytes: 4 << 30,
+		Firmware:    libvirt.FirmwareEFI,
+		SecureBoot:  boolPtr(false),
+		DiskBus:     "virtio",
+		DiskDiscard: "unmap",
+		NICModel:    "virtio",
+	},
+	{
+		Name:        "windows-desktop",
+		Description: "Windows 10/11 desktop with secure boot, a TPM and Hyper-V enlightenments",
+		Profile:     libvirt.GuestProfileWindows,
+		VCPUs:       4,
+		MemoryBytes: 8 << 30,
+		Firmware:    libvirt.FirmwareEFI,
+		SecureBoot:  boolPtr(true),
+		TPM:         boolPtr(true),
+		DiskBus:     "sata",
+		DiskDiscard: "unmap",
+		NICModel:    "e1000",
+	},
+	{
+		Name:        "minimal-appliance",
+		Description: "Small appliance that yields CPU and disk time to other VMs",
+		Profile:     libvirt.GuestProfileLinux,
+		VCPUs:       1,
+		MemoryBytes: 512 << 20,
+		Firmware:    libvirt.FirmwareBIOS,
+		DiskBus:     "virtio",
+		NICModel:    "virtio",
+		CPUShares:   uint64Ptr(512),
+		BlkioWeight: uintPtr(250),
+	},
+}
+
+// HardwarePresetRequest defines or redefines a hardware preset. Empty
+// fields are left to the guest profile.
+type HardwarePresetRequest struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Profile     string  `json:"profile"`
+	VCPUs       uint    `json:"vcpus"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+	Firmware    string  `json:"firmware"`
+	SecureBoot  *bool   `json:"secure_boot"`
+	TPM         *bool   `json:"tpm"`
+	DiskBus     string  `json:"disk_bus"`
+	DiskDiscard string  `json:"disk_discard"`
+	NICModel    string  `json:"nic_model"`
+	CPUShares   *uint64 `json:"cpu_shares"`
+	BlkioWeight *uint   `json:"blkio_weight"`
+}
+
+// EnsureDefaultHardwarePresets adds presets for common guests while there
+// are none.
+func (s *HostService) EnsureDefaultHardwarePresets() {
+	var count int64
+	if err := s.db.Model(&storage.HardwarePreset{}).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	for _, preset := range defaultHardwarePresets {
+		if err := s.db.Create(&preset).Error; err != nil {
+			log.Printf("Warning: failed to add hardware preset %s: %v", preset.Name, err)
+		}
+	}
+}
+
+func normalizeHardwarePreset(req HardwarePresetRequest) (HardwarePresetRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.NICModel = strings.TrimSpace(req.NICModel)
+	var v validator
+	if !presetNamePattern.MatchString(req.Name) {
+		v.add("name", "must start with a letter or digit and contain only letters, digits, '_', '.' and '-' (at most 64)")
+	}
+	if req.Profile != "" && req.Profile != libvirt.GuestProfileLinux && req.Profile != libvirt.GuestProfileWindows {
+		v.add("profile", "must be '%s' or '%s'", libvirt.GuestProfileLinux, libvirt.GuestProfileWindows)
+	}
+	if req.MemoryBytes != 0 && req.MemoryBytes < minVMMemoryBytes {
+		v.add("memory_bytes", "must be at least %d MiB", minVMMemoryBytes>>20)
+	}
+	switch req.Firmware {
+	case "", libvirt.FirmwareEFI:
+	case libvirt.FirmwareBIOS:
+		if req.SecureBoot != nil && *req.SecureBoot {
+			v.add("secure_boot", "requires EFI firmware")
+		}
+	default:
+		v.add("firmware", "must be '%s' or '%s'", libvirt.FirmwareBIOS, libvirt.FirmwareEFI)
+	}
+	if req.DiskBus != "" && req.DiskBus != "virtio" && req.DiskBus != "sata" {
+		v.add("disk_bus", "must be 'virtio' or 'sata'")
+	}
+	if req.DiskDiscard != "" && !libvirt.DiskDiscardModes[req.DiskDiscard] {
+		v.add("disk_discard", "must be 'unmap' or 'ignore'")
+	}
+	if req.CPUShares != nil && (*req.CPUShares < minCPUShares || *req.CPUShares > maxCPUShares) {
+		v.add("cpu_shares", "must be between %d and %d", minCPUShares, maxCPUShares)
+	}
+	if req.BlkioWeight != nil && (*req.BlkioWeight < minBlkioWeight || *req.BlkioWeight > maxBlkioWeight) {
+		v.add("blkio_weight", "must be between %d and %d", minBlkioWeight, maxBlkioWeight)
+	}
+	return req, v.err()
+}
+
+// ListHardwarePresets returns the hardware presets by name.
+func (s *HostService) ListHardwarePresets() ([]storage.HardwarePreset, error) {
+	presets := []storage.HardwarePreset{}
+	if err := s.db.Order("name").Find(&presets).Error; err != nil {
+		return nil, err
+	}
+	return presets, nil
+}
+
+// GetHardwarePreset returns one hardware preset.
+func (s *HostService) GetHardwarePreset(name string) (*storage.HardwarePreset, error) {
+	var preset storage.HardwarePreset
+	if err := s.db.Where("name = ?", name).First(&preset).Error; err != nil {
+		return nil, fmt.Errorf("could not find hardware preset %s: %w", name, err)
+	}
+	return &preset, nil
+}
+
+// CreateHardwarePreset adds a hardware preset.
+func (s *HostService) CreateHardwarePreset(req HardwarePresetRequest) (*storage.HardwarePreset, error) {
+	req, err := normalizeHardwarePreset(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.HardwarePreset{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrHardwarePresetExists, req.Name)
+	}
+
+	preset := storage.HardwarePreset{Name: req.Name}
+	applyHardwarePresetRequest(&preset, req)
+	if err := s.db.Create(&preset).Error; err != nil {
+		return nil, fmt.Errorf("failed to save hardware preset: %w", err)
+	}
+	s.recordAudit("hardware_preset.create", "hardware_preset", preset.Name, hardwarePresetSummary(&preset))
+	return &preset, nil
+}
+
+// UpdateHardwarePreset redefines a hardware preset. VMs created from it keep
+// their hardware. The preset cannot be renamed.
+func (s *HostService) UpdateHardwarePreset(name string, req HardwarePresetRequest) (*storage.HardwarePreset, error) {
+	preset, err := s.GetHardwarePreset(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = preset.Name
+	if req, err = normalizeHardwarePreset(req); err != nil {
+		return nil, err
+	}
+
+	applyHardwarePresetRequest(preset, req)
+	if err := s.db.Save(preset).Error; err != nil {
+		return nil, fmt.Errorf("failed to save hardware preset: %w", err)
+	}
+	s.recordAudit("hardware_preset.update", "hardware_preset", preset.Name, hardwarePresetSummary(preset))
+	return preset, nil
+}
+
+// DeleteHardwarePreset removes a hardware preset.
+func (s *HostService) DeleteHardwarePreset(name string) error {
+	preset, err := s.GetHardwarePreset(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(preset).Error; err != nil {
+		return fmt.Errorf("failed to delete hardware preset: %w", err)
+	}
+	s.recordAudit("hardware_preset.delete", "hardware_preset", name, "")
+	return nil
+}
+
+func applyHardwarePresetRequest(preset *storage.HardwarePreset, req HardwarePresetRequest) {
+	preset.Description = req.Description
+	preset.Profile = req.Profile
+	preset.VCPUs = req.VCPUs
+	preset.MemoryBytes = req.MemoryBytes
+	preset.Firmware = req.Firmware
+	preset.SecureBoot = req.SecureBoot
+	preset.TPM = req.TPM
+	preset.DiskBus = req.DiskBus
+	preset.DiskDiscard = req.DiskDiscard
+	preset.NICModel = req.NICModel
+	preset.CPUShares = req.CPUShares
+	preset.BlkioWeight = req.BlkioWeight
+}
+
+func hardwarePresetSummary(preset *storage.HardwarePreset) string {
+	return fmt.Sprintf("profile=%s vcpus=%d memory=%d firmware=%s disk_bus=%s nic_model=%s",
+		valueOr(preset.Profile, "default"), preset.VCPUs, preset.MemoryBytes, valueOr(preset.Firmware, "default"),
+		valueOr(preset.DiskBus, "default"), valueOr(preset.NICModel, "default"))
+}
+
+// applyHardwarePreset fills in what a VM creation request leaves out from
+// a preset. Anything the request sets wins.
+func applyHardwarePreset(req *VMCreateRequest, preset *storage.HardwarePreset) {
+	if req.Profile == "" {
+		req.Profile = preset.Profile
+	}
+	if req.VCPUs == 0 {
+		req.VCPUs = preset.VCPUs
+	}
+	if req.MemoryBytes == 0 {
+		req.MemoryBytes = preset.MemoryBytes
+	}
+	if req.Firmware == "" {
+		req.Firmware = preset.Firmware
+	}
+	if req.SecureBoot == nil {
+		req.SecureBoot = preset.SecureBoot
+	}
+	if req.TPM == nil {
+		req.TPM = preset.TPM
+	}
+	if req.Disk != nil {
+		if req.Disk.Bus == "" {
+			req.Disk.Bus = preset.DiskBus
+		}
+		if req.Disk.Discard == "" {
+			req.Disk.Discard = preset.DiskDiscard
+		}
+	}
+	for i := range req.NICs {
+		if req.NICs[i].Model == "" {
+			req.NICs[i].Model = preset.NICModel
+		}
+	}
+	if req.CPUShares == nil {
+		req.CPUShares = preset.CPUShares
+	}
+	if req.BlkioWeight == nil {
+		req.BlkioWeight = preset.BlkioWeight
+	}
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Health checks, as named in the reasons for a status.
+const (
+	HealthCheckState       = "state"       // The VM's state
+	HealthCheckGuestAgent  = "guest-agent" // The guest agent of a running VM is disconnected
+	HealthCheckStats       = "stats"       // What is known of a running VM is out of date
+	HealthCheckDiskFull    = "disk-full"   // A filesystem in the guest is filling up
+	HealthCheckBlockJob    = "block-job"   // A block job of the VM failed
+	HealthCheckConnection  = "connection"  // The host is not connected
+	HealthCheckMaintenance = "maintenance" // The host is in maintenance mode
+	HealthCheckSync        = "sync"        // The periodic sync of the host keeps failing
+	HealthCheckAlert       = "alert"       // The host has an open alert
+)
+
+const (
+	defaultHealthStatsStaleMinutes   = 30
+	maxHealthStatsStaleMinutes       = 7 * 24 * 60
+	defaultHealthDiskWarningPercent  = 85.0
+	defaultHealthDiskCriticalPercent = 95.0
+	// healthSyncFailures is how many periodic syncs of a host must fail in a
+	// row before its health shows it; a single failure is often a blip.
+	healthSyncFailures = 3
+)
+
+var defaultHealthStateStatuses = map[storage.VMState]storage.HealthStatus{
+	storage.StateError:     storage.HealthRed,
+	storage.StatePaused:    storage.HealthYellow,
+	storage.StateSuspended: storage.HealthYellow,
+}
+
+var vmStates = []storage.VMState{
+	storage.StateInitialized, storage.StateActive, storage.StatePaused,
+	storage.StateSuspended, storage.StateStopped, storage.StateError,
+}
+
+// HealthSettingsView is the health configuration with its defaults filled
+// in. States missing from StateStatuses are green.
+type HealthSettingsView struct {
+	StateStatuses       map[storage.VMState]storage.HealthStatus `json:"state_statuses"`
+	AgentStatus         storage.HealthStatus                     `json:"agent_status"`
+	StatsStaleMinutes   uint                                     `json:"stats_stale_minutes"`
+	StatsStaleStatus    storage.HealthStatus                     `json:"stats_stale_status"`
+	DiskWarningPercent  float64                                  `json:"disk_warning_percent"`
+	DiskCriticalPercent float64                                  `json:"disk_critical_percent"`
+	BlockJobStatus      storage.HealthStatus                     `json:"block_job_status"`
+	MaintenanceStatus   storage.HealthStatus                     `json:"maintenance_status"`
+	SyncFailureStatus   storage.HealthStatus                     `json:"sync_failure_status"`
+}
+
+// GetHealthSettings returns the rules health is computed with.
+func (s *HostService) GetHealthSettings() (*HealthSettingsView, error) {
+	var settings storage.HealthSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	view := &HealthSettingsView{
+		StateStatuses:       make(map[storage.VMState]storage.HealthStatus),
+		AgentStatus:         settings.AgentStatus,
+		StatsStaleMinutes:   settings.StatsStaleMinutes,
+		StatsStaleStatus:    settings.StatsStaleStatus,
+		DiskWarningPercent:  settings.DiskWarningPercent,
+		DiskCriticalPercent: settings.DiskCriticalPercent,
+		BlockJobStatus:      settings.BlockJobStatus,
+		MaintenanceStatus:   settings.MaintenanceStatus,
+		SyncFailureStatus:   settings.SyncFailureStatus,
+	}
+	for state, status := range defaultHealthStateStatuses {
+		view.StateStatuses[state] = status
+	}
+	for state, status := range settings.StateStatuses {
+		view.StateStatuses[state] = status
+	}
+	for _, status := range []*storage.HealthStatus{&view.AgentStatus, &view.StatsStaleStatus, &view.MaintenanceStatus, &view.SyncFailureStatus} {
+		if *status == "" {
+			*status = storage.HealthYellow
+		}
+	}
+	if view.BlockJobStatus == "" {
+		view.BlockJobStatus = storage.HealthRed
+	}
+	if view.StatsStaleMinutes == 0 {
+		view.StatsStaleMinutes = defaultHealthStatsStaleMinutes
+	}
+	if view.DiskWarningPercent == 0 {
+		view.DiskWarningPercent = defaultHealthDiskWarningPercent
+	}
+	if view.DiskCriticalPercent == 0 {
+		view.DiskCriticalPercent = defaultHealthDiskCriticalPercent
+	}
+	return view, nil
+}
+
+func validHealthStatus(status storage.HealthStatus) bool {
+	return status == storage.HealthGreen || status == storage.HealthYellow || status == storage.HealthRed
+}
+
+// SetHealthSettings changes the rules health is computed with. Zero values
+// select the defaults and a status of 'green' turns a check off. The health
+// monitor applies them on its next round.
+func (s *HostService) SetHealthSettings(req HealthSettingsView) (*HealthSettingsView, error) {
+	var v validator
+	for state, status := range req.StateStatuses {
+		if !slices.Contains(vmStates, state) {
+			v.add("state_statuses", "unknown state '%s'", state)
+		}
+		if !validHealthStatus(status) {
+			v.add(fmt.Sprintf("state_statuses[%s]", state), "must be 'green', 'yellow' or 'red'")
+		}
+	}
+	statuses := []struct {
+		field  string
+		status storage.HealthStatus
+	}{
+		{"agent_status", req.AgentStatus},
+		{"stats_stale_status", req.StatsStaleStatus},
+		{"block_job_status", req.BlockJobStatus},
+		{"maintenance_status", req.MaintenanceStatus},
+		{"sync_failure_status", req.SyncFailureStatus},
+	}
+	for _, rule := range statuses {
+		if rule.status != "" && !validHealthStatus(rule.status) {
+			v.add(rule.field, "must be empty (default), 'green', 'yellow' or 'red'")
+		}
+	}
+	if req.StatsStaleMinutes > maxHealthStatsStaleMinutes {
+		v.add("stats_stale_minutes", "must be 0 (default) or between 1 and %d", maxHealthStatsStaleMinutes)
+	}
+	if req.DiskWarningPercent < 0 || req.DiskWarningPercent > 100 {
+		v.add("disk_warning_percent", "must be between 0 (default) and 100")
+	}
+	if req.DiskCriticalPercent < 0 || req.DiskCriticalPercent > 100 {
+		v.add("disk_critical_percent", "must be between 0 (default) and 100")
+	}
+	warning, critical := req.DiskWarningPercent, req.DiskCriticalPercent
+	if warning == 0 {
+		warning = defaultHealthDiskWarningPercent
+	}
+	if critical == 0 {
+		critical = defaultHealthDiskCriticalPercent
+	}
+	if warning >= critical {
+		v.add("disk_warning_percent", "must be below disk_critical_percent")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	row := storage.HealthSettings{
+		ID:                  1,
+		StateStatuses:       req.StateStatuses,
+		AgentStatus:         req.AgentStatus,
+		StatsStaleMinutes:   req.StatsStaleMinutes,
+		StatsStaleStatus:    req.StatsStaleStatus,
+		DiskWarningPercent:  req.DiskWarningPercent,
+		DiskCriticalPercent: req.DiskCriticalPercent,
+		BlockJobStatus:      req.BlockJobStatus,
+		MaintenanceStatus:   req.MaintenanceStatus,
+		SyncFailureStatus:   req.SyncFailureStatus,
+	}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save health settings: %w", err)
+	}
+	settings, err := s.GetHealthSettings()
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("health.update", "health", "global",
+		fmt.Sprintf("agent_status=%s stats_stale_minutes=%d stats_stale_status=%s disk_warning_percent=%g disk_critical_percent=%g block_job_status=%s maintenance_status=%s sync_failure_status=%s",
+			settings.AgentStatus, settings.StatsStaleMinutes, settings.StatsStaleStatus, settings.DiskWarningPercent,
+			settings.DiskCriticalPercent, settings.BlockJobStatus, settings.MaintenanceStatus, settings.SyncFailureStatus))
+	return settings, nil
+}
+
+// StartHealthMonitor periodically computes the health of every host and VM
+// and stores it where it changed. It blocks, so run it in its own goroutine.
+func (s *HostService) StartHealthMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.evaluateHealth(); err != nil {
+			log.Printf("Warning: failed to evaluate health: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// evaluateHealth runs the health checks of all hosts and VMs, and tells
+// clients about the hosts and VMs whose health changed.
+func (s *HostService) evaluateHealth() error {
+	settings, err := s.GetHealthSettings()
+	if err != nil {
+		return err
+	}
+	connected := make(map[string]bool)
+	for _, hostID := range s.connector.ConnectedHostIDs() {
+		connected[hostID] = true
+	}
+	now := time.Now()
+
+	var hosts []storage.Host
+	if err := s.db.Find(&hosts).Error; err != nil {
+		return fmt.Errorf("failed to list hosts: %w", err)
+	}
+	var alerts []storage.Alert
+	if err := s.db.Where("resolved_at IS NULL AND suppressed = ?", false).Order("id").Find(&alerts).Error; err != nil {
+		return fmt.Errorf("failed to list open alerts: %w", err)
+	}
+	hostsChanged := false
+	for _, host := range hosts {
+		reasons := s.hostHealthReasons(&host, settings, connected[host.ID], alerts)
+		if host.HealthReasons != nil && host.Health == worstHealth(reasons) && slices.Equal(host.HealthReasons, reasons) {
+			continue
+		}
+		if err := s.storeHealth("hosts", host.ID, reasons, now); err != nil {
+			log.Printf("Warning: failed to store the health of host %s: %v", host.ID, err)
+			continue
+		}
+		hostsChanged = true
+	}
+	if hostsChanged {
+		s.broadcastHostsChanged()
+	}
+
+	var vms []storage.VirtualMachine
+	if err := s.db.Find(&vms).Error; err != nil {
+		return fmt.Errorf("failed to list VMs: %w", err)
+	}
+	changedHosts := make(map[string]bool)
+	for _, vm := range vms {
+		reasons := s.vmHealthReasons(&vm, settings, connected[vm.HostID], now)
+		if vm.HealthReasons != nil && vm.Health == worstHealth(reasons) && slices.Equal(vm.HealthReasons, reasons) {
+			continue
+		}
+		if err := s.storeHealth("virtual_machines", vm.ID, reasons, now); err != nil {
+			log.Printf("Warning: failed to store the health of VM %s on host %s: %v", vm.Name, vm.HostID, err)
+			continue
+		}
+		changedHosts[vm.HostID] = true
+	}
+	for hostID := range changedHosts {
+		s.broadcastVMsChanged(hostID)
+	}
+	return nil
+}
+
+// storeHealth writes the health of a host or VM. Health is not part of what
+// a host or VM is configured to be, so it is written past the generation
+// counter: a VM going from green to yellow and back must not fail spec
+// edits made with If-Match.
+func (s *HostService) storeHealth(table string, id interface{}, reasons []storage.HealthReason, now time.Time) error {
+	encoded, err := json.Marshal(reasons)
+	if err != nil {
+		return err
+	}
+	return s.db.Exec("UPDATE "+table+" SET health = ?, health_reasons = ?, health_changed_at = ? WHERE id = ?",
+		worstHealth(reasons), string(encoded), now, id).Error
+}
+
+// worstHealth returns the most severe status among the reasons, green when
+// there are none.
+func worstHealth(reasons []storage.HealthReason) storage.HealthStatus {
+	worst := storage.HealthGreen
+	for _, reason := range reasons {
+		switch {
+		case reason.Status == storage.HealthRed:
+			return storage.HealthRed
+		case reason.Status == storage.HealthYellow:
+			worst = storage.HealthYellow
+		}
+	}
+	return worst
+}
+
+// addHealthReason appends a failed check unless its status turns it off.
+func addHealthReason(reasons []storage.HealthReason, check string, status storage.HealthStatus, format string, args ...interface{}) []storage.HealthReason {
+	if status == storage.HealthGreen {
+		return reasons
+	}
+	return append(reasons, storage.HealthReason{Check: check, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// hostHealthReasons runs the health checks of a host.
+func (s *HostService) hostHealthReasons(host *storage.Host, settings *HealthSettingsView, connected bool, alerts []storage.Alert) []storage.HealthReason {
+	reasons := []storage.HealthReason{}
+	if !connected {
+		reasons = addHealthReason(reasons, HealthCheckConnection, storage.HealthRed, "Host is not connected")
+	}
+	if host.MaintenanceMode {
+		reasons = addHealthReason(reasons, HealthCheckMaintenance, settings.MaintenanceStatus, "Host is in maintenance mode")
+	}
+	if connected {
+		if _, failures, lastError := s.syncSchedule.outcome(host.ID); failures >= healthSyncFailures {
+			reasons = addHealthReason(reasons, HealthCheckSync, settings.SyncFailureStatus, "Last %d syncs failed: %s", failures, lastError)
+		}
+	}
+	for _, alert := range alerts {
+		if alert.HostID != host.ID {
+			continue
+		}
+		status := storage.HealthYellow
+		if alert.Severity == storage.AlertCritical {
+			status = storage.HealthRed
+		}
+		reasons = addHealthReason(reasons, HealthCheckAlert, status, "%s", alert.Message)
+	}
+	return reasons
+}
+
+// vmHealthReasons runs the health checks of a VM. What the guest reports,
+// its agent and filesystems, is only checked while it runs.
+func (s *HostService) vmHealthReasons(vm *storage.VirtualMachine, settings *HealthSettingsView, connected bool, now time.Time) []storage.HealthReason {
+	reasons := []storage.HealthReason{}
+	if status, ok := settings.StateStatuses[vm.State]; ok {
+		reasons = addHealthReason(reasons, HealthCheckState, status, "VM is %s", vm.State)
+	}
+	if vm.State == storage.StateActive {
+		if vm.GuestAgent == libvirt.GuestAgentDisconnected {
+			reasons = addHealthReason(reasons, HealthCheckGuestAgent, settings.AgentStatus, "Guest agent is not connected")
+		}
+		if !connected {
+			reasons = addHealthReason(reasons, HealthCheckStats, settings.StatsStaleStatus, "Host is not connected, so the VM's state may be out of date")
+		} else if lastSync, _, _ := s.syncSchedule.outcome(vm.HostID); !lastSync.IsZero() {
+			if age := now.Sub(lastSync); age > time.Duration(settings.StatsStaleMinutes)*time.Minute {
+				reasons = addHealthReason(reasons, HealthCheckStats, settings.StatsStaleStatus, "Not refreshed for %s", age.Truncate(time.Minute))
+			}
+		}
+		for _, fs := range vm.GuestFilesystems {
+			switch {
+			case fs.UsedPercent >= settings.DiskCriticalPercent:
+				reasons = addHealthReason(reasons, HealthCheckDiskFull, storage.HealthRed, "%s is %.0f%% full", fs.Mountpoint, fs.UsedPercent)
+			case fs.UsedPercent >= settings.DiskWarningPercent:
+				reasons = addHealthReason(reasons, HealthCheckDiskFull, storage.HealthYellow, "%s is %.0f%% full", fs.Mountpoint, fs.UsedPercent)
+			}
+		}
+	}
+	for _, job := range s.connector.FailedBlockJobs(vm.HostID, vm.Name) {
+		reasons = addHealthReason(reasons, HealthCheckBlockJob, settings.BlockJobStatus,
+			"%s job on disk %s failed at %s", job.Type, job.Disk, job.FailedAt.Format(time.RFC3339))
+	}
+	return reasons
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/agent"
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrAgentUnauthorized is returned when an agent presents an unknown host or a bad token.
+var ErrAgentUnauthorized = errors.New("agent authentication failed")
+
+// isAgentHost reports whether a host is reached through a reverse tunnel.
+func isAgentHost(host storage.Host) bool {
+	hostURI, err := libvirt.ParseHostURI(host.URI)
+	return err == nil && hostURI.Transport == libvirt.TransportAgent
+}
+
+// issueAgentToken generates a new agent token, storing only its hash on the host.
+func issueAgentToken(host *storage.Host) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("failed to generate agent token: %w", err)
+	}
+	host.AgentToken = hex.EncodeToString(buf)
+	host.AgentTokenHash = hashAgentToken(host.AgentToken)
+	return nil
+}
+
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AuthenticateAgent checks the credentials an agent presents when connecting.
+func (s *HostService) AuthenticateAgent(hostID, token string) error {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return ErrAgentUnauthorized
+	}
+	if !isAgentHost(host) || host.AgentTokenHash == "" || token == "" {
+		return ErrAgentUnauthorized
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAgentToken(token)), []byte(host.AgentTokenHash)) != 1 {
+		return ErrAgentUnauthorized
+	}
+	return nil
+}
+
+// RunAgentSession connects to a host's libvirt daemon over its freshly
+// established reverse tunnel and blocks until the tunnel goes away.
+func (s *HostService) RunAgentSession(hostID string, session *agent.Session) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		log.Printf("Agent session for unknown host %s rejected: %v", hostID, err)
+		session.Close()
+		return
+	}
+
+	s.connector.RegisterAgent(hostID, session)
+	go session.Serve()
+	log.Printf("Agent for host %s connected", hostID)
+
+	// A reconnecting agent replaces any stale libvirt connection.
+	s.disconnectHost(hostID, false)
+	if err := s.connector.AddHost(host); err != nil {
+		log.Printf("Failed to connect to libvirt through agent for host %s: %v", hostID, err)
+		s.recordEvent(EventHostConnectionFailed, hostID, "", "Failed to connect to libvirt through the agent",
+			map[string]interface{}{"error": err.Error()})
+		session.Close()
+	} else {
+		s.recordAudit("host.agent.connected", "host", hostID, "")
+		s.recordEvent(EventHostConnected, hostID, "", "Agent connected", nil)
+		s.broadcastHostsChanged()
+		go s.resumeHost(host)
+	}
+
+	<-session.Done()
+
+	s.connector.UnregisterAgent(hostID, session)
+	if !s.connector.IsTunneled(hostID) {
+		s.disconnectHost(hostID, false)
+	}
+	log.Printf("Agent for host %s disconnected", hostID)
+	s.recordEvent(EventHostDisconnected, hostID, "", "Agent disconnected", nil)
+	s.broadcastHostsChanged()
+}
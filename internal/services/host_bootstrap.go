@@ -0,0 +1,125 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// HostPrepareRequest describes a bare Linux machine to turn into a hypervisor.
+type HostPrepareRequest struct {
+	URI             string `json:"uri"`              // qemu+ssh URI of the machine
+	ProxyJump       string `json:"proxy_jump"`       // Optional bastion chain, [user@]host[:port],...
+	InstallPackages bool   `json:"install_packages"` // Install missing libvirt/qemu packages
+}
+
+// packageInstallCommands maps a package manager to the command installing the
+// hypervisor stack with it.
+var packageInstallCommands = map[string]string{
+	"apt-get": "DEBIAN_FRONTEND=noninteractive apt-get update -q && DEBIAN_FRONTEND=noninteractive apt-get install -y -q qemu-kvm libvirt-daemon-system libvirt-clients",
+	"dnf":     "dnf install -y qemu-kvm libvirt",
+	"yum":     "yum install -y qemu-kvm libvirt",
+	"zypper":  "zypper --non-interactive install qemu-kvm libvirt",
+}
+
+// bootstrapStep is a single shell step of the host preparation workflow.
+type bootstrapStep struct {
+	description string
+	command     string
+}
+
+// PrepareHost starts a task that provisions a machine as a libvirt host over
+// SSH. Once the task completes the host can be added with AddHost.
+func (s *HostService) PrepareHost(req HostPrepareRequest) (*storage.Task, error) {
+	if err := ValidateHostPrepareRequest(&req); err != nil {
+		return nil, err
+	}
+	task, err := s.tasks.Start("host.prepare", fmt.Sprintf("Preparing %s", req.URI))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("host.prepare", "host", req.URI, fmt.Sprintf("install_packages=%t", req.InstallPackages))
+
+	started := copyTask(task)
+	go func() {
+		err := s.runHostBootstrap(task, req)
+		if err != nil {
+			log.Printf("Host preparation for %s failed: %v", req.URI, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+
+	return started, nil
+}
+
+func (s *HostService) runHostBootstrap(task *storage.Task, req HostPrepareRequest) error {
+	shell, err := libvirt.DialHostShell(req.URI, req.ProxyJump)
+	if err != nil {
+		return err
+	}
+	defer shell.Close()
+	s.tasks.Step(task, 5, "SSH connection established")
+
+	// Run privileged commands through sudo when not logged in as root.
+	uid, err := shell.Run("id -u")
+	if err != nil {
+		return fmt.Errorf("failed to determine remote user: %w", err)
+	}
+	sudo := ""
+	if strings.TrimSpace(uid) != "0" {
+		sudo = "sudo -n "
+	}
+
+	pkgManager, err := shell.Run("for pm in apt-get dnf yum zypper; do command -v $pm >/dev/null 2>&1 && echo $pm && break; done")
+	if err != nil {
+		return fmt.Errorf("failed to detect package manager: %w", err)
+	}
+	pkgManager = strings.TrimSpace(pkgManager)
+	s.tasks.Step(task, 10, fmt.Sprintf("Detected package manager: %s", valueOr(pkgManager, "none")))
+
+	const checkInstalled = "command -v virsh >/dev/null 2>&1 && (command -v qemu-system-x86_64 >/dev/null 2>&1 || test -x /usr/libexec/qemu-kvm)"
+	if _, err := shell.Run(checkInstalled); err != nil {
+		if !req.InstallPackages {
+			return fmt.Errorf("libvirt and qemu are not installed; retry with install_packages enabled")
+		}
+		installCmd, ok := packageInstallCommands[pkgManager]
+		if !ok {
+			return fmt.Errorf("libvirt and qemu are not installed and no supported package manager was found")
+		}
+		s.tasks.Step(task, 15, "Installing libvirt and qemu packages")
+		if output, err := shell.Run(sudo + "sh -c '" + installCmd + "'"); err != nil {
+			return fmt.Errorf("package installation failed: %w (%s)", err, lastLine(output))
+		}
+		s.tasks.Step(task, 50, "Packages installed")
+	} else {
+		s.tasks.Step(task, 50, "libvirt and qemu are already installed")
+	}
+
+	virsh := sudo + "virsh -c qemu:///system "
+	steps := []bootstrapStep{
+		{"Enabling libvirtd", sudo + "systemctl enable --now libvirtd"},
+		{"Defining default network", virsh + "net-info default >/dev/null 2>&1 || " + virsh + "net-define /usr/share/libvirt/networks/default.xml"},
+		{"Starting default network", virsh + "net-autostart default && (" + virsh + "net-list --name | grep -qx default || " + virsh + "net-start default)"},
+		{"Defining default storage pool", virsh + "pool-info default >/dev/null 2>&1 || (" + virsh + "pool-define-as default dir --target /var/lib/libvirt/images && " + virsh + "pool-build default)"},
+		{"Starting default storage pool", virsh + "pool-autostart default && (" + virsh + "pool-list --name | grep -qx default || " + virsh + "pool-start default)"},
+	}
+	for i, step := range steps {
+		if output, err := shell.Run(step.command); err != nil {
+			return fmt.Errorf("%s failed: %w (%s)", strings.ToLower(step.description), err, lastLine(output))
+		}
+		s.tasks.Step(task, 50+(i+1)*50/(len(steps)+1), step.description+": done")
+	}
+
+	s.tasks.Step(task, 99, "Host is ready to be added")
+	return nil
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidReservation is returned for a reservation that leaves nothing for VMs.
+var ErrInvalidReservation = errors.New("the reservation must leave at least one CPU and some memory for VMs")
+
+// committedStates are the VM states that hold on to host CPU and memory.
+var committedStates = []storage.VMState{storage.StateActive, storage.StatePaused, storage.StateSuspended}
+
+// HostReservation is the CPU and memory of a host kept back for the
+// hypervisor OS.
+type HostReservation struct {
+	ReservedCPUs        uint   `json:"reserved_cpus"`
+	ReservedMemoryBytes uint64 `json:"reserved_memory_bytes"`
+}
+
+// HostCapacity is what a host can offer to VMs once its reservation is
+// subtracted, and how much of that running VMs use.
+type HostCapacity struct {
+	HostID                 string  `json:"host_id"`
+	HostName               string  `json:"host_name"`
+	TotalCPUs              uint    `json:"total_cpus"`
+	TotalMemoryBytes       uint64  `json:"total_memory_bytes"`
+	ReservedCPUs           uint    `json:"reserved_cpus"`
+	ReservedMemoryBytes    uint64  `json:"reserved_memory_bytes"`
+	AllocatableCPUs        uint    `json:"allocatable_cpus"`         // Total minus reserved
+	AllocatableMemoryBytes uint64  `json:"allocatable_memory_bytes"` // Total minus reserved
+	AllocatedVCPUs         uint    `json:"allocated_vcpus"`          // vCPUs of running, paused and suspended VMs
+	AllocatedMemoryBytes   uint64  `json:"allocated_memory_bytes"`   // Memory of running, paused and suspended VMs
+	AvailableMemoryBytes   uint64  `json:"available_memory_bytes"`   // Allocatable minus allocated, 0 when overcommitted
+	CPUOvercommitRatio     float64 `json:"cpu_overcommit_ratio"`     // Allocated vCPUs per allocatable CPU
+}
+
+// SetHostReservation sets the CPU and memory reserved for a host's
+// hypervisor OS. When the host is connected, the reservation is checked
+// against its hardware.
+func (s *HostService) SetHostReservation(hostID string, res HostReservation) error {
+	if info, err := s.connector.GetHostInfo(hostID); err == nil {
+		if res.ReservedCPUs >= info.CPU || res.ReservedMemoryBytes >= info.Memory {
+			return fmt.Errorf("%w: host %s has %d CPUs and %d MiB of memory", ErrInvalidReservation, hostID, info.CPU, info.Memory>>20)
+		}
+	}
+	result := s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{
+		"reserved_cpus":         res.ReservedCPUs,
+		"reserved_memory_bytes": res.ReservedMemoryBytes,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update the reservation of host %s: %w", hostID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find host %s: %w", hostID, gorm.ErrRecordNotFound)
+	}
+	s.recordAudit("host.reservation", "host", hostID,
+		fmt.Sprintf("cpus=%d memory=%dMiB", res.ReservedCPUs, res.ReservedMemoryBytes>>20))
+	s.broadcastHostsChanged()
+	return nil
+}
+
+// GetHostCapacity returns the CPU and memory a host can offer to VMs after
+// its reservation, and how much of it is committed to VMs that are not shut
+// off.
+func (s *HostService) GetHostCapacity(hostID string) (*HostCapacity, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	info, err := s.connector.GetHostInfo(hostID)
+	if err != nil {
+		return nil, err
+	}
+	return s.hostCapacity(&host, info)
+}
+
+func (s *HostService) hostCapacity(host *storage.Host, info *libvirt.HostInfo) (*HostCapacity, error) {
+	capacity := &HostCapacity{
+		HostID:              host.ID,
+		HostName:            host.Name,
+		TotalCPUs:           info.CPU,
+		TotalMemoryBytes:    info.Memory,
+		ReservedCPUs:        host.ReservedCPUs,
+		ReservedMemoryBytes: host.ReservedMemoryBytes,
+	}
+	if info.CPU > host.ReservedCPUs {
+		capacity.AllocatableCPUs = info.CPU - host.ReservedCPUs
+	}
+	if info.Memory > host.ReservedMemoryBytes {
+		capacity.AllocatableMemoryBytes = info.Memory - host.ReservedMemoryBytes
+	}
+
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND state IN ?", host.ID, committedStates).Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		capacity.AllocatedVCPUs += vm.VCPUCount
+		capacity.AllocatedMemoryBytes += vm.MemoryBytes
+	}
+	if capacity.AllocatableMemoryBytes > capacity.AllocatedMemoryBytes {
+		capacity.AvailableMemoryBytes = capacity.AllocatableMemoryBytes - capacity.AllocatedMemoryBytes
+	}
+	if capacity.AllocatableCPUs > 0 {
+		capacity.CPUOvercommitRatio = float64(capacity.AllocatedVCPUs) / float64(capacity.AllocatableCPUs)
+	}
+	return capacity, nil
+}
@@ -0,0 +1,410 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// Evacuation policies of a VM.
+const (
+	EvacuationMigrate           = "migrate"
+	EvacuationShutdown          = "shutdown"
+	EvacuationMigrateOrShutdown = "migrate-or-shutdown" // Shut down when the VM cannot be migrated
+)
+
+// Statuses of a VM in an evacuation.
+const (
+	EvacuationPending      = "pending"
+	EvacuationMigrating    = "migrating"
+	EvacuationShuttingDown = "shutting-down"
+	EvacuationMigrated     = "migrated"
+	EvacuationStopped      = "stopped"
+	EvacuationFailed       = "failed"
+)
+
+const (
+	defaultEvacuationParallel        = 2
+	maxEvacuationParallel            = 8
+	defaultEvacuationShutdownTimeout = 300 * time.Second
+)
+
+var (
+	// ErrEvacuationInProgress is returned when a host is already being evacuated.
+	ErrEvacuationInProgress = errors.New("host is already being evacuated")
+	// ErrNoEvacuationTarget is returned when no connected host can take a VM.
+	ErrNoEvacuationTarget = errors.New("no host can take the VM")
+)
+
+// VMEvacuationSettings says what evacuating its host does with a running VM.
+type VMEvacuationSettings struct {
+	Policy       string `json:"policy"`         // migrate, shutdown or migrate-or-shutdown; empty for migrate
+	TargetHostID string `json:"target_host_id"` // Empty picks a host at evacuation time
+}
+
+// HostEvacuationRequest empties a host of its running VMs.
+type HostEvacuationRequest struct {
+	// Target for the VMs without their own; empty picks the connected host
+	// with the most free memory that passes the precheck, per VM.
+	TargetHostID           string `json:"target_host_id"`
+	MaxParallel            uint   `json:"max_parallel"`             // VMs handled at once; 0 for 2
+	ShutdownTimeoutSeconds uint   `json:"shutdown_timeout_seconds"` // 0 for 300
+	// Tuning of every live migration.
+	MaxBandwidthMiB uint64 `json:"max_bandwidth_mib"`
+	AutoConverge    bool   `json:"auto_converge"`
+}
+
+// VMEvacuationStatus is a VM's part of an evacuation. The evacuation task
+// reports them in its metrics, under "vms" by VM name.
+type VMEvacuationStatus struct {
+	Policy       string `json:"policy"`
+	Status       string `json:"status"`
+	TargetHostID string `json:"target_host_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+// evacuation is a host evacuation in progress. Its VMs are handled in
+// parallel, so all writes to the task go through its lock.
+type evacuation struct {
+	hostID string
+	req    HostEvacuationRequest
+	task   *storage.Task
+
+	mu       sync.Mutex
+	vms      map[string]*VMEvacuationStatus
+	finished int
+}
+
+// SetVMEvacuationSettings sets what evacuating its host does with a VM.
+func (s *HostService) SetVMEvacuationSettings(hostID, vmName string, settings VMEvacuationSettings) error {
+	var v validator
+	switch settings.Policy {
+	case "", EvacuationMigrate, EvacuationShutdown, EvacuationMigrateOrShutdown:
+	default:
+		v.add("policy", "unknown policy '%s'; use migrate, shutdown or migrate-or-shutdown", settings.Policy)
+	}
+	if settings.TargetHostID == hostID {
+		v.add("target_host_id", "must be another host")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if settings.TargetHostID != "" {
+		var target storage.Host
+		if err := s.db.Where("id = ?", settings.TargetHostID).First(&target).Error; err != nil {
+			return fmt.Errorf("could not find host %s: %w", settings.TargetHostID, err)
+		}
+	}
+	err = s.db.Model(vm).Updates(map[string]interface{}{
+		"evacuation_policy":         settings.Policy,
+		"evacuation_target_host_id": settings.TargetHostID,
+	}).Error
+	if err != nil {
+		return err
+	}
+	s.recordAudit("vm.evacuation.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("policy=%s target=%s", settings.Policy, settings.TargetHostID))
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
+
+// EvacuateHost puts a host into maintenance mode and empties it of its
+// running VMs as one task: each VM is live migrated or shut down as its
+// policy says, several at a time. VMs that could not be moved or stopped
+// are left running and fail the task.
+func (s *HostService) EvacuateHost(hostID string, req HostEvacuationRequest) (*storage.Task, error) {
+	var v validator
+	if req.MaxParallel > maxEvacuationParallel {
+		v.add("max_parallel", "must be at most %d", maxEvacuationParallel)
+	}
+	if req.TargetHostID == hostID {
+		v.add("target_host_id", "must be another host")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if req.MaxParallel == 0 {
+		req.MaxParallel = defaultEvacuationParallel
+	}
+	if _, err := s.connector.GetConnection(hostID); err != nil {
+		return nil, err
+	}
+
+	if _, running := s.evacuations.LoadOrStore(hostID, true); running {
+		return nil, fmt.Errorf("%w: %s", ErrEvacuationInProgress, hostID)
+	}
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		s.evacuations.Delete(hostID)
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	// Nothing is started or placed on the host while it empties.
+	if !host.MaintenanceMode {
+		if err := s.SetHostMaintenance(hostID, true); err != nil {
+			s.evacuations.Delete(hostID)
+			return nil, err
+		}
+	}
+
+	s.SyncVMsForHost(hostID)
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND state IN ?", hostID, committedStates).Order("name").Find(&vms).Error; err != nil {
+		s.evacuations.Delete(hostID)
+		return nil, err
+	}
+	task, err := s.tasks.Start("host.evacuate", fmt.Sprintf("Evacuating %d VMs from %s", len(vms), hostID))
+	if err != nil {
+		s.evacuations.Delete(hostID)
+		return nil, err
+	}
+	s.recordAudit("host.evacuate", "host", hostID,
+		fmt.Sprintf("vms=%d target=%s parallel=%d", len(vms), req.TargetHostID, req.MaxParallel))
+
+	e := &evacuation{hostID: hostID, req: req, task: task, vms: make(map[string]*VMEvacuationStatus, len(vms))}
+	for _, vm := range vms {
+		e.vms[vm.Name] = &VMEvacuationStatus{Policy: evacuationPolicy(&vm), Status: EvacuationPending}
+	}
+	s.reportEvacuation(e, "")
+
+	started := copyTask(task)
+	go func() {
+		defer s.evacuations.Delete(hostID)
+		err := s.runEvacuation(e, vms)
+		if err != nil {
+			log.Printf("Evacuation of host %s incomplete: %v", hostID, err)
+		}
+		s.tasks.Finish(task, err)
+		s.broadcastHostsChanged()
+	}()
+	return started, nil
+}
+
+func evacuationPolicy(vm *storage.VirtualMachine) string {
+	if vm.EvacuationPolicy == "" {
+		return EvacuationMigrate
+	}
+	return vm.EvacuationPolicy
+}
+
+func (s *HostService) runEvacuation(e *evacuation, vms []storage.VirtualMachine) error {
+	slots := make(chan struct{}, e.req.MaxParallel)
+	var wg sync.WaitGroup
+	for _, vm := range vms {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(vm storage.VirtualMachine) {
+			defer func() { <-slots; wg.Done() }()
+			s.evacuateVM(e, &vm)
+		}(vm)
+	}
+	wg.Wait()
+
+	var failed []string
+	for name, status := range e.vms {
+		if status.Status == EvacuationFailed {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d of %d VMs are still running on %s: %s", len(failed), len(vms), e.hostID, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// evacuateVM migrates or shuts down one VM of an evacuation.
+func (s *HostService) evacuateVM(e *evacuation, vm *storage.VirtualMachine) {
+	policy := evacuationPolicy(vm)
+	if policy != EvacuationShutdown {
+		target, err := s.evacuationTarget(e, vm)
+		if err == nil {
+			s.updateEvacuation(e, vm.Name, EvacuationMigrating, target, nil,
+				fmt.Sprintf("Migrating %s to %s", vm.Name, target))
+			err = s.migrateForEvacuation(e, vm, target)
+			if err == nil {
+				s.updateEvacuation(e, vm.Name, EvacuationMigrated, target, nil,
+					fmt.Sprintf("%s runs on %s", vm.Name, target))
+				return
+			}
+		}
+		if policy == EvacuationMigrate {
+			s.updateEvacuation(e, vm.Name, EvacuationFailed, "", err,
+				fmt.Sprintf("Could not migrate %s: %v", vm.Name, err))
+			return
+		}
+		s.updateEvacuation(e, vm.Name, EvacuationShuttingDown, "", nil,
+			fmt.Sprintf("Could not migrate %s (%v); shutting it down", vm.Name, err))
+	} else {
+		s.updateEvacuation(e, vm.Name, EvacuationShuttingDown, "", nil, fmt.Sprintf("Shutting down %s", vm.Name))
+	}
+
+	if err := s.shutdownForEvacuation(e, vm); err != nil {
+		s.updateEvacuation(e, vm.Name, EvacuationFailed, "", err, fmt.Sprintf("Could not shut down %s: %v", vm.Name, err))
+		return
+	}
+	s.updateEvacuation(e, vm.Name, EvacuationStopped, "", nil, fmt.Sprintf("Stopped %s", vm.Name))
+}
+
+// evacuationTarget returns the host a VM moves to: its own target, else
+// the request's, else the connected host with the most free memory that
+// passes the migration precheck.
+func (s *HostService) evacuationTarget(e *evacuation, vm *storage.VirtualMachine) (string, error) {
+	target := vm.EvacuationTargetHostID
+	if target == "" {
+		target = e.req.TargetHostID
+	}
+	if target != "" {
+		precheck, err := s.PrecheckMigration(e.hostID, vm.Name, target)
+		if err != nil {
+			return "", err
+		}
+		if !precheck.Compatible {
+			return "", fmt.Errorf("%w: %s", ErrMigrationBlocked, joinMigrationIssues(precheck.Blockers))
+		}
+		return target, nil
+	}
+
+	var hosts []storage.Host
+	if err := s.db.Where("id IN ? AND id <> ? AND maintenance_mode = ?", s.connector.ConnectedHostIDs(), e.hostID, false).Find(&hosts).Error; err != nil {
+		return "", err
+	}
+	var candidates []*HostCapacity
+	for i := range hosts {
+		info, err := s.connector.GetHostInfo(hosts[i].ID)
+		if err != nil {
+			continue
+		}
+		if capacity, err := s.hostCapacity(&hosts[i], info); err == nil {
+			candidates = append(candidates, capacity)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].AvailableMemoryBytes > candidates[j].AvailableMemoryBytes
+	})
+	for _, candidate := range candidates {
+		precheck, err := s.PrecheckMigration(e.hostID, vm.Name, candidate.HostID)
+		if err == nil && precheck.Compatible {
+			return candidate.HostID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoEvacuationTarget, vm.Name)
+}
+
+// migrateForEvacuation live migrates a VM as part of an evacuation. The
+// migration is registered like one started on its own, so it can be
+// adjusted or aborted through the VM's live migration endpoints.
+func (s *HostService) migrateForEvacuation(e *evacuation, vm *storage.VirtualMachine, target string) error {
+	req := LiveMigrationRequest{TargetHostID: target, MaxBandwidthMiB: e.req.MaxBandwidthMiB, AutoConverge: e.req.AutoConverge}
+	m := &liveMigration{hostID: e.hostID, vmName: vm.Name, targetHostID: target, task: e.task, req: req, notes: make(chan string, 8)}
+	if _, running := s.liveMigrations.LoadOrStore(vm.UUID, m); running {
+		return fmt.Errorf("%w: %s is already being migrated", ErrMigrationInProgress, vm.Name)
+	}
+	defer s.liveMigrations.Delete(vm.UUID)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.connector.LiveMigrate(e.hostID, vm.Name, target, libvirt.LiveMigrationOptions{
+			MaxBandwidthMiB: req.MaxBandwidthMiB,
+			AutoConverge:    req.AutoConverge,
+		})
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				s.SyncVMsForHost(e.hostID)
+				return err
+			}
+			return s.finishLiveMigration(m, vm.UUID)
+		case note := <-m.notes:
+			s.updateEvacuation(e, vm.Name, "", "", nil, fmt.Sprintf("%s: %s", vm.Name, note))
+		}
+	}
+}
+
+// shutdownForEvacuation shuts a VM down cleanly and waits for it to stop.
+// A VM that does not stop in time is left running rather than forced off.
+func (s *HostService) shutdownForEvacuation(e *evacuation, vm *storage.VirtualMachine) error {
+	timeout := defaultEvacuationShutdownTimeout
+	if e.req.ShutdownTimeoutSeconds > 0 {
+		timeout = time.Duration(e.req.ShutdownTimeoutSeconds) * time.Second
+	}
+	if err := s.ShutdownVM(context.Background(), e.hostID, vm.Name); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(orchestrationPollPeriod)
+		info, err := s.connector.GetDomainInfo(e.hostID, vm.Name)
+		if err != nil {
+			return err
+		}
+		if info.State == golibvirt.DomainShutoff {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not shut down within %s", vm.Name, timeout)
+		}
+	}
+	if changed, err := s.syncSingleVM(e.hostID, vm.Name); err == nil && changed {
+		s.broadcastVMsChanged(e.hostID)
+	}
+	return nil
+}
+
+// updateEvacuation records a VM's new status, or only a step log line when
+// status is empty, and publishes the task.
+func (s *HostService) updateEvacuation(e *evacuation, vmName, status, target string, err error, message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if vm := e.vms[vmName]; vm != nil && status != "" {
+		vm.Status = status
+		if target != "" {
+			vm.TargetHostID = target
+		}
+		if err != nil {
+			vm.Error = err.Error()
+		}
+		switch status {
+		case EvacuationMigrated, EvacuationStopped, EvacuationFailed:
+			e.finished++
+		}
+	}
+	s.reportEvacuation(e, message)
+}
+
+// reportEvacuation publishes the statuses of an evacuation's VMs on its
+// task. The caller holds the evacuation's lock, if it is running.
+func (s *HostService) reportEvacuation(e *evacuation, message string) {
+	progress := 100
+	if len(e.vms) > 0 {
+		progress = 100 * e.finished / len(e.vms)
+	}
+	vms := make(map[string]VMEvacuationStatus, len(e.vms))
+	for name, vm := range e.vms {
+		vms[name] = *vm
+	}
+	e.task.Metrics = map[string]interface{}{
+		"vms":      vms,
+		"finished": e.finished,
+		"total":    len(e.vms),
+	}
+	if message == "" {
+		s.tasks.Report(e.task, progress, e.task.Metrics)
+		return
+	}
+	s.tasks.Step(e.task, progress, message)
+}
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+)
+
+// PermissionHostExec allows running the allow-listed commands on hosts.
+const PermissionHostExec = "hosts.exec"
+
+// Bounds of a host command, so that a hung or chatty command cannot tie up
+// the host's SSH connection or the server's memory.
+const (
+	defaultHostExecSeconds = 30
+	maxHostExecSeconds     = 300
+	maxHostExecOutput      = 1 << 20 // Per stream
+)
+
+var (
+	packageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._-]{0,127}$`)
+	commandNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9+._-]{0,63}$`)
+)
+
+// hostCommandArg is an argument of an allow-listed host command. Arguments
+// are validated and shell-quoted, never spliced in raw.
+type hostCommandArg struct {
+	name        string
+	description string
+	validate    func(value string) string // Returns what is wrong with the value, or ""
+}
+
+// hostCommand is a command the host exec service may run. Commands only
+// read or inspect; anything that changes a host has its own endpoint.
+type hostCommand struct {
+	description string
+	args        []hostCommandArg
+	build       func(args map[string]string) string
+}
+
+func absolutePathArg(name, description string) hostCommandArg {
+	return hostCommandArg{name: name, description: description, validate: func(value string) string {
+		if !path.IsAbs(value) || path.Clean(value) != value || strings.ContainsAny(value, "\x00\n") {
+			return "must be a clean absolute path"
+		}
+		return ""
+	}}
+}
+
+func patternArg(name, description string, pattern *regexp.Regexp) hostCommandArg {
+	return hostCommandArg{name: name, description: description, validate: func(value string) string {
+		if !pattern.MatchString(value) {
+			return "must match " + pattern.String()
+		}
+		return ""
+	}}
+}
+
+// hostCommands is the allow-list of the host exec service, by name.
+var hostCommands = map[string]hostCommand{
+	"qemu-img-info": {
+		description: "Format, sizes and backing chain of a disk image",
+		args:        []hostCommandArg{absolutePathArg("path", "Image path")},
+		build: func(args map[string]string) string {
+			return "qemu-img info --output=json --backing-chain -U " + libvirt.ShellQuote(args["path"])
+		},
+	},
+	"qemu-img-check": {
+		description: "Consistency check of a qcow2 image, without repairing it",
+		args:        []hostCommandArg{absolutePathArg("path", "Image path")},
+		build: func(args map[string]string) string {
+			return "qemu-img check --output=json -U " + libvirt.ShellQuote(args["path"])
+		},
+	},
+	"discard-support": {
+		description: "Discard (TRIM) support of the host's block devices",
+		build: func(map[string]string) string {
+			return "lsblk --discard --json"
+		},
+	},
+	"fstrim-dry-run": {
+		description: "What fstrim would discard on a host filesystem, without discarding it",
+		args:        []hostCommandArg{absolutePathArg("mountpoint", "Mount point of the filesystem")},
+		build: func(args map[string]string) string {
+			return "fstrim --dry-run --verbose " + libvirt.ShellQuote(args["mountpoint"])
+		},
+	},
+	"tcpdump-version": {
+		description: "Version of tcpdump, which packet captures need",
+		build: func(map[string]string) string {
+			return "tcpdump --version"
+		},
+	},
+	"tcpdump-interfaces": {
+		description: "Interfaces tcpdump can capture on",
+		build: func(map[string]string) string {
+			return "tcpdump --list-interfaces"
+		},
+	},
+	"package-version": {
+		description: "Installed version of a package, from rpm or dpkg",
+		args:        []hostCommandArg{patternArg("package", "Package name, e.g. qemu-kvm", packageNamePattern)},
+		build: func(args map[string]string) string {
+			pkg := libvirt.ShellQuote(args["package"])
+			return "if command -v rpm >/dev/null 2>&1; then rpm -q " + pkg +
+				"; else dpkg-query -W -f='${Package} ${Version}\\n' " + pkg + "; fi"
+		},
+	},
+	"command-available": {
+		description: "Whether a program is installed, and where",
+		args:        []hostCommandArg{patternArg("command", "Program name, e.g. virt-sparsify", commandNamePattern)},
+		build: func(args map[string]string) string {
+			return "command -v " + libvirt.ShellQuote(args["command"])
+		},
+	},
+}
+
+// HostCommandArgView describes an argument of an allow-listed host command.
+type HostCommandArgView struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// HostCommandView describes an allow-listed host command.
+type HostCommandView struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Args        []HostCommandArgView `json:"args"`
+}
+
+// HostExecRequest runs an allow-listed command on a host.
+type HostExecRequest struct {
+	Command        string            `json:"command"`
+	Args           map[string]string `json:"args"`
+	TimeoutSeconds int               `json:"timeout_seconds"` // 0 uses 30
+}
+
+// HostExecResult is the outcome of a host command.
+type HostExecResult struct {
+	HostID          string    `json:"host_id"`
+	Command         string    `json:"command"`
+	CommandLine     string    `json:"command_line"` // As run on the host
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ExitCode        int       `json:"exit_code"` // -1 when the command timed out or reported none
+	TimedOut        bool      `json:"timed_out"`
+	Stdout          string    `json:"stdout"`
+	Stderr          string    `json:"stderr"`
+	Truncated       bool      `json:"truncated"` // Output beyond 1 MiB per stream was dropped
+}
+
+// ListHostCommands returns the commands the host exec service runs, ordered
+// by name.
+func (s *HostService) ListHostCommands() []HostCommandView {
+	views := make([]HostCommandView, 0, len(hostCommands))
+	for name, command := range hostCommands {
+		view := HostCommandView{Name: name, Description: command.description, Args: []HostCommandArgView{}}
+		for _, arg := range command.args {
+			view.Args = append(view.Args, HostCommandArgView{Name: arg.name, Description: arg.description})
+		}
+		views = append(views, view)
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// buildHostCommand checks a request against the allow-list and returns the
+// command line to run.
+func buildHostCommand(req HostExecRequest) (string, error) {
+	var v validator
+	command, ok := hostCommands[req.Command]
+	if !ok {
+		v.add("command", "unknown command '%s', see GET /api/v1/host-commands", req.Command)
+		return "", v.err()
+	}
+	known := make(map[string]bool, len(command.args))
+	for _, arg := range command.args {
+		known[arg.name] = true
+		value, ok := req.Args[arg.name]
+		if !ok || value == "" {
+			v.add("args."+arg.name, "is required")
+			continue
+		}
+		if problem := arg.validate(value); problem != "" {
+			v.add("args."+arg.name, "%s", problem)
+		}
+	}
+	for name := range req.Args {
+		if !known[name] {
+			v.add("args."+name, "is not an argument of %s", req.Command)
+		}
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > maxHostExecSeconds {
+		v.add("timeout_seconds", "must be 0 (default) or between 1 and %d", maxHostExecSeconds)
+	}
+	if err := v.err(); err != nil {
+		return "", err
+	}
+	return command.build(req.Args), nil
+}
+
+// ExecHostCommand runs an allow-listed command on a host over the SSH
+// connection of its libvirt transport, and returns its output. Every run,
+// and every request the allow-list refuses, is recorded in the audit log
+// with the user who asked. The allow-list only covers the commands users pick
+// through this service; features such as packet captures, the pool file
+// browser and host preparation run their own fixed commands, with their own
+// validation, permissions and audit log entries for what they change.
+func (s *HostService) ExecHostCommand(actorID uint, hostID string, req HostExecRequest) (*HostExecResult, error) {
+	line, err := buildHostCommand(req)
+	if err != nil {
+		s.recordUserAudit(actorID, "host.exec.rejected", "host", hostID, fmt.Sprintf("command=%q error=%q", req.Command, err.Error()))
+		return nil, err
+	}
+	timeout := time.Duration(req.TimeoutSeconds) * time.Second
+	if timeout == 0 {
+		timeout = defaultHostExecSeconds * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	started := time.Now()
+	output, err := s.connector.ExecHostCommand(ctx, hostID, line, maxHostExecOutput)
+	duration := time.Since(started)
+	if err != nil {
+		s.recordUserAudit(actorID, "host.exec.failed", "host", hostID,
+			fmt.Sprintf("command=%s line=%q error=%q", req.Command, line, err.Error()))
+		return nil, err
+	}
+	s.recordUserAudit(actorID, "host.exec", "host", hostID,
+		fmt.Sprintf("command=%s line=%q exit_code=%d timed_out=%t duration=%.3fs stdout_bytes=%d stderr_bytes=%d",
+			req.Command, line, output.ExitCode, output.TimedOut, duration.Seconds(), len(output.Stdout), len(output.Stderr)))
+	return &HostExecResult{
+		HostID:          hostID,
+		Command:         req.Command,
+		CommandLine:     line,
+		StartedAt:       started,
+		DurationSeconds: duration.Seconds(),
+		ExitCode:        output.ExitCode,
+		TimedOut:        output.TimedOut,
+		Stdout:          output.Stdout,
+		Stderr:          output.Stderr,
+		Truncated:       output.Truncated,
+	}, nil
+}
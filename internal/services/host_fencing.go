@@ -0,0 +1,589 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Ways of checking whether a disconnected host is dead.
+const (
+	FencingMethodSSH  = "ssh"
+	FencingMethodIPMI = "ipmi"
+)
+
+// States of a host as its fencing check sees it.
+const (
+	FencingStateDisabled    = "disabled"
+	FencingStateHealthy     = "healthy"
+	FencingStateUnreachable = "unreachable"
+	FencingStateDead        = "dead"
+	FencingStateFenced      = "fenced"
+)
+
+// HostPowerFence confirms a dead host as fenced. Its tokens are issued and
+// consumed by the fencing endpoints only, not by the power ones.
+const HostPowerFence HostPowerAction = "fence"
+
+const (
+	defaultFencingDeadAfterMinutes = 5
+	maxFencingDeadAfterMinutes     = 24 * 60
+	fencingProbeTimeout            = 10 * time.Second
+)
+
+var (
+	// ErrHostNotDead is returned when fencing a host that its fencing check
+	// has not declared dead.
+	ErrHostNotDead = errors.New("host has not been declared dead by its fencing check")
+	// ErrHostNotFenced is returned when recovering the VMs of a host that has
+	// not been fenced.
+	ErrHostNotFenced = errors.New("host must be fenced before its VMs are recovered")
+)
+
+// HostFencingRequest configures the fencing check of a host.
+type HostFencingRequest struct {
+	Enabled          bool    `json:"enabled"`
+	Method           string  `json:"method"`             // ssh or ipmi
+	DeadAfterMinutes uint    `json:"dead_after_minutes"` // 0 for 5
+	IPMIAddress      string  `json:"ipmi_address"`
+	IPMIUsername     string  `json:"ipmi_username"`
+	IPMIPassword     *string `json:"ipmi_password"` // nil keeps the stored password
+}
+
+// HostFencingStatus is the fencing configuration of a host and what its
+// check found so far.
+type HostFencingStatus struct {
+	storage.HostFencing
+	State           string `json:"state"`
+	IPMIPasswordSet bool   `json:"ipmi_password_set"`
+}
+
+// RecoverableVM is a VM of a dead host and whether it can be defined on
+// another host.
+type RecoverableVM struct {
+	Name       string          `json:"name"`
+	DomainUUID string          `json:"domain_uuid"`
+	State      storage.VMState `json:"state"` // Last known state
+	// When the definition used for the recovery was read from the host; nil
+	// when none was saved, which makes the VM unrecoverable.
+	DefinitionSavedAt *time.Time                 `json:"definition_saved_at"`
+	Recoverable       bool                       `json:"recoverable"`
+	Precheck          *libvirt.MigrationPrecheck `json:"precheck,omitempty"` // Only with a target
+}
+
+// HostRecoveryPlan lists the VMs of a dead host for recovery on a target.
+type HostRecoveryPlan struct {
+	HostID       string          `json:"host_id"`
+	State        string          `json:"state"`
+	TargetHostID string          `json:"target_host_id,omitempty"`
+	VMs          []RecoverableVM `json:"vms"`
+}
+
+// HostRecoveryRequest defines VMs of a fenced host on another host.
+type HostRecoveryRequest struct {
+	TargetHostID string   `json:"target_host_id"`
+	VMs          []string `json:"vms"`   // Empty for every VM with a saved definition
+	Start        bool     `json:"start"` // Start the VMs that were running when the host died
+}
+
+func fencingState(f *storage.HostFencing) string {
+	switch {
+	case !f.Enabled:
+		return FencingStateDisabled
+	case f.FencedAt != nil:
+		return FencingStateFenced
+	case f.DeadAt != nil:
+		return FencingStateDead
+	case f.UnreachableSince != nil:
+		return FencingStateUnreachable
+	default:
+		return FencingStateHealthy
+	}
+}
+
+func (s *HostService) getHostFencing(hostID string) (*storage.Host, *storage.HostFencing, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	fencing := storage.HostFencing{HostID: hostID, Method: FencingMethodSSH, DeadAfterMinutes: defaultFencingDeadAfterMinutes}
+	if err := s.db.Where("host_id = ?", hostID).Limit(1).Find(&fencing).Error; err != nil {
+		return nil, nil, err
+	}
+	return &host, &fencing, nil
+}
+
+// GetHostFencing returns the fencing configuration and state of a host.
+func (s *HostService) GetHostFencing(hostID string) (*HostFencingStatus, error) {
+	_, fencing, err := s.getHostFencing(hostID)
+	if err != nil {
+		return nil, err
+	}
+	return &HostFencingStatus{HostFencing: *fencing, State: fencingState(fencing), IPMIPasswordSet: fencing.IPMIPassword != ""}, nil
+}
+
+// SetHostFencing configures the check that declares a disconnected host
+// dead. Disabling it also forgets what the check found so far.
+func (s *HostService) SetHostFencing(hostID string, req HostFencingRequest) (*HostFencingStatus, error) {
+	host, fencing, err := s.getHostFencing(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if req.DeadAfterMinutes == 0 {
+		req.DeadAfterMinutes = defaultFencingDeadAfterMinutes
+	}
+	password := fencing.IPMIPassword
+	if req.IPMIPassword != nil {
+		password = *req.IPMIPassword
+	}
+	var v validator
+	switch req.Method {
+	case FencingMethodSSH:
+		if isAgentHost(*host) {
+			v.add("method", "hosts connected through an agent can only be checked over ipmi")
+		}
+	case FencingMethodIPMI:
+		if req.IPMIAddress == "" {
+			v.add("ipmi_address", "is required for ipmi")
+		}
+		if req.IPMIUsername == "" {
+			v.add("ipmi_username", "is required for ipmi")
+		}
+	default:
+		v.add("method", "unknown method '%s'; use ssh or ipmi", req.Method)
+	}
+	if req.DeadAfterMinutes > maxFencingDeadAfterMinutes {
+		v.add("dead_after_minutes", "must be at most %d", maxFencingDeadAfterMinutes)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	fencing.Enabled = req.Enabled
+	fencing.Method = req.Method
+	fencing.DeadAfterMinutes = req.DeadAfterMinutes
+	fencing.IPMIAddress = req.IPMIAddress
+	fencing.IPMIUsername = req.IPMIUsername
+	fencing.IPMIPassword = password
+	if !req.Enabled {
+		fencing.UnreachableSince, fencing.DeadAt, fencing.FencedAt = nil, nil, nil
+	}
+	if err := s.db.Save(fencing).Error; err != nil {
+		return nil, fmt.Errorf("failed to save fencing settings: %w", err)
+	}
+	s.recordAudit("host.fencing.update", "host", hostID,
+		fmt.Sprintf("enabled=%t method=%s dead_after=%dm", req.Enabled, req.Method, req.DeadAfterMinutes))
+	s.broadcastHostsChanged()
+	return s.GetHostFencing(hostID)
+}
+
+// StartFencingMonitor periodically checks the hosts with fencing enabled.
+// Connected hosts have their VM definitions saved for a later recovery;
+// disconnected ones are probed, and declared dead once the probe has failed
+// for long enough. Disconnected hosts in maintenance mode are not probed.
+// Nothing is checked while the HA feature is off.
+func (s *HostService) StartFencingMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.featureEnabled(FeatureHA) {
+			continue
+		}
+		var hosts []storage.HostFencing
+		if err := s.db.Where("enabled = ?", true).Find(&hosts).Error; err != nil {
+			log.Printf("Warning: failed to load fencing settings: %v", err)
+			continue
+		}
+		connected := make(map[string]bool)
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			connected[hostID] = true
+		}
+		// Hosts in maintenance mode may be down on purpose.
+		var inMaintenance []string
+		if err := s.db.Model(&storage.Host{}).Where("maintenance_mode = ?", true).Pluck("id", &inMaintenance).Error; err != nil {
+			log.Printf("Warning: failed to load hosts in maintenance mode: %v", err)
+			continue
+		}
+		for i := range hosts {
+			if !connected[hosts[i].HostID] && slices.Contains(inMaintenance, hosts[i].HostID) {
+				continue
+			}
+			s.checkFencing(&hosts[i], connected[hosts[i].HostID])
+		}
+	}
+}
+
+func (s *HostService) checkFencing(f *storage.HostFencing, connected bool) {
+	if connected {
+		if f.FencedAt == nil && (f.UnreachableSince != nil || f.DeadAt != nil) {
+			s.updateFencing(f.HostID, map[string]interface{}{"unreachable_since": nil, "dead_at": nil})
+		}
+		if err := s.saveRecoveryDefinitions(f.HostID); err != nil {
+			log.Printf("Warning: failed to save VM definitions of host %s: %v", f.HostID, err)
+		}
+		return
+	}
+	if f.DeadAt != nil {
+		return
+	}
+
+	alive, err := s.probeHost(f)
+	if err != nil {
+		log.Printf("Warning: fencing check of host %s failed: %v", f.HostID, err)
+	}
+	if alive {
+		if f.UnreachableSince != nil {
+			s.updateFencing(f.HostID, map[string]interface{}{"unreachable_since": nil})
+		}
+		return
+	}
+	now := time.Now()
+	if f.UnreachableSince == nil {
+		log.Printf("Host %s fails its %s fencing check", f.HostID, f.Method)
+		s.updateFencing(f.HostID, map[string]interface{}{"unreachable_since": now})
+		return
+	}
+	deadAfter := time.Duration(f.DeadAfterMinutes) * time.Minute
+	if now.Sub(*f.UnreachableSince) < deadAfter {
+		return
+	}
+	s.updateFencing(f.HostID, map[string]interface{}{"dead_at": now})
+	s.recordEvent(EventHostDead, f.HostID, "",
+		fmt.Sprintf("Host %s has failed its %s check for %s and is declared dead", f.HostID, f.Method, deadAfter),
+		map[string]interface{}{"method": f.Method, "unreachable_since": f.UnreachableSince})
+	s.broadcastHostsChanged()
+}
+
+func (s *HostService) updateFencing(hostID string, fields map[string]interface{}) {
+	if err := s.db.Model(&storage.HostFencing{}).Where("host_id = ?", hostID).Updates(fields).Error; err != nil {
+		log.Printf("Warning: failed to update fencing state of host %s: %v", hostID, err)
+	}
+}
+
+// probeHost reports whether a disconnected host still shows signs of life.
+// A probe that cannot tell counts as alive, so a host is never declared dead
+// because its BMC is unreachable.
+func (s *HostService) probeHost(f *storage.HostFencing) (bool, error) {
+	if f.Method == FencingMethodIPMI {
+		output, err := ipmiChassisPower(f, "status")
+		if err != nil {
+			return true, err
+		}
+		return !strings.Contains(strings.ToLower(output), "is off"), nil
+	}
+
+	var host storage.Host
+	if err := s.db.Where("id = ?", f.HostID).First(&host).Error; err != nil {
+		return true, err
+	}
+	hostURI, err := libvirt.ParseHostURI(host.URI)
+	if err != nil {
+		return true, err
+	}
+	port := "22"
+	if hostURI.Transport == "ssh" && hostURI.URL.Port() != "" {
+		port = hostURI.URL.Port()
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostURI.URL.Hostname(), port), fencingProbeTimeout)
+	if err != nil {
+		return false, nil
+	}
+	conn.Close()
+	return true, nil
+}
+
+// ipmiChassisPower runs an ipmitool chassis power command against a host's
+// BMC. The password is passed in the environment, not on the command line.
+func ipmiChassisPower(f *storage.HostFencing, command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fencingProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ipmitool", "-I", "lanplus", "-H", f.IPMIAddress, "-U", f.IPMIUsername, "-E",
+		"chassis", "power", command)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+f.IPMIPassword)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("ipmitool chassis power %s on %s failed: %w (output: %s)",
+			command, f.IPMIAddress, err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// saveRecoveryDefinitions stores the current definition of each VM of a
+// host, writing only those that changed.
+func (s *HostService) saveRecoveryDefinitions(hostID string) error {
+	defs, err := s.connector.GetDomainDefinitions(hostID)
+	if err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ?", hostID).Find(&vms).Error; err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		domainXML, ok := defs[vm.DomainUUID]
+		if !ok {
+			continue
+		}
+		var saved storage.VMRecoveryDefinition
+		if err := s.db.Where("vm_id = ?", vm.ID).Limit(1).Find(&saved).Error; err != nil {
+			return err
+		}
+		if saved.VMID != 0 && saved.XML == domainXML {
+			continue
+		}
+		if err := s.db.Save(&storage.VMRecoveryDefinition{VMID: vm.ID, XML: domainXML}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFencePreconditions makes sure a host is declared dead and still
+// disconnected.
+func (s *HostService) checkFencePreconditions(hostID string) (*storage.HostFencing, error) {
+	_, fencing, err := s.getHostFencing(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if !fencing.Enabled || fencing.DeadAt == nil {
+		return nil, ErrHostNotDead
+	}
+	if _, err := s.connector.GetConnection(hostID); err == nil {
+		return nil, fmt.Errorf("%w: host %s is connected", ErrHostNotDead, hostID)
+	}
+	return fencing, nil
+}
+
+// PrepareHostFence checks that a host has been declared dead and issues a
+// short-lived confirmation token for fencing it.
+func (s *HostService) PrepareHostFence(hostID string) (*HostPowerToken, error) {
+	if _, err := s.checkFencePreconditions(hostID); err != nil {
+		return nil, err
+	}
+	return s.powerTokens.issue(hostID, HostPowerFence)
+}
+
+// FenceHost confirms that a dead host is off, which allows recovering its
+// VMs on other hosts. With IPMI the host is powered off first; otherwise the
+// operator vouches for it, e.g. after pulling its power.
+func (s *HostService) FenceHost(hostID, token string) error {
+	if !s.powerTokens.consume(token, hostID, HostPowerFence) {
+		return ErrInvalidConfirmToken
+	}
+	fencing, err := s.checkFencePreconditions(hostID)
+	if err != nil {
+		return err
+	}
+	if fencing.Method == FencingMethodIPMI {
+		if _, err := ipmiChassisPower(fencing, "off"); err != nil {
+			return err
+		}
+		output, err := ipmiChassisPower(fencing, "status")
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(strings.ToLower(output), "is off") {
+			return fmt.Errorf("host %s is still powered on after the IPMI power off: %s", hostID, strings.TrimSpace(output))
+		}
+	}
+
+	s.updateFencing(hostID, map[string]interface{}{"fenced_at": time.Now()})
+	s.recordAudit("host.fence", "host", hostID, fmt.Sprintf("method=%s", fencing.Method))
+	s.recordEvent(EventHostFenced, hostID, "", fmt.Sprintf("Host %s was fenced; its VMs can be recovered", hostID), nil)
+	s.broadcastHostsChanged()
+	return nil
+}
+
+// GetHostRecovery lists the VMs of a dead host and, given a target, whether
+// each of them can be defined there.
+func (s *HostService) GetHostRecovery(hostID, targetHostID string) (*HostRecoveryPlan, error) {
+	_, fencing, err := s.getHostFencing(hostID)
+	if err != nil {
+		return nil, err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ?", hostID).Order("name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	plan := &HostRecoveryPlan{HostID: hostID, State: fencingState(fencing), TargetHostID: targetHostID, VMs: []RecoverableVM{}}
+	for _, vm := range vms {
+		entry := RecoverableVM{Name: vm.Name, DomainUUID: vm.DomainUUID, State: vm.State}
+		var def storage.VMRecoveryDefinition
+		if err := s.db.Where("vm_id = ?", vm.ID).Limit(1).Find(&def).Error; err != nil {
+			return nil, err
+		}
+		if def.VMID != 0 {
+			entry.DefinitionSavedAt = &def.UpdatedAt
+			entry.Recoverable = true
+			if targetHostID != "" {
+				precheck, err := s.connector.PrecheckRecovery(hostID, targetHostID, def.XML)
+				if err != nil {
+					return nil, err
+				}
+				entry.Precheck = precheck
+				entry.Recoverable = len(precheck.Blockers) == 0
+			}
+		}
+		plan.VMs = append(plan.VMs, entry)
+	}
+	return plan, nil
+}
+
+// RecoverHostVMs defines VMs of a fenced host on another host from their
+// saved definitions, as a task. Their records move to the target, as for a
+// migration. VMs whose precheck finds blockers are skipped.
+func (s *HostService) RecoverHostVMs(hostID string, req HostRecoveryRequest) (*storage.Task, error) {
+	if req.TargetHostID == "" {
+		return nil, ErrMissingMigrationTarget
+	}
+	if req.TargetHostID == hostID {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "target_host_id", Message: "must be another host"}}}
+	}
+	_, fencing, err := s.getHostFencing(hostID)
+	if err != nil {
+		return nil, err
+	}
+	if fencing.FencedAt == nil {
+		return nil, ErrHostNotFenced
+	}
+	if _, err := s.connector.GetConnection(hostID); err == nil {
+		return nil, fmt.Errorf("%w: host %s is connected again", ErrHostNotFenced, hostID)
+	}
+
+	query := s.db.Where("host_id = ?", hostID)
+	if len(req.VMs) > 0 {
+		query = query.Where("name IN ?", req.VMs)
+	}
+	var vms []storage.VirtualMachine
+	if err := query.Order("name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	if len(req.VMs) > 0 && len(vms) < len(req.VMs) {
+		return nil, fmt.Errorf("some of the VMs are not on host %s: %w", hostID, gorm.ErrRecordNotFound)
+	}
+
+	task, err := s.tasks.Start("host.recover", fmt.Sprintf("Recovering %d VMs of %s on %s", len(vms), hostID, req.TargetHostID))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("host.recover", "host", hostID,
+		fmt.Sprintf("target=%s vms=%d start=%t", req.TargetHostID, len(vms), req.Start))
+
+	started := copyTask(task)
+	go func() {
+		err := s.runHostRecovery(task, hostID, req, vms)
+		if err != nil {
+			log.Printf("Recovery of VMs of host %s: %v", hostID, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runHostRecovery(task *storage.Task, hostID string, req HostRecoveryRequest, vms []storage.VirtualMachine) error {
+	var failed []string
+	for i, vm := range vms {
+		progress := 100 * i / len(vms)
+		if err := s.recoverVM(task, hostID, req, &vm); err != nil {
+			failed = append(failed, vm.Name)
+			s.tasks.Step(task, progress, fmt.Sprintf("Could not recover %s: %v", vm.Name, err))
+			continue
+		}
+		s.tasks.Step(task, progress, fmt.Sprintf("Recovered %s on %s", vm.Name, req.TargetHostID))
+	}
+
+	s.SyncVMsForHost(req.TargetHostID)
+	s.broadcastVMsChanged(hostID)
+	s.broadcastVMsChanged(req.TargetHostID)
+	if len(failed) > 0 {
+		return fmt.Errorf("could not recover %d of %d VMs: %s", len(failed), len(vms), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func (s *HostService) recoverVM(task *storage.Task, hostID string, req HostRecoveryRequest, vm *storage.VirtualMachine) error {
+	var def storage.VMRecoveryDefinition
+	if err := s.db.Where("vm_id = ?", vm.ID).Limit(1).Find(&def).Error; err != nil {
+		return err
+	}
+	if def.VMID == 0 {
+		return errors.New("no definition was saved while the host was connected")
+	}
+	precheck, err := s.connector.PrecheckRecovery(hostID, req.TargetHostID, def.XML)
+	if err != nil {
+		return err
+	}
+	if len(precheck.Blockers) > 0 {
+		return fmt.Errorf("%w: %s", ErrMigrationBlocked, joinMigrationIssues(precheck.Blockers))
+	}
+	if err := s.connector.DefineRecoveredDomain(req.TargetHostID, def.XML); err != nil {
+		return err
+	}
+	wasRunning := vm.State == storage.StateActive || vm.State == storage.StatePaused
+	err = s.db.Model(vm).Updates(map[string]interface{}{"host_id": req.TargetHostID, "state": storage.StateStopped}).Error
+	if err != nil {
+		return fmt.Errorf("failed to move %s to host %s in the database: %w", vm.Name, req.TargetHostID, err)
+	}
+	recovery := storage.VMRecovery{VMName: vm.Name, DomainUUID: vm.DomainUUID, FromHostID: hostID, ToHostID: req.TargetHostID, TaskID: task.ID}
+	if err := s.db.Create(&recovery).Error; err != nil {
+		log.Printf("Warning: failed to record the recovery of %s: %v", vm.Name, err)
+	}
+	s.recordEvent(EventVMRecovered, req.TargetHostID, vm.Name,
+		fmt.Sprintf("VM %s recovered on %s from dead host %s", vm.Name, req.TargetHostID, hostID),
+		map[string]interface{}{"task_id": task.ID, "source_host_id": hostID})
+
+	if req.Start && wasRunning {
+		if err := s.StartVM(context.Background(), req.TargetHostID, vm.Name); err != nil {
+			return fmt.Errorf("defined on %s, but failed to start: %w", req.TargetHostID, err)
+		}
+	}
+	return nil
+}
+
+// removeRecoveredVMs runs when a host connects. The VMs that were recovered
+// elsewhere while it was dead are stopped and undefined on it, so they do
+// not run twice on the same storage, and its fencing state is reset. If
+// some cannot be removed, the host stays fenced and the next connection
+// tries again.
+func (s *HostService) removeRecoveredVMs(hostID string) {
+	var fencing storage.HostFencing
+	if err := s.db.Where("host_id = ?", hostID).Limit(1).Find(&fencing).Error; err != nil || fencing.HostID == "" {
+		return
+	}
+	if fencing.FencedAt == nil && fencing.DeadAt == nil && fencing.UnreachableSince == nil {
+		return
+	}
+	var recoveries []storage.VMRecovery
+	if err := s.db.Where("from_host_id = ? AND cleaned_up_at IS NULL", hostID).Find(&recoveries).Error; err != nil {
+		log.Printf("Warning: failed to load the recovered VMs of host %s: %v", hostID, err)
+		return
+	}
+	failed := 0
+	for _, recovery := range recoveries {
+		if err := s.connector.RemoveRecoveredDomain(hostID, recovery.DomainUUID); err != nil {
+			log.Printf("Warning: could not remove %s, recovered on %s, from host %s: %v", recovery.VMName, recovery.ToHostID, hostID, err)
+			failed++
+			continue
+		}
+		s.db.Model(&recovery).Update("cleaned_up_at", time.Now())
+		s.recordAudit("vm.recovery.cleanup", "vm", fmt.Sprintf("%s/%s", hostID, recovery.VMName),
+			fmt.Sprintf("recovered on %s", recovery.ToHostID))
+	}
+	if failed > 0 {
+		return
+	}
+	s.updateFencing(hostID, map[string]interface{}{"unreachable_since": nil, "dead_at": nil, "fenced_at": nil})
+	s.broadcastHostsChanged()
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// HostInfoView is a host's details, read live while the host is connected
+// and from the last reading otherwise.
+type HostInfoView struct {
+	libvirt.HostInfo
+	UpdatedAt time.Time `json:"updated_at"` // When the details were read from the host
+	Cached    bool      `json:"cached"`     // The host could not be reached; the details are from updated_at
+}
+
+// GetHostInfo reads a host's details and caches them. When the host cannot
+// be reached, the cached details are returned instead, if there are any.
+func (s *HostService) GetHostInfo(hostID string) (*HostInfoView, error) {
+	info, err := s.connector.GetHostInfo(hostID)
+	if err != nil {
+		var record storage.HostInfo
+		if dbErr := s.db.Where("host_id = ?", hostID).Limit(1).Find(&record).Error; dbErr != nil || record.HostID == "" {
+			return nil, err
+		}
+		return &HostInfoView{HostInfo: hostInfoFromRecord(record), UpdatedAt: record.UpdatedAt, Cached: true}, nil
+	}
+
+	record := hostInfoRecord(hostID, info)
+	if err := s.db.Save(&record).Error; err != nil {
+		log.Printf("Warning: failed to cache details of host %s: %v", hostID, err)
+	}
+	return &HostInfoView{HostInfo: *info, UpdatedAt: record.UpdatedAt}, nil
+}
+
+func hostInfoRecord(hostID string, info *libvirt.HostInfo) storage.HostInfo {
+	record := storage.HostInfo{
+		HostID:            hostID,
+		Hostname:          info.Hostname,
+		CPUs:              info.CPU,
+		Sockets:           info.Sockets,
+		Cores:             info.Cores,
+		Threads:           info.Threads,
+		CPUMHz:            info.CPUMHz,
+		CPUArch:           info.CPUArch,
+		CPUModel:          info.CPUModel,
+		CPUVendor:         info.CPUVendor,
+		MemoryBytes:       info.Memory,
+		FreeMemoryBytes:   info.FreeMemory,
+		NUMACells:         make([]storage.HostNUMACell, len(info.NUMACells)),
+		Hypervisor:        info.Hypervisor,
+		HypervisorVersion: info.HypervisorVersion,
+		LibvirtVersion:    info.LibvirtVersion,
+		Kernel:            info.Kernel,
+	}
+	for i, cell := range info.NUMACells {
+		record.NUMACells[i] = storage.HostNUMACell{
+			ID:              cell.ID,
+			MemoryBytes:     cell.Memory,
+			FreeMemoryBytes: cell.FreeMemory,
+			CPUs:            cell.CPUs,
+		}
+	}
+	return record
+}
+
+func hostInfoFromRecord(record storage.HostInfo) libvirt.HostInfo {
+	info := libvirt.HostInfo{
+		Hostname:          record.Hostname,
+		CPU:               record.CPUs,
+		Memory:            record.MemoryBytes,
+		Cores:             record.Cores,
+		Threads:           record.Threads,
+		FreeMemory:        record.FreeMemoryBytes,
+		Sockets:           record.Sockets,
+		CPUMHz:            record.CPUMHz,
+		CPUArch:           record.CPUArch,
+		CPUModel:          record.CPUModel,
+		CPUVendor:         record.CPUVendor,
+		NUMACells:         make([]libvirt.NUMACell, len(record.NUMACells)),
+		Hypervisor:        record.Hypervisor,
+		HypervisorVersion: record.HypervisorVersion,
+		LibvirtVersion:    record.LibvirtVersion,
+		Kernel:            record.Kernel,
+	}
+	for i, cell := range record.NUMACells {
+		info.NUMACells[i] = libvirt.NUMACell{
+			ID:         cell.ID,
+			Memory:     cell.MemoryBytes,
+			FreeMemory: cell.FreeMemoryBytes,
+			CPUs:       cell.CPUs,
+		}
+	}
+	return info
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrHostExists is returned when another host already has the requested name
+// or URI.
+var ErrHostExists = errors.New("a host with this name or URI already exists")
+
+// ResolveHostID returns the ID of the host with the given ID or name, so
+// clients from before host IDs were generated can keep using names. Unknown
+// references are returned unchanged.
+func (s *HostService) ResolveHostID(ref string) string {
+	return storage.ResolveHostID(s.db, ref)
+}
+
+// checkHostUnique makes sure no host other than id has the given name or URI.
+func (s *HostService) checkHostUnique(id, name, uri string) error {
+	var other storage.Host
+	query := s.db.Where("id <> ? AND name = ?", id, name)
+	if uri != "" {
+		query = query.Or("id <> ? AND uri = ?", id, uri)
+	}
+	if err := query.Limit(1).Find(&other).Error; err != nil {
+		return err
+	}
+	if other.ID == "" {
+		return nil
+	}
+	if other.Name == name {
+		return fmt.Errorf("%w: %s is already taken", ErrHostExists, name)
+	}
+	return fmt.Errorf("%w: %s already uses %s", ErrHostExists, other.Name, uri)
+}
+
+// RenameHost changes the display name of a host. Its ID, and so every
+// reference to it, stays the same.
+func (s *HostService) RenameHost(hostID, name string) (*storage.Host, error) {
+	var v validator
+	v.hostName("name", name)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	if host.Name == name {
+		return &host, nil
+	}
+	if err := s.checkHostUnique(host.ID, name, ""); err != nil {
+		return nil, err
+	}
+	oldName := host.Name
+	if err := s.db.Model(&host).Update("name", name).Error; err != nil {
+		return nil, fmt.Errorf("failed to rename host: %w", err)
+	}
+	s.recordAudit("host.rename", "host", hostID, fmt.Sprintf("from=%s to=%s", oldName, name))
+	s.broadcastHostsChanged()
+	return &host, nil
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// HostPowerAction is a power operation that can be performed on a hypervisor.
+type HostPowerAction string
+
+const (
+	HostPowerReboot   HostPowerAction = "reboot"
+	HostPowerShutdown HostPowerAction = "shutdown"
+)
+
+// powerTokenTTL is how long a confirmation token remains valid.
+const powerTokenTTL = 2 * time.Minute
+
+var (
+	ErrHostNotInMaintenance = errors.New("host must be in maintenance mode")
+	ErrHostHasActiveVMs     = errors.New("host still has running or paused VMs")
+	ErrInvalidConfirmToken  = errors.New("confirmation token is missing, invalid or expired")
+	ErrUnknownPowerAction   = errors.New("unknown host power action")
+)
+
+// HostPowerToken is handed to the client when a power action is prepared and
+// must be echoed back to execute it.
+type HostPowerToken struct {
+	Token     string          `json:"token"`
+	Action    HostPowerAction `json:"action"`
+	ExpiresAt time.Time       `json:"expires_at"`
+}
+
+// powerTokenStore keeps outstanding confirmation tokens, keyed by token.
+type powerTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]pendingPowerAction
+}
+
+type pendingPowerAction struct {
+	hostID    string
+	action    HostPowerAction
+	expiresAt time.Time
+}
+
+func newPowerTokenStore() *powerTokenStore {
+	return &powerTokenStore{tokens: make(map[string]pendingPowerAction)}
+}
+
+func (p *powerTokenStore) issue(hostID string, action HostPowerAction) (*HostPowerToken, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("failed to generate confirmation token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(powerTokenTTL)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Drop anything that has expired while we hold the lock.
+	for t, pending := range p.tokens {
+		if time.Now().After(pending.expiresAt) {
+			delete(p.tokens, t)
+		}
+	}
+	p.tokens[token] = pendingPowerAction{hostID: hostID, action: action, expiresAt: expiresAt}
+
+	return &HostPowerToken{Token: token, Action: action, ExpiresAt: expiresAt}, nil
+}
+
+// consume validates and invalidates a token. Tokens are single use.
+func (p *powerTokenStore) consume(token, hostID string, action HostPowerAction) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending, ok := p.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(p.tokens, token)
+	return pending.hostID == hostID && pending.action == action && time.Now().Before(pending.expiresAt)
+}
+
+// SetHostMaintenance toggles maintenance mode for a host.
+func (s *HostService) SetHostMaintenance(hostID string, enabled bool) error {
+	result := s.db.Model(&storage.Host{}).Where("id = ?", hostID).Update("maintenance_mode", enabled)
+	if result.Error != nil {
+		return fmt.Errorf("failed to update maintenance mode for host %s: %w", hostID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("host %s not found", hostID)
+	}
+
+	s.recordAudit("host.maintenance", "host", hostID, fmt.Sprintf("enabled=%t", enabled))
+	s.broadcastHostsChanged()
+	return nil
+}
+
+// PrepareHostPowerAction checks that a host can be safely powered off or
+// rebooted and issues a short-lived confirmation token for the action.
+func (s *HostService) PrepareHostPowerAction(hostID string, action HostPowerAction) (*HostPowerToken, error) {
+	if err := s.checkHostPowerPreconditions(hostID, action); err != nil {
+		return nil, err
+	}
+	return s.powerTokens.issue(hostID, action)
+}
+
+// ExecuteHostPowerAction performs a previously prepared power action. The
+// preconditions are re-checked as the host may have changed since the token
+// was issued.
+func (s *HostService) ExecuteHostPowerAction(hostID string, action HostPowerAction, token string) error {
+	if !s.powerTokens.consume(token, hostID, action) {
+		return ErrInvalidConfirmToken
+	}
+	if err := s.checkHostPowerPreconditions(hostID, action); err != nil {
+		return err
+	}
+
+	var command string
+	switch action {
+	case HostPowerReboot:
+		command = "systemctl reboot"
+	case HostPowerShutdown:
+		command = "systemctl poweroff"
+	}
+
+	s.recordAudit("host."+string(action), "host", hostID, "requested via confirmation token")
+	log.Printf("Executing host power action %s on %s", action, hostID)
+
+	if output, err := s.connector.RunHostCommand(hostID, command); err != nil {
+		s.recordAudit("host."+string(action)+".failed", "host", hostID, err.Error())
+		return fmt.Errorf("failed to %s host %s: %w (output: %s)", action, hostID, err, output)
+	}
+
+	// The libvirt connection is about to go away; drop it now so the pool
+	// does not hold on to a dead socket.
+	if err := s.disconnectHost(hostID, false); err != nil {
+		log.Printf("Warning: failed to disconnect from host %s after %s: %v", hostID, action, err)
+	}
+	s.broadcastHostsChanged()
+	return nil
+}
+
+func (s *HostService) checkHostPowerPreconditions(hostID string, action HostPowerAction) error {
+	if action != HostPowerReboot && action != HostPowerShutdown {
+		return ErrUnknownPowerAction
+	}
+
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	if !host.MaintenanceMode {
+		return ErrHostNotInMaintenance
+	}
+
+	vms, err := s.connector.ListAllDomains(hostID)
+	if err != nil {
+		return fmt.Errorf("could not verify VM states on host %s: %w", hostID, err)
+	}
+	for _, vm := range vms {
+		if vm.State == golibvirt.DomainRunning || vm.State == golibvirt.DomainPaused {
+			return fmt.Errorf("%w: %s", ErrHostHasActiveVMs, vm.Name)
+		}
+	}
+	return nil
+}
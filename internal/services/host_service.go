@@ -1,24 +1,37 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/capsali/virtumancer-flash/internal/agent"
 	"github.com/capsali/virtumancer-flash/internal/libvirt"
 	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/tracing"
 	"github.com/capsali/virtumancer-flash/internal/ws"
 	golibvirt "github.com/digitalocean/go-libvirt"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
+// PermissionManageHosts allows adding, preparing, renaming and removing
+// hosts, and powering, fencing and evacuating them.
+const PermissionManageHosts = "hosts.manage"
+
 // VMView is a combination of DB data and live libvirt data for the frontend.
 type VMView struct {
 	// From DB
 	ID              uint   `json:"db_id"`
+	HostID          string `json:"host_id"`
 	Name            string `json:"name"`
 	UUID            string `json:"uuid"`
 	DomainUUID      string `json:"domain_uuid"`
@@ -28,6 +41,31 @@ type VMView struct {
 	IsTemplate      bool   `json:"is_template"`
 	CPUModel        string `json:"cpu_model"`
 	CPUTopologyJSON string `json:"cpu_topology_json"`
+	OSType          string `json:"os_type"` // linux, windows, bsd, macos, other or empty when unknown
+	OSVariant       string `json:"os_variant"`
+	OSName          string `json:"os_name"`
+
+	// Place in the host's startup sequence after an outage.
+	StartupPriority     uint `json:"startup_priority"`
+	StartupDelaySeconds uint `json:"startup_delay_seconds"`
+
+	// Relative CPU and block I/O weights; 0 is the hypervisor's default.
+	CPUShares   uint64 `json:"cpu_shares"`
+	BlkioWeight uint   `json:"blkio_weight"`
+	// Memory the balloon policy leaves the VM; 0 uses the policy's guarantee.
+	BalloonMinBytes uint64 `json:"balloon_min_bytes"`
+	// What evacuating the host does with the VM while it runs.
+	EvacuationPolicy       string `json:"evacuation_policy"`
+	EvacuationTargetHostID string `json:"evacuation_target_host_id"`
+
+	// User-defined key/value fields.
+	CustomFields map[string]string `json:"custom_fields"`
+	// Labels for selecting groups of VMs, e.g. env=prod.
+	Labels map[string]string `json:"labels"`
+	// The VM's own project or else its host's; 0 when it has none.
+	ProjectID uint `json:"project_id"`
+	// Increments on every change; spec edits name it in If-Match.
+	Generation uint64 `json:"generation"`
 
 	// From Libvirt or DB cache
 	State    storage.VMState       `json:"state"` // Use our custom string state
@@ -38,48 +76,348 @@ type VMView struct {
 	MaxMem  uint64 `json:"max_mem"`
 	Memory  uint64 `json:"memory"`
 	CpuTime uint64 `json:"cpu_time"`
-	Uptime  int64  `json:"uptime"`
+
+	// Tracked by Virtumancer: when the VM was first seen running, and the
+	// seconds since then, or -1 when it is not running.
+	StartedAt *time.Time `json:"started_at"`
+	Uptime    int64      `json:"uptime"`
+
+	// Usage of the filesystems mounted in the guest, as its guest agent last
+	// reported it, and when; empty for VMs without a guest agent.
+	GuestFilesystems   []storage.GuestFilesystem `json:"guest_filesystems"`
+	GuestFilesystemsAt *time.Time                `json:"guest_filesystems_at"`
+	// State of the guest agent of the running VM: connected, disconnected,
+	// or empty without an agent channel.
+	GuestAgent string `json:"guest_agent"`
+
+	// Red, yellow or green at a glance, the checks behind it and when it
+	// last changed, as computed by the health monitor.
+	Health          storage.HealthStatus   `json:"health"`
+	HealthReasons   []storage.HealthReason `json:"health_reasons"`
+	HealthChangedAt *time.Time             `json:"health_changed_at"`
 }
 
 // VmSubscription holds the clients subscribed to a VM's stats and a channel to stop polling.
 type VmSubscription struct {
-	clients      map[*ws.Client]bool
-	stop         chan struct{}
+	hostID         string
+	vmName         string
+	clients        map[*ws.Client]time.Duration // Interval requested by each client, 0 for the configured one
+	configured     time.Duration                // Interval configured for the VM; guarded by the manager's lock
+	stop           chan struct{}
 	lastKnownStats *libvirt.VMStats
-	mu           sync.RWMutex
+	mu             sync.RWMutex
 }
 
 // MonitoringManager handles real-time VM stat subscriptions.
 type MonitoringManager struct {
-	mu            sync.Mutex
-	subscriptions map[string]*VmSubscription // key is "hostId:vmName"
-	service       *HostService               // back-reference
+	mu                sync.Mutex
+	subscriptions     map[string]*VmSubscription        // key is "hostId:vmName"
+	hostSubscriptions map[string]*HostStatsSubscription // key is the host ID
+	service           *HostService                      // back-reference
 }
 
 // NewMonitoringManager creates a new manager.
 func NewMonitoringManager(service *HostService) *MonitoringManager {
 	return &MonitoringManager{
-		subscriptions: make(map[string]*VmSubscription),
-		service:       service,
+		subscriptions:     make(map[string]*VmSubscription),
+		hostSubscriptions: make(map[string]*HostStatsSubscription),
+		service:           service,
 	}
 }
 
 type HostServiceProvider interface {
 	ws.InboundMessageHandler
 	GetAllHosts() ([]storage.Host, error)
-	GetHostInfo(hostID string) (*libvirt.HostInfo, error)
+	GetHostInfo(hostID string) (*HostInfoView, error)
 	AddHost(host storage.Host) (*storage.Host, error)
+	RenameHost(hostID, name string) (*storage.Host, error)
+	ResolveHostID(ref string) string
 	RemoveHost(hostID string) error
 	ConnectToAllHosts()
 	GetVMsForHostFromDB(hostID string) ([]VMView, error)
 	GetVMStats(hostID, vmName string) (*libvirt.VMStats, error)
-	GetVMHardwareAndTriggerSync(hostID, vmName string) (*libvirt.HardwareInfo, error)
+	GetVMHardware(hostID, vmName string) (*libvirt.HardwareInfo, error)
+	GetVMCapabilities(hostID, vmName string) (*libvirt.HotplugCapabilities, error)
+	GetVMScreenshot(hostID, vmName string) ([]byte, error)
+	GetVMProcessUsage(hostID, vmName string) (*libvirt.ProcessUsage, error)
+	GetDiskBackingChain(hostID, vmName, target string) (*libvirt.DiskChain, error)
+	AttachDisk(hostID, vmName string, req DiskAttachRequest) (*AttachedDisk, error)
+	AttachNIC(hostID, vmName string, req NICAttachRequest) (*AttachedNIC, error)
+	StartPacketCapture(hostID, vmName string, req PacketCaptureRequest) (*storage.PacketCapture, error)
+	ListPacketCaptures() ([]storage.PacketCapture, error)
+	OpenPacketCapture(id uint) (*storage.PacketCapture, error)
+	DeletePacketCapture(id uint) error
+	ListSnapshots(hostID, vmName string) ([]libvirt.SnapshotInfo, error)
+	EstimateSnapshot(hostID, vmName, memory string) (*SnapshotEstimate, error)
+	CreateSnapshot(hostID, vmName string, req SnapshotRequest) (*storage.Task, error)
+	RevertSnapshot(hostID, vmName, name string) (*storage.Task, error)
+	DeleteSnapshot(hostID, vmName, name string) error
+	GetGraphicsPasswordStatus(hostID, vmName string) (*GraphicsPasswordStatus, error)
+	SetGraphicsPassword(hostID, vmName string, req GraphicsPasswordRequest) (*GraphicsPasswordResult, error)
+	RevokeGraphicsPassword(hostID, vmName string) error
+	GetConsoleInfo(hostID, vmName string, index int, serverHost string) (*ConsoleInfo, error)
 	SyncVMsForHost(hostID string)
-	StartVM(hostID, vmName string) error
-	ShutdownVM(hostID, vmName string) error
-	RebootVM(hostID, vmName string) error
-	ForceOffVM(hostID, vmName string) error
-	ForceResetVM(hostID, vmName string) error
+	RefreshHostVMs(hostID string) error
+	RefreshVM(ctx context.Context, hostID, vmName string) error
+	ListVMsPage(hostID, token string, limit int) (*VMPage, error)
+	StartVM(ctx context.Context, hostID, vmName string) error
+	ShutdownVM(ctx context.Context, hostID, vmName string) error
+	RebootVM(ctx context.Context, hostID, vmName string) error
+	ForceOffVM(ctx context.Context, hostID, vmName string) error
+	ForceResetVM(ctx context.Context, hostID, vmName string) error
+	SetHostMaintenance(hostID string, enabled bool) error
+	SetHostReservation(hostID string, res HostReservation) error
+	GetHostCapacity(hostID string) (*HostCapacity, error)
+	SetHostStartupSettings(hostID string, settings HostStartupSettings) error
+	PreviewHostStartup(hostID string) (*StartupPlan, error)
+	SetVMStartupSettings(hostID, vmName string, settings VMStartupSettings) error
+	GetVMTuning(hostID, vmName string) (*libvirt.DomainTuning, error)
+	SetVMTuning(hostID, vmName string, req VMTuningRequest) (*libvirt.DomainTuning, error)
+	GetBalloonPolicy(hostID string) (*storage.BalloonPolicy, error)
+	SetBalloonPolicy(hostID string, req BalloonPolicyRequest) (*storage.BalloonPolicy, error)
+	SetVMBalloonGuarantee(hostID, vmName string, minBytes uint64) error
+	CompactVMDisks(hostID, vmName string, req DiskCompactionRequest) (*storage.Task, error)
+	GetDiskCompactionPolicy(hostID string) (*storage.DiskCompactionPolicy, error)
+	SetDiskCompactionPolicy(hostID string, req DiskCompactionPolicyRequest) (*storage.DiskCompactionPolicy, error)
+	TrimVMFilesystems(hostID, vmName string, req FstrimRequest) (*FstrimResult, error)
+	GetFstrimPolicy(hostID string) (*storage.FstrimPolicy, error)
+	SetFstrimPolicy(hostID string, req FstrimPolicyRequest) (*storage.FstrimPolicy, error)
+	GetKSM(hostID string) (*KSMStatus, error)
+	SetKSM(hostID string, req KSMRequest) (*KSMStatus, error)
+	GetHostSEV(hostID string) (*libvirt.SEVCapability, error)
+	GetVMLaunchSecurity(hostID, vmName string) (*VMLaunchSecurity, error)
+	SetVMLaunchSecurity(hostID, vmName string, req LaunchSecurityRequest) (*VMLaunchSecurity, error)
+	ListMachineTypes(hostID string) ([]libvirt.MachineType, error)
+	GetVMMachineType(hostID, vmName, target string) (*VMMachineType, error)
+	UpgradeVMMachineType(hostID, vmName string, req MachineTypeUpgradeRequest) (*storage.VMMachineTypeChange, error)
+	RollbackVMMachineType(hostID, vmName string) (*storage.VMMachineTypeChange, error)
+	ListVMDefinitions(hostID, vmName string) ([]storage.VMDefinition, error)
+	GetVMDefinition(hostID, vmName string, version uint) (*storage.VMDefinition, error)
+	DiffVMDefinitions(hostID, vmName string, from, to uint) (*VMDefinitionDiff, error)
+	RestoreVMDefinition(hostID, vmName string, version uint) (*storage.VMDefinition, error)
+	StartLiveMigration(hostID, vmName string, req LiveMigrationRequest) (*storage.Task, error)
+	UpdateLiveMigration(hostID, vmName string, req LiveMigrationUpdate) error
+	AbortLiveMigration(hostID, vmName string) error
+	SetVMEvacuationSettings(hostID, vmName string, settings VMEvacuationSettings) error
+	EvacuateHost(hostID string, req HostEvacuationRequest) (*storage.Task, error)
+	GetHostFencing(hostID string) (*HostFencingStatus, error)
+	SetHostFencing(hostID string, req HostFencingRequest) (*HostFencingStatus, error)
+	PrepareHostFence(hostID string) (*HostPowerToken, error)
+	FenceHost(hostID, token string) error
+	GetHostRecovery(hostID, targetHostID string) (*HostRecoveryPlan, error)
+	RecoverHostVMs(hostID string, req HostRecoveryRequest) (*storage.Task, error)
+	PrepareHostPowerAction(hostID string, action HostPowerAction) (*HostPowerToken, error)
+	ExecuteHostPowerAction(hostID string, action HostPowerAction, token string) error
+	PrepareHost(req HostPrepareRequest) (*storage.Task, error)
+	ListTasks() ([]storage.Task, error)
+	GetTask(id uint) (*storage.Task, error)
+	AuthenticateAgent(hostID, token string) error
+	Login(username, password, ipAddress, userAgent string) (*LoginResult, error)
+	Logout(token string) error
+	AuthenticateSession(token string) (*storage.User, *storage.UserSession, error)
+	GetUserProfile(userID uint) (*UserProfile, error)
+	ChangePassword(userID, sessionID uint, currentPassword, newPassword, ipAddress, userAgent string) error
+	ListUserSessions(userID, currentSessionID uint) ([]UserSessionView, error)
+	RevokeUserSession(userID, sessionID uint) error
+	RevokeOtherUserSessions(userID, keepSessionID uint) (int64, error)
+	UserHasPermission(user *storage.User, action string) (bool, error)
+	ListRoles() ([]storage.Role, error)
+	ListUsers() ([]UserView, error)
+	GetUser(id uint) (*UserView, error)
+	CreateUser(actorID uint, req UserRequest) (*UserView, error)
+	SetUserRole(actorID, id uint, role string) (*UserView, error)
+	SetUserDisabled(actorID, id uint, disabled bool) (*UserView, error)
+	ResetUserPassword(actorID, id uint, password string, sendEmail bool) (*UserView, error)
+	SetUserEmail(actorID, id uint, email string) (*UserView, error)
+	UnlockUser(actorID, id uint) (*UserView, error)
+	DeleteUser(actorID, id uint) error
+	GetSecuritySettings() (*SecuritySettingsView, error)
+	SetSecuritySettings(actorID uint, settings SecuritySettingsView) (*SecuritySettingsView, error)
+	GetEmailSettings() (*EmailSettingsView, error)
+	SetEmailSettings(actorID uint, req EmailSettingsRequest) (*EmailSettingsView, error)
+	SendTestEmail(actorID uint, to string) error
+	SendCapacityReport(actorID uint) error
+	ListLoginAttempts(filter LoginAttemptFilter) ([]storage.LoginAttempt, error)
+	GetSecurityReport(since time.Time) (*SecurityReport, error)
+	BeginIdempotentRequest(userID uint, key, requestHash string) (*storage.IdempotencyKey, error)
+	CompleteIdempotentRequest(id uint, statusCode int, contentType string, body []byte) error
+	ReleaseIdempotencyKey(id uint) error
+	PlanRemoveHost(hostID string) (*DryRunPlan, error)
+	PlanDeleteVolume(hostID, poolName, volName string, opts VolumeDeleteOptions) (*DryRunPlan, error)
+	PlanDeleteNetwork(hostID, name string) (*DryRunPlan, error)
+	PlanColdMigration(hostID, vmName string, req ColdMigrationRequest) (*DryRunPlan, error)
+	PlanOrchestrationRun(action string, req OrchestrationRequest) (*DryRunPlan, error)
+	RunAgentSession(hostID string, session *agent.Session)
+	ListStoragePools(hostID string) ([]storage.StoragePool, error)
+	RefreshStoragePools(hostID string) error
+	GetStoragePoolUsage(hostID, poolName string, since time.Time) ([]storage.StoragePoolUsageSample, error)
+	SetStoragePoolThresholds(hostID, poolName string, thresholds PoolThresholds) (*storage.StoragePool, error)
+	SetStoragePoolAutostart(hostID, poolName string, enabled bool) (*storage.StoragePool, error)
+	SetStoragePoolActive(hostID, poolName string, active bool) (*storage.StoragePool, error)
+	ListAlerts(includeResolved bool) ([]storage.Alert, error)
+	ListVolumes(hostID, poolName string) ([]libvirt.VolumeInfo, error)
+	DeleteVolume(hostID, poolName, volName string, opts VolumeDeleteOptions) (*storage.Task, error)
+	GetVolumeImageSize(hostID, poolName, volName string) (uint64, error)
+	DownloadVolume(hostID, poolName, volName string, offset, length uint64, w io.Writer) error
+	UploadVolume(hostID, poolName, volName string, req VolumeUploadRequest, r io.Reader) (*UploadedVolume, error)
+	ListCatalogImages() ([]storage.CatalogImage, error)
+	CreateCatalogImage(req CatalogImageRequest) (*storage.CatalogImage, error)
+	UpdateCatalogImage(name string, req CatalogImageRequest) (*storage.CatalogImage, error)
+	DeleteCatalogImage(name string) error
+	DownloadCatalogImage(hostID, poolName string, req ImageDownloadRequest) (*storage.Task, error)
+	FindOrphanedVolumes(hostID, poolName string) ([]libvirt.VolumeInfo, error)
+	AdoptOrphanedVolume(hostID, poolName, volName string, req OrphanAttachRequest) (*AttachedDisk, error)
+	ListPoolFiles(hostID, poolName, dir string) (*PoolDirectory, error)
+	StatPoolFile(hostID, poolName, filePath string) (*PoolFile, error)
+	DeletePoolFile(hostID, poolName, filePath string) error
+	RenamePoolFile(hostID, poolName string, req PoolFileRenameRequest) (*PoolFile, error)
+	GetMACPool() (*MACPoolInfo, error)
+	SetMACPool(prefix string) (*MACPoolInfo, error)
+	ListMACConflicts() ([]storage.MACConflict, error)
+	ListNetworks(hostID string) ([]storage.Network, error)
+	CreateNetwork(hostID string, req NetworkRequest) (*storage.Network, error)
+	DeleteNetwork(hostID, name string) error
+	SetNetworkAutostart(hostID, name string, enabled bool) (*storage.Network, error)
+	SetNetworkActive(hostID, name string, active bool) (*storage.Network, error)
+	ListSecrets(hostID string) ([]libvirt.SecretInfo, error)
+	GetSecret(hostID, secretID string) (*libvirt.SecretInfo, error)
+	CreateSecret(hostID string, req SecretRequest) (*libvirt.SecretInfo, error)
+	DeleteSecret(hostID, secretID string) error
+	GetMonitoringSettings() (*MonitoringSettingsView, error)
+	SetMonitoringSettings(intervalSeconds float64) (*MonitoringSettingsView, error)
+	GetConsoleSettings() *ConsoleSettingsView
+	SetConsoleSettings(pingIntervalSeconds, idleTimeoutSeconds uint) (*ConsoleSettingsView, error)
+	SetHostStatsInterval(hostID string, intervalSeconds float64) error
+	GetVMStatsInterval(hostID, vmName string) (*StatsInterval, error)
+	SetVMStatsInterval(hostID, vmName string, intervalSeconds float64) (*StatsInterval, error)
+	GetVMCustomFields(hostID, vmName string) (map[string]string, error)
+	ReplaceVMCustomFields(hostID, vmName string, fields map[string]string) (map[string]string, error)
+	GetVMLabels(hostID, vmName string) (map[string]string, error)
+	ReplaceVMLabels(hostID, vmName string, labels map[string]string) (map[string]string, error)
+	SetVMLabel(hostID, vmName, key, value string) error
+	DeleteVMLabel(hostID, vmName, key string) error
+	ListVMs(selector string) ([]VMView, error)
+	GetCostRates() (*storage.CostRates, error)
+	SetCostRates(rates storage.CostRates) (*storage.CostRates, error)
+	GetCostReport(filter CostReportFilter) (*CostReport, error)
+	GetVMAvailability(hostID, vmName string, filter AvailabilityFilter) (*VMAvailability, error)
+	GetAvailabilityReport(filter AvailabilityFilter) (*AvailabilityReport, error)
+	ListHostCapacities() ([]HostCapacity, error)
+	ListVMUsage(filter UsageFilter) ([]storage.VMUsageSample, error)
+	ListPoolUsage(filter UsageFilter) ([]PoolUsageRow, error)
+	UsersExist() (bool, error)
+	ProjectsEnabled() (bool, error)
+	ProjectScopeFor(user *storage.User) (*ProjectScope, error)
+	ResourceProject(kind, hostID, key string) (uint, error)
+	HostVisible(scope *ProjectScope, hostID string) (bool, error)
+	BroadcastFilter(scope *ProjectScope) ws.Filter
+	ListProjects(scope *ProjectScope) ([]ProjectView, error)
+	GetProject(scope *ProjectScope, projectID uint) (*ProjectView, error)
+	CreateProject(actorID uint, req ProjectRequest) (*storage.Project, error)
+	DeleteProject(actorID, projectID uint) error
+	SetProjectMember(actorID, projectID, userID uint, role string) error
+	RemoveProjectMember(actorID, projectID, userID uint) error
+	AssignProjectResource(actorID, projectID uint, req ProjectResourceRequest) (*ProjectResourceView, error)
+	UnassignProjectResource(actorID, projectID, resourceID uint) error
+	ListNotificationSubscriptions(userID uint) ([]storage.NotificationSubscription, error)
+	CreateNotificationSubscription(userID uint, req NotificationSubscriptionRequest) (*storage.NotificationSubscription, error)
+	DeleteNotificationSubscription(userID, id uint) error
+	ListNotifications(userID uint, unreadOnly bool, limit int) (*NotificationList, error)
+	MarkNotificationRead(userID, id uint, read bool) error
+	MarkAllNotificationsRead(userID uint) error
+	DeleteNotification(userID, id uint) error
+	SetVMCustomField(hostID, vmName, name, value string) error
+	DeleteVMCustomField(hostID, vmName, name string) error
+	ListPlacementRules() ([]storage.PlacementRule, error)
+	CreatePlacementRule(req PlacementRuleRequest) (*storage.PlacementRule, error)
+	UpdatePlacementRule(name string, req PlacementRuleRequest) (*storage.PlacementRule, error)
+	DeletePlacementRule(name string) error
+	GetPlacementViolations() ([]PlacementViolation, error)
+	CheckPlacement(hostID, vmName, targetHostID string) ([]PlacementViolation, error)
+	ListVMDependencies() ([]storage.VMDependency, error)
+	CreateVMDependency(req VMDependencyRequest) (*storage.VMDependency, error)
+	DeleteVMDependency(id uint) error
+	PlanOrchestration(action string, req OrchestrationRequest) ([]OrchestrationStep, error)
+	StartOrchestration(action string, req OrchestrationRequest) (*storage.Task, error)
+	ListRunbooks() ([]storage.Runbook, error)
+	GetRunbook(name string) (*storage.Runbook, error)
+	CreateRunbook(req RunbookRequest) (*storage.Runbook, error)
+	UpdateRunbook(name string, req RunbookRequest) (*storage.Runbook, error)
+	DeleteRunbook(name string) error
+	RunRunbook(name string, userID uint, req RunbookRunRequest) (*storage.RunbookRun, error)
+	ListRunbookRuns(name string) ([]storage.RunbookRun, error)
+	GetRunbookRun(id uint) (*storage.RunbookRun, error)
+	ListVMGroups() ([]VMGroupView, error)
+	GetVMGroup(name string) (*VMGroupView, error)
+	CreateVMGroup(req VMGroupRequest) (*VMGroupView, error)
+	UpdateVMGroup(name string, req VMGroupRequest) (*VMGroupView, error)
+	DeleteVMGroup(name string) error
+	AddVMGroupMember(name string, req VMGroupMemberRequest) (*VMGroupView, error)
+	RemoveVMGroupMember(name, vmUUID string) error
+	StartVMGroup(name string) (*storage.Task, error)
+	StopVMGroup(name string) (*storage.Task, error)
+	SnapshotVMGroup(name string, req SnapshotRequest) (*storage.Task, error)
+	GetVMGroupStats(name string) (*VMGroupStats, error)
+	ListMaintenanceWindows(activeOnly bool) ([]MaintenanceWindowView, error)
+	GetMaintenanceWindow(name string) (*MaintenanceWindowView, error)
+	CreateMaintenanceWindow(req MaintenanceWindowRequest) (*MaintenanceWindowView, error)
+	UpdateMaintenanceWindow(name string, req MaintenanceWindowRequest) (*MaintenanceWindowView, error)
+	DeleteMaintenanceWindow(name string) error
+	PrecheckMigration(hostID, vmName, targetHostID string) (*MigrationPrecheckResult, error)
+	StartColdMigration(hostID, vmName string, req ColdMigrationRequest) (*storage.MigrationJob, error)
+	ListMigrationJobs() ([]storage.MigrationJob, error)
+	GetMigrationJob(id uint) (*storage.MigrationJob, error)
+	ResumeMigrationJob(id uint) (*storage.MigrationJob, error)
+	DiscardMigrationJob(id uint) error
+	GetDatabaseStats() storage.DBStats
+	GetConnectionStats() []libvirt.ConnectionStats
+	GetRuntimeDiagnostics() *RuntimeDiagnostics
+	GetCapabilities(user *storage.User) (*Capabilities, error)
+	ListFeatureFlags() ([]FeatureFlagView, error)
+	GetFeatureFlag(name string) (*FeatureFlagView, error)
+	SetFeatureFlag(name string, req FeatureFlagRequest) (*FeatureFlagView, error)
+	ResetFeatureFlag(name string) (*FeatureFlagView, error)
+	CheckFeature(name string, user *storage.User) error
+	CheckDBConsistency() (*DBConsistencyReport, error)
+	WriteMetrics(w io.Writer)
+	ListEvents(filter EventFilter) ([]storage.Event, error)
+	GetDiscoveryStatus() (*DiscoveryStatus, error)
+	GetDiscoverySettings() (*DiscoverySettingsView, error)
+	SetDiscoverySettings(req DiscoverySettingsView) (*DiscoverySettingsView, error)
+	GetSyncSettings() (*SyncSettingsView, error)
+	SetSyncSettings(req SyncSettingsView) (*SyncSettingsView, error)
+	GetForecastSettings() (*ForecastSettingsView, error)
+	SetForecastSettings(req ForecastSettingsView) (*ForecastSettingsView, error)
+	GetForecast(req ForecastSettingsView) (*Forecast, error)
+	GetHealthSettings() (*HealthSettingsView, error)
+	SetHealthSettings(req HealthSettingsView) (*HealthSettingsView, error)
+	ListHostCommands() []HostCommandView
+	ExecHostCommand(actorID uint, hostID string, req HostExecRequest) (*HostExecResult, error)
+	GetSyncStatus() []HostSyncStatus
+	BeginVMSpecEdit(hostID, vmName string, version uint64) (func(applied bool), error)
+	HostInventoryTag() (string, error)
+	VMInventoryTag(hostID string) (string, error)
+	VMHardwareTag(hostID, vmName string) (string, error)
+	CreateVM(hostID string, req VMCreateRequest) (*CreatedVM, error)
+	GetGuestSettings() (*storage.GuestSettings, error)
+	SetGuestSettings(req GuestSettingsRequest) (*storage.GuestSettings, error)
+	GetTracingSettings() (*storage.TracingSettings, error)
+	SetTracingSettings(req TracingSettingsRequest) (*storage.TracingSettings, error)
+	ListHardwarePresets() ([]storage.HardwarePreset, error)
+	GetHardwarePreset(name string) (*storage.HardwarePreset, error)
+	CreateHardwarePreset(req HardwarePresetRequest) (*storage.HardwarePreset, error)
+	UpdateHardwarePreset(name string, req HardwarePresetRequest) (*storage.HardwarePreset, error)
+	DeleteHardwarePreset(name string) error
+	ScanForHosts() error
+	AdoptDiscoveredHost(address string, req DiscoveryAdoptRequest) (*storage.Host, error)
+	TerraformHosts(name string) ([]TerraformHost, error)
+	TerraformHost(id string) (*TerraformHost, error)
+	TerraformVMs(filter TerraformFilter) ([]TerraformVM, error)
+	TerraformVM(id string) (*TerraformVM, error)
+	TerraformNetworks(filter TerraformFilter) ([]TerraformNetwork, error)
+	TerraformNetwork(id uint) (*TerraformNetwork, error)
+	TerraformVolumes(filter TerraformFilter) ([]TerraformVolume, error)
+	TerraformVolume(id uint) (*TerraformVolume, error)
 }
 
 type HostService struct {
@@ -87,6 +425,18 @@ type HostService struct {
 	connector *libvirt.Connector
 	hub       *ws.Hub
 	monitor   *MonitoringManager
+	tasks     *TaskManager
+	syncs     *hostSyncs
+
+	syncSchedule    *syncSchedule
+	powerTokens     *powerTokenStore
+	migrations      sync.Map // IDs of migration jobs with a run in progress
+	liveMigrations  sync.Map // VM UUIDs of live migrations in progress, to their *liveMigration
+	evacuations     sync.Map // IDs of hosts being evacuated
+	diskCompactions sync.Map // 'host/vm' keys of VMs whose disks are being compacted
+	vmSpecEdits     sync.Map // 'host/vm' keys to the *sync.Mutex serializing edits of the VM
+	discovery       *discoveryState
+	featureDefaults map[string]bool // Feature flag defaults from the configuration
 }
 
 func NewHostService(db *gorm.DB, connector *libvirt.Connector, hub *ws.Hub) *HostService {
@@ -94,6 +444,12 @@ func NewHostService(db *gorm.DB, connector *libvirt.Connector, hub *ws.Hub) *Hos
 		db:        db,
 		connector: connector,
 		hub:       hub,
+		tasks:     NewTaskManager(db, hub),
+		syncs:     newHostSyncs(),
+
+		syncSchedule: newSyncSchedule(),
+		powerTokens:  newPowerTokenStore(),
+		discovery:    newDiscoveryState(),
 	}
 	s.monitor = NewMonitoringManager(s)
 	return s
@@ -110,32 +466,111 @@ func (s *HostService) broadcastVMsChanged(hostID string) {
 	})
 }
 
+// broadcastVMStateChanged sends the full view of a VM whose state changed, so
+// open VM pages can update without refetching.
+func (s *HostService) broadcastVMStateChanged(hostID string, vmID uint, previous storage.VMState) {
+	var vm storage.VirtualMachine
+	if err := s.db.First(&vm, vmID).Error; err != nil {
+		log.Printf("Warning: could not load VM %d for state change notification: %v", vmID, err)
+		return
+	}
+	// Changes during a maintenance window are expected and notify nobody.
+	window := s.activeMaintenanceWindow(hostID, vm.Name)
+	s.hub.BroadcastMessage(ws.Message{
+		Type: "vm-state-changed",
+		Payload: ws.MessagePayload{
+			"hostId":        hostID,
+			"vmName":        vm.Name,
+			"previousState": previous,
+			"expected":      window != nil,
+			"vm":            s.vmToView(vm),
+		},
+	})
+	change := storage.VMStateChange{VMUUID: vm.UUID, HostID: hostID, VMName: vm.Name, PreviousState: previous, State: vm.State, Expected: window != nil}
+	if err := s.db.Create(&change).Error; err != nil {
+		log.Printf("Warning: failed to record state change of VM %s: %v", vm.Name, err)
+	}
+	details := map[string]interface{}{"previous_state": previous, "state": vm.State}
+	if window != nil {
+		details["expected"] = true
+		details["maintenance_window"] = window.Name
+	}
+	s.saveEvent(EventVMStateChanged, hostID, vm.Name, fmt.Sprintf("State changed from %s to %s", previous, vm.State), details, window != nil)
+}
+
+// recordAudit writes an entry to the audit log. Failures are logged but never
+// block the operation being audited.
+func (s *HostService) recordAudit(action, targetType, targetID, details string) {
+	s.recordUserAudit(0, action, targetType, targetID, details)
+}
+
+// recordUserAudit writes an audit log entry for an action of a logged-in user.
+func (s *HostService) recordUserAudit(userID uint, action, targetType, targetID, details string) {
+	entry := storage.AuditLog{
+		UserID:     userID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		log.Printf("Warning: failed to write audit log entry %s for %s %s: %v", action, targetType, targetID, err)
+	}
+}
+
 // --- Host Management ---
 
 func (s *HostService) GetAllHosts() ([]storage.Host, error) {
 	var hosts []storage.Host
-	if err := s.db.Find(&hosts).Error; err != nil {
+	if err := s.db.Order("name").Find(&hosts).Error; err != nil {
 		return nil, err
 	}
 	return hosts, nil
 }
 
-func (s *HostService) GetHostInfo(hostID string) (*libvirt.HostInfo, error) {
-	return s.connector.GetHostInfo(hostID)
-}
-
+// AddHost connects to a new host and stores it. The host gets a generated ID;
+// clients from before that send the name as the ID.
 func (s *HostService) AddHost(host storage.Host) (*storage.Host, error) {
+	if host.Name == "" {
+		host.Name = host.ID
+	}
+	host.ID = uuid.NewString()
+	if err := ValidateHost(&host); err != nil {
+		return nil, err
+	}
+	if err := s.checkHostUnique(host.ID, host.Name, host.URI); err != nil {
+		return nil, err
+	}
+	hostURI, err := libvirt.ParseHostURI(host.URI)
+	if err != nil {
+		return nil, err
+	}
+	host.Driver = hostURI.Driver
+
+	// Agent hosts dial in to us; there is nothing to connect to yet.
+	if hostURI.Transport == libvirt.TransportAgent {
+		if err := issueAgentToken(&host); err != nil {
+			return nil, err
+		}
+		if err := s.db.Create(&host).Error; err != nil {
+			return nil, fmt.Errorf("failed to save host to database: %w", err)
+		}
+		s.broadcastHostsChanged()
+		return &host, nil
+	}
+
 	if err := s.db.Create(&host).Error; err != nil {
 		return nil, fmt.Errorf("failed to save host to database: %w", err)
 	}
 
-	err := s.connector.AddHost(host)
+	err = s.connector.AddHost(host)
 	if err != nil {
 		if delErr := s.db.Delete(&host).Error; delErr != nil {
 			log.Printf("CRITICAL: Failed to rollback host creation for %s after connection failure. DB Error: %v", host.ID, delErr)
 		}
 		return nil, fmt.Errorf("failed to connect to host: %w", err)
 	}
+	s.recordEvent(EventHostConnected, host.ID, "", "Host added and connected", nil)
 
 	// Initial sync after adding a host
 	go s.SyncVMsForHost(host.ID)
@@ -145,17 +580,40 @@ func (s *HostService) AddHost(host storage.Host) (*storage.Host, error) {
 }
 
 func (s *HostService) RemoveHost(hostID string) error {
-	if err := s.connector.RemoveHost(hostID); err != nil {
+	if err := s.disconnectHost(hostID, true); err != nil {
 		log.Printf("Warning: failed to disconnect from host %s during removal, continuing with DB deletion: %v", hostID, err)
 	}
 
-	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.VirtualMachine{}).Error; err != nil {
-		log.Printf("Warning: failed to delete VMs for host %s from database: %v", hostID, err)
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.HostInfo{}).Error; err != nil {
+		log.Printf("Warning: failed to delete cached details of host %s from database: %v", hostID, err)
+	}
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.BalloonPolicy{}).Error; err != nil {
+		log.Printf("Warning: failed to delete balloon policy of host %s from database: %v", hostID, err)
+	}
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.DiskCompactionPolicy{}).Error; err != nil {
+		log.Printf("Warning: failed to delete disk compaction policy of host %s from database: %v", hostID, err)
+	}
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.FstrimPolicy{}).Error; err != nil {
+		log.Printf("Warning: failed to delete fstrim policy of host %s from database: %v", hostID, err)
+	}
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.HostFencing{}).Error; err != nil {
+		log.Printf("Warning: failed to delete fencing settings of host %s from database: %v", hostID, err)
+	}
+	s.db.Model(&storage.Alert{}).Where("host_id = ? AND resolved_at IS NULL", hostID).Update("resolved_at", time.Now())
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.ProjectResource{}).Error; err != nil {
+		log.Printf("Warning: failed to delete project assignments for host %s from database: %v", hostID, err)
+	}
+	if err := s.db.Where("host_id = ?", hostID).Delete(&storage.NotificationSubscription{}).Error; err != nil {
+		log.Printf("Warning: failed to delete notification subscriptions for host %s from database: %v", hostID, err)
 	}
 
+	// The host's VMs, networks and storage pools go with it, and with the
+	// VMs their devices, attachments, ports, snapshots and the like.
 	if err := s.db.Where("id = ?", hostID).Delete(&storage.Host{}).Error; err != nil {
 		return fmt.Errorf("failed to delete host from database: %w", err)
 	}
+	s.recordEvent(EventHostRemoved, hostID, "", "Host removed", nil)
+	s.EvaluatePlacementRules()
 
 	s.broadcastHostsChanged()
 	return nil
@@ -169,11 +627,26 @@ func (s *HostService) ConnectToAllHosts() {
 	}
 
 	for _, host := range hosts {
+		// Hosts added before driver detection existed have no driver recorded.
+		if host.Driver == "" {
+			if hostURI, err := libvirt.ParseHostURI(host.URI); err == nil {
+				s.db.Model(&host).Update("driver", hostURI.Driver)
+			}
+		}
+
+		if isAgentHost(host) {
+			log.Printf("Waiting for agent of stored host %s to connect", host.ID)
+			continue
+		}
+
 		log.Printf("Attempting to connect to stored host: %s", host.ID)
 		if err := s.connector.AddHost(host); err != nil {
 			log.Printf("Failed to connect to host %s (%s) on startup: %v", host.ID, host.URI, err)
+			s.recordEvent(EventHostConnectionFailed, host.ID, "", "Failed to connect on startup",
+				map[string]interface{}{"error": err.Error()})
 		} else {
-			go s.SyncVMsForHost(host.ID)
+			s.recordEvent(EventHostConnected, host.ID, "", "Connected on startup", nil)
+			go s.resumeHost(host)
 		}
 	}
 }
@@ -187,39 +660,105 @@ func (s *HostService) GetVMsForHostFromDB(hostID string) ([]VMView, error) {
 
 	var vmViews []VMView
 	for _, dbVM := range dbVMs {
-		var graphics libvirt.GraphicsInfo // Default to false
-
-		// Only query for graphics devices if the VM is running.
-		if dbVM.State == storage.StateActive {
-			var graphicsDevice storage.GraphicsDevice
-			err := s.db.Joins("join graphics_device_attachments on graphics_device_attachments.graphics_device_id = graphics_devices.id").
-				Where("graphics_device_attachments.vm_id = ?", dbVM.ID).First(&graphicsDevice).Error
-
-			if err != nil && err != gorm.ErrRecordNotFound {
-				// Log only unexpected errors, not "not found".
-				log.Printf("Error querying graphics device for running VM %d: %v", dbVM.ID, err)
-			} else if err == nil {
-				graphics.VNC = strings.ToLower(graphicsDevice.Type) == "vnc"
-				graphics.SPICE = strings.ToLower(graphicsDevice.Type) == "spice"
-			}
+		vmViews = append(vmViews, s.vmToView(dbVM))
+	}
+	return vmViews, nil
+}
+
+// vmRunning reports whether a VM in the given state has a running QEMU
+// process, and so an uptime.
+func vmRunning(state storage.VMState) bool {
+	return state == storage.StateActive || state == storage.StatePaused || state == storage.StateSuspended
+}
+
+// vmToView builds the API view of a VM from its database record.
+func (s *HostService) vmToView(dbVM storage.VirtualMachine) VMView {
+	var graphics libvirt.GraphicsInfo // Default to false
+
+	// Only query for graphics devices if the VM is running.
+	if dbVM.State == storage.StateActive {
+		var graphicsDevice storage.GraphicsDevice
+		err := s.db.Joins("join graphics_device_attachments on graphics_device_attachments.graphics_device_id = graphics_devices.id").
+			Where("graphics_device_attachments.vm_id = ?", dbVM.ID).First(&graphicsDevice).Error
+
+		if err != nil && err != gorm.ErrRecordNotFound {
+			// Log only unexpected errors, not "not found".
+			log.Printf("Error querying graphics device for running VM %d: %v", dbVM.ID, err)
+		} else if err == nil {
+			graphics.VNC = strings.ToLower(graphicsDevice.Type) == "vnc"
+			graphics.SPICE = strings.ToLower(graphicsDevice.Type) == "spice"
 		}
+	}
 
-		vmViews = append(vmViews, VMView{
-			ID:              dbVM.ID,
-			Name:            dbVM.Name,
-			UUID:            dbVM.UUID,
-			DomainUUID:      dbVM.DomainUUID,
-			Description:     dbVM.Description,
-			VCPUCount:       dbVM.VCPUCount,
-			MemoryBytes:     dbVM.MemoryBytes,
-			IsTemplate:      dbVM.IsTemplate,
-			CPUModel:        dbVM.CPUModel,
-			CPUTopologyJSON: dbVM.CPUTopologyJSON,
-			State:           dbVM.State,
-			Graphics:        graphics,
-		})
+	var uptime int64 = -1
+	if dbVM.StartedAt != nil {
+		uptime = int64(time.Since(*dbVM.StartedAt).Seconds())
+	}
+
+	customFields, err := customFieldsOf(s.db, dbVM.ID)
+	if err != nil {
+		log.Printf("Error querying custom fields of VM %d: %v", dbVM.ID, err)
+	}
+	labels, err := labelsOf(s.db, dbVM.ID)
+	if err != nil {
+		log.Printf("Error querying labels of VM %d: %v", dbVM.ID, err)
+	}
+	projectID, err := s.vmProject(dbVM)
+	if err != nil {
+		log.Printf("Error querying the project of VM %d: %v", dbVM.ID, err)
+	}
+	guestFilesystems := dbVM.GuestFilesystems
+	if guestFilesystems == nil {
+		guestFilesystems = []storage.GuestFilesystem{}
+	}
+	healthReasons := dbVM.HealthReasons
+	if healthReasons == nil {
+		healthReasons = []storage.HealthReason{}
+	}
+
+	return VMView{
+		ID:              dbVM.ID,
+		HostID:          dbVM.HostID,
+		Name:            dbVM.Name,
+		UUID:            dbVM.UUID,
+		DomainUUID:      dbVM.DomainUUID,
+		Description:     dbVM.Description,
+		VCPUCount:       dbVM.VCPUCount,
+		MemoryBytes:     dbVM.MemoryBytes,
+		IsTemplate:      dbVM.IsTemplate,
+		CPUModel:        dbVM.CPUModel,
+		CPUTopologyJSON: dbVM.CPUTopologyJSON,
+		OSType:          dbVM.OSType,
+		OSVariant:       dbVM.OSVariant,
+		OSName:          dbVM.OSName,
+		State:           dbVM.State,
+		Graphics:        graphics,
+		StartedAt:       dbVM.StartedAt,
+		Uptime:          uptime,
+		CustomFields:    customFields,
+		Labels:          labels,
+		ProjectID:       projectID,
+		Generation:      dbVM.Generation,
+
+		StartupPriority:     dbVM.StartupPriority,
+		StartupDelaySeconds: dbVM.StartupDelaySeconds,
+
+		CPUShares:   dbVM.CPUShares,
+		BlkioWeight: dbVM.BlkioWeight,
+
+		BalloonMinBytes: dbVM.BalloonMinBytes,
+
+		EvacuationPolicy:       dbVM.EvacuationPolicy,
+		EvacuationTargetHostID: dbVM.EvacuationTargetHostID,
+
+		GuestFilesystems:   guestFilesystems,
+		GuestFilesystemsAt: dbVM.GuestFilesystemsAt,
+		GuestAgent:         dbVM.GuestAgent,
+
+		Health:          dbVM.Health,
+		HealthReasons:   healthReasons,
+		HealthChangedAt: dbVM.HealthChangedAt,
 	}
-	return vmViews, nil
 }
 
 func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.HardwareInfo, error) {
@@ -245,10 +784,12 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 				Bus: da.BusType,
 			},
 			Driver: struct {
-				Name string `xml:"name,attr" json:"driver_name"`
-				Type string `xml:"type,attr" json:"type"`
+				Name    string `xml:"name,attr" json:"driver_name"`
+				Type    string `xml:"type,attr" json:"type"`
+				Discard string `xml:"discard,attr" json:"discard,omitempty"`
 			}{
-				Type: da.Volume.Format,
+				Type:    da.Volume.Format,
+				Discard: da.Discard,
 			},
 		})
 	}
@@ -260,7 +801,7 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 		for _, port := range ports {
 			var binding storage.PortBinding
 			if err := s.db.Preload("Network").Where("port_id = ?", port.ID).First(&binding).Error; err == nil {
-				hardware.Networks = append(hardware.Networks, libvirt.NetworkInfo{
+				nic := libvirt.NetworkInfo{
 					Mac: struct {
 						Address string `xml:"address,attr" json:"address"`
 					}{
@@ -281,44 +822,98 @@ func (s *HostService) getVMHardwareFromDB(hostID, vmName string) (*libvirt.Hardw
 					}{
 						Dev: port.DeviceName,
 					},
-				})
+				}
+				if binding.Network.VirtualPortType != "" {
+					nic.VirtualPort = &struct {
+						Type string `xml:"type,attr" json:"type"`
+					}{Type: binding.Network.VirtualPortType}
+				}
+				if binding.VLANID != 0 {
+					nic.VLAN = &libvirt.InterfaceVLAN{}
+					nic.VLAN.Tag.ID = binding.VLANID
+				}
+				hardware.Networks = append(hardware.Networks, nic)
 			}
 		}
 	}
 
 	return &hardware, nil
 }
-func (s *HostService) GetVMHardwareAndTriggerSync(hostID, vmName string) (*libvirt.HardwareInfo, error) {
-	// We will now always sync and then get from DB for consistency,
-	// since the data is structured and no longer a simple JSON blob.
-	if changed, syncErr := s.syncSingleVM(hostID, vmName); syncErr != nil {
-		log.Printf("Error during hardware sync for %s: %v", vmName, syncErr)
-		// We can still try to return what's in the DB
-	} else if changed {
-		s.broadcastVMsChanged(hostID)
-	}
 
+// GetVMHardware returns the hardware of a VM as last synced. It does not
+// talk to libvirt; RefreshVM syncs the VM first.
+func (s *HostService) GetVMHardware(hostID, vmName string) (*libvirt.HardwareInfo, error) {
 	return s.getVMHardwareFromDB(hostID, vmName)
 }
 
+// GetVMCapabilities reports which devices can be added to a VM while it
+// runs, with the reason for those that cannot.
+func (s *HostService) GetVMCapabilities(hostID, vmName string) (*libvirt.HotplugCapabilities, error) {
+	return s.connector.GetHotplugCapabilities(hostID, vmName)
+}
+
+// SyncVMsForHost syncs a host's VMs in the background, logging failures.
 func (s *HostService) SyncVMsForHost(hostID string) {
-	changed, err := s.syncAndListVMs(hostID)
-	if err != nil {
+	err := s.RefreshHostVMs(hostID)
+	if errors.Is(err, ErrHostGone) || errors.Is(err, context.Canceled) {
+		log.Printf("VM sync for host %s stopped: %v", hostID, err)
+	} else if err != nil {
 		log.Printf("Error during background VM sync for host %s: %v", hostID, err)
-		return
+	}
+}
+
+// RefreshHostVMs syncs every VM of a host from libvirt now, instead of
+// waiting for the next periodic sync.
+func (s *HostService) RefreshHostVMs(hostID string) error {
+	changed, err := s.reconcileHost(hostID)
+	if errors.Is(err, ErrHostGone) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	if err != nil {
+		s.recordEvent(EventSyncFailed, hostID, "", "VM sync failed", map[string]interface{}{"error": err.Error()})
+		return err
+	}
+	if changed {
+		// Syncs without changes are not recorded; they run periodically.
+		s.recordEvent(EventVMsSynced, hostID, "", "VM inventory changed during sync", nil)
+		s.broadcastVMsChanged(hostID)
+		s.EvaluatePlacementRules()
+	}
+	return nil
+}
+
+// RefreshVM syncs a single VM from libvirt now. A VM that no longer exists
+// in libvirt is removed.
+func (s *HostService) RefreshVM(ctx context.Context, hostID, vmName string) error {
+	changed, err := s.syncSingleVMContext(ctx, hostID, vmName)
+	if err != nil {
+		return err
 	}
 	if changed {
 		s.broadcastVMsChanged(hostID)
 	}
+	return nil
 }
 
 func (s *HostService) syncSingleVM(hostID, vmName string) (bool, error) {
+	return s.syncSingleVMContext(context.Background(), hostID, vmName)
+}
+
+// syncSingleVMContext is syncSingleVM as part of a request, whose trace
+// shows the libvirt calls and queries of the sync.
+func (s *HostService) syncSingleVMContext(ctx context.Context, hostID, vmName string) (changed bool, err error) {
+	ctx, span := tracing.Start(ctx, "HostService.syncSingleVM", tracing.Host(hostID), tracing.VM(vmName))
+	defer func() { tracing.End(span, err) }()
+	db := s.db.WithContext(ctx)
+
+	_, infoSpan := tracing.Start(ctx, "libvirt.GetDomainInfo", tracing.Host(hostID), tracing.VM(vmName))
 	vmInfo, err := s.connector.GetDomainInfo(hostID, vmName)
+	tracing.End(infoSpan, err)
 	if err != nil {
 		var dbVM storage.VirtualMachine
-		if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&dbVM).Error; err == nil {
+		if err := db.Where("host_id = ? AND name = ?", hostID, vmName).First(&dbVM).Error; err == nil {
 			log.Printf("Pruning VM %s from database as it's no longer in libvirt.", vmName)
-			if err := s.db.Delete(&dbVM).Error; err != nil {
+			if err := db.Unscoped().Delete(&dbVM).Error; err != nil {
 				log.Printf("Warning: failed to prune old VM %s: %v", dbVM.Name, err)
 				return false, err
 			}
@@ -327,25 +922,91 @@ func (s *HostService) syncSingleVM(hostID, vmName string) (bool, error) {
 		return false, fmt.Errorf("could not fetch info for VM %s on host %s: %w", vmName, hostID, err)
 	}
 
+	_, hardwareSpan := tracing.Start(ctx, "libvirt.GetDomainHardware", tracing.Host(hostID), tracing.VM(vmName))
 	hardwareInfo, err := s.connector.GetDomainHardware(hostID, vmName)
+	tracing.End(hardwareSpan, err)
 	if err != nil {
 		log.Printf("Warning: could not fetch hardware for VM %s: %v", vmInfo.Name, err)
 	}
 
-	tx := s.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+	var result vmSyncResult
+	err = storage.Transact(db, func(tx *gorm.DB) error {
+		if err := requireHost(hostID)(tx); err != nil {
+			return err
 		}
-	}()
+		var err error
+		result, err = s.applyVMSync(tx, hostID, vmInfo, hardwareInfo)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if result.stateChanged {
+		s.broadcastVMStateChanged(hostID, result.vmID, result.previousState)
+	}
+
+	return result.changed, nil
+}
+
+// vmSyncResult describes what syncing a VM changed in the database.
+type vmSyncResult struct {
+	vmID          uint
+	changed       bool
+	stateChanged  bool
+	previousState storage.VMState
+}
+
+// cpuTopologyJSON encodes a domain's CPU topology for storage, or returns an
+// empty string when the domain does not define one.
+func cpuTopologyJSON(topology *libvirt.CPUTopology) string {
+	if topology == nil {
+		return ""
+	}
+	encoded, err := json.Marshal(topology)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// hardwareFingerprint is a hash of a VM's hardware as read from libvirt.
+func hardwareFingerprint(hardware *libvirt.HardwareInfo, graphics *libvirt.GraphicsInfo) string {
+	encoded, err := json.Marshal(struct {
+		Hardware *libvirt.HardwareInfo
+		Graphics *libvirt.GraphicsInfo
+	}{hardware, graphics})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// osInfoSupersedes reports whether freshly read OS info should replace what is
+// stored for a VM. The guest agent is only reachable while the VM runs, so
+// what it reported is kept over the domain XML metadata until it reports
+// something else.
+func osInfoSupersedes(info libvirt.OSInfo, vm storage.VirtualMachine) bool {
+	if info.Source == "" {
+		return false
+	}
+	if info.Source != libvirt.OSSourceGuestAgent && vm.OSSource == libvirt.OSSourceGuestAgent {
+		return false
+	}
+	return info.Family != vm.OSType || info.Variant != vm.OSVariant || info.Name != vm.OSName || info.Source != vm.OSSource
+}
 
+// applyVMSync writes a VM's live state and hardware to the database. All
+// libvirt calls happen before, so the transaction only holds the database
+// lock for the writes themselves.
+func (s *HostService) applyVMSync(tx *gorm.DB, hostID string, vmInfo *libvirt.VMInfo, hardwareInfo *libvirt.HardwareInfo) (vmSyncResult, error) {
+	var result vmSyncResult
 	var existingVMOnHost storage.VirtualMachine
-	var changed bool
-	err = tx.Where("host_id = ? AND domain_uuid = ?", hostID, vmInfo.UUID).First(&existingVMOnHost).Error
+	err := tx.Where("host_id = ? AND domain_uuid = ?", hostID, vmInfo.UUID).First(&existingVMOnHost).Error
 
 	if err != nil && err != gorm.ErrRecordNotFound {
-		tx.Rollback()
-		return false, err // Database error
+		return result, err // Database error
 	}
 
 	// Case 1: The VM is not in our DB for this host. It's either brand new or has a conflict.
@@ -360,7 +1021,30 @@ func (s *HostService) syncSingleVM(hostID, vmName string) (bool, error) {
 			State:       mapLibvirtStateToVMState(vmInfo.State),
 			VCPUCount:   vmInfo.Vcpu,
 			MemoryBytes: vmInfo.MaxMem * 1024,
+			OSType:      vmInfo.OS.Family,
+			OSVariant:   vmInfo.OS.Variant,
+			OSName:      vmInfo.OS.Name,
+			OSSource:    vmInfo.OS.Source,
+
+			Description:     vmInfo.Description,
+			CPUModel:        vmInfo.CPUModel,
+			CPUTopologyJSON: cpuTopologyJSON(vmInfo.CPUTopology),
+			CPUShares:       vmInfo.Tuning.CPUShares,
+			BlkioWeight:     vmInfo.Tuning.BlkioWeight,
+		}
+		if hardwareInfo != nil {
+			newVMRecord.HardwareFingerprint = hardwareFingerprint(hardwareInfo, &vmInfo.Graphics)
+		}
+		if vmRunning(newVMRecord.State) {
+			now := time.Now()
+			newVMRecord.StartedAt = &now
 		}
+		if vmInfo.GuestFilesystems != nil {
+			now := time.Now()
+			newVMRecord.GuestFilesystems = vmInfo.GuestFilesystems
+			newVMRecord.GuestFilesystemsAt = &now
+		}
+		newVMRecord.GuestAgent = vmInfo.GuestAgent
 
 		if err == gorm.ErrRecordNotFound {
 			// No conflict found. This is a genuinely new VM to our entire system.
@@ -368,8 +1052,7 @@ func (s *HostService) syncSingleVM(hostID, vmName string) (bool, error) {
 			newVMRecord.UUID = vmInfo.UUID
 		} else if err != nil {
 			// Some other DB error occurred
-			tx.Rollback()
-			return false, err
+			return result, err
 		} else {
 			// Conflict found! A VM with this domain UUID exists on another host.
 			// Generate a new, unique internal UUID for our system.
@@ -378,57 +1061,112 @@ func (s *HostService) syncSingleVM(hostID, vmName string) (bool, error) {
 		}
 
 		if err := tx.Create(&newVMRecord).Error; err != nil {
-			tx.Rollback()
-			return false, err
+			return result, err
 		}
-		changed = true
+		result.changed = true
 		existingVMOnHost = newVMRecord // Use the newly created record for hardware sync
 	} else { // Case 2: The VM already exists in our DB for this host. Just update its state.
+		result.previousState = existingVMOnHost.State
+		result.stateChanged = result.previousState != mapLibvirtStateToVMState(vmInfo.State)
+		topologyJSON := cpuTopologyJSON(vmInfo.CPUTopology)
 		updates := map[string]interface{}{
-			"Name":        vmInfo.Name,
-			"State":       mapLibvirtStateToVMState(vmInfo.State),
-			"VCPUCount":   vmInfo.Vcpu,
-			"MemoryBytes": vmInfo.MaxMem * 1024,
+			"Name":            vmInfo.Name,
+			"State":           mapLibvirtStateToVMState(vmInfo.State),
+			"VCPUCount":       vmInfo.Vcpu,
+			"MemoryBytes":     vmInfo.MaxMem * 1024,
+			"Description":     vmInfo.Description,
+			"CPUModel":        vmInfo.CPUModel,
+			"CPUTopologyJSON": topologyJSON,
+			"CPUShares":       vmInfo.Tuning.CPUShares,
+			"BlkioWeight":     vmInfo.Tuning.BlkioWeight,
+		}
+		// Without a guest agent libvirt cannot tell how long a VM has been
+		// running, so remember when it was first seen running instead.
+		startedAtChanged := false
+		if running := vmRunning(mapLibvirtStateToVMState(vmInfo.State)); running && existingVMOnHost.StartedAt == nil {
+			now := time.Now()
+			updates["StartedAt"] = &now
+			startedAtChanged = true
+		} else if !running && existingVMOnHost.StartedAt != nil {
+			updates["StartedAt"] = nil
+			startedAtChanged = true
+		}
+		osChanged := false
+		if osInfoSupersedes(vmInfo.OS, existingVMOnHost) {
+			updates["OSType"] = vmInfo.OS.Family
+			updates["OSVariant"] = vmInfo.OS.Variant
+			updates["OSName"] = vmInfo.OS.Name
+			updates["OSSource"] = vmInfo.OS.Source
+			osChanged = true
 		}
 		if existingVMOnHost.Name != vmInfo.Name || existingVMOnHost.State != mapLibvirtStateToVMState(vmInfo.State) ||
-			existingVMOnHost.VCPUCount != vmInfo.Vcpu || existingVMOnHost.MemoryBytes != (vmInfo.MaxMem*1024) {
+			existingVMOnHost.VCPUCount != vmInfo.Vcpu || existingVMOnHost.MemoryBytes != (vmInfo.MaxMem*1024) ||
+			existingVMOnHost.Description != vmInfo.Description || existingVMOnHost.CPUModel != vmInfo.CPUModel ||
+			existingVMOnHost.CPUTopologyJSON != topologyJSON || existingVMOnHost.CPUShares != vmInfo.Tuning.CPUShares ||
+			existingVMOnHost.BlkioWeight != vmInfo.Tuning.BlkioWeight || startedAtChanged || osChanged {
 			if err := tx.Model(&existingVMOnHost).Updates(updates).Error; err != nil {
-				tx.Rollback()
-				return false, err
+				return result, err
+			}
+			result.changed = true
+		}
+		// Usage inside the guest changes all the time; storing it does not
+		// count as a change to broadcast.
+		if vmInfo.GuestFilesystems != nil {
+			now := time.Now()
+			usage := storage.VirtualMachine{GuestFilesystems: vmInfo.GuestFilesystems, GuestFilesystemsAt: &now}
+			if err := tx.Model(&existingVMOnHost).Select("GuestFilesystems", "GuestFilesystemsAt").Updates(&usage).Error; err != nil {
+				return result, err
+			}
+		}
+		// Neither does the guest agent coming and going; the health monitor
+		// reports it.
+		if vmInfo.GuestAgent != existingVMOnHost.GuestAgent {
+			if err := tx.Model(&existingVMOnHost).Update("GuestAgent", vmInfo.GuestAgent).Error; err != nil {
+				return result, err
 			}
-			changed = true
 		}
 	}
+	result.vmID = existingVMOnHost.ID
 
 	if hardwareInfo != nil {
-		if err := s.syncVMHardware(tx, existingVMOnHost.ID, hostID, hardwareInfo, &vmInfo.Graphics); err != nil {
-			tx.Rollback()
-			return false, fmt.Errorf("failed to sync hardware: %w", err)
+		if fingerprint := hardwareFingerprint(hardwareInfo, &vmInfo.Graphics); fingerprint != existingVMOnHost.HardwareFingerprint {
+			if err := tx.Model(&existingVMOnHost).Update("HardwareFingerprint", fingerprint).Error; err != nil {
+				return result, err
+			}
+			// VMs synced before fingerprints were kept have none yet.
+			result.changed = result.changed || existingVMOnHost.HardwareFingerprint != ""
+		}
+		if err := s.syncVMHardware(tx, existingVMOnHost.ID, hostID, vmInfo.Name, hardwareInfo, &vmInfo.Graphics); err != nil {
+			return result, fmt.Errorf("failed to sync hardware: %w", err)
 		}
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		return false, err
-	}
-
-	return changed, nil
+	return result, nil
 }
 
 // syncVMHardware reconciles the live hardware state with the database.
-func (s *HostService) syncVMHardware(tx *gorm.DB, vmID uint, hostID string, hardware *libvirt.HardwareInfo, graphics *libvirt.GraphicsInfo) error {
+func (s *HostService) syncVMHardware(tx *gorm.DB, vmID uint, hostID, vmName string, hardware *libvirt.HardwareInfo, graphics *libvirt.GraphicsInfo) error {
 	// Correctly clear existing PortBindings by finding associated ports first
 	var portsToDelete []storage.Port
 	tx.Where("vm_id = ?", vmID).Find(&portsToDelete)
+	previousBindings := make(map[uint]storage.PortBinding)
 	if len(portsToDelete) > 0 {
 		var portIDs []uint
 		for _, p := range portsToDelete {
 			portIDs = append(portIDs, p.ID)
 		}
+		// Keep the old bindings at hand: VLANs on Linux bridges are not part
+		// of the domain XML and would otherwise be lost.
+		var bindings []storage.PortBinding
+		tx.Preload("Network").Where("port_id IN ?", portIDs).Find(&bindings)
+		for _, b := range bindings {
+			previousBindings[b.PortID] = b
+		}
 		tx.Where("port_id IN ?", portIDs).Delete(&storage.PortBinding{})
 	}
 
 	tx.Where("vm_id = ?", vmID).Delete(&storage.VolumeAttachment{})
-	tx.Where("vm_id = ?", vmID).Delete(&storage.GraphicsDeviceAttachment{})
+	tx.Unscoped().Where("vm_id = ?", vmID).Delete(&storage.GraphicsDeviceAttachment{})
 
 	// Sync Disks
 	for _, disk := range hardware.Disks {
@@ -445,50 +1183,79 @@ func (s *HostService) syncVMHardware(tx *gorm.DB, vmID uint, hostID string, hard
 				VolumeID:   volume.ID,
 				DeviceName: disk.Target.Dev,
 				BusType:    disk.Target.Bus,
+				Discard:    disk.Driver.Discard,
 			}
 			tx.Create(&attachment)
 		}
 	}
 
 	// Sync Networks
+	var liveMACs, conflictedMACs []string
 	for _, net := range hardware.Networks {
-		var network storage.Network
-		networkUUID := uuid.NewSHA1(uuid.Nil, []byte(fmt.Sprintf("%s:%s", hostID, net.Source.Bridge)))
-
-		tx.FirstOrCreate(&network, storage.Network{UUID: networkUUID.String()}, storage.Network{
-			HostID:     hostID,
-			Name:       net.Source.Bridge,
-			BridgeName: net.Source.Bridge,
-			Mode:       "bridged",
-			UUID:       networkUUID.String(),
-		})
+		port, err := s.claimPort(tx, vmID, hostID, vmName, net)
+		if err != nil {
+			return err
+		}
+		if port == nil {
+			conflictedMACs = append(conflictedMACs, strings.ToLower(net.Mac.Address))
+			continue
+		}
+		liveMACs = append(liveMACs, port.MACAddress)
 
-		var port storage.Port
-		// Use Assign to update fields on existing records or create a new one.
-		tx.Where(storage.Port{MACAddress: net.Mac.Address}).
-			Assign(storage.Port{
-				VMID:       vmID,
-				MACAddress: net.Mac.Address,
-				DeviceName: net.Target.Dev,
-				ModelName:  net.Model.Type,
-			}).
-			FirstOrCreate(&port)
+		var previous *storage.PortBinding
+		if b, ok := previousBindings[port.ID]; ok {
+			previous = &b
+		}
+		network, vlanID := resolveNICNetwork(tx, hostID, net, previous)
 
 		if network.ID != 0 && port.ID != 0 {
 			binding := storage.PortBinding{
 				PortID:    port.ID,
 				NetworkID: network.ID,
+				VLANID:    vlanID,
 			}
 			tx.FirstOrCreate(&binding, storage.PortBinding{PortID: port.ID, NetworkID: network.ID})
 		}
 	}
 
-	// Sync Graphics
-	var gfxDevice storage.GraphicsDevice
+	// Drop ports of NICs the VM no longer has, so their addresses are free
+	// for other VMs, and conflicts that no longer apply.
+	stalePorts := tx.Where("vm_id = ?", vmID)
+	if len(liveMACs) > 0 {
+		stalePorts = stalePorts.Where("mac_address NOT IN ?", liveMACs)
+	}
+	if err := stalePorts.Delete(&storage.Port{}).Error; err != nil {
+		return err
+	}
+	staleConflicts := tx.Where("vm_id = ?", vmID)
+	if len(conflictedMACs) > 0 {
+		staleConflicts = staleConflicts.Where("mac_address NOT IN ?", conflictedMACs)
+	}
+	if err := staleConflicts.Delete(&storage.MACConflict{}).Error; err != nil {
+		return err
+	}
+
+	// Sync Graphics: the VM's own device, replacing one of another protocol
+	var gfxType, gfxModel string
 	if graphics.VNC {
-		tx.FirstOrCreate(&gfxDevice, storage.GraphicsDevice{Type: "vnc"}, storage.GraphicsDevice{Type: "vnc", ModelName: "vnc"})
+		gfxType, gfxModel = "vnc", "vnc"
 	} else if graphics.SPICE {
-		tx.FirstOrCreate(&gfxDevice, storage.GraphicsDevice{Type: "spice"}, storage.GraphicsDevice{Type: "spice", ModelName: "qxl"})
+		gfxType, gfxModel = "spice", "qxl"
+	}
+	staleDevices := tx.Unscoped().Where("vm_id = ?", vmID)
+	if gfxType != "" {
+		staleDevices = staleDevices.Where("type <> ?", gfxType)
+	}
+	if err := staleDevices.Delete(&storage.GraphicsDevice{}).Error; err != nil {
+		return err
+	}
+	var gfxDevice storage.GraphicsDevice
+	if gfxType != "" {
+		err := tx.Where(storage.GraphicsDevice{VMID: vmID, Type: gfxType}).
+			Attrs(storage.GraphicsDevice{ModelName: gfxModel}).FirstOrCreate(&gfxDevice).Error
+		if err != nil {
+			return err
+		}
 	}
 
 	if gfxDevice.ID != 0 {
@@ -518,26 +1285,43 @@ func mapLibvirtStateToVMState(state golibvirt.DomainState) storage.VMState {
 	}
 }
 
-// syncAndListVMs is the core function to get VMs from libvirt and sync with the local DB.
-// It returns true if any data was changed in the database.
+// syncAndListVMs syncs every VM of a host. The VMs are read from libvirt
+// first and then written in one batched transaction, rather than one
+// transaction per VM competing for SQLite's write lock.
 func (s *HostService) syncAndListVMs(hostID string) (bool, error) {
-	liveVMs, err := s.connector.ListAllDomains(hostID)
+	ctx, done, err := s.syncs.start(hostID)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	liveVMs, err := s.connector.ListAllDomainsContext(ctx, hostID)
 	if err != nil {
 		return false, fmt.Errorf("service failed to list vms for host %s: %w", hostID, err)
 	}
 
-	var overallChanged bool
+	var batch storage.WriteBatch
+	batch.Require(requireHost(hostID))
+	var names []string
+	results := make([]vmSyncResult, len(liveVMs))
 
 	liveVMUUIDs := make(map[string]struct{})
-	for _, vmInfo := range liveVMs {
+	for i := range liveVMs {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		vmInfo := &liveVMs[i]
 		liveVMUUIDs[vmInfo.UUID] = struct{}{}
-		changed, err := s.syncSingleVM(hostID, vmInfo.Name)
+		hardwareInfo, err := s.connector.GetDomainHardware(hostID, vmInfo.Name)
 		if err != nil {
-			log.Printf("Error syncing VM %s: %v", vmInfo.Name, err)
-		}
-		if changed {
-			overallChanged = true
+			log.Printf("Warning: could not fetch hardware for VM %s: %v", vmInfo.Name, err)
 		}
+		names = append(names, vmInfo.Name)
+		batch.Add(func(tx *gorm.DB) error {
+			var err error
+			results[i], err = s.applyVMSync(tx, hostID, vmInfo, hardwareInfo)
+			return err
+		})
 	}
 
 	var dbVMs []storage.VirtualMachine
@@ -545,81 +1329,165 @@ func (s *HostService) syncAndListVMs(hostID string) (bool, error) {
 		return false, fmt.Errorf("could not get DB records for pruning check: %w", err)
 	}
 
+	var pruned []string
 	for _, dbVM := range dbVMs {
 		if _, exists := liveVMUUIDs[dbVM.DomainUUID]; !exists {
+			dbVM := dbVM
 			log.Printf("Pruning VM %s (UUID: %s) from database as it's no longer in libvirt.", dbVM.Name, dbVM.UUID)
-			if err := s.db.Delete(&dbVM).Error; err != nil {
-				log.Printf("Warning: failed to prune old VM %s: %v", dbVM.Name, err)
-			} else {
-				overallChanged = true
-			}
+			pruned = append(pruned, dbVM.Name)
+			batch.Add(func(tx *gorm.DB) error {
+				return tx.Unscoped().Delete(&dbVM).Error
+			})
+		}
+	}
+
+	opErrs, err := batch.Commit(s.db)
+	if err != nil {
+		return false, fmt.Errorf("failed to write sync results for host %s: %w", hostID, err)
+	}
+
+	var overallChanged bool
+	for i, name := range names {
+		if opErrs[i] != nil {
+			log.Printf("Error syncing VM %s: %v", name, opErrs[i])
+			continue
+		}
+		if results[i].changed {
+			overallChanged = true
+		}
+		if results[i].stateChanged {
+			s.broadcastVMStateChanged(hostID, results[i].vmID, results[i].previousState)
+		}
+	}
+	for i, name := range pruned {
+		if err := opErrs[len(names)+i]; err != nil {
+			log.Printf("Warning: failed to prune old VM %s: %v", name, err)
+			continue
 		}
+		overallChanged = true
 	}
 
 	return overallChanged, nil
 }
 
+// GetDatabaseStats reports database activity and write contention.
+func (s *HostService) GetDatabaseStats() storage.DBStats {
+	return storage.GetDBStats(s.db)
+}
+
+// GetConnectionStats reports how busy each host connection is.
+func (s *HostService) GetConnectionStats() []libvirt.ConnectionStats {
+	return s.connector.ConnectionStats()
+}
+
 func (s *HostService) GetVMStats(hostID, vmName string) (*libvirt.VMStats, error) {
 	// First, check if there's an active subscription.
 	stats := s.monitor.GetLastKnownStats(hostID, vmName)
 	if stats != nil {
 		return stats, nil
 	}
+	if stats := s.monitor.hostStats(hostID, vmName); stats != nil {
+		return stats, nil
+	}
 
 	// If no active subscription, perform a one-time fetch.
 	return s.connector.GetDomainStats(hostID, vmName)
 }
 
-// --- VM Actions ---
-
-func (s *HostService) StartVM(hostID, vmName string) error {
-	if err := s.connector.StartDomain(hostID, vmName); err != nil {
-		return err
+// GetVMProcessUsage reports the host resources used by a VM's QEMU process.
+// When the process start time is known it also corrects the VM's recorded
+// start time, which is otherwise only the moment it was first seen running.
+func (s *HostService) GetVMProcessUsage(hostID, vmName string) (*libvirt.ProcessUsage, error) {
+	usage, err := s.connector.GetDomainProcessUsage(hostID, vmName)
+	if err != nil {
+		return nil, err
 	}
-	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
-		s.broadcastVMsChanged(hostID)
+	if usage.StartedAt != nil {
+		err := s.db.Model(&storage.VirtualMachine{}).
+			Where("host_id = ? AND name = ? AND (started_at IS NULL OR started_at > ?)", hostID, vmName, *usage.StartedAt).
+			Update("started_at", *usage.StartedAt).Error
+		if err != nil {
+			log.Printf("Warning: failed to update start time of VM %s: %v", vmName, err)
+		}
 	}
-	return nil
+	return usage, nil
 }
 
-func (s *HostService) ShutdownVM(hostID, vmName string) error {
-	if err := s.connector.ShutdownDomain(hostID, vmName); err != nil {
-		return err
-	}
-	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
-		s.broadcastVMsChanged(hostID)
-	}
-	return nil
+// GetVMScreenshot captures the current display of a VM as a PNG image.
+func (s *HostService) GetVMScreenshot(hostID, vmName string) ([]byte, error) {
+	return s.connector.GetDomainScreenshot(hostID, vmName)
 }
 
-func (s *HostService) RebootVM(hostID, vmName string) error {
-	if err := s.connector.RebootDomain(hostID, vmName); err != nil {
-		return err
-	}
-	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
-		s.broadcastVMsChanged(hostID)
-	}
-	return nil
+// --- VM Actions ---
+
+// GetDiskBackingChain inspects the backing file chain of a VM disk.
+func (s *HostService) GetDiskBackingChain(hostID, vmName, target string) (*libvirt.DiskChain, error) {
+	return s.connector.GetDiskBackingChain(hostID, vmName, target)
 }
 
-func (s *HostService) ForceOffVM(hostID, vmName string) error {
-	if err := s.connector.DestroyDomain(hostID, vmName); err != nil {
+// powerAction runs a power action on a VM and syncs its new state. The
+// action and the sync show in the trace of ctx.
+func (s *HostService) powerAction(ctx context.Context, name, hostID, vmName string, action func(context.Context) error) (err error) {
+	ctx, span := tracing.Start(ctx, "HostService."+name, tracing.Host(hostID), tracing.VM(vmName))
+	defer func() { tracing.End(span, err) }()
+
+	if err := action(ctx); err != nil {
 		return err
 	}
-	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+	if changed, err := s.syncSingleVMContext(ctx, hostID, vmName); err == nil && changed {
 		s.broadcastVMsChanged(hostID)
 	}
 	return nil
 }
 
-func (s *HostService) ForceResetVM(hostID, vmName string) error {
-	if err := s.connector.ResetDomain(hostID, vmName); err != nil {
-		return err
+func (s *HostService) StartVM(ctx context.Context, hostID, vmName string) error {
+	if _, compacting := s.diskCompactions.Load(diskCompactionKey(hostID, vmName)); compacting {
+		return fmt.Errorf("cannot start %s: %w", vmName, ErrDiskCompactionInProgress)
 	}
-	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
-		s.broadcastVMsChanged(hostID)
+	// A cold migration copies and then deletes the images of a shut-off VM,
+	// so the VM must stay off until its job completes or is discarded.
+	if vm, err := s.findVM(hostID, vmName); err == nil {
+		job, err := s.unfinishedMigrationJob(vm.UUID)
+		if err != nil {
+			return err
+		}
+		if job != nil {
+			return fmt.Errorf("cannot start %s: %w: job %d has not completed; resume or discard it", vmName, ErrMigrationInProgress, job.ID)
+		}
 	}
-	return nil
+	return s.powerAction(ctx, "StartVM", hostID, vmName, func(ctx context.Context) error {
+		if err := s.connector.StartDomain(ctx, hostID, vmName); err != nil {
+			return err
+		}
+		if err := s.applyBridgeVLANs(ctx, hostID, vmName); err != nil {
+			log.Printf("Warning: failed to apply bridge VLANs for VM %s on host %s: %v", vmName, hostID, err)
+		}
+		return nil
+	})
+}
+
+func (s *HostService) ShutdownVM(ctx context.Context, hostID, vmName string) error {
+	return s.powerAction(ctx, "ShutdownVM", hostID, vmName, func(ctx context.Context) error {
+		return s.connector.ShutdownDomain(ctx, hostID, vmName)
+	})
+}
+
+func (s *HostService) RebootVM(ctx context.Context, hostID, vmName string) error {
+	return s.powerAction(ctx, "RebootVM", hostID, vmName, func(ctx context.Context) error {
+		return s.connector.RebootDomain(ctx, hostID, vmName)
+	})
+}
+
+func (s *HostService) ForceOffVM(ctx context.Context, hostID, vmName string) error {
+	return s.powerAction(ctx, "ForceOffVM", hostID, vmName, func(ctx context.Context) error {
+		return s.connector.DestroyDomain(ctx, hostID, vmName)
+	})
+}
+
+func (s *HostService) ForceResetVM(ctx context.Context, hostID, vmName string) error {
+	return s.powerAction(ctx, "ForceResetVM", hostID, vmName, func(ctx context.Context) error {
+		return s.connector.ResetDomain(ctx, hostID, vmName)
+	})
 }
 
 // --- WebSocket Message Handling ---
@@ -631,7 +1499,13 @@ func (s *HostService) HandleSubscribe(client *ws.Client, payload ws.MessagePaylo
 		log.Println("Invalid payload for vm-stats subscription")
 		return
 	}
-	s.monitor.Subscribe(client, hostID, vmName)
+	hostID = s.ResolveHostID(hostID) // Older clients send the host's name
+	// Clients may ask for their own cadence; it is clamped to the allowed range.
+	var requested time.Duration
+	if seconds, ok := payload["intervalSeconds"].(float64); ok && seconds > 0 {
+		requested = clampInterval(time.Duration(seconds * float64(time.Second)))
+	}
+	s.monitor.Subscribe(client, hostID, vmName, requested)
 }
 
 func (s *HostService) HandleUnsubscribe(client *ws.Client, payload ws.MessagePayload) {
@@ -641,7 +1515,7 @@ func (s *HostService) HandleUnsubscribe(client *ws.Client, payload ws.MessagePay
 		log.Println("Invalid payload for vm-stats unsubscription")
 		return
 	}
-	s.monitor.Unsubscribe(client, hostID, vmName)
+	s.monitor.Unsubscribe(client, s.ResolveHostID(hostID), vmName)
 }
 
 func (s *HostService) HandleClientDisconnect(client *ws.Client) {
@@ -650,7 +1524,9 @@ func (s *HostService) HandleClientDisconnect(client *ws.Client) {
 
 // --- Monitoring Goroutine Logic ---
 
-func (m *MonitoringManager) Subscribe(client *ws.Client, hostID, vmName string) {
+func (m *MonitoringManager) Subscribe(client *ws.Client, hostID, vmName string, interval time.Duration) {
+	configured := m.service.configuredStatsInterval(hostID, vmName)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -659,13 +1535,68 @@ func (m *MonitoringManager) Subscribe(client *ws.Client, hostID, vmName string)
 	if !exists {
 		log.Printf("Starting monitoring for %s", key)
 		sub = &VmSubscription{
-			clients: make(map[*ws.Client]bool),
-			stop:    make(chan struct{}),
+			hostID:     hostID,
+			vmName:     vmName,
+			clients:    make(map[*ws.Client]time.Duration),
+			configured: configured,
+			stop:       make(chan struct{}),
 		}
 		m.subscriptions[key] = sub
+		sub.clients[client] = interval
 		go m.pollVmStats(hostID, vmName, sub)
+		return
+	}
+	sub.clients[client] = interval
+}
+
+// pollInterval returns how often a subscription is polled: the shortest
+// interval any of its clients wants, where clients that did not ask for one
+// get the configured interval.
+func (m *MonitoringManager) pollInterval(sub *VmSubscription) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var interval time.Duration
+	for _, requested := range sub.clients {
+		if requested == 0 {
+			requested = sub.configured
+		}
+		if interval == 0 || requested < interval {
+			interval = requested
+		}
+	}
+	if interval == 0 {
+		interval = sub.configured
+	}
+	return clampInterval(interval)
+}
+
+// refreshConfiguredIntervals reloads the configured interval of every active
+// subscription after the settings changed.
+func (m *MonitoringManager) refreshConfiguredIntervals() {
+	m.mu.Lock()
+	subs := make([]*VmSubscription, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		subs = append(subs, sub)
+	}
+	hostSubs := make([]*HostStatsSubscription, 0, len(m.hostSubscriptions))
+	for _, sub := range m.hostSubscriptions {
+		hostSubs = append(hostSubs, sub)
+	}
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		configured := m.service.configuredStatsInterval(sub.hostID, sub.vmName)
+		m.mu.Lock()
+		sub.configured = configured
+		m.mu.Unlock()
+	}
+	for _, sub := range hostSubs {
+		configured := m.service.configuredHostStatsInterval(sub.hostID)
+		m.mu.Lock()
+		sub.configured = configured
+		m.mu.Unlock()
 	}
-	sub.clients[client] = true
 }
 
 func (m *MonitoringManager) Unsubscribe(client *ws.Client, hostID, vmName string) {
@@ -697,6 +1628,16 @@ func (m *MonitoringManager) UnsubscribeClient(client *ws.Client) {
 			}
 		}
 	}
+	for hostID, sub := range m.hostSubscriptions {
+		if _, ok := sub.clients[client]; ok {
+			delete(sub.clients, client)
+			if len(sub.clients) == 0 {
+				log.Printf("Stopping VM stats monitoring for host %s due to client disconnect", hostID)
+				close(sub.stop)
+				delete(m.hostSubscriptions, hostID)
+			}
+		}
+	}
 }
 
 func (m *MonitoringManager) GetLastKnownStats(hostID, vmName string) *libvirt.VMStats {
@@ -713,9 +1654,12 @@ func (m *MonitoringManager) GetLastKnownStats(hostID, vmName string) *libvirt.VM
 }
 
 func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscription) {
-	ticker := time.NewTicker(2 * time.Second)
+	interval := m.pollInterval(sub)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var filesystems []storage.GuestFilesystem
+	var filesystemsReadAt time.Time
 	for {
 		select {
 		case <-ticker.C:
@@ -723,6 +1667,15 @@ func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscripti
 			if err != nil {
 				stats = &libvirt.VMStats{State: golibvirt.DomainShutoff}
 			}
+			// Asking the guest agent is slower than the other stats, so the
+			// filesystem usage is only refreshed now and then.
+			if stats.State == golibvirt.DomainRunning && time.Since(filesystemsReadAt) >= guestFilesystemsInterval {
+				filesystemsReadAt = time.Now()
+				if read, err := m.service.connector.GetGuestFilesystems(hostID, vmName); err == nil {
+					filesystems = read
+				}
+			}
+			stats.GuestFilesystems = filesystems
 
 			// Update last known stats
 			sub.mu.Lock()
@@ -748,6 +1701,12 @@ func (m *MonitoringManager) pollVmStats(hostID, vmName string, sub *VmSubscripti
 				m.mu.Unlock()
 				return
 			}
+
+			// Follow changes to the settings and to the subscribed clients.
+			if next := m.pollInterval(sub); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		case <-sub.stop:
 			return
 		}
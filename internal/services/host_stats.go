@@ -0,0 +1,157 @@
+package services
+
+import (
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+// HostStatsSubscription holds the clients subscribed to the stats of all VMs
+// of a host. One bulk libvirt call per interval serves them all, instead of
+// one poller per VM.
+type HostStatsSubscription struct {
+	hostID     string
+	clients    map[*ws.Client]time.Duration // Interval requested by each client, 0 for the configured one
+	configured time.Duration                // Interval configured for the host; guarded by the manager's lock
+	stop       chan struct{}
+	lastStats  map[string]*libvirt.VMStats // Guarded by the manager's lock
+}
+
+func (s *HostService) HandleSubscribeHostStats(client *ws.Client, payload ws.MessagePayload) {
+	hostID, ok := payload["hostId"].(string)
+	if !ok {
+		log.Println("Invalid payload for host-vms-stats subscription")
+		return
+	}
+	hostID = s.ResolveHostID(hostID)
+	var requested time.Duration
+	if seconds, ok := payload["intervalSeconds"].(float64); ok && seconds > 0 {
+		requested = clampInterval(time.Duration(seconds * float64(time.Second)))
+	}
+	s.monitor.SubscribeHost(client, hostID, requested)
+}
+
+func (s *HostService) HandleUnsubscribeHostStats(client *ws.Client, payload ws.MessagePayload) {
+	hostID, ok := payload["hostId"].(string)
+	if !ok {
+		log.Println("Invalid payload for host-vms-stats unsubscription")
+		return
+	}
+	s.monitor.UnsubscribeHost(client, s.ResolveHostID(hostID))
+}
+
+// SubscribeHost adds a client to the stats subscription of a host, starting
+// the poller if it is the first.
+func (m *MonitoringManager) SubscribeHost(client *ws.Client, hostID string, interval time.Duration) {
+	configured := m.service.configuredHostStatsInterval(hostID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub, exists := m.hostSubscriptions[hostID]
+	if !exists {
+		log.Printf("Starting VM stats monitoring for host %s", hostID)
+		sub = &HostStatsSubscription{
+			hostID:     hostID,
+			clients:    make(map[*ws.Client]time.Duration),
+			configured: configured,
+			stop:       make(chan struct{}),
+		}
+		m.hostSubscriptions[hostID] = sub
+		sub.clients[client] = interval
+		go m.pollHostStats(sub)
+		return
+	}
+	sub.clients[client] = interval
+}
+
+func (m *MonitoringManager) UnsubscribeHost(client *ws.Client, hostID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, exists := m.hostSubscriptions[hostID]; exists {
+		delete(sub.clients, client)
+		if len(sub.clients) == 0 {
+			log.Printf("Stopping VM stats monitoring for host %s", hostID)
+			close(sub.stop)
+			delete(m.hostSubscriptions, hostID)
+		}
+	}
+}
+
+// hostPollInterval returns how often a host subscription is polled, as
+// pollInterval does for a single VM.
+func (m *MonitoringManager) hostPollInterval(sub *HostStatsSubscription) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var interval time.Duration
+	for _, requested := range sub.clients {
+		if requested == 0 {
+			requested = sub.configured
+		}
+		if interval == 0 || requested < interval {
+			interval = requested
+		}
+	}
+	if interval == 0 {
+		interval = sub.configured
+	}
+	return clampInterval(interval)
+}
+
+// hostStats returns the stats of a VM from its host's subscription, or nil.
+func (m *MonitoringManager) hostStats(hostID, vmName string) *libvirt.VMStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if sub, exists := m.hostSubscriptions[hostID]; exists {
+		return sub.lastStats[vmName]
+	}
+	return nil
+}
+
+// pollHostStats sends one message per interval with the stats of every VM of
+// the host. Unlike VM subscriptions it keeps running while VMs are stopped,
+// until the last client unsubscribes.
+func (m *MonitoringManager) pollHostStats(sub *HostStatsSubscription) {
+	interval := m.hostPollInterval(sub)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			stats, err := m.service.connector.GetAllDomainStats(sub.hostID)
+			if err != nil {
+				log.Printf("Warning: could not get VM stats for host %s: %v", sub.hostID, err)
+			} else {
+				m.mu.Lock()
+				sub.lastStats = stats
+				m.mu.Unlock()
+
+				payload := ws.MessagePayload{
+					"hostId": sub.hostID,
+					"stats":  stats,
+				}
+				// KSM counters ride along; hosts without KSM just omit them.
+				if ksm, err := m.service.connector.GetKSMStats(sub.hostID); err == nil {
+					payload["ksm"] = ksm
+				}
+				m.service.hub.BroadcastMessage(ws.Message{
+					Type:    "host-vms-stats-updated",
+					Payload: payload,
+				})
+			}
+
+			if next := m.hostPollInterval(sub); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		case <-sub.stop:
+			return
+		}
+	}
+}
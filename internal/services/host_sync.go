@@ -0,0 +1,94 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ErrHostGone is returned by a VM sync whose host was removed or
+// disconnected while it ran.
+var ErrHostGone = errors.New("host was removed or disconnected")
+
+// hostSyncs ties the VM syncs of each host to a context. Disconnecting a
+// host cancels it and waits for the syncs in flight, so none of them writes
+// the host's VMs back after they were deleted.
+type hostSyncs struct {
+	mu      sync.Mutex
+	hosts   map[string]*hostSync
+	removed map[string]bool
+}
+
+type hostSync struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+func newHostSyncs() *hostSyncs {
+	return &hostSyncs{hosts: make(map[string]*hostSync), removed: make(map[string]bool)}
+}
+
+// start registers a sync of a host. The returned context is cancelled when
+// the host is disconnected, and done must be called when the sync ends.
+func (h *hostSyncs) start(hostID string) (context.Context, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.removed[hostID] {
+		return nil, nil, fmt.Errorf("%w: %s", ErrHostGone, hostID)
+	}
+	hs, ok := h.hosts[hostID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		hs = &hostSync{ctx: ctx, cancel: cancel}
+		h.hosts[hostID] = hs
+	}
+	hs.running.Add(1)
+	return hs.ctx, hs.running.Done, nil
+}
+
+// stop cancels the syncs of a host. The returned function waits for them to
+// finish. Syncs started afterwards get a fresh context, unless the host was
+// removed, in which case they are refused.
+func (h *hostSyncs) stop(hostID string, removed bool) (wait func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if removed {
+		h.removed[hostID] = true
+	}
+	hs, ok := h.hosts[hostID]
+	if !ok {
+		return func() {}
+	}
+	delete(h.hosts, hostID)
+	hs.cancel()
+	return hs.running.Wait
+}
+
+// disconnectHost drops the libvirt connection of a host after cancelling its
+// VM syncs, and waits for them to finish. removed also refuses later syncs.
+func (s *HostService) disconnectHost(hostID string, removed bool) error {
+	wait := s.syncs.stop(hostID, removed)
+	err := s.connector.RemoveHost(hostID)
+	wait()
+	return err
+}
+
+// requireHost fails with ErrHostGone when a host no longer exists. Syncs run
+// it inside their transactions so they never write VMs of a removed host.
+func requireHost(hostID string) storage.WriteOp {
+	return func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&storage.Host{}).Where("id = ?", hostID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: %s", ErrHostGone, hostID)
+		}
+		return nil
+	}
+}
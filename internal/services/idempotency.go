@@ -0,0 +1,77 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// idempotencyKeyLifetime is how long the response to a request with an
+// Idempotency-Key is kept for retries.
+const idempotencyKeyLifetime = 24 * time.Hour
+
+// MaxIdempotencyKeyLength is the longest Idempotency-Key accepted.
+const MaxIdempotencyKeyLength = 255
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a
+	// different request.
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+	// ErrIdempotencyKeyInProgress is returned when a key is sent again while
+	// the first request with it is still being handled.
+	ErrIdempotencyKeyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// BeginIdempotentRequest claims an idempotency key of a user for a request;
+// userID is 0 for requests without a session. If the key was already used for the same request and that request has finished, the
+// returned record holds its response (StatusCode is set) to be replayed.
+// Otherwise the key is new and the caller must handle the request and then
+// call CompleteIdempotentRequest, or ReleaseIdempotencyKey if it cannot.
+func (s *HostService) BeginIdempotentRequest(userID uint, key, requestHash string) (*storage.IdempotencyKey, error) {
+	now := time.Now()
+	var record storage.IdempotencyKey
+	claimed := false
+	err := storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", now).Delete(&storage.IdempotencyKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND key = ?", userID, key).Limit(1).Find(&record).Error; err != nil {
+			return err
+		}
+		if record.ID != 0 {
+			return nil
+		}
+		record = storage.IdempotencyKey{UserID: userID, Key: key, RequestHash: requestHash, ExpiresAt: now.Add(idempotencyKeyLifetime)}
+		claimed = true
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if record.RequestHash != requestHash {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if !claimed && record.StatusCode == 0 {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+	return &record, nil
+}
+
+// CompleteIdempotentRequest stores the response to a request so that retries
+// with its key get it again.
+func (s *HostService) CompleteIdempotentRequest(id uint, statusCode int, contentType string, body []byte) error {
+	return s.db.Model(&storage.IdempotencyKey{ID: id}).Updates(map[string]interface{}{
+		"status_code":  statusCode,
+		"content_type": contentType,
+		"body":         body,
+	}).Error
+}
+
+// ReleaseIdempotencyKey forgets a key whose request produced no response
+// worth keeping, so it can be used again.
+func (s *HostService) ReleaseIdempotencyKey(id uint) error {
+	return s.db.Delete(&storage.IdempotencyKey{}, id).Error
+}
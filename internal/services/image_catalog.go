@@ -0,0 +1,348 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+var (
+	// ErrCatalogImageExists is returned when a catalog image name is already taken.
+	ErrCatalogImageExists = errors.New("catalog image already exists")
+	// ErrChecksumNotListed is returned when an image's checksum file does not list the image.
+	ErrChecksumNotListed = errors.New("the checksum file does not list the image")
+)
+
+const (
+	// maxChecksumFileSize caps how much of a checksum file is read.
+	maxChecksumFileSize = 1 << 20
+	// imageDownloadReportInterval is how often the progress of an image
+	// download is reported on its task.
+	imageDownloadReportInterval = time.Second
+)
+
+var (
+	catalogImageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	checksumPattern         = regexp.MustCompile(`^([0-9a-f]{64}|[0-9a-f]{128})$`)
+	// bsdChecksumLine matches lines like 'SHA256 (image.qcow2) = <hex>'.
+	bsdChecksumLine = regexp.MustCompile(`^SHA(256|512) \((.+)\) = ([0-9A-Fa-f]+)$`)
+)
+
+// checksumClient fetches checksum files; images are streamed without a
+// deadline, as they may take a long time.
+var checksumClient = &http.Client{Timeout: 30 * time.Second}
+
+// defaultCatalogImages fill an empty catalog at startup.
+var defaultCatalogImages = []storage.CatalogImage{
+	{
+		Name:        "ubuntu-24.04",
+		Description: "Ubuntu 24.04 LTS (Noble Numbat) server cloud image",
+		URL:         "https://cloud-images.ubuntu.com/noble/current/noble-server-cloudimg-amd64.img",
+		ChecksumURL: "https://cloud-images.ubuntu.com/noble/current/SHA256SUMS",
+	},
+	{
+		Name:        "debian-12",
+		Description: "Debian 12 (bookworm) generic cloud image",
+		URL:         "https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-generic-amd64.qcow2",
+		ChecksumURL: "https://cloud.debian.org/images/cloud/bookworm/latest/SHA512SUMS",
+	},
+	{
+		Name:        "fedora-41",
+		Description: "Fedora 41 Cloud Base generic image",
+		URL:         "https://download.fedoraproject.org/pub/fedora/linux/releases/41/Cloud/x86_64/images/Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2",
+		ChecksumURL: "https://download.fedoraproject.org/pub/fedora/linux/releases/41/Cloud/x86_64/images/Fedora-Cloud-41-1.4-x86_64-CHECKSUM",
+	},
+}
+
+// CatalogImageRequest defines or redefines a catalog image.
+type CatalogImageRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	URL         string `json:"url"`
+	Checksum    string `json:"checksum"`     // SHA256 or SHA512 in hex
+	ChecksumURL string `json:"checksum_url"` // Used when Checksum is empty
+}
+
+// ImageDownloadRequest downloads a catalog image into a new volume.
+type ImageDownloadRequest struct {
+	Image  string `json:"image"`  // Catalog image name
+	Volume string `json:"volume"` // Name of the new volume; the file name of the image URL if empty
+}
+
+// EnsureDefaultImageCatalog puts common cloud images into the catalog while
+// it is empty.
+func (s *HostService) EnsureDefaultImageCatalog() {
+	var count int64
+	if err := s.db.Model(&storage.CatalogImage{}).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	for _, image := range defaultCatalogImages {
+		if err := s.db.Create(&image).Error; err != nil {
+			log.Printf("Warning: failed to add %s to the image catalog: %v", image.Name, err)
+		}
+	}
+}
+
+func validImageURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func normalizeCatalogImage(req CatalogImageRequest) (CatalogImageRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.URL = strings.TrimSpace(req.URL)
+	req.Checksum = strings.ToLower(strings.TrimSpace(req.Checksum))
+	req.ChecksumURL = strings.TrimSpace(req.ChecksumURL)
+	var v validator
+	if !catalogImageNamePattern.MatchString(req.Name) {
+		v.add("name", "must start with a letter or digit and contain only letters, digits, '_', '.' and '-' (at most 64)")
+	}
+	if !validImageURL(req.URL) {
+		v.add("url", "must be an http or https URL")
+	} else if u, _ := url.Parse(req.URL); path.Base(u.Path) == "/" || path.Base(u.Path) == "." {
+		v.add("url", "must name a file")
+	}
+	switch {
+	case req.Checksum != "":
+		if !checksumPattern.MatchString(req.Checksum) {
+			v.add("checksum", "must be a SHA256 or SHA512 in hex")
+		}
+	case req.ChecksumURL == "":
+		v.add("checksum", "a checksum or checksum_url is required")
+	case !validImageURL(req.ChecksumURL):
+		v.add("checksum_url", "must be an http or https URL")
+	}
+	return req, v.err()
+}
+
+// ListCatalogImages returns the image catalog by name.
+func (s *HostService) ListCatalogImages() ([]storage.CatalogImage, error) {
+	images := []storage.CatalogImage{}
+	if err := s.db.Order("name").Find(&images).Error; err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (s *HostService) getCatalogImage(name string) (*storage.CatalogImage, error) {
+	var image storage.CatalogImage
+	if err := s.db.Where("name = ?", name).First(&image).Error; err != nil {
+		return nil, fmt.Errorf("could not find catalog image %s: %w", name, err)
+	}
+	return &image, nil
+}
+
+// CreateCatalogImage adds an image to the catalog.
+func (s *HostService) CreateCatalogImage(req CatalogImageRequest) (*storage.CatalogImage, error) {
+	req, err := normalizeCatalogImage(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.CatalogImage{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrCatalogImageExists, req.Name)
+	}
+
+	image := storage.CatalogImage{
+		Name:        req.Name,
+		Description: req.Description,
+		URL:         req.URL,
+		Checksum:    req.Checksum,
+		ChecksumURL: req.ChecksumURL,
+	}
+	if err := s.db.Create(&image).Error; err != nil {
+		return nil, fmt.Errorf("failed to save catalog image: %w", err)
+	}
+	s.recordAudit("image_catalog.create", "catalog_image", image.Name, "url="+image.URL)
+	return &image, nil
+}
+
+// UpdateCatalogImage redefines a catalog image, e.g. to point it at a newer
+// release. The image cannot be renamed.
+func (s *HostService) UpdateCatalogImage(name string, req CatalogImageRequest) (*storage.CatalogImage, error) {
+	image, err := s.getCatalogImage(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = image.Name
+	if req, err = normalizeCatalogImage(req); err != nil {
+		return nil, err
+	}
+
+	image.Description = req.Description
+	image.URL = req.URL
+	image.Checksum = req.Checksum
+	image.ChecksumURL = req.ChecksumURL
+	if err := s.db.Save(image).Error; err != nil {
+		return nil, fmt.Errorf("failed to save catalog image: %w", err)
+	}
+	s.recordAudit("image_catalog.update", "catalog_image", image.Name, "url="+image.URL)
+	return image, nil
+}
+
+// DeleteCatalogImage removes an image from the catalog. Volumes downloaded
+// from it are kept.
+func (s *HostService) DeleteCatalogImage(name string) error {
+	image, err := s.getCatalogImage(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(image).Error; err != nil {
+		return fmt.Errorf("failed to delete catalog image: %w", err)
+	}
+	s.recordAudit("image_catalog.delete", "catalog_image", name, "")
+	return nil
+}
+
+// DownloadCatalogImage downloads a catalog image into a new volume of a
+// host's pool as a task. The image is streamed from its publisher through
+// Virtumancer to the host, and verified against its checksum on the way.
+// The volume can then be attached to VMs as a disk.
+func (s *HostService) DownloadCatalogImage(hostID, poolName string, req ImageDownloadRequest) (*storage.Task, error) {
+	image, err := s.getCatalogImage(req.Image)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.getStoragePool(hostID, poolName); err != nil {
+		return nil, err
+	}
+	volName := req.Volume
+	if volName == "" {
+		u, _ := url.Parse(image.URL)
+		volName = path.Base(u.Path)
+	}
+	if strings.ContainsAny(volName, "/\x00") || volName == "." || volName == ".." {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "volume", Message: "must be a file name"}}}
+	}
+
+	task, err := s.tasks.Start("image.download", fmt.Sprintf("Downloading %s to %s/%s on %s", image.Name, poolName, volName, hostID))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("image.download", "volume", fmt.Sprintf("%s/%s/%s", hostID, poolName, volName), "image="+image.Name+" url="+image.URL)
+
+	started := copyTask(task)
+	go func() {
+		err := s.runImageDownload(task, hostID, poolName, volName, image)
+		if err != nil {
+			log.Printf("Download of image %s to host %s failed: %v", image.Name, hostID, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runImageDownload(task *storage.Task, hostID, poolName, volName string, image *storage.CatalogImage) error {
+	expected := image.Checksum
+	if expected == "" {
+		s.tasks.Step(task, 1, "Fetching checksum from "+image.ChecksumURL)
+		var err error
+		if expected, err = fetchImageChecksum(image); err != nil {
+			return err
+		}
+	}
+
+	s.tasks.Step(task, 2, "Downloading "+image.URL)
+	resp, err := http.Get(image.URL)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", image.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", image.URL, resp.Status)
+	}
+	if resp.ContentLength <= 0 {
+		return fmt.Errorf("%s does not announce its size", image.URL)
+	}
+
+	size := uint64(resp.ContentLength)
+	progress := &imageDownloadProgress{s: s, task: task, total: size}
+	uploaded, err := s.storeImage(hostID, poolName, volName, size, io.TeeReader(resp.Body, progress), expected)
+	if err != nil {
+		return err
+	}
+	if uploaded.ChecksumStatus == ChecksumMismatch {
+		return fmt.Errorf("%w: %s does not match the checksum %s", ErrChecksumMismatch, image.URL, expected)
+	}
+	s.tasks.Step(task, 100, fmt.Sprintf("Downloaded %s to %s/%s, checksum verified", image.Name, poolName, volName))
+	return nil
+}
+
+// fetchImageChecksum looks up an image's checksum in its checksum file.
+func fetchImageChecksum(image *storage.CatalogImage) (string, error) {
+	resp, err := checksumClient.Get(image.ChecksumURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch %s: %w", image.ChecksumURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch %s: %s", image.ChecksumURL, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxChecksumFileSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", image.ChecksumURL, err)
+	}
+	u, _ := url.Parse(image.URL)
+	sum := findChecksum(data, path.Base(u.Path))
+	if sum == "" {
+		return "", fmt.Errorf("%w: %s in %s", ErrChecksumNotListed, path.Base(u.Path), image.ChecksumURL)
+	}
+	return sum, nil
+}
+
+// findChecksum returns the checksum a file lists for fileName, in lower
+// case. It reads both the GNU format of sha256sum ('<hex>  name', or
+// '<hex> *name' for binary mode) and the BSD one ('SHA256 (name) = <hex>').
+func findChecksum(data []byte, fileName string) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var sum, name string
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			name, sum = m[2], m[3]
+		} else if fields := strings.Fields(line); len(fields) == 2 {
+			sum, name = fields[0], strings.TrimPrefix(fields[1], "*")
+		}
+		sum = strings.ToLower(sum)
+		if name == fileName && checksumPattern.MatchString(sum) {
+			return sum
+		}
+	}
+	return ""
+}
+
+// imageDownloadProgress reports how much of an image has been downloaded
+// on its task, at most every imageDownloadReportInterval.
+type imageDownloadProgress struct {
+	s          *HostService
+	task       *storage.Task
+	total      uint64
+	done       uint64
+	reportedAt time.Time
+}
+
+func (p *imageDownloadProgress) Write(b []byte) (int, error) {
+	p.done += uint64(len(b))
+	if now := time.Now(); now.Sub(p.reportedAt) >= imageDownloadReportInterval || p.done == p.total {
+		p.reportedAt = now
+		p.s.tasks.Report(p.task, 2+int(97*p.done/p.total), map[string]interface{}{
+			"bytes_done":  p.done,
+			"bytes_total": p.total,
+		})
+	}
+	return len(b), nil
+}
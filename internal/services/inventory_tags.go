@@ -0,0 +1,85 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Inventory tags fingerprint the rows a list is built from, for ETags. A tag
+// changes whenever the list may have changed, and costs a few aggregate
+// queries instead of building the list. Row IDs only grow, so an insert
+// raises the highest ID and a delete lowers the count; an update raises the
+// sum of the generations or, in tables without them, the latest time of a
+// change.
+
+// HostInventoryTag returns the tag of the host list.
+func (s *HostService) HostInventoryTag() (string, error) {
+	return changeStamps(
+		// Host IDs are UUIDs, which do not grow, but hosts are few enough to
+		// list with their generations. Health is written without counting
+		// as a change, so it is stamped by when it last changed.
+		stampOf(s.db.Model(&storage.Host{}), "group_concat(id || ':' || generation || ':' || coalesce(health_changed_at, ''))"),
+		stampOf(s.db.Model(&storage.ProjectResource{}), "max(id)"),
+	)
+}
+
+// VMInventoryTag returns the tag of the VM list of a host, or of all hosts
+// when hostID is empty. VM generations count changes of the VMs and their
+// hardware; health, labels, custom fields and projects are stamped on their
+// own.
+func (s *HostService) VMInventoryTag(hostID string) (string, error) {
+	vms := func() *gorm.DB {
+		query := s.db.Model(&storage.VirtualMachine{})
+		if hostID != "" {
+			query = query.Where("host_id = ?", hostID)
+		}
+		return query
+	}
+	return changeStamps(
+		stampOf(vms(), "max(id)", "sum(generation)", "max(health_changed_at)"),
+		stampOf(s.db.Model(&storage.VMLabel{}).Where("vm_id IN (?)", vms().Select("id")), "max(id)", "max(updated_at)"),
+		stampOf(s.db.Model(&storage.VMCustomField{}).Where("vm_id IN (?)", vms().Select("id")), "max(id)", "max(updated_at)"),
+		stampOf(s.db.Model(&storage.ProjectResource{}), "max(id)"),
+	)
+}
+
+// VMHardwareTag returns the tag of a VM's hardware, which its generation
+// covers.
+func (s *HostService) VMHardwareTag(hostID, vmName string) (string, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", vm.ID, vm.Generation), nil
+}
+
+// changeStamp summarizes the rows a query selects by their count and the
+// given aggregates, chosen so that any insert, update or delete among them
+// changes the result.
+type changeStamp struct {
+	query      *gorm.DB
+	aggregates []string
+}
+
+func stampOf(query *gorm.DB, aggregates ...string) changeStamp {
+	return changeStamp{query: query, aggregates: aggregates}
+}
+
+func changeStamps(stamps ...changeStamp) (string, error) {
+	parts := make([]string, 0, len(stamps))
+	for _, stamp := range stamps {
+		columns := "count(*)"
+		for _, aggregate := range stamp.aggregates {
+			columns += " || '/' || coalesce(" + aggregate + ", '')"
+		}
+		var part string
+		if err := stamp.query.Select(columns).Scan(&part).Error; err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ";"), nil
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+)
+
+// KSMStatus is the kernel same-page merging state of a host. Run is read
+// over SSH, so it is nil for hosts connected any other way.
+type KSMStatus struct {
+	libvirt.KSMStats
+	Run     *uint `json:"run"`     // 0 stopped, 1 merging, 2 unmerging
+	Enabled *bool `json:"enabled"` // Run is 1
+}
+
+// KSMRequest turns KSM on or off and tunes its scanner. Fields left out
+// keep their value.
+type KSMRequest struct {
+	Enabled        *bool `json:"enabled"`
+	PagesToScan    *uint `json:"pages_to_scan"`
+	SleepMillisecs *uint `json:"sleep_millisecs"`
+}
+
+// GetKSM returns the KSM counters of a host and whether it is merging.
+func (s *HostService) GetKSM(hostID string) (*KSMStatus, error) {
+	stats, err := s.connector.GetKSMStats(hostID)
+	if err != nil {
+		return nil, err
+	}
+	status := &KSMStatus{KSMStats: *stats}
+	run, err := s.connector.GetKSMRun(hostID)
+	switch {
+	case err == nil:
+		enabled := run == 1
+		status.Run, status.Enabled = &run, &enabled
+	case !errors.Is(err, libvirt.ErrNoSSHChannel):
+		log.Printf("Warning: could not read KSM run mode of host %s: %v", hostID, err)
+	}
+	return status, nil
+}
+
+// SetKSM turns KSM on or off and tunes its scanner. Turning it off stops
+// merging but leaves merged pages shared.
+func (s *HostService) SetKSM(hostID string, req KSMRequest) (*KSMStatus, error) {
+	var v validator
+	if req.Enabled == nil && req.PagesToScan == nil && req.SleepMillisecs == nil {
+		v.add("enabled", "or pages_to_scan or sleep_millisecs is required")
+	}
+	if req.PagesToScan != nil && *req.PagesToScan == 0 {
+		v.add("pages_to_scan", "must be positive")
+	}
+	if req.SleepMillisecs != nil && *req.SleepMillisecs == 0 {
+		v.add("sleep_millisecs", "must be positive")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	var details []string
+	if req.PagesToScan != nil || req.SleepMillisecs != nil {
+		if err := s.connector.SetKSMTuning(hostID, libvirt.KSMTuning{
+			PagesToScan:    req.PagesToScan,
+			SleepMillisecs: req.SleepMillisecs,
+		}); err != nil {
+			return nil, err
+		}
+		if req.PagesToScan != nil {
+			details = append(details, fmt.Sprintf("pages_to_scan=%d", *req.PagesToScan))
+		}
+		if req.SleepMillisecs != nil {
+			details = append(details, fmt.Sprintf("sleep_millisecs=%d", *req.SleepMillisecs))
+		}
+	}
+	if req.Enabled != nil {
+		var run uint
+		if *req.Enabled {
+			run = 1
+		}
+		if err := s.connector.SetKSMRun(hostID, run); err != nil {
+			return nil, err
+		}
+		details = append(details, fmt.Sprintf("enabled=%t", *req.Enabled))
+	}
+	s.recordAudit("host.ksm.update", "host", hostID, strings.Join(details, " "))
+	return s.GetKSM(hostID)
+}
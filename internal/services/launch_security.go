@@ -0,0 +1,118 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+)
+
+// defaultSEVPolicy forbids debugging the guest and sharing its keys with
+// other guests, the usual policy for confidential workloads.
+const defaultSEVPolicy = 0x0003
+
+// LaunchSecurityRequest enables or disables SEV memory encryption on a VM.
+type LaunchSecurityRequest struct {
+	Enabled bool `json:"enabled"`
+	// Guest policy bits; 0 selects the default of 0x0003. ES sets the
+	// SEV-ES bit on top.
+	Policy          uint32 `json:"policy"`
+	ES              bool   `json:"es"`
+	CBitPos         uint   `json:"cbitpos"`
+	ReducedPhysBits uint   `json:"reduced_phys_bits"`
+	DHCert          string `json:"dh_cert"`
+	Session         string `json:"session"`
+}
+
+// VMLaunchSecurity is the SEV configuration of a VM and, while it runs, what
+// it reports for attestation.
+type VMLaunchSecurity struct {
+	Enabled bool                        `json:"enabled"`
+	ES      bool                        `json:"es"`
+	Config  *libvirt.LaunchSecurity     `json:"config"`
+	Info    *libvirt.LaunchSecurityInfo `json:"info"` // nil unless the VM runs
+}
+
+// GetHostSEV reports whether a host can run SEV guests.
+func (s *HostService) GetHostSEV(hostID string) (*libvirt.SEVCapability, error) {
+	return s.connector.GetSEVCapability(hostID)
+}
+
+// GetVMLaunchSecurity returns the SEV configuration of a VM, with its launch
+// measurement when it is running.
+func (s *HostService) GetVMLaunchSecurity(hostID, vmName string) (*VMLaunchSecurity, error) {
+	if _, err := s.findVM(hostID, vmName); err != nil {
+		return nil, err
+	}
+	config, err := s.connector.GetDomainLaunchSecurity(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	result := &VMLaunchSecurity{Config: config}
+	if config == nil {
+		return result, nil
+	}
+	result.Enabled = true
+	result.ES = config.Policy&libvirt.SEVPolicyES != 0
+	info, err := s.connector.GetDomainLaunchSecurityInfo(hostID, vmName)
+	switch {
+	case err == nil:
+		result.Info = info
+	case !errors.Is(err, libvirt.ErrDomainNotRunning):
+		log.Printf("Warning: could not get launch security info of %s on host %s: %v", vmName, hostID, err)
+	}
+	return result, nil
+}
+
+// SetVMLaunchSecurity enables or disables SEV memory encryption on a
+// shut-off VM. It takes effect on the next start.
+func (s *HostService) SetVMLaunchSecurity(hostID, vmName string, req LaunchSecurityRequest) (*VMLaunchSecurity, error) {
+	var v validator
+	if req.Enabled {
+		if req.DHCert != "" {
+			if _, err := base64.StdEncoding.DecodeString(req.DHCert); err != nil {
+				v.add("dh_cert", "must be base64")
+			}
+		}
+		if req.Session != "" {
+			if _, err := base64.StdEncoding.DecodeString(req.Session); err != nil {
+				v.add("session", "must be base64")
+			}
+		}
+		if (req.DHCert == "") != (req.Session == "") {
+			v.add("session", "and dh_cert must be given together")
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if _, err := s.findVM(hostID, vmName); err != nil {
+		return nil, err
+	}
+
+	var config *libvirt.LaunchSecurity
+	details := "disabled"
+	if req.Enabled {
+		config = &libvirt.LaunchSecurity{
+			Policy:          req.Policy,
+			CBitPos:         req.CBitPos,
+			ReducedPhysBits: req.ReducedPhysBits,
+			DHCert:          req.DHCert,
+			Session:         req.Session,
+		}
+		if config.Policy == 0 {
+			config.Policy = defaultSEVPolicy
+		}
+		if req.ES {
+			config.Policy |= libvirt.SEVPolicyES
+		}
+		details = fmt.Sprintf("policy=0x%04x", config.Policy)
+	}
+	if err := s.connector.SetDomainLaunchSecurity(hostID, vmName, config); err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.launch_security.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), details)
+	return s.GetVMLaunchSecurity(hostID, vmName)
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrPostCopyStarted is returned when aborting a live migration that has
+// switched to post-copy: the VM already runs on the target.
+var ErrPostCopyStarted = errors.New("migration has switched to post-copy and cannot be aborted")
+
+// liveMigrationPollInterval is how often the progress of a live migration
+// is read and reported on its task.
+const liveMigrationPollInterval = time.Second
+
+// LiveMigrationRequest moves a running VM to another host while it keeps
+// running. Zero values leave the hypervisor's defaults.
+type LiveMigrationRequest struct {
+	TargetHostID    string   `json:"target_host_id"`
+	MaxBandwidthMiB uint64   `json:"max_bandwidth_mib"` // MiB/s
+	MaxDowntimeMs   uint64   `json:"max_downtime_ms"`
+	AutoConverge    bool     `json:"auto_converge"`
+	Compression     []string `json:"compression"`
+	PostCopy        bool     `json:"post_copy"`
+	// Switch to post-copy by itself after this many full passes over the
+	// guest's memory; 0 leaves the switch to an update request.
+	PostCopyAfterPasses uint64 `json:"post_copy_after_passes"`
+}
+
+// LiveMigrationUpdate adjusts a running live migration.
+type LiveMigrationUpdate struct {
+	MaxBandwidthMiB *uint64 `json:"max_bandwidth_mib"`
+	MaxDowntimeMs   *uint64 `json:"max_downtime_ms"`
+	StartPostCopy   bool    `json:"start_post_copy"`
+}
+
+// liveMigration is a live migration in progress.
+type liveMigration struct {
+	hostID       string
+	vmName       string
+	targetHostID string
+	task         *storage.Task // Only written by the goroutine running the migration
+	req          LiveMigrationRequest
+	notes        chan string // Step log lines from update requests, for that goroutine to add
+
+	mu              sync.Mutex
+	postCopyStarted bool
+}
+
+// StartLiveMigration moves a running VM to another host as a task. The
+// task reports the data remaining, dirty rate and bandwidth every second
+// in its metrics.
+func (s *HostService) StartLiveMigration(hostID, vmName string, req LiveMigrationRequest) (*storage.Task, error) {
+	var v validator
+	for _, method := range req.Compression {
+		if !libvirt.MigrationCompressionMethods[method] {
+			v.add("compression", "unknown method '%s'; use xbzrle, mt, zlib or zstd", method)
+		}
+	}
+	if req.PostCopyAfterPasses > 0 && !req.PostCopy {
+		v.add("post_copy_after_passes", "needs post_copy")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	precheck, err := s.PrecheckMigration(hostID, vmName, req.TargetHostID)
+	if err != nil {
+		return nil, err
+	}
+	if !precheck.Live {
+		return nil, fmt.Errorf("cannot live migrate %s: %w", vmName, libvirt.ErrDomainNotRunning)
+	}
+	if !precheck.Compatible {
+		return nil, fmt.Errorf("%w: %s", ErrMigrationBlocked, joinMigrationIssues(precheck.Blockers))
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &liveMigration{hostID: hostID, vmName: vmName, targetHostID: req.TargetHostID, req: req, notes: make(chan string, 8)}
+	if _, running := s.liveMigrations.LoadOrStore(vm.UUID, m); running {
+		return nil, fmt.Errorf("%w: %s is already being migrated", ErrMigrationInProgress, vmName)
+	}
+	task, err := s.tasks.Start("vm.migrate.live", fmt.Sprintf("Live migrating %s from %s to %s", vmName, hostID, req.TargetHostID))
+	if err != nil {
+		s.liveMigrations.Delete(vm.UUID)
+		return nil, err
+	}
+	m.task = task
+	s.recordAudit("vm.migrate.live", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("target=%s bandwidth=%d downtime=%d auto_converge=%t post_copy=%t compression=%s",
+			req.TargetHostID, req.MaxBandwidthMiB, req.MaxDowntimeMs, req.AutoConverge, req.PostCopy, strings.Join(req.Compression, ",")))
+
+	started := copyTask(task)
+	go func() {
+		defer s.liveMigrations.Delete(vm.UUID)
+		err := s.runLiveMigration(m, vm.UUID)
+		if err != nil {
+			log.Printf("Live migration of %s to %s failed: %v", vmName, req.TargetHostID, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runLiveMigration(m *liveMigration, vmUUID string) error {
+	s.tasks.Step(m.task, 5, "Copying memory")
+	done := make(chan error, 1)
+	go func() {
+		done <- s.connector.LiveMigrate(m.hostID, m.vmName, m.targetHostID, libvirt.LiveMigrationOptions{
+			MaxBandwidthMiB: m.req.MaxBandwidthMiB,
+			MaxDowntimeMs:   m.req.MaxDowntimeMs,
+			AutoConverge:    m.req.AutoConverge,
+			Compression:     m.req.Compression,
+			PostCopy:        m.req.PostCopy,
+		})
+	}()
+
+	ticker := time.NewTicker(liveMigrationPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				s.SyncVMsForHost(m.hostID)
+				return err
+			}
+			if err := s.finishLiveMigration(m, vmUUID); err != nil {
+				return err
+			}
+			s.tasks.Step(m.task, 100, fmt.Sprintf("%s runs on %s", m.vmName, m.targetHostID))
+			return nil
+		case note := <-m.notes:
+			s.tasks.Step(m.task, m.task.Progress, note)
+		case <-ticker.C:
+			s.reportLiveMigration(m)
+		}
+	}
+}
+
+// reportLiveMigration publishes the progress of a migration on its task,
+// and switches to post-copy once the migration has made the requested
+// number of passes.
+func (s *HostService) reportLiveMigration(m *liveMigration) {
+	progress, err := s.connector.GetMigrationProgress(m.hostID, m.vmName)
+	if err != nil || !progress.Active {
+		return
+	}
+	m.mu.Lock()
+	if after := m.req.PostCopyAfterPasses; after > 0 && !m.postCopyStarted && progress.MemoryIteration > after {
+		if err := s.connector.StartPostCopy(m.hostID, m.vmName); err != nil {
+			log.Printf("Warning: could not switch the migration of %s to post-copy: %v", m.vmName, err)
+		} else {
+			m.postCopyStarted = true
+			s.tasks.Step(m.task, m.task.Progress, fmt.Sprintf("Switched to post-copy after %d passes over memory", after))
+		}
+	}
+	postCopy := m.postCopyStarted
+	m.mu.Unlock()
+
+	percent := m.task.Progress
+	if progress.DataTotal > 0 {
+		percent = 5 + int(90*progress.DataProcessed/progress.DataTotal)
+		if percent > 95 {
+			percent = 95
+		}
+	}
+	s.tasks.Report(m.task, percent, map[string]interface{}{
+		"elapsed_ms":             progress.ElapsedMs,
+		"data_total":             progress.DataTotal,
+		"data_processed":         progress.DataProcessed,
+		"data_remaining":         progress.DataRemaining,
+		"memory_dirty_rate":      progress.MemoryDirtyRate,
+		"memory_iteration":       progress.MemoryIteration,
+		"bandwidth":              progress.Bandwidth,
+		"expected_downtime_ms":   progress.ExpectedDowntimeMs,
+		"auto_converge_throttle": progress.AutoConvergeThrottle,
+		"post_copy":              postCopy,
+	})
+}
+
+// finishLiveMigration moves the VM's record to the target host, as for a
+// cold migration, so it keeps its UUID, custom fields and placement rules.
+func (s *HostService) finishLiveMigration(m *liveMigration, vmUUID string) error {
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("uuid = ?", vmUUID).Update("host_id", m.targetHostID).Error; err != nil {
+		return fmt.Errorf("failed to move %s to host %s in the database: %w", m.vmName, m.targetHostID, err)
+	}
+	s.recordEvent(EventVMMigrated, m.targetHostID, m.vmName,
+		fmt.Sprintf("VM %s live migrated from %s to %s", m.vmName, m.hostID, m.targetHostID),
+		map[string]interface{}{"task_id": m.task.ID, "source_host_id": m.hostID, "live": true})
+
+	s.SyncVMsForHost(m.hostID)
+	s.SyncVMsForHost(m.targetHostID)
+	s.broadcastVMsChanged(m.hostID)
+	s.broadcastVMsChanged(m.targetHostID)
+	return nil
+}
+
+// runningLiveMigration returns the live migration of a VM in progress.
+func (s *HostService) runningLiveMigration(hostID, vmName string) (*liveMigration, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := s.liveMigrations.Load(vm.UUID); ok {
+		return m.(*liveMigration), nil
+	}
+	return nil, fmt.Errorf("%w for %s", libvirt.ErrNoMigrationRunning, vmName)
+}
+
+// UpdateLiveMigration changes the bandwidth or maximum downtime of a
+// running live migration, or switches it to post-copy.
+func (s *HostService) UpdateLiveMigration(hostID, vmName string, req LiveMigrationUpdate) error {
+	m, err := s.runningLiveMigration(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	if req.StartPostCopy && !m.req.PostCopy {
+		return &ValidationError{Fields: []FieldError{{Field: "start_post_copy", Message: "the migration was started without post_copy"}}}
+	}
+	if err := s.connector.SetMigrationLimits(hostID, vmName, req.MaxBandwidthMiB, req.MaxDowntimeMs); err != nil {
+		return err
+	}
+
+	var details []string
+	if req.MaxBandwidthMiB != nil {
+		details = append(details, fmt.Sprintf("bandwidth=%d", *req.MaxBandwidthMiB))
+	}
+	if req.MaxDowntimeMs != nil {
+		details = append(details, fmt.Sprintf("downtime=%d", *req.MaxDowntimeMs))
+	}
+	if req.StartPostCopy {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.postCopyStarted {
+			if err := s.connector.StartPostCopy(hostID, vmName); err != nil {
+				return err
+			}
+			m.postCopyStarted = true
+			select {
+			case m.notes <- "Switched to post-copy":
+			default:
+			}
+		}
+		details = append(details, "post_copy=started")
+	}
+	s.recordAudit("vm.migrate.live.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), strings.Join(details, " "))
+	return nil
+}
+
+// AbortLiveMigration cancels a running live migration; the VM keeps running
+// on its source host.
+func (s *HostService) AbortLiveMigration(hostID, vmName string) error {
+	m, err := s.runningLiveMigration(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	postCopy := m.postCopyStarted
+	m.mu.Unlock()
+	if postCopy {
+		return fmt.Errorf("%w: %s", ErrPostCopyStarted, vmName)
+	}
+	if err := s.connector.AbortMigration(hostID, vmName); err != nil {
+		return err
+	}
+	s.recordAudit("vm.migrate.live.abort", "vm", fmt.Sprintf("%s/%s", hostID, vmName), fmt.Sprintf("task=%d", m.task.ID))
+	return nil
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// DefaultMACPrefix is the QEMU/KVM OUI, which libvirt also uses for the
+// addresses it generates.
+const DefaultMACPrefix = "52:54:00"
+
+// macAllocationAttempts bounds the random search for a free address.
+const macAllocationAttempts = 64
+
+var (
+	// ErrInvalidMACPrefix is returned for a malformed or multicast pool prefix.
+	ErrInvalidMACPrefix = errors.New("MAC prefix must be 1-5 hex octets of a unicast address, e.g. '52:54:00'")
+	// ErrMACPoolExhausted is returned when no free address could be found in the pool.
+	ErrMACPoolExhausted = errors.New("no free MAC address left in the pool")
+)
+
+// MACPoolInfo describes the configured MAC pool and how much of it is used.
+type MACPoolInfo struct {
+	Prefix string `json:"prefix"`
+	Size   uint64 `json:"size"` // Number of addresses in the pool
+	Used   int64  `json:"used"` // Known NICs with an address in the pool
+}
+
+// parseMACPrefix validates a pool prefix and returns its octets.
+func parseMACPrefix(prefix string) ([]byte, error) {
+	parts := strings.Split(prefix, ":")
+	if len(parts) < 1 || len(parts) > 5 {
+		return nil, ErrInvalidMACPrefix
+	}
+	octets := make([]byte, len(parts))
+	for i, part := range parts {
+		b, err := strconv.ParseUint(part, 16, 8)
+		if len(part) != 2 || err != nil {
+			return nil, ErrInvalidMACPrefix
+		}
+		octets[i] = byte(b)
+	}
+	if octets[0]&0x01 != 0 {
+		return nil, ErrInvalidMACPrefix
+	}
+	return octets, nil
+}
+
+// macPrefix returns the configured pool prefix.
+func (s *HostService) macPrefix() string {
+	var pool storage.MACAddressPool
+	if err := s.db.First(&pool).Error; err != nil || pool.Prefix == "" {
+		return DefaultMACPrefix
+	}
+	return pool.Prefix
+}
+
+// GetMACPool returns the MAC pool configuration and usage.
+func (s *HostService) GetMACPool() (*MACPoolInfo, error) {
+	prefix := s.macPrefix()
+	var used int64
+	if err := s.db.Model(&storage.Port{}).Where("mac_address LIKE ?", prefix+":%").Count(&used).Error; err != nil {
+		return nil, err
+	}
+	return &MACPoolInfo{
+		Prefix: prefix,
+		Size:   uint64(1) << (8 * (6 - len(strings.Split(prefix, ":")))),
+		Used:   used,
+	}, nil
+}
+
+// SetMACPool changes the prefix generated NIC addresses are drawn from.
+// Existing NICs keep their addresses.
+func (s *HostService) SetMACPool(prefix string) (*MACPoolInfo, error) {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if _, err := parseMACPrefix(prefix); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(&storage.MACAddressPool{ID: 1, Prefix: prefix}).Error; err != nil {
+		return nil, fmt.Errorf("failed to save MAC pool: %w", err)
+	}
+	s.recordAudit("network.mac-pool.update", "mac_pool", "1", "prefix="+prefix)
+	return s.GetMACPool()
+}
+
+// AllocateMACAddress picks a random address from the pool that no known NIC
+// on any host uses.
+func (s *HostService) AllocateMACAddress() (string, error) {
+	prefix, err := parseMACPrefix(s.macPrefix())
+	if err != nil {
+		return "", err
+	}
+
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, prefix)
+	for i := 0; i < macAllocationAttempts; i++ {
+		if _, err := rand.Read(mac[len(prefix):]); err != nil {
+			return "", fmt.Errorf("failed to generate MAC address: %w", err)
+		}
+		var count int64
+		if err := s.db.Unscoped().Model(&storage.Port{}).Where("mac_address = ?", mac.String()).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return mac.String(), nil
+		}
+	}
+	return "", ErrMACPoolExhausted
+}
+
+// macOwner returns the live VM that owns a NIC with the given address, if any.
+func macOwner(tx *gorm.DB, mac string) (*storage.VirtualMachine, error) {
+	var port storage.Port
+	if err := tx.Where("mac_address = ?", mac).First(&port).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var owner storage.VirtualMachine
+	if err := tx.First(&owner, port.VMID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil // Left behind by a VM that no longer exists
+		}
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// claimPort records a NIC of a VM during sync. MAC addresses are unique across
+// all hosts, so when another live VM already owns the address a conflict is
+// recorded instead and nil is returned. Ports left behind by removed VMs or
+// NICs are taken over.
+func (s *HostService) claimPort(tx *gorm.DB, vmID uint, hostID, vmName string, nic libvirt.NetworkInfo) (*storage.Port, error) {
+	mac := strings.ToLower(nic.Mac.Address)
+
+	owner, err := macOwner(tx, mac)
+	if err != nil {
+		return nil, err
+	}
+	if owner != nil && owner.ID != vmID {
+		conflict := storage.MACConflict{
+			MACAddress:  mac,
+			VMID:        vmID,
+			HostID:      hostID,
+			VMName:      vmName,
+			OwnerVMID:   owner.ID,
+			OwnerHostID: owner.HostID,
+			OwnerVMName: owner.Name,
+		}
+		var existing storage.MACConflict
+		err := tx.Where("mac_address = ? AND vm_id = ?", mac, vmID).First(&existing).Error
+		switch {
+		case err == nil:
+			conflict.ID = existing.ID
+			conflict.CreatedAt = existing.CreatedAt
+			err = tx.Save(&conflict).Error
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err = tx.Create(&conflict).Error; err == nil {
+				logMACConflict(conflict)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to record MAC conflict for %s: %w", mac, err)
+		}
+		return nil, nil
+	}
+
+	var port storage.Port
+	err = tx.Unscoped().Where("mac_address = ?", mac).First(&port).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		port = storage.Port{
+			VMID:       vmID,
+			MACAddress: mac,
+			DeviceName: nic.Target.Dev,
+			ModelName:  nic.Model.Type,
+		}
+		if err := tx.Create(&port).Error; err != nil {
+			return nil, err
+		}
+		return &port, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = tx.Unscoped().Model(&port).Updates(map[string]interface{}{
+		"vm_id":       vmID,
+		"device_name": nic.Target.Dev,
+		"model_name":  nic.Model.Type,
+		"deleted_at":  nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return &port, nil
+}
+
+// ListMACConflicts returns the open MAC conflicts between VMs that still exist.
+func (s *HostService) ListMACConflicts() ([]storage.MACConflict, error) {
+	conflicts := []storage.MACConflict{}
+	err := s.db.
+		Joins("JOIN virtual_machines vm ON vm.id = mac_conflicts.vm_id AND vm.deleted_at IS NULL").
+		Joins("JOIN virtual_machines owner ON owner.id = mac_conflicts.owner_vm_id AND owner.deleted_at IS NULL").
+		Order("mac_conflicts.id").
+		Find(&conflicts).Error
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, nil
+}
+
+// logMACConflict warns about a newly detected conflict.
+func logMACConflict(c storage.MACConflict) {
+	log.Printf("Warning: MAC address %s of VM %s on host %s is already used by VM %s on host %s; the NIC was not recorded",
+		c.MACAddress, c.VMName, c.HostID, c.OwnerVMName, c.OwnerHostID)
+}
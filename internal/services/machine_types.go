@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// ErrMachineTypeStartFailed is returned when a VM does not start on its new
+// machine type. The change has been rolled back by then.
+var ErrMachineTypeStartFailed = errors.New("VM did not start on the new machine type; the change was rolled back")
+
+// MachineTypeUpgradeRequest moves a shut-off VM to another machine type.
+type MachineTypeUpgradeRequest struct {
+	Target string `json:"target"` // Empty for the newest version of the VM's family
+	// Start the VM after the change, and roll the change back if it does
+	// not start.
+	Start bool `json:"start"`
+}
+
+// VMMachineType is a VM's machine type upgrade plan with the changes made
+// so far.
+type VMMachineType struct {
+	Plan    *libvirt.MachineTypeUpgradePlan `json:"plan"`
+	History []storage.VMMachineTypeChange   `json:"history"`
+}
+
+// ListMachineTypes returns the machine types a host offers.
+func (s *HostService) ListMachineTypes(hostID string) ([]libvirt.MachineType, error) {
+	return s.connector.ListMachineTypes(hostID)
+}
+
+// GetVMMachineType previews the move of a VM to a machine type, by default
+// the newest of its family, and lists its earlier changes.
+func (s *HostService) GetVMMachineType(hostID, vmName, target string) (*VMMachineType, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := s.connector.PlanMachineTypeUpgrade(hostID, vmName, target)
+	if err != nil {
+		return nil, err
+	}
+	history := []storage.VMMachineTypeChange{}
+	if err := s.db.Where("vm_id = ?", vm.ID).Order("id desc").Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return &VMMachineType{Plan: plan, History: history}, nil
+}
+
+// UpgradeVMMachineType moves a shut-off VM to another machine type and
+// keeps its previous definition for a rollback.
+func (s *HostService) UpgradeVMMachineType(hostID, vmName string, req MachineTypeUpgradeRequest) (*storage.VMMachineTypeChange, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	plan, previousXML, err := s.connector.UpgradeMachineType(hostID, vmName, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	change := storage.VMMachineTypeChange{
+		VMID:        vm.ID,
+		FromMachine: plan.Current,
+		ToMachine:   plan.Target,
+		Changes:     plan.Changes,
+		PreviousXML: previousXML,
+	}
+	if err := s.db.Create(&change).Error; err != nil {
+		// The VM is changed, but could not be rolled back later; undo it now.
+		if restoreErr := s.connector.RestoreDomainDefinition(hostID, vmName, previousXML); restoreErr != nil {
+			log.Printf("Warning: could not restore the definition of %s on host %s: %v", vmName, hostID, restoreErr)
+		}
+		return nil, err
+	}
+	target := fmt.Sprintf("%s/%s", hostID, vmName)
+	s.recordAudit("vm.machine_type.upgrade", "vm", target, fmt.Sprintf("%s -> %s", plan.Current, plan.Target))
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+
+	if req.Start {
+		if startErr := s.StartVM(context.Background(), hostID, vmName); startErr != nil {
+			if _, err := s.rollbackMachineType(hostID, vmName, &change); err != nil {
+				return nil, fmt.Errorf("VM did not start on %s (%v), and rolling back failed: %w", plan.Target, startErr, err)
+			}
+			return nil, fmt.Errorf("%w: %v", ErrMachineTypeStartFailed, startErr)
+		}
+	}
+	return &change, nil
+}
+
+// RollbackVMMachineType restores the definition a shut-off VM had before
+// its latest machine type change.
+func (s *HostService) RollbackVMMachineType(hostID, vmName string) (*storage.VMMachineTypeChange, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	var change storage.VMMachineTypeChange
+	if err := s.db.Where("vm_id = ? AND rolled_back_at IS NULL", vm.ID).Order("id desc").First(&change).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("no machine type change of %s to roll back: %w", vmName, err)
+		}
+		return nil, err
+	}
+	return s.rollbackMachineType(hostID, vmName, &change)
+}
+
+func (s *HostService) rollbackMachineType(hostID, vmName string, change *storage.VMMachineTypeChange) (*storage.VMMachineTypeChange, error) {
+	if err := s.connector.RestoreDomainDefinition(hostID, vmName, change.PreviousXML); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	change.RolledBackAt = &now
+	if err := s.db.Model(change).Update("rolled_back_at", now).Error; err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.machine_type.rollback", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("%s -> %s", change.ToMachine, change.FromMachine))
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	return change, nil
+}
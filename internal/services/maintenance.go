@@ -0,0 +1,275 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+var maintenanceWindowNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// ErrMaintenanceWindowExists is returned when a window name is already taken.
+var ErrMaintenanceWindowExists = errors.New("maintenance window already exists")
+
+// maintenanceQuietEvents are the events that notify nobody while a
+// maintenance window covers their host or VM. Everything else, such as
+// fencing and runbook notifications, still goes out.
+var maintenanceQuietEvents = []string{
+	EventVMStateChanged,
+	EventSyncFailed,
+	EventHostConnectionFailed,
+	EventHostDisconnected,
+	EventHostDead,
+	EventAlertRaised,
+	EventAlertResolved,
+}
+
+// MaintenanceWindowRequest defines or redefines a maintenance window.
+type MaintenanceWindowRequest struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+	HostID      string    `json:"host_id"`
+	VMUUID      string    `json:"vm_uuid"`
+	Selector    string    `json:"selector"`
+}
+
+// MaintenanceWindowView is a maintenance window with whether it is on.
+type MaintenanceWindowView struct {
+	storage.MaintenanceWindow
+	Active bool `json:"active"`
+}
+
+func maintenanceWindowView(window storage.MaintenanceWindow, now time.Time) MaintenanceWindowView {
+	return MaintenanceWindowView{
+		MaintenanceWindow: window,
+		Active:            !now.Before(window.StartsAt) && now.Before(window.EndsAt),
+	}
+}
+
+func (s *HostService) validateMaintenanceWindow(req MaintenanceWindowRequest) (MaintenanceWindowRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	req.HostID = strings.TrimSpace(req.HostID)
+	req.VMUUID = strings.TrimSpace(req.VMUUID)
+	req.Selector = strings.TrimSpace(req.Selector)
+	var v validator
+	if !maintenanceWindowNamePattern.MatchString(req.Name) {
+		v.add("name", "must start with a letter or digit and contain only letters, digits, '_', '.' and '-' (at most 64)")
+	}
+	if req.StartsAt.IsZero() {
+		v.add("starts_at", "is required")
+	}
+	if req.EndsAt.IsZero() {
+		v.add("ends_at", "is required")
+	} else if !req.EndsAt.After(req.StartsAt) {
+		v.add("ends_at", "must be after starts_at")
+	}
+	var selectorErr *ValidationError
+	if _, err := ParseSelector(req.Selector); errors.As(err, &selectorErr) {
+		v.fields = append(v.fields, selectorErr.Fields...)
+	}
+	if req.HostID != "" {
+		var count int64
+		if err := s.db.Model(&storage.Host{}).Where("id = ?", req.HostID).Count(&count).Error; err != nil {
+			return req, err
+		}
+		if count == 0 {
+			v.add("host_id", "no host has the ID '%s'", req.HostID)
+		}
+	}
+	if req.VMUUID != "" {
+		var count int64
+		if err := s.db.Model(&storage.VirtualMachine{}).Where("uuid = ?", req.VMUUID).Count(&count).Error; err != nil {
+			return req, err
+		}
+		if count == 0 {
+			v.add("vm_uuid", "no VM has the uuid '%s'", req.VMUUID)
+		}
+	}
+	return req, v.err()
+}
+
+func (s *HostService) getMaintenanceWindow(name string) (*storage.MaintenanceWindow, error) {
+	var window storage.MaintenanceWindow
+	if err := s.db.Where("name = ?", name).First(&window).Error; err != nil {
+		return nil, fmt.Errorf("could not find maintenance window %s: %w", name, err)
+	}
+	return &window, nil
+}
+
+// ListMaintenanceWindows returns the maintenance windows, latest first, or
+// only the ones that are on.
+func (s *HostService) ListMaintenanceWindows(activeOnly bool) ([]MaintenanceWindowView, error) {
+	now := time.Now()
+	query := s.db.Order("starts_at DESC, name")
+	if activeOnly {
+		query = query.Where("starts_at <= ? AND ends_at > ?", now, now)
+	}
+	var windows []storage.MaintenanceWindow
+	if err := query.Find(&windows).Error; err != nil {
+		return nil, err
+	}
+	views := make([]MaintenanceWindowView, 0, len(windows))
+	for _, window := range windows {
+		views = append(views, maintenanceWindowView(window, now))
+	}
+	return views, nil
+}
+
+// GetMaintenanceWindow returns a maintenance window.
+func (s *HostService) GetMaintenanceWindow(name string) (*MaintenanceWindowView, error) {
+	window, err := s.getMaintenanceWindow(name)
+	if err != nil {
+		return nil, err
+	}
+	view := maintenanceWindowView(*window, time.Now())
+	return &view, nil
+}
+
+// CreateMaintenanceWindow plans a maintenance window. It may lie in the
+// past, to leave an unplanned outage out of availability reports.
+func (s *HostService) CreateMaintenanceWindow(req MaintenanceWindowRequest) (*MaintenanceWindowView, error) {
+	req, err := s.validateMaintenanceWindow(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.MaintenanceWindow{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrMaintenanceWindowExists, req.Name)
+	}
+
+	window := storage.MaintenanceWindow{Name: req.Name}
+	applyMaintenanceWindow(&window, req)
+	if err := s.db.Create(&window).Error; err != nil {
+		return nil, fmt.Errorf("failed to save maintenance window: %w", err)
+	}
+	s.recordAudit("maintenance.create", "maintenance", window.Name, maintenanceWindowDetails(&window))
+	view := maintenanceWindowView(window, time.Now())
+	return &view, nil
+}
+
+// UpdateMaintenanceWindow changes the time and scope of a window, e.g. to
+// end it early. The window cannot be renamed.
+func (s *HostService) UpdateMaintenanceWindow(name string, req MaintenanceWindowRequest) (*MaintenanceWindowView, error) {
+	window, err := s.getMaintenanceWindow(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = window.Name
+	if req, err = s.validateMaintenanceWindow(req); err != nil {
+		return nil, err
+	}
+	applyMaintenanceWindow(window, req)
+	if err := s.db.Save(window).Error; err != nil {
+		return nil, fmt.Errorf("failed to save maintenance window: %w", err)
+	}
+	s.recordAudit("maintenance.update", "maintenance", window.Name, maintenanceWindowDetails(window))
+	view := maintenanceWindowView(*window, time.Now())
+	return &view, nil
+}
+
+// DeleteMaintenanceWindow removes a window. Availability reports count its
+// time again; alerts and state changes it covered keep their marks.
+func (s *HostService) DeleteMaintenanceWindow(name string) error {
+	window, err := s.getMaintenanceWindow(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(window).Error; err != nil {
+		return fmt.Errorf("failed to delete maintenance window: %w", err)
+	}
+	s.recordAudit("maintenance.delete", "maintenance", name, "")
+	return nil
+}
+
+// applyMaintenanceWindow copies a request to a window. Timestamps are stored
+// as text in local time, so they are converted for comparisons to hold.
+func applyMaintenanceWindow(window *storage.MaintenanceWindow, req MaintenanceWindowRequest) {
+	window.Description = req.Description
+	window.StartsAt = req.StartsAt.Local()
+	window.EndsAt = req.EndsAt.Local()
+	window.HostID = req.HostID
+	window.VMUUID = req.VMUUID
+	window.Selector = req.Selector
+}
+
+func maintenanceWindowDetails(window *storage.MaintenanceWindow) string {
+	return fmt.Sprintf("starts=%s ends=%s host=%s vm=%s selector=%s", window.StartsAt.Format(time.RFC3339),
+		window.EndsAt.Format(time.RFC3339), window.HostID, window.VMUUID, window.Selector)
+}
+
+// maintenanceWindowsBetween returns the windows that overlap a time range.
+func (s *HostService) maintenanceWindowsBetween(from, to time.Time) ([]storage.MaintenanceWindow, error) {
+	var windows []storage.MaintenanceWindow
+	err := s.db.Where("starts_at < ? AND ends_at > ?", to.Local(), from.Local()).Order("starts_at, id").Find(&windows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load maintenance windows: %w", err)
+	}
+	return windows, nil
+}
+
+// maintenanceWindowCovers reports whether a window's scope takes in a host
+// or, when vm is not nil, a VM with the given labels. Windows scoped to VMs
+// do not cover their hosts.
+func maintenanceWindowCovers(window storage.MaintenanceWindow, hostID string, vm *storage.VirtualMachine, labels map[string]string) bool {
+	if window.HostID != "" && window.HostID != hostID {
+		return false
+	}
+	if window.VMUUID == "" && window.Selector == "" {
+		return true
+	}
+	if vm == nil || (window.VMUUID != "" && window.VMUUID != vm.UUID) {
+		return false
+	}
+	if window.Selector != "" {
+		sel, err := ParseSelector(window.Selector)
+		if err != nil || !sel.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// activeMaintenanceWindow returns the window that is on now for a host or,
+// with a VM name, for a VM; nil if there is none.
+func (s *HostService) activeMaintenanceWindow(hostID, vmName string) *storage.MaintenanceWindow {
+	now := time.Now()
+	windows, err := s.maintenanceWindowsBetween(now, now.Add(time.Nanosecond))
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	if len(windows) == 0 {
+		return nil
+	}
+
+	var vm *storage.VirtualMachine
+	var labels map[string]string
+	if vmName != "" && slices.ContainsFunc(windows, func(w storage.MaintenanceWindow) bool { return w.VMUUID != "" || w.Selector != "" }) {
+		found, err := s.findVM(hostID, vmName)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Warning: failed to look up VM %s for maintenance windows: %v", vmName, err)
+		}
+		if found != nil {
+			vm = found
+			labels, _ = labelsOf(s.db, vm.ID)
+		}
+	}
+	for i := range windows {
+		if maintenanceWindowCovers(windows[i], hostID, vm, labels) {
+			return &windows[i]
+		}
+	}
+	return nil
+}
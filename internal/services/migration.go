@@ -0,0 +1,394 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Categories of precheck findings that are added to the host comparison.
+const (
+	MigrationCheckPlacement = "placement" // Placement rules the move would violate
+	MigrationCheckCapacity  = "capacity"  // CPU and memory left on the target after its reservation
+)
+
+var (
+	// ErrMissingMigrationTarget is returned when a migration request names no target host.
+	ErrMissingMigrationTarget = errors.New("a target host is required")
+	// ErrMigrationBlocked is returned when the precheck found blockers.
+	ErrMigrationBlocked = errors.New("migration is blocked")
+	// ErrMigrationInProgress is returned when a VM already has an unfinished
+	// migration job, or a job is already running.
+	ErrMigrationInProgress = errors.New("migration already in progress")
+	// ErrMigrationCompleted is returned when resuming or discarding a job that
+	// has completed.
+	ErrMigrationCompleted = errors.New("migration job has completed")
+)
+
+// MigrationPrecheckResult is the outcome of a migration precheck. The
+// migration can go ahead when there are no blockers; warnings point at
+// things that could not be verified or may need attention.
+type MigrationPrecheckResult struct {
+	Compatible bool `json:"compatible"`
+	*libvirt.MigrationPrecheck
+}
+
+// PrecheckMigration checks whether a VM can be moved to another host. Next
+// to the comparison of the two hosts, it blocks on a target in maintenance
+// mode, checks the target's capacity and warns about placement rules the
+// move would violate.
+func (s *HostService) PrecheckMigration(hostID, vmName, targetHostID string) (*MigrationPrecheckResult, error) {
+	if targetHostID == "" {
+		return nil, ErrMissingMigrationTarget
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	check, err := s.connector.PrecheckMigration(hostID, vmName, targetHostID)
+	if err != nil {
+		return nil, err
+	}
+
+	var target storage.Host
+	if err := s.db.Where("id = ?", targetHostID).Limit(1).Find(&target).Error; err != nil {
+		return nil, err
+	}
+	if target.MaintenanceMode {
+		check.Blockers = append(check.Blockers, libvirt.MigrationIssue{
+			Check:   libvirt.MigrationCheckHost,
+			Message: "Target host " + targetHostID + " is in maintenance mode",
+		})
+	}
+	if target.ID != "" && targetHostID != hostID {
+		s.checkTargetCapacity(check, vm, &target)
+	}
+
+	violations, err := s.CheckPlacement(hostID, vmName, targetHostID)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range violations {
+		check.Warnings = append(check.Warnings, libvirt.MigrationIssue{Check: MigrationCheckPlacement, Message: v.Message})
+	}
+
+	return &MigrationPrecheckResult{Compatible: len(check.Blockers) == 0, MigrationPrecheck: check}, nil
+}
+
+// checkTargetCapacity compares what a VM needs with what the target offers
+// to VMs after its reservation. A running VM that does not fit blocks the
+// migration; a stopped one only warns, as it needs the memory once started.
+func (s *HostService) checkTargetCapacity(check *libvirt.MigrationPrecheck, vm *storage.VirtualMachine, target *storage.Host) {
+	info, err := s.connector.GetHostInfo(target.ID)
+	if err != nil {
+		return // An unreachable target is already a host blocker.
+	}
+	capacity, err := s.hostCapacity(target, info)
+	if err != nil {
+		check.Warnings = append(check.Warnings, libvirt.MigrationIssue{
+			Check:   MigrationCheckCapacity,
+			Message: fmt.Sprintf("Could not compute the capacity of %s: %v", target.ID, err),
+		})
+		return
+	}
+	if vm.MemoryBytes > capacity.AvailableMemoryBytes {
+		issue := libvirt.MigrationIssue{
+			Check: MigrationCheckCapacity,
+			Message: fmt.Sprintf("%s needs %d MiB of memory, but only %d MiB are available on %s after its reservation of %d MiB",
+				vm.Name, vm.MemoryBytes>>20, capacity.AvailableMemoryBytes>>20, target.ID, capacity.ReservedMemoryBytes>>20),
+		}
+		if check.Live {
+			check.Blockers = append(check.Blockers, issue)
+		} else {
+			check.Warnings = append(check.Warnings, issue)
+		}
+	}
+	if vm.VCPUCount > capacity.AllocatableCPUs {
+		check.Warnings = append(check.Warnings, libvirt.MigrationIssue{
+			Check: MigrationCheckCapacity,
+			Message: fmt.Sprintf("%s has %d vCPUs, more than the %d CPUs %s offers to VMs after its reservation",
+				vm.Name, vm.VCPUCount, capacity.AllocatableCPUs, target.ID),
+		})
+	}
+}
+
+// ColdMigrationRequest moves a shut-off VM to a host without shared storage.
+type ColdMigrationRequest struct {
+	TargetHostID string `json:"target_host_id"`
+	TargetPool   string `json:"target_pool"` // Optional; by default each volume goes to the pool of the same name
+}
+
+// StartColdMigration moves a shut-off VM to another host by copying its disk
+// images there, defining it on the target and removing it and its images
+// from the source. The move runs as a task; its progress is kept in a
+// migration job, which can be resumed if a run fails or is interrupted.
+func (s *HostService) StartColdMigration(hostID, vmName string, req ColdMigrationRequest) (*storage.MigrationJob, error) {
+	vm, _, plan, err := s.prepareColdMigration(hostID, vmName, req)
+	if err != nil {
+		return nil, err
+	}
+	job := &storage.MigrationJob{
+		VMUUID:       vm.UUID,
+		VMName:       vmName,
+		SourceHostID: hostID,
+		TargetHostID: req.TargetHostID,
+		TargetPool:   req.TargetPool,
+		Phase:        storage.MigrationPhaseCopy,
+		Status:       storage.TaskPending,
+		Disks:        plan.Disks,
+		DomainXML:    plan.DomainXML,
+	}
+	if err := s.db.Create(job).Error; err != nil {
+		return nil, fmt.Errorf("failed to save migration job: %w", err)
+	}
+	s.recordAudit("vm.migrate", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("job=%d target=%s pool=%s disks=%d", job.ID, job.TargetHostID, job.TargetPool, len(job.Disks)))
+
+	return s.launchMigrationJob(job)
+}
+
+// prepareColdMigration checks that a VM can be cold migrated and works out
+// where its disks go, without changing anything.
+func (s *HostService) prepareColdMigration(hostID, vmName string, req ColdMigrationRequest) (*storage.VirtualMachine, *MigrationPrecheckResult, *libvirt.ColdMigrationPlan, error) {
+	precheck, err := s.PrecheckMigration(hostID, vmName, req.TargetHostID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	unfinished, err := s.unfinishedMigrationJob(vm.UUID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if unfinished != nil {
+		return nil, nil, nil, fmt.Errorf("%w: job %d for %s is unfinished; resume or discard it", ErrMigrationInProgress, unfinished.ID, vmName)
+	}
+
+	// The storage is copied, so it does not have to be shared.
+	var blockers []string
+	for _, issue := range precheck.Blockers {
+		if issue.Check != libvirt.MigrationCheckStorage {
+			blockers = append(blockers, issue.Message)
+		}
+	}
+	if len(blockers) > 0 {
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrMigrationBlocked, strings.Join(blockers, "; "))
+	}
+
+	plan, err := s.connector.PlanColdMigration(hostID, vmName, req.TargetHostID, req.TargetPool)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return vm, precheck, plan, nil
+}
+
+// ListMigrationJobs returns the most recent migration jobs, newest first.
+func (s *HostService) ListMigrationJobs() ([]storage.MigrationJob, error) {
+	jobs := []storage.MigrationJob{}
+	if err := s.db.Order("id desc").Limit(100).Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// GetMigrationJob returns a single migration job.
+func (s *HostService) GetMigrationJob(id uint) (*storage.MigrationJob, error) {
+	var job storage.MigrationJob
+	if err := s.db.First(&job, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find migration job %d: %w", id, err)
+	}
+	return &job, nil
+}
+
+// ResumeMigrationJob runs a failed or interrupted migration job again from
+// the phase and disk it stopped at.
+func (s *HostService) ResumeMigrationJob(id uint) (*storage.MigrationJob, error) {
+	job, err := s.GetMigrationJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status == storage.TaskCompleted {
+		return nil, fmt.Errorf("%w: job %d", ErrMigrationCompleted, id)
+	}
+	if err := s.checkMigrationSource(job); err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.migrate.resume", "vm", fmt.Sprintf("%s/%s", job.SourceHostID, job.VMName),
+		fmt.Sprintf("job=%d phase=%s", job.ID, job.Phase))
+	return s.launchMigrationJob(job)
+}
+
+// DiscardMigrationJob forgets an unfinished migration job so the VM can be
+// migrated again. Images it already copied stay on the target host.
+func (s *HostService) DiscardMigrationJob(id uint) error {
+	job, err := s.GetMigrationJob(id)
+	if err != nil {
+		return err
+	}
+	if job.Status == storage.TaskCompleted {
+		return fmt.Errorf("%w: job %d", ErrMigrationCompleted, id)
+	}
+	if _, running := s.migrations.Load(job.ID); running {
+		return fmt.Errorf("%w: job %d is running", ErrMigrationInProgress, id)
+	}
+	if err := s.db.Unscoped().Delete(job).Error; err != nil {
+		return err
+	}
+	s.recordAudit("vm.migrate.discard", "vm", fmt.Sprintf("%s/%s", job.SourceHostID, job.VMName),
+		fmt.Sprintf("job=%d phase=%s", job.ID, job.Phase))
+	return nil
+}
+
+// launchMigrationJob starts a task that runs a migration job in the
+// background. A job only ever has one run in progress. The job is then owned
+// by the run, so callers get a copy of it as it was at the start.
+func (s *HostService) launchMigrationJob(job *storage.MigrationJob) (*storage.MigrationJob, error) {
+	if _, running := s.migrations.LoadOrStore(job.ID, true); running {
+		return nil, fmt.Errorf("%w: job %d is running", ErrMigrationInProgress, job.ID)
+	}
+	task, err := s.tasks.Start("vm.migrate", fmt.Sprintf("Migrating %s from %s to %s (job %d)", job.VMName, job.SourceHostID, job.TargetHostID, job.ID))
+	if err != nil {
+		s.migrations.Delete(job.ID)
+		return nil, err
+	}
+	job.TaskID = task.ID
+	job.Status = storage.TaskRunning
+	job.Error = ""
+	s.saveMigrationJob(job)
+	started := *job
+	started.Disks = slices.Clone(job.Disks)
+
+	go func() {
+		defer s.migrations.Delete(job.ID)
+		err := s.runMigrationJob(task, job)
+		if err != nil {
+			log.Printf("Migration job %d of %s failed: %v", job.ID, job.VMName, err)
+			job.Status = storage.TaskFailed
+			job.Error = err.Error()
+		} else {
+			job.Status = storage.TaskCompleted
+		}
+		s.saveMigrationJob(job)
+		s.tasks.Finish(task, err)
+	}()
+	return &started, nil
+}
+
+// checkMigrationSource makes sure the VM of a job is still shut off on its
+// source host, so that no phase copies images that are in use or takes a
+// running VM apart. Only cleanup may find the VM already removed.
+func (s *HostService) checkMigrationSource(job *storage.MigrationJob) error {
+	defined, err := s.connector.CheckMigrationSource(job.SourceHostID, job.DomainXML)
+	if err != nil {
+		return fmt.Errorf("cannot continue migration job %d: %w", job.ID, err)
+	}
+	if !defined && job.Phase != storage.MigrationPhaseCleanup {
+		return fmt.Errorf("cannot continue migration job %d: %s is no longer defined on host %s", job.ID, job.VMName, job.SourceHostID)
+	}
+	return nil
+}
+
+// unfinishedMigrationJob returns the migration job of a VM that has not
+// completed, or nil.
+func (s *HostService) unfinishedMigrationJob(vmUUID string) (*storage.MigrationJob, error) {
+	var job storage.MigrationJob
+	if err := s.db.Where("vm_uuid = ? AND status <> ?", vmUUID, storage.TaskCompleted).Limit(1).Find(&job).Error; err != nil {
+		return nil, err
+	}
+	if job.ID == 0 {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (s *HostService) runMigrationJob(task *storage.Task, job *storage.MigrationJob) error {
+	if job.Phase == storage.MigrationPhaseCopy {
+		for i := range job.Disks {
+			disk := &job.Disks[i]
+			progress := 5 + 80*i/len(job.Disks)
+			if disk.Copied {
+				s.tasks.Step(task, progress, fmt.Sprintf("%s was already copied", disk.Device))
+				continue
+			}
+			if err := s.checkMigrationSource(job); err != nil {
+				return err
+			}
+			if !disk.Created {
+				err := s.connector.CreateMigrationTarget(job.TargetHostID, disk)
+				s.saveMigrationJob(job)
+				if err != nil {
+					return err
+				}
+			}
+			s.tasks.Step(task, progress, fmt.Sprintf("Copying %s (%s)", disk.Device, disk.SourcePath))
+			if err := s.connector.CopyMigrationDisk(job.SourceHostID, job.TargetHostID, disk); err != nil {
+				return err
+			}
+			s.saveMigrationJob(job)
+		}
+		job.Phase = storage.MigrationPhaseDefine
+		s.saveMigrationJob(job)
+	}
+
+	if job.Phase == storage.MigrationPhaseDefine {
+		if err := s.checkMigrationSource(job); err != nil {
+			return err
+		}
+		s.tasks.Step(task, 90, fmt.Sprintf("Defining %s on %s", job.VMName, job.TargetHostID))
+		if err := s.connector.DefineMigratedDomain(job.TargetHostID, job.DomainXML, job.Disks); err != nil {
+			return err
+		}
+		// Move the record rather than letting the syncs recreate it, so the
+		// VM keeps its UUID, custom fields and placement rules.
+		if err := s.db.Model(&storage.VirtualMachine{}).Where("uuid = ?", job.VMUUID).Update("host_id", job.TargetHostID).Error; err != nil {
+			return fmt.Errorf("failed to move %s to host %s in the database: %w", job.VMName, job.TargetHostID, err)
+		}
+		job.Phase = storage.MigrationPhaseCleanup
+		s.saveMigrationJob(job)
+	}
+
+	if job.Phase == storage.MigrationPhaseCleanup {
+		// RemoveMigratedSource checks the state again right before it
+		// undefines the VM.
+		if err := s.checkMigrationSource(job); err != nil {
+			return err
+		}
+		s.tasks.Step(task, 95, fmt.Sprintf("Removing %s and its images from %s", job.VMName, job.SourceHostID))
+		if err := s.connector.RemoveMigratedSource(job.SourceHostID, job.DomainXML, job.Disks); err != nil {
+			return err
+		}
+		job.Phase = storage.MigrationPhaseDone
+		s.saveMigrationJob(job)
+		s.recordEvent(EventVMMigrated, job.TargetHostID, job.VMName,
+			fmt.Sprintf("VM %s migrated from %s to %s", job.VMName, job.SourceHostID, job.TargetHostID),
+			map[string]interface{}{"job_id": job.ID, "source_host_id": job.SourceHostID})
+	}
+
+	s.SyncVMsForHost(job.SourceHostID)
+	s.SyncVMsForHost(job.TargetHostID)
+	s.broadcastVMsChanged(job.SourceHostID)
+	s.broadcastVMsChanged(job.TargetHostID)
+	return nil
+}
+
+func (s *HostService) saveMigrationJob(job *storage.MigrationJob) {
+	if err := s.db.Save(job).Error; err != nil {
+		log.Printf("Warning: failed to persist migration job %d: %v", job.ID, err)
+	}
+}
+
+// joinMigrationIssues lists the messages of precheck issues for an error.
+func joinMigrationIssues(issues []libvirt.MigrationIssue) string {
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.Message)
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Bounds for VM stats polling. Every poll costs several libvirt calls per VM,
+// so intervals below the floor are raised to it, whoever asks for them.
+const (
+	DefaultStatsInterval = 2 * time.Second
+	MinStatsInterval     = time.Second
+	MaxStatsInterval     = time.Hour
+)
+
+// guestFilesystemsInterval is how often the stats poller asks a VM's guest
+// agent for its filesystem usage.
+const guestFilesystemsInterval = time.Minute
+
+// ErrInvalidInterval is returned for a polling interval outside the allowed range.
+var ErrInvalidInterval = fmt.Errorf("interval must be 0 (inherit) or between %v and %v seconds",
+	MinStatsInterval.Seconds(), MaxStatsInterval.Seconds())
+
+// StatsInterval is a polling interval and the level it was configured at.
+type StatsInterval struct {
+	IntervalSeconds float64 `json:"stats_interval_seconds"`
+	Source          string  `json:"source"` // 'vm', 'host', 'global' or 'default'
+}
+
+// MonitoringSettingsView is the global monitoring configuration together with
+// its fixed bounds.
+type MonitoringSettingsView struct {
+	StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	MinIntervalSeconds   float64 `json:"min_interval_seconds"`
+	MaxIntervalSeconds   float64 `json:"max_interval_seconds"`
+}
+
+func validateInterval(seconds float64, allowInherit bool) error {
+	if seconds == 0 && allowInherit {
+		return nil
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	if d < MinStatsInterval || d > MaxStatsInterval {
+		return ErrInvalidInterval
+	}
+	return nil
+}
+
+// clampInterval applies the polling floor and ceiling.
+func clampInterval(d time.Duration) time.Duration {
+	if d < MinStatsInterval {
+		return MinStatsInterval
+	}
+	if d > MaxStatsInterval {
+		return MaxStatsInterval
+	}
+	return d
+}
+
+// GetMonitoringSettings returns the global monitoring configuration.
+func (s *HostService) GetMonitoringSettings() (*MonitoringSettingsView, error) {
+	view := &MonitoringSettingsView{
+		StatsIntervalSeconds: DefaultStatsInterval.Seconds(),
+		MinIntervalSeconds:   MinStatsInterval.Seconds(),
+		MaxIntervalSeconds:   MaxStatsInterval.Seconds(),
+	}
+	var settings storage.MonitoringSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	if settings.StatsIntervalSeconds > 0 {
+		view.StatsIntervalSeconds = settings.StatsIntervalSeconds
+	}
+	return view, nil
+}
+
+// SetMonitoringSettings changes the global default stats interval. Running
+// subscriptions pick up the change on their next poll.
+func (s *HostService) SetMonitoringSettings(intervalSeconds float64) (*MonitoringSettingsView, error) {
+	if err := validateInterval(intervalSeconds, false); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(&storage.MonitoringSettings{ID: 1, StatsIntervalSeconds: intervalSeconds}).Error; err != nil {
+		return nil, fmt.Errorf("failed to save monitoring settings: %w", err)
+	}
+	s.recordAudit("monitoring.update", "monitoring", "global", fmt.Sprintf("stats_interval=%gs", intervalSeconds))
+	s.monitor.refreshConfiguredIntervals()
+	return s.GetMonitoringSettings()
+}
+
+// SetHostStatsInterval overrides the stats interval for a host's VMs; 0
+// reverts to the global setting.
+func (s *HostService) SetHostStatsInterval(hostID string, intervalSeconds float64) error {
+	if err := validateInterval(intervalSeconds, true); err != nil {
+		return err
+	}
+	result := s.db.Model(&storage.Host{}).Where("id = ?", hostID).Update("stats_interval_seconds", intervalSeconds)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find host %s: %w", hostID, gorm.ErrRecordNotFound)
+	}
+	s.recordAudit("monitoring.update", "host", hostID, fmt.Sprintf("stats_interval=%gs", intervalSeconds))
+	s.monitor.refreshConfiguredIntervals()
+	return nil
+}
+
+// SetVMStatsInterval overrides the stats interval for a single VM; 0 reverts
+// to the host's or the global setting.
+func (s *HostService) SetVMStatsInterval(hostID, vmName string, intervalSeconds float64) (*StatsInterval, error) {
+	if err := validateInterval(intervalSeconds, true); err != nil {
+		return nil, err
+	}
+	result := s.db.Model(&storage.VirtualMachine{}).Where("host_id = ? AND name = ?", hostID, vmName).Update("stats_interval_seconds", intervalSeconds)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, fmt.Errorf("could not find VM %s on host %s: %w", vmName, hostID, gorm.ErrRecordNotFound)
+	}
+	s.recordAudit("monitoring.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), fmt.Sprintf("stats_interval=%gs", intervalSeconds))
+	s.monitor.refreshConfiguredIntervals()
+	return s.GetVMStatsInterval(hostID, vmName)
+}
+
+// GetVMStatsInterval returns the stats interval that applies to a VM and the
+// level it comes from.
+func (s *HostService) GetVMStatsInterval(hostID, vmName string) (*StatsInterval, error) {
+	var vm storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&vm).Error; err != nil {
+		return nil, fmt.Errorf("could not find VM %s on host %s: %w", vmName, hostID, err)
+	}
+	if vm.StatsIntervalSeconds > 0 {
+		return &StatsInterval{IntervalSeconds: vm.StatsIntervalSeconds, Source: "vm"}, nil
+	}
+	return s.hostStatsInterval(hostID)
+}
+
+// hostStatsInterval returns the stats interval that applies to a host's VMs
+// without an interval of their own.
+func (s *HostService) hostStatsInterval(hostID string) (*StatsInterval, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).Limit(1).Find(&host).Error; err != nil {
+		return nil, err
+	}
+	if host.StatsIntervalSeconds > 0 {
+		return &StatsInterval{IntervalSeconds: host.StatsIntervalSeconds, Source: "host"}, nil
+	}
+
+	var settings storage.MonitoringSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	if settings.StatsIntervalSeconds > 0 {
+		return &StatsInterval{IntervalSeconds: settings.StatsIntervalSeconds, Source: "global"}, nil
+	}
+	return &StatsInterval{IntervalSeconds: DefaultStatsInterval.Seconds(), Source: "default"}, nil
+}
+
+// configuredStatsInterval returns the interval configured for a VM, falling
+// back to the default if the settings cannot be read.
+func (s *HostService) configuredStatsInterval(hostID, vmName string) time.Duration {
+	interval, err := s.GetVMStatsInterval(hostID, vmName)
+	if err != nil {
+		return DefaultStatsInterval
+	}
+	return clampInterval(time.Duration(interval.IntervalSeconds * float64(time.Second)))
+}
+
+// configuredHostStatsInterval returns the interval configured for a host,
+// falling back to the default if the settings cannot be read.
+func (s *HostService) configuredHostStatsInterval(hostID string) time.Duration {
+	interval, err := s.hostStatsInterval(hostID)
+	if err != nil {
+		return DefaultStatsInterval
+	}
+	return clampInterval(time.Duration(interval.IntervalSeconds * float64(time.Second)))
+}
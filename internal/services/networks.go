@@ -0,0 +1,320 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidNetwork is returned for an incomplete or inconsistent network definition.
+	ErrInvalidNetwork = errors.New("a network needs a name, a bridge, a virtual port type of '' or 'openvswitch', and a VLAN ID of 0-4094")
+	// ErrNetworkExists is returned when a network name is already taken on a host.
+	ErrNetworkExists = errors.New("network already exists")
+	// ErrNetworkInUse is returned when deleting a network that NICs are bound to.
+	ErrNetworkInUse = errors.New("network is in use by VM interfaces")
+	// ErrNotLibvirtNetwork is returned when starting, stopping or changing
+	// the autostart of a network that is a plain bridge.
+	ErrNotLibvirtNetwork = errors.New("network is not a libvirt network")
+)
+
+// NetworkRequest defines a bridged network, optionally tagged with a VLAN.
+// Several networks can share a bridge with different VLANs. On Linux bridges
+// VLAN filtering must be enabled on the bridge itself.
+type NetworkRequest struct {
+	Name            string `json:"name"`
+	BridgeName      string `json:"bridge_name"`
+	VirtualPortType string `json:"virtualport_type"` // 'openvswitch' for OVS bridges, empty for Linux bridges
+	VLANID          uint   `json:"vlan_id"`          // 0 for untagged
+}
+
+// ListNetworks returns the networks known on a host, both defined ones and
+// those discovered from VM interfaces. Networks defined in libvirt are
+// recorded on first sight and carry their live state. When the host cannot
+// be reached the stored networks are returned without it.
+func (s *HostService) ListNetworks(hostID string) ([]storage.Network, error) {
+	live, err := s.connector.ListVirtualNetworks(hostID)
+	if err != nil {
+		log.Printf("Warning: could not list libvirt networks of host %s: %v", hostID, err)
+	}
+	for _, info := range live {
+		s.recordVirtualNetwork(hostID, info)
+	}
+
+	networks := []storage.Network{}
+	if err := s.db.Where("host_id = ?", hostID).Order("name").Find(&networks).Error; err != nil {
+		return nil, err
+	}
+	byName := make(map[string]libvirt.VirtualNetworkInfo, len(live))
+	for _, info := range live {
+		byName[info.Name] = info
+	}
+	for i := range networks {
+		if info, ok := byName[networks[i].Name]; ok {
+			networks[i].LibvirtNetwork = true
+			networks[i].Active = info.Active
+			networks[i].Autostart = info.Autostart
+		}
+	}
+	return networks, nil
+}
+
+// recordVirtualNetwork stores a libvirt network that is not known yet.
+func (s *HostService) recordVirtualNetwork(hostID string, info libvirt.VirtualNetworkInfo) {
+	mode := info.Forward
+	switch mode {
+	case "":
+		mode = "isolated"
+	case "bridge":
+		mode = "bridged"
+	}
+	network := storage.Network{
+		HostID:     hostID,
+		Name:       info.Name,
+		UUID:       info.UUID,
+		BridgeName: info.Bridge,
+		Mode:       mode,
+	}
+	err := s.db.Where("host_id = ? AND name = ?", hostID, info.Name).FirstOrCreate(&network).Error
+	if err != nil {
+		log.Printf("Warning: failed to record network %s of host %s: %v", info.Name, hostID, err)
+	}
+}
+
+// SetNetworkAutostart sets whether a libvirt network is started with
+// libvirtd and returns it with its new state.
+func (s *HostService) SetNetworkAutostart(hostID, name string, enabled bool) (*storage.Network, error) {
+	if err := s.requireVirtualNetwork(hostID, name); err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetNetworkAutostart(hostID, name, enabled); err != nil {
+		return nil, err
+	}
+	s.recordAudit("network.autostart", "network", fmt.Sprintf("%s/%s", hostID, name), fmt.Sprintf("enabled=%t", enabled))
+	return s.getNetworkState(hostID, name)
+}
+
+// SetNetworkActive starts or stops a libvirt network and returns it with
+// its new state.
+func (s *HostService) SetNetworkActive(hostID, name string, active bool) (*storage.Network, error) {
+	if err := s.requireVirtualNetwork(hostID, name); err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetNetworkActive(hostID, name, active); err != nil {
+		return nil, err
+	}
+	action := "network.stop"
+	if active {
+		action = "network.start"
+	}
+	s.recordAudit(action, "network", fmt.Sprintf("%s/%s", hostID, name), "")
+	return s.getNetworkState(hostID, name)
+}
+
+// requireVirtualNetwork checks that a network is known and defined in libvirt.
+func (s *HostService) requireVirtualNetwork(hostID, name string) error {
+	network, err := s.getNetworkState(hostID, name)
+	if err != nil {
+		return err
+	}
+	if !network.LibvirtNetwork {
+		return fmt.Errorf("%w: %s", ErrNotLibvirtNetwork, name)
+	}
+	return nil
+}
+
+// getNetworkState returns a network with the live state of its libvirt
+// network, if it has one.
+func (s *HostService) getNetworkState(hostID, name string) (*storage.Network, error) {
+	networks, err := s.ListNetworks(hostID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range networks {
+		if networks[i].Name == name {
+			return &networks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("could not find network %s on host %s: %w", name, hostID, gorm.ErrRecordNotFound)
+}
+
+// CreateNetwork defines a network on a host.
+func (s *HostService) CreateNetwork(hostID string, req NetworkRequest) (*storage.Network, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || req.BridgeName == "" || req.VLANID > libvirt.MaxVLANID ||
+		(req.VirtualPortType != "" && req.VirtualPortType != libvirt.VirtualPortOVS) {
+		return nil, ErrInvalidNetwork
+	}
+
+	var count int64
+	if err := s.db.Unscoped().Model(&storage.Network{}).Where("host_id = ? AND name = ?", hostID, req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s on host %s", ErrNetworkExists, req.Name, hostID)
+	}
+
+	network := storage.Network{
+		HostID:          hostID,
+		Name:            req.Name,
+		UUID:            uuid.New().String(),
+		BridgeName:      req.BridgeName,
+		Mode:            "bridged",
+		VirtualPortType: req.VirtualPortType,
+		VLANID:          req.VLANID,
+	}
+	if err := s.db.Create(&network).Error; err != nil {
+		return nil, fmt.Errorf("failed to save network: %w", err)
+	}
+	s.recordAudit("network.create", "network", fmt.Sprintf("%s/%s", hostID, req.Name),
+		fmt.Sprintf("bridge=%s virtualport=%s vlan=%d", req.BridgeName, req.VirtualPortType, req.VLANID))
+	return &network, nil
+}
+
+// DeleteNetwork removes a network definition that no NIC is bound to.
+func (s *HostService) DeleteNetwork(hostID, name string) error {
+	network, err := s.deletableNetwork(hostID, name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Unscoped().Delete(network).Error; err != nil {
+		return err
+	}
+	s.recordAudit("network.delete", "network", fmt.Sprintf("%s/%s", hostID, name), "")
+	return nil
+}
+
+// deletableNetwork returns a network after checking that no NIC is bound to it.
+func (s *HostService) deletableNetwork(hostID, name string) (*storage.Network, error) {
+	var network storage.Network
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, name).First(&network).Error; err != nil {
+		return nil, fmt.Errorf("could not find network %s on host %s: %w", name, hostID, err)
+	}
+	var bound int64
+	if err := s.db.Model(&storage.PortBinding{}).Where("network_id = ?", network.ID).Count(&bound).Error; err != nil {
+		return nil, err
+	}
+	if bound > 0 {
+		return nil, fmt.Errorf("%w: %d interface(s) on %s", ErrNetworkInUse, bound, name)
+	}
+	return &network, nil
+}
+
+// resolveNICNetwork picks the network a NIC found during sync belongs to and
+// the VLAN it is tagged with. VLANs on Linux bridges are applied outside of
+// libvirt, so for those the previous binding is kept; OVS tags are read from
+// the interface XML. NICs on a bridge without a matching network are bound to
+// a network named after the bridge, which is created on first sight.
+func resolveNICNetwork(tx *gorm.DB, hostID string, nic libvirt.NetworkInfo, previous *storage.PortBinding) (storage.Network, uint) {
+	bridge := nic.Source.Bridge
+	vlanID := nic.VLANID()
+
+	if previous != nil && previous.Network.BridgeName == bridge {
+		if previous.Network.VirtualPortType != libvirt.VirtualPortOVS {
+			return previous.Network, previous.VLANID
+		}
+		if vlanID == previous.VLANID {
+			return previous.Network, vlanID
+		}
+	}
+
+	var network storage.Network
+	if vlanID != 0 {
+		err := tx.Where("host_id = ? AND bridge_name = ? AND vlan_id = ?", hostID, bridge, vlanID).Order("id").First(&network).Error
+		if err == nil {
+			return network, vlanID
+		}
+	}
+
+	virtualPortType := ""
+	if nic.VirtualPort != nil {
+		virtualPortType = nic.VirtualPort.Type
+	}
+	networkUUID := uuid.NewSHA1(uuid.Nil, []byte(fmt.Sprintf("%s:%s", hostID, bridge)))
+	tx.FirstOrCreate(&network, storage.Network{UUID: networkUUID.String()}, storage.Network{
+		HostID:          hostID,
+		Name:            bridge,
+		BridgeName:      bridge,
+		Mode:            "bridged",
+		UUID:            networkUUID.String(),
+		VirtualPortType: virtualPortType,
+	})
+	return network, vlanID
+}
+
+// bindNIC records the network and VLAN chosen for a NIC, which sync cannot
+// derive from the domain XML on Linux bridges.
+func (s *HostService) bindNIC(mac string, network *storage.Network, vlanID uint) error {
+	var port storage.Port
+	if err := s.db.Where("mac_address = ?", mac).First(&port).Error; err != nil {
+		return fmt.Errorf("could not find interface %s: %w", mac, err)
+	}
+	if err := s.db.Where("port_id = ?", port.ID).Delete(&storage.PortBinding{}).Error; err != nil {
+		return err
+	}
+	return s.db.Create(&storage.PortBinding{PortID: port.ID, NetworkID: network.ID, VLANID: vlanID}).Error
+}
+
+// applyBridgeVLANs tags the tap devices of a running VM's NICs that are on
+// VLANs of Linux bridges. libvirt handles OVS VLANs itself.
+func (s *HostService) applyBridgeVLANs(ctx context.Context, hostID, vmName string) (err error) {
+	ctx, span := tracing.Start(ctx, "HostService.applyBridgeVLANs", tracing.Host(hostID), tracing.VM(vmName))
+	defer func() { tracing.End(span, err) }()
+	db := s.db.WithContext(ctx)
+
+	var vm storage.VirtualMachine
+	if err := db.Where("host_id = ? AND name = ?", hostID, vmName).First(&vm).Error; err != nil {
+		return err
+	}
+	var bindings []storage.PortBinding
+	err = db.Preload("Port").Preload("Network").
+		Joins("JOIN ports ON ports.id = port_bindings.port_id AND ports.deleted_at IS NULL").
+		Where("ports.vm_id = ? AND port_bindings.vlan_id > 0", vm.ID).
+		Find(&bindings).Error
+	if err != nil {
+		return err
+	}
+
+	var pending []storage.PortBinding
+	for _, b := range bindings {
+		if b.Network.VirtualPortType != libvirt.VirtualPortOVS {
+			pending = append(pending, b)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	taps := make(map[string]string)
+	for _, nic := range hardware.Networks {
+		taps[strings.ToLower(nic.Mac.Address)] = nic.Target.Dev
+	}
+	for _, b := range pending {
+		tap := taps[b.Port.MACAddress]
+		if tap == "" {
+			log.Printf("Warning: no tap device for interface %s of VM %s; VLAN %d not applied", b.Port.MACAddress, vmName, b.VLANID)
+			continue
+		}
+		_, vlanSpan := tracing.Start(ctx, "ssh.SetBridgePortVLAN", tracing.Host(hostID),
+			attribute.String("virtumancer.tap_device", tap), attribute.Int("virtumancer.vlan_id", int(b.VLANID)))
+		err := s.connector.SetBridgePortVLAN(hostID, tap, b.VLANID)
+		tracing.End(vlanSpan, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+// maxNotificationSubscriptions bounds the subscriptions of one user.
+const maxNotificationSubscriptions = 100
+
+// Bounds on the number of notifications returned by one query.
+const (
+	defaultNotificationLimit = 50
+	maxNotificationLimit     = 500
+)
+
+// eventTypes are the events that can be subscribed to.
+var eventTypes = []string{
+	EventVMStateChanged,
+	EventVMsSynced,
+	EventVMMigrated,
+	EventVMRecovered,
+	EventSyncFailed,
+	EventHostConnected,
+	EventHostConnectionFailed,
+	EventHostDisconnected,
+	EventHostRemoved,
+	EventHostDead,
+	EventHostFenced,
+	EventAlertRaised,
+	EventAlertResolved,
+	EventTaskInterrupted,
+	EventRunbookNotification,
+}
+
+// NotificationSubscriptionRequest creates a subscription. Empty fields match
+// anything; at least one should be set to keep the volume down.
+type NotificationSubscriptionRequest struct {
+	EventType string `json:"event_type"`
+	HostID    string `json:"host_id"`
+	VMName    string `json:"vm_name"`
+	Selector  string `json:"selector"`
+}
+
+// NotificationList is a page of a user's notifications with the number of
+// unread ones overall.
+type NotificationList struct {
+	Unread        int64                  `json:"unread"`
+	Notifications []storage.Notification `json:"notifications"`
+}
+
+// ListNotificationSubscriptions returns the subscriptions of a user.
+func (s *HostService) ListNotificationSubscriptions(userID uint) ([]storage.NotificationSubscription, error) {
+	subs := []storage.NotificationSubscription{}
+	err := s.db.Where("user_id = ?", userID).Order("id").Find(&subs).Error
+	return subs, err
+}
+
+// CreateNotificationSubscription subscribes a user to events.
+func (s *HostService) CreateNotificationSubscription(userID uint, req NotificationSubscriptionRequest) (*storage.NotificationSubscription, error) {
+	var v validator
+	if req.EventType != "" && !slices.Contains(eventTypes, req.EventType) {
+		v.add("event_type", "unknown event type '%s'", req.EventType)
+	}
+	if req.VMName != "" && req.HostID == "" {
+		v.add("vm_name", "needs a host_id, as VM names are only unique per host")
+	}
+	var selectorErr *ValidationError
+	if _, err := ParseSelector(req.Selector); errors.As(err, &selectorErr) {
+		v.fields = append(v.fields, selectorErr.Fields...)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if req.HostID != "" {
+		var host storage.Host
+		if err := s.db.Where("id = ?", req.HostID).First(&host).Error; err != nil {
+			return nil, fmt.Errorf("could not find host %s: %w", req.HostID, err)
+		}
+	}
+
+	var count int64
+	if err := s.db.Model(&storage.NotificationSubscription{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count >= maxNotificationSubscriptions {
+		v.add("subscriptions", "a user can have at most %d subscriptions", maxNotificationSubscriptions)
+		return nil, v.err()
+	}
+
+	sub := storage.NotificationSubscription{
+		UserID:    userID,
+		EventType: req.EventType,
+		HostID:    req.HostID,
+		VMName:    req.VMName,
+		Selector:  req.Selector,
+	}
+	if err := s.db.Create(&sub).Error; err != nil {
+		return nil, fmt.Errorf("failed to save subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+// DeleteNotificationSubscription removes a subscription of a user.
+func (s *HostService) DeleteNotificationSubscription(userID, id uint) error {
+	result := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&storage.NotificationSubscription{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find subscription %d: %w", id, gorm.ErrRecordNotFound)
+	}
+	return nil
+}
+
+// ListNotifications returns a user's notifications, newest first.
+func (s *HostService) ListNotifications(userID uint, unreadOnly bool, limit int) (*NotificationList, error) {
+	if limit <= 0 {
+		limit = defaultNotificationLimit
+	}
+	if limit > maxNotificationLimit {
+		limit = maxNotificationLimit
+	}
+	list := &NotificationList{Notifications: []storage.Notification{}}
+	if err := s.db.Model(&storage.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Count(&list.Unread).Error; err != nil {
+		return nil, err
+	}
+	query := s.db.Where("user_id = ?", userID)
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+	if err := query.Order("created_at desc, id desc").Limit(limit).Find(&list.Notifications).Error; err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// MarkNotificationRead marks a notification of a user as read or unread.
+func (s *HostService) MarkNotificationRead(userID, id uint, read bool) error {
+	var readAt *time.Time
+	if read {
+		now := time.Now()
+		readAt = &now
+	}
+	result := s.db.Model(&storage.Notification{}).Where("id = ? AND user_id = ?", id, userID).Update("read_at", readAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find notification %d: %w", id, gorm.ErrRecordNotFound)
+	}
+	s.broadcastNotificationsChanged(userID)
+	return nil
+}
+
+// MarkAllNotificationsRead marks every unread notification of a user as read.
+func (s *HostService) MarkAllNotificationsRead(userID uint) error {
+	err := s.db.Model(&storage.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Update("read_at", time.Now()).Error
+	if err != nil {
+		return err
+	}
+	s.broadcastNotificationsChanged(userID)
+	return nil
+}
+
+// DeleteNotification removes a notification of a user.
+func (s *HostService) DeleteNotification(userID, id uint) error {
+	result := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&storage.Notification{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find notification %d: %w", id, gorm.ErrRecordNotFound)
+	}
+	s.broadcastNotificationsChanged(userID)
+	return nil
+}
+
+// broadcastNotificationsChanged tells the other open sessions of a user to
+// refresh their notifications.
+func (s *HostService) broadcastNotificationsChanged(userID uint) {
+	s.hub.SendToUser(userID, ws.Message{Type: "notifications-changed"})
+}
+
+// notifySubscribers delivers an event to every user with a matching
+// subscription, once per user, and pushes it to their open sessions.
+// Failures are logged but never block the operation that raised the event.
+func (s *HostService) notifySubscribers(event storage.Event) {
+	var subs []storage.NotificationSubscription
+	if err := s.db.Order("id").Find(&subs).Error; err != nil {
+		log.Printf("Warning: failed to load notification subscriptions: %v", err)
+		return
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	var labels map[string]string
+	if event.VMName != "" && slices.ContainsFunc(subs, func(sub storage.NotificationSubscription) bool { return sub.Selector != "" }) {
+		var vm storage.VirtualMachine
+		if err := s.db.Where("host_id = ? AND name = ?", event.HostID, event.VMName).Limit(1).Find(&vm).Error; err == nil && vm.ID != 0 {
+			labels, _ = labelsOf(s.db, vm.ID)
+		}
+	}
+
+	notified := make(map[uint]bool)
+	for _, sub := range subs {
+		if notified[sub.UserID] || !subscriptionMatches(sub, event, labels) {
+			continue
+		}
+		notified[sub.UserID] = true
+		if !s.eventVisibleTo(sub.UserID, event) {
+			continue
+		}
+		notification := storage.Notification{
+			UserID:  sub.UserID,
+			EventID: event.ID,
+			Type:    event.Type,
+			HostID:  event.HostID,
+			VMName:  event.VMName,
+			Message: event.Message,
+		}
+		if err := s.db.Create(&notification).Error; err != nil {
+			log.Printf("Warning: failed to save %s notification for user %d: %v", event.Type, sub.UserID, err)
+			continue
+		}
+		s.hub.SendToUser(sub.UserID, ws.Message{
+			Type:    "notification",
+			Payload: ws.MessagePayload{"notification": notification},
+		})
+	}
+}
+
+// subscriptionMatches reports whether an event falls under a subscription.
+// labels are those of the event's VM, nil when there is none.
+func subscriptionMatches(sub storage.NotificationSubscription, event storage.Event, labels map[string]string) bool {
+	if sub.EventType != "" && sub.EventType != event.Type {
+		return false
+	}
+	if sub.HostID != "" && sub.HostID != event.HostID {
+		return false
+	}
+	if sub.VMName != "" && sub.VMName != event.VMName {
+		return false
+	}
+	if sub.Selector != "" {
+		sel, err := ParseSelector(sub.Selector)
+		if err != nil || labels == nil || !sel.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// eventVisibleTo reports whether a user may see an event: enabled users
+// can, unless projects are in use and the event's VM or host is outside
+// their projects.
+func (s *HostService) eventVisibleTo(userID uint, event storage.Event) bool {
+	var user storage.User
+	if err := s.db.Limit(1).Find(&user, userID).Error; err != nil || user.ID == 0 || user.Disabled {
+		return false
+	}
+	enabled, err := s.ProjectsEnabled()
+	if err != nil || !enabled {
+		return err == nil
+	}
+	scope, err := s.ProjectScopeFor(&user)
+	if err != nil || scope == nil {
+		return err == nil
+	}
+	switch {
+	case event.VMName != "":
+		projectID, err := s.ResourceProject(ResourceVM, event.HostID, event.VMName)
+		return err == nil && scope.Allows(projectID, ProjectViewer)
+	case event.HostID != "":
+		visible, err := s.HostVisible(scope, event.HostID)
+		return err == nil && visible
+	}
+	return false
+}
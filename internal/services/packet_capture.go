@@ -0,0 +1,226 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// PermissionManageCaptures allows taking, downloading and deleting packet
+// captures, which can hold the traffic of any VM.
+const PermissionManageCaptures = "captures.manage"
+
+// Bounds applied to every packet capture to protect the hypervisor and the
+// server's disk.
+const (
+	captureDir             = "captures"
+	defaultCaptureSeconds  = 30
+	maxCaptureSeconds      = 300
+	defaultCapturePackets  = 10000
+	maxCapturePackets      = 100000
+	maxCaptureBytes        = 100 << 20
+	defaultCaptureSnaplen  = 65535
+	captureTimeoutExitCode = 124 // returned by timeout(1) when it stops tcpdump
+)
+
+var (
+	// ErrInvalidCaptureRequest is returned when capture limits are out of range.
+	ErrInvalidCaptureRequest = errors.New("invalid packet capture request")
+	// ErrInterfaceNotFound is returned when a VM has no matching host-side interface.
+	ErrInterfaceNotFound = errors.New("interface not found; the VM must be running")
+)
+
+// PacketCaptureRequest starts a capture on a VM's tap device.
+type PacketCaptureRequest struct {
+	Interface       string `json:"interface"` // Tap device or MAC address; defaults to the first NIC
+	Filter          string `json:"filter"`    // Optional BPF filter, e.g. 'tcp port 443'
+	DurationSeconds int    `json:"duration_seconds"`
+	MaxPackets      int    `json:"max_packets"`
+	Snaplen         int    `json:"snaplen"`
+}
+
+// capLimitWriter writes to a file until its byte budget is used up and
+// silently drops the rest, so a capture can never exceed its size budget.
+type capLimitWriter struct {
+	file      *os.File
+	remaining int64
+	written   int64
+	truncated bool
+}
+
+func (w *capLimitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if int64(len(p)) > w.remaining {
+		p = p[:w.remaining]
+		w.truncated = true
+	}
+	if len(p) > 0 {
+		written, err := w.file.Write(p)
+		w.remaining -= int64(written)
+		w.written += int64(written)
+		if err != nil {
+			return written, err
+		}
+	}
+	return n, nil
+}
+
+// StartPacketCapture runs a bounded tcpdump on the host-side device of a VM
+// NIC over the host's SSH channel. The capture runs as a task and the pcap is
+// kept on the server for download.
+func (s *HostService) StartPacketCapture(hostID, vmName string, req PacketCaptureRequest) (*storage.PacketCapture, error) {
+	if req.DurationSeconds == 0 {
+		req.DurationSeconds = defaultCaptureSeconds
+	}
+	if req.MaxPackets == 0 {
+		req.MaxPackets = defaultCapturePackets
+	}
+	if req.Snaplen == 0 {
+		req.Snaplen = defaultCaptureSnaplen
+	}
+	if req.DurationSeconds < 1 || req.DurationSeconds > maxCaptureSeconds ||
+		req.MaxPackets < 1 || req.MaxPackets > maxCapturePackets ||
+		req.Snaplen < 64 || req.Snaplen > 65535 {
+		return nil, fmt.Errorf("%w: duration must be 1-%d seconds, packets 1-%d and snaplen 64-65535",
+			ErrInvalidCaptureRequest, maxCaptureSeconds, maxCapturePackets)
+	}
+	if strings.HasPrefix(strings.TrimSpace(req.Filter), "-") {
+		return nil, fmt.Errorf("%w: the filter must not start with '-'", ErrInvalidCaptureRequest)
+	}
+
+	device, err := s.resolveTapDevice(hostID, vmName, req.Interface)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(captureDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %w", err)
+	}
+
+	task, err := s.tasks.Start("vm.packet-capture", fmt.Sprintf("Capturing on %s of %s for up to %ds", device, vmName, req.DurationSeconds))
+	if err != nil {
+		return nil, err
+	}
+	capture := &storage.PacketCapture{
+		HostID:          hostID,
+		VMName:          vmName,
+		Interface:       device,
+		Filter:          req.Filter,
+		DurationSeconds: req.DurationSeconds,
+		MaxPackets:      req.MaxPackets,
+		TaskID:          task.ID,
+	}
+	if err := s.db.Create(capture).Error; err != nil {
+		s.tasks.Finish(task, err)
+		return nil, fmt.Errorf("failed to save packet capture: %w", err)
+	}
+	capture.FilePath = filepath.Join(captureDir, fmt.Sprintf("capture-%d.pcap", capture.ID))
+	s.db.Model(capture).Update("file_path", capture.FilePath)
+
+	s.recordAudit("vm.packet-capture", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("interface=%s filter=%q duration=%ds packets=%d", device, req.Filter, req.DurationSeconds, req.MaxPackets))
+
+	// The capture records its size once done; the caller gets it as it starts
+	started := *capture
+	go func() {
+		err := s.runPacketCapture(capture, req.Snaplen)
+		if err != nil {
+			log.Printf("Packet capture %d on %s/%s failed: %v", capture.ID, hostID, vmName, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+
+	return &started, nil
+}
+
+func (s *HostService) runPacketCapture(capture *storage.PacketCapture, snaplen int) error {
+	file, err := os.OpenFile(capture.FilePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+	defer file.Close()
+
+	command := fmt.Sprintf("timeout --signal=INT %d tcpdump -i %s -U -w - -c %d -s %d",
+		capture.DurationSeconds, libvirt.ShellQuote(capture.Interface), capture.MaxPackets, snaplen)
+	if capture.Filter != "" {
+		// After "--" so that tcpdump never reads the filter as options.
+		command += " -- " + libvirt.ShellQuote(capture.Filter)
+	}
+	// timeout(1) exits non-zero when the capture runs its full duration.
+	command += fmt.Sprintf("; rc=$?; [ $rc -eq %d ] && exit 0; exit $rc", captureTimeoutExitCode)
+
+	writer := &capLimitWriter{file: file, remaining: maxCaptureBytes}
+	err = s.connector.StreamHostCommand(capture.HostID, command, writer)
+
+	capture.SizeBytes = writer.written
+	capture.Truncated = writer.truncated
+	if dbErr := s.db.Model(capture).Updates(map[string]interface{}{
+		"size_bytes": capture.SizeBytes,
+		"truncated":  capture.Truncated,
+	}).Error; dbErr != nil {
+		log.Printf("Warning: failed to update packet capture %d: %v", capture.ID, dbErr)
+	}
+	return err
+}
+
+// resolveTapDevice finds the host-side device of a VM NIC by device name or
+// MAC address, defaulting to the first NIC.
+func (s *HostService) resolveTapDevice(hostID, vmName, iface string) (string, error) {
+	hardware, err := s.connector.GetDomainHardware(hostID, vmName)
+	if err != nil {
+		return "", err
+	}
+	for _, nic := range hardware.Networks {
+		if nic.Target.Dev == "" {
+			continue
+		}
+		if iface == "" || nic.Target.Dev == iface || strings.EqualFold(nic.Mac.Address, iface) {
+			return nic.Target.Dev, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s on %s", ErrInterfaceNotFound, valueOr(iface, "any NIC"), vmName)
+}
+
+// ListPacketCaptures returns the stored captures, newest first.
+func (s *HostService) ListPacketCaptures() ([]storage.PacketCapture, error) {
+	var captures []storage.PacketCapture
+	if err := s.db.Order("id desc").Find(&captures).Error; err != nil {
+		return nil, err
+	}
+	return captures, nil
+}
+
+// OpenPacketCapture returns a capture for download, including the path of its
+// pcap file, and records the access.
+func (s *HostService) OpenPacketCapture(id uint) (*storage.PacketCapture, error) {
+	var capture storage.PacketCapture
+	if err := s.db.First(&capture, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find packet capture %d: %w", id, err)
+	}
+	s.recordAudit("vm.packet-capture.download", "packet_capture", fmt.Sprint(id), "")
+	return &capture, nil
+}
+
+// DeletePacketCapture removes a capture and its pcap file.
+func (s *HostService) DeletePacketCapture(id uint) error {
+	var capture storage.PacketCapture
+	if err := s.db.First(&capture, id).Error; err != nil {
+		return fmt.Errorf("could not find packet capture %d: %w", id, err)
+	}
+	if capture.FilePath != "" {
+		if err := os.Remove(capture.FilePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete capture file: %w", err)
+		}
+	}
+	if err := s.db.Unscoped().Delete(&capture).Error; err != nil {
+		return err
+	}
+	s.recordAudit("vm.packet-capture.delete", "packet_capture", fmt.Sprint(id), "")
+	return nil
+}
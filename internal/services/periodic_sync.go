@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Reads of VMs come from the database, so the VMs of every connected host
+// are reconciled with libvirt in the background. Each host has its own
+// cadence: after a sync that found changes it is synced again at the active
+// interval, and every quiet sync doubles the wait until it is back at the
+// configured interval. Failing hosts back off further, up to
+// MaxSyncInterval. Refreshing a host or VM syncs it at once.
+const (
+	DefaultSyncInterval       = 5 * time.Minute
+	DefaultActiveSyncInterval = time.Minute
+	MinSyncInterval           = 30 * time.Second
+	MaxSyncInterval           = 24 * time.Hour
+
+	// syncJitter spreads syncs by up to this share of their interval either
+	// way, so hosts added together do not stay in lockstep.
+	syncJitter = 0.1
+
+	// syncCheckInterval is how often the scheduler looks for hosts due for
+	// a sync.
+	syncCheckInterval = 10 * time.Second
+)
+
+// SyncSettingsView is the periodic sync configuration with its defaults
+// filled in.
+type SyncSettingsView struct {
+	IntervalSeconds       uint `json:"interval_seconds"`
+	ActiveIntervalSeconds uint `json:"active_interval_seconds"`
+	MinIntervalSeconds    uint `json:"min_interval_seconds"`
+	MaxIntervalSeconds    uint `json:"max_interval_seconds"`
+}
+
+func (v *SyncSettingsView) interval() time.Duration {
+	return time.Duration(v.IntervalSeconds) * time.Second
+}
+
+func (v *SyncSettingsView) activeInterval() time.Duration {
+	return time.Duration(v.ActiveIntervalSeconds) * time.Second
+}
+
+// HostSyncStatus is where a host stands in the periodic sync.
+type HostSyncStatus struct {
+	HostID              string     `json:"host_id"`
+	Running             bool       `json:"running"`
+	IntervalSeconds     float64    `json:"interval_seconds"` // Current wait between syncs, before jitter
+	LastSyncAt          *time.Time `json:"last_sync_at"`
+	LastChangedAt       *time.Time `json:"last_changed_at"` // Last sync that found changes
+	NextSyncAt          time.Time  `json:"next_sync_at"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// syncSchedule tracks the cadence of every host's periodic sync.
+type syncSchedule struct {
+	mu    sync.Mutex
+	hosts map[string]*hostSchedule
+}
+
+type hostSchedule struct {
+	running       bool
+	interval      time.Duration
+	nextAt        time.Time
+	lastAt        time.Time
+	lastChangedAt time.Time
+	lastSuccessAt time.Time
+	failures      int
+	lastError     string
+}
+
+func newSyncSchedule() *syncSchedule {
+	return &syncSchedule{hosts: make(map[string]*hostSchedule)}
+}
+
+// jittered varies d by up to syncJitter either way.
+func jittered(d time.Duration) time.Duration {
+	return time.Duration(float64(d) * (1 + syncJitter*(2*rand.Float64()-1)))
+}
+
+// host returns the schedule of a host, adding it with its first sync at a
+// random point of the interval so hosts connected together are spread out.
+// The lock must be held.
+func (q *syncSchedule) host(hostID string, settings *SyncSettingsView) *hostSchedule {
+	h, ok := q.hosts[hostID]
+	if !ok {
+		h = &hostSchedule{
+			interval: settings.interval(),
+			nextAt:   time.Now().Add(time.Duration(rand.Int64N(int64(settings.interval())))),
+		}
+		q.hosts[hostID] = h
+	}
+	return h
+}
+
+// due marks the connected hosts whose next sync has come as running and
+// returns them. Hosts that disconnected are forgotten.
+func (q *syncSchedule) due(connected []string, settings *SyncSettingsView) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	present := make(map[string]bool, len(connected))
+	var due []string
+	now := time.Now()
+	for _, hostID := range connected {
+		present[hostID] = true
+		h := q.host(hostID, settings)
+		if !h.running && !now.Before(h.nextAt) {
+			h.running = true
+			due = append(due, hostID)
+		}
+	}
+	for hostID, h := range q.hosts {
+		if !present[hostID] && !h.running {
+			delete(q.hosts, hostID)
+		}
+	}
+	return due
+}
+
+// record schedules a host's next sync from the outcome of the last one.
+func (q *syncSchedule) record(hostID string, changed bool, err error, settings *SyncSettingsView) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	h := q.host(hostID, settings)
+	now := time.Now()
+	h.running = false
+	h.lastAt = now
+	switch {
+	case err != nil:
+		h.failures++
+		h.lastError = err.Error()
+		h.interval = min(settings.interval()<<min(h.failures, 16), MaxSyncInterval)
+	case changed:
+		h.failures, h.lastError = 0, ""
+		h.lastChangedAt, h.lastSuccessAt = now, now
+		h.interval = settings.activeInterval()
+	default:
+		h.failures, h.lastError = 0, ""
+		h.lastSuccessAt = now
+		h.interval = min(max(h.interval*2, settings.activeInterval()), settings.interval())
+	}
+	h.nextAt = now.Add(jittered(h.interval))
+}
+
+// outcome returns when a host was last synced successfully, zero if it has
+// not been since it connected, how many syncs have failed since and the
+// last error.
+func (q *syncSchedule) outcome(hostID string) (time.Time, int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	h, ok := q.hosts[hostID]
+	if !ok {
+		return time.Time{}, 0, ""
+	}
+	return h.lastSuccessAt, h.failures, h.lastError
+}
+
+// release ends a run that produced no outcome, e.g. for a host that was
+// removed meanwhile.
+func (q *syncSchedule) release(hostID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if h, ok := q.hosts[hostID]; ok {
+		h.running = false
+	}
+}
+
+// GetSyncSettings returns the periodic sync configuration.
+func (s *HostService) GetSyncSettings() (*SyncSettingsView, error) {
+	var settings storage.SyncSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	view := &SyncSettingsView{
+		IntervalSeconds:       settings.IntervalSeconds,
+		ActiveIntervalSeconds: settings.ActiveIntervalSeconds,
+		MinIntervalSeconds:    uint(MinSyncInterval.Seconds()),
+		MaxIntervalSeconds:    uint(MaxSyncInterval.Seconds()),
+	}
+	if view.IntervalSeconds == 0 {
+		view.IntervalSeconds = uint(DefaultSyncInterval.Seconds())
+	}
+	if view.ActiveIntervalSeconds == 0 {
+		view.ActiveIntervalSeconds = min(uint(DefaultActiveSyncInterval.Seconds()), view.IntervalSeconds)
+	}
+	return view, nil
+}
+
+// SetSyncSettings changes the intervals of the periodic sync. Hosts pick
+// them up after their next sync.
+func (s *HostService) SetSyncSettings(req SyncSettingsView) (*SyncSettingsView, error) {
+	var v validator
+	interval := time.Duration(req.IntervalSeconds) * time.Second
+	if interval != 0 && (interval < MinSyncInterval || interval > MaxSyncInterval) {
+		v.add("interval_seconds", "must be 0 (default) or between %v and %v", MinSyncInterval.Seconds(), MaxSyncInterval.Seconds())
+	}
+	active := time.Duration(req.ActiveIntervalSeconds) * time.Second
+	if active != 0 && (active < MinSyncInterval || active > MaxSyncInterval) {
+		v.add("active_interval_seconds", "must be 0 (default) or between %v and %v", MinSyncInterval.Seconds(), MaxSyncInterval.Seconds())
+	}
+	if interval == 0 {
+		interval = DefaultSyncInterval
+	}
+	if active > interval {
+		v.add("active_interval_seconds", "must not be longer than interval_seconds")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	row := storage.SyncSettings{ID: 1, IntervalSeconds: req.IntervalSeconds, ActiveIntervalSeconds: req.ActiveIntervalSeconds}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save sync settings: %w", err)
+	}
+	s.recordAudit("sync.update", "sync", "global",
+		fmt.Sprintf("interval_seconds=%d active_interval_seconds=%d", req.IntervalSeconds, req.ActiveIntervalSeconds))
+	return s.GetSyncSettings()
+}
+
+// GetSyncStatus returns the periodic sync schedule of the connected hosts,
+// ordered by next sync.
+func (s *HostService) GetSyncStatus() []HostSyncStatus {
+	q := s.syncSchedule
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	statuses := make([]HostSyncStatus, 0, len(q.hosts))
+	for hostID, h := range q.hosts {
+		status := HostSyncStatus{
+			HostID:              hostID,
+			Running:             h.running,
+			IntervalSeconds:     h.interval.Seconds(),
+			NextSyncAt:          h.nextAt,
+			ConsecutiveFailures: h.failures,
+			LastError:           h.lastError,
+		}
+		if !h.lastAt.IsZero() {
+			lastAt := h.lastAt
+			status.LastSyncAt = &lastAt
+		}
+		if !h.lastChangedAt.IsZero() {
+			lastChangedAt := h.lastChangedAt
+			status.LastChangedAt = &lastChangedAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].NextSyncAt.Before(statuses[j].NextSyncAt) })
+	return statuses
+}
+
+// StartPeriodicSync syncs the VMs of every connected host when its schedule
+// says so. Hosts are synced in parallel, each at most once at a time.
+func (s *HostService) StartPeriodicSync() {
+	ticker := time.NewTicker(syncCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		settings, err := s.GetSyncSettings()
+		if err != nil {
+			log.Printf("Warning: failed to load sync settings: %v", err)
+			continue
+		}
+		for _, hostID := range s.syncSchedule.due(s.connector.ConnectedHostIDs(), settings) {
+			go s.SyncVMsForHost(hostID)
+		}
+	}
+}
+
+// reconcileHost syncs a host's VMs, archives their changed definitions and
+// schedules its next periodic sync from the outcome.
+func (s *HostService) reconcileHost(hostID string) (bool, error) {
+	changed, err := s.syncAndListVMs(hostID)
+	if errors.Is(err, ErrHostGone) || errors.Is(err, context.Canceled) {
+		s.syncSchedule.release(hostID)
+		return false, err
+	}
+	if err == nil {
+		// Definition events archive most changes as they happen; this
+		// catches those whose event was missed.
+		if archiveErr := s.archiveHostDefinitions(hostID); archiveErr != nil {
+			log.Printf("Warning: failed to archive the VM definitions of host %s: %v", hostID, archiveErr)
+		}
+	}
+	settings, settingsErr := s.GetSyncSettings()
+	if settingsErr != nil {
+		log.Printf("Warning: failed to load sync settings: %v", settingsErr)
+		s.syncSchedule.release(hostID)
+	} else {
+		s.syncSchedule.record(hostID, changed, err, settings)
+	}
+	return changed, err
+}
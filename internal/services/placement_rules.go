@@ -0,0 +1,327 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Types of placement rules.
+const (
+	PlacementAffinity     = "affinity"      // Keep the VMs on the same host
+	PlacementAntiAffinity = "anti-affinity" // Never put two of the VMs on the same host
+)
+
+const alertSourcePlacementRule = "placement_rule"
+
+var (
+	// ErrInvalidPlacementRule is returned for a rule without a name, with an unknown type or with fewer than two VMs.
+	ErrInvalidPlacementRule = errors.New("a placement rule needs a name, a type of 'affinity' or 'anti-affinity', and at least two distinct VM UUIDs")
+	// ErrPlacementRuleExists is returned when a rule name is already taken.
+	ErrPlacementRuleExists = errors.New("placement rule already exists")
+)
+
+// PlacementRuleRequest defines or redefines a placement rule. Rules are
+// enabled unless Enabled is set to false.
+type PlacementRuleRequest struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	VMUUIDs []string `json:"vm_uuids"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+// PlacedVM is a rule member and the host it currently runs on.
+type PlacedVM struct {
+	UUID   string `json:"uuid"`
+	Name   string `json:"name"`
+	HostID string `json:"host_id"`
+}
+
+// PlacementViolation describes a placement rule that the current, or a
+// proposed, placement of its VMs breaks.
+type PlacementViolation struct {
+	Rule    string     `json:"rule"`
+	Type    string     `json:"type"`
+	Message string     `json:"message"`
+	VMs     []PlacedVM `json:"vms"` // The members involved in the violation
+}
+
+func normalizePlacementRule(req PlacementRuleRequest) (PlacementRuleRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || (req.Type != PlacementAffinity && req.Type != PlacementAntiAffinity) {
+		return req, ErrInvalidPlacementRule
+	}
+	seen := make(map[string]bool, len(req.VMUUIDs))
+	uuids := make([]string, 0, len(req.VMUUIDs))
+	for _, id := range req.VMUUIDs {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		uuids = append(uuids, id)
+	}
+	if len(uuids) < 2 {
+		return req, ErrInvalidPlacementRule
+	}
+	req.VMUUIDs = uuids
+	return req, nil
+}
+
+// ListPlacementRules returns all placement rules.
+func (s *HostService) ListPlacementRules() ([]storage.PlacementRule, error) {
+	rules := []storage.PlacementRule{}
+	if err := s.db.Order("name").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *HostService) getPlacementRule(name string) (*storage.PlacementRule, error) {
+	var rule storage.PlacementRule
+	if err := s.db.Where("name = ?", name).First(&rule).Error; err != nil {
+		return nil, fmt.Errorf("could not find placement rule %s: %w", name, err)
+	}
+	return &rule, nil
+}
+
+// CreatePlacementRule defines a placement rule and checks the current
+// placement against it straight away.
+func (s *HostService) CreatePlacementRule(req PlacementRuleRequest) (*storage.PlacementRule, error) {
+	req, err := normalizePlacementRule(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.PlacementRule{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPlacementRuleExists, req.Name)
+	}
+
+	rule := storage.PlacementRule{
+		Name:    req.Name,
+		Type:    req.Type,
+		VMUUIDs: req.VMUUIDs,
+		Enabled: req.Enabled == nil || *req.Enabled,
+	}
+	if err := s.db.Create(&rule).Error; err != nil {
+		return nil, fmt.Errorf("failed to save placement rule: %w", err)
+	}
+	s.recordAudit("placement_rule.create", "placement_rule", rule.Name,
+		fmt.Sprintf("type=%s vms=%s enabled=%t", rule.Type, strings.Join(rule.VMUUIDs, ","), rule.Enabled))
+	s.EvaluatePlacementRules()
+	return &rule, nil
+}
+
+// UpdatePlacementRule redefines an existing rule. The rule cannot be renamed.
+func (s *HostService) UpdatePlacementRule(name string, req PlacementRuleRequest) (*storage.PlacementRule, error) {
+	rule, err := s.getPlacementRule(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = rule.Name
+	req, err = normalizePlacementRule(req)
+	if err != nil {
+		return nil, err
+	}
+
+	rule.Type = req.Type
+	rule.VMUUIDs = req.VMUUIDs
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	if err := s.db.Save(rule).Error; err != nil {
+		return nil, fmt.Errorf("failed to save placement rule: %w", err)
+	}
+	s.recordAudit("placement_rule.update", "placement_rule", rule.Name,
+		fmt.Sprintf("type=%s vms=%s enabled=%t", rule.Type, strings.Join(rule.VMUUIDs, ","), rule.Enabled))
+	s.EvaluatePlacementRules()
+	return rule, nil
+}
+
+// DeletePlacementRule removes a rule and resolves its open alert.
+func (s *HostService) DeletePlacementRule(name string) error {
+	rule, err := s.getPlacementRule(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Unscoped().Delete(rule).Error; err != nil {
+		return err
+	}
+	s.recordAudit("placement_rule.delete", "placement_rule", rule.Name, "")
+	s.resolvePlacementAlert(rule.Name)
+	return nil
+}
+
+// placementMembers returns where the existing members of a rule are placed.
+// Members whose VM no longer exists are left out.
+func placementMembers(db *gorm.DB, rule *storage.PlacementRule) ([]PlacedVM, error) {
+	var vms []storage.VirtualMachine
+	if err := db.Where("uuid IN ?", rule.VMUUIDs).Order("name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	members := make([]PlacedVM, 0, len(vms))
+	for _, vm := range vms {
+		members = append(members, PlacedVM{UUID: vm.UUID, Name: vm.Name, HostID: vm.HostID})
+	}
+	return members, nil
+}
+
+// placementViolation checks one rule against a placement of its members.
+func placementViolation(rule *storage.PlacementRule, members []PlacedVM) *PlacementViolation {
+	byHost := make(map[string][]PlacedVM)
+	for _, m := range members {
+		byHost[m.HostID] = append(byHost[m.HostID], m)
+	}
+	hosts := make([]string, 0, len(byHost))
+	for hostID := range byHost {
+		hosts = append(hosts, hostID)
+	}
+	sort.Strings(hosts)
+
+	switch rule.Type {
+	case PlacementAffinity:
+		if len(hosts) <= 1 {
+			return nil
+		}
+		return &PlacementViolation{
+			Rule:    rule.Name,
+			Type:    rule.Type,
+			Message: fmt.Sprintf("Affinity rule %s is violated: its VMs are spread over hosts %s", rule.Name, strings.Join(hosts, ", ")),
+			VMs:     members,
+		}
+	case PlacementAntiAffinity:
+		var shared []PlacedVM
+		var crowded []string
+		for _, hostID := range hosts {
+			if len(byHost[hostID]) > 1 {
+				shared = append(shared, byHost[hostID]...)
+				crowded = append(crowded, hostID)
+			}
+		}
+		if len(shared) == 0 {
+			return nil
+		}
+		return &PlacementViolation{
+			Rule:    rule.Name,
+			Type:    rule.Type,
+			Message: fmt.Sprintf("Anti-affinity rule %s is violated: several of its VMs run together on %s", rule.Name, strings.Join(crowded, ", ")),
+			VMs:     shared,
+		}
+	}
+	return nil
+}
+
+// GetPlacementViolations returns the enabled rules that the current
+// placement of VMs breaks.
+func (s *HostService) GetPlacementViolations() ([]PlacementViolation, error) {
+	var rules []storage.PlacementRule
+	if err := s.db.Where("enabled = ?", true).Order("name").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	violations := []PlacementViolation{}
+	for i := range rules {
+		members, err := placementMembers(s.db, &rules[i])
+		if err != nil {
+			return nil, err
+		}
+		if v := placementViolation(&rules[i], members); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+	return violations, nil
+}
+
+// CheckPlacement returns the enabled rules that would be violated if a VM
+// ran on targetHostID, with every other VM where it is now. Placement
+// decisions and migrations use it to warn before moving a VM.
+func (s *HostService) CheckPlacement(hostID, vmName, targetHostID string) ([]PlacementViolation, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []storage.PlacementRule
+	if err := s.db.Where("enabled = ?", true).Order("name").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	violations := []PlacementViolation{}
+	for i := range rules {
+		rule := &rules[i]
+		if !slices.Contains(rule.VMUUIDs, vm.UUID) {
+			continue
+		}
+		members, err := placementMembers(s.db, rule)
+		if err != nil {
+			return nil, err
+		}
+		for j := range members {
+			if members[j].UUID == vm.UUID {
+				members[j].HostID = targetHostID
+			}
+		}
+		if v := placementViolation(rule, members); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+	return violations, nil
+}
+
+// EvaluatePlacementRules raises an alert for every enabled rule the current
+// placement violates and resolves the alerts of rules that are satisfied
+// again, disabled or deleted.
+func (s *HostService) EvaluatePlacementRules() {
+	violations, err := s.GetPlacementViolations()
+	if err != nil {
+		log.Printf("Warning: failed to evaluate placement rules: %v", err)
+		return
+	}
+	violated := make(map[string]bool, len(violations))
+	for _, v := range violations {
+		violated[v.Rule] = true
+		var alert storage.Alert
+		err := s.db.Where("source = ? AND source_id = ? AND resolved_at IS NULL", alertSourcePlacementRule, v.Rule).First(&alert).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Warning: failed to look up alerts for placement rule %s: %v", v.Rule, err)
+			continue
+		}
+		if err != nil || alert.Message != v.Message {
+			alert.Severity = storage.AlertWarning
+			alert.Source = alertSourcePlacementRule
+			alert.SourceID = v.Rule
+			alert.Message = v.Message
+			s.saveAlert(&alert, EventAlertRaised)
+		}
+	}
+
+	var open []storage.Alert
+	if err := s.db.Where("source = ? AND resolved_at IS NULL", alertSourcePlacementRule).Find(&open).Error; err != nil {
+		log.Printf("Warning: failed to look up placement rule alerts: %v", err)
+		return
+	}
+	for _, alert := range open {
+		if !violated[alert.SourceID] {
+			s.resolvePlacementAlert(alert.SourceID)
+		}
+	}
+}
+
+// resolvePlacementAlert closes the open alert of a placement rule, if any.
+func (s *HostService) resolvePlacementAlert(ruleName string) {
+	var alert storage.Alert
+	if err := s.db.Where("source = ? AND source_id = ? AND resolved_at IS NULL", alertSourcePlacementRule, ruleName).First(&alert).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	alert.ResolvedAt = &now
+	s.saveAlert(&alert, EventAlertResolved)
+}
@@ -0,0 +1,354 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrPoolInactive is returned when browsing a pool that is not started, as
+// its directory may not even be mounted.
+var ErrPoolInactive = errors.New("storage pool is not active")
+
+// ErrPathOutsidePool is returned when a path in a pool leads out of the
+// pool's directory through a symbolic link.
+var ErrPathOutsidePool = errors.New("path leads outside the storage pool")
+
+// ErrPoolFileNotRegular is returned when deleting or renaming anything but
+// a regular file, e.g. a directory or a symbolic link.
+var ErrPoolFileNotRegular = errors.New("only regular files can be deleted or renamed")
+
+// ErrPoolFileInUse is returned when deleting or renaming a file a VM uses,
+// as a disk or as the backing file of another image.
+var ErrPoolFileInUse = errors.New("file is in use")
+
+// PoolFile is a directory entry in a storage pool.
+type PoolFile struct {
+	libvirt.HostFile
+	Path     string   `json:"path"`      // Relative to the pool's directory
+	HostPath string   `json:"host_path"` // Physical path on the host
+	UsedBy   []string `json:"used_by"`   // Why the file cannot be deleted, e.g. 'disk vda of VM web-01'
+}
+
+// PoolDirectory is the content of a directory in a storage pool.
+type PoolDirectory struct {
+	HostID   string     `json:"host_id"`
+	Pool     string     `json:"pool"`
+	Path     string     `json:"path"` // Relative to the pool's directory, "" for the directory itself
+	HostPath string     `json:"host_path"`
+	Entries  []PoolFile `json:"entries"` // Directories first, then by name
+}
+
+// PoolFileRenameRequest renames a file within a storage pool.
+type PoolFileRenameRequest struct {
+	Path    string `json:"path"`
+	NewPath string `json:"new_path"`
+}
+
+// poolLocation is a directory of a storage pool, resolved on the host.
+type poolLocation struct {
+	pool     *libvirt.StoragePoolInfo
+	rel      string // Relative to the pool's directory
+	hostPath string // Physical path
+}
+
+// cleanPoolPath validates a path relative to a pool's directory and returns
+// it cleaned, "" for the directory itself. Paths that climb out with ".."
+// are refused rather than cleaned, so a typo cannot reach another file.
+func cleanPoolPath(v *validator, field, p string) string {
+	switch {
+	case strings.HasPrefix(p, "/"):
+		v.add(field, "must be relative to the pool's directory")
+	case strings.ContainsAny(p, "\x00\n"):
+		v.add(field, "must not contain NUL or newline characters")
+	case p == ".." || strings.HasPrefix(p, "../") || strings.HasSuffix(p, "/..") || strings.Contains(p, "/../"):
+		v.add(field, "must not contain '..'")
+	}
+	if clean := path.Clean(p); clean != "." {
+		return clean
+	}
+	return ""
+}
+
+// poolDir returns the directory of a cleaned pool path, "" for the pool's
+// directory itself.
+func poolDir(rel string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// locatePoolDirectory resolves a directory of a file-based storage pool on
+// its host, refusing one that a symbolic link leads out of the pool.
+func (s *HostService) locatePoolDirectory(hostID, poolName, rel string) (*poolLocation, error) {
+	pool, err := s.connector.GetStoragePool(hostID, poolName, false)
+	if err != nil {
+		return nil, err
+	}
+	if !scannablePoolTypes[pool.Type] {
+		return nil, fmt.Errorf("%w: pool '%s' is of type %s", ErrUnsupportedPoolType, poolName, pool.Type)
+	}
+	if !pool.Active {
+		return nil, fmt.Errorf("%w: %s", ErrPoolInactive, poolName)
+	}
+
+	resolved, err := s.connector.HostRealDirectories(hostID, pool.Path, path.Join(pool.Path, rel))
+	if err != nil {
+		return nil, err
+	}
+	root, dir := resolved[0], resolved[1]
+	if dir != root && !strings.HasPrefix(dir, strings.TrimSuffix(root, "/")+"/") {
+		return nil, fmt.Errorf("%w: %s resolves to %s", ErrPathOutsidePool, valueOr(rel, "."), dir)
+	}
+	return &poolLocation{pool: pool, rel: rel, hostPath: dir}, nil
+}
+
+// poolFileUsers maps the image paths in use on a host to what uses them:
+// the disks of its VMs and the volumes of its active pools that have a
+// backing file.
+func (s *HostService) poolFileUsers(hostID string) (map[string][]string, error) {
+	var disks []struct {
+		Path   string
+		Device string
+		VMName string
+	}
+	err := s.db.Table("volume_attachments").
+		Select("volumes.name AS path, volume_attachments.device_name AS device, virtual_machines.name AS vm_name").
+		Joins("JOIN volumes ON volumes.id = volume_attachments.volume_id").
+		Joins("JOIN virtual_machines ON virtual_machines.id = volume_attachments.vm_id AND virtual_machines.deleted_at IS NULL").
+		Where("virtual_machines.host_id = ? AND volume_attachments.deleted_at IS NULL", hostID).
+		Scan(&disks).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load disk attachments for host %s: %w", hostID, err)
+	}
+	users := make(map[string][]string)
+	for _, disk := range disks {
+		users[disk.Path] = append(users[disk.Path], fmt.Sprintf("disk %s of VM %s", disk.Device, disk.VMName))
+	}
+
+	pools, err := s.connector.ListStoragePools(hostID, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		if !pool.Active {
+			continue
+		}
+		volumes, err := s.connector.ListVolumes(hostID, pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, vol := range volumes {
+			if vol.BackingPath != "" {
+				users[vol.BackingPath] = append(users[vol.BackingPath], "backing file of "+vol.Path)
+			}
+		}
+	}
+	return users, nil
+}
+
+// poolFile describes an entry of a pool directory, with what uses it under
+// either its path through the pool's directory or its physical path.
+func poolFile(loc *poolLocation, file libvirt.HostFile, users map[string][]string) PoolFile {
+	entry := PoolFile{
+		HostFile: file,
+		Path:     path.Join(loc.rel, file.Name),
+		HostPath: path.Join(loc.hostPath, file.Name),
+		UsedBy:   []string{},
+	}
+	entry.UsedBy = append(entry.UsedBy, users[path.Join(loc.pool.Path, entry.Path)]...)
+	if entry.HostPath != path.Join(loc.pool.Path, entry.Path) {
+		entry.UsedBy = append(entry.UsedBy, users[entry.HostPath]...)
+	}
+	return entry
+}
+
+// ListPoolFiles lists a directory of a directory-type storage pool, straight
+// from the host over its SSH connection.
+func (s *HostService) ListPoolFiles(hostID, poolName, dir string) (*PoolDirectory, error) {
+	var v validator
+	rel := cleanPoolPath(&v, "path", dir)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	loc, err := s.locatePoolDirectory(hostID, poolName, rel)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.connector.ListHostDirectory(hostID, loc.hostPath)
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.poolFileUsers(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &PoolDirectory{HostID: hostID, Pool: poolName, Path: rel, HostPath: loc.hostPath, Entries: []PoolFile{}}
+	for _, file := range files {
+		listing.Entries = append(listing.Entries, poolFile(loc, file, users))
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		a, b := listing.Entries[i], listing.Entries[j]
+		if (a.Type == libvirt.HostFileDirectory) != (b.Type == libvirt.HostFileDirectory) {
+			return a.Type == libvirt.HostFileDirectory
+		}
+		return a.Name < b.Name
+	})
+	return listing, nil
+}
+
+// statPoolFile resolves and describes a file of a storage pool.
+func (s *HostService) statPoolFile(hostID, poolName, rel string) (*PoolFile, error) {
+	loc, err := s.locatePoolDirectory(hostID, poolName, poolDir(rel))
+	if err != nil {
+		return nil, err
+	}
+	file, err := s.connector.StatHostFile(hostID, path.Join(loc.hostPath, path.Base(rel)))
+	if err != nil {
+		return nil, err
+	}
+	users, err := s.poolFileUsers(hostID)
+	if err != nil {
+		return nil, err
+	}
+	entry := poolFile(loc, *file, users)
+	return &entry, nil
+}
+
+// StatPoolFile describes a file of a directory-type storage pool and what
+// uses it.
+func (s *HostService) StatPoolFile(hostID, poolName, filePath string) (*PoolFile, error) {
+	var v validator
+	rel := cleanPoolPath(&v, "path", filePath)
+	if rel == "" {
+		v.add("path", "is required")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return s.statPoolFile(hostID, poolName, rel)
+}
+
+// unusedPoolFile describes a file of a storage pool that may be deleted or
+// renamed: a regular file no VM on the host uses. VMs are re-synced first so
+// recent changes to their disks are taken into account.
+func (s *HostService) unusedPoolFile(hostID, poolName, rel string) (*PoolFile, error) {
+	if changed, err := s.syncAndListVMs(hostID); err != nil {
+		return nil, err
+	} else if changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	file, err := s.statPoolFile(hostID, poolName, rel)
+	if err != nil {
+		return nil, err
+	}
+	if file.Type != libvirt.HostFileRegular {
+		return nil, fmt.Errorf("%w: %s is a %s", ErrPoolFileNotRegular, rel, file.Type)
+	}
+	if len(file.UsedBy) > 0 {
+		return nil, fmt.Errorf("%w: %s is the %s", ErrPoolFileInUse, rel, strings.Join(file.UsedBy, ", the "))
+	}
+	return file, nil
+}
+
+// DeletePoolFile deletes a file of a directory-type storage pool that no VM
+// uses, e.g. an image left behind by a VM deleted outside of libvirt.
+func (s *HostService) DeletePoolFile(hostID, poolName, filePath string) error {
+	var v validator
+	rel := cleanPoolPath(&v, "path", filePath)
+	if rel == "" {
+		v.add("path", "is required")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	file, err := s.unusedPoolFile(hostID, poolName, rel)
+	if err != nil {
+		return err
+	}
+	if err := s.connector.RemoveHostFile(hostID, file.HostPath); err != nil {
+		return err
+	}
+
+	if poolDir(rel) == "" {
+		if pool, err := s.getStoragePool(hostID, poolName); err == nil {
+			if err := s.db.Where("storage_pool_id = ? AND name = ?", pool.ID, rel).Delete(&storage.Volume{}).Error; err != nil {
+				log.Printf("Warning: failed to delete volume %s from database: %v", rel, err)
+			}
+		}
+	}
+	s.recordAudit("pool.file.delete", "pool-file", fmt.Sprintf("%s/%s/%s", hostID, poolName, rel),
+		fmt.Sprintf("host_path=%s size=%d", file.HostPath, file.SizeBytes))
+	s.afterPoolFilesChanged(hostID, poolName)
+	return nil
+}
+
+// RenamePoolFile renames or moves a file that no VM uses within a
+// directory-type storage pool. The new path must not be taken.
+func (s *HostService) RenamePoolFile(hostID, poolName string, req PoolFileRenameRequest) (*PoolFile, error) {
+	var v validator
+	from := cleanPoolPath(&v, "path", req.Path)
+	if from == "" {
+		v.add("path", "is required")
+	}
+	to := cleanPoolPath(&v, "new_path", req.NewPath)
+	if to == "" {
+		v.add("new_path", "is required")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	file, err := s.unusedPoolFile(hostID, poolName, from)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := s.locatePoolDirectory(hostID, poolName, poolDir(to))
+	if err != nil {
+		return nil, err
+	}
+	target := path.Join(dest.hostPath, path.Base(to))
+	if err := s.connector.RenameHostFile(hostID, file.HostPath, target); err != nil {
+		return nil, err
+	}
+
+	// Uploaded images keep their checksum under the new name, as long as
+	// they stay volumes of the pool.
+	if poolDir(from) == "" {
+		if pool, err := s.getStoragePool(hostID, poolName); err == nil {
+			query := s.db.Model(&storage.Volume{}).Where("storage_pool_id = ? AND name = ?", pool.ID, from)
+			if poolDir(to) == "" {
+				err = query.Update("name", to).Error
+			} else {
+				err = query.Delete(&storage.Volume{}).Error
+			}
+			if err != nil {
+				log.Printf("Warning: failed to update volume %s in database: %v", from, err)
+			}
+		}
+	}
+	s.recordAudit("pool.file.rename", "pool-file", fmt.Sprintf("%s/%s/%s", hostID, poolName, from),
+		fmt.Sprintf("new_path=%s host_path=%s", to, target))
+	s.afterPoolFilesChanged(hostID, poolName)
+	return s.statPoolFile(hostID, poolName, to)
+}
+
+// afterPoolFilesChanged rescans a pool so libvirt's volume list and the
+// pool's usage reflect files changed behind libvirt's back.
+func (s *HostService) afterPoolFilesChanged(hostID, poolName string) {
+	if _, err := s.connector.GetStoragePool(hostID, poolName, true); err != nil {
+		log.Printf("Warning: failed to refresh storage pool %s on host %s: %v", poolName, hostID, err)
+	}
+	go func() {
+		if err := s.RefreshStoragePools(hostID); err != nil {
+			log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+		}
+	}()
+}
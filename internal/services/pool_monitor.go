@@ -0,0 +1,390 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+// Default pool usage thresholds, in percent of capacity, used when a pool
+// has none configured.
+const (
+	DefaultPoolWarningPercent  = 80.0
+	DefaultPoolCriticalPercent = 90.0
+)
+
+// poolUsageRetention is how long usage samples are kept.
+const poolUsageRetention = 30 * 24 * time.Hour
+
+const alertSourceStoragePool = "storage_pool"
+
+// ErrInvalidThresholds is returned for out-of-range or inverted alert thresholds.
+var ErrInvalidThresholds = errors.New("thresholds must be between 0 and 100 with warning below critical")
+
+// PoolThresholds configures when a pool raises usage alerts. A zero value
+// resets that threshold to the default.
+type PoolThresholds struct {
+	WarningPercent  float64 `json:"warning_percent"`
+	CriticalPercent float64 `json:"critical_percent"`
+}
+
+// StartPoolMonitor periodically refreshes storage pools on every connected
+// host. It blocks, so run it in its own goroutine.
+func (s *HostService) StartPoolMonitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, hostID := range s.connector.ConnectedHostIDs() {
+			if err := s.RefreshStoragePools(hostID); err != nil {
+				log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+			}
+		}
+		cutoff := time.Now().Add(-poolUsageRetention)
+		if err := s.db.Where("created_at < ?", cutoff).Delete(&storage.StoragePoolUsageSample{}).Error; err != nil {
+			log.Printf("Warning: failed to prune storage pool usage history: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// RefreshStoragePools rescans a host's pools, records their usage and
+// evaluates alert thresholds.
+func (s *HostService) RefreshStoragePools(hostID string) error {
+	pools, err := s.connector.ListStoragePools(hostID, true)
+	if err != nil {
+		return err
+	}
+
+	seen := make([]string, 0, len(pools))
+	for _, info := range pools {
+		seen = append(seen, info.UUID)
+		pool, err := s.upsertStoragePool(hostID, info)
+		if err != nil {
+			log.Printf("Warning: failed to store pool %s on host %s: %v", info.Name, hostID, err)
+			continue
+		}
+
+		sample := storage.StoragePoolUsageSample{
+			StoragePoolID:   pool.ID,
+			CapacityBytes:   pool.CapacityBytes,
+			AllocationBytes: pool.AllocationBytes,
+			AvailableBytes:  pool.AvailableBytes,
+		}
+		if err := s.db.Create(&sample).Error; err != nil {
+			log.Printf("Warning: failed to record usage for pool %s on host %s: %v", pool.Name, hostID, err)
+		}
+
+		s.hub.BroadcastMessage(ws.Message{
+			Type: "pool-usage-updated",
+			Payload: ws.MessagePayload{
+				"hostId": hostID,
+				"pool":   pool,
+			},
+		})
+
+		s.evaluatePoolAlert(pool)
+	}
+
+	// Forget pools that were undefined on the host. The delete is permanent
+	// so a pool redefined with the same UUID can be stored again.
+	var stale []storage.StoragePool
+	query := s.db.Where("host_id = ?", hostID)
+	if len(seen) > 0 {
+		query = query.Where("uuid NOT IN ?", seen)
+	}
+	if err := query.Find(&stale).Error; err != nil {
+		log.Printf("Warning: failed to look up stale pools for host %s: %v", hostID, err)
+	}
+	for _, pool := range stale {
+		s.resolvePoolAlert(pool.UUID)
+		s.db.Where("storage_pool_id = ?", pool.ID).Delete(&storage.StoragePoolUsageSample{})
+		if err := s.db.Unscoped().Delete(&pool).Error; err != nil {
+			log.Printf("Warning: failed to remove stale pool %s on host %s: %v", pool.Name, hostID, err)
+		}
+	}
+	return nil
+}
+
+func (s *HostService) upsertStoragePool(hostID string, info libvirt.StoragePoolInfo) (*storage.StoragePool, error) {
+	var pool storage.StoragePool
+	err := s.db.Where("uuid = ?", info.UUID).First(&pool).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	pool.HostID = hostID
+	pool.Name = info.Name
+	pool.UUID = info.UUID
+	pool.Type = info.Type
+	pool.Path = info.Path
+	pool.Active = info.Active
+	pool.Autostart = info.Autostart
+	pool.CapacityBytes = info.CapacityBytes
+	pool.AllocationBytes = info.AllocationBytes
+	pool.AvailableBytes = info.AvailableBytes
+	pool.Backend = info.Backend
+	pool.VirtualAllocationBytes = info.VirtualAllocationBytes
+	pool.ThinPools = nil
+	for _, tp := range info.ThinPools {
+		pool.ThinPools = append(pool.ThinPools, storage.ThinPoolUsage(tp))
+	}
+	pool.Dataset = nil
+	if info.Dataset != nil {
+		dataset := storage.ZFSDatasetUsage(*info.Dataset)
+		pool.Dataset = &dataset
+	}
+	pool.Overcommitted = isOvercommitted(&pool)
+	if err := s.db.Save(&pool).Error; err != nil {
+		return nil, err
+	}
+	return &pool, nil
+}
+
+// evaluatePoolAlert raises, escalates or resolves the usage alert of a pool.
+func (s *HostService) evaluatePoolAlert(pool *storage.StoragePool) {
+	var severity storage.AlertSeverity
+	usage := poolUsagePercent(pool)
+	warning, critical := poolThresholds(pool)
+	switch {
+	case usage >= critical:
+		severity = storage.AlertCritical
+	case usage >= warning:
+		severity = storage.AlertWarning
+	}
+
+	if severity == "" {
+		s.resolvePoolAlert(pool.UUID)
+		return
+	}
+
+	var alert storage.Alert
+	err := s.db.Where("source = ? AND source_id = ? AND resolved_at IS NULL", alertSourceStoragePool, pool.UUID).First(&alert).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("Warning: failed to look up alerts for pool %s: %v", pool.Name, err)
+		return
+	}
+	if err != nil || alert.Severity != severity {
+		alert.HostID = pool.HostID
+		alert.Severity = severity
+		alert.Source = alertSourceStoragePool
+		alert.SourceID = pool.UUID
+		alert.Message = fmt.Sprintf("Storage pool %s on host %s is %.1f%% full", pool.Name, pool.HostID, usage)
+		s.saveAlert(&alert, EventAlertRaised)
+	}
+}
+
+// resolvePoolAlert closes the open usage alert of a pool, if any.
+func (s *HostService) resolvePoolAlert(poolUUID string) {
+	var alert storage.Alert
+	if err := s.db.Where("source = ? AND source_id = ? AND resolved_at IS NULL", alertSourceStoragePool, poolUUID).First(&alert).Error; err != nil {
+		return
+	}
+	now := time.Now()
+	alert.ResolvedAt = &now
+	s.saveAlert(&alert, EventAlertResolved)
+}
+
+// saveAlert persists a raised or resolved alert and tells everyone about it.
+// Alerts raised during a maintenance window covering their host are
+// suppressed: they are kept and shown, but nobody is emailed or notified.
+func (s *HostService) saveAlert(alert *storage.Alert, event string) {
+	window := s.activeMaintenanceWindow(alert.HostID, "")
+	if event == EventAlertRaised {
+		alert.Suppressed = window != nil
+	}
+	if err := s.db.Save(alert).Error; err != nil {
+		log.Printf("Warning: failed to persist alert for %s %s: %v", alert.Source, alert.SourceID, err)
+		return
+	}
+	s.hub.BroadcastMessage(ws.Message{
+		Type:    event,
+		Payload: ws.MessagePayload{"alert": alert},
+	})
+	details := map[string]interface{}{"severity": alert.Severity, "source": alert.Source, "source_id": alert.SourceID}
+	if window != nil {
+		details["maintenance_window"] = window.Name
+	}
+	quiet := alert.Suppressed || window != nil
+	s.saveEvent(event, alert.HostID, "", alert.Message, details, quiet)
+	if !quiet {
+		s.emailAlert(alert, event)
+	}
+}
+
+// poolUsagePercent returns how full a pool is, measured on the space that
+// runs out first: the fullest thin pool for LVM thin provisioning, and the
+// dataset for directory pools on ZFS.
+func poolUsagePercent(pool *storage.StoragePool) float64 {
+	percent := func(used, total uint64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(used) / float64(total) * 100
+	}
+
+	switch {
+	case len(pool.ThinPools) > 0:
+		usage := 0.0
+		for _, tp := range pool.ThinPools {
+			usage = max(usage, percent(tp.DataUsedBytes, tp.SizeBytes))
+		}
+		return usage
+	case pool.Dataset != nil:
+		return percent(pool.Dataset.UsedBytes, pool.Dataset.UsedBytes+pool.Dataset.AvailableBytes)
+	default:
+		return percent(pool.AllocationBytes, pool.CapacityBytes)
+	}
+}
+
+// isOvercommitted reports whether a pool's volumes could grow beyond the
+// physical space backing them.
+func isOvercommitted(pool *storage.StoragePool) bool {
+	switch {
+	case len(pool.ThinPools) > 0:
+		for _, tp := range pool.ThinPools {
+			if tp.VirtualBytes > tp.SizeBytes {
+				return true
+			}
+		}
+		return false
+	case pool.Dataset != nil:
+		return pool.VirtualAllocationBytes > pool.Dataset.UsedBytes+pool.Dataset.AvailableBytes
+	default:
+		return pool.VirtualAllocationBytes > pool.CapacityBytes
+	}
+}
+
+func poolThresholds(pool *storage.StoragePool) (warning, critical float64) {
+	warning, critical = pool.WarningPercent, pool.CriticalPercent
+	if warning == 0 {
+		warning = DefaultPoolWarningPercent
+	}
+	if critical == 0 {
+		critical = DefaultPoolCriticalPercent
+	}
+	return warning, critical
+}
+
+// ListStoragePools returns the pools last seen on a host.
+func (s *HostService) ListStoragePools(hostID string) ([]storage.StoragePool, error) {
+	var pools []storage.StoragePool
+	if err := s.db.Where("host_id = ?", hostID).Order("name").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func (s *HostService) getStoragePool(hostID, poolName string) (*storage.StoragePool, error) {
+	var pool storage.StoragePool
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, poolName).First(&pool).Error; err != nil {
+		return nil, fmt.Errorf("could not find storage pool %s on host %s: %w", poolName, hostID, err)
+	}
+	return &pool, nil
+}
+
+// GetStoragePoolUsage returns a pool's usage samples recorded since the given time.
+func (s *HostService) GetStoragePoolUsage(hostID, poolName string, since time.Time) ([]storage.StoragePoolUsageSample, error) {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	var samples []storage.StoragePoolUsageSample
+	if err := s.db.Where("storage_pool_id = ? AND created_at >= ?", pool.ID, since).Order("created_at").Find(&samples).Error; err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// SetStoragePoolThresholds configures a pool's usage alert thresholds and
+// re-evaluates its alert straight away.
+func (s *HostService) SetStoragePoolThresholds(hostID, poolName string, thresholds PoolThresholds) (*storage.StoragePool, error) {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.WarningPercent = thresholds.WarningPercent
+	pool.CriticalPercent = thresholds.CriticalPercent
+	warning, critical := poolThresholds(pool)
+	if warning < 0 || critical > 100 || warning >= critical {
+		return nil, ErrInvalidThresholds
+	}
+
+	if err := s.db.Model(pool).Updates(map[string]interface{}{
+		"warning_percent":  pool.WarningPercent,
+		"critical_percent": pool.CriticalPercent,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to save thresholds: %w", err)
+	}
+	s.recordAudit("storage_pool.thresholds", "storage_pool", pool.UUID, fmt.Sprintf("warning=%g critical=%g", warning, critical))
+	s.evaluatePoolAlert(pool)
+	return pool, nil
+}
+
+// SetStoragePoolAutostart sets whether a pool is started with libvirtd and
+// returns it refreshed.
+func (s *HostService) SetStoragePoolAutostart(hostID, poolName string, enabled bool) (*storage.StoragePool, error) {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetStoragePoolAutostart(hostID, poolName, enabled); err != nil {
+		return nil, err
+	}
+	s.recordAudit("storage_pool.autostart", "storage_pool", pool.UUID, fmt.Sprintf("enabled=%t", enabled))
+	return s.reloadStoragePool(hostID, poolName)
+}
+
+// SetStoragePoolActive starts or stops a pool and returns it refreshed.
+func (s *HostService) SetStoragePoolActive(hostID, poolName string, active bool) (*storage.StoragePool, error) {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.SetStoragePoolActive(hostID, poolName, active); err != nil {
+		return nil, err
+	}
+	action := "storage_pool.stop"
+	if active {
+		action = "storage_pool.start"
+	}
+	s.recordAudit(action, "storage_pool", pool.UUID, "")
+	return s.reloadStoragePool(hostID, poolName)
+}
+
+// reloadStoragePool reads a single pool from its host and stores it.
+func (s *HostService) reloadStoragePool(hostID, poolName string) (*storage.StoragePool, error) {
+	info, err := s.connector.GetStoragePool(hostID, poolName, false)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := s.upsertStoragePool(hostID, *info)
+	if err != nil {
+		return nil, err
+	}
+	s.evaluatePoolAlert(pool)
+	return pool, nil
+}
+
+// ListAlerts returns open alerts, or the most recent alerts of any state
+// when includeResolved is set.
+func (s *HostService) ListAlerts(includeResolved bool) ([]storage.Alert, error) {
+	var alerts []storage.Alert
+	query := s.db.Order("id desc")
+	if includeResolved {
+		query = query.Limit(200)
+	} else {
+		query = query.Where("resolved_at IS NULL")
+	}
+	if err := query.Find(&alerts).Error; err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
@@ -0,0 +1,518 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+// PermissionManageProjects allows creating and deleting projects, assigning
+// resources to them, and seeing every resource whatever its project.
+const PermissionManageProjects = "projects.manage"
+
+// Roles of project members, from least to most privileged.
+const (
+	ProjectViewer   = "viewer"   // Reads the project's resources
+	ProjectOperator = "operator" // Also acts on its VMs, networks and volumes
+	ProjectAdmin    = "admin"    // Also changes its hosts and manages its members
+)
+
+var projectRoleRank = map[string]int{ProjectViewer: 1, ProjectOperator: 2, ProjectAdmin: 3}
+
+// Kinds of resources that can be assigned to a project.
+const (
+	ResourceHost    = "host"
+	ResourceVM      = "vm"
+	ResourceNetwork = "network"
+	ResourceVolume  = "volume"
+)
+
+// ErrProjectExists is returned when a project name is already taken.
+var ErrProjectExists = errors.New("project already exists")
+
+// ProjectRequest creates a project.
+type ProjectRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ProjectResourceRequest assigns a resource to a project. Name is the VM or
+// network name, or 'pool/volume' for volumes, and is empty for hosts.
+type ProjectResourceRequest struct {
+	Kind   string `json:"kind"`
+	HostID string `json:"host_id"`
+	Name   string `json:"name"`
+}
+
+// ProjectMemberView is a member of a project.
+type ProjectMemberView struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// ProjectResourceView is a resource assigned to a project. VMs are shown
+// with their current host and name.
+type ProjectResourceView struct {
+	ID     uint   `json:"id"`
+	Kind   string `json:"kind"`
+	HostID string `json:"host_id"`
+	Name   string `json:"name"`
+	VMUUID string `json:"vm_uuid,omitempty"`
+}
+
+// ProjectView is a project with the caller's role in it, and when looked up
+// on its own, its members and resources.
+type ProjectView struct {
+	storage.Project
+	Role      string                `json:"role,omitempty"` // Empty for users who see every project
+	Members   []ProjectMemberView   `json:"members,omitempty"`
+	Resources []ProjectResourceView `json:"resources,omitempty"`
+}
+
+// ProjectScope is what a user may access while projects are in use: the
+// projects they are a member of and their role in each. A nil scope is
+// unrestricted.
+type ProjectScope struct {
+	roles map[uint]string
+}
+
+// Allows reports whether the scope has at least the given role in a
+// project. Resources outside any project (ID 0) are only open to
+// unrestricted users.
+func (sc *ProjectScope) Allows(projectID uint, role string) bool {
+	if sc == nil {
+		return true
+	}
+	have, ok := sc.roles[projectID]
+	return ok && projectRoleRank[have] >= projectRoleRank[role]
+}
+
+// String lists the projects of the scope with the role in each, e.g.
+// "1=viewer,3=operator", or returns "unrestricted" for a nil scope.
+func (sc *ProjectScope) String() string {
+	if sc == nil {
+		return "unrestricted"
+	}
+	parts := make([]string, 0, len(sc.roles))
+	for _, id := range sc.ProjectIDs() {
+		parts = append(parts, fmt.Sprintf("%d=%s", id, sc.roles[id]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// ProjectIDs returns the projects of the scope.
+func (sc *ProjectScope) ProjectIDs() []uint {
+	ids := make([]uint, 0, len(sc.roles))
+	for id := range sc.roles {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// ProjectsEnabled reports whether any project exists. Until one does, the
+// API is not scoped by project.
+func (s *HostService) ProjectsEnabled() (bool, error) {
+	var count int64
+	err := s.db.Model(&storage.Project{}).Count(&count).Error
+	return count > 0, err
+}
+
+// ProjectScopeFor returns the scope of a user: nil for users who may manage
+// projects, otherwise the projects they are a member of.
+func (s *HostService) ProjectScopeFor(user *storage.User) (*ProjectScope, error) {
+	unrestricted, err := s.UserHasPermission(user, PermissionManageProjects)
+	if err != nil || unrestricted {
+		return nil, err
+	}
+	var members []storage.ProjectMember
+	if err := s.db.Where("user_id = ?", user.ID).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	scope := &ProjectScope{roles: make(map[uint]string, len(members))}
+	for _, m := range members {
+		scope.roles[m.ProjectID] = m.Role
+	}
+	return scope, nil
+}
+
+// assignedProject returns the project a resource is explicitly assigned to,
+// or 0.
+func (s *HostService) assignedProject(kind, hostID, key string) (uint, error) {
+	var res storage.ProjectResource
+	err := s.db.Where("kind = ? AND host_id = ? AND key = ?", kind, hostID, key).Limit(1).Find(&res).Error
+	return res.ProjectID, err
+}
+
+// vmProject returns the project of a VM: its own, or else its host's.
+func (s *HostService) vmProject(vm storage.VirtualMachine) (uint, error) {
+	projectID, err := s.assignedProject(ResourceVM, "", vm.UUID)
+	if err != nil || projectID != 0 {
+		return projectID, err
+	}
+	return s.assignedProject(ResourceHost, vm.HostID, "")
+}
+
+// ResourceProject returns the project a resource belongs to, or 0 for none.
+// VMs, networks and volumes without a project of their own belong to their
+// host's. key is the VM or network name, or 'pool/volume', and empty for
+// hosts.
+func (s *HostService) ResourceProject(kind, hostID, key string) (uint, error) {
+	switch kind {
+	case ResourceHost:
+		return s.assignedProject(ResourceHost, hostID, "")
+	case ResourceVM:
+		var vm storage.VirtualMachine
+		if err := s.db.Where("host_id = ? AND name = ?", hostID, key).Limit(1).Find(&vm).Error; err != nil {
+			return 0, err
+		}
+		if vm.ID == 0 {
+			return s.assignedProject(ResourceHost, hostID, "")
+		}
+		return s.vmProject(vm)
+	}
+	projectID, err := s.assignedProject(kind, hostID, key)
+	if err != nil || projectID != 0 {
+		return projectID, err
+	}
+	return s.assignedProject(ResourceHost, hostID, "")
+}
+
+// HostVisible reports whether a scope can see a host, either through the
+// host's project or through a VM, network or volume on it in one of its
+// projects.
+func (s *HostService) HostVisible(scope *ProjectScope, hostID string) (bool, error) {
+	if scope == nil {
+		return true, nil
+	}
+	projectID, err := s.assignedProject(ResourceHost, hostID, "")
+	if err != nil || scope.Allows(projectID, ProjectViewer) {
+		return err == nil, err
+	}
+	ids := scope.ProjectIDs()
+	if len(ids) == 0 {
+		return false, nil
+	}
+	var count int64
+	err = s.db.Model(&storage.ProjectResource{}).
+		Where("project_id IN ? AND kind IN ? AND host_id = ?", ids, []string{ResourceNetwork, ResourceVolume}, hostID).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	err = s.db.Model(&storage.VirtualMachine{}).
+		Where("host_id = ? AND uuid IN (?)", hostID,
+			s.db.Model(&storage.ProjectResource{}).Select("key").Where("project_id IN ? AND kind = ?", ids, ResourceVM)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// broadcastAccessTTL is how long a WebSocket filter trusts what it looked up
+// about a host or VM, so that stats streams do not query for every message.
+const broadcastAccessTTL = 30 * time.Second
+
+// broadcastAccess is a cached answer of a WebSocket filter.
+type broadcastAccess struct {
+	allowed bool
+	at      time.Time
+}
+
+// BroadcastFilter returns the WebSocket filter of a scope, nil for an
+// unrestricted one. Messages about a VM pass when the scope may view the VM,
+// vms-changed when it can see the host, and other messages about a host when
+// it may view the host itself, as they cover all of its VMs or pools.
+// hosts-changed always passes as it names no host; any other message only
+// reaches unrestricted clients.
+func (s *HostService) BroadcastFilter(scope *ProjectScope) ws.Filter {
+	if scope == nil {
+		return nil
+	}
+	cache := make(map[string]broadcastAccess)
+	return func(message ws.Message) bool {
+		if message.Type == "hosts-changed" {
+			return true
+		}
+		hostID, _ := message.Payload["hostId"].(string)
+		if hostID == "" {
+			return false
+		}
+		vmName, _ := message.Payload["vmName"].(string)
+		check := "host"
+		switch {
+		case vmName != "":
+			check = "vm"
+		case message.Type == "vms-changed":
+			check = "visible"
+		}
+		key := check + "\x00" + hostID + "\x00" + vmName
+		if cached, ok := cache[key]; ok && time.Since(cached.at) < broadcastAccessTTL {
+			return cached.allowed
+		}
+
+		var allowed bool
+		var err error
+		switch check {
+		case "vm":
+			var projectID uint
+			projectID, err = s.ResourceProject(ResourceVM, hostID, vmName)
+			allowed = scope.Allows(projectID, ProjectViewer)
+		case "visible":
+			allowed, err = s.HostVisible(scope, hostID)
+		default:
+			var projectID uint
+			projectID, err = s.ResourceProject(ResourceHost, hostID, "")
+			allowed = scope.Allows(projectID, ProjectViewer)
+		}
+		if err != nil {
+			return false
+		}
+		cache[key] = broadcastAccess{allowed: allowed, at: time.Now()}
+		return allowed
+	}
+}
+
+// ListProjects returns the projects a scope can see, ordered by name.
+func (s *HostService) ListProjects(scope *ProjectScope) ([]ProjectView, error) {
+	query := s.db.Order("name")
+	if scope != nil {
+		query = query.Where("id IN ?", scope.ProjectIDs())
+	}
+	var projects []storage.Project
+	if err := query.Find(&projects).Error; err != nil {
+		return nil, err
+	}
+	views := make([]ProjectView, len(projects))
+	for i, p := range projects {
+		views[i] = ProjectView{Project: p}
+		if scope != nil {
+			views[i].Role = scope.roles[p.ID]
+		}
+	}
+	return views, nil
+}
+
+// GetProject returns a project with its members and resources.
+func (s *HostService) GetProject(scope *ProjectScope, projectID uint) (*ProjectView, error) {
+	var project storage.Project
+	if err := s.db.First(&project, projectID).Error; err != nil {
+		return nil, fmt.Errorf("could not find project %d: %w", projectID, err)
+	}
+	view := &ProjectView{Project: project, Members: []ProjectMemberView{}, Resources: []ProjectResourceView{}}
+	if scope != nil {
+		view.Role = scope.roles[projectID]
+	}
+
+	err := s.db.Table("project_members").
+		Select("project_members.user_id, users.username, project_members.role").
+		Joins("JOIN users ON users.id = project_members.user_id").
+		Where("project_members.project_id = ?", projectID).
+		Order("users.username").
+		Scan(&view.Members).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var resources []storage.ProjectResource
+	if err := s.db.Where("project_id = ?", projectID).Order("kind, host_id, key").Find(&resources).Error; err != nil {
+		return nil, err
+	}
+	for _, res := range resources {
+		view.Resources = append(view.Resources, s.projectResourceView(res))
+	}
+	return view, nil
+}
+
+func (s *HostService) projectResourceView(res storage.ProjectResource) ProjectResourceView {
+	view := ProjectResourceView{ID: res.ID, Kind: res.Kind, HostID: res.HostID, Name: res.Key}
+	if res.Kind == ResourceVM {
+		var vm storage.VirtualMachine
+		s.db.Where("uuid = ?", res.Key).Limit(1).Find(&vm)
+		view.HostID, view.Name, view.VMUUID = vm.HostID, vm.Name, res.Key
+	}
+	return view
+}
+
+// CreateProject creates an empty project. Creating the first project turns
+// on project scoping for the whole API.
+func (s *HostService) CreateProject(actorID uint, req ProjectRequest) (*storage.Project, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	var v validator
+	if v.required("name", req.Name) && !hostNamePattern.MatchString(req.Name) {
+		v.add("name", "must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+	if len(req.Description) > 1024 {
+		v.add("description", "must be at most 1024 characters")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	var count int64
+	if err := s.db.Model(&storage.Project{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrProjectExists, req.Name)
+	}
+	project := storage.Project{Name: req.Name, Description: req.Description}
+	if err := s.db.Create(&project).Error; err != nil {
+		return nil, fmt.Errorf("failed to create project: %w", err)
+	}
+	s.recordUserAudit(actorID, "project.create", "project", fmt.Sprint(project.ID), "name="+project.Name)
+	return &project, nil
+}
+
+// DeleteProject deletes a project with its memberships and assignments. Its
+// VMs, networks and volumes fall back to their host's project.
+func (s *HostService) DeleteProject(actorID, projectID uint) error {
+	var project storage.Project
+	if err := s.db.First(&project, projectID).Error; err != nil {
+		return fmt.Errorf("could not find project %d: %w", projectID, err)
+	}
+	err := storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Where("project_id = ?", projectID).Delete(&storage.ProjectMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("project_id = ?", projectID).Delete(&storage.ProjectResource{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&project).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete project: %w", err)
+	}
+	s.recordUserAudit(actorID, "project.delete", "project", fmt.Sprint(projectID), "name="+project.Name)
+	s.broadcastHostsChanged()
+	return nil
+}
+
+// SetProjectMember adds a user to a project or changes their role in it.
+func (s *HostService) SetProjectMember(actorID, projectID, userID uint, role string) error {
+	var v validator
+	if _, ok := projectRoleRank[role]; !ok {
+		v.add("role", "must be viewer, operator or admin")
+	}
+	if err := v.err(); err != nil {
+		return err
+	}
+	var project storage.Project
+	if err := s.db.First(&project, projectID).Error; err != nil {
+		return fmt.Errorf("could not find project %d: %w", projectID, err)
+	}
+	var user storage.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return fmt.Errorf("could not find user %d: %w", userID, err)
+	}
+
+	var member storage.ProjectMember
+	if err := s.db.Where("project_id = ? AND user_id = ?", projectID, userID).Limit(1).Find(&member).Error; err != nil {
+		return err
+	}
+	member.ProjectID, member.UserID, member.Role = projectID, userID, role
+	if err := s.db.Save(&member).Error; err != nil {
+		return fmt.Errorf("failed to save project member: %w", err)
+	}
+	s.recordUserAudit(actorID, "project.member.set", "project", fmt.Sprint(projectID), fmt.Sprintf("user=%s role=%s", user.Username, role))
+	return nil
+}
+
+// RemoveProjectMember takes a user out of a project.
+func (s *HostService) RemoveProjectMember(actorID, projectID, userID uint) error {
+	result := s.db.Where("project_id = ? AND user_id = ?", projectID, userID).Delete(&storage.ProjectMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("user %d is not a member of project %d: %w", userID, projectID, gorm.ErrRecordNotFound)
+	}
+	s.recordUserAudit(actorID, "project.member.remove", "project", fmt.Sprint(projectID), fmt.Sprintf("user=%d", userID))
+	return nil
+}
+
+// AssignProjectResource puts a resource into a project, moving it out of any
+// project it was assigned to before.
+func (s *HostService) AssignProjectResource(actorID, projectID uint, req ProjectResourceRequest) (*ProjectResourceView, error) {
+	var v validator
+	switch req.Kind {
+	case ResourceHost:
+		if req.Name != "" {
+			v.add("name", "must be empty for hosts")
+		}
+	case ResourceVM, ResourceNetwork:
+		v.required("name", req.Name)
+	case ResourceVolume:
+		if pool, vol, ok := strings.Cut(req.Name, "/"); !ok || pool == "" || vol == "" {
+			v.add("name", "must be 'pool/volume' for volumes")
+		}
+	default:
+		v.add("kind", "must be host, vm, network or volume")
+	}
+	v.required("host_id", req.HostID)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	var project storage.Project
+	if err := s.db.First(&project, projectID).Error; err != nil {
+		return nil, fmt.Errorf("could not find project %d: %w", projectID, err)
+	}
+	var host storage.Host
+	if err := s.db.Where("id = ?", req.HostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", req.HostID, err)
+	}
+
+	res := storage.ProjectResource{Kind: req.Kind, HostID: host.ID, Key: req.Name}
+	switch req.Kind {
+	case ResourceVM:
+		vm, err := s.findVM(host.ID, req.Name)
+		if err != nil {
+			return nil, err
+		}
+		res.HostID, res.Key = "", vm.UUID
+	case ResourceNetwork:
+		var count int64
+		if err := s.db.Model(&storage.Network{}).Where("host_id = ? AND name = ?", host.ID, req.Name).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, fmt.Errorf("could not find network %s on host %s: %w", req.Name, host.Name, gorm.ErrRecordNotFound)
+		}
+	}
+
+	err := storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Where("kind = ? AND host_id = ? AND key = ?", res.Kind, res.HostID, res.Key).Delete(&storage.ProjectResource{}).Error; err != nil {
+			return err
+		}
+		res.ProjectID = projectID
+		return tx.Create(&res).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign %s to project: %w", req.Kind, err)
+	}
+	s.recordUserAudit(actorID, "project.resource.assign", "project", fmt.Sprint(projectID), fmt.Sprintf("%s=%s/%s", req.Kind, host.Name, req.Name))
+	s.broadcastHostsChanged()
+	view := s.projectResourceView(res)
+	return &view, nil
+}
+
+// UnassignProjectResource takes a resource out of a project. A VM, network
+// or volume falls back to its host's project.
+func (s *HostService) UnassignProjectResource(actorID, projectID, resourceID uint) error {
+	var res storage.ProjectResource
+	if err := s.db.Where("id = ? AND project_id = ?", resourceID, projectID).First(&res).Error; err != nil {
+		return fmt.Errorf("could not find resource %d in project %d: %w", resourceID, projectID, err)
+	}
+	if err := s.db.Delete(&res).Error; err != nil {
+		return err
+	}
+	s.recordUserAudit(actorID, "project.resource.unassign", "project", fmt.Sprint(projectID), fmt.Sprintf("%s=%s/%s", res.Kind, res.HostID, res.Key))
+	s.broadcastHostsChanged()
+	return nil
+}
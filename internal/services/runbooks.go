@@ -0,0 +1,625 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// Actions of runbook steps. Each runs an operation that is also available
+// on its own through the API.
+const (
+	RunbookActionStart          = "vm.start"
+	RunbookActionShutdown       = "vm.shutdown"
+	RunbookActionForceOff       = "vm.force-off"
+	RunbookActionReboot         = "vm.reboot"
+	RunbookActionSnapshot       = "vm.snapshot"
+	RunbookActionRevertSnapshot = "vm.snapshot-revert"
+	RunbookActionDeleteSnapshot = "vm.snapshot-delete"
+	RunbookActionSetLabel       = "vm.label"
+	RunbookActionGroupStart     = "group.start"
+	RunbookActionGroupStop      = "group.stop"
+	RunbookActionWait           = "wait"
+	RunbookActionNotify         = "notify"
+)
+
+// Statuses of the steps of a runbook run.
+const (
+	RunbookStepPending   = "pending"
+	RunbookStepRunning   = "running"
+	RunbookStepCompleted = "completed"
+	RunbookStepFailed    = "failed"
+	RunbookStepSkipped   = "skipped"
+)
+
+const (
+	// maxRunbookSteps bounds the steps of one runbook.
+	maxRunbookSteps = 50
+	// maxRunbookWait bounds a wait step.
+	maxRunbookWait = time.Hour
+	// runbookRunsListed is how many runs of a runbook are listed.
+	runbookRunsListed = 100
+)
+
+var (
+	// ErrRunbookExists is returned when a runbook name is already taken.
+	ErrRunbookExists = errors.New("runbook already exists")
+	// ErrRunbookRunning is returned when a runbook that is being run would be
+	// deleted.
+	ErrRunbookRunning = errors.New("runbook is running")
+)
+
+var (
+	runbookNamePattern      = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	runbookParameterPattern = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+	// runbookCondition is an operand, == or !=, and a value.
+	runbookCondition = regexp.MustCompile(`^\s*(\S+)\s*(==|!=)\s*(\S+)\s*$`)
+)
+
+// runbookAction describes an action: the parameters it needs and takes, and
+// what it does. run returns a line for the step log.
+type runbookAction struct {
+	required []string
+	optional []string
+	run      func(s *HostService, run *storage.RunbookRun, params map[string]string) (string, error)
+}
+
+var vmParams = []string{"host", "vm"}
+
+var runbookActions = map[string]runbookAction{
+	RunbookActionStart: {required: vmParams, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		if err := s.StartVM(context.Background(), p["host"], p["vm"]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Started %s", p["vm"]), nil
+	}},
+	RunbookActionShutdown: {required: vmParams, optional: []string{"timeout_seconds"}, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		info, err := s.connector.GetDomainInfo(p["host"], p["vm"])
+		if err != nil {
+			return "", err
+		}
+		if info.State == golibvirt.DomainShutoff {
+			return fmt.Sprintf("%s is already stopped", p["vm"]), nil
+		}
+		timeout, err := runbookSeconds(p, "timeout_seconds", defaultDependencyTimeout)
+		if err != nil {
+			return "", err
+		}
+		if err := s.ShutdownVM(context.Background(), p["host"], p["vm"]); err != nil {
+			return "", err
+		}
+		if err := s.waitForShutoff(p["host"], p["vm"], timeout); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Shut down %s", p["vm"]), nil
+	}},
+	RunbookActionForceOff: {required: vmParams, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		if err := s.ForceOffVM(context.Background(), p["host"], p["vm"]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Forced %s off", p["vm"]), nil
+	}},
+	RunbookActionReboot: {required: vmParams, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		if err := s.RebootVM(context.Background(), p["host"], p["vm"]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Rebooted %s", p["vm"]), nil
+	}},
+	RunbookActionSnapshot: {required: vmParams, optional: []string{"name", "description", "memory"}, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		name := p["name"]
+		if name == "" {
+			name = time.Now().Format("snap-20060102-150405")
+		}
+		task, err := s.CreateSnapshot(p["host"], p["vm"], SnapshotRequest{Name: name, Description: p["description"], Memory: p["memory"]})
+		if err != nil {
+			return "", err
+		}
+		if err := s.waitForTask(task.ID); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Took snapshot %s of %s", name, p["vm"]), nil
+	}},
+	RunbookActionRevertSnapshot: {required: append(vmParams, "name"), run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		task, err := s.RevertSnapshot(p["host"], p["vm"], p["name"])
+		if err != nil {
+			return "", err
+		}
+		if err := s.waitForTask(task.ID); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Reverted %s to snapshot %s", p["vm"], p["name"]), nil
+	}},
+	RunbookActionDeleteSnapshot: {required: append(vmParams, "name"), run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		if err := s.DeleteSnapshot(p["host"], p["vm"], p["name"]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Deleted snapshot %s of %s", p["name"], p["vm"]), nil
+	}},
+	RunbookActionSetLabel: {required: append(vmParams, "key", "value"), run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		if err := s.SetVMLabel(p["host"], p["vm"], p["key"], p["value"]); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Labeled %s %s=%s", p["vm"], p["key"], p["value"]), nil
+	}},
+	RunbookActionGroupStart: {required: []string{"selector"}, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		return s.runbookOrchestration(OrchestrationStart, p)
+	}},
+	RunbookActionGroupStop: {required: []string{"selector"}, optional: []string{"timeout_seconds"}, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		return s.runbookOrchestration(OrchestrationStop, p)
+	}},
+	RunbookActionWait: {required: []string{"seconds"}, run: func(s *HostService, _ *storage.RunbookRun, p map[string]string) (string, error) {
+		wait, err := runbookSeconds(p, "seconds", 0)
+		if err != nil {
+			return "", err
+		}
+		if wait > maxRunbookWait {
+			return "", fmt.Errorf("a wait can be at most %s", maxRunbookWait)
+		}
+		time.Sleep(wait)
+		return fmt.Sprintf("Waited %s", wait), nil
+	}},
+	RunbookActionNotify: {required: []string{"message"}, optional: vmParams, run: func(s *HostService, run *storage.RunbookRun, p map[string]string) (string, error) {
+		s.recordEvent(EventRunbookNotification, p["host"], p["vm"], p["message"],
+			map[string]interface{}{"runbook": run.RunbookName, "run_id": run.ID})
+		return "Notified: " + p["message"], nil
+	}},
+}
+
+// RunbookRequest defines or redefines a runbook.
+type RunbookRequest struct {
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	Parameters  []storage.RunbookParameter `json:"parameters"`
+	Steps       []storage.RunbookStep      `json:"steps"`
+}
+
+// RunbookRunRequest runs a runbook with values for its parameters.
+type RunbookRunRequest struct {
+	Parameters map[string]string `json:"parameters"`
+}
+
+func runbookSeconds(params map[string]string, name string, fallback time.Duration) (time.Duration, error) {
+	if params[name] == "" {
+		return fallback, nil
+	}
+	seconds, err := strconv.ParseUint(params[name], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number of seconds, not '%s'", name, params[name])
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func (s *HostService) runbookOrchestration(action string, p map[string]string) (string, error) {
+	timeout, err := runbookSeconds(p, "timeout_seconds", 0)
+	if err != nil {
+		return "", err
+	}
+	task, err := s.StartOrchestration(action, OrchestrationRequest{Selector: p["selector"], TimeoutSeconds: uint(timeout.Seconds())})
+	if err != nil {
+		return "", err
+	}
+	if err := s.waitForTask(task.ID); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Orchestrated %s of %s", action, p["selector"]), nil
+}
+
+// waitForTask polls a task until it is no longer pending or running, and
+// returns its error if it failed.
+func (s *HostService) waitForTask(id uint) error {
+	for {
+		task, err := s.tasks.Get(id)
+		if err != nil {
+			return err
+		}
+		switch task.Status {
+		case storage.TaskPending, storage.TaskRunning:
+			time.Sleep(orchestrationPollPeriod)
+		case storage.TaskCompleted:
+			return nil
+		default:
+			return fmt.Errorf("task %d %s: %s", id, strings.ToLower(string(task.Status)), task.Error)
+		}
+	}
+}
+
+// parseRunbookCondition splits a condition into its operand, operator and
+// value.
+func parseRunbookCondition(condition string) (operand, op, value string, err error) {
+	m := runbookCondition.FindStringSubmatch(condition)
+	if m == nil {
+		return "", "", "", fmt.Errorf("must be of the form '<operand> == <value>' or '<operand> != <value>'")
+	}
+	return m[1], m[2], strings.Trim(m[3], `'"`), nil
+}
+
+// expandRunbookParameters replaces the ${name} references in a text with
+// the values of the parameters.
+func expandRunbookParameters(text string, values map[string]string) string {
+	return runbookParameterPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		return values[runbookParameterPattern.FindStringSubmatch(ref)[1]]
+	})
+}
+
+func normalizeRunbook(req RunbookRequest) (RunbookRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	var v validator
+	if !runbookNamePattern.MatchString(req.Name) {
+		v.add("name", "must start with a letter or digit and contain only letters, digits, '_', '.' and '-' (at most 64)")
+	}
+	declared := make(map[string]bool, len(req.Parameters))
+	for i, param := range req.Parameters {
+		field := fmt.Sprintf("parameters[%d].name", i)
+		switch {
+		case !runbookParameterPattern.MatchString("${" + param.Name + "}"):
+			v.add(field, "must contain only letters, digits and '_'")
+		case declared[param.Name]:
+			v.add(field, "'%s' is declared twice", param.Name)
+		}
+		declared[param.Name] = true
+	}
+	checkReferences := func(field, text string) {
+		for _, m := range runbookParameterPattern.FindAllStringSubmatch(text, -1) {
+			if !declared[m[1]] {
+				v.add(field, "refers to the undeclared parameter '%s'", m[1])
+			}
+		}
+	}
+
+	if len(req.Steps) == 0 || len(req.Steps) > maxRunbookSteps {
+		v.add("steps", "must have 1 to %d steps", maxRunbookSteps)
+	}
+	seen := make(map[string]bool, len(req.Steps))
+	for i, step := range req.Steps {
+		field := fmt.Sprintf("steps[%d]", i)
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", i+1)
+			req.Steps[i].Name = step.Name
+		}
+		if seen[step.Name] {
+			v.add(field+".name", "'%s' is used by an earlier step", step.Name)
+		}
+		action, ok := runbookActions[step.Action]
+		if !ok {
+			v.add(field+".action", "unknown action '%s'", step.Action)
+		} else {
+			for _, param := range action.required {
+				if strings.TrimSpace(step.Params[param]) == "" {
+					v.add(fmt.Sprintf("%s.params.%s", field, param), "is required for %s", step.Action)
+				}
+			}
+			for param, value := range step.Params {
+				if !slices.Contains(action.required, param) && !slices.Contains(action.optional, param) {
+					v.add(fmt.Sprintf("%s.params.%s", field, param), "is not a parameter of %s", step.Action)
+				}
+				checkReferences(fmt.Sprintf("%s.params.%s", field, param), value)
+			}
+		}
+		if step.If != "" {
+			checkReferences(field+".if", step.If)
+			operand, _, _, err := parseRunbookCondition(step.If)
+			switch {
+			case err != nil:
+				v.add(field+".if", "%v", err)
+			case operand == "vm.state":
+				if step.Params["host"] == "" || step.Params["vm"] == "" {
+					v.add(field+".if", "vm.state needs the host and vm parameters")
+				}
+			case strings.HasPrefix(operand, "steps."):
+				name, ok := strings.CutSuffix(strings.TrimPrefix(operand, "steps."), ".status")
+				if !ok || !seen[name] {
+					v.add(field+".if", "'%s' must be steps.<name>.status of an earlier step", operand)
+				}
+			}
+		}
+		seen[step.Name] = true
+	}
+	return req, v.err()
+}
+
+// ListRunbooks returns the runbooks by name.
+func (s *HostService) ListRunbooks() ([]storage.Runbook, error) {
+	books := []storage.Runbook{}
+	if err := s.db.Order("name").Find(&books).Error; err != nil {
+		return nil, err
+	}
+	return books, nil
+}
+
+// GetRunbook returns one runbook.
+func (s *HostService) GetRunbook(name string) (*storage.Runbook, error) {
+	var book storage.Runbook
+	if err := s.db.Where("name = ?", name).First(&book).Error; err != nil {
+		return nil, fmt.Errorf("could not find runbook %s: %w", name, err)
+	}
+	return &book, nil
+}
+
+// CreateRunbook adds a runbook.
+func (s *HostService) CreateRunbook(req RunbookRequest) (*storage.Runbook, error) {
+	req, err := normalizeRunbook(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.Runbook{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRunbookExists, req.Name)
+	}
+
+	book := storage.Runbook{Name: req.Name, Description: req.Description, Parameters: req.Parameters, Steps: req.Steps}
+	if err := s.db.Create(&book).Error; err != nil {
+		return nil, fmt.Errorf("failed to save runbook: %w", err)
+	}
+	s.recordAudit("runbook.create", "runbook", book.Name, fmt.Sprintf("%d steps", len(book.Steps)))
+	return &book, nil
+}
+
+// UpdateRunbook redefines a runbook. Runs in progress go on with the steps
+// they started with. The runbook cannot be renamed.
+func (s *HostService) UpdateRunbook(name string, req RunbookRequest) (*storage.Runbook, error) {
+	book, err := s.GetRunbook(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = book.Name
+	if req, err = normalizeRunbook(req); err != nil {
+		return nil, err
+	}
+
+	book.Description = req.Description
+	book.Parameters = req.Parameters
+	book.Steps = req.Steps
+	if err := s.db.Save(book).Error; err != nil {
+		return nil, fmt.Errorf("failed to save runbook: %w", err)
+	}
+	s.recordAudit("runbook.update", "runbook", book.Name, fmt.Sprintf("%d steps", len(book.Steps)))
+	return book, nil
+}
+
+// DeleteRunbook removes a runbook and the record of its runs. Runbooks that
+// are being run cannot be deleted.
+func (s *HostService) DeleteRunbook(name string) error {
+	book, err := s.GetRunbook(name)
+	if err != nil {
+		return err
+	}
+	var running int64
+	if err := s.db.Model(&storage.RunbookRun{}).Where("runbook_id = ? AND status IN ?", book.ID,
+		[]storage.TaskStatus{storage.TaskPending, storage.TaskRunning}).Count(&running).Error; err != nil {
+		return err
+	}
+	if running > 0 {
+		return fmt.Errorf("%w: %s", ErrRunbookRunning, name)
+	}
+	if err := s.db.Delete(book).Error; err != nil {
+		return fmt.Errorf("failed to delete runbook: %w", err)
+	}
+	s.recordAudit("runbook.delete", "runbook", name, "")
+	return nil
+}
+
+// ListRunbookRuns returns the latest runs of a runbook, newest first.
+func (s *HostService) ListRunbookRuns(name string) ([]storage.RunbookRun, error) {
+	book, err := s.GetRunbook(name)
+	if err != nil {
+		return nil, err
+	}
+	runs := []storage.RunbookRun{}
+	if err := s.db.Where("runbook_id = ?", book.ID).Order("id desc").Limit(runbookRunsListed).Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// GetRunbookRun returns a run of a runbook.
+func (s *HostService) GetRunbookRun(id uint) (*storage.RunbookRun, error) {
+	var run storage.RunbookRun
+	if err := s.db.First(&run, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find runbook run %d: %w", id, err)
+	}
+	return &run, nil
+}
+
+// RunRunbook runs a runbook as a task, one step after the other. A step
+// whose condition does not hold is skipped; a step that fails ends the run,
+// unless it may fail, and the steps after it are skipped.
+func (s *HostService) RunRunbook(name string, userID uint, req RunbookRunRequest) (*storage.RunbookRun, error) {
+	book, err := s.GetRunbook(name)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(book.Parameters))
+	var v validator
+	for _, param := range book.Parameters {
+		value, ok := req.Parameters[param.Name]
+		switch {
+		case ok:
+			values[param.Name] = value
+		case param.Required:
+			v.add("parameters."+param.Name, "is required")
+		default:
+			values[param.Name] = param.Default
+		}
+	}
+	for key := range req.Parameters {
+		if !slices.ContainsFunc(book.Parameters, func(p storage.RunbookParameter) bool { return p.Name == key }) {
+			v.add("parameters."+key, "is not a parameter of runbook %s", name)
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	task, err := s.tasks.Start("runbook.run", fmt.Sprintf("Runbook %s", name))
+	if err != nil {
+		return nil, err
+	}
+	run := &storage.RunbookRun{
+		RunbookID:   book.ID,
+		RunbookName: book.Name,
+		UserID:      userID,
+		TaskID:      task.ID,
+		Status:      storage.TaskRunning,
+		Parameters:  values,
+		Steps:       make([]storage.RunbookStepRun, len(book.Steps)),
+	}
+	for i, step := range book.Steps {
+		run.Steps[i] = storage.RunbookStepRun{Name: step.Name, Action: step.Action, Status: RunbookStepPending}
+	}
+	if err := s.db.Create(run).Error; err != nil {
+		s.tasks.Finish(task, err)
+		return nil, fmt.Errorf("failed to save runbook run: %w", err)
+	}
+	s.recordAudit("runbook.run", "runbook", name, fmt.Sprintf("run=%d task=%d", run.ID, task.ID))
+
+	// The run records the outcome of each step; the caller gets it as it starts
+	started := *run
+	started.Steps = slices.Clone(run.Steps)
+	go func() {
+		err := s.executeRunbook(run, task, book.Steps)
+		if err != nil {
+			log.Printf("Runbook %s (run %d) failed: %v", name, run.ID, err)
+			run.Status = storage.TaskFailed
+			run.Error = err.Error()
+		} else {
+			run.Status = storage.TaskCompleted
+		}
+		now := time.Now()
+		run.FinishedAt = &now
+		s.saveRunbookRun(run)
+		s.tasks.Finish(task, err)
+	}()
+	return &started, nil
+}
+
+func (s *HostService) executeRunbook(run *storage.RunbookRun, task *storage.Task, steps []storage.RunbookStep) error {
+	var failed error
+	for i, step := range steps {
+		result := &run.Steps[i]
+		progress := 100 * i / len(steps)
+		if failed != nil {
+			result.Status = RunbookStepSkipped
+			result.Message = "An earlier step failed"
+			continue
+		}
+		params := make(map[string]string, len(step.Params))
+		for key, value := range step.Params {
+			params[key] = expandRunbookParameters(value, run.Parameters)
+		}
+
+		now := time.Now()
+		result.StartedAt = &now
+		ok, err := s.runbookConditionHolds(run, expandRunbookParameters(step.If, run.Parameters), params)
+		var message string
+		switch {
+		case err != nil:
+			err = fmt.Errorf("could not check the condition: %w", err)
+		case !ok:
+			result.Status = RunbookStepSkipped
+			result.Message = "Condition not met: " + step.If
+			s.tasks.Step(task, progress, fmt.Sprintf("Skipped %s: condition not met", step.Name))
+			s.saveRunbookRun(run)
+			continue
+		default:
+			result.Status = RunbookStepRunning
+			s.saveRunbookRun(run)
+			s.tasks.Step(task, progress, fmt.Sprintf("Running %s (%s)", step.Name, step.Action))
+			message, err = runbookActions[step.Action].run(s, run, params)
+		}
+
+		finished := time.Now()
+		result.FinishedAt = &finished
+		if err != nil {
+			result.Status = RunbookStepFailed
+			result.Error = err.Error()
+			s.tasks.Step(task, progress, fmt.Sprintf("Step %s failed: %v", step.Name, err))
+			if !step.ContinueOnError {
+				failed = fmt.Errorf("step %s failed: %w", step.Name, err)
+			}
+		} else {
+			result.Status = RunbookStepCompleted
+			result.Message = message
+			s.tasks.Step(task, progress, message)
+		}
+		s.saveRunbookRun(run)
+	}
+	return failed
+}
+
+// runbookConditionHolds evaluates the condition of a step, with its
+// parameters already filled in. An empty condition always holds.
+func (s *HostService) runbookConditionHolds(run *storage.RunbookRun, condition string, params map[string]string) (bool, error) {
+	if condition == "" {
+		return true, nil
+	}
+	operand, op, want, err := parseRunbookCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	got := operand
+	switch {
+	case operand == "vm.state":
+		info, err := s.connector.GetDomainInfo(params["host"], params["vm"])
+		if err != nil {
+			return false, err
+		}
+		got = strings.ToLower(string(mapLibvirtStateToVMState(info.State)))
+	case strings.HasPrefix(operand, "steps."):
+		name := strings.TrimSuffix(strings.TrimPrefix(operand, "steps."), ".status")
+		for _, step := range run.Steps {
+			if step.Name == name {
+				got = step.Status
+			}
+		}
+	}
+	return (got == want) == (op == "=="), nil
+}
+
+func (s *HostService) saveRunbookRun(run *storage.RunbookRun) {
+	if err := s.db.Save(run).Error; err != nil {
+		log.Printf("Warning: failed to persist runbook run %d: %v", run.ID, err)
+	}
+	s.hub.BroadcastMessage(ws.Message{
+		Type:    "runbook-run-updated",
+		Payload: ws.MessagePayload{"run": run},
+	})
+}
+
+// interruptRunbookRuns marks the runbook runs cut short by a restart. Their
+// steps are not repeated, as some of them may not be safe to run twice.
+func (s *HostService) interruptRunbookRuns() {
+	var runs []storage.RunbookRun
+	unfinished := []storage.TaskStatus{storage.TaskPending, storage.TaskRunning}
+	if err := s.db.Where("status IN ?", unfinished).Find(&runs).Error; err != nil {
+		log.Printf("Warning: failed to look for interrupted runbook runs: %v", err)
+		return
+	}
+	for i := range runs {
+		run := &runs[i]
+		run.Status = storage.TaskInterrupted
+		run.Error = interruptedMessage
+		for j := range run.Steps {
+			switch run.Steps[j].Status {
+			case RunbookStepRunning:
+				run.Steps[j].Status = RunbookStepFailed
+				run.Steps[j].Error = interruptedMessage
+			case RunbookStepPending:
+				run.Steps[j].Status = RunbookStepSkipped
+			}
+		}
+		s.saveRunbookRun(run)
+	}
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/google/uuid"
+)
+
+// secretUsageTypes are the usage types a secret can be created with.
+var secretUsageTypes = []string{
+	libvirt.SecretUsageNone, libvirt.SecretUsageVolume, libvirt.SecretUsageCeph,
+	libvirt.SecretUsageISCSI, libvirt.SecretUsageTLS, libvirt.SecretUsageVTPM,
+}
+
+// SecretRequest defines a libvirt secret, such as the key a Ceph or iSCSI
+// disk authenticates with.
+type SecretRequest struct {
+	UUID        string `json:"uuid"`       // Optional; an existing secret with this UUID is redefined
+	UsageType   string `json:"usage_type"` // none, volume, ceph, iscsi, tls or vtpm
+	UsageID     string `json:"usage_id"`   // Ceph or TLS name, iSCSI target or volume path
+	Description string `json:"description"`
+	Ephemeral   bool   `json:"ephemeral"`
+	Private     bool   `json:"private"`
+	Value       string `json:"value"` // Base64, as for virsh secret-set-value; omit to leave the value unset
+}
+
+// ListSecrets returns the secrets defined on a host, without their values.
+func (s *HostService) ListSecrets(hostID string) ([]libvirt.SecretInfo, error) {
+	return s.connector.ListSecrets(hostID)
+}
+
+// GetSecret returns a secret of a host, without its value.
+func (s *HostService) GetSecret(hostID, secretID string) (*libvirt.SecretInfo, error) {
+	if err := validateSecretID(secretID); err != nil {
+		return nil, err
+	}
+	return s.connector.GetSecret(hostID, secretID)
+}
+
+// CreateSecret defines a secret on a host and sets its value.
+func (s *HostService) CreateSecret(hostID string, req SecretRequest) (*libvirt.SecretInfo, error) {
+	var v validator
+	if req.UUID != "" {
+		if _, err := uuid.Parse(req.UUID); err != nil {
+			v.add("uuid", "must be a UUID")
+		}
+	}
+	if req.UsageType == "" {
+		req.UsageType = libvirt.SecretUsageNone
+	}
+	if !slices.Contains(secretUsageTypes, req.UsageType) {
+		v.add("usage_type", "must be none, volume, ceph, iscsi, tls or vtpm")
+	} else if req.UsageType != libvirt.SecretUsageNone {
+		v.required("usage_id", req.UsageID)
+	}
+	var value []byte
+	if req.Value != "" {
+		decoded, err := base64.StdEncoding.DecodeString(req.Value)
+		if err != nil {
+			v.add("value", "must be base64")
+		}
+		value = decoded
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	secret, err := s.connector.DefineSecret(hostID, libvirt.SecretDefinition{
+		UUID:        req.UUID,
+		UsageType:   req.UsageType,
+		UsageID:     req.UsageID,
+		Description: req.Description,
+		Ephemeral:   req.Ephemeral,
+		Private:     req.Private,
+	}, value)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("secret.create", "secret", fmt.Sprintf("%s/%s", hostID, secret.UUID),
+		fmt.Sprintf("usage=%s id=%s value_set=%t", secret.UsageType, secret.UsageID, value != nil))
+	return secret, nil
+}
+
+// DeleteSecret undefines a secret on a host.
+func (s *HostService) DeleteSecret(hostID, secretID string) error {
+	if err := validateSecretID(secretID); err != nil {
+		return err
+	}
+	if err := s.connector.DeleteSecret(hostID, secretID); err != nil {
+		return err
+	}
+	s.recordAudit("secret.delete", "secret", fmt.Sprintf("%s/%s", hostID, secretID), "")
+	return nil
+}
+
+func validateSecretID(secretID string) error {
+	if _, err := uuid.Parse(secretID); err != nil {
+		return &ValidationError{Fields: []FieldError{{Field: "secretID", Message: "must be a UUID"}}}
+	}
+	return nil
+}
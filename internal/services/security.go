@@ -0,0 +1,240 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// Lockout policy used until an admin configures one, and its bounds.
+const (
+	defaultLockoutThreshold = 5
+	defaultLockoutMinutes   = 15
+	MaxLockoutThreshold     = 100
+	MaxLockoutMinutes       = 24 * 60
+)
+
+// loginAttemptRetention is how long login attempts are kept.
+const loginAttemptRetention = 90 * 24 * time.Hour
+
+// Reasons a login attempt failed.
+const (
+	LoginFailedCredentials = "invalid_credentials"
+	LoginFailedDisabled    = "disabled"
+	LoginFailedLocked      = "locked"
+)
+
+// Bounds on the number of login attempts returned by one query.
+const (
+	defaultLoginAttemptLimit = 100
+	maxLoginAttemptLimit     = 1000
+)
+
+// ErrInvalidSecuritySettings is returned for a lockout policy outside the
+// allowed range.
+var ErrInvalidSecuritySettings = fmt.Errorf("lockout_threshold must be at most %d (0 disables lockout) and lockout_minutes between 1 and %d",
+	MaxLockoutThreshold, MaxLockoutMinutes)
+
+// SecuritySettingsView is the account lockout policy.
+type SecuritySettingsView struct {
+	LockoutThreshold uint `json:"lockout_threshold"` // 0 never locks accounts
+	LockoutMinutes   uint `json:"lockout_minutes"`
+}
+
+// LoginAttemptFilter selects login attempts. Zero fields match everything.
+type LoginAttemptFilter struct {
+	Username  string
+	IPAddress string
+	Success   *bool
+	Since     time.Time
+	Limit     int
+}
+
+// FailureCount is the number of failed logins of a username or address.
+type FailureCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// SecurityReport summarizes login activity since a point in time.
+type SecurityReport struct {
+	Since              time.Time              `json:"since"`
+	Successes          int64                  `json:"successes"`
+	Failures           int64                  `json:"failures"`
+	Lockouts           int64                  `json:"lockouts"`
+	LockedUsers        []UserView             `json:"locked_users"`
+	FailuresByUsername []FailureCount         `json:"failures_by_username"`
+	FailuresByIP       []FailureCount         `json:"failures_by_ip"`
+	RecentFailures     []storage.LoginAttempt `json:"recent_failures"`
+}
+
+// GetSecuritySettings returns the account lockout policy.
+func (s *HostService) GetSecuritySettings() (*SecuritySettingsView, error) {
+	var row storage.SecuritySettings
+	if err := s.db.Limit(1).Find(&row).Error; err != nil {
+		return nil, err
+	}
+	if row.ID == 0 {
+		return &SecuritySettingsView{LockoutThreshold: defaultLockoutThreshold, LockoutMinutes: defaultLockoutMinutes}, nil
+	}
+	return &SecuritySettingsView{LockoutThreshold: row.LockoutThreshold, LockoutMinutes: row.LockoutMinutes}, nil
+}
+
+// SetSecuritySettings changes the account lockout policy. Accounts that are
+// already locked stay locked until their lockout runs out.
+func (s *HostService) SetSecuritySettings(actorID uint, settings SecuritySettingsView) (*SecuritySettingsView, error) {
+	if settings.LockoutThreshold > MaxLockoutThreshold || settings.LockoutMinutes < 1 || settings.LockoutMinutes > MaxLockoutMinutes {
+		return nil, ErrInvalidSecuritySettings
+	}
+	row := storage.SecuritySettings{ID: 1, LockoutThreshold: settings.LockoutThreshold, LockoutMinutes: settings.LockoutMinutes}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save security settings: %w", err)
+	}
+	s.recordUserAudit(actorID, "security.update", "security", "global",
+		fmt.Sprintf("lockout_threshold=%d lockout_minutes=%d", settings.LockoutThreshold, settings.LockoutMinutes))
+	return s.GetSecuritySettings()
+}
+
+// recordLoginAttempt stores a login attempt and, for failures, an audit log
+// entry. Failures are logged but never block the login.
+func (s *HostService) recordLoginAttempt(username string, userID uint, reason, ipAddress, userAgent string) {
+	attempt := storage.LoginAttempt{
+		Username:  username,
+		UserID:    userID,
+		Success:   reason == "",
+		Reason:    reason,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+	}
+	if err := s.db.Create(&attempt).Error; err != nil {
+		log.Printf("Warning: failed to record login attempt for %s: %v", username, err)
+	}
+	if reason != "" {
+		s.recordUserAudit(userID, "user.login.failed", "user", username, fmt.Sprintf("ip=%s reason=%s", ipAddress, reason))
+	}
+}
+
+// registerLoginFailure counts a wrong password against a user and locks the
+// account once the policy's threshold is reached. The count is kept in SQL
+// so that concurrent guesses cannot overwrite each other's increments.
+func (s *HostService) registerLoginFailure(user *storage.User, ipAddress string) {
+	var failedLogins uint
+	err := s.db.Raw("UPDATE users SET failed_logins = failed_logins + 1, updated_at = ? WHERE id = ? RETURNING failed_logins",
+		time.Now(), user.ID).
+		Scan(&failedLogins).Error
+	if err != nil {
+		log.Printf("Warning: failed to record failed login of %s: %v", user.Username, err)
+		return
+	}
+	user.FailedLogins = failedLogins
+
+	settings, err := s.GetSecuritySettings()
+	if err != nil {
+		log.Printf("Warning: failed to load the lockout policy: %v", err)
+		return
+	}
+	if settings.LockoutThreshold == 0 || failedLogins < settings.LockoutThreshold {
+		return
+	}
+	// Of several guesses reaching the threshold at once, only the first
+	// finds the count still there, so the account is locked once.
+	lockedUntil := time.Now().Add(time.Duration(settings.LockoutMinutes) * time.Minute)
+	result := s.db.Model(&storage.User{}).Where("id = ? AND failed_logins >= ?", user.ID, settings.LockoutThreshold).
+		Updates(map[string]interface{}{"failed_logins": 0, "locked_until": lockedUntil})
+	if result.Error != nil {
+		log.Printf("Warning: failed to lock %s: %v", user.Username, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		user.FailedLogins, user.LockedUntil = 0, &lockedUntil
+		s.recordUserAudit(user.ID, "user.lock", "user", user.Username,
+			fmt.Sprintf("failed_logins=%d ip=%s locked_until=%s", failedLogins, ipAddress, lockedUntil.Format(time.RFC3339)))
+	}
+}
+
+// ListLoginAttempts returns login attempts matching the filter, newest first.
+func (s *HostService) ListLoginAttempts(filter LoginAttemptFilter) ([]storage.LoginAttempt, error) {
+	query := s.db.Order("created_at desc, id desc")
+	if filter.Username != "" {
+		query = query.Where("username = ?", filter.Username)
+	}
+	if filter.IPAddress != "" {
+		query = query.Where("ip_address = ?", filter.IPAddress)
+	}
+	if filter.Success != nil {
+		query = query.Where("success = ?", *filter.Success)
+	}
+	// Timestamps are stored as text in local time, see ListEvents.
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since.Local())
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultLoginAttemptLimit
+	}
+	if limit > maxLoginAttemptLimit {
+		limit = maxLoginAttemptLimit
+	}
+
+	attempts := []storage.LoginAttempt{}
+	if err := query.Limit(limit).Find(&attempts).Error; err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// failureCounts returns the failed logins since a time grouped by a column,
+// most failures first.
+func (s *HostService) failureCounts(column string, since time.Time) ([]FailureCount, error) {
+	counts := []FailureCount{}
+	err := s.db.Model(&storage.LoginAttempt{}).
+		Select(column+" AS key, COUNT(*) AS count").
+		Where("success = ? AND created_at >= ?", false, since).
+		Group(column).Order("count desc").Limit(10).
+		Scan(&counts).Error
+	return counts, err
+}
+
+// GetSecurityReport summarizes logins since a time: how many succeeded and
+// failed, which accounts are locked, and where failures come from.
+func (s *HostService) GetSecurityReport(since time.Time) (*SecurityReport, error) {
+	local := since.Local()
+	report := &SecurityReport{Since: since, LockedUsers: []UserView{}}
+
+	for success, count := range map[bool]*int64{true: &report.Successes, false: &report.Failures} {
+		err := s.db.Model(&storage.LoginAttempt{}).Where("success = ? AND created_at >= ?", success, local).Count(count).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := s.db.Model(&storage.AuditLog{}).Where("action = ? AND created_at >= ?", "user.lock", local).Count(&report.Lockouts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := s.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, user := range users {
+		if user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+			report.LockedUsers = append(report.LockedUsers, user)
+		}
+	}
+
+	if report.FailuresByUsername, err = s.failureCounts("username", local); err != nil {
+		return nil, err
+	}
+	if report.FailuresByIP, err = s.failureCounts("ip_address", local); err != nil {
+		return nil, err
+	}
+	failed := false
+	report.RecentFailures, err = s.ListLoginAttempts(LoginAttemptFilter{Success: &failed, Since: since, Limit: 20})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
@@ -0,0 +1,268 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// snapshotWriteRate is the rate, in bytes per second, assumed for writing a
+// VM's memory to disk when estimating how long a snapshot takes. QEMU skips
+// zero pages, so idle guests are usually faster.
+const snapshotWriteRate = 200 << 20
+
+// snapshotNamePattern restricts snapshot names to ones that are safe in the
+// file names of external snapshots.
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+var (
+	// ErrInvalidSnapshotRequest is returned for a bad snapshot name or
+	// memory mode.
+	ErrInvalidSnapshotRequest = errors.New("invalid snapshot request")
+	// ErrSnapshotExists is returned when a VM already has a snapshot with
+	// the requested name.
+	ErrSnapshotExists = errors.New("a snapshot with this name already exists")
+)
+
+// SnapshotRequest takes a snapshot of a VM.
+type SnapshotRequest struct {
+	Name        string `json:"name"` // Defaults to 'snap-<date>-<time>'
+	Description string `json:"description"`
+	Memory      string `json:"memory"` // 'internal' (default) or 'external'; ignored for shut-off VMs
+}
+
+// SnapshotEstimate tells what taking a snapshot of a VM would cost, and why
+// it cannot be taken if Blockers is not empty.
+type SnapshotEstimate struct {
+	Memory           string                 `json:"memory"` // Memory mode the snapshot would use
+	Running          bool                   `json:"running"`
+	StateBytes       uint64                 `json:"state_bytes"`       // Upper bound of the memory state written
+	EstimatedSeconds int                    `json:"estimated_seconds"` // Time to write the memory state
+	PausedSeconds    int                    `json:"paused_seconds"`    // Time the guest is paused
+	FreeBytes        uint64                 `json:"free_bytes,omitempty"`
+	Disks            []libvirt.SnapshotDisk `json:"disks"`
+	Blockers         []string               `json:"blockers"`
+	Warnings         []string               `json:"warnings"`
+}
+
+// snapshotMemoryMode validates a requested memory mode, defaulting to an
+// internal snapshot.
+func snapshotMemoryMode(memory string) (string, error) {
+	switch memory {
+	case "", libvirt.SnapshotMemoryInternal:
+		return libvirt.SnapshotMemoryInternal, nil
+	case libvirt.SnapshotMemoryExternal:
+		return memory, nil
+	default:
+		return "", fmt.Errorf("%w: memory must be '%s' or '%s'", ErrInvalidSnapshotRequest,
+			libvirt.SnapshotMemoryInternal, libvirt.SnapshotMemoryExternal)
+	}
+}
+
+// EstimateSnapshot works out how much memory state a snapshot of a VM would
+// write, how long that takes and how long the guest is paused. An internal
+// snapshot pauses the guest until its memory is saved; an external one saves
+// it while the guest runs and only pauses it briefly at the end.
+func (s *HostService) EstimateSnapshot(hostID, vmName, memory string) (*SnapshotEstimate, error) {
+	memory, err := snapshotMemoryMode(memory)
+	if err != nil {
+		return nil, err
+	}
+	source, err := s.connector.GetSnapshotSource(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &SnapshotEstimate{
+		Memory:    memory,
+		Running:   source.Running,
+		FreeBytes: source.FreeBytes,
+		Disks:     source.Disks,
+		Blockers:  libvirt.CheckSnapshotSupport(source, memory),
+		Warnings:  []string{},
+	}
+	if estimate.Blockers == nil {
+		estimate.Blockers = []string{}
+	}
+	if !source.Running {
+		estimate.Memory = libvirt.SnapshotMemoryNone
+		estimate.Warnings = append(estimate.Warnings, "The VM is shut off; only its disks are saved")
+		return estimate, nil
+	}
+
+	estimate.StateBytes = source.MemoryBytes
+	estimate.EstimatedSeconds = int((source.MemoryBytes + snapshotWriteRate - 1) / snapshotWriteRate)
+	if memory == libvirt.SnapshotMemoryInternal {
+		estimate.PausedSeconds = estimate.EstimatedSeconds
+		estimate.Warnings = append(estimate.Warnings,
+			fmt.Sprintf("The guest is paused for about %ds while its memory is saved", estimate.PausedSeconds))
+	} else {
+		estimate.PausedSeconds = 1
+		estimate.Warnings = append(estimate.Warnings,
+			"Each disk is switched to a new overlay image; the guest keeps running while its memory is saved, which takes longer if it writes to memory heavily")
+	}
+	if source.FreeBytes > 0 && source.FreeBytes < source.MemoryBytes {
+		estimate.Warnings = append(estimate.Warnings, fmt.Sprintf("The storage pool has %d bytes free but the memory state can take up to %d bytes",
+			source.FreeBytes, source.MemoryBytes))
+	}
+	return estimate, nil
+}
+
+// ListSnapshots returns the snapshots of a VM, oldest first, and refreshes
+// the stored copy.
+func (s *HostService) ListSnapshots(hostID, vmName string) ([]libvirt.SnapshotInfo, error) {
+	snapshots, err := s.connector.ListSnapshots(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	s.storeSnapshots(hostID, vmName, snapshots)
+	return snapshots, nil
+}
+
+// storeSnapshots replaces the stored snapshots of a VM with the given list.
+func (s *HostService) storeSnapshots(hostID, vmName string, snapshots []libvirt.SnapshotInfo) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return
+	}
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("vm_id = ?", vm.ID).Delete(&storage.VMSnapshot{}).Error; err != nil {
+			return err
+		}
+		for _, snap := range snapshots {
+			row := storage.VMSnapshot{
+				VMID:        vm.ID,
+				Name:        snap.Name,
+				Description: snap.Description,
+				ParentName:  snap.Parent,
+				State:       snap.State,
+				Memory:      snap.Memory,
+			}
+			if err := tx.Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Warning: failed to store snapshots of %s on host %s: %v", vmName, hostID, err)
+	}
+}
+
+// refreshSnapshots reloads the snapshots of a VM into the database.
+func (s *HostService) refreshSnapshots(hostID, vmName string) {
+	if _, err := s.ListSnapshots(hostID, vmName); err != nil {
+		log.Printf("Warning: failed to refresh snapshots of %s on host %s: %v", vmName, hostID, err)
+	}
+}
+
+// CreateSnapshot takes a snapshot of a VM as a task. Running VMs are saved
+// with their memory, so reverting brings them back exactly where they were.
+// The snapshot is refused up front when the VM's disks cannot hold it, e.g.
+// raw disks for an internal snapshot.
+func (s *HostService) CreateSnapshot(hostID, vmName string, req SnapshotRequest) (*storage.Task, error) {
+	if req.Name == "" {
+		req.Name = time.Now().Format("snap-20060102-150405")
+	}
+	if !snapshotNamePattern.MatchString(req.Name) {
+		return nil, fmt.Errorf("%w: name must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidSnapshotRequest)
+	}
+	estimate, err := s.EstimateSnapshot(hostID, vmName, req.Memory)
+	if err != nil {
+		return nil, err
+	}
+	if len(estimate.Blockers) > 0 {
+		return nil, fmt.Errorf("%w: %s", libvirt.ErrSnapshotUnsupported, strings.Join(estimate.Blockers, "; "))
+	}
+	existing, err := s.connector.ListSnapshots(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range existing {
+		if snap.Name == req.Name {
+			return nil, fmt.Errorf("%w: %s", ErrSnapshotExists, req.Name)
+		}
+	}
+
+	task, err := s.tasks.Start("vm.snapshot", fmt.Sprintf("Snapshot %s of %s (memory: %s)", req.Name, vmName, estimate.Memory))
+	if err != nil {
+		return nil, err
+	}
+	spec := libvirt.SnapshotSpec{Name: req.Name, Description: req.Description, Memory: estimate.Memory}
+	target := fmt.Sprintf("%s/%s", hostID, vmName)
+
+	started := copyTask(task)
+	go func() {
+		if estimate.Running {
+			s.tasks.Step(task, 10, fmt.Sprintf("Saving up to %d MiB of memory, about %ds", estimate.StateBytes>>20, estimate.EstimatedSeconds))
+		} else {
+			s.tasks.Step(task, 10, "Saving disks")
+		}
+		err := s.connector.CreateSnapshot(hostID, vmName, spec)
+		if err != nil {
+			log.Printf("Snapshot %s of %s on host %s failed: %v", req.Name, vmName, hostID, err)
+		} else {
+			s.recordAudit("vm.snapshot", "vm", target, fmt.Sprintf("name=%s memory=%s", req.Name, estimate.Memory))
+			s.refreshSnapshots(hostID, vmName)
+		}
+		s.tasks.Finish(task, err)
+	}()
+
+	return started, nil
+}
+
+// RevertSnapshot puts a VM back to one of its snapshots as a task. Whatever
+// the VM did since is lost.
+func (s *HostService) RevertSnapshot(hostID, vmName, name string) (*storage.Task, error) {
+	existing, err := s.connector.ListSnapshots(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, snap := range existing {
+		found = found || snap.Name == name
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s has no snapshot '%s'", libvirt.ErrSnapshotNotFound, vmName, name)
+	}
+
+	task, err := s.tasks.Start("vm.snapshot-revert", fmt.Sprintf("Reverting %s to snapshot %s", vmName, name))
+	if err != nil {
+		return nil, err
+	}
+
+	started := copyTask(task)
+	go func() {
+		s.tasks.Step(task, 10, "Restoring disks and memory")
+		err := s.connector.RevertSnapshot(hostID, vmName, name)
+		if err != nil {
+			log.Printf("Revert of %s on host %s to snapshot %s failed: %v", vmName, hostID, name, err)
+		} else {
+			s.recordAudit("vm.snapshot.revert", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "name="+name)
+			s.refreshSnapshots(hostID, vmName)
+			if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+				s.broadcastVMsChanged(hostID)
+			}
+		}
+		s.tasks.Finish(task, err)
+	}()
+
+	return started, nil
+}
+
+// DeleteSnapshot removes a snapshot of a VM.
+func (s *HostService) DeleteSnapshot(hostID, vmName, name string) error {
+	if err := s.connector.DeleteSnapshot(hostID, vmName, name); err != nil {
+		return err
+	}
+	s.recordAudit("vm.snapshot.delete", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "name="+name)
+	s.refreshSnapshots(hostID, vmName)
+	return nil
+}
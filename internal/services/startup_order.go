@@ -0,0 +1,227 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// maxStartupDelaySeconds bounds the waits of a startup sequence.
+const maxStartupDelaySeconds = 3600
+
+// Actions of a startup step.
+const (
+	StartupActionStart = "start"
+	StartupActionSkip  = "skip"
+)
+
+// ErrInvalidStartupSettings is returned for a startup delay out of range.
+var ErrInvalidStartupSettings = fmt.Errorf("startup delays must be at most %d seconds", maxStartupDelaySeconds)
+
+// HostStartupSettings controls whether VMs are started in order when a host
+// reconnects after an outage.
+type HostStartupSettings struct {
+	Enabled        bool `json:"enabled"`
+	StaggerSeconds uint `json:"stagger_seconds"` // Wait between two starts, unless the VM sets its own delay
+}
+
+// VMStartupSettings places a VM in its host's startup sequence.
+type VMStartupSettings struct {
+	Priority     uint `json:"priority"`      // Lower starts first; 0 leaves the VM alone
+	DelaySeconds uint `json:"delay_seconds"` // Wait after starting the VM; 0 uses the host's stagger
+}
+
+// StartupStep is a VM of a startup sequence.
+type StartupStep struct {
+	VMName         string `json:"vm_name"`
+	Priority       uint   `json:"priority"`
+	Action         string `json:"action"`           // 'start' or 'skip'
+	Reason         string `json:"reason,omitempty"` // Why a VM is skipped
+	StartAtSeconds uint   `json:"start_at_seconds"` // Offset from the beginning of the sequence
+	DelaySeconds   uint   `json:"delay_seconds"`    // Wait before the next start
+}
+
+// StartupPlan is the order in which a host's VMs are started after an
+// outage.
+type StartupPlan struct {
+	HostID         string        `json:"host_id"`
+	Enabled        bool          `json:"enabled"`
+	StaggerSeconds uint          `json:"stagger_seconds"`
+	Steps          []StartupStep `json:"steps"`
+}
+
+// SetHostStartupSettings enables or disables ordered startup for a host.
+func (s *HostService) SetHostStartupSettings(hostID string, settings HostStartupSettings) error {
+	if settings.StaggerSeconds > maxStartupDelaySeconds {
+		return ErrInvalidStartupSettings
+	}
+	result := s.db.Model(&storage.Host{}).Where("id = ?", hostID).Updates(map[string]interface{}{
+		"startup_ordering":        settings.Enabled,
+		"startup_stagger_seconds": settings.StaggerSeconds,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update startup settings of host %s: %w", hostID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find host %s: %w", hostID, gorm.ErrRecordNotFound)
+	}
+	s.recordAudit("host.startup.update", "host", hostID,
+		fmt.Sprintf("enabled=%t stagger=%ds", settings.Enabled, settings.StaggerSeconds))
+	s.broadcastHostsChanged()
+	return nil
+}
+
+// SetVMStartupSettings sets a VM's place in its host's startup sequence.
+func (s *HostService) SetVMStartupSettings(hostID, vmName string, settings VMStartupSettings) error {
+	if settings.DelaySeconds > maxStartupDelaySeconds {
+		return ErrInvalidStartupSettings
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	err = s.db.Model(vm).Updates(map[string]interface{}{
+		"startup_priority":      settings.Priority,
+		"startup_delay_seconds": settings.DelaySeconds,
+	}).Error
+	if err != nil {
+		return err
+	}
+	s.recordAudit("vm.startup.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("priority=%d delay=%ds", settings.Priority, settings.DelaySeconds))
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
+
+// PreviewHostStartup returns what the startup sequence would do if the host
+// went down now and reconnected: the VMs with a priority that are running
+// now are started again in order, the others are skipped.
+func (s *HostService) PreviewHostStartup(hostID string) (*StartupPlan, error) {
+	var host storage.Host
+	if err := s.db.Where("id = ?", hostID).First(&host).Error; err != nil {
+		return nil, fmt.Errorf("could not find host %s: %w", hostID, err)
+	}
+	return s.startupPlan(&host)
+}
+
+// startupPlan orders the prioritized VMs of a host from the states recorded
+// in the database, which still reflect the time before an outage until the
+// host has been synced again.
+func (s *HostService) startupPlan(host *storage.Host) (*StartupPlan, error) {
+	var vms []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND startup_priority > 0", host.ID).Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	sort.Slice(vms, func(i, j int) bool {
+		if vms[i].StartupPriority != vms[j].StartupPriority {
+			return vms[i].StartupPriority < vms[j].StartupPriority
+		}
+		return vms[i].Name < vms[j].Name
+	})
+
+	plan := &StartupPlan{
+		HostID:         host.ID,
+		Enabled:        host.StartupOrdering,
+		StaggerSeconds: host.StartupStaggerSeconds,
+		Steps:          []StartupStep{},
+	}
+	var offset uint
+	for _, vm := range vms {
+		step := StartupStep{VMName: vm.Name, Priority: vm.StartupPriority, Action: StartupActionStart}
+		if !slices.Contains(committedStates, vm.State) {
+			step.Action = StartupActionSkip
+			step.Reason = fmt.Sprintf("was %s before the outage", strings.ToLower(string(vm.State)))
+			plan.Steps = append(plan.Steps, step)
+			continue
+		}
+		step.StartAtSeconds = offset
+		step.DelaySeconds = vm.StartupDelaySeconds
+		if step.DelaySeconds == 0 {
+			step.DelaySeconds = host.StartupStaggerSeconds
+		}
+		offset += step.DelaySeconds
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+// resumeHost syncs a host that has just connected and, if the host uses
+// ordered startup, starts the VMs that were running before it went away.
+// VMs recovered elsewhere while it was dead are removed from it first.
+func (s *HostService) resumeHost(host storage.Host) {
+	s.removeRecoveredVMs(host.ID)
+	if _, err := s.GetHostInfo(host.ID); err != nil {
+		log.Printf("Warning: failed to read details of host %s: %v", host.ID, err)
+	}
+	plan, err := s.startupPlan(&host)
+	s.SyncVMsForHost(host.ID)
+	if err != nil {
+		log.Printf("Warning: failed to plan the startup of host %s: %v", host.ID, err)
+		return
+	}
+	if !host.StartupOrdering {
+		return
+	}
+	if host.MaintenanceMode {
+		log.Printf("Host %s is in maintenance mode; not starting its VMs", host.ID)
+		return
+	}
+	var toStart []StartupStep
+	for _, step := range plan.Steps {
+		if step.Action == StartupActionStart {
+			toStart = append(toStart, step)
+		}
+	}
+	if len(toStart) == 0 {
+		return
+	}
+
+	task, err := s.tasks.Start("host.startup", fmt.Sprintf("Starting %d VMs of %s in order", len(toStart), host.ID))
+	if err != nil {
+		log.Printf("Warning: failed to start the startup sequence of host %s: %v", host.ID, err)
+		return
+	}
+	err = s.runStartupSequence(task, host.ID, toStart)
+	if err != nil {
+		log.Printf("Startup sequence of host %s: %v", host.ID, err)
+	}
+	s.tasks.Finish(task, err)
+}
+
+func (s *HostService) runStartupSequence(task *storage.Task, hostID string, steps []StartupStep) error {
+	var failed []string
+	for i, step := range steps {
+		progress := 100 * i / len(steps)
+		var vm storage.VirtualMachine
+		if err := s.db.Where("host_id = ? AND name = ?", hostID, step.VMName).First(&vm).Error; err != nil {
+			s.tasks.Step(task, progress, fmt.Sprintf("%s no longer exists", step.VMName))
+			continue
+		}
+		if vm.State != storage.StateStopped {
+			// Still running, e.g. only Virtumancer lost its connection, or
+			// started by libvirt's autostart.
+			s.tasks.Step(task, progress, fmt.Sprintf("%s is already %s", step.VMName, strings.ToLower(string(vm.State))))
+			continue
+		}
+		if err := s.StartVM(context.Background(), hostID, step.VMName); err != nil {
+			failed = append(failed, step.VMName)
+			s.tasks.Step(task, progress, fmt.Sprintf("Failed to start %s: %v", step.VMName, err))
+			continue
+		}
+		s.tasks.Step(task, progress, fmt.Sprintf("Started %s (priority %d)", step.VMName, step.Priority))
+		if i < len(steps)-1 && step.DelaySeconds > 0 {
+			time.Sleep(time.Duration(step.DelaySeconds) * time.Second)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to start %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+)
+
+// interruptedMessage is logged on tasks and jobs cut short by a restart.
+const interruptedMessage = "Interrupted by a server restart"
+
+// RecoverInterruptedTasks deals with the tasks that were pending or running
+// when the server stopped. Their goroutines are gone, so each is marked
+// interrupted and recorded as an event. Migration jobs keep checkpoints, but
+// are only marked interrupted too: the VM may have been started since, so an
+// operator resumes them. Runbook runs are only marked interrupted. Run it
+// once at startup.
+func (s *HostService) RecoverInterruptedTasks() {
+	var tasks []storage.Task
+	unfinished := []storage.TaskStatus{storage.TaskPending, storage.TaskRunning}
+	if err := s.db.Where("status IN ?", unfinished).Find(&tasks).Error; err != nil {
+		log.Printf("Warning: failed to look for interrupted tasks: %v", err)
+		return
+	}
+	s.interruptMigrationJobs()
+	s.interruptRunbookRuns()
+
+	for i := range tasks {
+		task := &tasks[i]
+		task.Status = storage.TaskInterrupted
+		task.Error = interruptedMessage
+		s.tasks.Step(task, task.Progress, interruptedMessage)
+		message := fmt.Sprintf("Task %d (%s) was interrupted by a server restart", task.ID, task.Type)
+		log.Print(message)
+		s.recordEvent(EventTaskInterrupted, "", "", message, map[string]interface{}{"task_id": task.ID, "task_type": task.Type})
+	}
+
+	if len(tasks) > 0 {
+		s.hub.BroadcastMessage(ws.Message{
+			Type:    "tasks-recovered",
+			Payload: ws.MessagePayload{"interrupted": len(tasks)},
+		})
+	}
+}
+
+// interruptMigrationJobs marks the migration jobs that were running when the
+// server stopped as interrupted. They keep their phase and disks, to be
+// resumed by hand once the VM is confirmed to be still shut off.
+func (s *HostService) interruptMigrationJobs() {
+	var jobs []storage.MigrationJob
+	if err := s.db.Where("status IN ?", []storage.TaskStatus{storage.TaskPending, storage.TaskRunning}).Find(&jobs).Error; err != nil {
+		log.Printf("Warning: failed to look for interrupted migration jobs: %v", err)
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		job.Status = storage.TaskInterrupted
+		job.Error = interruptedMessage + "; resume the job once the VM is confirmed to be shut off"
+		s.saveMigrationJob(job)
+		log.Printf("Migration job %d of %s was interrupted in phase %s; it must be resumed by hand", job.ID, job.VMName, job.Phase)
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/ws"
+	"gorm.io/gorm"
+)
+
+// TaskManager persists long-running operations and streams their progress
+// to websocket clients.
+type TaskManager struct {
+	db  *gorm.DB
+	hub *ws.Hub
+}
+
+// NewTaskManager creates a new task manager.
+func NewTaskManager(db *gorm.DB, hub *ws.Hub) *TaskManager {
+	return &TaskManager{db: db, hub: hub}
+}
+
+// Start creates a task in the running state. The task returned is the
+// worker's to update; hand others a copyTask taken before the worker starts.
+func (m *TaskManager) Start(taskType, details string) (*storage.Task, error) {
+	task := &storage.Task{
+		Type:    taskType,
+		Status:  storage.TaskRunning,
+		Details: details,
+	}
+	if err := m.db.Create(task).Error; err != nil {
+		return nil, fmt.Errorf("failed to create %s task: %w", taskType, err)
+	}
+	m.broadcast(task)
+	return task, nil
+}
+
+// Step appends a line to the task's step log and updates its progress.
+func (m *TaskManager) Step(task *storage.Task, progress int, message string) {
+	if task.Details == "" {
+		task.Details = message
+	} else {
+		task.Details = task.Details + "\n" + message
+	}
+	task.Progress = progress
+	m.save(task)
+}
+
+// Report updates the progress and live measurements of a task without
+// adding to its step log.
+func (m *TaskManager) Report(task *storage.Task, progress int, metrics map[string]interface{}) {
+	task.Progress = progress
+	task.Metrics = metrics
+	m.save(task)
+}
+
+// Finish marks a task as completed, or failed if err is non-nil.
+func (m *TaskManager) Finish(task *storage.Task, err error) {
+	if err != nil {
+		task.Status = storage.TaskFailed
+		task.Error = err.Error()
+	} else {
+		task.Status = storage.TaskCompleted
+		task.Progress = 100
+	}
+	m.save(task)
+}
+
+// List returns the most recent tasks, newest first.
+func (m *TaskManager) List(limit int) ([]storage.Task, error) {
+	var tasks []storage.Task
+	if err := m.db.Order("id desc").Limit(limit).Find(&tasks).Error; err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// Get returns a single task by ID.
+func (m *TaskManager) Get(id uint) (*storage.Task, error) {
+	var task storage.Task
+	if err := m.db.First(&task, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find task %d: %w", id, err)
+	}
+	return &task, nil
+}
+
+func (m *TaskManager) save(task *storage.Task) {
+	if err := m.db.Save(task).Error; err != nil {
+		log.Printf("Warning: failed to persist task %d: %v", task.ID, err)
+	}
+	m.broadcast(task)
+}
+
+// broadcast sends a copy of the task, as the hub encodes it later while the
+// worker goes on updating the original.
+func (m *TaskManager) broadcast(task *storage.Task) {
+	m.hub.BroadcastMessage(ws.Message{
+		Type: "task-updated",
+		Payload: ws.MessagePayload{
+			"task": copyTask(task),
+		},
+	})
+}
+
+// copyTask returns a copy of a task that is safe to read while the task's
+// worker updates the original, e.g. to return from a request.
+func copyTask(task *storage.Task) *storage.Task {
+	c := *task
+	c.Metrics = maps.Clone(task.Metrics)
+	return &c
+}
+
+// ListTasks returns the most recent tasks.
+func (s *HostService) ListTasks() ([]storage.Task, error) {
+	return s.tasks.List(100)
+}
+
+// GetTask returns a single task.
+func (s *HostService) GetTask(id uint) (*storage.Task, error) {
+	return s.tasks.Get(id)
+}
+
+// lastLine returns the final line of command output, for compact step logs.
+func lastLine(output string) string {
+	output = strings.TrimSpace(output)
+	if i := strings.LastIndex(output, "\n"); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"strconv"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// The Terraform* views are the read side of a Terraform provider. They come
+// from the database only, so reading them never triggers a sync or talks to
+// libvirt, and their shapes only ever grow. Every resource has a stable
+// string ID and a generation that increments whenever the resource changes,
+// letting the provider tell drift from a refresh that found nothing new.
+
+// TerraformHost is a host as read by a Terraform provider.
+type TerraformHost struct {
+	ID              string `json:"id"`
+	Name            string `json:"name"`
+	URI             string `json:"uri"`
+	Driver          string `json:"driver"`
+	ProxyJump       string `json:"proxy_jump"`
+	MaintenanceMode bool   `json:"maintenance_mode"`
+	Generation      uint64 `json:"generation"`
+}
+
+// TerraformVM is a VM as read by a Terraform provider. Its ID is
+// Virtumancer's UUID of the VM, which survives renames.
+type TerraformVM struct {
+	ID          string            `json:"id"`
+	HostID      string            `json:"host_id"`
+	Name        string            `json:"name"`
+	DomainUUID  string            `json:"domain_uuid"`
+	Description string            `json:"description"`
+	State       storage.VMState   `json:"state"`
+	VCPUCount   uint              `json:"vcpu_count"`
+	MemoryBytes uint64            `json:"memory_bytes"`
+	CPUModel    string            `json:"cpu_model"`
+	OSType      string            `json:"os_type"`
+	OSVariant   string            `json:"os_variant"`
+	IsTemplate  bool              `json:"is_template"`
+	Labels      map[string]string `json:"labels"`
+	Generation  uint64            `json:"generation"`
+}
+
+// TerraformNetwork is a network as read by a Terraform provider.
+type TerraformNetwork struct {
+	ID              string `json:"id"`
+	HostID          string `json:"host_id"`
+	Name            string `json:"name"`
+	UUID            string `json:"uuid"`
+	BridgeName      string `json:"bridge_name"`
+	Mode            string `json:"mode"`
+	VirtualPortType string `json:"virtualport_type"`
+	VLANID          uint   `json:"vlan_id"`
+	Generation      uint64 `json:"generation"`
+}
+
+// TerraformVolume is a storage volume as read by a Terraform provider.
+type TerraformVolume struct {
+	ID              string `json:"id"`
+	HostID          string `json:"host_id"`
+	Pool            string `json:"pool"`
+	Name            string `json:"name"`
+	Type            string `json:"type"` // DISK or ISO
+	Format          string `json:"format"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	SHA256          string `json:"sha256"`
+	Generation      uint64 `json:"generation"`
+}
+
+// TerraformFilter narrows a list to one host and, optionally, one name.
+// Empty fields match everything.
+type TerraformFilter struct {
+	HostID string
+	Pool   string // Volumes only
+	Name   string
+}
+
+func terraformHost(h storage.Host) TerraformHost {
+	return TerraformHost{
+		ID:              h.ID,
+		Name:            h.Name,
+		URI:             h.URI,
+		Driver:          h.Driver,
+		ProxyJump:       h.ProxyJump,
+		MaintenanceMode: h.MaintenanceMode,
+		Generation:      h.Generation,
+	}
+}
+
+// TerraformHosts lists the hosts, optionally only the one of a name.
+func (s *HostService) TerraformHosts(name string) ([]TerraformHost, error) {
+	query := s.db.Order("name")
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	var hosts []storage.Host
+	if err := query.Find(&hosts).Error; err != nil {
+		return nil, err
+	}
+	views := make([]TerraformHost, len(hosts))
+	for i, h := range hosts {
+		views[i] = terraformHost(h)
+	}
+	return views, nil
+}
+
+// TerraformHost returns a host by ID.
+func (s *HostService) TerraformHost(id string) (*TerraformHost, error) {
+	var host storage.Host
+	if err := s.db.First(&host, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	view := terraformHost(host)
+	return &view, nil
+}
+
+// TerraformVMs lists the VMs, templates included.
+func (s *HostService) TerraformVMs(filter TerraformFilter) ([]TerraformVM, error) {
+	query := s.db.Order("host_id, name")
+	if filter.HostID != "" {
+		query = query.Where("host_id = ?", s.ResolveHostID(filter.HostID))
+	}
+	if filter.Name != "" {
+		query = query.Where("name = ?", filter.Name)
+	}
+	var vms []storage.VirtualMachine
+	if err := query.Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	return s.terraformVMs(vms)
+}
+
+// TerraformVM returns a VM by its UUID.
+func (s *HostService) TerraformVM(id string) (*TerraformVM, error) {
+	var vm storage.VirtualMachine
+	if err := s.db.First(&vm, "uuid = ?", id).Error; err != nil {
+		return nil, err
+	}
+	views, err := s.terraformVMs([]storage.VirtualMachine{vm})
+	if err != nil {
+		return nil, err
+	}
+	return &views[0], nil
+}
+
+// terraformVMs builds the views of VMs, reading their labels in one query.
+func (s *HostService) terraformVMs(vms []storage.VirtualMachine) ([]TerraformVM, error) {
+	views := make([]TerraformVM, len(vms))
+	byID := make(map[uint]*TerraformVM, len(vms))
+	ids := make([]uint, len(vms))
+	for i, vm := range vms {
+		views[i] = TerraformVM{
+			ID:          vm.UUID,
+			HostID:      vm.HostID,
+			Name:        vm.Name,
+			DomainUUID:  vm.DomainUUID,
+			Description: vm.Description,
+			State:       vm.State,
+			VCPUCount:   vm.VCPUCount,
+			MemoryBytes: vm.MemoryBytes,
+			CPUModel:    vm.CPUModel,
+			OSType:      vm.OSType,
+			OSVariant:   vm.OSVariant,
+			IsTemplate:  vm.IsTemplate,
+			Labels:      map[string]string{},
+			Generation:  vm.Generation,
+		}
+		byID[vm.ID] = &views[i]
+		ids[i] = vm.ID
+	}
+	if len(ids) == 0 {
+		return views, nil
+	}
+	var labels []storage.VMLabel
+	if err := s.db.Where("vm_id IN ?", ids).Find(&labels).Error; err != nil {
+		return nil, err
+	}
+	for _, label := range labels {
+		byID[label.VMID].Labels[label.Key] = label.Value
+	}
+	return views, nil
+}
+
+func terraformNetwork(n storage.Network) TerraformNetwork {
+	return TerraformNetwork{
+		ID:              strconv.FormatUint(uint64(n.ID), 10),
+		HostID:          n.HostID,
+		Name:            n.Name,
+		UUID:            n.UUID,
+		BridgeName:      n.BridgeName,
+		Mode:            n.Mode,
+		VirtualPortType: n.VirtualPortType,
+		VLANID:          n.VLANID,
+		Generation:      n.Generation,
+	}
+}
+
+// TerraformNetworks lists the networks.
+func (s *HostService) TerraformNetworks(filter TerraformFilter) ([]TerraformNetwork, error) {
+	query := s.db.Order("host_id, name")
+	if filter.HostID != "" {
+		query = query.Where("host_id = ?", s.ResolveHostID(filter.HostID))
+	}
+	if filter.Name != "" {
+		query = query.Where("name = ?", filter.Name)
+	}
+	var networks []storage.Network
+	if err := query.Find(&networks).Error; err != nil {
+		return nil, err
+	}
+	views := make([]TerraformNetwork, len(networks))
+	for i, n := range networks {
+		views[i] = terraformNetwork(n)
+	}
+	return views, nil
+}
+
+// TerraformNetwork returns a network by ID.
+func (s *HostService) TerraformNetwork(id uint) (*TerraformNetwork, error) {
+	var network storage.Network
+	if err := s.db.First(&network, id).Error; err != nil {
+		return nil, err
+	}
+	view := terraformNetwork(network)
+	return &view, nil
+}
+
+// terraformVolumeRow is a volume joined with its pool.
+type terraformVolumeRow struct {
+	storage.Volume
+	HostID   string
+	PoolName string
+}
+
+func (s *HostService) volumeQuery() *gorm.DB {
+	return s.db.Model(&storage.Volume{}).
+		Select("volumes.*, storage_pools.host_id AS host_id, storage_pools.name AS pool_name").
+		Joins("JOIN storage_pools ON storage_pools.id = volumes.storage_pool_id AND storage_pools.deleted_at IS NULL")
+}
+
+func terraformVolume(v terraformVolumeRow) TerraformVolume {
+	return TerraformVolume{
+		ID:              strconv.FormatUint(uint64(v.ID), 10),
+		HostID:          v.HostID,
+		Pool:            v.PoolName,
+		Name:            v.Name,
+		Type:            v.Type,
+		Format:          v.Format,
+		CapacityBytes:   v.CapacityBytes,
+		AllocationBytes: v.AllocationBytes,
+		SHA256:          v.SHA256,
+		Generation:      v.Generation,
+	}
+}
+
+// TerraformVolumes lists the volumes of the storage pools.
+func (s *HostService) TerraformVolumes(filter TerraformFilter) ([]TerraformVolume, error) {
+	query := s.volumeQuery().Order("storage_pools.host_id, storage_pools.name, volumes.name")
+	if filter.HostID != "" {
+		query = query.Where("storage_pools.host_id = ?", s.ResolveHostID(filter.HostID))
+	}
+	if filter.Pool != "" {
+		query = query.Where("storage_pools.name = ?", filter.Pool)
+	}
+	if filter.Name != "" {
+		query = query.Where("volumes.name = ?", filter.Name)
+	}
+	var rows []terraformVolumeRow
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	views := make([]TerraformVolume, len(rows))
+	for i, row := range rows {
+		views[i] = terraformVolume(row)
+	}
+	return views, nil
+}
+
+// TerraformVolume returns a volume by ID.
+func (s *HostService) TerraformVolume(id uint) (*TerraformVolume, error) {
+	var rows []terraformVolumeRow
+	if err := s.volumeQuery().Where("volumes.id = ?", id).Limit(1).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	view := terraformVolume(rows[0])
+	return &view, nil
+}
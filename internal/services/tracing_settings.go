@@ -0,0 +1,81 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/tracing"
+)
+
+// TracingSettingsRequest changes where spans are exported. The sample ratio
+// defaults to tracing every request.
+type TracingSettingsRequest struct {
+	Enabled     bool     `json:"enabled"`
+	Endpoint    string   `json:"endpoint"`
+	Insecure    bool     `json:"insecure"`
+	SampleRatio *float64 `json:"sample_ratio"`
+}
+
+func tracingConfig(settings *storage.TracingSettings) tracing.Config {
+	return tracing.Config{
+		Enabled:     settings.Enabled,
+		Endpoint:    settings.Endpoint,
+		Insecure:    settings.Insecure,
+		SampleRatio: settings.SampleRatio,
+	}
+}
+
+// ConfigureTracing starts exporting spans if tracing is enabled.
+func (s *HostService) ConfigureTracing() {
+	settings, err := s.GetTracingSettings()
+	if err != nil || !settings.Enabled {
+		return
+	}
+	if err := tracing.Configure(tracingConfig(settings)); err != nil {
+		log.Printf("Warning: tracing is not exported: %v", err)
+		return
+	}
+	log.Printf("Exporting traces to %s", settings.Endpoint)
+}
+
+// GetTracingSettings returns where spans are exported.
+func (s *HostService) GetTracingSettings() (*storage.TracingSettings, error) {
+	settings := storage.TracingSettings{SampleRatio: 1}
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetTracingSettings changes where spans are exported. It takes effect at
+// once; spans of the previous exporter are flushed first.
+func (s *HostService) SetTracingSettings(req TracingSettingsRequest) (*storage.TracingSettings, error) {
+	row := storage.TracingSettings{ID: 1, Enabled: req.Enabled, Endpoint: req.Endpoint, Insecure: req.Insecure, SampleRatio: 1}
+	var v validator
+	if req.SampleRatio != nil {
+		if *req.SampleRatio < 0 || *req.SampleRatio > 1 {
+			v.add("sample_ratio", "must be between 0 and 1")
+		}
+		row.SampleRatio = *req.SampleRatio
+	}
+	if req.Enabled && req.Endpoint == "" {
+		v.add("endpoint", "is required to enable tracing")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	if err := tracing.Configure(tracingConfig(&row)); err != nil {
+		if errors.Is(err, tracing.ErrInvalidEndpoint) {
+			return nil, &ValidationError{Fields: []FieldError{{Field: "endpoint", Message: err.Error()}}}
+		}
+		return nil, err
+	}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save tracing settings: %w", err)
+	}
+	s.recordAudit("tracing.update", "tracing", "global",
+		fmt.Sprintf("enabled=%t endpoint=%s sample_ratio=%g", row.Enabled, row.Endpoint, row.SampleRatio))
+	return s.GetTracingSettings()
+}
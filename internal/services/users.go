@@ -0,0 +1,442 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// PermissionManageUsers allows managing user accounts.
+const PermissionManageUsers = "users.manage"
+
+// Roles created on first start. Only admins can manage users, hosts, cost
+// rates, projects, email and feature flags, read diagnostics, run host
+// commands and capture packets, so far. Operators can also delete volumes and pool files.
+var defaultRoles = map[string][]string{
+	"admin":    {PermissionManageUsers, PermissionManageHosts, PermissionManageStorage, PermissionManageCosts, PermissionManageProjects, PermissionManageEmail, PermissionViewDiagnostics, PermissionManageFeatures, PermissionHostExec, PermissionManageCaptures},
+	"operator": {PermissionManageStorage},
+	"viewer":   {},
+}
+
+var (
+	// ErrInvalidUser is returned for a user without a username or with an unknown role.
+	ErrInvalidUser = errors.New("a user needs a username and an existing role")
+	// ErrUserExists is returned when a username is already taken.
+	ErrUserExists = errors.New("user already exists")
+	// ErrSelfManagement is returned when an admin tries to disable, demote or
+	// delete their own account, which could leave nobody able to manage users.
+	ErrSelfManagement = errors.New("admins cannot disable, demote or delete their own account")
+	// ErrForbidden is returned when a user lacks the permission for an action.
+	ErrForbidden = errors.New("permission denied")
+)
+
+// UserRequest creates a user. With Invite, the account details are emailed
+// to the user, who has to change the password at the first login.
+type UserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	Email    string `json:"email"`
+	Invite   bool   `json:"invite"`
+}
+
+// UserView is a user account as shown to admins.
+type UserView struct {
+	ID                 uint       `json:"id"`
+	Username           string     `json:"username"`
+	Email              string     `json:"email"`
+	Role               string     `json:"role"`
+	Disabled           bool       `json:"disabled"`
+	MustChangePassword bool       `json:"must_change_password"`
+	LockedUntil        *time.Time `json:"locked_until"`
+	CreatedAt          time.Time  `json:"created_at"`
+	LastLoginAt        *time.Time `json:"last_login_at"`
+	PasswordChangedAt  *time.Time `json:"password_changed_at"`
+	FailedLogins       uint       `json:"failed_logins"` // Since the last successful login or lockout
+}
+
+// EnsureDefaultUsers creates the default roles, and an admin account with a
+// random password if there are no users yet. The password is logged once;
+// change it after the first login.
+func (s *HostService) EnsureDefaultUsers() {
+	for name, actions := range defaultRoles {
+		var role storage.Role
+		if err := s.db.Where("name = ?", name).FirstOrCreate(&role, storage.Role{Name: name}).Error; err != nil {
+			log.Printf("Warning: failed to create role %s: %v", name, err)
+			continue
+		}
+		for _, action := range actions {
+			var perm storage.Permission
+			if err := s.db.Where("action = ?", action).FirstOrCreate(&perm, storage.Permission{Action: action}).Error; err != nil {
+				log.Printf("Warning: failed to create permission %s: %v", action, err)
+				continue
+			}
+			if err := s.db.Model(&role).Association("Permissions").Append(&perm); err != nil {
+				log.Printf("Warning: failed to grant %s to role %s: %v", action, name, err)
+			}
+		}
+	}
+
+	var count int64
+	if err := s.db.Model(&storage.User{}).Count(&count).Error; err != nil || count > 0 {
+		return
+	}
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("Warning: failed to generate the initial admin password: %v", err)
+		return
+	}
+	password := base64.RawURLEncoding.EncodeToString(buf)
+	if _, err := s.CreateUser(0, UserRequest{Username: "admin", Password: password, Role: "admin"}); err != nil {
+		log.Printf("Warning: failed to create the initial admin user: %v", err)
+		return
+	}
+	s.db.Model(&storage.User{}).Where("username = ?", "admin").Update("must_change_password", true)
+	log.Printf("Created user admin with password %s; change it after logging in", password)
+}
+
+// UsersExist reports whether any user account exists. Once one does, every
+// request but logging in needs a session.
+func (s *HostService) UsersExist() (bool, error) {
+	var count int64
+	err := s.db.Model(&storage.User{}).Count(&count).Error
+	return count > 0, err
+}
+
+// UserHasPermission reports whether a user's role grants an action.
+func (s *HostService) UserHasPermission(user *storage.User, action string) (bool, error) {
+	if user.RoleID == 0 {
+		return false, nil
+	}
+	var count int64
+	err := s.db.Table("role_permissions").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("role_permissions.role_id = ? AND permissions.action = ?", user.RoleID, action).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (s *HostService) roleNames() (map[uint]string, error) {
+	var roles []storage.Role
+	if err := s.db.Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string, len(roles))
+	for _, role := range roles {
+		names[role.ID] = role.Name
+	}
+	return names, nil
+}
+
+func (s *HostService) roleID(name string) (uint, error) {
+	var role storage.Role
+	if err := s.db.Where("name = ?", name).Limit(1).Find(&role).Error; err != nil {
+		return 0, err
+	}
+	if role.ID == 0 {
+		return 0, ErrInvalidUser
+	}
+	return role.ID, nil
+}
+
+func userToView(user storage.User, roles map[uint]string) UserView {
+	return UserView{
+		ID:                 user.ID,
+		Username:           user.Username,
+		Email:              user.Email,
+		Role:               roles[user.RoleID],
+		Disabled:           user.Disabled,
+		MustChangePassword: user.MustChangePassword,
+		LockedUntil:        user.LockedUntil,
+		CreatedAt:          user.CreatedAt,
+		LastLoginAt:        user.LastLoginAt,
+		PasswordChangedAt:  user.PasswordChangedAt,
+		FailedLogins:       user.FailedLogins,
+	}
+}
+
+// ListRoles returns the roles users can be given.
+func (s *HostService) ListRoles() ([]storage.Role, error) {
+	roles := []storage.Role{}
+	if err := s.db.Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// ListUsers returns all user accounts.
+func (s *HostService) ListUsers() ([]UserView, error) {
+	roles, err := s.roleNames()
+	if err != nil {
+		return nil, err
+	}
+	var users []storage.User
+	if err := s.db.Order("username").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	views := make([]UserView, 0, len(users))
+	for _, user := range users {
+		views = append(views, userToView(user, roles))
+	}
+	return views, nil
+}
+
+// GetUser returns a single user account.
+func (s *HostService) GetUser(id uint) (*UserView, error) {
+	var user storage.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find user %d: %w", id, err)
+	}
+	roles, err := s.roleNames()
+	if err != nil {
+		return nil, err
+	}
+	view := userToView(user, roles)
+	return &view, nil
+}
+
+// CreateUser adds a user account with a role. actorID is the admin doing
+// it, 0 for the system.
+func (s *HostService) CreateUser(actorID uint, req UserRequest) (*UserView, error) {
+	req.Username = strings.TrimSpace(req.Username)
+	if req.Username == "" {
+		return nil, ErrInvalidUser
+	}
+	roleID, err := s.roleID(req.Role)
+	if err != nil {
+		return nil, err
+	}
+	email, err := s.checkUserEmail(req.Email, req.Invite)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Unscoped().Model(&storage.User{}).Where("username = ?", req.Username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUserExists, req.Username)
+	}
+	user := storage.User{Username: req.Username, Email: email, PasswordHash: hash, RoleID: roleID, MustChangePassword: req.Invite}
+	if err := s.db.Create(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to save user: %w", err)
+	}
+	s.recordUserAudit(actorID, "user.create", "user", user.Username, fmt.Sprintf("role=%s", req.Role))
+	if req.Invite {
+		s.emailUser(actorID, &user, "user.invite", "Your Virtumancer account",
+			fmt.Sprintf("An account has been created for you on Virtumancer.\n\nUsername: %s\nTemporary password: %s\n\n"+
+				"You will be asked to choose a new password when you first log in.\n", user.Username, req.Password))
+	}
+	return s.GetUser(user.ID)
+}
+
+// checkUserEmail checks the email address of a user and returns it without
+// any display name. Sending to it requires email to be enabled.
+func (s *HostService) checkUserEmail(email string, send bool) (string, error) {
+	var v validator
+	email = strings.TrimSpace(email)
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			v.add("email", "'%s' is not an email address", email)
+		} else {
+			email = addr.Address
+		}
+	} else if send {
+		v.add("email", "is required to send an email")
+	}
+	if err := v.err(); err != nil {
+		return "", err
+	}
+	if send {
+		settings, err := s.loadEmailSettings()
+		if err != nil {
+			return "", err
+		}
+		if !settings.Enabled {
+			return "", ErrEmailDisabled
+		}
+	}
+	return email, nil
+}
+
+// emailUser sends an account email to a user. Failures are logged and
+// recorded in the audit log, but do not undo the change being reported.
+func (s *HostService) emailUser(actorID uint, user *storage.User, action, subject, body string) {
+	if err := s.sendEmail([]string{user.Email}, subject, body); err != nil {
+		log.Printf("Warning: %v", err)
+		s.recordUserAudit(actorID, action+".failed", "user", user.Username, err.Error())
+		return
+	}
+	s.recordUserAudit(actorID, action, "user", user.Username, "to="+user.Email)
+}
+
+// SetUserEmail changes the email address of a user; an empty one removes it.
+func (s *HostService) SetUserEmail(actorID, id uint, email string) (*UserView, error) {
+	email, err := s.checkUserEmail(email, false)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.updateUser(actorID, id, true, func(u *storage.User) error {
+		u.Email = email
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.recordUserAudit(actorID, "user.email.update", "user", user.Username, "email="+email)
+	return s.GetUser(id)
+}
+
+// updateUser loads a user, applies a change and saves it, refusing changes
+// an admin makes to their own account if self is false.
+func (s *HostService) updateUser(actorID, id uint, self bool, change func(*storage.User) error) (*storage.User, error) {
+	if !self && actorID == id {
+		return nil, ErrSelfManagement
+	}
+	var user storage.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return nil, fmt.Errorf("could not find user %d: %w", id, err)
+	}
+	if err := change(&user); err != nil {
+		return nil, err
+	}
+	if err := s.db.Save(&user).Error; err != nil {
+		return nil, fmt.Errorf("failed to save user %s: %w", user.Username, err)
+	}
+	return &user, nil
+}
+
+// SetUserRole gives a user another role.
+func (s *HostService) SetUserRole(actorID, id uint, role string) (*UserView, error) {
+	roleID, err := s.roleID(role)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.updateUser(actorID, id, false, func(u *storage.User) error {
+		u.RoleID = roleID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.recordUserAudit(actorID, "user.role.update", "user", user.Username, fmt.Sprintf("role=%s", role))
+	return s.GetUser(id)
+}
+
+// SetUserDisabled disables or re-enables a user. Disabling ends the user's
+// sessions.
+func (s *HostService) SetUserDisabled(actorID, id uint, disabled bool) (*UserView, error) {
+	user, err := s.updateUser(actorID, id, !disabled, func(u *storage.User) error {
+		u.Disabled = disabled
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	action := "user.enable"
+	if disabled {
+		action = "user.disable"
+		if _, err := s.RevokeOtherUserSessions(id, 0); err != nil {
+			return nil, err
+		}
+	}
+	s.recordUserAudit(actorID, action, "user", user.Username, "")
+	return s.GetUser(id)
+}
+
+// ResetUserPassword sets a temporary password that the user has to change,
+// and ends the user's sessions. With sendEmail, the temporary password is
+// emailed to the user.
+func (s *HostService) ResetUserPassword(actorID, id uint, password string, sendEmail bool) (*UserView, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	if sendEmail {
+		var target storage.User
+		if err := s.db.First(&target, id).Error; err != nil {
+			return nil, fmt.Errorf("could not find user %d: %w", id, err)
+		}
+		if _, err := s.checkUserEmail(target.Email, true); err != nil {
+			return nil, err
+		}
+	}
+	user, err := s.updateUser(actorID, id, true, func(u *storage.User) error {
+		u.PasswordHash = hash
+		u.MustChangePassword = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.RevokeOtherUserSessions(id, 0); err != nil {
+		return nil, err
+	}
+	s.recordUserAudit(actorID, "user.password.reset", "user", user.Username, "")
+	if sendEmail {
+		s.emailUser(actorID, user, "user.password.email", "Your Virtumancer password was reset",
+			fmt.Sprintf("An administrator has reset your Virtumancer password.\n\nUsername: %s\nTemporary password: %s\n\n"+
+				"You will be asked to choose a new password when you next log in.\n", user.Username, password))
+	}
+	return s.GetUser(id)
+}
+
+// UnlockUser lifts a lockout before it runs out and forgets earlier failed
+// logins.
+func (s *HostService) UnlockUser(actorID, id uint) (*UserView, error) {
+	user, err := s.updateUser(actorID, id, true, func(u *storage.User) error {
+		u.LockedUntil = nil
+		u.FailedLogins = 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.recordUserAudit(actorID, "user.unlock", "user", user.Username, "")
+	return s.GetUser(id)
+}
+
+// DeleteUser removes a user account, its sessions and its project
+// memberships.
+func (s *HostService) DeleteUser(actorID, id uint) error {
+	if actorID == id {
+		return ErrSelfManagement
+	}
+	var user storage.User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return fmt.Errorf("could not find user %d: %w", id, err)
+	}
+	err := storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", id).Delete(&storage.UserSession{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&storage.ProjectMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&storage.NotificationSubscription{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&storage.Notification{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&user).Error
+	})
+	if err != nil {
+		return err
+	}
+	s.recordUserAudit(actorID, "user.delete", "user", user.Username, "")
+	return nil
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// maxVMNameLength is the longest VM name accepted, in bytes.
+const maxVMNameLength = 255
+
+// hostNamePattern restricts host names to ones that are safe in URLs and log
+// lines.
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"` // JSON name of the field, or path parameter
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a request has missing or malformed fields.
+// The API answers it with 422 and the list of fields.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		problems[i] = f.Field + ": " + f.Message
+	}
+	return "invalid request: " + strings.Join(problems, "; ")
+}
+
+// validator collects the field errors of a request.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) add(field, format string, args ...any) {
+	v.fields = append(v.fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required records an error if value is empty and reports whether it is set.
+func (v *validator) required(field, value string) bool {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+		return false
+	}
+	return true
+}
+
+// err returns the collected errors as a *ValidationError, or nil.
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	return &ValidationError{Fields: v.fields}
+}
+
+// hostName checks the display name of a host.
+func (v *validator) hostName(field, name string) {
+	if v.required(field, name) && !hostNamePattern.MatchString(name) {
+		v.add(field, "must be 1-64 letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+}
+
+// hostURI checks a libvirt URI: a supported driver and transport, and a
+// machine to connect to for remote transports.
+func (v *validator) hostURI(field, uri string) *libvirt.HostURI {
+	if !v.required(field, uri) {
+		return nil
+	}
+	parsed, err := libvirt.ParseHostURI(uri)
+	if err != nil {
+		v.add(field, "%v", err)
+		return nil
+	}
+	switch parsed.Transport {
+	case libvirt.TransportSSH, libvirt.TransportTCP:
+		if parsed.URL.Hostname() == "" {
+			v.add(field, "must name the machine to connect to, e.g. %s+%s://host/system", parsed.Driver, parsed.Transport)
+		}
+	case libvirt.TransportUnix:
+		if parsed.URL.Host != "" {
+			v.add(field, "a local URI cannot name a machine; use %s+ssh or %s+tcp", parsed.Driver, parsed.Driver)
+		}
+	}
+	return parsed
+}
+
+// ValidateHost checks a host about to be added.
+func ValidateHost(host *storage.Host) error {
+	var v validator
+	v.hostName("name", host.Name)
+	uri := v.hostURI("uri", host.URI)
+	if host.ProxyJump != "" && uri != nil && uri.Transport != libvirt.TransportSSH {
+		v.add("proxy_jump", "is only used with SSH URIs")
+	}
+	if host.StatsIntervalSeconds < 0 {
+		v.add("stats_interval_seconds", "cannot be negative")
+	}
+	if host.MaxConcurrentRPCs < 0 {
+		v.add("max_concurrent_rpcs", "cannot be negative")
+	}
+	return v.err()
+}
+
+// ValidateHostPrepareRequest checks a request to provision a machine, which is
+// always reached over SSH.
+func ValidateHostPrepareRequest(req *HostPrepareRequest) error {
+	var v validator
+	if uri := v.hostURI("uri", req.URI); uri != nil && uri.Transport != libvirt.TransportSSH {
+		v.add("uri", "must be an SSH URI, e.g. qemu+ssh://root@host/system")
+	}
+	return v.err()
+}
+
+// ValidateVMName checks a VM name the way libvirt does: not empty, no '/'
+// and no control characters.
+func ValidateVMName(field, name string) error {
+	var v validator
+	switch {
+	case name == "":
+		v.add(field, "is required")
+	case len(name) > maxVMNameLength:
+		v.add(field, "must be at most %d bytes", maxVMNameLength)
+	case name == "." || name == "..":
+		v.add(field, "cannot be '.' or '..'")
+	case strings.ContainsRune(name, '/'):
+		v.add(field, "cannot contain '/'")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		v.add(field, "cannot contain control characters")
+	}
+	return v.err()
+}
+
+// ValidateHostID checks the ID or name of an existing host given in a
+// request. Names of hosts added before names were restricted are still
+// accepted, so this only refuses what can never name a host.
+func ValidateHostID(field, id string) error {
+	var v validator
+	switch {
+	case strings.TrimSpace(id) == "":
+		v.add(field, "is required")
+	case strings.IndexFunc(id, unicode.IsControl) >= 0:
+		v.add(field, "cannot contain control characters")
+	}
+	return v.err()
+}
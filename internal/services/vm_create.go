@@ -0,0 +1,371 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// minVMMemoryBytes is the least memory a new VM can be created with.
+const minVMMemoryBytes = 64 << 20
+
+// VolumeRef names an existing volume on the host a VM is created on.
+type VolumeRef struct {
+	Pool   string `json:"pool"`
+	Volume string `json:"volume"`
+}
+
+// VMCreateDisk is the boot disk of a new VM, either an existing volume or
+// one created in the same call.
+type VMCreateDisk struct {
+	Pool    string              `json:"pool"`
+	Volume  string              `json:"volume,omitempty"`
+	Create  *libvirt.VolumeSpec `json:"create,omitempty"`
+	Bus     string              `json:"bus,omitempty"`     // 'virtio' or 'sata'; the profile's default if empty
+	Discard string              `json:"discard,omitempty"` // 'unmap' or 'ignore'
+}
+
+// VMCreateRequest defines a new VM on a host. A hardware preset fills in
+// what is left out, and the profile picks the defaults of the rest: Windows
+// guests boot from EFI with secure boot and a TPM, get Hyper-V
+// enlightenments, a sata boot disk and e1000 NICs, which work before the
+// virtio drivers are installed.
+type VMCreateRequest struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Preset      string             `json:"preset,omitempty"`  // Name of a hardware preset
+	Profile     string             `json:"profile,omitempty"` // 'linux' (default) or 'windows'
+	VCPUs       uint               `json:"vcpus"`
+	MemoryBytes uint64             `json:"memory_bytes"`
+	Firmware    string             `json:"firmware,omitempty"`    // 'bios' or 'efi'
+	SecureBoot  *bool              `json:"secure_boot,omitempty"` // EFI only
+	TPM         *bool              `json:"tpm,omitempty"`
+	Disk        *VMCreateDisk      `json:"disk,omitempty"`
+	InstallISO  *VolumeRef         `json:"install_iso,omitempty"`
+	VirtioISO   *VolumeRef         `json:"virtio_iso,omitempty"` // Windows only; overrides the configured virtio-win ISO
+	NICs        []NICAttachRequest `json:"nics"`
+	CPUShares   *uint64            `json:"cpu_shares,omitempty"`
+	BlkioWeight *uint              `json:"blkio_weight,omitempty"`
+}
+
+// CreatedVM is the result of creating a VM.
+type CreatedVM struct {
+	Name       string        `json:"name"`
+	Preset     string        `json:"preset,omitempty"`
+	Profile    string        `json:"profile"`
+	Firmware   string        `json:"firmware"`
+	SecureBoot bool          `json:"secure_boot"`
+	TPM        bool          `json:"tpm"`
+	Disk       *AttachedDisk `json:"disk"`
+	CDROMs     []string      `json:"cdroms"`
+	NICs       []AttachedNIC `json:"nics"`
+	Warnings   []string      `json:"warnings"`
+}
+
+// GuestSettingsRequest changes the settings applied to new VMs. The
+// virtio-win pool and volume are set or cleared together.
+type GuestSettingsRequest struct {
+	VirtioWinPool   string `json:"virtio_win_pool"`
+	VirtioWinVolume string `json:"virtio_win_volume"`
+}
+
+// applyVMCreateDefaults fills in what the profile decides.
+func applyVMCreateDefaults(req *VMCreateRequest) {
+	windows := req.Profile == libvirt.GuestProfileWindows
+	if req.Profile == "" {
+		req.Profile = libvirt.GuestProfileLinux
+	}
+	if req.Firmware == "" {
+		req.Firmware = libvirt.FirmwareBIOS
+		if windows {
+			req.Firmware = libvirt.FirmwareEFI
+		}
+	}
+	if req.SecureBoot == nil {
+		secureBoot := windows && req.Firmware == libvirt.FirmwareEFI
+		req.SecureBoot = &secureBoot
+	}
+	if req.TPM == nil {
+		req.TPM = &windows
+	}
+	if req.Disk != nil && req.Disk.Bus == "" {
+		req.Disk.Bus = "virtio"
+		if windows {
+			req.Disk.Bus = "sata"
+		}
+	}
+	for i := range req.NICs {
+		if req.NICs[i].Model == "" {
+			req.NICs[i].Model = "virtio"
+			if windows {
+				req.NICs[i].Model = "e1000"
+			}
+		}
+	}
+}
+
+func validateVMCreateRequest(req *VMCreateRequest) error {
+	if err := ValidateVMName("name", req.Name); err != nil {
+		return err
+	}
+	var v validator
+	if req.Profile != libvirt.GuestProfileLinux && req.Profile != libvirt.GuestProfileWindows {
+		v.add("profile", "must be '%s' or '%s'", libvirt.GuestProfileLinux, libvirt.GuestProfileWindows)
+	}
+	if req.VCPUs == 0 {
+		v.add("vcpus", "must be at least 1")
+	}
+	if req.MemoryBytes < minVMMemoryBytes {
+		v.add("memory_bytes", "must be at least %d MiB", minVMMemoryBytes>>20)
+	}
+	switch req.Firmware {
+	case libvirt.FirmwareBIOS:
+		if *req.SecureBoot {
+			v.add("secure_boot", "requires EFI firmware")
+		}
+	case libvirt.FirmwareEFI:
+	default:
+		v.add("firmware", "must be '%s' or '%s'", libvirt.FirmwareBIOS, libvirt.FirmwareEFI)
+	}
+	if d := req.Disk; d != nil {
+		if d.Pool == "" || (d.Volume == "") == (d.Create == nil) {
+			v.add("disk", "specify a pool and either an existing volume or a volume to create")
+		}
+		if d.Bus != "virtio" && d.Bus != "sata" {
+			v.add("disk.bus", "must be 'virtio' or 'sata'")
+		}
+		if d.Discard != "" && !libvirt.DiskDiscardModes[d.Discard] {
+			v.add("disk.discard", "must be 'unmap' or 'ignore'")
+		}
+	}
+	if iso := req.InstallISO; iso != nil && (iso.Pool == "" || iso.Volume == "") {
+		v.add("install_iso", "needs a pool and a volume")
+	}
+	if iso := req.VirtioISO; iso != nil && (iso.Pool == "" || iso.Volume == "") {
+		v.add("virtio_iso", "needs a pool and a volume")
+	}
+	if req.VirtioISO != nil && req.Profile != libvirt.GuestProfileWindows {
+		v.add("virtio_iso", "only applies to the windows profile")
+	}
+	for i, nic := range req.NICs {
+		if nic.Network == "" && nic.Bridge == "" {
+			v.add(fmt.Sprintf("nics[%d]", i), "needs a network or a bridge")
+		}
+	}
+	if req.CPUShares != nil && (*req.CPUShares < minCPUShares || *req.CPUShares > maxCPUShares) {
+		v.add("cpu_shares", "must be between %d and %d", minCPUShares, maxCPUShares)
+	}
+	if req.BlkioWeight != nil && (*req.BlkioWeight < minBlkioWeight || *req.BlkioWeight > maxBlkioWeight) {
+		v.add("blkio_weight", "must be between %d and %d", minBlkioWeight, maxBlkioWeight)
+	}
+	return v.err()
+}
+
+// CreateVM defines a new, shut-off VM on a host with a boot disk, CD-ROMs
+// and NICs. Everything the call created is removed again if a later step
+// fails. Windows guests also get the configured virtio-win ISO; a missing
+// one is reported as a warning, as the drivers can be attached later.
+func (s *HostService) CreateVM(hostID string, req VMCreateRequest) (*CreatedVM, error) {
+	if req.Preset != "" {
+		preset, err := s.GetHardwarePreset(req.Preset)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, &ValidationError{Fields: []FieldError{{Field: "preset", Message: "no hardware preset with this name"}}}
+			}
+			return nil, err
+		}
+		applyHardwarePreset(&req, preset)
+	}
+	applyVMCreateDefaults(&req)
+	if err := validateVMCreateRequest(&req); err != nil {
+		return nil, err
+	}
+	created := &CreatedVM{
+		Name:       req.Name,
+		Preset:     req.Preset,
+		Profile:    req.Profile,
+		Firmware:   req.Firmware,
+		SecureBoot: *req.SecureBoot,
+		TPM:        *req.TPM,
+		CDROMs:     []string{},
+		NICs:       []AttachedNIC{},
+		Warnings:   []string{},
+	}
+
+	spec := libvirt.DomainSpec{
+		Name:        req.Name,
+		Description: req.Description,
+		Profile:     req.Profile,
+		VCPUs:       req.VCPUs,
+		MemoryBytes: req.MemoryBytes,
+		Firmware:    req.Firmware,
+		SecureBoot:  *req.SecureBoot,
+		TPM:         *req.TPM,
+	}
+	if req.InstallISO != nil {
+		vol, err := s.lookupVMVolume(hostID, *req.InstallISO)
+		if err != nil {
+			return nil, err
+		}
+		spec.CDROMs = append(spec.CDROMs, vol.Path)
+	}
+	if req.Profile == libvirt.GuestProfileWindows {
+		iso, warning, err := s.virtioWinISO(hostID, req.VirtioISO)
+		if err != nil {
+			return nil, err
+		}
+		if iso != nil {
+			spec.CDROMs = append(spec.CDROMs, iso.Path)
+		} else {
+			created.Warnings = append(created.Warnings, warning)
+		}
+	}
+	created.CDROMs = append(created.CDROMs, spec.CDROMs...)
+
+	// The disk comes last, so a volume is only created once the ISOs were
+	// found.
+	var createdVolume *libvirt.VolumeInfo
+	if d := req.Disk; d != nil {
+		var vol *libvirt.VolumeInfo
+		var err error
+		if d.Create != nil {
+			vol, err = s.connector.CreateVolume(hostID, d.Pool, *d.Create)
+			createdVolume = vol
+		} else {
+			vol, err = s.lookupVMVolume(hostID, VolumeRef{Pool: d.Pool, Volume: d.Volume})
+		}
+		if err != nil {
+			return nil, err
+		}
+		spec.Disks = append(spec.Disks, libvirt.DiskAttachSpec{
+			Path:    vol.Path,
+			Block:   vol.Type == "block",
+			Format:  valueOr(vol.Format, "raw"),
+			Bus:     d.Bus,
+			Discard: d.Discard,
+		})
+		created.Disk = &AttachedDisk{Created: d.Create != nil, Volume: *vol}
+	}
+	removeVolume := func() {
+		if createdVolume == nil {
+			return
+		}
+		if err := s.connector.DeleteVolume(hostID, req.Disk.Pool, createdVolume.Name); err != nil {
+			log.Printf("Warning: failed to remove volume %s/%s after failed VM creation: %v", req.Disk.Pool, createdVolume.Name, err)
+		}
+	}
+
+	if err := s.connector.DefineDomain(hostID, spec); err != nil {
+		removeVolume()
+		return nil, err
+	}
+	for _, nicReq := range req.NICs {
+		nic, err := s.AttachNIC(hostID, req.Name, nicReq)
+		if err != nil {
+			if undefErr := s.connector.UndefineDomain(hostID, req.Name); undefErr != nil {
+				log.Printf("Warning: failed to undefine %s after failed VM creation: %v", req.Name, undefErr)
+			}
+			removeVolume()
+			// Attaching synced the VM; this prunes it again.
+			if changed, _ := s.syncSingleVM(hostID, req.Name); changed {
+				s.broadcastVMsChanged(hostID)
+			}
+			return nil, err
+		}
+		created.NICs = append(created.NICs, *nic)
+	}
+
+	if created.Disk != nil {
+		if hardware, err := s.connector.GetDomainHardware(hostID, req.Name); err == nil {
+			for _, disk := range hardware.Disks {
+				if disk.Device == "disk" && (disk.Source.File == created.Disk.Volume.Path || disk.Source.Dev == created.Disk.Volume.Path) {
+					created.Disk.Target = disk.Target.Dev
+				}
+			}
+		}
+	}
+	s.recordAudit("vm.create", "vm", fmt.Sprintf("%s/%s", hostID, req.Name),
+		fmt.Sprintf("preset=%s profile=%s vcpus=%d memory=%d firmware=%s secure_boot=%t tpm=%t cdroms=%s nics=%d",
+			valueOr(req.Preset, "none"), req.Profile, req.VCPUs, req.MemoryBytes, req.Firmware, *req.SecureBoot, *req.TPM,
+			strings.Join(created.CDROMs, ","), len(created.NICs)))
+	if changed, err := s.syncSingleVM(hostID, req.Name); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	if req.CPUShares != nil || req.BlkioWeight != nil {
+		// Applied once the VM is synced. A failure only warns, as the VM is
+		// usable without its tuning.
+		if _, err := s.SetVMTuning(hostID, req.Name, VMTuningRequest{CPUShares: req.CPUShares, BlkioWeight: req.BlkioWeight}); err != nil {
+			created.Warnings = append(created.Warnings, fmt.Sprintf("could not apply the tuning: %v", err))
+		}
+	}
+	if createdVolume != nil {
+		go func() {
+			if err := s.RefreshStoragePools(hostID); err != nil {
+				log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+			}
+		}()
+	}
+	return created, nil
+}
+
+// lookupVMVolume looks up an existing volume a new VM uses, refusing
+// uploads that failed checksum verification.
+func (s *HostService) lookupVMVolume(hostID string, ref VolumeRef) (*libvirt.VolumeInfo, error) {
+	if err := s.checkVolumeChecksum(hostID, ref.Pool, ref.Volume); err != nil {
+		return nil, err
+	}
+	return s.connector.GetVolume(hostID, ref.Pool, ref.Volume)
+}
+
+// virtioWinISO returns the virtio-win driver ISO a new Windows VM gets: the
+// one requested, or else the configured one. When there is none, it returns
+// a warning to pass on instead.
+func (s *HostService) virtioWinISO(hostID string, requested *VolumeRef) (*libvirt.VolumeInfo, string, error) {
+	if requested != nil {
+		vol, err := s.lookupVMVolume(hostID, *requested)
+		return vol, "", err
+	}
+	settings, err := s.GetGuestSettings()
+	if err != nil {
+		return nil, "", err
+	}
+	if settings.VirtioWinVolume == "" {
+		return nil, "no virtio-win ISO is configured; Windows will not see virtio devices until the drivers are installed", nil
+	}
+	ref := VolumeRef{Pool: settings.VirtioWinPool, Volume: settings.VirtioWinVolume}
+	vol, err := s.lookupVMVolume(hostID, ref)
+	if err != nil {
+		log.Printf("Warning: virtio-win ISO %s/%s is not usable on host %s: %v", ref.Pool, ref.Volume, hostID, err)
+		return nil, fmt.Sprintf("the virtio-win ISO %s/%s is not usable on this host: %v", ref.Pool, ref.Volume, err), nil
+	}
+	return vol, "", nil
+}
+
+// GetGuestSettings returns the settings applied to new VMs.
+func (s *HostService) GetGuestSettings() (*storage.GuestSettings, error) {
+	var settings storage.GuestSettings
+	if err := s.db.Limit(1).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetGuestSettings changes the settings applied to new VMs. VMs created
+// before keep what they were created with.
+func (s *HostService) SetGuestSettings(req GuestSettingsRequest) (*storage.GuestSettings, error) {
+	if (req.VirtioWinPool == "") != (req.VirtioWinVolume == "") {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "virtio_win_volume", Message: "set together with virtio_win_pool, or clear both"}}}
+	}
+	row := storage.GuestSettings{ID: 1, VirtioWinPool: req.VirtioWinPool, VirtioWinVolume: req.VirtioWinVolume}
+	if err := s.db.Save(&row).Error; err != nil {
+		return nil, fmt.Errorf("failed to save guest settings: %w", err)
+	}
+	s.recordAudit("guests.update", "guests", "global",
+		fmt.Sprintf("virtio_win=%s/%s", req.VirtioWinPool, req.VirtioWinVolume))
+	return s.GetGuestSettings()
+}
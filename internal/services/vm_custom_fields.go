@@ -0,0 +1,163 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Limits on the custom fields of a VM.
+const (
+	maxCustomFields           = 64
+	maxCustomFieldNameLength  = 64
+	maxCustomFieldValueLength = 1024
+)
+
+// ErrInvalidCustomField is returned for a malformed field name, a value that
+// is too long, or too many fields on one VM.
+var ErrInvalidCustomField = fmt.Errorf("custom field names must be 1-%d letters, digits, '_', '.' or '-', values at most %d characters, and a VM can have at most %d fields",
+	maxCustomFieldNameLength, maxCustomFieldValueLength, maxCustomFields)
+
+var customFieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func validateCustomField(name, value string) error {
+	if len(name) > maxCustomFieldNameLength || !customFieldNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: invalid name '%s'", ErrInvalidCustomField, name)
+	}
+	if len(value) > maxCustomFieldValueLength {
+		return fmt.Errorf("%w: value of '%s' is too long", ErrInvalidCustomField, name)
+	}
+	return nil
+}
+
+// findVM returns the database record of a VM.
+func (s *HostService) findVM(hostID, vmName string) (*storage.VirtualMachine, error) {
+	var vm storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND name = ?", hostID, vmName).First(&vm).Error; err != nil {
+		return nil, fmt.Errorf("could not find VM %s on host %s: %w", vmName, hostID, err)
+	}
+	return &vm, nil
+}
+
+// customFieldsOf returns the custom fields of a VM as a map, never nil.
+func customFieldsOf(db *gorm.DB, vmID uint) (map[string]string, error) {
+	var rows []storage.VMCustomField
+	if err := db.Where("vm_id = ?", vmID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(rows))
+	for _, row := range rows {
+		fields[row.Name] = row.Value
+	}
+	return fields, nil
+}
+
+// GetVMCustomFields returns the custom fields of a VM.
+func (s *HostService) GetVMCustomFields(hostID, vmName string) (map[string]string, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return customFieldsOf(s.db, vm.ID)
+}
+
+// ReplaceVMCustomFields replaces all custom fields of a VM with the given set.
+func (s *HostService) ReplaceVMCustomFields(hostID, vmName string, fields map[string]string) (map[string]string, error) {
+	if len(fields) > maxCustomFields {
+		return nil, ErrInvalidCustomField
+	}
+	for name, value := range fields {
+		if err := validateCustomField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Where("vm_id = ?", vm.ID).Delete(&storage.VMCustomField{}).Error; err != nil {
+			return err
+		}
+		for name, value := range fields {
+			if err := tx.Create(&storage.VMCustomField{VMID: vm.ID, Name: name, Value: value}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s.recordAudit("vm.fields.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "fields="+strings.Join(names, ","))
+	s.broadcastVMsChanged(hostID)
+	return customFieldsOf(s.db, vm.ID)
+}
+
+// SetVMCustomField creates or updates a single custom field of a VM.
+func (s *HostService) SetVMCustomField(hostID, vmName, name, value string) error {
+	if err := validateCustomField(name, value); err != nil {
+		return err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		var field storage.VMCustomField
+		err := tx.Where("vm_id = ? AND name = ?", vm.ID, name).First(&field).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			var count int64
+			if err := tx.Model(&storage.VMCustomField{}).Where("vm_id = ?", vm.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count >= maxCustomFields {
+				return ErrInvalidCustomField
+			}
+			return tx.Create(&storage.VMCustomField{VMID: vm.ID, Name: name, Value: value}).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&field).Update("value", value).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.recordAudit("vm.fields.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "fields="+name)
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
+
+// DeleteVMCustomField removes a custom field from a VM.
+func (s *HostService) DeleteVMCustomField(hostID, vmName, name string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	result := s.db.Where("vm_id = ? AND name = ?", vm.ID, name).Delete(&storage.VMCustomField{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find custom field '%s' on VM %s: %w", name, vmName, gorm.ErrRecordNotFound)
+	}
+
+	s.recordAudit("vm.fields.delete", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "field="+name)
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
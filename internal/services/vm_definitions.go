@@ -0,0 +1,326 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Sources of archived VM definitions.
+const (
+	DefinitionSourceSync    = "sync"    // A sync or a libvirt event found the definition changed
+	DefinitionSourceEdit    = "edit"    // Saved before an edit through Virtumancer
+	DefinitionSourceRestore = "restore" // An earlier version put back
+)
+
+// maxDefinitionVersions is how many versions of a VM's definition are kept.
+// Older ones are deleted as new ones are archived.
+const maxDefinitionVersions = 100
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// VMDefinitionDiff compares two versions of a VM's definition.
+type VMDefinitionDiff struct {
+	From    uint   `json:"from"`
+	To      uint   `json:"to"` // 0 for the VM's current definition on its host
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	Diff    string `json:"diff"` // In unified format, empty when both are the same
+}
+
+// ListVMDefinitions lists the archived versions of a VM's definition, the
+// newest first, without their XML.
+func (s *HostService) ListVMDefinitions(hostID, vmName string) ([]storage.VMDefinition, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	defs := []storage.VMDefinition{}
+	if err := s.db.Omit("xml").Where("vm_id = ?", vm.ID).Order("version desc").Find(&defs).Error; err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// GetVMDefinition returns an archived version of a VM's definition.
+func (s *HostService) GetVMDefinition(hostID, vmName string, version uint) (*storage.VMDefinition, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	var def storage.VMDefinition
+	if err := s.db.Where("vm_id = ? AND version = ?", vm.ID, version).First(&def).Error; err != nil {
+		return nil, fmt.Errorf("could not find version %d of the definition of %s: %w", version, vmName, err)
+	}
+	return &def, nil
+}
+
+// DiffVMDefinitions compares two archived versions of a VM's definition.
+// With to 0, the version is compared with the VM's definition on its host.
+func (s *HostService) DiffVMDefinitions(hostID, vmName string, from, to uint) (*VMDefinitionDiff, error) {
+	fromDef, err := s.GetVMDefinition(hostID, vmName, from)
+	if err != nil {
+		return nil, err
+	}
+	toLabel, toXML := "current", ""
+	if to == 0 {
+		if toXML, err = s.connector.GetDomainDefinition(hostID, vmName); err != nil {
+			return nil, err
+		}
+	} else {
+		toDef, err := s.GetVMDefinition(hostID, vmName, to)
+		if err != nil {
+			return nil, err
+		}
+		toLabel, toXML = fmt.Sprintf("version %d", to), toDef.XML
+	}
+	diff := &VMDefinitionDiff{From: from, To: to}
+	diff.Diff, diff.Added, diff.Removed = unifiedDiff(fmt.Sprintf("version %d", from), toLabel, fromDef.XML, toXML)
+	return diff, nil
+}
+
+// RestoreVMDefinition puts an archived version of a VM's definition back.
+// The definition it replaces has been archived before, as with every spec
+// edit. A running VM picks the restored definition up when it next starts.
+func (s *HostService) RestoreVMDefinition(hostID, vmName string, version uint) (*storage.VMDefinition, error) {
+	def, err := s.GetVMDefinition(hostID, vmName, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.connector.RedefineDomain(hostID, vmName, def.XML); err != nil {
+		return nil, err
+	}
+	target := fmt.Sprintf("%s/%s", hostID, vmName)
+	s.recordAudit("vm.definition.restore", "vm", target, fmt.Sprintf("version %d", version))
+
+	restored, err := s.archiveVMDefinition(hostID, vmName, DefinitionSourceRestore, fmt.Sprintf("Restored version %d", version))
+	if err != nil {
+		log.Printf("Warning: failed to archive the restored definition of %s on host %s: %v", vmName, hostID, err)
+	}
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	if restored == nil {
+		// The definition was not changed, or its event archived it first.
+		return s.latestVMDefinition(hostID, vmName)
+	}
+	restored.XML = ""
+	return restored, nil
+}
+
+func (s *HostService) latestVMDefinition(hostID, vmName string) (*storage.VMDefinition, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	var def storage.VMDefinition
+	if err := s.db.Omit("xml").Where("vm_id = ?", vm.ID).Order("version desc").First(&def).Error; err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+// archiveVMDefinition reads a VM's definition from its host and archives it
+// if it changed since the last version.
+func (s *HostService) archiveVMDefinition(hostID, vmName, source, reason string) (*storage.VMDefinition, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	domainXML, err := s.connector.GetDomainDefinition(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return s.archiveDefinition(vm.ID, domainXML, source, reason)
+}
+
+// archiveHostDefinitions archives the definitions of a host's VMs that
+// changed since their last version.
+func (s *HostService) archiveHostDefinitions(hostID string) error {
+	defs, err := s.connector.GetDomainDefinitionsWithoutSecrets(hostID)
+	if err != nil {
+		return err
+	}
+	var vms []storage.VirtualMachine
+	if err := s.db.Select("id", "domain_uuid").Where("host_id = ?", hostID).Find(&vms).Error; err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		domainXML, ok := defs[vm.DomainUUID]
+		if !ok {
+			continue
+		}
+		if _, err := s.archiveDefinition(vm.ID, domainXML, DefinitionSourceSync, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveDefinition stores a definition of a VM as its next version, unless
+// it is the same as the latest one. It returns the new version, or nil.
+func (s *HostService) archiveDefinition(vmID uint, domainXML, source, reason string) (*storage.VMDefinition, error) {
+	sum := sha256.Sum256([]byte(domainXML))
+	def := storage.VMDefinition{VMID: vmID, Source: source, Reason: reason, SHA256: hex.EncodeToString(sum[:]), XML: domainXML}
+	archived := false
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var latest storage.VMDefinition
+		if err := tx.Select("version", "sha256").Where("vm_id = ?", vmID).Order("version desc").Limit(1).Find(&latest).Error; err != nil {
+			return err
+		}
+		if latest.Version != 0 && latest.SHA256 == def.SHA256 {
+			return nil
+		}
+		def.Version = latest.Version + 1
+		if err := tx.Create(&def).Error; err != nil {
+			return err
+		}
+		archived = true
+		if def.Version <= maxDefinitionVersions {
+			return nil
+		}
+		return tx.Where("vm_id = ? AND version <= ?", vmID, def.Version-maxDefinitionVersions).Delete(&storage.VMDefinition{}).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive the definition of VM %d: %w", vmID, err)
+	}
+	if !archived {
+		return nil, nil
+	}
+	return &def, nil
+}
+
+// lineEdit is a line kept, removed or added by a diff, with its position in
+// the old and the new text, counting from 1.
+type lineEdit struct {
+	op       byte // ' ', '-' or '+'
+	text     string
+	fromLine int
+	toLine   int
+}
+
+// diffLines returns the edits turning the lines a into the lines b, based on
+// their longest common subsequence. Removals come before additions.
+func diffLines(a, b []string) []lineEdit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of ma[i:]
+	// and mb[j:].
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	edits := make([]lineEdit, 0, len(a)+len(b)-prefix-suffix)
+	fromLine, toLine := 1, 1
+	add := func(op byte, text string) {
+		edits = append(edits, lineEdit{op: op, text: text, fromLine: fromLine, toLine: toLine})
+		if op != '+' {
+			fromLine++
+		}
+		if op != '-' {
+			toLine++
+		}
+	}
+	for _, line := range a[:prefix] {
+		add(' ', line)
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			add(' ', ma[i])
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			add('-', ma[i])
+			i++
+		default:
+			add('+', mb[j])
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		add(' ', line)
+	}
+	return edits
+}
+
+// unifiedDiff compares two texts line by line, returning the differences in
+// unified format and the number of lines added and removed.
+func unifiedDiff(fromLabel, toLabel, from, to string) (string, int, int) {
+	edits := diffLines(strings.Split(from, "\n"), strings.Split(to, "\n"))
+	var out strings.Builder
+	added, removed := 0, 0
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromLabel, toLabel)
+		}
+		// Changes closer than twice the context share a hunk.
+		last := i
+		for j := i; j < len(edits) && j-last <= 2*diffContext; j++ {
+			if edits[j].op != ' ' {
+				last = j
+			}
+		}
+		start, end := max(i-diffContext, 0), min(last+diffContext+1, len(edits))
+
+		fromCount, toCount := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				fromCount++
+			}
+			if e.op != '-' {
+				toCount++
+			}
+		}
+		fromStart, toStart := edits[start].fromLine, edits[start].toLine
+		if fromCount == 0 {
+			fromStart--
+		}
+		if toCount == 0 {
+			toStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.text)
+			out.WriteByte('\n')
+			switch e.op {
+			case '+':
+				added++
+			case '-':
+				removed++
+			}
+		}
+		i = end
+	}
+	return out.String(), added, removed
+}
@@ -0,0 +1,497 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+)
+
+// Conditions under which a dependency counts as ready.
+const (
+	DependencyWaitRunning = "running" // The VM is running
+	DependencyWaitAgent   = "agent"   // Its QEMU guest agent answers a ping
+	DependencyWaitTCP     = "tcp"     // An address, e.g. the database port, accepts connections
+)
+
+// Orchestrated group actions.
+const (
+	OrchestrationStart = "start"
+	OrchestrationStop  = "stop"
+)
+
+const (
+	defaultDependencyTimeout = 300 * time.Second
+	orchestrationPollPeriod  = 2 * time.Second
+)
+
+var (
+	// ErrInvalidDependency is returned for a dependency with unknown VMs, an
+	// unknown wait condition or a TCP wait without a host:port address.
+	ErrInvalidDependency = errors.New("a dependency needs two distinct known VMs, a wait_for of 'running', 'agent' or 'tcp', and a host:port tcp_address for 'tcp'")
+	// ErrDependencyExists is returned when the dependency is already declared.
+	ErrDependencyExists = errors.New("dependency already exists")
+	// ErrDependencyCycle is returned when a dependency would make a VM
+	// depend on itself.
+	ErrDependencyCycle = errors.New("dependency would create a cycle")
+	// ErrInvalidOrchestration is returned for an unknown action or a request
+	// without known VMs.
+	ErrInvalidOrchestration = errors.New("an orchestration needs an action of 'start' or 'stop' and at least one known VM UUID")
+)
+
+// VMDependencyRequest declares that a VM depends on another one.
+type VMDependencyRequest struct {
+	VMUUID         string `json:"vm_uuid"`
+	DependsOnUUID  string `json:"depends_on_uuid"`
+	WaitFor        string `json:"wait_for"` // Defaults to 'running'
+	TCPAddress     string `json:"tcp_address"`
+	TimeoutSeconds uint   `json:"timeout_seconds"` // Defaults to 300
+}
+
+// OrchestrationRequest starts or stops a group of VMs along their
+// dependencies.
+type OrchestrationRequest struct {
+	VMUUIDs        []string `json:"vm_uuids"`
+	Selector       string   `json:"selector"`        // Label selector adding the matching VMs to vm_uuids, e.g. 'env=prod'
+	TimeoutSeconds uint     `json:"timeout_seconds"` // How long a stop waits for each VM to shut down; defaults to 300
+}
+
+// requestedUUIDs returns the VMs named in the request and those matching its
+// selector.
+func (s *HostService) requestedUUIDs(req OrchestrationRequest) ([]string, error) {
+	if strings.TrimSpace(req.Selector) == "" {
+		return req.VMUUIDs, nil
+	}
+	sel, err := ParseSelector(req.Selector)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := s.selectVMs(sel)
+	if err != nil {
+		return nil, err
+	}
+	uuids := append([]string{}, req.VMUUIDs...)
+	for _, vm := range vms {
+		uuids = append(uuids, vm.UUID)
+	}
+	return uuids, nil
+}
+
+// OrchestrationStep is a VM of an orchestrated start or stop, in the order
+// they are handled.
+type OrchestrationStep struct {
+	VMUUID    string   `json:"vm_uuid"`
+	VMName    string   `json:"vm_name"`
+	HostID    string   `json:"host_id"`
+	State     string   `json:"state"`
+	DependsOn []string `json:"depends_on"` // Names of the group members the VM needs
+	Requested bool     `json:"requested"`  // False for VMs pulled in through the dependency graph
+}
+
+// ListVMDependencies returns all declared dependencies.
+func (s *HostService) ListVMDependencies() ([]storage.VMDependency, error) {
+	deps := []storage.VMDependency{}
+	if err := s.db.Order("id").Find(&deps).Error; err != nil {
+		return nil, err
+	}
+	return deps, nil
+}
+
+// CreateVMDependency declares a dependency between two VMs, refusing ones
+// that would close a cycle.
+func (s *HostService) CreateVMDependency(req VMDependencyRequest) (*storage.VMDependency, error) {
+	req.VMUUID = strings.TrimSpace(req.VMUUID)
+	req.DependsOnUUID = strings.TrimSpace(req.DependsOnUUID)
+	req.TCPAddress = strings.TrimSpace(req.TCPAddress)
+	if req.WaitFor == "" {
+		req.WaitFor = DependencyWaitRunning
+	}
+	if req.VMUUID == "" || req.VMUUID == req.DependsOnUUID {
+		return nil, ErrInvalidDependency
+	}
+	switch req.WaitFor {
+	case DependencyWaitRunning, DependencyWaitAgent:
+		req.TCPAddress = ""
+	case DependencyWaitTCP:
+		if _, _, err := net.SplitHostPort(req.TCPAddress); err != nil {
+			return nil, ErrInvalidDependency
+		}
+	default:
+		return nil, ErrInvalidDependency
+	}
+	var count int64
+	if err := s.db.Model(&storage.VirtualMachine{}).Where("uuid IN ?", []string{req.VMUUID, req.DependsOnUUID}).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count != 2 {
+		return nil, ErrInvalidDependency
+	}
+
+	deps, err := s.ListVMDependencies()
+	if err != nil {
+		return nil, err
+	}
+	needs := make(map[string][]string)
+	for _, dep := range deps {
+		if dep.VMUUID == req.VMUUID && dep.DependsOnUUID == req.DependsOnUUID {
+			return nil, ErrDependencyExists
+		}
+		needs[dep.VMUUID] = append(needs[dep.VMUUID], dep.DependsOnUUID)
+	}
+	// The new edge closes a cycle if the VM is already needed, directly or
+	// not, by the VM it is about to depend on.
+	seen := map[string]bool{}
+	pending := []string{req.DependsOnUUID}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if id == req.VMUUID {
+			return nil, ErrDependencyCycle
+		}
+		if !seen[id] {
+			seen[id] = true
+			pending = append(pending, needs[id]...)
+		}
+	}
+
+	dep := storage.VMDependency{
+		VMUUID:         req.VMUUID,
+		DependsOnUUID:  req.DependsOnUUID,
+		WaitFor:        req.WaitFor,
+		TCPAddress:     req.TCPAddress,
+		TimeoutSeconds: req.TimeoutSeconds,
+	}
+	if err := s.db.Create(&dep).Error; err != nil {
+		return nil, fmt.Errorf("failed to save dependency: %w", err)
+	}
+	s.recordAudit("vm.dependency.create", "vm", dep.VMUUID,
+		fmt.Sprintf("depends_on=%s wait_for=%s %s", dep.DependsOnUUID, dep.WaitFor, dep.TCPAddress))
+	return &dep, nil
+}
+
+// DeleteVMDependency removes a dependency.
+func (s *HostService) DeleteVMDependency(id uint) error {
+	var dep storage.VMDependency
+	if err := s.db.First(&dep, id).Error; err != nil {
+		return fmt.Errorf("could not find dependency %d: %w", id, err)
+	}
+	if err := s.db.Delete(&dep).Error; err != nil {
+		return err
+	}
+	s.recordAudit("vm.dependency.delete", "vm", dep.VMUUID, fmt.Sprintf("depends_on=%s", dep.DependsOnUUID))
+	return nil
+}
+
+// orchestrationGroup is a set of VMs ordered along their dependencies.
+type orchestrationGroup struct {
+	vms   []storage.VirtualMachine
+	needs map[string][]storage.VMDependency // Dependencies within the group, by dependent VM UUID
+}
+
+// planOrchestration pulls in what the requested VMs are tied to, their
+// dependencies for a start and the VMs depending on them for a stop, and
+// orders the group so that every VM comes after the ones it must wait for.
+func (s *HostService) planOrchestration(action string, uuids []string) (*orchestrationGroup, map[string]bool, error) {
+	if action != OrchestrationStart && action != OrchestrationStop {
+		return nil, nil, ErrInvalidOrchestration
+	}
+	var all []storage.VirtualMachine
+	if err := s.db.Find(&all).Error; err != nil {
+		return nil, nil, err
+	}
+	byUUID := make(map[string]storage.VirtualMachine, len(all))
+	for _, vm := range all {
+		byUUID[vm.UUID] = vm
+	}
+	deps, err := s.ListVMDependencies()
+	if err != nil {
+		return nil, nil, err
+	}
+	// pulls leads from a VM to the VMs that must be handled before it, which
+	// join the group; after is the reverse.
+	pulls := make(map[string][]string)
+	after := make(map[string][]string)
+	for _, dep := range deps {
+		first, then := dep.DependsOnUUID, dep.VMUUID
+		if action == OrchestrationStop {
+			first, then = then, first
+		}
+		pulls[then] = append(pulls[then], first)
+		after[first] = append(after[first], then)
+	}
+
+	requested := make(map[string]bool)
+	members := make(map[string]bool)
+	var pending []string
+	for _, id := range uuids {
+		id = strings.TrimSpace(id)
+		if _, ok := byUUID[id]; ok {
+			requested[id] = true
+			pending = append(pending, id)
+		}
+	}
+	if len(pending) == 0 {
+		return nil, nil, ErrInvalidOrchestration
+	}
+	for len(pending) > 0 {
+		id := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := byUUID[id]; !ok || members[id] {
+			continue
+		}
+		members[id] = true
+		pending = append(pending, pulls[id]...)
+	}
+
+	group := &orchestrationGroup{needs: make(map[string][]storage.VMDependency)}
+	for _, dep := range deps {
+		if !members[dep.VMUUID] || !members[dep.DependsOnUUID] {
+			continue
+		}
+		group.needs[dep.VMUUID] = append(group.needs[dep.VMUUID], dep)
+	}
+	blockers := make(map[string]int)
+	for id := range members {
+		for _, first := range pulls[id] {
+			if members[first] {
+				blockers[id]++
+			}
+		}
+	}
+	// Kahn's algorithm, taking ready VMs by name so the order is stable.
+	var ready []storage.VirtualMachine
+	for id := range members {
+		if blockers[id] == 0 {
+			ready = append(ready, byUUID[id])
+		}
+	}
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			if ready[i].Name != ready[j].Name {
+				return ready[i].Name < ready[j].Name
+			}
+			return ready[i].HostID < ready[j].HostID
+		})
+		vm := ready[0]
+		ready = ready[1:]
+		group.vms = append(group.vms, vm)
+		for _, id := range after[vm.UUID] {
+			if !members[id] {
+				continue
+			}
+			blockers[id]--
+			if blockers[id] == 0 {
+				ready = append(ready, byUUID[id])
+			}
+		}
+	}
+	if len(group.vms) != len(members) {
+		return nil, nil, ErrDependencyCycle
+	}
+	return group, requested, nil
+}
+
+// PlanOrchestration returns the order in which an orchestrated start or
+// stop would handle the VMs, without touching them.
+func (s *HostService) PlanOrchestration(action string, req OrchestrationRequest) ([]OrchestrationStep, error) {
+	uuids, err := s.requestedUUIDs(req)
+	if err != nil {
+		return nil, err
+	}
+	group, requested, err := s.planOrchestration(action, uuids)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string, len(group.vms))
+	for _, vm := range group.vms {
+		names[vm.UUID] = vm.Name
+	}
+	steps := make([]OrchestrationStep, 0, len(group.vms))
+	for _, vm := range group.vms {
+		step := OrchestrationStep{
+			VMUUID:    vm.UUID,
+			VMName:    vm.Name,
+			HostID:    vm.HostID,
+			State:     string(vm.State),
+			DependsOn: []string{},
+			Requested: requested[vm.UUID],
+		}
+		for _, dep := range group.needs[vm.UUID] {
+			step.DependsOn = append(step.DependsOn, names[dep.DependsOnUUID])
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// StartOrchestration starts or stops a group of VMs in dependency order as
+// a background task. A start brings up the dependencies of the requested
+// VMs first and waits for each dependency to become ready before starting
+// the VMs that need it; a stop shuts down the dependent VMs first and waits
+// for each VM to power off before moving on.
+func (s *HostService) StartOrchestration(action string, req OrchestrationRequest) (*storage.Task, error) {
+	uuids, err := s.requestedUUIDs(req)
+	if err != nil {
+		return nil, err
+	}
+	group, _, err := s.planOrchestration(action, uuids)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(group.vms))
+	for _, vm := range group.vms {
+		names = append(names, vm.Name)
+	}
+	task, err := s.tasks.Start("vm.group-"+action, fmt.Sprintf("Orchestrated %s of %s", action, strings.Join(names, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.group."+action, "vm", strings.Join(names, ","), "")
+
+	started := copyTask(task)
+	go func() {
+		var err error
+		if action == OrchestrationStart {
+			err = s.runGroupStart(task, group)
+		} else {
+			timeout := defaultDependencyTimeout
+			if req.TimeoutSeconds > 0 {
+				timeout = time.Duration(req.TimeoutSeconds) * time.Second
+			}
+			err = s.runGroupStop(task, group, timeout)
+		}
+		if err != nil {
+			log.Printf("Orchestrated %s failed: %v", action, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runGroupStart(task *storage.Task, group *orchestrationGroup) error {
+	byUUID := make(map[string]storage.VirtualMachine, len(group.vms))
+	for _, vm := range group.vms {
+		byUUID[vm.UUID] = vm
+	}
+	for i, vm := range group.vms {
+		progress := 100 * i / len(group.vms)
+		for _, dep := range group.needs[vm.UUID] {
+			needed := byUUID[dep.DependsOnUUID]
+			s.tasks.Step(task, progress, fmt.Sprintf("Waiting for %s to be ready (%s)", needed.Name, dep.WaitFor))
+			if err := s.waitForDependency(needed, dep); err != nil {
+				return fmt.Errorf("%s is not ready, not starting %s: %w", needed.Name, vm.Name, err)
+			}
+		}
+		info, err := s.connector.GetDomainInfo(vm.HostID, vm.Name)
+		if err != nil {
+			return err
+		}
+		if info.State == golibvirt.DomainRunning {
+			s.tasks.Step(task, progress, fmt.Sprintf("%s is already running", vm.Name))
+			continue
+		}
+		if err := s.StartVM(context.Background(), vm.HostID, vm.Name); err != nil {
+			return fmt.Errorf("failed to start %s: %w", vm.Name, err)
+		}
+		s.tasks.Step(task, progress, fmt.Sprintf("Started %s on %s", vm.Name, vm.HostID))
+	}
+	return nil
+}
+
+// waitForDependency polls a VM until it meets the dependency's wait
+// condition or the dependency's timeout expires.
+func (s *HostService) waitForDependency(vm storage.VirtualMachine, dep storage.VMDependency) error {
+	timeout := defaultDependencyTimeout
+	if dep.TimeoutSeconds > 0 {
+		timeout = time.Duration(dep.TimeoutSeconds) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	var err error
+	for {
+		err = s.dependencyReady(vm, dep)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s: %w", timeout, err)
+		}
+		time.Sleep(orchestrationPollPeriod)
+	}
+}
+
+func (s *HostService) dependencyReady(vm storage.VirtualMachine, dep storage.VMDependency) error {
+	info, err := s.connector.GetDomainInfo(vm.HostID, vm.Name)
+	if err != nil {
+		return err
+	}
+	if info.State != golibvirt.DomainRunning {
+		return fmt.Errorf("%s is %s", vm.Name, strings.ToLower(string(mapLibvirtStateToVMState(info.State))))
+	}
+	switch dep.WaitFor {
+	case DependencyWaitAgent:
+		if err := s.connector.PingGuestAgent(vm.HostID, vm.Name); err != nil {
+			return fmt.Errorf("guest agent of %s does not answer: %w", vm.Name, err)
+		}
+	case DependencyWaitTCP:
+		conn, err := net.DialTimeout("tcp", dep.TCPAddress, orchestrationPollPeriod)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *HostService) runGroupStop(task *storage.Task, group *orchestrationGroup, timeout time.Duration) error {
+	for i, vm := range group.vms {
+		progress := 100 * i / len(group.vms)
+		info, err := s.connector.GetDomainInfo(vm.HostID, vm.Name)
+		if err != nil {
+			return err
+		}
+		if info.State == golibvirt.DomainShutoff {
+			s.tasks.Step(task, progress, fmt.Sprintf("%s is already stopped", vm.Name))
+			continue
+		}
+		if err := s.ShutdownVM(context.Background(), vm.HostID, vm.Name); err != nil {
+			return fmt.Errorf("failed to shut down %s: %w", vm.Name, err)
+		}
+		s.tasks.Step(task, progress, fmt.Sprintf("Shutting down %s on %s", vm.Name, vm.HostID))
+		// The VMs it depends on must not go away while it is still running.
+		if err := s.waitForShutoff(vm.HostID, vm.Name, timeout); err != nil {
+			return err
+		}
+		s.tasks.Step(task, progress, fmt.Sprintf("Stopped %s", vm.Name))
+	}
+	return nil
+}
+
+// waitForShutoff polls a VM that is shutting down until it is off, and
+// syncs it then.
+func (s *HostService) waitForShutoff(hostID, vmName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(orchestrationPollPeriod)
+		info, err := s.connector.GetDomainInfo(hostID, vmName)
+		if err != nil {
+			return err
+		}
+		if info.State == golibvirt.DomainShutoff {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s did not shut down within %s", vmName, timeout)
+		}
+	}
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	return nil
+}
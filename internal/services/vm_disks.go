@@ -0,0 +1,89 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+)
+
+// ErrInvalidDiskRequest is returned when a disk request names neither or both
+// of an existing volume and a volume to create.
+var ErrInvalidDiskRequest = errors.New("specify a pool and either an existing volume or a volume to create")
+
+// DiskAttachRequest adds a disk to a VM, either from an existing volume or
+// from a new volume created in the same call.
+type DiskAttachRequest struct {
+	Pool     string              `json:"pool"`
+	Volume   string              `json:"volume,omitempty"` // Name of an existing volume in Pool
+	Create   *libvirt.VolumeSpec `json:"create,omitempty"` // New volume to create in Pool
+	Target   string              `json:"target,omitempty"` // Guest device, e.g. 'vdb'; picked automatically if empty
+	Bus      string              `json:"bus,omitempty"`    // 'virtio' (default), 'scsi', 'sata' or 'ide'
+	ReadOnly bool                `json:"read_only"`
+	Discard  string              `json:"discard,omitempty"` // 'unmap' or 'ignore'; the hypervisor's default if empty
+}
+
+// AttachedDisk is the result of attaching a disk.
+type AttachedDisk struct {
+	Target  string             `json:"target"`
+	Created bool               `json:"created"`
+	Volume  libvirt.VolumeInfo `json:"volume"`
+}
+
+// AttachDisk attaches a volume to a VM, creating it first when requested. A
+// volume created by this call is removed again if attaching it fails.
+func (s *HostService) AttachDisk(hostID, vmName string, req DiskAttachRequest) (*AttachedDisk, error) {
+	if req.Pool == "" || (req.Volume == "") == (req.Create == nil) {
+		return nil, ErrInvalidDiskRequest
+	}
+	if req.Discard != "" && !libvirt.DiskDiscardModes[req.Discard] {
+		return nil, &ValidationError{Fields: []FieldError{{Field: "discard", Message: "must be 'unmap' or 'ignore'"}}}
+	}
+
+	var vol *libvirt.VolumeInfo
+	var err error
+	if req.Create != nil {
+		vol, err = s.connector.CreateVolume(hostID, req.Pool, *req.Create)
+	} else {
+		if err := s.checkVolumeChecksum(hostID, req.Pool, req.Volume); err != nil {
+			return nil, err
+		}
+		vol, err = s.connector.GetVolume(hostID, req.Pool, req.Volume)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := s.connector.AttachDisk(hostID, vmName, libvirt.DiskAttachSpec{
+		Path:     vol.Path,
+		Block:    vol.Type == "block",
+		Format:   valueOr(vol.Format, "raw"),
+		Target:   req.Target,
+		Bus:      req.Bus,
+		ReadOnly: req.ReadOnly,
+		Discard:  req.Discard,
+	})
+	if err != nil {
+		if req.Create != nil {
+			if delErr := s.connector.DeleteVolume(hostID, req.Pool, vol.Name); delErr != nil {
+				log.Printf("Warning: failed to remove volume %s/%s after failed attach: %v", req.Pool, vol.Name, delErr)
+			}
+		}
+		return nil, err
+	}
+
+	s.recordAudit("vm.disk.attach", "vm", fmt.Sprintf("%s/%s", hostID, vmName), fmt.Sprintf("%s=%s/%s created=%t discard=%s", target, req.Pool, vol.Name, req.Create != nil, valueOr(req.Discard, "default")))
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	if req.Create != nil {
+		go func() {
+			if err := s.RefreshStoragePools(hostID); err != nil {
+				log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+			}
+		}()
+	}
+
+	return &AttachedDisk{Target: target, Created: req.Create != nil, Volume: *vol}, nil
+}
@@ -0,0 +1,610 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"gorm.io/gorm"
+)
+
+var vmGroupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+var (
+	// ErrVMGroupExists is returned when a group name is already taken.
+	ErrVMGroupExists = errors.New("VM group already exists")
+	// ErrVMGroupEmpty is returned when a group without members would be
+	// started, stopped or snapshotted.
+	ErrVMGroupEmpty = errors.New("VM group has no members")
+)
+
+// VMGroupRequest defines or redefines a VM group. On update, a nil Members
+// keeps the members.
+type VMGroupRequest struct {
+	Name               string                 `json:"name"`
+	Description        string                 `json:"description"`
+	StartDelaySeconds  uint                   `json:"start_delay_seconds"`
+	StopTimeoutSeconds uint                   `json:"stop_timeout_seconds"`
+	SnapshotMemory     string                 `json:"snapshot_memory"` // Defaults to 'internal'
+	Members            []VMGroupMemberRequest `json:"members"`
+}
+
+// VMGroupMemberRequest puts a VM in a group.
+type VMGroupMemberRequest struct {
+	VMUUID     string `json:"vm_uuid"`
+	StartOrder uint   `json:"start_order"`
+}
+
+// VMGroupMember is a member of a group with its VM.
+type VMGroupMember struct {
+	VMUUID     string `json:"vm_uuid"`
+	VMName     string `json:"vm_name"`
+	HostID     string `json:"host_id"`
+	State      string `json:"state"`
+	StartOrder uint   `json:"start_order"`
+}
+
+// VMGroupView is a group with its members in start order.
+type VMGroupView struct {
+	storage.VMGroup
+	Members []VMGroupMember `json:"members"`
+}
+
+// VMGroupStats adds up the resources of a group's members. The live usage
+// covers the running members whose stats could be read.
+type VMGroupStats struct {
+	Members         int      `json:"members"`
+	Running         int      `json:"running"`
+	VCPUs           uint     `json:"vcpus"`        // Configured, of all members
+	MemoryBytes     uint64   `json:"memory_bytes"` // Configured, of all members
+	CPUTimeNs       uint64   `json:"cpu_time_ns"`
+	MemoryUsedBytes uint64   `json:"memory_used_bytes"`
+	DiskReadBytes   int64    `json:"disk_read_bytes"`
+	DiskWriteBytes  int64    `json:"disk_write_bytes"`
+	NetRxBytes      int64    `json:"net_rx_bytes"`
+	NetTxBytes      int64    `json:"net_tx_bytes"`
+	Unavailable     []string `json:"unavailable"` // Running members without stats
+}
+
+// groupMember is a member VM with its start order.
+type groupMember struct {
+	vm    storage.VirtualMachine
+	order uint
+}
+
+func normalizeVMGroup(req VMGroupRequest) (VMGroupRequest, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	var v validator
+	if !vmGroupNamePattern.MatchString(req.Name) {
+		v.add("name", "must start with a letter or digit and contain only letters, digits, '_', '.' and '-' (at most 64)")
+	}
+	memory, err := snapshotMemoryMode(req.SnapshotMemory)
+	if err != nil {
+		v.add("snapshot_memory", "must be '%s' or '%s'", libvirt.SnapshotMemoryInternal, libvirt.SnapshotMemoryExternal)
+	}
+	req.SnapshotMemory = memory
+	seen := make(map[string]bool, len(req.Members))
+	for i := range req.Members {
+		req.Members[i].VMUUID = strings.TrimSpace(req.Members[i].VMUUID)
+		id := req.Members[i].VMUUID
+		switch {
+		case id == "":
+			v.add(fmt.Sprintf("members[%d].vm_uuid", i), "is required")
+		case seen[id]:
+			v.add(fmt.Sprintf("members[%d].vm_uuid", i), "'%s' is listed twice", id)
+		}
+		seen[id] = true
+	}
+	return req, v.err()
+}
+
+// memberRows looks up the VMs of the requested members.
+func (s *HostService) memberRows(groupID uint, members []VMGroupMemberRequest) ([]storage.VMGroupMember, error) {
+	rows := make([]storage.VMGroupMember, 0, len(members))
+	var v validator
+	for i, m := range members {
+		var vm storage.VirtualMachine
+		err := s.db.Where("uuid = ?", m.VMUUID).First(&vm).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			v.add(fmt.Sprintf("members[%d].vm_uuid", i), "no VM has the uuid '%s'", m.VMUUID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, storage.VMGroupMember{GroupID: groupID, VMID: vm.ID, StartOrder: m.StartOrder})
+	}
+	return rows, v.err()
+}
+
+// groupMembers returns the members of a group in start order, then by name.
+func (s *HostService) groupMembers(groupID uint) ([]groupMember, error) {
+	var rows []struct {
+		storage.VirtualMachine
+		StartOrder uint
+	}
+	err := s.db.Model(&storage.VirtualMachine{}).
+		Select("virtual_machines.*, vm_group_members.start_order").
+		Joins("JOIN vm_group_members ON vm_group_members.vm_id = virtual_machines.id").
+		Where("vm_group_members.group_id = ?", groupID).
+		Order("vm_group_members.start_order, virtual_machines.name, virtual_machines.host_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	members := make([]groupMember, 0, len(rows))
+	for _, row := range rows {
+		members = append(members, groupMember{vm: row.VirtualMachine, order: row.StartOrder})
+	}
+	return members, nil
+}
+
+// groupTiers splits members in start order into tiers of the same order.
+func groupTiers(members []groupMember) [][]storage.VirtualMachine {
+	var tiers [][]storage.VirtualMachine
+	for i, m := range members {
+		if i == 0 || m.order != members[i-1].order {
+			tiers = append(tiers, nil)
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], m.vm)
+	}
+	return tiers
+}
+
+func (s *HostService) vmGroupView(group *storage.VMGroup) (*VMGroupView, error) {
+	members, err := s.groupMembers(group.ID)
+	if err != nil {
+		return nil, err
+	}
+	view := &VMGroupView{VMGroup: *group, Members: make([]VMGroupMember, 0, len(members))}
+	for _, m := range members {
+		view.Members = append(view.Members, VMGroupMember{
+			VMUUID:     m.vm.UUID,
+			VMName:     m.vm.Name,
+			HostID:     m.vm.HostID,
+			State:      string(m.vm.State),
+			StartOrder: m.order,
+		})
+	}
+	return view, nil
+}
+
+func (s *HostService) getVMGroup(name string) (*storage.VMGroup, error) {
+	var group storage.VMGroup
+	if err := s.db.Where("name = ?", name).First(&group).Error; err != nil {
+		return nil, fmt.Errorf("could not find VM group %s: %w", name, err)
+	}
+	return &group, nil
+}
+
+// ListVMGroups returns the VM groups by name, with their members.
+func (s *HostService) ListVMGroups() ([]VMGroupView, error) {
+	var groups []storage.VMGroup
+	if err := s.db.Order("name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	views := make([]VMGroupView, 0, len(groups))
+	for i := range groups {
+		view, err := s.vmGroupView(&groups[i])
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, *view)
+	}
+	return views, nil
+}
+
+// GetVMGroup returns a VM group with its members.
+func (s *HostService) GetVMGroup(name string) (*VMGroupView, error) {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.vmGroupView(group)
+}
+
+// CreateVMGroup defines a VM group with its members.
+func (s *HostService) CreateVMGroup(req VMGroupRequest) (*VMGroupView, error) {
+	req, err := normalizeVMGroup(req)
+	if err != nil {
+		return nil, err
+	}
+	var count int64
+	if err := s.db.Model(&storage.VMGroup{}).Where("name = ?", req.Name).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrVMGroupExists, req.Name)
+	}
+	rows, err := s.memberRows(0, req.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	group := storage.VMGroup{
+		Name:               req.Name,
+		Description:        req.Description,
+		StartDelaySeconds:  req.StartDelaySeconds,
+		StopTimeoutSeconds: req.StopTimeoutSeconds,
+		SnapshotMemory:     req.SnapshotMemory,
+	}
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Create(&group).Error; err != nil {
+			return err
+		}
+		for i := range rows {
+			rows[i].GroupID = group.ID
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save VM group: %w", err)
+	}
+	s.recordAudit("vmgroup.create", "vmgroup", group.Name, fmt.Sprintf("members=%d", len(rows)))
+	return s.vmGroupView(&group)
+}
+
+// UpdateVMGroup changes the settings of a group and, if members are given,
+// replaces its members. The group cannot be renamed.
+func (s *HostService) UpdateVMGroup(name string, req VMGroupRequest) (*VMGroupView, error) {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	req.Name = group.Name
+	if req, err = normalizeVMGroup(req); err != nil {
+		return nil, err
+	}
+	rows, err := s.memberRows(group.ID, req.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	group.Description = req.Description
+	group.StartDelaySeconds = req.StartDelaySeconds
+	group.StopTimeoutSeconds = req.StopTimeoutSeconds
+	group.SnapshotMemory = req.SnapshotMemory
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Save(group).Error; err != nil {
+			return err
+		}
+		if req.Members == nil {
+			return nil
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&storage.VMGroupMember{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save VM group: %w", err)
+	}
+	details := "members unchanged"
+	if req.Members != nil {
+		details = fmt.Sprintf("members=%d", len(rows))
+	}
+	s.recordAudit("vmgroup.update", "vmgroup", group.Name, details)
+	return s.vmGroupView(group)
+}
+
+// DeleteVMGroup removes a group. Its VMs are left alone.
+func (s *HostService) DeleteVMGroup(name string) error {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Delete(group).Error; err != nil {
+		return fmt.Errorf("failed to delete VM group: %w", err)
+	}
+	s.recordAudit("vmgroup.delete", "vmgroup", name, "")
+	return nil
+}
+
+// AddVMGroupMember puts a VM in a group, or changes its start order if it
+// is a member already.
+func (s *HostService) AddVMGroupMember(name string, req VMGroupMemberRequest) (*VMGroupView, error) {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	req.VMUUID = strings.TrimSpace(req.VMUUID)
+	var v validator
+	v.required("vm_uuid", req.VMUUID)
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	rows, err := s.memberRows(group.ID, []VMGroupMemberRequest{req})
+	if err != nil {
+		return nil, err
+	}
+	row := rows[0]
+	err = s.db.Where(storage.VMGroupMember{GroupID: group.ID, VMID: row.VMID}).
+		Assign(storage.VMGroupMember{StartOrder: row.StartOrder}).
+		FirstOrCreate(&row).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save VM group member: %w", err)
+	}
+	s.recordAudit("vmgroup.member.add", "vmgroup", group.Name, fmt.Sprintf("vm=%s start_order=%d", req.VMUUID, req.StartOrder))
+	return s.vmGroupView(group)
+}
+
+// RemoveVMGroupMember takes a VM out of a group.
+func (s *HostService) RemoveVMGroupMember(name, vmUUID string) error {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return err
+	}
+	result := s.db.Where("group_id = ? AND vm_id IN (?)", group.ID,
+		s.db.Model(&storage.VirtualMachine{}).Select("id").Where("uuid = ?", vmUUID)).
+		Delete(&storage.VMGroupMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("VM %s is not a member of group %s: %w", vmUUID, name, gorm.ErrRecordNotFound)
+	}
+	s.recordAudit("vmgroup.member.remove", "vmgroup", group.Name, "vm="+vmUUID)
+	return nil
+}
+
+// nonEmptyGroup returns a group and its members, or ErrVMGroupEmpty.
+func (s *HostService) nonEmptyGroup(name string) (*storage.VMGroup, []groupMember, error) {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := s.groupMembers(group.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrVMGroupEmpty, name)
+	}
+	return group, members, nil
+}
+
+// StartVMGroup starts the members of a group as a task, tier by tier in
+// ascending start order, waiting the group's start delay after each tier.
+// Members that are already running are passed over. The task stops at the
+// first member that fails to start.
+func (s *HostService) StartVMGroup(name string) (*storage.Task, error) {
+	group, members, err := s.nonEmptyGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	task, err := s.tasks.Start("vmgroup.start", fmt.Sprintf("Starting VM group %s", name))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("vmgroup.start", "vmgroup", name, "")
+
+	started := copyTask(task)
+	go func() {
+		err := s.runVMGroupStart(task, group, groupTiers(members))
+		if err != nil {
+			log.Printf("Start of VM group %s failed: %v", name, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runVMGroupStart(task *storage.Task, group *storage.VMGroup, tiers [][]storage.VirtualMachine) error {
+	delay := time.Duration(group.StartDelaySeconds) * time.Second
+	for i, tier := range tiers {
+		progress := 100 * i / len(tiers)
+		started := false
+		for _, vm := range tier {
+			info, err := s.connector.GetDomainInfo(vm.HostID, vm.Name)
+			if err != nil {
+				return err
+			}
+			if info.State == golibvirt.DomainRunning {
+				s.tasks.Step(task, progress, fmt.Sprintf("%s is already running", vm.Name))
+				continue
+			}
+			if err := s.StartVM(context.Background(), vm.HostID, vm.Name); err != nil {
+				return fmt.Errorf("failed to start %s: %w", vm.Name, err)
+			}
+			started = true
+			s.tasks.Step(task, progress, fmt.Sprintf("Started %s on %s", vm.Name, vm.HostID))
+		}
+		if started && delay > 0 && i < len(tiers)-1 {
+			s.tasks.Step(task, progress, fmt.Sprintf("Waiting %s before the next tier", delay))
+			time.Sleep(delay)
+		}
+	}
+	return nil
+}
+
+// StopVMGroup shuts down the members of a group as a task, tier by tier in
+// descending start order. The members of a tier are shut down together, and
+// the next tier waits until they are all off. Nothing is forced off.
+func (s *HostService) StopVMGroup(name string) (*storage.Task, error) {
+	group, members, err := s.nonEmptyGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	task, err := s.tasks.Start("vmgroup.stop", fmt.Sprintf("Stopping VM group %s", name))
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("vmgroup.stop", "vmgroup", name, "")
+
+	started := copyTask(task)
+	go func() {
+		err := s.runVMGroupStop(task, group, groupTiers(members))
+		if err != nil {
+			log.Printf("Stop of VM group %s failed: %v", name, err)
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runVMGroupStop(task *storage.Task, group *storage.VMGroup, tiers [][]storage.VirtualMachine) error {
+	timeout := defaultDependencyTimeout
+	if group.StopTimeoutSeconds > 0 {
+		timeout = time.Duration(group.StopTimeoutSeconds) * time.Second
+	}
+	for i := range tiers {
+		tier := tiers[len(tiers)-1-i]
+		progress := 100 * i / len(tiers)
+		var stopping []storage.VirtualMachine
+		for _, vm := range tier {
+			info, err := s.connector.GetDomainInfo(vm.HostID, vm.Name)
+			if err != nil {
+				return err
+			}
+			if info.State == golibvirt.DomainShutoff {
+				s.tasks.Step(task, progress, fmt.Sprintf("%s is already stopped", vm.Name))
+				continue
+			}
+			if err := s.ShutdownVM(context.Background(), vm.HostID, vm.Name); err != nil {
+				return fmt.Errorf("failed to shut down %s: %w", vm.Name, err)
+			}
+			s.tasks.Step(task, progress, fmt.Sprintf("Shutting down %s on %s", vm.Name, vm.HostID))
+			stopping = append(stopping, vm)
+		}
+		for _, vm := range stopping {
+			if err := s.waitForShutoff(vm.HostID, vm.Name, timeout); err != nil {
+				return err
+			}
+			s.tasks.Step(task, progress, fmt.Sprintf("Stopped %s", vm.Name))
+		}
+	}
+	return nil
+}
+
+// SnapshotVMGroup takes a snapshot with the same name of every member of a
+// group as a task, using the group's memory mode unless the request sets
+// one. Every member is checked before the first snapshot is taken. If a
+// snapshot fails, those already taken are deleted again, so that the group
+// either has the snapshot on all members or on none.
+func (s *HostService) SnapshotVMGroup(name string, req SnapshotRequest) (*storage.Task, error) {
+	group, members, err := s.nonEmptyGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" {
+		req.Name = time.Now().Format("snap-20060102-150405")
+	}
+	if !snapshotNamePattern.MatchString(req.Name) {
+		return nil, fmt.Errorf("%w: name must be 1-64 letters, digits, '.', '_' or '-'", ErrInvalidSnapshotRequest)
+	}
+	if req.Memory == "" {
+		req.Memory = group.SnapshotMemory
+	}
+
+	specs := make([]libvirt.SnapshotSpec, len(members))
+	var blockers []string
+	for i, m := range members {
+		estimate, err := s.EstimateSnapshot(m.vm.HostID, m.vm.Name, req.Memory)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.vm.Name, err)
+		}
+		for _, blocker := range estimate.Blockers {
+			blockers = append(blockers, fmt.Sprintf("%s: %s", m.vm.Name, blocker))
+		}
+		existing, err := s.connector.ListSnapshots(m.vm.HostID, m.vm.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.vm.Name, err)
+		}
+		for _, snap := range existing {
+			if snap.Name == req.Name {
+				return nil, fmt.Errorf("%w: %s on %s", ErrSnapshotExists, req.Name, m.vm.Name)
+			}
+		}
+		specs[i] = libvirt.SnapshotSpec{Name: req.Name, Description: req.Description, Memory: estimate.Memory}
+	}
+	if len(blockers) > 0 {
+		return nil, fmt.Errorf("%w: %s", libvirt.ErrSnapshotUnsupported, strings.Join(blockers, "; "))
+	}
+
+	task, err := s.tasks.Start("vmgroup.snapshot", fmt.Sprintf("Snapshot %s of VM group %s", req.Name, name))
+	if err != nil {
+		return nil, err
+	}
+	started := copyTask(task)
+	go func() {
+		err := s.runVMGroupSnapshot(task, members, specs)
+		if err != nil {
+			log.Printf("Snapshot %s of VM group %s failed: %v", req.Name, name, err)
+		} else {
+			s.recordAudit("vmgroup.snapshot", "vmgroup", name, fmt.Sprintf("name=%s members=%d", req.Name, len(members)))
+		}
+		s.tasks.Finish(task, err)
+	}()
+	return started, nil
+}
+
+func (s *HostService) runVMGroupSnapshot(task *storage.Task, members []groupMember, specs []libvirt.SnapshotSpec) error {
+	for i, m := range members {
+		s.tasks.Step(task, 100*i/len(members), fmt.Sprintf("Taking snapshot of %s (memory: %s)", m.vm.Name, specs[i].Memory))
+		err := s.connector.CreateSnapshot(m.vm.HostID, m.vm.Name, specs[i])
+		if err == nil {
+			s.refreshSnapshots(m.vm.HostID, m.vm.Name)
+			continue
+		}
+		for _, taken := range members[:i] {
+			s.tasks.Step(task, 100*i/len(members), fmt.Sprintf("Deleting the snapshot of %s again", taken.vm.Name))
+			if err := s.connector.DeleteSnapshot(taken.vm.HostID, taken.vm.Name, specs[i].Name); err != nil {
+				log.Printf("Warning: failed to delete snapshot %s of %s: %v", specs[i].Name, taken.vm.Name, err)
+			}
+			s.refreshSnapshots(taken.vm.HostID, taken.vm.Name)
+		}
+		return fmt.Errorf("snapshot of %s failed: %w", m.vm.Name, err)
+	}
+	return nil
+}
+
+// GetVMGroupStats adds up the configured resources of a group's members and
+// the live usage of those that are running.
+func (s *HostService) GetVMGroupStats(name string) (*VMGroupStats, error) {
+	group, err := s.getVMGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	members, err := s.groupMembers(group.ID)
+	if err != nil {
+		return nil, err
+	}
+	stats := &VMGroupStats{Members: len(members), Unavailable: []string{}}
+	for _, m := range members {
+		stats.VCPUs += m.vm.VCPUCount
+		stats.MemoryBytes += m.vm.MemoryBytes
+		if m.vm.State != storage.StateActive {
+			continue
+		}
+		stats.Running++
+		live, err := s.GetVMStats(m.vm.HostID, m.vm.Name)
+		if err != nil {
+			stats.Unavailable = append(stats.Unavailable, m.vm.Name)
+			continue
+		}
+		stats.CPUTimeNs += live.CpuTime
+		stats.MemoryUsedBytes += live.Memory
+		for _, disk := range live.DiskStats {
+			stats.DiskReadBytes += disk.ReadBytes
+			stats.DiskWriteBytes += disk.WriteBytes
+		}
+		for _, nic := range live.NetStats {
+			stats.NetRxBytes += nic.ReadBytes
+			stats.NetTxBytes += nic.WriteBytes
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,360 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+	"gorm.io/gorm"
+)
+
+// Limits on labels, following Kubernetes: names and values of at most 63
+// characters, keys optionally prefixed with a DNS subdomain and '/'.
+const (
+	maxLabels               = 64
+	maxLabelNameLength      = 63
+	maxLabelPrefixLength    = 253
+	maxLabelValueLength     = 63
+	maxSelectorRequirements = 32
+)
+
+var (
+	labelNamePattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+	labelPrefixPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+)
+
+// label checks a label key and value, recording problems under the given
+// field.
+func (v *validator) label(field, key, value string) {
+	v.labelKey(field, key)
+	v.labelValue(field, value)
+}
+
+func (v *validator) labelKey(field, key string) {
+	prefix, name, hasPrefix := strings.Cut(key, "/")
+	if !hasPrefix {
+		prefix, name = "", key
+	}
+	switch {
+	case hasPrefix && (len(prefix) > maxLabelPrefixLength || !labelPrefixPattern.MatchString(prefix)):
+		v.add(field, "key prefix '%s' must be a lowercase DNS subdomain", prefix)
+	case len(name) > maxLabelNameLength || !labelNamePattern.MatchString(name):
+		v.add(field, "key '%s' must be 1-%d letters, digits, '-', '_' or '.', starting and ending with a letter or digit", key, maxLabelNameLength)
+	}
+}
+
+func (v *validator) labelValue(field, value string) {
+	if value != "" && (len(value) > maxLabelValueLength || !labelNamePattern.MatchString(value)) {
+		v.add(field, "value '%s' must be empty or 1-%d letters, digits, '-', '_' or '.', starting and ending with a letter or digit", value, maxLabelValueLength)
+	}
+}
+
+// labelsOf returns the labels of a VM as a map, never nil.
+func labelsOf(db *gorm.DB, vmID uint) (map[string]string, error) {
+	var rows []storage.VMLabel
+	if err := db.Where("vm_id = ?", vmID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(rows))
+	for _, row := range rows {
+		labels[row.Key] = row.Value
+	}
+	return labels, nil
+}
+
+// GetVMLabels returns the labels of a VM.
+func (s *HostService) GetVMLabels(hostID, vmName string) (map[string]string, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return labelsOf(s.db, vm.ID)
+}
+
+// ReplaceVMLabels replaces all labels of a VM with the given set.
+func (s *HostService) ReplaceVMLabels(hostID, vmName string, labels map[string]string) (map[string]string, error) {
+	var v validator
+	if len(labels) > maxLabels {
+		v.add("labels", "a VM can have at most %d labels", maxLabels)
+	}
+	for key, value := range labels {
+		v.label("labels", key, value)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		if err := tx.Where("vm_id = ?", vm.ID).Delete(&storage.VMLabel{}).Error; err != nil {
+			return err
+		}
+		for key, value := range labels {
+			if err := tx.Create(&storage.VMLabel{VMID: vm.ID, Key: key, Value: value}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	s.recordAudit("vm.labels.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "labels="+strings.Join(pairs, ","))
+	s.broadcastVMsChanged(hostID)
+	return labelsOf(s.db, vm.ID)
+}
+
+// SetVMLabel creates or updates a single label of a VM.
+func (s *HostService) SetVMLabel(hostID, vmName, key, value string) error {
+	var v validator
+	v.label("value", key, value)
+	if err := v.err(); err != nil {
+		return err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+
+	err = storage.Transact(s.db, func(tx *gorm.DB) error {
+		var label storage.VMLabel
+		err := tx.Where("vm_id = ? AND key = ?", vm.ID, key).First(&label).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			var count int64
+			if err := tx.Model(&storage.VMLabel{}).Where("vm_id = ?", vm.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count >= maxLabels {
+				return &ValidationError{Fields: []FieldError{{Field: "key", Message: fmt.Sprintf("a VM can have at most %d labels", maxLabels)}}}
+			}
+			return tx.Create(&storage.VMLabel{VMID: vm.ID, Key: key, Value: value}).Error
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Model(&label).Update("value", value).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	s.recordAudit("vm.labels.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), fmt.Sprintf("labels=%s=%s", key, value))
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
+
+// DeleteVMLabel removes a label from a VM.
+func (s *HostService) DeleteVMLabel(hostID, vmName, key string) error {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return err
+	}
+	result := s.db.Where("vm_id = ? AND key = ?", vm.ID, key).Delete(&storage.VMLabel{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("could not find label '%s' on VM %s: %w", key, vmName, gorm.ErrRecordNotFound)
+	}
+
+	s.recordAudit("vm.labels.delete", "vm", fmt.Sprintf("%s/%s", hostID, vmName), "label="+key)
+	s.broadcastVMsChanged(hostID)
+	return nil
+}
+
+// Selector operators, as in Kubernetes label selectors.
+const (
+	selectorEquals       = "="
+	selectorNotEquals    = "!="
+	selectorIn           = "in"
+	selectorNotIn        = "notin"
+	selectorExists       = "exists"
+	selectorDoesNotExist = "!"
+)
+
+// selectorRequirement is one comma-separated term of a selector.
+type selectorRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// Selector picks VMs by their labels. The zero value matches every VM.
+type Selector struct {
+	requirements []selectorRequirement
+}
+
+// ParseSelector parses a Kubernetes-style label selector: comma-separated
+// requirements that must all hold, each one of 'key=value', 'key==value',
+// 'key!=value', 'key in (a,b)', 'key notin (a,b)', 'key' or '!key'.
+func ParseSelector(selector string) (Selector, error) {
+	var sel Selector
+	var v validator
+	terms := splitSelector(selector)
+	if len(terms) > maxSelectorRequirements {
+		v.add("selector", "can have at most %d requirements", maxSelectorRequirements)
+		return sel, v.err()
+	}
+	for _, term := range terms {
+		req, err := parseSelectorRequirement(term)
+		if err != nil {
+			v.add("selector", "%v", err)
+			continue
+		}
+		v.labelKey("selector", req.key)
+		for _, value := range req.values {
+			v.labelValue("selector", value)
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return sel, v.err()
+}
+
+// splitSelector splits a selector at the commas outside parentheses.
+func splitSelector(selector string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if last := selector[start:]; strings.TrimSpace(last) != "" || len(terms) > 0 {
+		terms = append(terms, last)
+	}
+	return terms
+}
+
+func parseSelectorRequirement(term string) (selectorRequirement, error) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return selectorRequirement{}, errors.New("empty requirement")
+	}
+	if key, ok := strings.CutPrefix(term, "!"); ok {
+		return selectorRequirement{key: strings.TrimSpace(key), operator: selectorDoesNotExist}, nil
+	}
+	for _, op := range []string{"!=", "==", "="} {
+		if key, value, ok := strings.Cut(term, op); ok {
+			operator := selectorEquals
+			if op == "!=" {
+				operator = selectorNotEquals
+			}
+			return selectorRequirement{key: strings.TrimSpace(key), operator: operator, values: []string{strings.TrimSpace(value)}}, nil
+		}
+	}
+	if fields := strings.Fields(term); len(fields) >= 2 && (fields[1] == selectorIn || fields[1] == selectorNotIn) {
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(term[len(fields[0]):]), fields[1]))
+		if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+			return selectorRequirement{}, fmt.Errorf("'%s' needs a parenthesized list of values", term)
+		}
+		var values []string
+		for _, value := range strings.Split(rest[1:len(rest)-1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		return selectorRequirement{key: fields[0], operator: fields[1], values: values}, nil
+	}
+	if strings.ContainsAny(term, " ()") {
+		return selectorRequirement{}, fmt.Errorf("cannot parse '%s'", term)
+	}
+	return selectorRequirement{key: term, operator: selectorExists}, nil
+}
+
+// Empty reports whether the selector has no requirements and so matches
+// every VM.
+func (sel Selector) Empty() bool {
+	return len(sel.requirements) == 0
+}
+
+// Matches reports whether a set of labels satisfies every requirement.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel.requirements {
+		value, ok := labels[req.key]
+		var matched bool
+		switch req.operator {
+		case selectorEquals:
+			matched = ok && value == req.values[0]
+		case selectorNotEquals:
+			matched = !ok || value != req.values[0]
+		case selectorIn:
+			matched = ok && slices.Contains(req.values, value)
+		case selectorNotIn:
+			matched = !ok || !slices.Contains(req.values, value)
+		case selectorExists:
+			matched = ok
+		case selectorDoesNotExist:
+			matched = !ok
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// selectVMs returns the VMs of all hosts whose labels match a selector.
+func (s *HostService) selectVMs(sel Selector) ([]storage.VirtualMachine, error) {
+	var vms []storage.VirtualMachine
+	if err := s.db.Order("host_id, name").Find(&vms).Error; err != nil {
+		return nil, err
+	}
+	if sel.Empty() {
+		return vms, nil
+	}
+	var rows []storage.VMLabel
+	if err := s.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	labels := make(map[uint]map[string]string)
+	for _, row := range rows {
+		if labels[row.VMID] == nil {
+			labels[row.VMID] = make(map[string]string)
+		}
+		labels[row.VMID][row.Key] = row.Value
+	}
+	matched := vms[:0]
+	for _, vm := range vms {
+		if sel.Matches(labels[vm.ID]) {
+			matched = append(matched, vm)
+		}
+	}
+	return matched, nil
+}
+
+// ListVMs returns the VMs of all hosts that match a label selector; an
+// empty selector returns every VM.
+func (s *HostService) ListVMs(selector string) ([]VMView, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := s.selectVMs(sel)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]VMView, 0, len(vms))
+	for _, vm := range vms {
+		views = append(views, s.vmToView(vm))
+	}
+	return views, nil
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+var (
+	// ErrInvalidNICRequest is returned when a NIC request has no bridge or network, a malformed MAC or an invalid VLAN.
+	ErrInvalidNICRequest = errors.New("specify a bridge or network and, optionally, a unicast MAC address and a VLAN ID of 1-4094")
+	// ErrMACInUse is returned when a requested MAC address belongs to another VM.
+	ErrMACInUse = errors.New("MAC address is already in use")
+)
+
+// NICAttachRequest adds a bridged network interface to a VM, either on a
+// defined network or directly on a bridge.
+type NICAttachRequest struct {
+	Network string `json:"network,omitempty"` // Name of a network on the host
+	Bridge  string `json:"bridge,omitempty"`  // Host bridge, when no network is given
+	VLANID  uint   `json:"vlan_id,omitempty"` // Overrides the network's VLAN
+	Model   string `json:"model,omitempty"`   // 'virtio' (default), 'e1000', ...
+	MAC     string `json:"mac_address,omitempty"`
+}
+
+// AttachedNIC is the result of attaching a NIC.
+type AttachedNIC struct {
+	MACAddress string `json:"mac_address"`
+	Network    string `json:"network"`
+	Bridge     string `json:"bridge"`
+	VLANID     uint   `json:"vlan_id"`
+	Model      string `json:"model"`
+}
+
+// AttachNIC attaches a bridged interface to a VM. Unless an address is
+// requested, one is allocated from the MAC pool; either way it must not be in
+// use by another VM on any host. The NIC is tagged with the VLAN of its
+// network unless another VLAN is requested.
+func (s *HostService) AttachNIC(hostID, vmName string, req NICAttachRequest) (*AttachedNIC, error) {
+	if (req.Network == "" && req.Bridge == "") || req.VLANID > libvirt.MaxVLANID {
+		return nil, ErrInvalidNICRequest
+	}
+	network, err := s.nicNetwork(hostID, req)
+	if err != nil {
+		return nil, err
+	}
+	vlanID := network.VLANID
+	if req.VLANID != 0 {
+		vlanID = req.VLANID
+	}
+
+	mac := strings.ToLower(req.MAC)
+	if mac == "" {
+		allocated, err := s.AllocateMACAddress()
+		if err != nil {
+			return nil, err
+		}
+		mac = allocated
+	} else {
+		hw, err := net.ParseMAC(mac)
+		if err != nil || len(hw) != 6 || hw[0]&0x01 != 0 {
+			return nil, ErrInvalidNICRequest
+		}
+		mac = hw.String()
+		owner, err := macOwner(s.db, mac)
+		if err != nil {
+			return nil, err
+		}
+		if owner != nil {
+			return nil, fmt.Errorf("%w by VM %s on host %s", ErrMACInUse, owner.Name, owner.HostID)
+		}
+	}
+
+	model := valueOr(req.Model, "virtio")
+	err = s.connector.AttachNIC(hostID, vmName, libvirt.NICAttachSpec{
+		MAC:             mac,
+		Bridge:          network.BridgeName,
+		Model:           model,
+		VirtualPortType: network.VirtualPortType,
+		VLANID:          vlanID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.recordAudit("vm.nic.attach", "vm", fmt.Sprintf("%s/%s", hostID, vmName),
+		fmt.Sprintf("mac=%s network=%s bridge=%s vlan=%d model=%s", mac, network.Name, network.BridgeName, vlanID, model))
+	if changed, err := s.syncSingleVM(hostID, vmName); err == nil && changed {
+		s.broadcastVMsChanged(hostID)
+	}
+	if err := s.bindNIC(mac, network, vlanID); err != nil {
+		log.Printf("Warning: failed to record network of interface %s on VM %s: %v", mac, vmName, err)
+	}
+	if vlanID != 0 && network.VirtualPortType != libvirt.VirtualPortOVS {
+		if err := s.applyBridgeVLANs(context.Background(), hostID, vmName); err != nil {
+			log.Printf("Warning: failed to apply bridge VLANs for VM %s on host %s: %v", vmName, hostID, err)
+		}
+	}
+
+	return &AttachedNIC{MACAddress: mac, Network: network.Name, Bridge: network.BridgeName, VLANID: vlanID, Model: model}, nil
+}
+
+// nicNetwork returns the network a new NIC is attached to: the named network,
+// or else the network on the requested bridge with the requested VLAN,
+// falling back to the network named after the bridge.
+func (s *HostService) nicNetwork(hostID string, req NICAttachRequest) (*storage.Network, error) {
+	var network storage.Network
+	if req.Network != "" {
+		if err := s.db.Where("host_id = ? AND name = ?", hostID, req.Network).First(&network).Error; err != nil {
+			return nil, fmt.Errorf("could not find network %s on host %s: %w", req.Network, hostID, err)
+		}
+		return &network, nil
+	}
+
+	var nic libvirt.NetworkInfo
+	nic.Source.Bridge = req.Bridge
+	if req.VLANID != 0 {
+		nic.VLAN = &libvirt.InterfaceVLAN{}
+		nic.VLAN.Tag.ID = req.VLANID
+	}
+	network, _ = resolveNICNetwork(s.db, hostID, nic, nil)
+	if network.ID == 0 {
+		return nil, fmt.Errorf("failed to record network for bridge %s", req.Bridge)
+	}
+	return &network, nil
+}
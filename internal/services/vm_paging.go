@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// vmPageTimeout bounds how long one page of a live VM listing may take.
+// Whatever was gathered by then is returned as a partial page, well before
+// clients and proxies give up on the request.
+const vmPageTimeout = 20 * time.Second
+
+// VMPage is one page of a host's VMs read live from libvirt, ordered by name.
+type VMPage struct {
+	VMs []VMView `json:"vms"`
+	// Continue fetches the next page; empty on the last page.
+	Continue string `json:"continue,omitempty"`
+	// Partial is set when the page was cut short to answer in time.
+	Partial bool `json:"partial"`
+	// Total is the number of VMs on the host.
+	Total int `json:"total"`
+}
+
+// ListVMsPage reads a page of a host's VMs live from libvirt. It writes
+// nothing: VMs already in the database are returned with their stored
+// details and live state, and VMs the next sync has yet to pick up with
+// what libvirt reported.
+func (s *HostService) ListVMsPage(hostID, token string, limit int) (*VMPage, error) {
+	hostCtx, done, err := s.syncs.start(hostID)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	ctx, cancel := context.WithTimeout(hostCtx, vmPageTimeout)
+	defer cancel()
+	page, err := s.connector.ListDomainsPage(ctx, hostID, token, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	uuids := make([]string, len(page.Domains))
+	for i, vmInfo := range page.Domains {
+		uuids[i] = vmInfo.UUID
+	}
+	var dbVMs []storage.VirtualMachine
+	if err := s.db.Where("host_id = ? AND domain_uuid IN ?", hostID, uuids).Find(&dbVMs).Error; err != nil {
+		return nil, fmt.Errorf("could not get DB VM records for host %s: %w", hostID, err)
+	}
+	known := make(map[string]storage.VirtualMachine, len(dbVMs))
+	for _, dbVM := range dbVMs {
+		known[dbVM.DomainUUID] = dbVM
+	}
+
+	result := &VMPage{VMs: make([]VMView, 0, len(page.Domains)), Continue: page.Continue, Partial: page.Partial, Total: page.Total}
+	for i := range page.Domains {
+		vmInfo := &page.Domains[i]
+		var view VMView
+		if dbVM, ok := known[vmInfo.UUID]; ok {
+			view = s.vmToView(dbVM)
+		} else {
+			view = s.unsyncedVMView(hostID, vmInfo)
+		}
+		view.State = mapLibvirtStateToVMState(vmInfo.State)
+		view.Graphics = vmInfo.Graphics
+		view.MaxMem = vmInfo.MaxMem
+		view.Memory = vmInfo.Memory
+		view.CpuTime = vmInfo.CpuTime
+		result.VMs = append(result.VMs, view)
+	}
+	return result, nil
+}
+
+// unsyncedVMView describes a VM that is not in the database yet from what
+// libvirt reported about it. It has no database ID or internal UUID.
+func (s *HostService) unsyncedVMView(hostID string, vmInfo *libvirt.VMInfo) VMView {
+	projectID, err := s.vmProject(storage.VirtualMachine{HostID: hostID})
+	if err != nil {
+		log.Printf("Error querying the project of host %s: %v", hostID, err)
+	}
+	return VMView{
+		HostID:           hostID,
+		Name:             vmInfo.Name,
+		DomainUUID:       vmInfo.UUID,
+		Description:      vmInfo.Description,
+		VCPUCount:        vmInfo.Vcpu,
+		MemoryBytes:      vmInfo.MaxMem * 1024,
+		CPUModel:         vmInfo.CPUModel,
+		CPUTopologyJSON:  cpuTopologyJSON(vmInfo.CPUTopology),
+		OSType:           vmInfo.OS.Family,
+		OSVariant:        vmInfo.OS.Variant,
+		OSName:           vmInfo.OS.Name,
+		CPUShares:        vmInfo.Tuning.CPUShares,
+		BlkioWeight:      vmInfo.Tuning.BlkioWeight,
+		CustomFields:     map[string]string{},
+		Labels:           map[string]string{},
+		ProjectID:        projectID,
+		Uptime:           -1,
+		GuestFilesystems: []storage.GuestFilesystem{},
+		GuestAgent:       vmInfo.GuestAgent,
+		Health:           storage.HealthGreen,
+		HealthReasons:    []storage.HealthReason{},
+	}
+}
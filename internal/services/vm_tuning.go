@@ -0,0 +1,83 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+)
+
+// Bounds of the tuning values libvirt accepts on cgroup v1 hosts. On cgroup
+// v2 hosts the kernel narrows CPU shares to 1-10000 and libvirt reports the
+// error.
+const (
+	minCPUShares   = 2
+	maxCPUShares   = 262144
+	minBlkioWeight = 100
+	maxBlkioWeight = 1000
+)
+
+// VMTuningRequest changes a VM's relative CPU shares and block I/O weight.
+// Fields left out keep their value.
+type VMTuningRequest struct {
+	CPUShares   *uint64 `json:"cpu_shares"`
+	BlkioWeight *uint   `json:"blkio_weight"`
+}
+
+// GetVMTuning returns a VM's CPU shares and block I/O weight as of the last
+// sync.
+func (s *HostService) GetVMTuning(hostID, vmName string) (*libvirt.DomainTuning, error) {
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return &libvirt.DomainTuning{CPUShares: vm.CPUShares, BlkioWeight: vm.BlkioWeight}, nil
+}
+
+// SetVMTuning sets a VM's CPU shares and block I/O weight, on the running
+// guest and in its definition.
+func (s *HostService) SetVMTuning(hostID, vmName string, req VMTuningRequest) (*libvirt.DomainTuning, error) {
+	var v validator
+	if req.CPUShares == nil && req.BlkioWeight == nil {
+		v.add("cpu_shares", "or blkio_weight is required")
+	}
+	if req.CPUShares != nil && (*req.CPUShares < minCPUShares || *req.CPUShares > maxCPUShares) {
+		v.add("cpu_shares", "must be between %d and %d", minCPUShares, maxCPUShares)
+	}
+	if req.BlkioWeight != nil && (*req.BlkioWeight < minBlkioWeight || *req.BlkioWeight > maxBlkioWeight) {
+		v.add("blkio_weight", "must be between %d and %d", minBlkioWeight, maxBlkioWeight)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	vm, err := s.findVM(hostID, vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.connector.SetDomainTuning(hostID, vmName, libvirt.DomainTuningUpdate{
+		CPUShares:   req.CPUShares,
+		BlkioWeight: req.BlkioWeight,
+	}); err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{}
+	var details []string
+	if req.CPUShares != nil {
+		updates["cpu_shares"] = *req.CPUShares
+		vm.CPUShares = *req.CPUShares
+		details = append(details, fmt.Sprintf("cpu_shares=%d", *req.CPUShares))
+	}
+	if req.BlkioWeight != nil {
+		updates["blkio_weight"] = *req.BlkioWeight
+		vm.BlkioWeight = *req.BlkioWeight
+		details = append(details, fmt.Sprintf("blkio_weight=%d", *req.BlkioWeight))
+	}
+	if err := s.db.Model(vm).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	s.recordAudit("vm.tuning.update", "vm", fmt.Sprintf("%s/%s", hostID, vmName), strings.Join(details, " "))
+	s.broadcastVMsChanged(hostID)
+	return &libvirt.DomainTuning{CPUShares: vm.CPUShares, BlkioWeight: vm.BlkioWeight}, nil
+}
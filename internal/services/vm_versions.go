@@ -0,0 +1,56 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// ErrVersionConflict is returned for an edit of a VM whose version is not
+// the one the edit was based on: someone else changed the VM meanwhile.
+var ErrVersionConflict = errors.New("VM was changed since it was read")
+
+// A VM's version is its generation, which increments whenever a sync or an
+// edit changes it. Spec edits name the version they were based on, so two
+// admins editing the same VM cannot silently overwrite each other: the edit
+// that comes second fails and must be redone on the new version.
+
+// BeginVMSpecEdit starts an edit of a VM's specification based on the given
+// version, failing with ErrVersionConflict when the VM is at another one.
+// The VM's definition is archived first. Edits of a VM are serialized until
+// the returned function is called with whether the edit was applied; an
+// applied edit moves the VM to a new version, even when it only changed
+// libvirt's definition.
+func (s *HostService) BeginVMSpecEdit(hostID, vmName string, version uint64) (func(applied bool), error) {
+	value, _ := s.vmSpecEdits.LoadOrStore(hostID+"/"+vmName, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+
+	var vm storage.VirtualMachine
+	if err := s.db.Select("id", "generation").Where("host_id = ? AND name = ?", hostID, vmName).First(&vm).Error; err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	if vm.Generation != version {
+		mu.Unlock()
+		return nil, fmt.Errorf("%w: the edit is based on version %d, the VM is at version %d", ErrVersionConflict, version, vm.Generation)
+	}
+	// Keep the definition the edit starts from, so it can be restored.
+	if _, err := s.archiveVMDefinition(hostID, vmName, DefinitionSourceEdit, ""); err != nil {
+		log.Printf("Warning: failed to archive the definition of VM %s on host %s before an edit: %v", vmName, hostID, err)
+	}
+	return func(applied bool) {
+		defer mu.Unlock()
+		if !applied {
+			return
+		}
+		// Edits that were synced into the database have bumped it already.
+		err := s.db.Exec("UPDATE virtual_machines SET generation = generation + 1 WHERE id = ? AND generation = ?", vm.ID, version).Error
+		if err != nil {
+			log.Printf("Warning: failed to bump the version of VM %s on host %s: %v", vmName, hostID, err)
+		}
+	}, nil
+}
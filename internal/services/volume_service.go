@@ -0,0 +1,346 @@
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/capsali/virtumancer-flash/internal/libvirt"
+	"github.com/capsali/virtumancer-flash/internal/storage"
+)
+
+// PermissionManageStorage allows deleting volumes and the files in pools.
+const PermissionManageStorage = "storage.manage"
+
+// ErrUnsupportedPoolType is returned when scanning a pool that is not file based.
+var ErrUnsupportedPoolType = errors.New("only directory and filesystem pools can be scanned for unmanaged disks")
+
+// ErrVolumeInUse is returned when adopting a volume already attached to a VM.
+var ErrVolumeInUse = errors.New("volume is attached to a VM")
+
+// ErrChecksumMismatch is returned when an uploaded image does not match the
+// checksum given with it, and when attaching such an image.
+var ErrChecksumMismatch = errors.New("image failed checksum verification")
+
+// Checksum states of an uploaded volume.
+const (
+	ChecksumVerified = "verified"
+	ChecksumMismatch = "mismatch"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// scannablePoolTypes are the pool types whose volumes are plain image files.
+var scannablePoolTypes = map[string]bool{"dir": true, "fs": true, "netfs": true}
+
+// OrphanAttachRequest attaches an unmanaged volume to a VM.
+type OrphanAttachRequest struct {
+	VMName   string `json:"vm_name"`
+	Target   string `json:"target,omitempty"`
+	Bus      string `json:"bus,omitempty"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// VolumeUploadRequest describes an image uploaded into a new volume.
+type VolumeUploadRequest struct {
+	SizeBytes uint64 // Length of the image
+	SHA256    string // Expected checksum in hex; empty skips the verification
+}
+
+// UploadedVolume is the result of an upload.
+type UploadedVolume struct {
+	Volume         libvirt.VolumeInfo `json:"volume"`
+	SHA256         string             `json:"sha256"`
+	ChecksumStatus string             `json:"checksum_status"`
+}
+
+// VolumeDeleteOptions controls how a volume is removed.
+type VolumeDeleteOptions struct {
+	Wipe          bool   // Overwrite the volume's data before deleting it
+	WipeAlgorithm string // One of libvirt's wipe algorithms, e.g. 'zero', 'dod'; defaults to 'zero'
+}
+
+// ListVolumes lists the volumes of a storage pool straight from libvirt.
+func (s *HostService) ListVolumes(hostID, poolName string) ([]libvirt.VolumeInfo, error) {
+	return s.connector.ListVolumes(hostID, poolName)
+}
+
+// GetVolumeImageSize returns how many bytes a download of a volume streams.
+func (s *HostService) GetVolumeImageSize(hostID, poolName, volName string) (uint64, error) {
+	return s.connector.GetVolumeImageSize(hostID, poolName, volName)
+}
+
+// DownloadVolume streams part of a volume's image into w, see
+// libvirt.Connector.DownloadVolume.
+func (s *HostService) DownloadVolume(hostID, poolName, volName string, offset, length uint64, w io.Writer) error {
+	s.recordAudit("volume.download", "volume", fmt.Sprintf("%s/%s/%s", hostID, poolName, volName),
+		fmt.Sprintf("offset=%d length=%d", offset, length))
+	return s.connector.DownloadVolume(hostID, poolName, volName, offset, length, w)
+}
+
+// UploadVolume stores an image read from r in a new volume. Its SHA256 is
+// computed while it is written and kept with the volume's record. An image
+// that does not match the expected checksum is kept for inspection, but
+// cannot be attached to VMs.
+func (s *HostService) UploadVolume(hostID, poolName, volName string, req VolumeUploadRequest, r io.Reader) (*UploadedVolume, error) {
+	expected := strings.ToLower(strings.TrimSpace(req.SHA256))
+	var v validator
+	if expected != "" && !sha256Pattern.MatchString(expected) {
+		v.add("sha256", "must be 64 hexadecimal digits")
+	}
+	if req.SizeBytes == 0 {
+		v.add("size_bytes", "the image is empty")
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+
+	uploaded, err := s.storeImage(hostID, poolName, volName, req.SizeBytes, r, expected)
+	if err != nil {
+		return nil, err
+	}
+	s.recordAudit("volume.upload", "volume", fmt.Sprintf("%s/%s/%s", hostID, poolName, volName),
+		fmt.Sprintf("size=%d sha256=%s checksum=%s", req.SizeBytes, uploaded.SHA256, valueOr(uploaded.ChecksumStatus, "none")))
+	if uploaded.ChecksumStatus == ChecksumMismatch {
+		return nil, fmt.Errorf("%w: %s/%s has SHA256 %s, expected %s", ErrChecksumMismatch, poolName, volName, uploaded.SHA256, expected)
+	}
+	return uploaded, nil
+}
+
+// storeImage writes an image into a new volume and records its checksum.
+// expected is a SHA256 or SHA512 in lower-case hex, or empty. A mismatch is
+// recorded on the volume and reported in the result, not as an error.
+func (s *HostService) storeImage(hostID, poolName, volName string, size uint64, r io.Reader, expected string) (*UploadedVolume, error) {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+
+	sum256 := sha256.New()
+	hashes := []io.Writer{sum256}
+	var sum512 hash.Hash
+	if len(expected) == sha512.Size*2 {
+		sum512 = sha512.New()
+		hashes = append(hashes, sum512)
+	}
+	vol, err := s.connector.UploadVolume(hostID, poolName, volName, size, io.TeeReader(r, io.MultiWriter(hashes...)))
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(sum256.Sum(nil))
+	actual := sum
+	if sum512 != nil {
+		actual = hex.EncodeToString(sum512.Sum(nil))
+	}
+	status := ""
+	switch {
+	case expected == "":
+	case actual == expected:
+		status = ChecksumVerified
+	default:
+		status = ChecksumMismatch
+	}
+	volType := "DISK"
+	if strings.EqualFold(path.Ext(volName), ".iso") {
+		volType = "ISO"
+	}
+	var record storage.Volume
+	err = s.db.Where(storage.Volume{StoragePoolID: pool.ID, Name: volName}).Assign(map[string]interface{}{
+		"type":             volType,
+		"format":           vol.Format,
+		"capacity_bytes":   vol.CapacityBytes,
+		"allocation_bytes": vol.AllocationBytes,
+		"sha256":           sum,
+		"checksum_status":  status,
+	}).FirstOrCreate(&record).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to save volume %s: %w", volName, err)
+	}
+
+	go func() {
+		if err := s.RefreshStoragePools(hostID); err != nil {
+			log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+		}
+	}()
+	return &UploadedVolume{Volume: *vol, SHA256: sum, ChecksumStatus: status}, nil
+}
+
+// checkVolumeChecksum refuses volumes whose upload failed checksum
+// verification.
+func (s *HostService) checkVolumeChecksum(hostID, poolName, volName string) error {
+	pool, err := s.getStoragePool(hostID, poolName)
+	if err != nil {
+		return nil // Nothing was uploaded to a pool that was never recorded
+	}
+	var failed int64
+	err = s.db.Model(&storage.Volume{}).
+		Where("storage_pool_id = ? AND name = ? AND checksum_status = ?", pool.ID, volName, ChecksumMismatch).
+		Count(&failed).Error
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %s/%s", ErrChecksumMismatch, poolName, volName)
+	}
+	return nil
+}
+
+// DeleteVolume removes a volume from a pool. Without wiping the volume is
+// deleted immediately and no task is returned; wiping can take hours on large
+// volumes, so it runs as a task that deletes the volume once the wipe succeeds.
+func (s *HostService) DeleteVolume(hostID, poolName, volName string, opts VolumeDeleteOptions) (*storage.Task, error) {
+	if !opts.Wipe {
+		if err := s.connector.DeleteVolume(hostID, poolName, volName); err != nil {
+			return nil, err
+		}
+		s.afterVolumeDeleted(hostID, poolName, volName, "")
+		return nil, nil
+	}
+
+	if err := libvirt.ValidateWipeAlgorithm(opts.WipeAlgorithm); err != nil {
+		return nil, err
+	}
+	algorithm := valueOr(opts.WipeAlgorithm, "zero")
+
+	task, err := s.tasks.Start("volume.wipe-delete", fmt.Sprintf("Wiping and deleting %s/%s on %s", poolName, volName, hostID))
+	if err != nil {
+		return nil, err
+	}
+
+	started := copyTask(task)
+	go func() {
+		s.tasks.Step(task, 10, fmt.Sprintf("Wiping volume using the %s algorithm", algorithm))
+		err := s.connector.WipeVolume(hostID, poolName, volName, opts.WipeAlgorithm)
+		if err != nil {
+			err = fmt.Errorf("failed to wipe volume: %w", err)
+		} else {
+			s.tasks.Step(task, 90, "Wipe completed, deleting volume")
+			if err = s.connector.DeleteVolume(hostID, poolName, volName); err != nil {
+				err = fmt.Errorf("failed to delete volume: %w", err)
+			}
+		}
+		if err != nil {
+			log.Printf("Secure delete of volume %s/%s on host %s failed: %v", poolName, volName, hostID, err)
+		} else {
+			s.afterVolumeDeleted(hostID, poolName, volName, "wipe="+algorithm)
+		}
+		s.tasks.Finish(task, err)
+	}()
+
+	return started, nil
+}
+
+// afterVolumeDeleted drops the cached volume record and refreshes the pool's usage.
+func (s *HostService) afterVolumeDeleted(hostID, poolName, volName, details string) {
+	if pool, err := s.getStoragePool(hostID, poolName); err == nil {
+		if err := s.db.Where("storage_pool_id = ? AND name = ?", pool.ID, volName).Delete(&storage.Volume{}).Error; err != nil {
+			log.Printf("Warning: failed to delete volume %s from database: %v", volName, err)
+		}
+	}
+	s.recordAudit("volume.delete", "volume", fmt.Sprintf("%s/%s/%s", hostID, poolName, volName), details)
+
+	go func() {
+		if err := s.RefreshStoragePools(hostID); err != nil {
+			log.Printf("Warning: failed to refresh storage pools for host %s: %v", hostID, err)
+		}
+	}()
+}
+
+// FindOrphanedVolumes lists the volumes of a directory-type pool that no VM on
+// the host uses, either as a disk or as the backing file of another volume
+// in the pool. The pool is rescanned and VMs are re-synced first so files
+// copied onto the host and recent VM changes are taken into account.
+func (s *HostService) FindOrphanedVolumes(hostID, poolName string) ([]libvirt.VolumeInfo, error) {
+	pool, err := s.connector.GetStoragePool(hostID, poolName, true)
+	if err != nil {
+		return nil, err
+	}
+	if !scannablePoolTypes[pool.Type] {
+		return nil, fmt.Errorf("%w: pool '%s' is of type %s", ErrUnsupportedPoolType, poolName, pool.Type)
+	}
+
+	if changed, err := s.syncAndListVMs(hostID); err != nil {
+		return nil, err
+	} else if changed {
+		s.broadcastVMsChanged(hostID)
+	}
+
+	volumes, err := s.connector.ListVolumes(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	inUse, err := s.attachedDiskPaths(hostID)
+	if err != nil {
+		return nil, err
+	}
+	for _, vol := range volumes {
+		if vol.BackingPath != "" {
+			inUse[vol.BackingPath] = true
+		}
+	}
+
+	orphans := []libvirt.VolumeInfo{}
+	for _, vol := range volumes {
+		if !inUse[vol.Path] {
+			orphans = append(orphans, vol)
+		}
+	}
+	return orphans, nil
+}
+
+// attachedDiskPaths returns the image paths of every disk attached to a VM on the host.
+func (s *HostService) attachedDiskPaths(hostID string) (map[string]bool, error) {
+	var paths []string
+	err := s.db.Table("volume_attachments").
+		Joins("JOIN volumes ON volumes.id = volume_attachments.volume_id").
+		Joins("JOIN virtual_machines ON virtual_machines.id = volume_attachments.vm_id AND virtual_machines.deleted_at IS NULL").
+		Where("virtual_machines.host_id = ? AND volume_attachments.deleted_at IS NULL", hostID).
+		Pluck("volumes.name", &paths).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load disk attachments for host %s: %w", hostID, err)
+	}
+
+	inUse := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		inUse[path] = true
+	}
+	return inUse, nil
+}
+
+// AdoptOrphanedVolume attaches an unmanaged volume to a VM after confirming
+// that no other VM is using it.
+func (s *HostService) AdoptOrphanedVolume(hostID, poolName, volName string, req OrphanAttachRequest) (*AttachedDisk, error) {
+	orphans, err := s.FindOrphanedVolumes(hostID, poolName)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, vol := range orphans {
+		if vol.Name == volName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		if _, err := s.connector.GetVolume(hostID, poolName, volName); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrVolumeInUse, poolName, volName)
+	}
+
+	return s.AttachDisk(hostID, req.VMName, DiskAttachRequest{
+		Pool:     poolName,
+		Volume:   volName,
+		Target:   req.Target,
+		Bus:      req.Bus,
+		ReadOnly: req.ReadOnly,
+	})
+}
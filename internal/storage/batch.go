@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WriteOp is a unit of work applied inside a batch transaction.
+type WriteOp func(tx *gorm.DB) error
+
+// WriteBatch groups many small writes, such as the per-VM changes of a host
+// sync, into a single transaction. SQLite serializes writers, so one
+// transaction holding the lock briefly beats dozens competing for it.
+type WriteBatch struct {
+	ops   []WriteOp
+	guard WriteOp
+}
+
+// Require sets a check run first inside the transaction. When it fails, the
+// whole batch is rolled back and Commit returns its error, e.g. when the host
+// being synced was removed in the meantime.
+func (b *WriteBatch) Require(guard WriteOp) {
+	b.guard = guard
+}
+
+// Add queues an operation. Operations run in the order they were added.
+func (b *WriteBatch) Add(op WriteOp) {
+	b.ops = append(b.ops, op)
+}
+
+// Len returns the number of queued operations.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Commit applies the queued operations in one transaction. Each operation
+// runs in its own savepoint, so a failing operation is rolled back on its own
+// and reported at its index in the returned slice, while the others are kept.
+// The error is only set when the transaction as a whole fails.
+func (b *WriteBatch) Commit(db *gorm.DB) ([]error, error) {
+	opErrs := make([]error, len(b.ops))
+	if len(b.ops) == 0 {
+		return opErrs, nil
+	}
+	err := Transact(db, func(tx *gorm.DB) error {
+		if b.guard != nil {
+			if err := b.guard(tx); err != nil {
+				return err
+			}
+		}
+		for i, op := range b.ops {
+			opErrs[i] = tx.Transaction(func(sp *gorm.DB) error { return op(sp) })
+		}
+		return nil
+	})
+	dbMetrics.batches.Add(1)
+	dbMetrics.batchedWrites.Add(uint64(len(b.ops)))
+	b.ops, b.guard = nil, nil
+	return opErrs, err
+}
+
+// Transact runs fn in a transaction and records how long the write lock was
+// held. Use it instead of db.Transaction for writes that should show up in
+// the contention metrics.
+func Transact(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	start := time.Now()
+	err := db.Transaction(fn)
+	dbMetrics.recordTransaction(time.Since(start), err)
+	return err
+}
+
+// DBStats describes database activity and contention since startup.
+type DBStats struct {
+	JournalMode        string  `json:"journal_mode"`
+	Transactions       uint64  `json:"transactions"`
+	FailedTransactions uint64  `json:"failed_transactions"`
+	AvgTransactionMs   float64 `json:"avg_transaction_ms"`
+	MaxTransactionMs   float64 `json:"max_transaction_ms"`
+	Batches            uint64  `json:"batches"`
+	BatchedWrites      uint64  `json:"batched_writes"`
+	LockErrors         uint64  `json:"lock_errors"` // Statements that failed with "database is locked" or "busy"
+	OpenConnections    int     `json:"open_connections"`
+	InUseConnections   int     `json:"in_use_connections"`
+	ConnectionWaits    int64   `json:"connection_waits"` // Times a query waited for a free connection
+	ConnectionWaitMs   float64 `json:"connection_wait_ms"`
+}
+
+type dbMetricsState struct {
+	transactions       atomic.Uint64
+	failedTransactions atomic.Uint64
+	batches            atomic.Uint64
+	batchedWrites      atomic.Uint64
+	lockErrors         atomic.Uint64
+
+	mu      sync.Mutex
+	totalTx time.Duration
+	maxTx   time.Duration
+}
+
+var dbMetrics dbMetricsState
+
+func (m *dbMetricsState) recordTransaction(d time.Duration, err error) {
+	m.transactions.Add(1)
+	if err != nil {
+		m.failedTransactions.Add(1)
+	}
+	m.mu.Lock()
+	m.totalTx += d
+	if d > m.maxTx {
+		m.maxTx = d
+	}
+	m.mu.Unlock()
+}
+
+// isLockError reports whether err is SQLite refusing a statement because
+// another connection holds the lock.
+func isLockError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// registerLockErrorCounter counts lock errors on every statement, not only
+// those in transactions started through Transact.
+func registerLockErrorCounter(db *gorm.DB) error {
+	count := func(tx *gorm.DB) {
+		if isLockError(tx.Error) {
+			dbMetrics.lockErrors.Add(1)
+		}
+	}
+	cb := db.Callback()
+	if err := cb.Create().After("gorm:create").Register("virtumancer:lock_errors", count); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("virtumancer:lock_errors", count); err != nil {
+		return err
+	}
+	if err := cb.Delete().After("gorm:delete").Register("virtumancer:lock_errors", count); err != nil {
+		return err
+	}
+	if err := cb.Query().After("gorm:query").Register("virtumancer:lock_errors", count); err != nil {
+		return err
+	}
+	return cb.Raw().After("gorm:raw").Register("virtumancer:lock_errors", count)
+}
+
+// GetDBStats returns the current database activity and contention figures.
+func GetDBStats(db *gorm.DB) DBStats {
+	stats := DBStats{
+		Transactions:       dbMetrics.transactions.Load(),
+		FailedTransactions: dbMetrics.failedTransactions.Load(),
+		Batches:            dbMetrics.batches.Load(),
+		BatchedWrites:      dbMetrics.batchedWrites.Load(),
+		LockErrors:         dbMetrics.lockErrors.Load(),
+	}
+	dbMetrics.mu.Lock()
+	if stats.Transactions > 0 {
+		stats.AvgTransactionMs = float64(dbMetrics.totalTx.Microseconds()) / float64(stats.Transactions) / 1000
+	}
+	stats.MaxTransactionMs = float64(dbMetrics.maxTx.Microseconds()) / 1000
+	dbMetrics.mu.Unlock()
+
+	db.Raw("PRAGMA journal_mode").Scan(&stats.JournalMode)
+	if sqlDB, err := db.DB(); err == nil {
+		pool := sqlDB.Stats()
+		stats.OpenConnections = pool.OpenConnections
+		stats.InUseConnections = pool.InUse
+		stats.ConnectionWaits = pool.WaitCount
+		stats.ConnectionWaitMs = float64(pool.WaitDuration.Microseconds()) / 1000
+	}
+	return stats
+}
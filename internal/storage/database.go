@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -17,12 +21,181 @@ const (
 	StateError       VMState = "ERROR"       // VM is in an unrecoverable error state.
 )
 
+// HealthStatus is the at-a-glance condition of a VM or host.
+type HealthStatus string
+
+const (
+	HealthGreen  HealthStatus = "green"  // Nothing needs attention.
+	HealthYellow HealthStatus = "yellow" // Something should be looked at.
+	HealthRed    HealthStatus = "red"    // Something is broken.
+)
+
+// HealthReason is a failed health check and the status it calls for.
+type HealthReason struct {
+	Check   string       `json:"check"` // e.g. 'state', 'guest-agent', 'stats', 'disk-full', 'block-job'
+	Status  HealthStatus `json:"status"`
+	Message string       `json:"message"`
+}
+
 // --- Core Entities ---
 
+// Project groups hosts, VMs, networks and volumes for a team. Users only see
+// the resources of the projects they are members of.
+type Project struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex" json:"name"`
+	Description string    `json:"description"`
+}
+
+// ProjectMember gives a user a role in a project: 'viewer', 'operator' or
+// 'admin'.
+type ProjectMember struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ProjectID uint      `gorm:"uniqueIndex:idx_project_member" json:"project_id"`
+	UserID    uint      `gorm:"uniqueIndex:idx_project_member;index" json:"user_id"`
+	Role      string    `json:"role"`
+}
+
+// ProjectResource assigns a resource to a project. VMs are identified by
+// their UUID alone so the assignment follows them between hosts; networks
+// by name and volumes by 'pool/volume' on their host; hosts by their ID with
+// an empty key. Resources without an assignment belong to their host's
+// project.
+type ProjectResource struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ProjectID uint      `gorm:"index" json:"project_id"`
+	Kind      string    `gorm:"uniqueIndex:idx_project_resource" json:"kind"` // 'host', 'vm', 'network' or 'volume'
+	HostID    string    `gorm:"uniqueIndex:idx_project_resource" json:"host_id"`
+	Key       string    `gorm:"uniqueIndex:idx_project_resource" json:"key"`
+}
+
 // Host represents a libvirt host connection configuration.
 type Host struct {
-	ID  string `gorm:"primaryKey" json:"id"`
-	URI string `json:"uri"`
+	ID              string `gorm:"primaryKey" json:"id"`    // Generated UUID; never changes.
+	Name            string `gorm:"uniqueIndex" json:"name"` // Display name, can be changed. Also accepted in place of the ID in API paths.
+	URI             string `gorm:"uniqueIndex" json:"uri"`
+	Driver          string `json:"driver"`           // Hypervisor driver from the URI scheme, e.g. 'qemu', 'lxc', 'xen', 'test'.
+	ProxyJump       string `json:"proxy_jump"`       // Optional SSH bastion chain, e.g. 'admin@bastion:2222,jump2'.
+	MaintenanceMode bool   `json:"maintenance_mode"` // Blocks disruptive host-level operations unless set.
+	AgentTokenHash  string `json:"-"`                // SHA-256 of the reverse-tunnel agent token, for agent transport hosts.
+	// Stats polling interval for the host's VMs in seconds; 0 uses the global setting.
+	StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	// Maximum number of concurrent libvirt operations against the host; 0 uses the default.
+	MaxConcurrentRPCs int `json:"max_concurrent_rpcs"`
+	// CPUs and memory kept back for the hypervisor OS; capacity and placement
+	// calculations only offer the rest to VMs.
+	ReservedCPUs        uint   `json:"reserved_cpus"`
+	ReservedMemoryBytes uint64 `json:"reserved_memory_bytes"`
+	// Restart the VMs that were running, in startup priority order, when the
+	// host reconnects after an outage.
+	StartupOrdering       bool `json:"startup_ordering"`
+	StartupStaggerSeconds uint `json:"startup_stagger_seconds"` // Default wait between two starts.
+	// Worst status of the host's health checks, the checks that failed and
+	// when either last changed, as evaluated by the health monitor.
+	Health          HealthStatus   `gorm:"type:varchar(10);default:'green'" json:"health"`
+	HealthReasons   []HealthReason `gorm:"serializer:json" json:"health_reasons"`
+	HealthChangedAt *time.Time     `json:"health_changed_at"`
+	// AgentToken is only populated in the response that creates an agent host.
+	AgentToken string `gorm:"-" json:"agent_token,omitempty"`
+	// Generation counts the changes to the row, starting at 1.
+	Generation uint64 `gorm:"not null;default:1" json:"generation"`
+}
+
+// BalloonPolicy lets Virtumancer move memory between the running VMs of a
+// host through their balloon drivers, keeping the host's free memory between
+// two watermarks.
+type BalloonPolicy struct {
+	HostID    string    `gorm:"primaryKey" json:"host_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Enabled   bool      `json:"enabled"`
+	// Memory is reclaimed from guests while the host has less than
+	// LowFreePercent available, and given back above HighFreePercent.
+	LowFreePercent  float64 `json:"low_free_percent"`
+	HighFreePercent float64 `json:"high_free_percent"`
+	// Share of its maximum memory a VM keeps at least, unless it sets its own
+	// guarantee.
+	MinGuaranteePercent float64 `json:"min_guarantee_percent"`
+}
+
+// DiskCompactionPolicy lets Virtumancer compact the disk images of a host's
+// shut-off VMs on a schedule, to give back the space guests have freed.
+type DiskCompactionPolicy struct {
+	HostID    string    `gorm:"primaryKey" json:"host_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Enabled   bool      `json:"enabled"`
+	// 'convert' rewrites images with qemu-img, 'sparsify' runs virt-sparsify.
+	Method        string     `json:"method"`
+	Compress      bool       `json:"compress"`       // Compress qcow2 images when converting them.
+	IntervalHours uint       `json:"interval_hours"` // Time between two runs.
+	LastRunAt     *time.Time `json:"last_run_at"`
+}
+
+// FstrimPolicy lets Virtumancer trim the filesystems of a host's running VMs
+// through their guest agents on a schedule, so that thin-provisioned images
+// give back the blocks the guests have freed.
+type FstrimPolicy struct {
+	HostID        string     `gorm:"primaryKey" json:"host_id"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Enabled       bool       `json:"enabled"`
+	IntervalHours uint       `json:"interval_hours"` // Time between two runs.
+	MinimumBytes  uint64     `json:"minimum_bytes"`  // Free ranges smaller than this are not trimmed.
+	LastRunAt     *time.Time `json:"last_run_at"`
+}
+
+// HostFencing decides when a disconnected host counts as dead, so that the
+// VMs on its shared storage can be recovered on other hosts. A host without
+// a row is never declared dead.
+type HostFencing struct {
+	HostID    string    `gorm:"primaryKey" json:"host_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Enabled   bool      `json:"enabled"`
+	// How a disconnected host is checked: 'ssh' dials its SSH port, 'ipmi'
+	// asks its BMC for the chassis power state.
+	Method           string `json:"method"`
+	DeadAfterMinutes uint   `json:"dead_after_minutes"` // How long the check must fail before the host is declared dead.
+	IPMIAddress      string `json:"ipmi_address"`
+	IPMIUsername     string `json:"ipmi_username"`
+	IPMIPassword     string `json:"-"`
+	// UnreachableSince is when the check first failed; nil while the host is
+	// connected or the check passes.
+	UnreachableSince *time.Time `json:"unreachable_since"`
+	DeadAt           *time.Time `json:"dead_at"`   // When the host was declared dead.
+	FencedAt         *time.Time `json:"fenced_at"` // When an operator confirmed the host is off, allowing recovery.
+}
+
+// HostInfo caches the hardware and software details last read from a host,
+// so they can be shown while it is disconnected.
+type HostInfo struct {
+	HostID            string         `gorm:"primaryKey" json:"host_id"`
+	UpdatedAt         time.Time      `json:"updated_at"` // When the details were last read from the host.
+	Hostname          string         `json:"hostname"`
+	CPUs              uint           `gorm:"column:cpus" json:"cpus"`
+	Sockets           uint           `json:"sockets"`
+	Cores             uint           `json:"cores"`   // Per socket.
+	Threads           uint           `json:"threads"` // Per core.
+	CPUMHz            uint           `gorm:"column:cpu_mhz" json:"cpu_mhz"`
+	CPUArch           string         `json:"cpu_arch"`
+	CPUModel          string         `json:"cpu_model"`
+	CPUVendor         string         `json:"cpu_vendor"`
+	MemoryBytes       uint64         `json:"memory_bytes"`
+	FreeMemoryBytes   uint64         `json:"free_memory_bytes"`
+	NUMACells         []HostNUMACell `gorm:"column:numa_cells;serializer:json" json:"numa_cells"`
+	Hypervisor        string         `json:"hypervisor"`
+	HypervisorVersion string         `json:"hypervisor_version"`
+	LibvirtVersion    string         `json:"libvirt_version"`
+	Kernel            string         `json:"kernel"`
+}
+
+// HostNUMACell is one NUMA node of a host.
+type HostNUMACell struct {
+	ID              uint   `json:"id"`
+	MemoryBytes     uint64 `json:"memory_bytes"`
+	FreeMemoryBytes uint64 `json:"free_memory_bytes"`
+	CPUs            []uint `json:"cpus"`
 }
 
 // VirtualMachine is Virtumancer's canonical definition of a VM's intended state.
@@ -38,8 +211,273 @@ type VirtualMachine struct {
 	CPUModel        string
 	CPUTopologyJSON string
 	MemoryBytes     uint64
-	OSType          string
+	OSType          string // OS family: linux, windows, bsd, macos or other; empty when unknown
+	OSVariant       string // e.g. ubuntu22.04 or win10
+	OSName          string // Human-readable name reported by the guest agent
+	OSSource        string // Where the OS info came from: guest-agent or domain-xml
 	IsTemplate      bool
+	StartedAt       *time.Time // When the VM was first seen running; nil while it is not running.
+	// Stats polling interval in seconds; 0 uses the host's or the global setting.
+	StatsIntervalSeconds float64
+	// Startup after a host outage: VMs are started in ascending priority;
+	// 0 leaves the VM alone.
+	StartupPriority     uint
+	StartupDelaySeconds uint // Wait after starting the VM before the next start; 0 uses the host's stagger.
+	// Relative CPU and block I/O weights against the host's other VMs, as
+	// set in the domain definition; 0 is the hypervisor's default.
+	CPUShares   uint64
+	BlkioWeight uint
+	// Memory the balloon policy never takes from the VM; 0 uses the policy's
+	// guarantee.
+	BalloonMinBytes uint64
+	// Memory the balloon policy has taken from the running VM and may give
+	// back; reset when the VM stops.
+	BalloonReclaimedBytes uint64
+	// What evacuating its host does with the VM while it runs: migrate,
+	// shutdown or migrate-or-shutdown; empty means migrate.
+	EvacuationPolicy       string
+	EvacuationTargetHostID string // Host to migrate to on evacuation; empty picks one.
+	// Usage of the filesystems mounted in the guest, last reported by its
+	// guest agent, and when.
+	GuestFilesystems   []GuestFilesystem `gorm:"serializer:json"`
+	GuestFilesystemsAt *time.Time
+	// State of the guest agent of the running VM at the last sync:
+	// 'connected', 'disconnected', or empty without an agent channel.
+	GuestAgent string
+	// Worst status of the VM's health checks, the checks that failed and
+	// when either last changed, as evaluated by the health monitor.
+	Health          HealthStatus   `gorm:"type:varchar(10);default:'green'"`
+	HealthReasons   []HealthReason `gorm:"serializer:json"`
+	HealthChangedAt *time.Time
+	// Hash of the hardware last synced, so that hardware changes count as
+	// changes of the VM.
+	HardwareFingerprint string
+	// Generation counts the changes to the row, starting at 1.
+	Generation uint64 `gorm:"not null;default:1"`
+
+	// Deleted with its host.
+	Host *Host `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// GuestFilesystem is a filesystem mounted inside a guest, as reported by its
+// guest agent.
+type GuestFilesystem struct {
+	Mountpoint  string   `json:"mountpoint"`
+	Name        string   `json:"name"` // Device in the guest, e.g. 'sda1'
+	Type        string   `json:"type"`
+	TotalBytes  uint64   `json:"total_bytes"`
+	UsedBytes   uint64   `json:"used_bytes"`
+	UsedPercent float64  `json:"used_percent"`
+	Disks       []string `json:"disks"` // Targets of the VM's disks it lives on, e.g. 'vda'
+}
+
+// VMCustomField is a user-defined key/value pair attached to a VM, such as an
+// owner or a cost center.
+type VMCustomField struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+	VMID      uint      `gorm:"uniqueIndex:idx_vm_custom_field" json:"-"`
+	Name      string    `gorm:"uniqueIndex:idx_vm_custom_field" json:"name"`
+	Value     string    `json:"value"`
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMLabel is a Kubernetes-style label on a VM, used to select groups of VMs.
+type VMLabel struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+	VMID      uint      `gorm:"uniqueIndex:idx_vm_label" json:"-"`
+	Key       string    `gorm:"uniqueIndex:idx_vm_label;index:idx_label_key_value" json:"key"`
+	Value     string    `gorm:"index:idx_label_key_value" json:"value"`
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMGraphicsPassword records that a VM's VNC and SPICE displays are
+// password protected. Only a hash of the password is kept; the password
+// itself lives in the domain definition on the host.
+type VMGraphicsPassword struct {
+	ID           uint       `gorm:"primarykey" json:"-"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	VMID         uint       `gorm:"uniqueIndex" json:"-"`
+	PasswordHash string     `json:"-"`
+	ExpiresAt    *time.Time `json:"expires_at"` // nil when the password does not expire
+	Revoked      bool       `json:"revoked"`    // Replaced by an unknown, already expired password
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMMachineTypeChange records a change of a VM's machine type with the
+// definition it replaced, so that it can be rolled back.
+type VMMachineTypeChange struct {
+	ID           uint       `gorm:"primarykey" json:"id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	VMID         uint       `gorm:"index" json:"-"`
+	FromMachine  string     `json:"from_machine"`
+	ToMachine    string     `json:"to_machine"`
+	Changes      []string   `gorm:"serializer:json" json:"changes"` // Adjustments made to the definition
+	PreviousXML  string     `json:"-"`
+	RolledBackAt *time.Time `json:"rolled_back_at"`
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMRecoveryDefinition is the inactive domain XML last read from a VM's
+// host, kept for defining the VM on another host if its host dies.
+type VMRecoveryDefinition struct {
+	VMID      uint `gorm:"primaryKey"`
+	UpdatedAt time.Time
+	XML       string
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMDefinition is one version of a VM's inactive domain XML, archived when a
+// sync finds the definition changed and before each edit made through
+// Virtumancer. Secrets such as display passwords are not part of it.
+type VMDefinition struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	VMID      uint      `gorm:"uniqueIndex:idx_vm_definition_version" json:"-"`
+	Version   uint      `gorm:"uniqueIndex:idx_vm_definition_version" json:"version"` // Counts up from 1 per VM
+	Source    string    `json:"source"`                                               // 'sync', 'edit' or 'restore'
+	Reason    string    `json:"reason,omitempty"`
+	SHA256    string    `json:"sha256"`
+	XML       string    `json:"xml,omitempty"`
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// VMRecovery records a VM defined on another host after its host died.
+type VMRecovery struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	VMName     string    `json:"vm_name"`
+	DomainUUID string    `json:"domain_uuid"`
+	FromHostID string    `gorm:"index" json:"from_host_id"`
+	ToHostID   string    `json:"to_host_id"`
+	TaskID     uint      `json:"task_id"`
+	// When the stale definition was removed from the old host after it came
+	// back; nil until then.
+	CleanedUpAt *time.Time `json:"cleaned_up_at"`
+}
+
+// PlacementRule keeps a group of VMs on the same host (affinity) or on
+// different hosts (anti-affinity).
+type PlacementRule struct {
+	gorm.Model
+	Name    string   `gorm:"uniqueIndex" json:"name"`
+	Type    string   `json:"type"`                            // 'affinity' or 'anti-affinity'.
+	VMUUIDs []string `gorm:"serializer:json" json:"vm_uuids"` // Virtumancer UUIDs of the member VMs.
+	Enabled bool     `json:"enabled"`
+}
+
+// VMDependency records that a VM needs another VM before it can start, e.g.
+// an application server and its database. Orchestrated starts bring the
+// dependency up first and wait until it is ready; orchestrated stops go the
+// other way round.
+type VMDependency struct {
+	gorm.Model
+	VMUUID         string `gorm:"index" json:"vm_uuid"`         // The dependent VM.
+	DependsOnUUID  string `gorm:"index" json:"depends_on_uuid"` // The VM it needs.
+	WaitFor        string `json:"wait_for"`                     // 'running', 'agent' or 'tcp': when the dependency counts as ready.
+	TCPAddress     string `json:"tcp_address,omitempty"`        // host:port that must accept connections for 'tcp'.
+	TimeoutSeconds uint   `json:"timeout_seconds"`              // How long to wait for the dependency to become ready.
+}
+
+// VMGroup treats VMs that make up one application, e.g. a web server and
+// its database, as a unit: they are started and stopped in order, and
+// snapshotted together.
+type VMGroup struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex" json:"name"`
+	Description string    `json:"description"`
+	// Settings shared by the members.
+	StartDelaySeconds  uint   `json:"start_delay_seconds"`  // Wait after starting each tier before the next one.
+	StopTimeoutSeconds uint   `json:"stop_timeout_seconds"` // How long a stop waits for each tier to shut down; 0 means 300.
+	SnapshotMemory     string `json:"snapshot_memory"`      // Memory mode of group snapshots: 'internal' or 'external'.
+}
+
+// VMGroupMember puts a VM in a group. Members start in ascending start
+// order and stop in descending start order; members with the same start
+// order form a tier.
+type VMGroupMember struct {
+	ID         uint `gorm:"primarykey" json:"-"`
+	GroupID    uint `gorm:"uniqueIndex:idx_group_vm" json:"-"`
+	VMID       uint `gorm:"uniqueIndex:idx_group_vm;index" json:"-"`
+	StartOrder uint `json:"start_order"`
+
+	// Deleted with its group or its VM.
+	Group *VMGroup        `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	VM    *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// Runbook is a named sequence of actions, e.g. snapshot, shut down and
+// start, that runs as one task. Its steps are run in order and refer to the
+// runbook's parameters as ${name}.
+type Runbook struct {
+	ID          uint               `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time          `json:"created_at"`
+	UpdatedAt   time.Time          `json:"updated_at"`
+	Name        string             `gorm:"uniqueIndex" json:"name"`
+	Description string             `json:"description"`
+	Parameters  []RunbookParameter `gorm:"serializer:json" json:"parameters"`
+	Steps       []RunbookStep      `gorm:"serializer:json" json:"steps"`
+}
+
+// RunbookParameter is a value supplied when a runbook is run.
+type RunbookParameter struct {
+	Name     string `json:"name"`
+	Default  string `json:"default,omitempty"`
+	Required bool   `json:"required,omitempty"` // Must be supplied; the default is not used.
+}
+
+// RunbookStep is one action of a runbook.
+type RunbookStep struct {
+	Name   string            `json:"name"`   // Unique in the runbook; conditions of later steps refer to it.
+	Action string            `json:"action"` // e.g. 'vm.snapshot', 'vm.shutdown', 'notify'.
+	Params map[string]string `json:"params,omitempty"`
+	// Condition the step runs under, e.g. 'vm.state == running'; empty to
+	// always run.
+	If              string `json:"if,omitempty"`
+	ContinueOnError bool   `json:"continue_on_error,omitempty"` // Go on with the next step if this one fails.
+}
+
+// RunbookRun is one run of a runbook, with the outcome of every step.
+type RunbookRun struct {
+	ID          uint              `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	RunbookID   uint              `gorm:"index" json:"runbook_id"`
+	Runbook     *Runbook          `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	RunbookName string            `json:"runbook_name"`
+	UserID      uint              `json:"user_id"` // 0 when run without logging in.
+	TaskID      uint              `json:"task_id"`
+	Status      TaskStatus        `json:"status"`
+	Parameters  map[string]string `gorm:"serializer:json" json:"parameters"`
+	Steps       []RunbookStepRun  `gorm:"serializer:json" json:"steps"`
+	FinishedAt  *time.Time        `json:"finished_at"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// RunbookStepRun is the outcome of a step of a runbook run.
+type RunbookStepRun struct {
+	Name       string     `json:"name"`
+	Action     string     `json:"action"`
+	Status     string     `json:"status"` // 'pending', 'running', 'completed', 'failed' or 'skipped'.
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	Error      string     `json:"error,omitempty"`
 }
 
 // --- Storage Management ---
@@ -47,13 +485,55 @@ type VirtualMachine struct {
 // StoragePool represents a libvirt storage pool (e.g., LVM, a directory).
 type StoragePool struct {
 	gorm.Model
-	HostID          string
-	Name            string
-	UUID            string `gorm:"uniqueIndex"`
-	Type            string
-	Path            string
-	CapacityBytes   uint64
-	AllocationBytes uint64
+	HostID          string `json:"host_id"`
+	Name            string `json:"name"`
+	UUID            string `gorm:"uniqueIndex" json:"uuid"`
+	Type            string `json:"type"`
+	Path            string `json:"path"`
+	Active          bool   `json:"active"`
+	Autostart       bool   `json:"autostart"` // Started with libvirtd; VMs with disks here fail to boot otherwise
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+	AvailableBytes  uint64 `json:"available_bytes"`
+	// Usage alert thresholds in percent of capacity; 0 selects the defaults.
+	WarningPercent  float64 `json:"warning_percent"`
+	CriticalPercent float64 `json:"critical_percent"`
+	// Thin provisioning metrics.
+	Backend                string           `json:"backend"`                  // Pool type, or 'lvm-thin' / 'zfs-dataset' when detected.
+	VirtualAllocationBytes uint64           `json:"virtual_allocation_bytes"` // Sum of volume capacities.
+	Overcommitted          bool             `json:"overcommitted"`            // Volumes can grow beyond the physical space.
+	ThinPools              []ThinPoolUsage  `gorm:"serializer:json" json:"thin_pools"`
+	Dataset                *ZFSDatasetUsage `gorm:"serializer:json" json:"dataset"`
+
+	// Deleted with its host.
+	Host *Host `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+}
+
+// ThinPoolUsage is the usage of an LVM thin pool inside a volume group pool.
+type ThinPoolUsage struct {
+	Name          string `json:"name"`
+	SizeBytes     uint64 `json:"size_bytes"`
+	DataUsedBytes uint64 `json:"data_used_bytes"`
+	VirtualBytes  uint64 `json:"virtual_bytes"`
+}
+
+// ZFSDatasetUsage is the space accounting of the ZFS dataset under a directory pool.
+type ZFSDatasetUsage struct {
+	Name             string  `json:"name"`
+	UsedBytes        uint64  `json:"used_bytes"`
+	AvailableBytes   uint64  `json:"available_bytes"`
+	LogicalUsedBytes uint64  `json:"logical_used_bytes"`
+	CompressRatio    float64 `json:"compress_ratio"`
+}
+
+// StoragePoolUsageSample is a point-in-time record of a pool's allocation.
+type StoragePoolUsageSample struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	StoragePoolID   uint      `gorm:"index" json:"storage_pool_id"`
+	CapacityBytes   uint64    `json:"capacity_bytes"`
+	AllocationBytes uint64    `json:"allocation_bytes"`
+	AvailableBytes  uint64    `json:"available_bytes"`
+	CreatedAt       time.Time `gorm:"index" json:"created_at"`
 }
 
 // Volume represents a single storage volume, like a virtual disk or an ISO.
@@ -65,6 +545,48 @@ type Volume struct {
 	Format          string
 	CapacityBytes   uint64
 	AllocationBytes uint64
+	// Set for images uploaded through the API or downloaded from the image
+	// catalog: the SHA256 of the written bytes, and whether they matched the
+	// expected checksum ('verified' or 'mismatch'; empty when none was given).
+	SHA256         string
+	ChecksumStatus string
+	Generation     uint64 `gorm:"not null;default:1"` // Counts the changes to the row, starting at 1.
+}
+
+// CatalogImage is a cloud image that can be downloaded onto a host's pool
+// from its publisher.
+type CatalogImage struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex" json:"name"` // e.g. 'ubuntu-24.04'
+	Description string    `json:"description"`
+	URL         string    `json:"url"`
+	// Where the image's checksum comes from: a fixed SHA256 or SHA512 in hex,
+	// or else a checksum file such as SHA256SUMS that lists the image.
+	Checksum    string `json:"checksum"`
+	ChecksumURL string `json:"checksum_url"`
+}
+
+// HardwarePreset is a named set of hardware for new VMs, e.g. 'linux-server'.
+// Empty fields fall back to the defaults of the guest profile.
+type HardwarePreset struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex" json:"name"`
+	Description string    `json:"description"`
+	Profile     string    `json:"profile"` // 'linux' or 'windows'.
+	VCPUs       uint      `json:"vcpus"`
+	MemoryBytes uint64    `json:"memory_bytes"`
+	Firmware    string    `json:"firmware"` // 'bios' or 'efi'.
+	SecureBoot  *bool     `json:"secure_boot"`
+	TPM         *bool     `json:"tpm"`
+	DiskBus     string    `json:"disk_bus"`     // 'virtio' or 'sata'.
+	DiskDiscard string    `json:"disk_discard"` // 'unmap' or 'ignore'.
+	NICModel    string    `json:"nic_model"`    // e.g. 'virtio', 'e1000'.
+	CPUShares   *uint64   `json:"cpu_shares"`
+	BlkioWeight *uint     `json:"blkio_weight"`
 }
 
 // VolumeAttachment links a Volume to a VirtualMachine.
@@ -72,10 +594,14 @@ type VolumeAttachment struct {
 	gorm.Model
 	VMID       uint
 	VolumeID   uint
-	Volume     Volume
+	Volume     Volume `gorm:"constraint:OnDelete:CASCADE"`
 	DeviceName string // e.g., "vda", "hdb"
 	BusType    string // e.g., "virtio", "sata", "ide"
 	IsReadOnly bool
+	Discard    string // "unmap", "ignore", or empty for the hypervisor's default
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // --- Network Management ---
@@ -83,11 +609,22 @@ type VolumeAttachment struct {
 // Network represents a virtual network or bridge on a host.
 type Network struct {
 	gorm.Model
-	HostID     string `gorm:"uniqueIndex:idx_network_host_name"`
-	Name       string `gorm:"uniqueIndex:idx_network_host_name"`
-	UUID       string
-	BridgeName string
-	Mode       string // e.g., 'bridged', 'nat', 'isolated'
+	HostID          string `gorm:"uniqueIndex:idx_network_host_name" json:"host_id"`
+	Name            string `gorm:"uniqueIndex:idx_network_host_name" json:"name"`
+	UUID            string `json:"uuid"`
+	BridgeName      string `json:"bridge_name"`
+	Mode            string `json:"mode"`             // e.g., 'bridged', 'nat', 'isolated'
+	VirtualPortType string `json:"virtualport_type"` // 'openvswitch' for OVS bridges, empty for Linux bridges
+	VLANID          uint   `json:"vlan_id"`          // Access VLAN of NICs on this network, 0 for untagged
+	// State of the libvirt network of the same name, read live when listing.
+	LibvirtNetwork bool `gorm:"-" json:"libvirt_network"`
+	Active         bool `gorm:"-" json:"active"`
+	Autostart      bool `gorm:"-" json:"autostart"`
+	// Generation counts the changes to the row, starting at 1.
+	Generation uint64 `gorm:"not null;default:1" json:"generation"`
+
+	// Deleted with its host.
+	Host *Host `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // Port represents a virtual Network Interface Card (vNIC) belonging to a VM.
@@ -98,15 +635,45 @@ type Port struct {
 	DeviceName string // e.g. "vnet0", "eth0"
 	ModelName  string // e.g., 'virtio', 'e1000'
 	IPAddress  string
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // PortBinding links a Port to a Network.
 type PortBinding struct {
 	gorm.Model
 	PortID    uint
-	Port      Port
+	Port      Port `gorm:"constraint:OnDelete:CASCADE"`
 	NetworkID uint
-	Network   Network
+	Network   Network `gorm:"constraint:OnDelete:CASCADE"`
+	VLANID    uint    // VLAN the NIC is tagged with, 0 for untagged
+}
+
+// MACAddressPool is the address range generated NIC MACs are drawn from.
+// There is a single row; without it the QEMU/KVM OUI is used.
+type MACAddressPool struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Prefix    string    `json:"prefix"` // Leading octets of generated MACs, e.g. '52:54:00'.
+}
+
+// MACConflict records a VM NIC whose MAC address already belongs to another
+// VM. The NIC is left out of the database until the conflict is resolved.
+type MACConflict struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"detected_at"`
+	MACAddress  string    `gorm:"index" json:"mac_address"`
+	VMID        uint      `gorm:"index" json:"vm_id"` // The VM whose NIC was rejected.
+	HostID      string    `json:"host_id"`
+	VMName      string    `json:"vm_name"`
+	OwnerVMID   uint      `json:"owner_vm_id"` // The VM that already owns the address.
+	OwnerHostID string    `json:"owner_host_id"`
+	OwnerVMName string    `json:"owner_vm_name"`
+
+	// Deleted with either VM.
+	VM      *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	OwnerVM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // --- Virtual Hardware Management ---
@@ -141,19 +708,30 @@ type InputDeviceAttachment struct {
 }
 
 // GraphicsDevice represents a virtual GPU and display protocol configuration.
+// Every device belongs to one VM, which has at most one per protocol. Rows
+// are deleted for good, not soft-deleted, to keep the index unique.
 type GraphicsDevice struct {
 	gorm.Model
-	Type          string // 'vnc', 'spice'
+	VMID          uint   `gorm:"uniqueIndex:idx_graphics_device_vm_type"`
+	Type          string `gorm:"uniqueIndex:idx_graphics_device_vm_type"` // 'vnc', 'spice'
 	ModelName     string // 'qxl', 'vga', 'virtio'
 	VRAMKiB       uint
 	ListenAddress string
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
-// GraphicsDeviceAttachment links a GraphicsDevice to a VirtualMachine.
+// GraphicsDeviceAttachment links a GraphicsDevice to its VirtualMachine. A VM
+// has a single attachment, deleted for good when it is replaced.
 type GraphicsDeviceAttachment struct {
 	gorm.Model
-	VMID             uint
+	VMID             uint `gorm:"uniqueIndex"`
 	GraphicsDeviceID uint
+
+	// Deleted with its VM or device.
+	VM             *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	GraphicsDevice *GraphicsDevice `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // SoundCard represents a virtual sound device.
@@ -379,15 +957,73 @@ type VMSnapshot struct {
 	Description string
 	ParentName  string
 	State       string
+	Memory      string // Where the VM's memory was saved: 'internal', 'external' or 'no'
 	ConfigXML   string
+
+	// Deleted with its VM.
+	VM *VirtualMachine `gorm:"constraint:OnDelete:CASCADE" json:"-"`
 }
 
 // User represents a Virtumancer user account.
 type User struct {
 	gorm.Model
-	Username     string `gorm:"uniqueIndex"`
-	PasswordHash string
-	RoleID       uint
+	Username           string `gorm:"uniqueIndex"`
+	Email              string // Optional; used for invites and password resets.
+	PasswordHash       string // bcrypt hash.
+	RoleID             uint
+	PasswordChangedAt  *time.Time
+	Disabled           bool       // Disabled users cannot log in.
+	MustChangePassword bool       // Set when an admin resets the password.
+	LockedUntil        *time.Time // Logins are refused until then.
+	LastLoginAt        *time.Time
+	FailedLogins       uint // Failed logins since the last success or lockout.
+}
+
+// UserSession is a login of a user. Clients present its token as a bearer
+// token or session cookie; only the token's hash is stored.
+type UserSession struct {
+	gorm.Model
+	UserID     uint      `gorm:"index" json:"-"`
+	TokenHash  string    `gorm:"uniqueIndex" json:"-"` // SHA-256 of the session token.
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"` // Pushed back while the session is in use.
+}
+
+// LoginAttempt records a login, successful or not.
+type LoginAttempt struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	Username  string    `gorm:"index" json:"username"` // As entered, even if no such user exists.
+	UserID    uint      `json:"user_id"`               // 0 for unknown usernames.
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"` // Why it failed: 'invalid_credentials', 'disabled' or 'locked'.
+	IPAddress string    `gorm:"index" json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// SecuritySettings is the single row of the account lockout policy.
+type SecuritySettings struct {
+	ID               uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt        time.Time `json:"updated_at"`
+	LockoutThreshold uint      `json:"lockout_threshold"` // Failed logins in a row that lock an account; 0 never locks.
+	LockoutMinutes   uint      `json:"lockout_minutes"`   // How long a lockout lasts.
+}
+
+// IdempotencyKey remembers the response to a request sent with an
+// Idempotency-Key header, so that a retry gets the same response instead of
+// running the action again.
+type IdempotencyKey struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UserID      uint   `gorm:"uniqueIndex:idx_idempotency_keys_user_key"` // 0 for requests without a session.
+	Key         string `gorm:"uniqueIndex:idx_idempotency_keys_user_key"`
+	RequestHash string // SHA-256 of the user, method, path and body.
+	StatusCode  int    // 0 while the request is being handled.
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time `gorm:"index"`
 }
 
 // Role defines a set of permissions.
@@ -404,14 +1040,315 @@ type Permission struct {
 	Description string
 }
 
+// TaskStatus defines the lifecycle states of a Task.
+type TaskStatus string
+
+const (
+	TaskPending   TaskStatus = "PENDING"
+	TaskRunning   TaskStatus = "RUNNING"
+	TaskCompleted TaskStatus = "COMPLETED"
+	TaskFailed    TaskStatus = "FAILED"
+	// TaskInterrupted marks a task that was running when the server stopped.
+	TaskInterrupted TaskStatus = "INTERRUPTED"
+)
+
 // Task tracks a long-running, asynchronous operation.
 type Task struct {
 	gorm.Model
-	UserID   uint
-	Type     string
-	Status   string
-	Progress int
-	Details  string
+	UserID   uint       `json:"user_id"`
+	Type     string     `json:"type"`
+	Status   TaskStatus `json:"status"`
+	Progress int        `json:"progress"` // 0-100
+	Details  string     `json:"details"`  // Human readable step log, one line per step.
+	Error    string     `json:"error,omitempty"`
+	// Latest measurements of a task that reports them while it runs, e.g.
+	// the data remaining of a live migration.
+	Metrics map[string]interface{} `gorm:"serializer:json" json:"metrics,omitempty"`
+}
+
+// AlertSeverity defines how urgent an Alert is.
+type AlertSeverity string
+
+const (
+	AlertWarning  AlertSeverity = "WARNING"
+	AlertCritical AlertSeverity = "CRITICAL"
+)
+
+// Alert is raised when a monitored resource crosses a threshold and stays
+// open until the condition clears.
+type Alert struct {
+	gorm.Model
+	HostID     string        `gorm:"index" json:"host_id"`
+	Severity   AlertSeverity `json:"severity"`
+	Source     string        `json:"source"`    // Kind of resource, e.g. 'storage_pool'.
+	SourceID   string        `json:"source_id"` // Identifier of the resource within its kind, e.g. the pool UUID.
+	Message    string        `json:"message"`
+	ResolvedAt *time.Time    `json:"resolved_at"`
+	// Raised during a maintenance window covering its host: nobody is
+	// emailed or notified, neither now nor when it is resolved.
+	Suppressed bool `json:"suppressed"`
+}
+
+// Event is a persisted record of something that happened to a host or VM,
+// kept so users can look back at what happened while nobody was watching.
+type Event struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `gorm:"index" json:"timestamp"`
+	Type      string    `gorm:"index" json:"type"` // Same names as the WebSocket messages where one exists, e.g. 'vm-state-changed'.
+	HostID    string    `gorm:"index" json:"host_id"`
+	VMName    string    `gorm:"index" json:"vm_name,omitempty"`
+	Message   string    `json:"message"`
+	Details   string    `json:"details,omitempty"` // JSON object with event-specific data.
+}
+
+// MaintenanceWindow is a planned period of work on hosts or VMs. While it is
+// on, alerts in its scope are suppressed and state changes are expected,
+// and availability reports leave it out. Empty scope fields match anything,
+// so a window without any covers everything.
+type MaintenanceWindow struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Name        string    `gorm:"uniqueIndex" json:"name"`
+	Description string    `json:"description"`
+	StartsAt    time.Time `gorm:"index" json:"starts_at"`
+	EndsAt      time.Time `gorm:"index" json:"ends_at"`
+	// Scope
+	HostID   string `json:"host_id"`
+	VMUUID   string `json:"vm_uuid"`
+	Selector string `json:"selector"` // Label selector the VMs must match
+}
+
+// VMStateChange records a VM moving from one state to another, for
+// availability reports. Like usage samples it keeps the VM's name and host,
+// and outlives the VM.
+type VMStateChange struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt     time.Time `gorm:"index" json:"created_at"`
+	VMUUID        string    `gorm:"index" json:"vm_uuid"`
+	HostID        string    `json:"host_id"`
+	VMName        string    `json:"vm_name"`
+	PreviousState VMState   `gorm:"type:varchar(20)" json:"previous_state"`
+	State         VMState   `gorm:"type:varchar(20)" json:"state"`
+	Expected      bool      `json:"expected"` // Happened during a maintenance window covering the VM
+}
+
+// NotificationSubscription asks for a user to be notified of events. Empty
+// fields match anything, so a subscription with only a host ID covers every
+// event of that host.
+type NotificationSubscription struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    uint      `gorm:"index" json:"-"`
+	EventType string    `json:"event_type"`
+	HostID    string    `json:"host_id"`
+	VMName    string    `json:"vm_name"`
+	Selector  string    `json:"selector"` // Label selector the event's VM must match.
+}
+
+// Notification is an event delivered to a user through one of their
+// subscriptions.
+type Notification struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+	UserID    uint       `gorm:"index:idx_notification_user_read" json:"-"`
+	EventID   uint       `json:"event_id"`
+	Type      string     `json:"type"`
+	HostID    string     `json:"host_id"`
+	VMName    string     `json:"vm_name,omitempty"`
+	Message   string     `json:"message"`
+	ReadAt    *time.Time `gorm:"index:idx_notification_user_read" json:"read_at"`
+}
+
+// PacketCapture is a bounded tcpdump capture of a VM interface, stored as a
+// pcap file on the Virtumancer server.
+type PacketCapture struct {
+	gorm.Model
+	HostID          string `gorm:"index" json:"host_id"`
+	VMName          string `json:"vm_name"`
+	Interface       string `json:"interface"` // Host-side tap device, e.g. 'vnet0'.
+	Filter          string `json:"filter"`    // BPF filter expression, if any.
+	DurationSeconds int    `json:"duration_seconds"`
+	MaxPackets      int    `json:"max_packets"`
+	SizeBytes       int64  `json:"size_bytes"`
+	Truncated       bool   `json:"truncated"` // The size limit was hit and later packets were dropped.
+	FilePath        string `json:"-"`
+	TaskID          uint   `json:"task_id"`
+}
+
+// Phases of a MigrationJob, in the order they run.
+const (
+	MigrationPhaseCopy    = "copy"    // Copying disk images to the target host.
+	MigrationPhaseDefine  = "define"  // Defining the domain on the target host.
+	MigrationPhaseCleanup = "cleanup" // Removing the domain and its images from the source host.
+	MigrationPhaseDone    = "done"
+)
+
+// MigrationDisk is a disk image copied by a MigrationJob and how far its
+// copy got.
+type MigrationDisk struct {
+	Device        string `json:"device"`                // Disk target, e.g. 'vda', or 'nvram' for UEFI variables.
+	Type          string `json:"type"`                  // Disk type in the domain XML: 'file', 'block' or 'volume'.
+	SourcePath    string `json:"source_path"`           // Image path on the source host.
+	SourcePool    string `json:"source_pool,omitempty"` // Empty for images outside storage pools.
+	Volume        string `json:"volume,omitempty"`      // Volume name within the pool.
+	Format        string `json:"format,omitempty"`
+	CapacityBytes uint64 `json:"capacity_bytes"`
+	TargetPool    string `json:"target_pool,omitempty"`
+	TargetPath    string `json:"target_path,omitempty"`
+	Created       bool   `json:"created"` // The target image was created by this job.
+	Copied        bool   `json:"copied"`
+}
+
+// MigrationJob moves a shut-off VM to a host that does not share its
+// storage. Progress is recorded per phase and per disk so an interrupted
+// job can be resumed where it stopped.
+type MigrationJob struct {
+	gorm.Model
+	VMUUID       string          `gorm:"index" json:"vm_uuid"`
+	VMName       string          `json:"vm_name"`
+	SourceHostID string          `json:"source_host_id"`
+	TargetHostID string          `json:"target_host_id"`
+	TargetPool   string          `json:"target_pool"` // Pool for pool volumes; empty keeps each volume's pool name.
+	Phase        string          `json:"phase"`
+	Status       TaskStatus      `json:"status"`
+	Disks        []MigrationDisk `gorm:"serializer:json" json:"disks"`
+	DomainXML    string          `json:"-"`       // Inactive definition read from the source before the copy.
+	TaskID       uint            `json:"task_id"` // Task of the latest run.
+	Error        string          `json:"error,omitempty"`
+}
+
+// MonitoringSettings holds the global monitoring configuration. There is a
+// single row; without it the built-in defaults apply.
+type MonitoringSettings struct {
+	ID                   uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt            time.Time `json:"updated_at"`
+	StatsIntervalSeconds float64   `json:"stats_interval_seconds"` // Default VM stats polling interval.
+}
+
+// ConsoleSettings is the single row of global console proxy settings.
+type ConsoleSettings struct {
+	ID                  uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt           time.Time `json:"updated_at"`
+	PingIntervalSeconds uint      `json:"ping_interval_seconds"` // WebSocket keepalive ping period; 0 uses the default.
+	IdleTimeoutSeconds  uint      `json:"idle_timeout_seconds"`  // Close sessions without traffic for this long; 0 never does.
+}
+
+// DiscoverySettings is the single row of host discovery settings.
+type DiscoverySettings struct {
+	ID              uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	Enabled         bool      `json:"enabled"`                        // Scan periodically; manual scans work either way.
+	Subnets         []string  `gorm:"serializer:json" json:"subnets"` // IPv4 CIDRs probed for SSH and libvirt ports.
+	MDNS            bool      `json:"mdns"`                           // Also browse mDNS records through avahi.
+	IntervalSeconds uint      `json:"interval_seconds"`               // Time between periodic scans; 0 uses the default.
+}
+
+// SyncSettings is the single row of settings for the periodic VM sync.
+type SyncSettings struct {
+	ID                    uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt             time.Time `json:"updated_at"`
+	IntervalSeconds       uint      `json:"interval_seconds"`        // Time between syncs of a quiet host; 0 uses the default.
+	ActiveIntervalSeconds uint      `json:"active_interval_seconds"` // Time between syncs of a host after changes; 0 uses the default.
+}
+
+// GuestSettings is the single row of settings applied to new VMs.
+type GuestSettings struct {
+	ID              uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt       time.Time `json:"updated_at"`
+	VirtioWinPool   string    `json:"virtio_win_pool"`   // Pool holding the virtio-win driver ISO on each host.
+	VirtioWinVolume string    `json:"virtio_win_volume"` // Name of the ISO in that pool; empty attaches none.
+}
+
+// ForecastSettings is the single row of settings for resource usage
+// forecasts.
+type ForecastSettings struct {
+	ID           uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	HorizonsDays []uint    `gorm:"serializer:json" json:"horizons_days"` // How far ahead to forecast; empty uses the defaults.
+	HistoryDays  uint      `json:"history_days"`                         // Usage history the forecast is fitted to; 0 uses the default.
+	Method       string    `json:"method"`                               // 'linear' or 'holt'; empty uses 'linear'.
+}
+
+// HealthSettings is the single row of rules the health of VMs and hosts is
+// computed with. A check whose status is 'green' is disabled; zero values
+// use the defaults.
+type HealthSettings struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Status of a VM in each state, e.g. {"ERROR": "red"}; empty uses the
+	// defaults.
+	StateStatuses       map[VMState]HealthStatus `gorm:"serializer:json" json:"state_statuses"`
+	AgentStatus         HealthStatus             `json:"agent_status"`          // When the guest agent of a running VM is disconnected.
+	StatsStaleMinutes   uint                     `json:"stats_stale_minutes"`   // Age after which the usage stats of a running VM are stale.
+	StatsStaleStatus    HealthStatus             `json:"stats_stale_status"`    // When they are.
+	DiskWarningPercent  float64                  `json:"disk_warning_percent"`  // Guest filesystem usage that turns a VM yellow.
+	DiskCriticalPercent float64                  `json:"disk_critical_percent"` // And red.
+	BlockJobStatus      HealthStatus             `json:"block_job_status"`      // When a block job of the VM failed.
+	MaintenanceStatus   HealthStatus             `json:"maintenance_status"`    // When a host is in maintenance mode.
+	SyncFailureStatus   HealthStatus             `json:"sync_failure_status"`   // When the periodic sync of a host keeps failing.
+}
+
+// FeatureFlag overrides the configured default of a feature flag. Without a
+// row, the default applies.
+type FeatureFlag struct {
+	Name      string    `gorm:"primaryKey" json:"name"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Enabled   *bool     `json:"enabled"`                      // Nil keeps the default.
+	Roles     []string  `gorm:"serializer:json" json:"roles"` // Roles that may use the feature; empty for all.
+}
+
+// TracingSettings is the single row configuring where OpenTelemetry spans
+// are exported.
+type TracingSettings struct {
+	ID          uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Enabled     bool      `json:"enabled"`
+	Endpoint    string    `json:"endpoint"`     // OTLP/HTTP collector URL; spans are posted to its /v1/traces.
+	Insecure    bool      `json:"insecure"`     // Skip verifying the collector's TLS certificate.
+	SampleRatio float64   `json:"sample_ratio"` // Share of API requests traced, 0 to 1; callers' sampling decisions are kept.
+}
+
+// EmailSettings is the single row configuring the SMTP server that alerts,
+// reports and account emails are sent through.
+type EmailSettings struct {
+	ID               uint       `gorm:"primarykey" json:"-"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	Enabled          bool       `json:"enabled"`
+	Host             string     `json:"host"`
+	Port             uint       `json:"port"`
+	Security         string     `json:"security"` // 'starttls', 'tls' or 'none'.
+	Username         string     `json:"username"` // Empty to send without authentication.
+	Password         string     `json:"-"`
+	From             string     `json:"from"`
+	AlertRecipients  []string   `gorm:"serializer:json" json:"alert_recipients"`
+	ReportRecipients []string   `gorm:"serializer:json" json:"report_recipients"`
+	WeeklyReport     bool       `json:"weekly_report"`  // Send a capacity summary every week.
+	LastReportAt     *time.Time `json:"last_report_at"` // When the weekly report was last sent.
+}
+
+// CostRates is the single row of unit costs used for showback reports.
+type CostRates struct {
+	ID            uint      `gorm:"primarykey" json:"-"`
+	UpdatedAt     time.Time `json:"updated_at"`
+	Currency      string    `json:"currency"`                          // Shown with the costs, e.g. EUR; purely informational.
+	VCPUHour      float64   `gorm:"column:vcpu_hour" json:"vcpu_hour"` // Cost of one vCPU running for an hour.
+	MemoryGBHour  float64   `json:"memory_gb_hour"`                    // Cost of one GiB of memory running for an hour.
+	StorageGBHour float64   `json:"storage_gb_hour"`                   // Cost of one GiB of disk for an hour, running or not.
+}
+
+// VMUsageSample is a point-in-time record of the resources a VM holds. It
+// keeps the VM's name and host so reports still cover deleted VMs.
+type VMUsageSample struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	VMUUID       string    `gorm:"index" json:"vm_uuid"`
+	VMName       string    `json:"vm_name"`
+	HostID       string    `json:"host_id"`
+	Running      bool      `json:"running"`
+	VCPUs        uint      `gorm:"column:vcpus" json:"vcpus"`
+	MemoryBytes  uint64    `json:"memory_bytes"`
+	StorageBytes uint64    `json:"storage_bytes"` // Virtual size of the VM's disks
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
 }
 
 // AuditLog records an event that occurred in the system.
@@ -424,23 +1361,108 @@ type AuditLog struct {
 	Details    string
 }
 
+// sqliteOptions tune SQLite for many concurrent readers and short writes. WAL
+// lets readers proceed while a sync writes, the busy timeout makes writers
+// queue instead of failing with "database is locked", and immediate
+// transactions take the write lock up front, avoiding the busy errors of
+// upgrading a read lock mid-transaction. Foreign keys are enforced, so
+// deleting a host or VM deletes what belongs to it.
+const sqliteOptions = "_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate&_foreign_keys=1"
+
 // InitDB initializes and returns a GORM database instance.
 func InitDB(dataSourceName string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(dataSourceName), &gorm.Config{})
+	dsn := dataSourceName
+	if !strings.Contains(dsn, "?") {
+		dsn += "?" + sqliteOptions
+	}
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := registerLockErrorCounter(db); err != nil {
+		return nil, err
+	}
+	if err := registerGenerationCounter(db); err != nil {
+		return nil, err
+	}
+
+	// The schema is migrated on a connection without foreign keys: SQLite
+	// changes constraints by rebuilding tables, and dropping the old table
+	// would cascade.
+	err = db.Connection(func(conn *gorm.DB) error {
+		conn = conn.Session(&gorm.Session{})
+		if err := conn.Exec("PRAGMA foreign_keys = OFF").Error; err != nil {
+			return err
+		}
+		defer conn.Exec("PRAGMA foreign_keys = ON")
+		return migrate(conn)
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return db, nil
+}
+
+// migrate brings the schema up to date and deletes rows that break its
+// foreign keys.
+func migrate(db *gorm.DB) error {
+	if err := migrateHostIDs(db); err != nil {
+		return fmt.Errorf("failed to migrate host IDs: %w", err)
+	}
+	if err := migrateGraphicsDevices(db); err != nil {
+		return fmt.Errorf("failed to migrate graphics devices: %w", err)
+	}
+	if err := dropOutdatedForeignKeys(db); err != nil {
+		return err
+	}
+	if err := migrateIdempotencyKeys(db); err != nil {
+		return fmt.Errorf("failed to migrate idempotency keys: %w", err)
+	}
+
 	// Auto-migrate the full schema
-	err = db.AutoMigrate(
+	err := db.AutoMigrate(
+		&Project{},
+		&ProjectMember{},
+		&ProjectResource{},
 		&Host{},
+		&HostInfo{},
+		&BalloonPolicy{},
+		&DiskCompactionPolicy{},
+		&FstrimPolicy{},
+		&HostFencing{},
 		&VirtualMachine{},
+		&VMCustomField{},
+		&VMLabel{},
+		&PlacementRule{},
+		&VMDependency{},
 		&StoragePool{},
+		&StoragePoolUsageSample{},
+		&VMUsageSample{},
 		&Volume{},
 		&VolumeAttachment{},
+		&CatalogImage{},
 		&Network{},
 		&Port{},
 		&PortBinding{},
+		&MACAddressPool{},
+		&MACConflict{},
+		&MonitoringSettings{},
+		&ConsoleSettings{},
+		&DiscoverySettings{},
+		&SyncSettings{},
+		&GuestSettings{},
+		&ForecastSettings{},
+		&HealthSettings{},
+		&HardwarePreset{},
+		&Runbook{},
+		&RunbookRun{},
+		&VMGroup{},
+		&VMGroupMember{},
+		&TracingSettings{},
+		&FeatureFlag{},
+		&EmailSettings{},
+		&CostRates{},
 		&Controller{},
 		&ControllerAttachment{},
 		&InputDevice{},
@@ -478,17 +1500,34 @@ func InitDB(dataSourceName string) (*gorm.DB, error) {
 		&IOMMUDevice{},
 		&IOMMUDeviceAttachment{},
 		&VMSnapshot{},
+		&VMGraphicsPassword{},
+		&VMMachineTypeChange{},
+		&VMRecoveryDefinition{},
+		&VMDefinition{},
+		&VMRecovery{},
 		&User{},
+		&UserSession{},
+		&LoginAttempt{},
+		&SecuritySettings{},
+		&IdempotencyKey{},
 		&Role{},
 		&Permission{},
 		&Task{},
 		&AuditLog{},
+		&Alert{},
+		&Event{},
+		&VMStateChange{},
+		&MaintenanceWindow{},
+		&NotificationSubscription{},
+		&Notification{},
+		&PacketCapture{},
+		&MigrationJob{},
 	)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return db, nil
+	return deleteDanglingRows(db)
 }
 
 
@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// migrateGraphicsDevices moves databases from graphics devices shared by all
+// VMs of a protocol to devices owned by one VM. The shared rows and their
+// attachments, soft-deleted ones included, are dropped before the schema is
+// migrated, as the new unique indexes could not be created over them. The
+// next sync of each VM records its own device.
+func migrateGraphicsDevices(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&GraphicsDevice{}) || m.HasColumn(&GraphicsDevice{}, "vm_id") {
+		return nil
+	}
+	return Transact(db, func(tx *gorm.DB) error {
+		if tx.Migrator().HasTable(&GraphicsDeviceAttachment{}) {
+			if err := tx.Exec("DELETE FROM graphics_device_attachments").Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Exec("DELETE FROM graphics_devices").Error; err != nil {
+			return err
+		}
+		log.Printf("Dropped shared graphics devices; the next VM sync records a device per VM")
+		return nil
+	})
+}
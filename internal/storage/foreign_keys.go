@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// cascade is a foreign key whose rows are deleted with the row they refer
+// to. The constraint is declared by an association field of the model.
+type cascade struct {
+	model  interface{}
+	field  string
+	table  string
+	column string
+	parent string
+}
+
+// cascades are the foreign keys that delete a host's VMs, networks and
+// storage pools with it, a VM's devices, attachments, ports, custom fields,
+// labels, snapshots, history and group memberships with the VM, a group's
+// memberships with the group, and a runbook's runs with the runbook. Parents
+// come before their children, so that deleting dangling rows in this order
+// also catches the rows left dangling by the deletions before.
+var cascades = []cascade{
+	{&VirtualMachine{}, "Host", "virtual_machines", "host_id", "hosts"},
+	{&Network{}, "Host", "networks", "host_id", "hosts"},
+	{&StoragePool{}, "Host", "storage_pools", "host_id", "hosts"},
+	{&VolumeAttachment{}, "VM", "volume_attachments", "vm_id", "virtual_machines"},
+	{&VolumeAttachment{}, "Volume", "volume_attachments", "volume_id", "volumes"},
+	{&GraphicsDevice{}, "VM", "graphics_devices", "vm_id", "virtual_machines"},
+	{&GraphicsDeviceAttachment{}, "VM", "graphics_device_attachments", "vm_id", "virtual_machines"},
+	{&GraphicsDeviceAttachment{}, "GraphicsDevice", "graphics_device_attachments", "graphics_device_id", "graphics_devices"},
+	{&Port{}, "VM", "ports", "vm_id", "virtual_machines"},
+	{&PortBinding{}, "Port", "port_bindings", "port_id", "ports"},
+	{&PortBinding{}, "Network", "port_bindings", "network_id", "networks"},
+	{&VMCustomField{}, "VM", "vm_custom_fields", "vm_id", "virtual_machines"},
+	{&VMLabel{}, "VM", "vm_labels", "vm_id", "virtual_machines"},
+	{&VMGraphicsPassword{}, "VM", "vm_graphics_passwords", "vm_id", "virtual_machines"},
+	{&VMMachineTypeChange{}, "VM", "vm_machine_type_changes", "vm_id", "virtual_machines"},
+	{&VMRecoveryDefinition{}, "VM", "vm_recovery_definitions", "vm_id", "virtual_machines"},
+	{&VMDefinition{}, "VM", "vm_definitions", "vm_id", "virtual_machines"},
+	{&VMSnapshot{}, "VM", "vm_snapshots", "vm_id", "virtual_machines"},
+	{&MACConflict{}, "VM", "mac_conflicts", "vm_id", "virtual_machines"},
+	{&MACConflict{}, "OwnerVM", "mac_conflicts", "owner_vm_id", "virtual_machines"},
+	{&VMGroupMember{}, "VM", "vm_group_members", "vm_id", "virtual_machines"},
+	{&RunbookRun{}, "Runbook", "runbook_runs", "runbook_id", "runbooks"},
+	{&VMGroupMember{}, "Group", "vm_group_members", "group_id", "vm_groups"},
+}
+
+// dropOutdatedForeignKeys drops the foreign keys of the cascades that were
+// created without ON DELETE CASCADE, so the schema migration recreates them.
+func dropOutdatedForeignKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	for _, c := range cascades {
+		if !m.HasTable(c.table) {
+			continue
+		}
+		var onDelete []string
+		err := db.Raw(`SELECT on_delete FROM pragma_foreign_key_list(?) WHERE "from" = ?`, c.table, c.column).Scan(&onDelete).Error
+		if err != nil {
+			return err
+		}
+		if len(onDelete) == 0 || onDelete[0] == "CASCADE" {
+			continue
+		}
+		if err := m.DropConstraint(c.model, c.field); err != nil {
+			return fmt.Errorf("failed to drop the foreign key of %s.%s: %w", c.table, c.column, err)
+		}
+	}
+	return nil
+}
+
+// deleteDanglingRows deletes what would have been deleted along with rows
+// removed before the foreign keys were enforced: the rows of the cascades
+// whose parent is gone. VMs used to be soft-deleted; those rows are purged
+// first, so their devices and attachments go as well.
+func deleteDanglingRows(db *gorm.DB) error {
+	result := db.Exec("DELETE FROM virtual_machines WHERE deleted_at IS NOT NULL")
+	if result.Error != nil {
+		return result.Error
+	}
+	total := result.RowsAffected
+	for _, c := range cascades {
+		result := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s NOT IN (SELECT id FROM %s)", c.table, c.column, c.parent))
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete dangling rows of %s: %w", c.table, result.Error)
+		}
+		total += result.RowsAffected
+	}
+	if total > 0 {
+		log.Printf("Deleted %d database rows left behind by deleted hosts and VMs", total)
+	}
+	return nil
+}
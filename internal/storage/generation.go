@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+)
+
+// generationField is the field of models that count their changes, see
+// registerGenerationCounter.
+const generationField = "Generation"
+
+const generationSetKey = "virtumancer:generation_set"
+
+// registerGenerationCounter makes every update of a model with a Generation
+// field increment it, but only for rows whose columns actually change. The
+// periodic syncs rewrite unchanged rows all the time, and clients such as a
+// Terraform provider compare generations to spot drift, so a blind
+// increment would report changes that never happened.
+func registerGenerationCounter(db *gorm.DB) error {
+	cb := db.Callback().Update()
+	if err := cb.Before("gorm:update").After("gorm:save_before_associations").Register("virtumancer:generation", countGeneration); err != nil {
+		return err
+	}
+	return cb.After("gorm:update").Register("virtumancer:generation_cleanup", func(tx *gorm.DB) {
+		if _, ok := tx.InstanceGet(generationSetKey); ok {
+			delete(tx.Statement.Clauses, "SET")
+		}
+	})
+}
+
+// countGeneration builds the statement's assignments the way gorm would and
+// adds "generation = generation + CASE WHEN <any column differs> THEN 1
+// ELSE 0 END" to them.
+func countGeneration(tx *gorm.DB) {
+	stmt := tx.Statement
+	if tx.Error != nil || stmt.Schema == nil || stmt.SQL.Len() > 0 {
+		return
+	}
+	field := stmt.Schema.LookUpField(generationField)
+	if field == nil {
+		return
+	}
+	if _, ok := stmt.Clauses["SET"]; ok {
+		return
+	}
+	set := callbacks.ConvertToAssignments(stmt)
+	if len(set) == 0 {
+		return
+	}
+
+	var updatedAt string
+	if f := stmt.Schema.LookUpField("UpdatedAt"); f != nil {
+		updatedAt = f.DBName
+	}
+	assignments := make(clause.Set, 0, len(set)+1)
+	var changed []string
+	var vars []interface{}
+	for _, a := range set {
+		if a.Column.Name == field.DBName {
+			continue // Save writes the loaded value back; the counter is ours
+		}
+		assignments = append(assignments, a)
+		if a.Column.Name == updatedAt {
+			continue
+		}
+		changed = append(changed, stmt.Quote(clause.Column{Table: a.Column.Table, Name: a.Column.Name})+" IS NOT ?")
+		vars = append(vars, a.Value)
+	}
+	if len(changed) > 0 {
+		column := stmt.Quote(field.DBName)
+		assignments = append(assignments, clause.Assignment{
+			Column: clause.Column{Name: field.DBName},
+			Value:  gorm.Expr(column+" + CASE WHEN "+strings.Join(changed, " OR ")+" THEN 1 ELSE 0 END", vars...),
+		})
+	}
+	stmt.AddClause(assignments)
+	tx.InstanceSet(generationSetKey, true)
+}
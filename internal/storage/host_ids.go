@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// hostReferences lists the columns holding host IDs.
+var hostReferences = []struct {
+	model  interface{}
+	column string
+}{
+	{&VirtualMachine{}, "host_id"},
+	{&HostInfo{}, "host_id"},
+	{&BalloonPolicy{}, "host_id"},
+	{&StoragePool{}, "host_id"},
+	{&Network{}, "host_id"},
+	{&MACConflict{}, "host_id"},
+	{&MACConflict{}, "owner_host_id"},
+	{&HostDevice{}, "host_id"},
+	{&Alert{}, "host_id"},
+	{&Event{}, "host_id"},
+	{&NotificationSubscription{}, "host_id"},
+	{&Notification{}, "host_id"},
+	{&PacketCapture{}, "host_id"},
+	{&VMUsageSample{}, "host_id"},
+	{&ProjectResource{}, "host_id"},
+	{&MigrationJob{}, "source_host_id"},
+	{&MigrationJob{}, "target_host_id"},
+}
+
+// migrateHostIDs moves databases from user-chosen host IDs to generated
+// ones. The old ID of each host becomes its name and every column referring
+// to it is rewritten. It runs before the schema is migrated, as the unique
+// indexes on name and URI can only be created once names are filled in and
+// duplicate URIs are gone.
+func migrateHostIDs(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&Host{}) || m.HasColumn(&Host{}, "name") {
+		return nil
+	}
+
+	var hosts []Host
+	if err := db.Select("id", "uri").Find(&hosts).Error; err != nil {
+		return err
+	}
+	byURI := make(map[string][]string)
+	for _, host := range hosts {
+		byURI[host.URI] = append(byURI[host.URI], host.ID)
+	}
+	for uri, ids := range byURI {
+		if len(ids) > 1 {
+			return fmt.Errorf("hosts %s share the URI %s; remove all but one before upgrading", strings.Join(ids, ", "), uri)
+		}
+	}
+
+	return Transact(db, func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&Host{}, "Name"); err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			newID := uuid.NewString()
+			if err := tx.Exec("UPDATE hosts SET id = ?, name = ? WHERE id = ?", newID, host.ID, host.ID).Error; err != nil {
+				return err
+			}
+			for _, ref := range hostReferences {
+				if !tx.Migrator().HasTable(ref.model) || !tx.Migrator().HasColumn(ref.model, ref.column) {
+					continue
+				}
+				err := tx.Model(ref.model).Unscoped().Where(ref.column+" = ?", host.ID).UpdateColumn(ref.column, newID).Error
+				if err != nil {
+					return fmt.Errorf("failed to update %s of host %s: %w", ref.column, host.ID, err)
+				}
+			}
+			log.Printf("Host %s now has the ID %s", host.ID, newID)
+		}
+		return nil
+	})
+}
+
+// ResolveHostID returns the ID of the host with the given ID or, for clients
+// from before IDs were generated, the given name. Unknown references are
+// returned unchanged so that lookups fail the usual way.
+func ResolveHostID(db *gorm.DB, ref string) string {
+	var host Host
+	if err := db.Select("id").Where("id = ?", ref).Limit(1).Find(&host).Error; err == nil && host.ID != "" {
+		return host.ID
+	}
+	if err := db.Select("id").Where("name = ?", ref).Limit(1).Find(&host).Error; err == nil && host.ID != "" {
+		return host.ID
+	}
+	return ref
+}
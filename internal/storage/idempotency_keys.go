@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// migrateIdempotencyKeys drops the idempotency keys of databases from before
+// keys belonged to a user. Their unique index on the key alone would clash
+// with the same key sent by two users, and the rows only serve retries
+// within a day, so they are not worth carrying over.
+func migrateIdempotencyKeys(db *gorm.DB) error {
+	m := db.Migrator()
+	if !m.HasTable(&IdempotencyKey{}) || m.HasColumn(&IdempotencyKey{}, "user_id") {
+		return nil
+	}
+	if err := m.DropTable(&IdempotencyKey{}); err != nil {
+		return err
+	}
+	log.Printf("Dropped idempotency keys kept without a user; retries of earlier requests run again")
+	return nil
+}
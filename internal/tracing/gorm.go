@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"errors"
+	"strings"
+
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const gormSpanKey = "tracing:span"
+
+// RegisterGorm records a span for every database statement run with a
+// context that carries a span, see gorm.DB.WithContext.
+func RegisterGorm(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tracing:before_create", beforeStatement("create")),
+		cb.Create().After("gorm:create").Register("tracing:after_create", afterStatement),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", beforeStatement("query")),
+		cb.Query().After("gorm:query").Register("tracing:after_query", afterStatement),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", beforeStatement("update")),
+		cb.Update().After("gorm:update").Register("tracing:after_update", afterStatement),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", beforeStatement("delete")),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", afterStatement),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", beforeStatement("row")),
+		cb.Row().After("gorm:row").Register("tracing:after_row", afterStatement),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", beforeStatement("raw")),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", afterStatement),
+	)
+}
+
+func beforeStatement(op string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil || !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+			return
+		}
+		name := "db." + op
+		if db.Statement.Table != "" {
+			name += " " + db.Statement.Table
+		}
+		_, span := tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemSqlite, semconv.DBOperationName(strings.ToUpper(op))))
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func afterStatement(db *gorm.DB) {
+	value, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(semconv.DBQueryText(db.Statement.SQL.String()))
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		End(span, db.Error)
+		return
+	}
+	span.End()
+}
@@ -0,0 +1,133 @@
+// Package tracing records OpenTelemetry spans for API requests and the
+// service, libvirt and database work done for them, and exports them over
+// OTLP/HTTP. Until an exporter is configured spans are not recorded.
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// ServiceName identifies Virtumancer's spans in the tracing backend.
+const ServiceName = "virtumancer"
+
+const instrumentationName = "github.com/capsali/virtumancer-flash"
+
+// Attribute keys shared by the spans.
+const (
+	HostKey = attribute.Key("virtumancer.host_id")
+	VMKey   = attribute.Key("virtumancer.vm_name")
+)
+
+// Config selects where spans are exported.
+type Config struct {
+	Enabled     bool
+	Endpoint    string  // OTLP/HTTP base URL, e.g. http://collector:4318
+	Insecure    bool    // Skip TLS certificate verification
+	SampleRatio float64 // Share of requests traced, between 0 and 1
+}
+
+// ErrInvalidEndpoint is returned for an endpoint that is not an http or
+// https URL.
+var ErrInvalidEndpoint = errors.New("endpoint must be an http:// or https:// URL")
+
+var (
+	mu       sync.Mutex
+	provider *sdktrace.TracerProvider
+)
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetTracerProvider(noop.NewTracerProvider())
+}
+
+// Configure replaces the exporter. Spans of the previous one are flushed
+// first. A disabled config stops tracing.
+func Configure(cfg Config) error {
+	var next *sdktrace.TracerProvider
+	if cfg.Enabled {
+		endpoint, err := url.Parse(cfg.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return ErrInvalidEndpoint
+		}
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint.JoinPath("v1", "traces").String())}
+		if cfg.Insecure && endpoint.Scheme == "https" {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(&tls.Config{InsecureSkipVerify: true}))
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(ServiceName)))
+		if err != nil {
+			return fmt.Errorf("failed to describe the service: %w", err)
+		}
+		next = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		)
+	}
+
+	mu.Lock()
+	previous := provider
+	provider = next
+	if next != nil {
+		otel.SetTracerProvider(next)
+	} else {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+	}
+	mu.Unlock()
+
+	if previous != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := previous.Shutdown(ctx); err != nil {
+			log.Printf("Warning: failed to flush spans of the previous exporter: %v", err)
+		}
+	}
+	return nil
+}
+
+func tracer() trace.Tracer {
+	return otel.GetTracerProvider().Tracer(instrumentationName)
+}
+
+// Start starts a span as a child of the span in ctx. Without one, as for
+// background work, nothing is recorded.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends a span, marking it failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Host and VM describe the host and VM a span works on.
+func Host(hostID string) attribute.KeyValue { return HostKey.String(hostID) }
+func VM(vmName string) attribute.KeyValue   { return VMKey.String(vmName) }
@@ -21,21 +21,28 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Outbound messages buffered per client. A client whose buffer is full
+	// is dropped.
+	sendBufferSize = 256
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// Allow all origins for now. In production, you'd want to restrict this.
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     CheckOrigin,
 }
 
+// Filter decides which broadcasts a client receives. It is only called from
+// the hub's goroutine.
+type Filter func(Message) bool
+
 // InboundMessageHandler is an interface for handling messages from a client.
 type InboundMessageHandler interface {
 	HandleSubscribe(client *Client, payload MessagePayload)
 	HandleUnsubscribe(client *Client, payload MessagePayload)
+	HandleSubscribeHostStats(client *Client, payload MessagePayload)
+	HandleUnsubscribeHostStats(client *Client, payload MessagePayload)
 	HandleClientDisconnect(client *Client)
 }
 
@@ -51,13 +58,24 @@ type Client struct {
 
 	// A handler for inbound messages, typically the HostService.
 	handler InboundMessageHandler
+
+	// The logged-in user of the connection, 0 if none. Only such clients
+	// receive that user's notifications.
+	userID uint
+
+	// The broadcasts the client may see, nil for all. Messages sent to its
+	// user always get through.
+	filter Filter
 }
 
 // readPump pumps messages from the websocket connection to the handler.
 func (c *Client) readPump() {
 	defer func() {
 		c.handler.HandleClientDisconnect(c)
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done: // The hub already let go of its clients
+		}
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -83,6 +101,10 @@ func (c *Client) readPump() {
 			c.handler.HandleSubscribe(c, msg.Payload)
 		case "unsubscribe-vm-stats":
 			c.handler.HandleUnsubscribe(c, msg.Payload)
+		case "subscribe-host-vms-stats":
+			c.handler.HandleSubscribeHostStats(c, msg.Payload)
+		case "unsubscribe-host-vms-stats":
+			c.handler.HandleUnsubscribeHostStats(c, msg.Payload)
 		default:
 			log.Printf("Received unknown websocket message type: %s", msg.Type)
 		}
@@ -124,15 +146,22 @@ func (c *Client) writePump() {
 	}
 }
 
-// ServeWs handles websocket requests from the peer.
-func ServeWs(hub *Hub, handler InboundMessageHandler, w http.ResponseWriter, r *http.Request) {
+// ServeWs handles websocket requests from the peer. userID is the logged-in
+// user of the request, or 0, and filter limits the broadcasts it gets.
+func ServeWs(hub *Hub, handler InboundMessageHandler, userID uint, filter Filter, w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), handler: handler}
-	client.hub.register <- client
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, sendBufferSize), handler: handler, userID: userID, filter: filter}
+	select {
+	case hub.register <- client:
+	case <-hub.done:
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down"), time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
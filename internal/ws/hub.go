@@ -3,6 +3,8 @@ package ws
 import (
 	"encoding/json"
 	"log"
+	"sync"
+	"time"
 )
 
 // MessagePayload defines the structure for data sent with a message.
@@ -14,64 +16,163 @@ type Message struct {
 	Payload MessagePayload `json:"payload,omitempty"`
 }
 
+// outbound is a message waiting for the hub, with the time it was handed
+// over and, for messages to one user, its recipient.
+type outbound struct {
+	message  Message
+	userID   uint // 0 for broadcasts
+	queuedAt time.Time
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	broadcast chan Message
+	// Messages for all clients, or for the clients of a single user.
+	outbound chan outbound
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Requests for the hub's statistics.
+	stats chan chan HubStats
+
+	// Closed by Close; Run then disconnects every client and returns.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	metrics *hubMetrics
+}
+
+// HubStats describes the connected clients and their outbound queues.
+type HubStats struct {
+	Clients        int `json:"clients"`
+	QueuedMessages int `json:"queued_messages"`  // Messages waiting in the clients' send buffers
+	MaxClientQueue int `json:"max_client_queue"` // Longest send buffer; clients are dropped when it is full
+	SendBufferSize int `json:"send_buffer_size"`
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		broadcast:  make(chan Message),
+		outbound:   make(chan outbound),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		stats:      make(chan chan HubStats),
+		done:       make(chan struct{}),
 		clients:    make(map[*Client]bool),
+		metrics:    newHubMetrics(),
 	}
 }
 
+// Run delivers messages to the clients until the hub is closed.
 func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			h.metrics.clients.Store(int64(len(h.clients)))
 			log.Println("WebSocket client connected")
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
 				close(client.send)
+				h.metrics.clients.Store(int64(len(h.clients)))
 				log.Println("WebSocket client disconnected")
 			}
-		case message := <-h.broadcast:
-			messageBytes, err := json.Marshal(message)
+		case out := <-h.outbound:
+			messageBytes, err := json.Marshal(out.message)
 			if err != nil {
-				log.Printf("Error marshalling broadcast message: %v", err)
+				log.Printf("Error marshalling message %s: %v", out.message.Type, err)
 				continue
 			}
 			for client := range h.clients {
-				select {
-				case client.send <- messageBytes:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if client.receives(out) {
+					h.deliver(client, out.message.Type, messageBytes)
 				}
 			}
+			h.metrics.clients.Store(int64(len(h.clients)))
+			h.metrics.observeBroadcast(out.message.Type, time.Since(out.queuedAt))
+		case reply := <-h.stats:
+			stats := HubStats{Clients: len(h.clients), SendBufferSize: sendBufferSize}
+			for client := range h.clients {
+				queued := len(client.send)
+				stats.QueuedMessages += queued
+				stats.MaxClientQueue = max(stats.MaxClientQueue, queued)
+			}
+			reply <- stats
+		case <-h.done:
+			// Closing the send channels makes the clients' write pumps say
+			// goodbye and close their connections.
+			for client := range h.clients {
+				close(client.send)
+				delete(h.clients, client)
+			}
+			h.metrics.clients.Store(0)
+			log.Println("WebSocket hub closed")
+			return
 		}
 	}
 }
 
+// receives reports whether a message is for a client: the messages to its
+// user, and the broadcasts its filter lets through.
+func (c *Client) receives(out outbound) bool {
+	if out.userID != 0 {
+		return c.userID == out.userID
+	}
+	return c.filter == nil || c.filter(out.message)
+}
+
+// deliver queues a message for a client, dropping clients that fall behind.
+func (h *Hub) deliver(client *Client, messageType string, messageBytes []byte) {
+	select {
+	case client.send <- messageBytes:
+		h.metrics.countSent(messageType)
+	default:
+		close(client.send)
+		delete(h.clients, client)
+		h.metrics.countDropped(messageType)
+	}
+}
+
+// send hands a message to Run, or drops it once the hub is closed.
+func (h *Hub) send(out outbound) {
+	out.queuedAt = time.Now()
+	select {
+	case h.outbound <- out:
+	case <-h.done:
+	}
+}
+
 // BroadcastMessage sends a message to all connected clients.
 func (h *Hub) BroadcastMessage(message Message) {
-	h.broadcast <- message
+	h.send(outbound{message: message})
+}
+
+// SendToUser sends a message to the clients of a logged-in user only.
+func (h *Hub) SendToUser(userID uint, message Message) {
+	h.send(outbound{message: message, userID: userID})
 }
 
+// Stats returns the number of clients and how many messages wait for them.
+func (h *Hub) Stats() HubStats {
+	reply := make(chan HubStats, 1)
+	select {
+	case h.stats <- reply:
+		return <-reply
+	case <-h.done:
+		return HubStats{SendBufferSize: sendBufferSize}
+	}
+}
 
+// Close disconnects every client and stops Run. Later messages are dropped
+// and new connections refused. It is safe to call more than once and from
+// any goroutine.
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
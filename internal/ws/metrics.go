@@ -0,0 +1,110 @@
+package ws
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// broadcastBuckets are the upper bounds, in seconds, of the broadcast
+// latency histogram: from handing a message to the hub until it is queued
+// for every client.
+var broadcastBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// messageTypeCounts counts the messages of one type.
+type messageTypeCounts struct {
+	sent    uint64   // Queued for a client, once per client
+	dropped uint64   // Not queued because the client's buffer was full
+	buckets []uint64 // Broadcasts per latency bucket, not cumulative; the last one is +Inf
+	sum     float64  // Total broadcast latency in seconds
+	count   uint64   // Broadcasts
+}
+
+// hubMetrics are the counters behind the hub's Prometheus metrics. They are
+// updated by Run and read by the metrics scraper.
+type hubMetrics struct {
+	clients atomic.Int64
+
+	mu     sync.Mutex
+	byType map[string]*messageTypeCounts
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{byType: make(map[string]*messageTypeCounts)}
+}
+
+// counts returns the counters of a message type. The lock must be held.
+func (m *hubMetrics) counts(messageType string) *messageTypeCounts {
+	c, ok := m.byType[messageType]
+	if !ok {
+		c = &messageTypeCounts{buckets: make([]uint64, len(broadcastBuckets)+1)}
+		m.byType[messageType] = c
+	}
+	return c
+}
+
+func (m *hubMetrics) countSent(messageType string) {
+	m.mu.Lock()
+	m.counts(messageType).sent++
+	m.mu.Unlock()
+}
+
+func (m *hubMetrics) countDropped(messageType string) {
+	m.mu.Lock()
+	m.counts(messageType).dropped++
+	m.mu.Unlock()
+}
+
+func (m *hubMetrics) observeBroadcast(messageType string, d time.Duration) {
+	seconds := d.Seconds()
+	bucket := sort.SearchFloat64s(broadcastBuckets, seconds)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counts(messageType)
+	c.buckets[bucket]++
+	c.sum += seconds
+	c.count++
+}
+
+// WriteMetrics writes the hub's metrics in the Prometheus text exposition
+// format.
+func (h *Hub) WriteMetrics(w io.Writer) {
+	m := h.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	types := make([]string, 0, len(m.byType))
+	for messageType := range m.byType {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+
+	fmt.Fprintln(w, "# HELP virtumancer_ws_clients Connected WebSocket clients.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_clients gauge")
+	fmt.Fprintf(w, "virtumancer_ws_clients %d\n", m.clients.Load())
+	fmt.Fprintln(w, "# HELP virtumancer_ws_messages_sent_total Messages queued for WebSocket clients, once per client, by message type.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_messages_sent_total counter")
+	for _, t := range types {
+		fmt.Fprintf(w, "virtumancer_ws_messages_sent_total{type=%q} %d\n", t, m.byType[t].sent)
+	}
+	fmt.Fprintln(w, "# HELP virtumancer_ws_messages_dropped_total Messages dropped because a client fell behind, by message type. The client is disconnected.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_messages_dropped_total counter")
+	for _, t := range types {
+		fmt.Fprintf(w, "virtumancer_ws_messages_dropped_total{type=%q} %d\n", t, m.byType[t].dropped)
+	}
+	fmt.Fprintln(w, "# HELP virtumancer_ws_broadcast_duration_seconds Time from handing a message to the hub until it is queued for every client, by message type.")
+	fmt.Fprintln(w, "# TYPE virtumancer_ws_broadcast_duration_seconds histogram")
+	for _, t := range types {
+		c := m.byType[t]
+		var cumulative uint64
+		for i, le := range broadcastBuckets {
+			cumulative += c.buckets[i]
+			fmt.Fprintf(w, "virtumancer_ws_broadcast_duration_seconds_bucket{type=%q,le=\"%g\"} %d\n", t, le, cumulative)
+		}
+		fmt.Fprintf(w, "virtumancer_ws_broadcast_duration_seconds_bucket{type=%q,le=\"+Inf\"} %d\n", t, c.count)
+		fmt.Fprintf(w, "virtumancer_ws_broadcast_duration_seconds_sum{type=%q} %g\n", t, c.sum)
+		fmt.Fprintf(w, "virtumancer_ws_broadcast_duration_seconds_count{type=%q} %d\n", t, c.count)
+	}
+}
@@ -0,0 +1,61 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// AllowedOriginsEnv names the environment variable with the origins, besides
+// the server's own, that browser pages may open WebSockets from, separated by
+// commas, e.g. "https://ops.example.com,http://localhost:5173".
+const AllowedOriginsEnv = "VIRTUMANCER_ALLOWED_ORIGINS"
+
+var (
+	originsMu      sync.RWMutex
+	allowedOrigins []string
+)
+
+// SetAllowedOrigins sets the origins CheckOrigin lets through besides the
+// server's own, as a comma-separated list.
+func SetAllowedOrigins(list string) {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, strings.ToLower(origin))
+		}
+	}
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	allowedOrigins = origins
+}
+
+// CheckOrigin refuses WebSocket upgrades that other sites' pages start with
+// the session cookie of a browser. Requests with a bearer token, and those
+// without an Origin header, do not come from a browser page and pass. Others
+// must come from a page of the server's own host or of an allowed origin.
+func CheckOrigin(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	originsMu.RLock()
+	defer originsMu.RUnlock()
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/capsali/virtumancer-flash/internal/api"
 	"github.com/capsali/virtumancer-flash/internal/libvirt"
 	"github.com/capsali/virtumancer-flash/internal/services"
 	"github.com/capsali/virtumancer-flash/internal/storage"
+	"github.com/capsali/virtumancer-flash/internal/tracing"
 	"github.com/capsali/virtumancer-flash/internal/ws"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// diagnosticsAddr is the localhost-only listener of the profiler.
+const diagnosticsAddr = "127.0.0.1:6060"
+
 func main() {
 	// Initialize Database
 	db, err := storage.InitDB("virtumancer.db")
@@ -21,6 +30,11 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
+	// Record spans for the queries of traced requests
+	if err := tracing.RegisterGorm(db); err != nil {
+		log.Fatalf("Failed to instrument the database: %v", err)
+	}
+
 	// Initialize WebSocket Hub
 	hub := ws.NewHub()
 	go hub.Run()
@@ -31,9 +45,69 @@ func main() {
 	// Initialize Host Service
 	hostService := services.NewHostService(db, connector, hub)
 
+	// Create the default roles and, on a fresh install, the first admin
+	hostService.EnsureDefaultUsers()
+	// Fill an empty image catalog with common cloud images
+	hostService.EnsureDefaultImageCatalog()
+	// Add hardware presets for common guests on a fresh install
+	hostService.EnsureDefaultHardwarePresets()
+
+	// Turn risky subsystems on or off as configured
+	if err := hostService.ConfigureFeatures(os.Getenv(services.FeaturesEnv)); err != nil {
+		log.Fatalf("Invalid %s: %v", services.FeaturesEnv, err)
+	}
+
+	// Pages of other origins may open WebSockets only when listed
+	ws.SetAllowedOrigins(os.Getenv(ws.AllowedOriginsEnv))
+
+	// Export spans when tracing is enabled
+	hostService.ConfigureTracing()
+
 	// On startup, load all hosts from DB and try to connect
 	hostService.ConnectToAllHosts()
 
+	// Mark tasks and migration jobs cut short by the last shutdown
+	hostService.RecoverInterruptedTasks()
+
+	// Keep storage pool usage and alerts up to date
+	go hostService.StartPoolMonitor(5 * time.Minute)
+
+	// Sample VM resource usage for cost reports
+	go hostService.StartUsageRecorder()
+
+	// Move memory between guests on hosts with a balloon policy
+	go hostService.StartBalloonPolicies(time.Minute)
+
+	// Compact the disks of stopped VMs on hosts with a compaction policy
+	go hostService.StartDiskCompactionPolicies(time.Hour)
+
+	// Trim the filesystems of running VMs on hosts with an fstrim policy
+	go hostService.StartFstrimPolicies(time.Hour)
+
+	// Declare disconnected hosts dead when their fencing check keeps failing
+	go hostService.StartFencingMonitor(time.Minute)
+
+	// Expire old entries of the event history
+	go hostService.StartEventRetention(time.Hour)
+
+	// Delete database rows orphaned by removed VMs and devices
+	go hostService.StartDBGarbageCollection(time.Hour)
+
+	// Email the weekly capacity summary, when enabled
+	go hostService.StartEmailReports(time.Hour)
+
+	// Probe the network for machines to add as hosts, when enabled
+	go hostService.StartDiscovery()
+
+	// Keep the VMs in the database in step with libvirt
+	go hostService.StartPeriodicSync()
+
+	// Pick up VMs defined or undefined on hosts as it happens
+	go hostService.StartDomainEventSync()
+
+	// Keep the red/yellow/green health of hosts and VMs up to date
+	go hostService.StartHealthMonitor(time.Minute)
+
 	// Initialize API Handler
 	apiHandler := api.NewAPIHandler(hostService, hub, db, connector)
 
@@ -44,31 +118,406 @@ func main() {
 
 	// API routes
 	r.Route("/api/v1", func(r chi.Router) {
+		// Every request gets a span, exported once tracing is configured
+		r.Use(tracing.Middleware)
+		// Malformed host IDs and VM names in the path are refused with 422
+		r.Use(apiHandler.ValidatePathNames)
+		// Once a user exists every request needs a session, and once projects
+		// exist, users only reach the resources of their projects
+		r.Use(apiHandler.ScopeProjects)
+		// Retries of POST requests with an Idempotency-Key replay the first
+		// response to the same user, once project access has been checked
+		r.Use(apiHandler.Idempotency)
+
 		r.Get("/health", apiHandler.HealthCheck)
+		r.Get("/capabilities", apiHandler.GetCapabilities)
+
+		// Authentication and the logged-in user's own account
+		r.Post("/auth/login", apiHandler.Login)
+		r.Post("/auth/logout", apiHandler.Logout)
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireSession)
+			r.Get("/me", apiHandler.GetMe)
+			r.Put("/me/password", apiHandler.ChangeMyPassword)
+			r.Get("/me/sessions", apiHandler.GetMySessions)
+			r.Delete("/me/sessions", apiHandler.RevokeMyOtherSessions)
+			r.Delete("/me/sessions/{sessionID}", apiHandler.RevokeMySession)
+
+			// Notifications of the logged-in user
+			r.Get("/notifications", apiHandler.GetNotifications)
+			r.Post("/notifications/read", apiHandler.MarkAllNotificationsRead)
+			r.Post("/notifications/{notificationID}/read", apiHandler.MarkNotificationRead)
+			r.Post("/notifications/{notificationID}/unread", apiHandler.MarkNotificationUnread)
+			r.Delete("/notifications/{notificationID}", apiHandler.DeleteNotification)
+			r.Get("/notifications/subscriptions", apiHandler.GetNotificationSubscriptions)
+			r.Post("/notifications/subscriptions", apiHandler.CreateNotificationSubscription)
+			r.Delete("/notifications/subscriptions/{subscriptionID}", apiHandler.DeleteNotificationSubscription)
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionManageUsers))
+				r.Get("/roles", apiHandler.GetRoles)
+				r.Get("/users", apiHandler.GetUsers)
+				r.Post("/users", apiHandler.CreateUser)
+				r.Get("/users/{userID}", apiHandler.GetUser)
+				r.Delete("/users/{userID}", apiHandler.DeleteUser)
+				r.Put("/users/{userID}/role", apiHandler.SetUserRole)
+				r.Post("/users/{userID}/disable", apiHandler.DisableUser)
+				r.Post("/users/{userID}/enable", apiHandler.EnableUser)
+				r.Post("/users/{userID}/password-reset", apiHandler.ResetUserPassword)
+				r.Put("/users/{userID}/email", apiHandler.SetUserEmail)
+				r.Post("/users/{userID}/unlock", apiHandler.UnlockUser)
+				r.Get("/security/settings", apiHandler.GetSecuritySettings)
+				r.Put("/security/settings", apiHandler.SetSecuritySettings)
+				r.Get("/security/login-attempts", apiHandler.GetLoginAttempts)
+				r.Get("/security/report", apiHandler.GetSecurityReport)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionManageEmail))
+				r.Get("/email/settings", apiHandler.GetEmailSettings)
+				r.Put("/email/settings", apiHandler.SetEmailSettings)
+				r.Post("/email/test", apiHandler.SendTestEmail)
+				r.Post("/email/report", apiHandler.SendCapacityReport)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionManageFeatures))
+				r.Get("/features", apiHandler.GetFeatureFlags)
+				r.Put("/features/{name}", apiHandler.SetFeatureFlag)
+				r.Delete("/features/{name}", apiHandler.ResetFeatureFlag)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionManageCosts))
+				r.Put("/costs/rates", apiHandler.SetCostRates)
+			})
+
+			// Allow-listed commands on hosts, for admins
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionHostExec))
+				r.Get("/host-commands", apiHandler.GetHostCommands)
+				r.Post("/hosts/{hostID}/exec", apiHandler.ExecHostCommand)
+			})
+
+			// Runtime diagnostics and the Go profiler, for admins
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionViewDiagnostics))
+				r.Get("/system/diagnostics", apiHandler.GetRuntimeDiagnostics)
+				r.Get("/system/db/consistency", apiHandler.GetDBConsistency)
+				r.Handle("/debug/pprof/*", http.StripPrefix("/api/v1", apiHandler.Diagnostics()))
+			})
+
+			// Projects; members are managed by project admins as well
+			r.Get("/projects", apiHandler.GetProjects)
+			r.Get("/projects/{projectID}", apiHandler.GetProject)
+			r.Put("/projects/{projectID}/members/{userID}", apiHandler.SetProjectMember)
+			r.Delete("/projects/{projectID}/members/{userID}", apiHandler.RemoveProjectMember)
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequirePermission(services.PermissionManageProjects))
+				r.Post("/projects", apiHandler.CreateProject)
+				r.Delete("/projects/{projectID}", apiHandler.DeleteProject)
+				r.Post("/projects/{projectID}/resources", apiHandler.AssignProjectResource)
+				r.Delete("/projects/{projectID}/resources/{resourceID}", apiHandler.UnassignProjectResource)
+			})
+		})
 
 		// Host routes
-		r.Get("/hosts", apiHandler.GetHosts)
-		r.Post("/hosts", apiHandler.CreateHost)
+		r.With(apiHandler.ETag(apiHandler.HostsTag)).Get("/hosts", apiHandler.GetHosts)
+		r.With(apiHandler.ETag(apiHandler.VMsTag)).Get("/vms", apiHandler.ListVMs)
+		r.Get("/costs/rates", apiHandler.GetCostRates)
+		r.Get("/costs/report", apiHandler.GetCostReport)
+		r.Get("/availability/report", apiHandler.GetAvailabilityReport)
+		r.Get("/export/vms", apiHandler.ExportVMs)
+		r.Get("/export/host-capacity", apiHandler.ExportHostCapacity)
+		r.Get("/export/vm-usage", apiHandler.ExportVMUsage)
+		r.Get("/export/pool-usage", apiHandler.ExportPoolUsage)
+
+		// Side-effect free reads for the Terraform provider
+		r.Get("/terraform/hosts", apiHandler.GetTerraformHosts)
+		r.Get("/terraform/hosts/{id}", apiHandler.GetTerraformHost)
+		r.Get("/terraform/vms", apiHandler.GetTerraformVMs)
+		r.Get("/terraform/vms/{id}", apiHandler.GetTerraformVM)
+		r.Get("/terraform/networks", apiHandler.GetTerraformNetworks)
+		r.Get("/terraform/networks/{id}", apiHandler.GetTerraformNetwork)
+		r.Get("/terraform/volumes", apiHandler.GetTerraformVolumes)
+		r.Get("/terraform/volumes/{id}", apiHandler.GetTerraformVolume)
+
+		// Host discovery, behind its feature flag
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireFeature(services.FeatureDiscovery))
+			r.Get("/discovery", apiHandler.GetDiscovery)
+			r.Post("/discovery/scan", apiHandler.ScanForHosts)
+			r.Get("/discovery/settings", apiHandler.GetDiscoverySettings)
+			r.Put("/discovery/settings", apiHandler.SetDiscoverySettings)
+			r.With(apiHandler.RequireSession, apiHandler.RequirePermission(services.PermissionManageHosts)).Post("/discovery/{address}/adopt", apiHandler.AdoptDiscoveredHost)
+		})
+
+		r.Get("/sync/settings", apiHandler.GetSyncSettings)
+		r.Put("/sync/settings", apiHandler.SetSyncSettings)
+		r.Get("/sync/status", apiHandler.GetSyncStatus)
+		r.Get("/forecast", apiHandler.GetForecast)
+		r.Get("/forecast/settings", apiHandler.GetForecastSettings)
+		r.Put("/forecast/settings", apiHandler.SetForecastSettings)
+		r.Get("/health/settings", apiHandler.GetHealthSettings)
+		r.Put("/health/settings", apiHandler.SetHealthSettings)
+		r.Get("/guests/settings", apiHandler.GetGuestSettings)
+		r.Put("/guests/settings", apiHandler.SetGuestSettings)
 		r.Get("/hosts/{hostID}/info", apiHandler.GetHostInfo)
-		r.Delete("/hosts/{hostID}", apiHandler.DeleteHost)
+
+		// Adding, removing and powering hosts, for admins
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireSession)
+			r.Use(apiHandler.RequirePermission(services.PermissionManageHosts))
+			r.Post("/hosts", apiHandler.CreateHost)
+			r.Post("/hosts/prepare", apiHandler.PrepareHost)
+			r.Delete("/hosts/{hostID}", apiHandler.DeleteHost)
+			r.Put("/hosts/{hostID}/name", apiHandler.RenameHost)
+			r.Post("/hosts/{hostID}/maintenance", apiHandler.SetHostMaintenance)
+			r.Post("/hosts/{hostID}/evacuate", apiHandler.EvacuateHost)
+			r.Post("/hosts/{hostID}/power/prepare", apiHandler.PrepareHostPower)
+			r.Post("/hosts/{hostID}/power", apiHandler.ExecuteHostPower)
+		})
+
+		r.Put("/hosts/{hostID}/reservation", apiHandler.SetHostReservation)
+		r.Get("/hosts/{hostID}/capacity", apiHandler.GetHostCapacity)
+		r.Put("/hosts/{hostID}/startup", apiHandler.SetHostStartup)
+		r.Get("/hosts/{hostID}/startup/preview", apiHandler.PreviewHostStartup)
+
+		// Balloon policies, behind the auto-ballooning feature flag
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireFeature(services.FeatureAutoBallooning))
+			r.Get("/hosts/{hostID}/balloon-policy", apiHandler.GetBalloonPolicy)
+			r.Put("/hosts/{hostID}/balloon-policy", apiHandler.SetBalloonPolicy)
+		})
+
+		r.Get("/hosts/{hostID}/disk-compaction-policy", apiHandler.GetDiskCompactionPolicy)
+		r.Put("/hosts/{hostID}/disk-compaction-policy", apiHandler.SetDiskCompactionPolicy)
+		r.Get("/hosts/{hostID}/fstrim-policy", apiHandler.GetFstrimPolicy)
+		r.Put("/hosts/{hostID}/fstrim-policy", apiHandler.SetFstrimPolicy)
+		r.Get("/hosts/{hostID}/ksm", apiHandler.GetKSM)
+		r.Put("/hosts/{hostID}/ksm", apiHandler.SetKSM)
+		r.Get("/hosts/{hostID}/sev", apiHandler.GetHostSEV)
+		r.Get("/hosts/{hostID}/machine-types", apiHandler.GetMachineTypes)
+
+		// Fencing and recovery, behind the HA feature flag
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireFeature(services.FeatureHA))
+			r.Get("/hosts/{hostID}/fencing", apiHandler.GetHostFencing)
+			r.Put("/hosts/{hostID}/fencing", apiHandler.SetHostFencing)
+			r.Get("/hosts/{hostID}/recovery", apiHandler.GetHostRecovery)
+			r.Group(func(r chi.Router) {
+				r.Use(apiHandler.RequireSession)
+				r.Use(apiHandler.RequirePermission(services.PermissionManageHosts))
+				r.Post("/hosts/{hostID}/fence/prepare", apiHandler.PrepareHostFence)
+				r.Post("/hosts/{hostID}/fence", apiHandler.FenceHost)
+				r.Post("/hosts/{hostID}/recovery", apiHandler.RecoverHostVMs)
+			})
+		})
+
+		// Storage pool routes
+		r.Get("/hosts/{hostID}/pools", apiHandler.GetStoragePools)
+		r.Post("/hosts/{hostID}/pools/refresh", apiHandler.RefreshStoragePools)
+		r.Get("/hosts/{hostID}/pools/{poolName}/usage", apiHandler.GetStoragePoolUsage)
+		r.Put("/hosts/{hostID}/pools/{poolName}/thresholds", apiHandler.SetStoragePoolThresholds)
+		r.Post("/hosts/{hostID}/pools/{poolName}/autostart", apiHandler.SetStoragePoolAutostart)
+		r.Post("/hosts/{hostID}/pools/{poolName}/active", apiHandler.SetStoragePoolActive)
+		r.Get("/hosts/{hostID}/pools/{poolName}/volumes", apiHandler.GetVolumes)
+		r.Get("/hosts/{hostID}/pools/{poolName}/volumes/{volName}/download", apiHandler.DownloadVolume)
+		r.Post("/hosts/{hostID}/pools/{poolName}/volumes/{volName}/upload", apiHandler.UploadVolume)
+		r.Post("/hosts/{hostID}/pools/{poolName}/images", apiHandler.DownloadCatalogImage)
+		r.Get("/hosts/{hostID}/pools/{poolName}/orphans", apiHandler.GetOrphanedVolumes)
+		r.Post("/hosts/{hostID}/pools/{poolName}/orphans/{volName}/attach", apiHandler.AdoptOrphanedVolume)
+		r.Get("/hosts/{hostID}/pools/{poolName}/files", apiHandler.GetPoolFiles)
+		r.Get("/hosts/{hostID}/pools/{poolName}/files/stat", apiHandler.GetPoolFile)
+		// Deleting what is stored in pools, for admins and operators
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireSession)
+			r.Use(apiHandler.RequirePermission(services.PermissionManageStorage))
+			r.Delete("/hosts/{hostID}/pools/{poolName}/volumes/{volName}", apiHandler.DeleteVolume)
+			r.Delete("/hosts/{hostID}/pools/{poolName}/files", apiHandler.DeletePoolFile)
+			r.Post("/hosts/{hostID}/pools/{poolName}/files/rename", apiHandler.RenamePoolFile)
+		})
+		r.Get("/image-catalog", apiHandler.GetCatalogImages)
+		r.Post("/image-catalog", apiHandler.CreateCatalogImage)
+		r.Put("/image-catalog/{imageName}", apiHandler.UpdateCatalogImage)
+		r.Delete("/image-catalog/{imageName}", apiHandler.DeleteCatalogImage)
+		r.Get("/hardware-presets", apiHandler.GetHardwarePresets)
+		r.Post("/hardware-presets", apiHandler.CreateHardwarePreset)
+		r.Get("/hardware-presets/{presetName}", apiHandler.GetHardwarePreset)
+		r.Put("/hardware-presets/{presetName}", apiHandler.UpdateHardwarePreset)
+		r.Delete("/hardware-presets/{presetName}", apiHandler.DeleteHardwarePreset)
+		r.Get("/alerts", apiHandler.GetAlerts)
+		r.Get("/maintenance-windows", apiHandler.GetMaintenanceWindows)
+		r.Post("/maintenance-windows", apiHandler.CreateMaintenanceWindow)
+		r.Get("/maintenance-windows/{windowName}", apiHandler.GetMaintenanceWindow)
+		r.Put("/maintenance-windows/{windowName}", apiHandler.UpdateMaintenanceWindow)
+		r.Delete("/maintenance-windows/{windowName}", apiHandler.DeleteMaintenanceWindow)
+
+		// Network routes
+		r.Get("/hosts/{hostID}/networks", apiHandler.GetNetworks)
+		r.Post("/hosts/{hostID}/networks", apiHandler.CreateNetwork)
+		r.Delete("/hosts/{hostID}/networks/{networkName}", apiHandler.DeleteNetwork)
+		r.Post("/hosts/{hostID}/networks/{networkName}/autostart", apiHandler.SetNetworkAutostart)
+		r.Post("/hosts/{hostID}/networks/{networkName}/active", apiHandler.SetNetworkActive)
+		r.Get("/hosts/{hostID}/secrets", apiHandler.GetSecrets)
+		r.Post("/hosts/{hostID}/secrets", apiHandler.CreateSecret)
+		r.Get("/hosts/{hostID}/secrets/{secretID}", apiHandler.GetSecret)
+		r.Delete("/hosts/{hostID}/secrets/{secretID}", apiHandler.DeleteSecret)
+
+		// MAC address routes
+		r.Get("/network/mac-pool", apiHandler.GetMACPool)
+		r.Put("/network/mac-pool", apiHandler.SetMACPool)
+		r.Get("/network/mac-conflicts", apiHandler.GetMACConflicts)
+
+		// Placement rules
+		r.Get("/placement-rules", apiHandler.GetPlacementRules)
+		r.Post("/placement-rules", apiHandler.CreatePlacementRule)
+		r.Get("/placement-rules/violations", apiHandler.GetPlacementViolations)
+		r.Put("/placement-rules/{ruleName}", apiHandler.UpdatePlacementRule)
+		r.Delete("/placement-rules/{ruleName}", apiHandler.DeletePlacementRule)
+		r.Get("/hosts/{hostID}/vms/{vmName}/placement-check", apiHandler.CheckVMPlacement)
+
+		// VM dependencies and orchestrated group start/stop
+		r.Get("/dependencies", apiHandler.GetVMDependencies)
+		r.Post("/dependencies", apiHandler.CreateVMDependency)
+		r.Delete("/dependencies/{dependencyID}", apiHandler.DeleteVMDependency)
+		r.Post("/orchestration/{action}", apiHandler.StartOrchestration)
+		r.Post("/orchestration/{action}/plan", apiHandler.PlanOrchestration)
+
+		// VM groups: VMs started, stopped and snapshotted as a unit
+		r.Get("/vm-groups", apiHandler.GetVMGroups)
+		r.Post("/vm-groups", apiHandler.CreateVMGroup)
+		r.Get("/vm-groups/{groupName}", apiHandler.GetVMGroup)
+		r.Put("/vm-groups/{groupName}", apiHandler.UpdateVMGroup)
+		r.Delete("/vm-groups/{groupName}", apiHandler.DeleteVMGroup)
+		r.Post("/vm-groups/{groupName}/members", apiHandler.AddVMGroupMember)
+		r.Delete("/vm-groups/{groupName}/members/{vmUUID}", apiHandler.RemoveVMGroupMember)
+		r.Post("/vm-groups/{groupName}/snapshot", apiHandler.SnapshotVMGroup)
+		r.Get("/vm-groups/{groupName}/stats", apiHandler.GetVMGroupStats)
+		r.Post("/vm-groups/{groupName}/{action}", apiHandler.VMGroupAction)
+
+		// Runbooks: steps of VM actions run as a task
+		r.Get("/runbooks", apiHandler.GetRunbooks)
+		r.Post("/runbooks", apiHandler.CreateRunbook)
+		r.Get("/runbooks/{runbookName}", apiHandler.GetRunbook)
+		r.Put("/runbooks/{runbookName}", apiHandler.UpdateRunbook)
+		r.Delete("/runbooks/{runbookName}", apiHandler.DeleteRunbook)
+		r.Post("/runbooks/{runbookName}/run", apiHandler.RunRunbook)
+		r.Get("/runbooks/{runbookName}/runs", apiHandler.GetRunbookRuns)
+		r.Get("/runbook-runs/{runID}", apiHandler.GetRunbookRun)
+
+		// Monitoring routes
+		r.Get("/monitoring", apiHandler.GetMonitoringSettings)
+		r.Put("/monitoring", apiHandler.SetMonitoringSettings)
+		r.Put("/hosts/{hostID}/monitoring", apiHandler.SetHostMonitoring)
+		r.Get("/hosts/{hostID}/vms/{vmName}/monitoring", apiHandler.GetVMMonitoring)
+		r.Put("/hosts/{hostID}/vms/{vmName}/monitoring", apiHandler.SetVMMonitoring)
 
 		// VM routes
-		r.Get("/hosts/{hostID}/vms", apiHandler.ListVMsFromLibvirt)
+		r.With(apiHandler.ETag(apiHandler.HostVMsTag)).Get("/hosts/{hostID}/vms", apiHandler.ListVMsFromLibvirt)
+		r.Post("/hosts/{hostID}/refresh", apiHandler.RefreshHostVMs)
+		r.Post("/hosts/{hostID}/vms/{vmName}/refresh", apiHandler.RefreshVM)
+		r.Post("/hosts/{hostID}/vms", apiHandler.CreateVM)
 		r.Post("/hosts/{hostID}/vms/{vmName}/start", apiHandler.StartVM)
 		r.Post("/hosts/{hostID}/vms/{vmName}/shutdown", apiHandler.ShutdownVM)
 		r.Post("/hosts/{hostID}/vms/{vmName}/reboot", apiHandler.RebootVM)
 		r.Post("/hosts/{hostID}/vms/{vmName}/forceoff", apiHandler.ForceOffVM)
 		r.Post("/hosts/{hostID}/vms/{vmName}/forcereset", apiHandler.ForceResetVM)
 		r.Get("/hosts/{hostID}/vms/{vmName}/stats", apiHandler.GetVMStats)
-		r.Get("/hosts/{hostID}/vms/{vmName}/hardware", apiHandler.GetVMHardware)
+		r.Get("/hosts/{hostID}/vms/{vmName}/availability", apiHandler.GetVMAvailability)
+		r.With(apiHandler.ETag(apiHandler.VMHardwareTag)).Get("/hosts/{hostID}/vms/{vmName}/hardware", apiHandler.GetVMHardware)
+		r.Get("/hosts/{hostID}/vms/{vmName}/capabilities", apiHandler.GetVMCapabilities)
+		r.Get("/hosts/{hostID}/vms/{vmName}/screenshot", apiHandler.GetVMScreenshot)
+		r.Get("/hosts/{hostID}/vms/{vmName}/process", apiHandler.GetVMProcessUsage)
+		r.Get("/hosts/{hostID}/vms/{vmName}/fields", apiHandler.GetVMCustomFields)
+		r.Put("/hosts/{hostID}/vms/{vmName}/fields", apiHandler.ReplaceVMCustomFields)
+		r.Put("/hosts/{hostID}/vms/{vmName}/fields/{name}", apiHandler.SetVMCustomField)
+		r.Delete("/hosts/{hostID}/vms/{vmName}/fields/{name}", apiHandler.DeleteVMCustomField)
+		r.Get("/hosts/{hostID}/vms/{vmName}/labels", apiHandler.GetVMLabels)
+		r.Put("/hosts/{hostID}/vms/{vmName}/labels", apiHandler.ReplaceVMLabels)
+		r.Put("/hosts/{hostID}/vms/{vmName}/labels/{key}", apiHandler.SetVMLabel)
+		r.Delete("/hosts/{hostID}/vms/{vmName}/labels/{key}", apiHandler.DeleteVMLabel)
+		// Spec edits name the VM version they are based on in If-Match
+		r.With(apiHandler.RequireVMVersion).Put("/hosts/{hostID}/vms/{vmName}/startup", apiHandler.SetVMStartup)
+		r.Get("/hosts/{hostID}/vms/{vmName}/tuning", apiHandler.GetVMTuning)
+		r.With(apiHandler.RequireVMVersion).Put("/hosts/{hostID}/vms/{vmName}/tuning", apiHandler.SetVMTuning)
+		r.With(apiHandler.RequireFeature(services.FeatureAutoBallooning), apiHandler.RequireVMVersion).Put("/hosts/{hostID}/vms/{vmName}/balloon-guarantee", apiHandler.SetVMBalloonGuarantee)
+		r.With(apiHandler.RequireVMVersion).Put("/hosts/{hostID}/vms/{vmName}/evacuation", apiHandler.SetVMEvacuation)
+		r.Get("/hosts/{hostID}/vms/{vmName}/launch-security", apiHandler.GetVMLaunchSecurity)
+		r.With(apiHandler.RequireVMVersion).Put("/hosts/{hostID}/vms/{vmName}/launch-security", apiHandler.SetVMLaunchSecurity)
+		r.Get("/hosts/{hostID}/vms/{vmName}/machine-type", apiHandler.GetVMMachineType)
+		r.With(apiHandler.RequireVMVersion).Post("/hosts/{hostID}/vms/{vmName}/machine-type/upgrade", apiHandler.UpgradeVMMachineType)
+		r.With(apiHandler.RequireVMVersion).Post("/hosts/{hostID}/vms/{vmName}/machine-type/rollback", apiHandler.RollbackVMMachineType)
+		r.Get("/hosts/{hostID}/vms/{vmName}/definitions", apiHandler.GetVMDefinitions)
+		r.Get("/hosts/{hostID}/vms/{vmName}/definitions/{version}", apiHandler.GetVMDefinition)
+		r.Get("/hosts/{hostID}/vms/{vmName}/definitions/{version}/diff", apiHandler.DiffVMDefinition)
+		r.With(apiHandler.RequireVMVersion).Post("/hosts/{hostID}/vms/{vmName}/definitions/{version}/restore", apiHandler.RestoreVMDefinition)
+		r.With(apiHandler.RequireVMVersion).Post("/hosts/{hostID}/vms/{vmName}/disks", apiHandler.AttachDisk)
+		r.Post("/hosts/{hostID}/vms/{vmName}/disks/compact", apiHandler.CompactVMDisks)
+		r.Post("/hosts/{hostID}/vms/{vmName}/fstrim", apiHandler.TrimVMFilesystems)
+		r.With(apiHandler.RequireVMVersion).Post("/hosts/{hostID}/vms/{vmName}/nics", apiHandler.AttachNIC)
+		r.Get("/hosts/{hostID}/vms/{vmName}/disks/{target}/chain", apiHandler.GetDiskBackingChain)
+		r.Get("/hosts/{hostID}/vms/{vmName}/snapshots", apiHandler.GetSnapshots)
+		r.Post("/hosts/{hostID}/vms/{vmName}/snapshots", apiHandler.CreateSnapshot)
+		r.Get("/hosts/{hostID}/vms/{vmName}/snapshots/estimate", apiHandler.EstimateSnapshot)
+		r.Post("/hosts/{hostID}/vms/{vmName}/snapshots/{snapshot}/revert", apiHandler.RevertSnapshot)
+		r.Delete("/hosts/{hostID}/vms/{vmName}/snapshots/{snapshot}", apiHandler.DeleteSnapshot)
+		r.Get("/hosts/{hostID}/vms/{vmName}/graphics-password", apiHandler.GetGraphicsPassword)
+		r.Put("/hosts/{hostID}/vms/{vmName}/graphics-password", apiHandler.SetGraphicsPassword)
+		r.Delete("/hosts/{hostID}/vms/{vmName}/graphics-password", apiHandler.RevokeGraphicsPassword)
+		r.Post("/hosts/{hostID}/vms/{vmName}/migrate/precheck", apiHandler.PrecheckMigration)
+		r.Post("/hosts/{hostID}/vms/{vmName}/migrate/cold", apiHandler.StartColdMigration)
+		r.Post("/hosts/{hostID}/vms/{vmName}/migrate/live", apiHandler.StartLiveMigration)
+		r.Put("/hosts/{hostID}/vms/{vmName}/migrate/live", apiHandler.UpdateLiveMigration)
+		r.Delete("/hosts/{hostID}/vms/{vmName}/migrate/live", apiHandler.AbortLiveMigration)
+
+		// Migration jobs
+		r.Get("/migrations", apiHandler.GetMigrationJobs)
+		r.Get("/migrations/{jobID}", apiHandler.GetMigrationJob)
+		r.Post("/migrations/{jobID}/resume", apiHandler.ResumeMigrationJob)
+		r.Delete("/migrations/{jobID}", apiHandler.DiscardMigrationJob)
+
+		// Packet captures and their artifacts, for admins
+		r.Group(func(r chi.Router) {
+			r.Use(apiHandler.RequireSession)
+			r.Use(apiHandler.RequirePermission(services.PermissionManageCaptures))
+			r.Post("/hosts/{hostID}/vms/{vmName}/captures", apiHandler.StartPacketCapture)
+			r.Get("/captures", apiHandler.GetPacketCaptures)
+			r.Get("/captures/{captureID}/download", apiHandler.DownloadPacketCapture)
+			r.Delete("/captures/{captureID}", apiHandler.DeletePacketCapture)
+		})
+
+		// System routes
+		r.Get("/system/database", apiHandler.GetDatabaseStats)
+		r.Get("/system/connections", apiHandler.GetConnectionStats)
+		r.Get("/system/tracing", apiHandler.GetTracingSettings)
+		r.Put("/system/tracing", apiHandler.SetTracingSettings)
+
+		// Event history
+		r.Get("/events/history", apiHandler.GetEventHistory)
+
+		// Task routes
+		r.Get("/tasks", apiHandler.GetTasks)
+		r.Get("/tasks/{taskID}", apiHandler.GetTask)
+
+		// Reverse tunnel for agent-transport hosts
+		r.Get("/agent/connect", apiHandler.HandleAgentConnect)
 
 		// Console routes
 		r.Get("/hosts/{hostID}/vms/{vmName}/console", apiHandler.HandleVMConsole)
 		r.Get("/hosts/{hostID}/vms/{vmName}/spice", apiHandler.HandleSpiceConsole)
+		r.Get("/hosts/{hostID}/vms/{vmName}/displays", apiHandler.GetVMDisplays)
+		r.Get("/hosts/{hostID}/vms/{vmName}/console-info", apiHandler.GetConsoleInfo)
+		r.Get("/console/sessions", apiHandler.GetConsoleSessions)
+		r.Get("/console/settings", apiHandler.GetConsoleSettings)
+		r.Put("/console/settings", apiHandler.SetConsoleSettings)
 	})
 
 	// WebSocket route for UI updates
-	r.HandleFunc("/ws", apiHandler.HandleWebSocket)
+	r.With(apiHandler.ScopeProjects).HandleFunc("/ws", apiHandler.HandleWebSocket)
+
+	// Prometheus scrape endpoint
+	r.Get("/metrics", apiHandler.Metrics)
 
 	// Static File Server for the Vue App
 	workDir, _ := os.Getwd()
@@ -86,11 +535,39 @@ func main() {
 		}
 	})
 
+	// Profiler and runtime diagnostics for the host itself, without login
+	go func() {
+		log.Printf("Serving diagnostics on http://%s/debug/pprof/", diagnosticsAddr)
+		if err := http.ListenAndServe(diagnosticsAddr, apiHandler.Diagnostics()); err != nil {
+			log.Printf("Could not serve diagnostics: %v", err)
+		}
+	}()
+
 	certFile := "localhost.crt"
 	keyFile := "localhost.key"
 
+	server := &http.Server{Addr: ":8888", Handler: r}
+
+	// On SIGINT or SIGTERM, disconnect the WebSocket clients and let the
+	// requests in flight finish
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Println("Shutting down")
+		hub.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: requests were cut short by the shutdown: %v", err)
+		}
+	}()
+
 	log.Println("Starting HTTPS server on :8888")
-	err = http.ListenAndServeTLS(":8888", certFile, keyFile, r)
+	err = server.ListenAndServeTLS(certFile, keyFile)
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
 	if err != nil {
 		log.Printf("Could not start HTTPS server: %v", err)
 		log.Println("Please ensure 'localhost.crt' and 'localhost.key' are present in the root directory.")
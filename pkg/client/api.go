@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// User is the account behind a session.
+type User struct {
+	ID                 uint      `json:"id"`
+	Username           string    `json:"username"`
+	Role               string    `json:"role"`
+	Permissions        []string  `json:"permissions"`
+	CreatedAt          time.Time `json:"created_at"`
+	MustChangePassword bool      `json:"must_change_password"`
+}
+
+// Session is the result of a login.
+type Session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      *User     `json:"user"`
+}
+
+// Host is a hypervisor managed by Virtumancer.
+type Host struct {
+	ID                   string  `json:"id"`
+	Name                 string  `json:"name"`
+	URI                  string  `json:"uri"`
+	Driver               string  `json:"driver"`
+	ProxyJump            string  `json:"proxy_jump,omitempty"`
+	MaintenanceMode      bool    `json:"maintenance_mode"`
+	StatsIntervalSeconds float64 `json:"stats_interval_seconds"`
+	MaxConcurrentRPCs    int     `json:"max_concurrent_rpcs"`
+	// Health is 'green', 'yellow' or 'red'; the reasons say why it is not
+	// green.
+	Health        string         `json:"health"`
+	HealthReasons []HealthReason `json:"health_reasons"`
+	// AgentToken is only set on the host returned by AddHost for agent
+	// transport hosts.
+	AgentToken string `json:"agent_token,omitempty"`
+}
+
+// VM is a virtual machine as listed for its host.
+type VM struct {
+	ID          uint              `json:"db_id"`
+	HostID      string            `json:"host_id"`
+	Name        string            `json:"name"`
+	UUID        string            `json:"uuid"`
+	DomainUUID  string            `json:"domain_uuid"`
+	Description string            `json:"description"`
+	VCPUCount   uint              `json:"vcpu_count"`
+	MemoryBytes uint64            `json:"memory_bytes"`
+	IsTemplate  bool              `json:"is_template"`
+	OSType      string            `json:"os_type"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	ProjectID   uint              `json:"project_id"`
+	// Health is 'green', 'yellow' or 'red'; the reasons say why it is not
+	// green.
+	Health        string         `json:"health"`
+	HealthReasons []HealthReason `json:"health_reasons"`
+}
+
+// HealthReason is a failed health check of a host or VM.
+type HealthReason struct {
+	Check   string `json:"check"` // e.g. 'state', 'guest-agent' or 'disk-full'
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// VMPage is one page of a host's VMs, see ListVMsPage.
+type VMPage struct {
+	VMs      []VM   `json:"vms"`
+	Continue string `json:"continue,omitempty"` // Empty on the last page
+	Partial  bool   `json:"partial"`
+	Total    int    `json:"total"`
+}
+
+// CreateVMRequest describes a new VM. Fields left empty take the server's
+// defaults or the preset's values.
+type CreateVMRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Preset      string `json:"preset,omitempty"`
+	Profile     string `json:"profile,omitempty"` // 'linux' or 'windows'
+	VCPUs       uint   `json:"vcpus,omitempty"`
+	MemoryBytes uint64 `json:"memory_bytes,omitempty"`
+	Firmware    string `json:"firmware,omitempty"` // 'bios' or 'efi'
+	// Disk, install media and NICs in the API's format, see API.md.
+	Disk       json.RawMessage `json:"disk,omitempty"`
+	InstallISO json.RawMessage `json:"install_iso,omitempty"`
+	NICs       json.RawMessage `json:"nics,omitempty"`
+}
+
+// CreatedVM is the VM defined by CreateVM.
+type CreatedVM struct {
+	Name       string   `json:"name"`
+	Preset     string   `json:"preset,omitempty"`
+	Profile    string   `json:"profile"`
+	Firmware   string   `json:"firmware"`
+	SecureBoot bool     `json:"secure_boot"`
+	TPM        bool     `json:"tpm"`
+	CDROMs     []string `json:"cdroms"`
+	Warnings   []string `json:"warnings"`
+}
+
+// VM states as reported in VMStats.State, following libvirt's domain states.
+const (
+	DomainNoState     = 0
+	DomainRunning     = 1
+	DomainBlocked     = 2
+	DomainPaused      = 3
+	DomainShutdown    = 4
+	DomainShutoff     = 5
+	DomainCrashed     = 6
+	DomainPMSuspended = 7
+)
+
+// VMStats are the live statistics of a VM.
+type VMStats struct {
+	State     int            `json:"state"` // One of the Domain* constants
+	Memory    uint64         `json:"memory"`
+	MaxMem    uint64         `json:"max_mem"`
+	Vcpu      uint           `json:"vcpu"`
+	CpuTime   uint64         `json:"cpu_time"` // Nanoseconds
+	DiskStats []DeviceStats  `json:"disk_stats"`
+	NetStats  []DeviceStats  `json:"net_stats"`
+	Guest     []GuestFSUsage `json:"guest_filesystems,omitempty"`
+}
+
+// DeviceStats are the I/O counters of a disk or network interface.
+type DeviceStats struct {
+	Device     string `json:"device"`
+	ReadBytes  int64  `json:"read_bytes"`
+	WriteBytes int64  `json:"write_bytes"`
+}
+
+// GuestFSUsage is the usage of a filesystem inside the guest, as reported
+// by its guest agent.
+type GuestFSUsage struct {
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	TotalBytes uint64 `json:"total_bytes"`
+	UsedBytes  uint64 `json:"used_bytes"`
+}
+
+// Task is a long-running operation, e.g. a migration.
+type Task struct {
+	ID        uint           `json:"ID"`
+	CreatedAt time.Time      `json:"CreatedAt"`
+	UpdatedAt time.Time      `json:"UpdatedAt"`
+	UserID    uint           `json:"user_id"`
+	Type      string         `json:"type"`
+	Status    string         `json:"status"`   // PENDING, RUNNING, COMPLETED, FAILED or INTERRUPTED
+	Progress  int            `json:"progress"` // 0-100
+	Details   string         `json:"details"`
+	Error     string         `json:"error,omitempty"`
+	Metrics   map[string]any `json:"metrics,omitempty"`
+}
+
+// Done reports whether the task has finished, successfully or not.
+func (t *Task) Done() bool {
+	switch t.Status {
+	case "COMPLETED", "FAILED", "INTERRUPTED":
+		return true
+	}
+	return false
+}
+
+// Login opens a session. Later requests of the client use its token.
+func (c *Client) Login(ctx context.Context, username, password string) (*Session, error) {
+	var session Session
+	req := map[string]string{"username": username, "password": password}
+	if err := c.do(ctx, http.MethodPost, c.endpoint("auth", "login"), req, &session); err != nil {
+		return nil, err
+	}
+	c.setToken(session.Token)
+	return &session, nil
+}
+
+// Logout ends the client's session.
+func (c *Client) Logout(ctx context.Context) error {
+	if err := c.do(ctx, http.MethodPost, c.endpoint("auth", "logout"), nil, nil); err != nil {
+		return err
+	}
+	c.setToken("")
+	return nil
+}
+
+// ListHosts returns the hosts the user can see.
+func (c *Client) ListHosts(ctx context.Context) ([]Host, error) {
+	var hosts []Host
+	if err := c.do(ctx, http.MethodGet, c.endpoint("hosts"), nil, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// AddHost connects a new hypervisor, e.g. {Name: "kvm-01", URI:
+// "qemu+ssh://root@kvm-01/system"}.
+func (c *Client) AddHost(ctx context.Context, host Host) (*Host, error) {
+	var created Host
+	if err := c.do(ctx, http.MethodPost, c.endpoint("hosts"), host, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// DeleteHost disconnects a host and forgets it.
+func (c *Client) DeleteHost(ctx context.Context, hostID string) error {
+	return c.do(ctx, http.MethodDelete, c.endpoint("hosts", hostID), nil, nil)
+}
+
+// ListVMs returns all VMs of a host. Hosts can be given by ID or name.
+func (c *Client) ListVMs(ctx context.Context, hostID string) ([]VM, error) {
+	var vms []VM
+	if err := c.do(ctx, http.MethodGet, c.endpoint("hosts", hostID, "vms"), nil, &vms); err != nil {
+		return nil, err
+	}
+	return vms, nil
+}
+
+// ListVMsPage reads one page of a host's VMs live from libvirt. Pass the
+// previous page's Continue token, or "" for the first page.
+func (c *Client) ListVMsPage(ctx context.Context, hostID, continueToken string, limit int) (*VMPage, error) {
+	u := c.endpoint("hosts", hostID, "vms")
+	query := u.Query()
+	query.Set("continue", continueToken)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	u.RawQuery = query.Encode()
+	var page VMPage
+	if err := c.do(ctx, http.MethodGet, u, nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// CreateVM defines a new VM on a host.
+func (c *Client) CreateVM(ctx context.Context, hostID string, req CreateVMRequest) (*CreatedVM, error) {
+	var vm CreatedVM
+	if err := c.do(ctx, http.MethodPost, c.endpoint("hosts", hostID, "vms"), req, &vm); err != nil {
+		return nil, err
+	}
+	return &vm, nil
+}
+
+// StartVM starts a VM.
+func (c *Client) StartVM(ctx context.Context, hostID, vmName string) error {
+	return c.powerAction(ctx, hostID, vmName, "start")
+}
+
+// ShutdownVM asks the guest to shut down.
+func (c *Client) ShutdownVM(ctx context.Context, hostID, vmName string) error {
+	return c.powerAction(ctx, hostID, vmName, "shutdown")
+}
+
+// RebootVM asks the guest to reboot.
+func (c *Client) RebootVM(ctx context.Context, hostID, vmName string) error {
+	return c.powerAction(ctx, hostID, vmName, "reboot")
+}
+
+// ForceOffVM stops a VM at once, like pulling its plug.
+func (c *Client) ForceOffVM(ctx context.Context, hostID, vmName string) error {
+	return c.powerAction(ctx, hostID, vmName, "forceoff")
+}
+
+// ForceResetVM resets a VM at once, like pressing its reset button.
+func (c *Client) ForceResetVM(ctx context.Context, hostID, vmName string) error {
+	return c.powerAction(ctx, hostID, vmName, "forcereset")
+}
+
+func (c *Client) powerAction(ctx context.Context, hostID, vmName, action string) error {
+	return c.do(ctx, http.MethodPost, c.endpoint("hosts", hostID, "vms", vmName, action), nil, nil)
+}
+
+// GetVMStats returns a VM's current statistics. See StreamVMStats for
+// updates as they are polled.
+func (c *Client) GetVMStats(ctx context.Context, hostID, vmName string) (*VMStats, error) {
+	var stats VMStats
+	if err := c.do(ctx, http.MethodGet, c.endpoint("hosts", hostID, "vms", vmName, "stats"), nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// GetVMHardware returns a VM's disks and network interfaces in the API's
+// format, see API.md.
+func (c *Client) GetVMHardware(ctx context.Context, hostID, vmName string) (json.RawMessage, error) {
+	var hardware json.RawMessage
+	if err := c.do(ctx, http.MethodGet, c.endpoint("hosts", hostID, "vms", vmName, "hardware"), nil, &hardware); err != nil {
+		return nil, err
+	}
+	return hardware, nil
+}
+
+// GetTask returns a task.
+func (c *Client) GetTask(ctx context.Context, taskID uint) (*Task, error) {
+	var task Task
+	if err := c.do(ctx, http.MethodGet, c.endpoint("tasks", strconv.FormatUint(uint64(taskID), 10)), nil, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// WaitTask polls a task every interval until it is done or ctx ends.
+func (c *Client) WaitTask(ctx context.Context, taskID uint, interval time.Duration) (*Task, error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		task, err := c.GetTask(ctx, taskID)
+		if err != nil {
+			return nil, err
+		}
+		if task.Done() {
+			return task, nil
+		}
+		select {
+		case <-ctx.Done():
+			return task, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package client is a Go client for the Virtumancer API. It wraps the REST
+// endpoints under /api/v1 in typed methods, streams VM stats from the UI
+// WebSocket and dials VM consoles, so other Go programs can drive
+// Virtumancer without hand-rolling HTTP calls.
+//
+//	c, err := client.New("https://virtumancer.example.com")
+//	if err != nil { ... }
+//	if _, err := c.Login(ctx, "admin", password); err != nil { ... }
+//	vms, err := c.ListVMs(ctx, "kvm-01")
+//
+// The package only depends on the wire format of the API, not on the
+// server's internal packages.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Client talks to one Virtumancer server. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests, e.g. one trusting
+// the server's self-signed certificate. Its transport's TLS settings are
+// also used for WebSocket connections.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken authenticates requests with an existing session token instead
+// of calling Login.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "https://virtumancer.example.com".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q: must be an http:// or https:// URL", baseURL)
+	}
+	c := &Client{baseURL: u, httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Token returns the session token the client sends, e.g. to store it for a
+// later WithToken.
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+func (c *Client) setToken(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// APIError is an error response of the API.
+type APIError struct {
+	StatusCode int           `json:"-"`
+	Message    string        `json:"error"`
+	Libvirt    *LibvirtError `json:"libvirt,omitempty"` // Set when the error came from a libvirt daemon
+	Fields     []FieldError  `json:"fields,omitempty"`  // Set for 422 responses to invalid requests
+}
+
+// LibvirtError describes an error reported by a libvirt daemon.
+type LibvirtError struct {
+	Code int    `json:"code"`
+	Name string `json:"name,omitempty"`
+	Kind string `json:"kind"`
+}
+
+// FieldError names an invalid field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if len(e.Fields) > 0 {
+		parts := make([]string, len(e.Fields))
+		for i, f := range e.Fields {
+			parts[i] = f.Field + ": " + f.Message
+		}
+		return fmt.Sprintf("virtumancer: %d %s (%s)", e.StatusCode, e.Message, strings.Join(parts, "; "))
+	}
+	return fmt.Sprintf("virtumancer: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is an API error with status 404.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an API error with status 409.
+func IsConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
+
+// endpoint returns the URL of an API path, escaping each path segment.
+func (c *Client) endpoint(segments ...string) *url.URL {
+	escaped := make([]string, len(segments))
+	for i, s := range segments {
+		escaped[i] = url.PathEscape(s)
+	}
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/" + strings.Join(segments, "/")
+	u.RawPath = strings.TrimSuffix(c.baseURL.EscapedPath(), "/") + "/api/v1/" + strings.Join(escaped, "/")
+	return &u
+}
+
+// do sends a request with an optional JSON body and decodes a JSON response
+// into out, unless out is nil.
+func (c *Client) do(ctx context.Context, method string, u *url.URL, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", method, u.Path, err)
+	}
+	return nil
+}
+
+// decodeError reads the API's error envelope. Responses without one, e.g.
+// from a proxy in front of the server, keep their status text.
+func decodeError(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err := json.Unmarshal(data, apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+	}
+	return apiErr
+}
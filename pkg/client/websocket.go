@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket opens a WebSocket to a path of the server, authenticated
+// with the client's session token.
+func (c *Client) dialWebSocket(ctx context.Context, u *url.URL, subprotocols ...string) (*websocket.Conn, error) {
+	wsURL := *u
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 30 * time.Second,
+		Subprotocols:     subprotocols,
+	}
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+		dialer.Proxy = transport.Proxy
+	}
+	header := http.Header{}
+	if token := c.Token(); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsURL.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 300 {
+			defer resp.Body.Close()
+			return nil, decodeError(resp)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// wsMessage is a message on the UI WebSocket.
+type wsMessage struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// StreamVMStats subscribes to a VM's stats and yields them as the server
+// polls them, every interval or at the server's default cadence when
+// interval is 0. The server stops polling a VM that is not running, so the
+// sequence ends after yielding stats whose State is not DomainRunning. It
+// also ends when ctx is done, when the caller stops ranging, or after
+// yielding an error.
+//
+//	for stats, err := range c.StreamVMStats(ctx, "kvm-01", "web-1", 0) {
+//		if err != nil { ... }
+//		fmt.Println(stats.CpuTime)
+//	}
+func (c *Client) StreamVMStats(ctx context.Context, hostID, vmName string, interval time.Duration) iter.Seq2[VMStats, error] {
+	return func(yield func(VMStats, error) bool) {
+		// Updates name the host by ID, so a host given by name is looked up.
+		hostID, err := c.resolveHostID(ctx, hostID)
+		if err != nil {
+			yield(VMStats{}, err)
+			return
+		}
+		u := *c.baseURL
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/ws"
+		u.RawPath = ""
+		conn, err := c.dialWebSocket(ctx, &u)
+		if err != nil {
+			yield(VMStats{}, fmt.Errorf("failed to connect to the WebSocket: %w", err))
+			return
+		}
+		defer conn.Close()
+		// Closing the connection unblocks the read below once ctx is done.
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		defer stop()
+
+		subscribe := map[string]any{
+			"type":    "subscribe-vm-stats",
+			"payload": map[string]any{"hostId": hostID, "vmName": vmName, "intervalSeconds": interval.Seconds()},
+		}
+		if err := conn.WriteJSON(subscribe); err != nil {
+			yield(VMStats{}, fmt.Errorf("failed to subscribe to VM stats: %w", err))
+			return
+		}
+
+		for {
+			var msg wsMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				yield(VMStats{}, fmt.Errorf("VM stats stream ended: %w", err))
+				return
+			}
+			if msg.Type != "vm-stats-updated" {
+				continue
+			}
+			var update struct {
+				HostID string  `json:"hostId"`
+				VMName string  `json:"vmName"`
+				Stats  VMStats `json:"stats"`
+			}
+			if err := json.Unmarshal(msg.Payload, &update); err != nil {
+				yield(VMStats{}, fmt.Errorf("failed to decode VM stats: %w", err))
+				return
+			}
+			if update.HostID != hostID || update.VMName != vmName {
+				continue // Another subscriber's VM
+			}
+			if !yield(update.Stats, nil) || update.Stats.State != DomainRunning {
+				return
+			}
+		}
+	}
+}
+
+// resolveHostID returns the ID of a host given by ID or name.
+func (c *Client) resolveHostID(ctx context.Context, hostID string) (string, error) {
+	hosts, err := c.ListHosts(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, host := range hosts {
+		if host.ID == hostID {
+			return hostID, nil
+		}
+	}
+	for _, host := range hosts {
+		if host.Name == hostID {
+			return host.ID, nil
+		}
+	}
+	return hostID, nil
+}
+
+// DialConsole connects to the VNC console of a VM through the server's
+// console proxy. The connection carries the raw RFB protocol, ready for a
+// VNC client library. display selects one of several VNC displays by
+// index; -1 picks the first.
+func (c *Client) DialConsole(ctx context.Context, hostID, vmName string, display int) (net.Conn, error) {
+	u := c.endpoint("hosts", hostID, "vms", vmName, "console")
+	if display >= 0 {
+		u.RawQuery = url.Values{"display": {strconv.Itoa(display)}}.Encode()
+	}
+	conn, err := c.dialWebSocket(ctx, u, "binary")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the console of %s: %w", vmName, err)
+	}
+	return &consoleConn{Conn: conn}, nil
+}
+
+// consoleConn adapts a console WebSocket to a net.Conn, sending writes as
+// binary messages and reading messages as one byte stream.
+type consoleConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *consoleConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage && messageType != websocket.TextMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *consoleConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *consoleConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -16,6 +16,7 @@ export const useMainStore = defineStore('main', () => {
 
     const activeVmStats = ref(null);
     const activeVmHardware = ref(null);
+    const forecast = ref(null);
 
     const totalVms = computed(() => {
         return hosts.value.reduce((total, host) => total + (host.vms ? host.vms.length : 0), 0);
@@ -23,6 +24,16 @@ export const useMainStore = defineStore('main', () => {
 
     let ws = null;
 
+    // Errors come as { "error": "...", "libvirt": { ... } }.
+    const readError = async (response) => {
+        const text = await response.text();
+        try {
+            return JSON.parse(text).error || `HTTP error! status: ${response.status}`;
+        } catch {
+            return text || `HTTP error! status: ${response.status}`;
+        }
+    };
+
     // --- WebSocket Logic ---
 
     function sendMessage(type, payload) {
@@ -150,8 +161,7 @@ export const useMainStore = defineStore('main', () => {
                 body: JSON.stringify(hostData),
             });
             if (!response.ok) {
-                const errorText = await response.text();
-                throw new Error(errorText || `HTTP error! status: ${response.status}`);
+                throw new Error(await readError(response));
             }
             // The websocket will trigger a full refresh
         } catch (error) {
@@ -167,8 +177,7 @@ export const useMainStore = defineStore('main', () => {
         try {
             const response = await fetch(`/api/v1/hosts/${hostId}`, { method: 'DELETE' });
             if (!response.ok) {
-                const errorText = await response.text();
-                throw new Error(errorText || `HTTP error! status: ${response.status}`);
+                throw new Error(await readError(response));
             }
             if (selectedHostId.value === hostId) {
                 selectedHostId.value = null;
@@ -218,7 +227,8 @@ export const useMainStore = defineStore('main', () => {
         }
         isLoading.value.vmHardware = true;
         try {
-            const response = await fetch(`/api/v1/hosts/${hostId}/vms/${vmName}/hardware`);
+            // Opening a VM syncs it, so its hardware is current.
+            const response = await fetch(`/api/v1/hosts/${hostId}/vms/${vmName}/refresh`, { method: 'POST' });
             if (!response.ok) throw new Error(`HTTP error! status: ${response.status}`);
             activeVmHardware.value = await response.json();
         } catch (error) {
@@ -235,8 +245,7 @@ export const useMainStore = defineStore('main', () => {
         try {
             const response = await fetch(`/api/v1/hosts/${hostId}/vms/${vmName}/${action}`, { method: 'POST' });
             if (!response.ok) {
-                const errorText = await response.text();
-                throw new Error(errorText || `HTTP error! status: ${response.status}`);
+                throw new Error(await readError(response));
             }
             // The websocket will handle the UI update
         } catch (error) {
@@ -247,6 +256,21 @@ export const useMainStore = defineStore('main', () => {
         }
     };
 
+    // --- Forecasts ---
+
+    // Horizons are days, e.g. [7, 30, 90]; without them the server's settings apply.
+    const fetchForecast = async (horizons) => {
+        const query = horizons?.length ? `?horizons=${horizons.join(',')}` : '';
+        try {
+            const response = await fetch(`/api/v1/forecast${query}`);
+            if (!response.ok) throw new Error(await readError(response));
+            forecast.value = await response.json();
+        } catch (error) {
+            console.error("Error fetching forecast:", error);
+            forecast.value = null;
+        }
+    };
+
     const startVm = (hostId, vmName) => performVmAction(hostId, vmName, 'start');
     const gracefulShutdownVm = (hostId, vmName) => performVmAction(hostId, vmName, 'shutdown');
     const gracefulRebootVm = (hostId, vmName) => performVmAction(hostId, vmName, 'reboot');
@@ -260,6 +284,7 @@ export const useMainStore = defineStore('main', () => {
         isLoading,
         activeVmStats,
         activeVmHardware,
+        forecast,
         totalVms,
         initializeRealtime,
         fetchHosts,
@@ -267,6 +292,7 @@ export const useMainStore = defineStore('main', () => {
         deleteHost,
         selectHost,
         fetchVmHardware,
+        fetchForecast,
         startVm,
         gracefulShutdownVm,
         gracefulRebootVm,